@@ -0,0 +1,398 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/m1k1o/neko/server/internal/config"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/drm/mp4"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	command := &cobra.Command{
+		Use:   "drm",
+		Short: "inspect DRM protected recordings and manage keys",
+		Long:  `inspect DRM protected recordings and manage keys`,
+	}
+
+	whichKey := &cobra.Command{
+		Use:   "which-key",
+		Short: "find the key protecting a frame of a recording",
+		Long:  `find the key protecting a frame of a recording, keys are read from drm.keys of the config file or environment`,
+		Run:   drmWhichKeyCmd,
+		Args:  cobra.NoArgs,
+	}
+	whichKey.Flags().String("recording", "", "path to the fragmented mp4 recording")
+	whichKey.Flags().Duration("ts", 0, "decode time of the frame, e.g. 1m30.5s")
+	whichKey.Flags().String("manifest", "", "path to the sidecar manifest of the recording, the recording path with "+drm.ManifestSuffix+" appended when present")
+	_ = whichKey.MarkFlagRequired("recording")
+
+	genKeys := &cobra.Command{
+		Use:   "genkeys",
+		Short: "generate content keys for drm.keys",
+		Long:  `generate the current content key followed by keys pre-provisioned for future rotations, one drm.keys entry per line`,
+		Run:   drmGenKeysCmd,
+		Args:  cobra.NoArgs,
+	}
+	genKeys.Flags().Int("future", 0, "number of pre-provisioned keys")
+	genKeys.Flags().Duration("interval", 6*time.Hour, "time between rotations to the pre-provisioned keys")
+
+	genKey := &cobra.Command{
+		Use:   "genkey",
+		Short: "generate a content key, key ID and IV",
+		Long:  `generate a random content key, key ID and IV and print them as drm.key_id, drm.key and drm.iv, or write them to files for drm.key_id_file, drm.key_file and drm.iv_file`,
+		Run:   drmGenKeyCmd,
+		Args:  cobra.NoArgs,
+	}
+	genKey.Flags().String("format", "flags", "output format: flags, env, yaml or json")
+	genKey.Flags().String("mode", "", "drm.mode to print along with the key, cbcs, cenc, cens or cbc1")
+	genKey.Flags().String("out-dir", "", "directory to write the key_id, key and iv files to, printing the options reading them instead")
+	genKey.Flags().Bool("force", false, "overwrite existing key files in --out-dir")
+
+	verify := &cobra.Command{
+		Use:   "verify [flags] input.h264",
+		Short: "decrypt a captured stream and check it",
+		Long:  `decrypt a captured Annex B stream and report its NAL units, the slices whose headers parse after decryption, the parameter sets left clear and where the first corruption occurs; keys of a manifest are read from drm.keys of the config file or environment too`,
+		Run:   drmVerifyCmd,
+		Args:  cobra.ExactArgs(1),
+	}
+	verify.Flags().String("key", "", "hex encoded content key")
+	verify.Flags().String("key-id", "", "hex encoded key ID, the KeySEI is checked against it")
+	verify.Flags().String("iv", "", "hex encoded IV")
+	verify.Flags().String("iv-nonce", "", "hex encoded nonce of the per-sample IVs of cenc, cens and cbc1, none when empty")
+	verify.Flags().String("mode", "cbcs", "encryption scheme: cbcs, cenc, cens or cbc1")
+	verify.Flags().String("pattern", "", "crypt:skip pattern of cbcs and cens, 1:9 when empty")
+	verify.Flags().String("codec", drm.CodecH264, "video codec of the stream: h264 or h265")
+	verify.Flags().String("manifest", "", "path to the sidecar manifest naming the protection of every access unit instead of --mode, --pattern and --iv, the input path with "+drm.ManifestSuffix+" appended when present")
+	verify.Flags().String("out", "", "path to write the decrypted stream to, e.g. for ffprobe")
+
+	command.AddCommand(whichKey)
+	command.AddCommand(verify)
+	command.AddCommand(genKeys)
+	command.AddCommand(genKey)
+	root.AddCommand(command)
+}
+
+func drmWhichKeyCmd(cmd *cobra.Command, args []string) {
+	path, _ := cmd.Flags().GetString("recording")
+	ts, _ := cmd.Flags().GetDuration("ts")
+
+	recording, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to read recording")
+	}
+
+	var keys []drm.Key
+
+	drmConfig := config.DRM{}
+	drmConfig.Set()
+	provider, err := drmConfig.KeyProvider()
+	if err == nil {
+		keys, err = provider.GetKeys(context.Background())
+	}
+	if err != nil {
+		// the KID is still found in the recording
+		log.Warn().Err(err).Msg("unable to load keys, generation is unknown")
+	}
+
+	manifestPath, _ := cmd.Flags().GetString("manifest")
+	if manifestPath == "" {
+		if _, err := os.Stat(path + drm.ManifestSuffix); err == nil {
+			manifestPath = path + drm.ManifestSuffix
+		}
+	}
+
+	var usage mp4.KeyUsage
+	if manifestPath == "" {
+		usage, err = mp4.WhichKey(recording, ts, keys)
+	} else {
+		var manifest drm.Manifest
+		if manifest, err = drm.ReadManifest(manifestPath); err != nil {
+			log.Fatal().Err(err).Str("manifest", manifestPath).Msg("unable to read manifest")
+		}
+		usage, err = mp4.WhichKeyManifest(recording, ts, keys, manifest)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("recording", path).Dur("ts", ts).Msg("unable to find key")
+	}
+
+	type subsample struct {
+		ClearBytes     uint32 `json:"clear_bytes"`
+		ProtectedBytes uint32 `json:"protected_bytes"`
+	}
+
+	out := struct {
+		KeyID      string      `json:"key_id"`
+		Generation *uint64     `json:"generation"`
+		DecodeTime string      `json:"decode_time"`
+		ValidFrom  string      `json:"valid_from"`
+		ValidTo    string      `json:"valid_to"`
+		Subsamples []subsample `json:"subsamples"`
+	}{
+		KeyID:      usage.KeyID,
+		DecodeTime: usage.DecodeTime.String(),
+		ValidFrom:  usage.ValidFrom.String(),
+		ValidTo:    usage.ValidTo.String(),
+		Subsamples: []subsample{},
+	}
+
+	if usage.Known {
+		out.Generation = &usage.Generation
+	}
+	for _, s := range usage.Subsamples {
+		out.Subsamples = append(out.Subsamples, subsample{
+			ClearBytes:     s.BytesOfClearData,
+			ProtectedBytes: s.BytesOfProtectedData,
+		})
+	}
+
+	// marshal indent to stdout
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.Fatal().Err(err).Msg("unable to marshal key usage")
+	}
+}
+
+func drmVerifyCmd(cmd *cobra.Command, args []string) {
+	path := args[0]
+	key, _ := cmd.Flags().GetString("key")
+	keyID, _ := cmd.Flags().GetString("key-id")
+	iv, _ := cmd.Flags().GetString("iv")
+	ivNonce, _ := cmd.Flags().GetString("iv-nonce")
+	mode, _ := cmd.Flags().GetString("mode")
+	pattern, _ := cmd.Flags().GetString("pattern")
+	codec, _ := cmd.Flags().GetString("codec")
+	outPath, _ := cmd.Flags().GetString("out")
+
+	stream, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to read stream")
+	}
+	if len(stream) >= 8 && string(stream[4:8]) == "ftyp" {
+		log.Fatal().Str("input", path).Msg("input is an mp4 recording, verify takes an Annex B stream, see which-key for recordings")
+	}
+
+	opts := drm.VerifyOptions{
+		Config: drm.Config{
+			Mode:    mode,
+			Codec:   codec,
+			KeyID:   keyID,
+			Key:     key,
+			IV:      iv,
+			IVNonce: ivNonce,
+		},
+	}
+	if pattern != "" {
+		p, err := drm.ParsePattern(pattern)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid pattern")
+		}
+		opts.Config.CryptBlocks, opts.Config.SkipBlocks = p.CryptBlocks, p.SkipBlocks
+	}
+
+	manifestPath, _ := cmd.Flags().GetString("manifest")
+	if manifestPath == "" {
+		if _, err := os.Stat(path + drm.ManifestSuffix); err == nil {
+			manifestPath = path + drm.ManifestSuffix
+		}
+	}
+
+	if manifestPath != "" {
+		manifest, err := drm.ReadManifest(manifestPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("manifest", manifestPath).Msg("unable to read manifest")
+		}
+		opts.Manifest = &manifest
+
+		// the periods after a rotation need keys of their own
+		drmConfig := config.DRM{}
+		drmConfig.Set()
+		provider, err := drmConfig.KeyProvider()
+		if err == nil {
+			opts.Keys, err = provider.GetKeys(context.Background())
+		}
+		if err != nil && key == "" {
+			log.Warn().Err(err).Msg("unable to load keys")
+		}
+	} else if key == "" || iv == "" {
+		log.Fatal().Msg("--key and --iv are required without a manifest")
+	}
+
+	report, decrypted, err := drm.Verify(stream, opts)
+	if err != nil {
+		log.Fatal().Err(err).Str("input", path).Msg("unable to verify stream")
+	}
+
+	if outPath != "" {
+		if err := os.WriteFile(outPath, decrypted, 0600); err != nil {
+			log.Fatal().Err(err).Str("out", outPath).Msg("unable to write decrypted stream")
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatal().Err(err).Msg("unable to marshal report")
+	}
+
+	// scripts tell a broken stream by the exit code
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func drmGenKeysCmd(cmd *cobra.Command, args []string) {
+	future, _ := cmd.Flags().GetInt("future")
+	interval, _ := cmd.Flags().GetDuration("interval")
+
+	if future < 0 || (future > 0 && interval <= 0) {
+		log.Fatal().Int("future", future).Dur("interval", interval).Msg("future keys need a positive count and interval")
+	}
+
+	random := func() string {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatal().Err(err).Msg("unable to generate key")
+		}
+		return hex.EncodeToString(b)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i <= future; i++ {
+		entry := random() + ":" + random() + ":" + random()
+		if i > 0 {
+			entry += "@" + now.Add(time.Duration(i)*interval).Format(time.RFC3339)
+		}
+		fmt.Println(entry)
+	}
+}
+
+// drmSetting is a config option printed by genkey
+type drmSetting struct {
+	key   string // without the drm. prefix
+	value string
+}
+
+func drmGenKeyCmd(cmd *cobra.Command, args []string) {
+	format, _ := cmd.Flags().GetString("format")
+	mode, _ := cmd.Flags().GetString("mode")
+	outDir, _ := cmd.Flags().GetString("out-dir")
+	force, _ := cmd.Flags().GetBool("force")
+
+	switch format {
+	case "flags", "env", "yaml", "json":
+	default:
+		log.Fatal().Str("format", format).Msg("format must be flags, env, yaml or json")
+	}
+	if mode != "" && !drm.ValidScheme(mode) {
+		log.Fatal().Str("mode", mode).Msg("mode must be cbcs, cenc, cens or cbc1")
+	}
+
+	var settings []drmSetting
+	if mode != "" {
+		settings = append(settings, drmSetting{"mode", mode})
+	}
+
+	names := []string{"key_id", "key", "iv"}
+
+	// nothing is written unless all files can be
+	if outDir != "" && !force {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(outDir, name)); err == nil {
+				log.Fatal().Str("path", filepath.Join(outDir, name)).Msg("key file exists, use --force to overwrite it")
+			}
+		}
+	}
+
+	for _, name := range names {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatal().Err(err).Msg("unable to generate key")
+		}
+		value := hex.EncodeToString(b)
+
+		if outDir == "" {
+			settings = append(settings, drmSetting{name, value})
+			continue
+		}
+
+		path, err := filepath.Abs(filepath.Join(outDir, name))
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to resolve key file")
+		}
+		if err := writeKeyFile(path, value, force); err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("unable to write key file")
+		}
+		settings = append(settings, drmSetting{name + "_file", path})
+	}
+
+	switch format {
+	case "flags":
+		lines := make([]string, len(settings))
+		for i, setting := range settings {
+			lines[i] = "--drm." + setting.key + "=" + setting.value
+		}
+		fmt.Println(strings.Join(lines, " \\\n"))
+	case "env":
+		for _, setting := range settings {
+			fmt.Println("NEKO_DRM_" + strings.ToUpper(setting.key) + "=" + setting.value)
+		}
+	case "yaml":
+		fmt.Println("drm:")
+		for _, setting := range settings {
+			// quoted, a key ID of digits only would be a number
+			fmt.Printf("  %s: %q\n", setting.key, setting.value)
+		}
+	case "json":
+		values := map[string]string{}
+		for _, setting := range settings {
+			values[setting.key] = setting.value
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]any{"drm": values}); err != nil {
+			log.Fatal().Err(err).Msg("unable to marshal key")
+		}
+	}
+}
+
+// writeKeyFile writes hex encoded key material readable by the owner only,
+// an existing file is only replaced with force
+func writeKeyFile(path, value string, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s exists, use --force to overwrite it", path)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// an overwritten file keeps its permissions otherwise
+	if err := file.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := file.WriteString(value + "\n"); err != nil {
+		return err
+	}
+	return file.Close()
+}
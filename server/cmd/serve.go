@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/signal"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -13,6 +14,7 @@ import (
 	"github.com/m1k1o/neko/server/internal/capture"
 	"github.com/m1k1o/neko/server/internal/config"
 	"github.com/m1k1o/neko/server/internal/desktop"
+	"github.com/m1k1o/neko/server/internal/drm"
 	"github.com/m1k1o/neko/server/internal/http"
 	"github.com/m1k1o/neko/server/internal/member"
 	"github.com/m1k1o/neko/server/internal/plugins"
@@ -45,6 +47,7 @@ type serve struct {
 	configs struct {
 		Desktop config.Desktop
 		Capture config.Capture
+		DRM     config.DRM
 		WebRTC  config.WebRTC
 		Member  config.Member
 		Session config.Session
@@ -55,6 +58,7 @@ type serve struct {
 	managers struct {
 		desktop   *desktop.DesktopManagerCtx
 		capture   *capture.CaptureManagerCtx
+		drm       *drm.DRMManagerCtx
 		webRTC    *webrtc.WebRTCManagerCtx
 		member    *member.MemberManagerCtx
 		session   *session.SessionManagerCtx
@@ -72,6 +76,9 @@ func (c *serve) Init(cmd *cobra.Command) error {
 	if err := c.configs.Capture.Init(cmd); err != nil {
 		return err
 	}
+	if err := c.configs.DRM.Init(cmd); err != nil {
+		return err
+	}
 	if err := c.configs.WebRTC.Init(cmd); err != nil {
 		return err
 	}
@@ -118,6 +125,7 @@ func (c *serve) PreRun(cmd *cobra.Command, args []string) {
 
 	c.configs.Desktop.Set()
 	c.configs.Capture.Set()
+	c.configs.DRM.Set()
 	c.configs.WebRTC.Set()
 	c.configs.Member.Set()
 	c.configs.Session.Set()
@@ -160,9 +168,16 @@ func (c *serve) Start(cmd *cobra.Command) {
 	)
 	c.managers.capture.Start()
 
+	c.managers.drm = drm.New(
+		c.managers.session,
+		&c.configs.DRM,
+	)
+	c.managers.drm.Start()
+
 	c.managers.webRTC = webrtc.New(
 		c.managers.desktop,
 		c.managers.capture,
+		c.managers.drm,
 		&c.configs.WebRTC,
 	)
 	c.managers.webRTC.Start()
@@ -172,6 +187,7 @@ func (c *serve) Start(cmd *cobra.Command) {
 		c.managers.desktop,
 		c.managers.capture,
 		c.managers.webRTC,
+		c.managers.drm,
 	)
 	c.managers.webSocket.Start()
 
@@ -180,6 +196,7 @@ func (c *serve) Start(cmd *cobra.Command) {
 		c.managers.member,
 		c.managers.desktop,
 		c.managers.capture,
+		c.managers.drm,
 	)
 
 	c.managers.plugins = plugins.New(
@@ -203,6 +220,25 @@ func (c *serve) Start(cmd *cobra.Command) {
 		&c.configs.Server,
 	)
 	c.managers.http.Start()
+
+	// a new drm key takes effect without a restart
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(c.reloadConfig)
+		viper.WatchConfig()
+	}
+}
+
+// reloadConfig applies the drm options of the changed config file, the
+// other options are read at startup only
+func (c *serve) reloadConfig(event fsnotify.Event) {
+	var drmConfig config.DRM
+	drmConfig.Set()
+
+	if err := c.managers.drm.Reload(&drmConfig); err != nil {
+		c.logger.Error().Err(err).
+			Str("file", event.Name).
+			Msg("drm configuration was not reloaded, the previous key stays in use")
+	}
 }
 
 func (c *serve) Shutdown() {
@@ -220,6 +256,9 @@ func (c *serve) Shutdown() {
 	err = c.managers.webRTC.Shutdown()
 	c.logger.Err(err).Msg("webrtc manager shutdown")
 
+	err = c.managers.drm.Shutdown()
+	c.logger.Err(err).Msg("drm manager shutdown")
+
 	err = c.managers.capture.Shutdown()
 	c.logger.Err(err).Msg("capture manager shutdown")
 
@@ -0,0 +1,80 @@
+package drm
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+// ClearKeyRequest is the license request of a ClearKey CDM, key IDs are
+// base64url encoded
+type ClearKeyRequest struct {
+	KeyIDs []string `json:"kids"`
+	Type   string   `json:"type"`
+}
+
+// ClearKeyJWK is a content key as JSON Web Key
+type ClearKeyJWK struct {
+	Kty   string `json:"kty"`
+	KeyID string `json:"kid"`
+	K     string `json:"k"`
+}
+
+type ClearKeyLicense struct {
+	Keys []ClearKeyJWK `json:"keys"`
+	Type string        `json:"type,omitempty"`
+}
+
+// clearKey answers W3C ClearKey license requests with the content keys of
+// the requested key IDs, only when explicitly enabled in the config
+func (h *DRMHandler) clearKey(w http.ResponseWriter, r *http.Request) error {
+	if !h.drm.ClearKeyEndpoint() {
+		return utils.HttpNotFound("drm clearkey endpoint is disabled")
+	}
+
+	data := &ClearKeyRequest{}
+	if err := utils.HttpJsonRequest(w, r, data); err != nil {
+		return err
+	}
+
+	keyIDs := make([][]byte, 0, len(data.KeyIDs))
+	for _, kid := range data.KeyIDs {
+		keyID, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(kid, "="))
+		if err != nil || len(keyID) != 16 {
+			return utils.HttpBadRequest("kids must be 16 bytes base64url encoded")
+		}
+		keyIDs = append(keyIDs, keyID)
+	}
+
+	keys, err := h.drm.ClearKeys(sessionID(r), keyIDs)
+	switch {
+	case err == nil:
+	case errors.Is(err, types.ErrDRMDisabled):
+		return utils.HttpUnprocessableEntity(err.Error())
+	default:
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	if len(keys) == 0 {
+		return utils.HttpNotFound("no content key for the requested key IDs")
+	}
+
+	license := ClearKeyLicense{
+		Keys: make([]ClearKeyJWK, 0, len(keys)),
+		Type: data.Type,
+	}
+	for _, key := range keys {
+		license.Keys = append(license.Keys, ClearKeyJWK{
+			Kty:   "oct",
+			KeyID: base64.RawURLEncoding.EncodeToString(key.KeyID),
+			K:     base64.RawURLEncoding.EncodeToString(key.Key),
+		})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return utils.HttpSuccess(w, license)
+}
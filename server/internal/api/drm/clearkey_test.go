@@ -0,0 +1,106 @@
+package drm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+func TestDRMHandler_clearKey(t *testing.T) {
+	keys := []types.DRMClearKey{{
+		KeyID: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		Key:   []byte{0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c},
+	}}
+	watcher := &dummySession{profile: types.MemberProfile{CanWatch: true}}
+
+	tests := []struct {
+		name     string
+		disabled bool
+		session  types.Session
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "no session",
+			body:     `{"kids":["AAAAAAAAAAAAAAAAAAAAAQ"],"type":"temporary"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "not allowed to watch",
+			session:  &dummySession{},
+			body:     `{"kids":["AAAAAAAAAAAAAAAAAAAAAQ"],"type":"temporary"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "endpoint disabled",
+			disabled: true,
+			session:  watcher,
+			body:     `{"kids":["AAAAAAAAAAAAAAAAAAAAAQ"],"type":"temporary"}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "license",
+			session:  watcher,
+			body:     `{"kids":["AAAAAAAAAAAAAAAAAAAAAQ"],"type":"temporary"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"keys":[{"kty":"oct","kid":"AAAAAAAAAAAAAAAAAAAAAQ","k":"PDw8PDw8PDw8PDw8PDw8PA"}],"type":"temporary"}`,
+		},
+		{
+			name:     "padded key ID",
+			session:  watcher,
+			body:     `{"kids":["AAAAAAAAAAAAAAAAAAAAAQ=="]}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"keys":[{"kty":"oct","kid":"AAAAAAAAAAAAAAAAAAAAAQ","k":"PDw8PDw8PDw8PDw8PDw8PA"}]}`,
+		},
+		{
+			name:     "other key ID",
+			session:  watcher,
+			body:     `{"kids":["AAAAAAAAAAAAAAAAAAAAAg"]}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "malformed key ID",
+			session:  watcher,
+			body:     `{"kids":["AAAA"]}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newDummyRouter()
+			New(&dummyManager{enabled: true, clearKey: !tt.disabled, clearKeys: keys}).Route(router)
+
+			r := httptest.NewRequest(http.MethodPost, "/clearkey", strings.NewReader(tt.body))
+			if tt.session != nil {
+				r = r.WithContext(auth.SetSession(r, tt.session))
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("POST /clearkey code = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantBody == "" {
+				return
+			}
+
+			var got, want any
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("POST /clearkey returned invalid JSON: %s", err)
+			}
+			json.Unmarshal([]byte(tt.wantBody), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("POST /clearkey = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package drm
+
+import (
+	"embed"
+	"net/http"
+
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+//go:embed debug
+var debugAssets embed.FS
+
+// debugPage serves a self-contained ClearKey test player, only when
+// explicitly enabled in the config
+func (h *DRMHandler) debugPage(w http.ResponseWriter, r *http.Request) error {
+	if !h.drm.DebugPage() {
+		return utils.HttpNotFound("drm debug page is disabled")
+	}
+
+	page, err := debugAssets.ReadFile("debug/index.html")
+	if err != nil {
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, err = w.Write(page)
+	return err
+}
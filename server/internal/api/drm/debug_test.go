@@ -0,0 +1,153 @@
+package drm
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+type dummySession struct {
+	types.Session
+	id      string
+	profile types.MemberProfile
+}
+
+func (s *dummySession) ID() string                   { return s.id }
+func (s *dummySession) Profile() types.MemberProfile { return s.profile }
+
+// dummyRouter is a flat router running middlewares in registration order
+type dummyRouter struct {
+	prefix      string
+	middlewares []types.MiddlewareHandler
+	routes      map[string]types.RouterHandler
+	chains      map[string][]types.MiddlewareHandler
+}
+
+func newDummyRouter() *dummyRouter {
+	return &dummyRouter{
+		routes: map[string]types.RouterHandler{},
+		chains: map[string][]types.MiddlewareHandler{},
+	}
+}
+
+func (r *dummyRouter) sub(prefix string, mw ...types.MiddlewareHandler) *dummyRouter {
+	return &dummyRouter{
+		prefix:      r.prefix + prefix,
+		middlewares: append(append([]types.MiddlewareHandler{}, r.middlewares...), mw...),
+		routes:      r.routes,
+		chains:      r.chains,
+	}
+}
+
+func (r *dummyRouter) handle(method, pattern string, fn types.RouterHandler) {
+	key := method + " " + strings.TrimSuffix(r.prefix+pattern, "/")
+	r.routes[key] = fn
+	r.chains[key] = r.middlewares
+}
+
+func (r *dummyRouter) Group(fn func(types.Router))                  { fn(r.sub("")) }
+func (r *dummyRouter) Route(p string, fn func(types.Router))        { fn(r.sub(p)) }
+func (r *dummyRouter) Get(p string, fn types.RouterHandler)         { r.handle(http.MethodGet, p, fn) }
+func (r *dummyRouter) Post(p string, fn types.RouterHandler)        { r.handle(http.MethodPost, p, fn) }
+func (r *dummyRouter) Put(p string, fn types.RouterHandler)         { r.handle(http.MethodPut, p, fn) }
+func (r *dummyRouter) Patch(p string, fn types.RouterHandler)       { r.handle(http.MethodPatch, p, fn) }
+func (r *dummyRouter) Delete(p string, fn types.RouterHandler)      { r.handle(http.MethodDelete, p, fn) }
+func (r *dummyRouter) With(fn types.MiddlewareHandler) types.Router { return r.sub("", fn) }
+func (r *dummyRouter) Use(fn types.MiddlewareHandler)               { r.middlewares = append(r.middlewares, fn) }
+
+func (r *dummyRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := req.Method + " " + strings.TrimSuffix(req.URL.Path, "/")
+
+	fn, ok := r.routes[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := func() error {
+		for _, mw := range r.chains[key] {
+			ctx, err := mw(w, req)
+			if err != nil {
+				return err
+			}
+			if ctx != nil {
+				req = req.WithContext(ctx)
+			}
+		}
+		return fn(w, req)
+	}()
+
+	if err != nil {
+		var httpErr *utils.HTTPError
+		if !errors.As(err, &httpErr) {
+			httpErr = utils.HttpInternalServerError()
+		}
+		w.WriteHeader(httpErr.Code)
+	}
+}
+
+func TestDRMHandler_debugPage(t *testing.T) {
+	tests := []struct {
+		name      string
+		debugPage bool
+		session   types.Session
+		wantCode  int
+	}{
+		{
+			name:      "no session",
+			debugPage: true,
+			wantCode:  http.StatusForbidden,
+		},
+		{
+			name:      "not admin",
+			debugPage: true,
+			session:   &dummySession{profile: types.MemberProfile{CanWatch: true}},
+			wantCode:  http.StatusForbidden,
+		},
+		{
+			name:     "admin but disabled",
+			session:  &dummySession{profile: types.MemberProfile{IsAdmin: true}},
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:      "admin",
+			debugPage: true,
+			session:   &dummySession{profile: types.MemberProfile{IsAdmin: true}},
+			wantCode:  http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newDummyRouter()
+			New(&dummyManager{enabled: true, debugPage: tt.debugPage}).Route(router)
+
+			r := httptest.NewRequest(http.MethodGet, "/debug", nil)
+			if tt.session != nil {
+				r = r.WithContext(auth.SetSession(r, tt.session))
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("GET /debug code = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if tt.wantCode == http.StatusOK {
+				if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+					t.Errorf("GET /debug Content-Type = %s, want text/html", ct)
+				}
+				if !strings.Contains(w.Body.String(), "neko DRM debug player") {
+					t.Errorf("GET /debug did not serve the debug page")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package drm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+// TestDRMHandler_disabledContract asserts every DRM endpoint in both states,
+// new endpoints must add themselves here. Disabled drm registers no viewer
+// endpoints and admin endpoints report it with 422 rather than empty data.
+func TestDRMHandler_disabledContract(t *testing.T) {
+	tests := []struct {
+		method       string
+		path         string
+		body         string
+		wantEnabled  int
+		wantDisabled int
+	}{
+		{
+			method:       http.MethodGet,
+			path:         "/",
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusOK,
+		},
+		{
+			method:       http.MethodPost,
+			path:         "/rotate",
+			body:         `{}`,
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusUnprocessableEntity,
+		},
+		{
+			method:       http.MethodPut,
+			path:         "/keys",
+			body:         `{"key_id":"AAECAwQFBgcICQoLDA0ODw==","key":"EBESExQVFhcYGRobHB0eHw==","iv":"ICEiIyQlJicoKSorLC0uLw=="}`,
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusUnprocessableEntity,
+		},
+		{
+			method:       http.MethodGet,
+			path:         "/profile",
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusUnprocessableEntity,
+		},
+		{
+			method:       http.MethodPost,
+			path:         "/profile",
+			body:         `{"mode":"cbcs"}`,
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusUnprocessableEntity,
+		},
+		{
+			method:       http.MethodPost,
+			path:         "/key/export",
+			body:         `{"password":"secret","public_key":""}`,
+			wantEnabled:  http.StatusBadRequest,
+			wantDisabled: http.StatusUnprocessableEntity,
+		},
+		{
+			method:       http.MethodGet,
+			path:         "/initdata",
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusNotFound,
+		},
+		{
+			method:       http.MethodPost,
+			path:         "/clearkey",
+			body:         `{"kids":["AAAAAAAAAAAAAAAAAAAAAQ"],"type":"temporary"}`,
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusNotFound,
+		},
+		{
+			method:       http.MethodGet,
+			path:         "/info",
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusNotFound,
+		},
+		{
+			method:       http.MethodGet,
+			path:         "/capabilities",
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusUnprocessableEntity,
+		},
+		{
+			method:       http.MethodGet,
+			path:         "/debug",
+			wantEnabled:  http.StatusOK,
+			wantDisabled: http.StatusNotFound,
+		},
+	}
+
+	admin := &dummySession{profile: types.MemberProfile{IsAdmin: true, CanWatch: true}}
+	keys := []types.DRMClearKey{{
+		KeyID: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		Key:   []byte{0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c, 0x3c},
+	}}
+
+	for _, enabled := range []bool{true, false} {
+		router := newDummyRouter()
+		New(&dummyManager{enabled: enabled, debugPage: true, clearKey: true, clearKeys: keys}).Route(router)
+
+		for _, tt := range tests {
+			want := tt.wantDisabled
+			if enabled {
+				want = tt.wantEnabled
+			}
+
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r = r.WithContext(auth.SetSession(r, admin))
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != want {
+				t.Errorf("enabled=%v: %s %s code = %d, want %d", enabled, tt.method, tt.path, w.Code, want)
+			}
+		}
+	}
+}
+
+// TestDRMHandler_disabledByReload asserts endpoints registered while drm was
+// enabled stop serving once a reload disables it
+func TestDRMHandler_disabledByReload(t *testing.T) {
+	manager := &dummyManager{enabled: true, debugPage: true, clearKey: true}
+	router := newDummyRouter()
+	New(manager).Route(router)
+
+	manager.enabled = false
+
+	admin := &dummySession{profile: types.MemberProfile{IsAdmin: true, CanWatch: true}}
+	for _, path := range []string{"/initdata", "/info", "/debug"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r = r.WithContext(auth.SetSession(r, admin))
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s code = %d after disabling, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
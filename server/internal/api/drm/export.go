@@ -0,0 +1,85 @@
+package drm
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+type KeyExportPayload struct {
+	Password  string `json:"password"`
+	PublicKey string `json:"public_key"` // PEM encoded RSA public key
+}
+
+// keyExport is the break-glass path for recovering recordings, it returns
+// the current content key encrypted under the public key of the caller
+func (h *DRMHandler) keyExport(w http.ResponseWriter, r *http.Request) error {
+	if !h.drm.Enabled() {
+		return errDisabled()
+	}
+
+	data := &KeyExportPayload{}
+	if err := utils.HttpJsonRequest(w, r, data); err != nil {
+		return err
+	}
+
+	publicKey, err := parsePublicKey(data.PublicKey)
+	if err != nil {
+		return utils.HttpBadRequest(err.Error())
+	}
+
+	actor := "unknown"
+	if session, ok := auth.GetSession(r); ok {
+		actor = session.ID()
+	}
+
+	export, err := h.drm.ExportKey(actor, data.Password, publicKey)
+	switch {
+	case err == nil:
+	case errors.Is(err, types.ErrDRMDisabled), errors.Is(err, types.ErrDRMUnsupported), errors.Is(err, drm.ErrKeyExportDisabled):
+		return utils.HttpUnprocessableEntity(err.Error())
+	case errors.Is(err, drm.ErrKeyExportDenied):
+		return utils.HttpForbidden(err.Error())
+	case errors.Is(err, drm.ErrKeyExportRateLimited):
+		return utils.HttpError(http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, drm.ErrKeyExportPublicKey):
+		return utils.HttpBadRequest(err.Error())
+	default:
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return utils.HttpSuccess(w, export)
+}
+
+// parsePublicKey accepts PKIX ("PUBLIC KEY") and PKCS #1 ("RSA PUBLIC KEY")
+// encoded RSA public keys
+func parsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("public_key must be PEM encoded")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public_key must be an RSA key")
+	}
+
+	return publicKey, nil
+}
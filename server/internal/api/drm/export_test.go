@@ -0,0 +1,112 @@
+package drm
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+func TestDRMHandler_keyExport(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() returned error: %s", err)
+	}
+
+	pkix, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() returned error: %s", err)
+	}
+
+	pkixPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+	pkcs1PEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&priv.PublicKey)}))
+
+	admin := &dummySession{id: "admin", profile: types.MemberProfile{IsAdmin: true}}
+
+	tests := []struct {
+		name      string
+		session   types.Session
+		publicKey string
+		err       error
+		wantCode  int
+	}{
+		{
+			name:      "not admin",
+			session:   &dummySession{profile: types.MemberProfile{CanWatch: true}},
+			publicKey: pkixPEM,
+			wantCode:  http.StatusForbidden,
+		},
+		{
+			name:      "pkix public key",
+			session:   admin,
+			publicKey: pkixPEM,
+			wantCode:  http.StatusOK,
+		},
+		{
+			name:      "pkcs1 public key",
+			session:   admin,
+			publicKey: pkcs1PEM,
+			wantCode:  http.StatusOK,
+		},
+		{
+			name:      "not pem",
+			session:   admin,
+			publicKey: "ssh-rsa AAAA",
+			wantCode:  http.StatusBadRequest,
+		},
+		{
+			name:      "export disabled",
+			session:   admin,
+			publicKey: pkixPEM,
+			err:       drm.ErrKeyExportDisabled,
+			wantCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "wrong password",
+			session:   admin,
+			publicKey: pkixPEM,
+			err:       drm.ErrKeyExportDenied,
+			wantCode:  http.StatusForbidden,
+		},
+		{
+			name:      "rate limited",
+			session:   admin,
+			publicKey: pkixPEM,
+			err:       fmt.Errorf("%w: next export possible in 1h0m0s", drm.ErrKeyExportRateLimited),
+			wantCode:  http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &dummyManager{enabled: true, err: tt.err}
+			router := newDummyRouter()
+			New(manager).Route(router)
+
+			body, _ := json.Marshal(KeyExportPayload{Password: "secret", PublicKey: tt.publicKey})
+			r := httptest.NewRequest(http.MethodPost, "/key/export", strings.NewReader(string(body)))
+			r = r.WithContext(auth.SetSession(r, tt.session))
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("POST /key/export code = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if tt.wantCode == http.StatusOK && (manager.exportKey == nil || !manager.exportKey.Equal(&priv.PublicKey)) {
+				t.Errorf("POST /key/export did not pass the public key")
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package drm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+type DRMHandler struct {
+	drm types.DRMManager
+}
+
+func New(
+	drm types.DRMManager,
+) *DRMHandler {
+	return &DRMHandler{
+		drm: drm,
+	}
+}
+
+// Route registers the admin endpoints, which report a disabled drm as
+// such, and the rest, which answer 404 while drm is disabled. Enabled is
+// checked on every request, a reload can switch it.
+func (h *DRMHandler) Route(r types.Router) {
+	r.With(auth.AdminsOnly).Get("/", h.status)
+	r.With(auth.AdminsOnly).Post("/rotate", h.keyRotate)
+	r.With(auth.AdminsOnly).Put("/keys", h.keyPush)
+	r.With(auth.AdminsOnly).Route("/profile", func(r types.Router) {
+		r.Get("/", h.profileGet)
+		r.Post("/", h.profileApply)
+	})
+	r.With(auth.AdminsOnly).Post("/key/export", h.keyExport)
+	r.With(auth.AdminsOnly).Get("/capabilities", h.capabilities)
+
+	// only sessions allowed to watch are entitled to the keys
+	r.With(h.enabledOnly).With(auth.CanWatchOnly).Get("/initdata", h.initData)
+	r.With(h.enabledOnly).With(auth.CanWatchOnly).Get("/info", h.info)
+	r.With(h.enabledOnly).With(auth.CanWatchOnly).Post("/clearkey", h.clearKey)
+	r.With(h.enabledOnly).With(auth.AdminsOnly).Get("/debug", h.debugPage)
+}
+
+// enabledOnly hides the endpoints that exist only while drm is enabled
+func (h *DRMHandler) enabledOnly(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	if !h.drm.Enabled() {
+		return nil, utils.HttpNotFound(types.ErrDRMDisabled.Error())
+	}
+
+	return nil, nil
+}
+
+// sessionID returns the ID of the session of a request, empty without one
+func sessionID(r *http.Request) string {
+	session, ok := auth.GetSession(r)
+	if !ok {
+		return ""
+	}
+	return session.ID()
+}
+
+// errDisabled is returned by admin endpoints while drm is disabled, so the
+// state is never mistaken for an empty configuration
+func errDisabled() error {
+	return utils.HttpUnprocessableEntity(types.ErrDRMDisabled.Error())
+}
+
+type ProfileStatusPayload struct {
+	Profile types.DRMProfile  `json:"profile"`
+	Pending *types.DRMProfile `json:"pending,omitempty"`
+}
+
+func (h *DRMHandler) profileStatus() ProfileStatusPayload {
+	payload := ProfileStatusPayload{
+		Profile: h.drm.Profile(),
+	}
+
+	if pending, ok := h.drm.PendingProfile(); ok {
+		payload.Pending = &pending
+		payload.Pending.Key = ""
+	}
+
+	// key material is never sent back
+	payload.Profile.Key = ""
+	return payload
+}
+
+func (h *DRMHandler) profileGet(w http.ResponseWriter, r *http.Request) error {
+	if !h.drm.Enabled() {
+		return errDisabled()
+	}
+
+	return utils.HttpSuccess(w, h.profileStatus())
+}
+
+func (h *DRMHandler) capabilities(w http.ResponseWriter, r *http.Request) error {
+	if !h.drm.Enabled() {
+		return errDisabled()
+	}
+
+	capabilities, err := h.drm.Capabilities()
+	if err != nil {
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	return utils.HttpSuccess(w, capabilities)
+}
+
+// info serves the DRM setup of the session for the client configuration
+func (h *DRMHandler) info(w http.ResponseWriter, r *http.Request) error {
+	info, err := h.drm.Info(sessionID(r))
+	if err != nil {
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	return utils.HttpSuccess(w, info)
+}
+
+func (h *DRMHandler) profileApply(w http.ResponseWriter, r *http.Request) error {
+	if !h.drm.Enabled() {
+		return errDisabled()
+	}
+
+	data := &types.DRMProfile{}
+	if err := utils.HttpJsonRequest(w, r, data); err != nil {
+		return err
+	}
+
+	err := h.drm.ApplyProfile(*data)
+	switch {
+	case err == nil:
+		// profile is staged and applied at the next keyframe
+	case errors.Is(err, types.ErrDRMDisabled), errors.Is(err, types.ErrDRMUnsupported), errors.Is(err, drm.ErrActivationPast):
+		return utils.HttpUnprocessableEntity(err.Error())
+	case errors.Is(err, drm.ErrInvalidProfile):
+		return utils.HttpBadRequest(err.Error())
+	case errors.Is(err, drm.ErrProfilePending):
+		return utils.HttpError(http.StatusConflict, err.Error())
+	default:
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	return utils.HttpSuccess(w, h.profileStatus())
+}
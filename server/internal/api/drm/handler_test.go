@@ -0,0 +1,245 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+type dummyManager struct {
+	enabled   bool
+	debugPage bool
+	profile   types.DRMProfile
+	pending   *types.DRMProfile
+	err       error
+	exportKey *rsa.PublicKey
+	initData  types.DRMInitData
+	info      drm.DRMInfo
+	clearKeys []types.DRMClearKey
+	clearKey  bool
+	rotated   []string
+	pushed    *drm.KeyPush
+}
+
+func (m *dummyManager) Start()                                     {}
+func (m *dummyManager) Shutdown() error                            { return nil }
+func (m *dummyManager) Enabled() bool                              { return m.enabled }
+func (m *dummyManager) DebugPage() bool                            { return m.debugPage }
+func (m *dummyManager) ClearKeyEndpoint() bool                     { return m.clearKey }
+func (m *dummyManager) Codec() string                              { return drm.CodecH264 }
+func (m *dummyManager) Encryptor() *drm.Encryptor                  { return nil }
+func (m *dummyManager) TrackEncryptor(track string) *drm.Encryptor { return nil }
+func (m *dummyManager) Events() *drm.Bus                           { return nil }
+func (m *dummyManager) Epoch() uint64                              { return 1 }
+func (m *dummyManager) Profile() types.DRMProfile                  { return m.profile }
+
+func (m *dummyManager) PendingProfile() (types.DRMProfile, bool) {
+	if m.pending == nil {
+		return types.DRMProfile{}, false
+	}
+	return *m.pending, true
+}
+
+func (m *dummyManager) ApplyProfile(profile types.DRMProfile) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.pending = &profile
+	return nil
+}
+
+func (m *dummyManager) Status() types.DRMStatus {
+	return types.DRMStatus{Enabled: m.enabled, Mode: m.profile.Mode, KeyID: m.profile.KeyID}
+}
+
+func (m *dummyManager) AcknowledgeKey(sessionID, keyID string) bool {
+	return false
+}
+
+func (m *dummyManager) PushKey(actor string, push drm.KeyPush) (drm.KeyPushResult, error) {
+	if m.err != nil {
+		return drm.KeyPushResult{}, m.err
+	}
+	if err := push.Validate(); err != nil {
+		return drm.KeyPushResult{}, err
+	}
+	m.pushed = &push
+	return drm.KeyPushResult{KeyID: hex.EncodeToString(push.KeyID), PreviousKeyID: m.profile.KeyID, Activation: push.ActivationPolicy()}, nil
+}
+
+func (m *dummyManager) RotateKey(actor, keyID, key, iv string) (types.DRMKeyRotation, error) {
+	if m.err != nil {
+		return types.DRMKeyRotation{}, m.err
+	}
+	m.rotated = []string{keyID, key, iv}
+	return types.DRMKeyRotation{KeyID: "000102030405060708090a0b0c0d0e0f", PreviousKeyID: m.profile.KeyID}, nil
+}
+
+func (m *dummyManager) ExportKey(actor, password string, publicKey *rsa.PublicKey) (types.DRMKeyExport, error) {
+	if m.err != nil {
+		return types.DRMKeyExport{}, m.err
+	}
+	m.exportKey = publicKey
+	return types.DRMKeyExport{KeyID: "00000000000000000000000000000001"}, nil
+}
+
+func (m *dummyManager) Capabilities() (types.DRMCapabilities, error) {
+	return types.DRMCapabilities{StreamChecks: drm.StreamChecks()}, nil
+}
+
+func (m *dummyManager) Exempt(sessionID string) bool { return false }
+
+func (m *dummyManager) StreamEncryptors() *drm.EncryptorRegistry { return nil }
+func (m *dummyManager) StreamChanged(session types.Session)      {}
+
+func (m *dummyManager) SessionProfile(sessionID string) types.DRMProfile { return m.profile }
+
+func (m *dummyManager) AcquireSession(sessionID string) (*drm.EncryptorSet, error) { return nil, nil }
+func (m *dummyManager) ReleaseSession(sessionID string)                            {}
+
+func (m *dummyManager) SetWireVersion(sessionID string, version int) error { return nil }
+func (m *dummyManager) WireVersion(sessionID string) int                   { return drm.FrameHeaderVersion }
+
+func (m *dummyManager) ClientInfo(sessionID string) (types.DRMInfo, error) {
+	return types.DRMInfo{}, nil
+}
+
+func (m *dummyManager) Info(sessionID string) (drm.DRMInfo, error) {
+	if m.err != nil {
+		return drm.DRMInfo{}, m.err
+	}
+	return m.info, nil
+}
+
+func (m *dummyManager) InitData(sessionID string) (types.DRMInitData, error) {
+	if m.err != nil {
+		return types.DRMInitData{}, m.err
+	}
+	return m.initData, nil
+}
+
+func (m *dummyManager) ClearKeys(sessionID string, keyIDs [][]byte) ([]types.DRMClearKey, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	var keys []types.DRMClearKey
+	for _, keyID := range keyIDs {
+		for _, key := range m.clearKeys {
+			if bytes.Equal(key.KeyID, keyID) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func TestDRMHandler_profileApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{
+			name:     "staged",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "validation failure",
+			err:      fmt.Errorf("%w: mode must be cbcs or cenc", drm.ErrInvalidProfile),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "already pending",
+			err:      drm.ErrProfilePending,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "disabled",
+			err:      types.ErrDRMDisabled,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "rolled back",
+			err:      fmt.Errorf("%w: failed", drm.ErrProfileRolledBack),
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &dummyManager{enabled: true, err: tt.err}
+			h := New(manager)
+
+			body := `{"mode":"cenc","key_id":"000102030405060708090a0b0c0d0e0f","key":"101112131415161718191a1b1c1d1e1f","iv":"202122232425262728292a2b2c2d2e2f"}`
+			r := httptest.NewRequest(http.MethodPost, "/profile", strings.NewReader(body))
+			w := httptest.NewRecorder()
+
+			code := http.StatusOK
+			if err := h.profileApply(w, r); err != nil {
+				var httpErr *utils.HTTPError
+				if !errors.As(err, &httpErr) {
+					t.Fatalf("profileApply() returned non http error: %s", err)
+				}
+				code = httpErr.Code
+			}
+
+			if code != tt.wantCode {
+				t.Errorf("profileApply() code = %d, want %d", code, tt.wantCode)
+			}
+
+			// the key must never be echoed back
+			if strings.Contains(w.Body.String(), "101112131415161718191a1b1c1d1e1f") {
+				t.Errorf("profileApply() response contains the key")
+			}
+		})
+	}
+}
+
+func TestDRMHandler_info(t *testing.T) {
+	manager := &dummyManager{
+		enabled: true,
+		info: drm.DRMInfo{
+			Enabled:         true,
+			Scheme:          "cbcs",
+			KeyID:           []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+			EncryptedTracks: []string{drm.TrackVideo},
+		},
+	}
+
+	router := newDummyRouter()
+	New(manager).Route(router)
+
+	get := func(session types.Session) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/info", nil)
+		if session != nil {
+			r = r.WithContext(auth.SetSession(r, session))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get(&dummySession{profile: types.MemberProfile{CanWatch: false}}); w.Code != http.StatusForbidden {
+		t.Errorf("GET /info for non-watcher code = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w := get(&dummySession{profile: types.MemberProfile{CanWatch: true}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /info code = %d, want %d", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), `"keyId":"AAAAAAAAAAAAAAAAAAAAAQ"`) {
+		t.Errorf("GET /info body = %s, want the base64url key ID", w.Body.String())
+	}
+}
@@ -0,0 +1,44 @@
+package drm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+// initData serves the EME init data of the session as one document, the
+// ETag is the epoch and a hash of the document so clients revalidate
+// cheaply and refetch after a rotation or once a pending key is listed
+func (h *DRMHandler) initData(w http.ResponseWriter, r *http.Request) error {
+	data, err := h.drm.InitData(sessionID(r))
+	switch {
+	case err == nil:
+	case errors.Is(err, types.ErrDRMDisabled):
+		return utils.HttpUnprocessableEntity(err.Error())
+	default:
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+	sum := sha256.Sum256(body)
+
+	etag := `"` + strconv.FormatUint(data.Epoch, 10) + "-" + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	return utils.HttpSuccess(w, data)
+}
@@ -0,0 +1,97 @@
+package drm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+func TestDRMHandler_initData(t *testing.T) {
+	manager := &dummyManager{
+		enabled: true,
+		initData: types.DRMInitData{
+			Epoch:  1,
+			Scheme: "cbcs",
+			Keys:   []types.DRMInitDataKey{{KeyID: "00000000000000000000000000000001"}},
+		},
+	}
+
+	router := newDummyRouter()
+	New(manager).Route(router)
+
+	get := func(session types.Session, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/initdata", nil)
+		if session != nil {
+			r = r.WithContext(auth.SetSession(r, session))
+		}
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// entitlement follows the watch permission
+	if w := get(nil, ""); w.Code != http.StatusForbidden {
+		t.Errorf("GET /initdata without session code = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := get(&dummySession{profile: types.MemberProfile{CanWatch: false, CanHost: true}}, ""); w.Code != http.StatusForbidden {
+		t.Errorf("GET /initdata for non-watcher code = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	watcher := &dummySession{profile: types.MemberProfile{CanWatch: true}}
+
+	w := get(watcher, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /initdata code = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"1-`) {
+		t.Errorf("GET /initdata ETag = %s, want one of epoch 1", etag)
+	}
+
+	var data types.DRMInitData
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatalf("unable to decode init data: %s", err)
+	}
+	if len(data.Keys) != 1 || data.Keys[0].KeyID != "00000000000000000000000000000001" {
+		t.Errorf("GET /initdata keys = %+v", data.Keys)
+	}
+
+	// revalidation before rotation
+	if w := get(watcher, etag); w.Code != http.StatusNotModified {
+		t.Errorf("GET /initdata revalidation code = %d, want %d", w.Code, http.StatusNotModified)
+	}
+
+	// a staged key is listed before the epoch changes, the cached copy is
+	// stale
+	manager.initData.Keys = append(manager.initData.Keys, types.DRMInitDataKey{KeyID: "00000000000000000000000000000002"})
+
+	w = get(watcher, etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /initdata with a pending key code = %d, want %d", w.Code, http.StatusOK)
+	}
+	pending := w.Header().Get("ETag")
+	if pending == etag || !strings.HasPrefix(pending, `"1-`) {
+		t.Errorf("GET /initdata with a pending key ETag = %s, want another one of epoch 1 than %s", pending, etag)
+	}
+
+	// rotation bumps the epoch
+	manager.initData.Epoch = 2
+	manager.initData.Keys = manager.initData.Keys[1:]
+
+	w = get(watcher, pending)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /initdata after rotation code = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("ETag"); !strings.HasPrefix(got, `"2-`) {
+		t.Errorf("GET /initdata after rotation ETag = %s, want one of epoch 2", got)
+	}
+}
@@ -0,0 +1,44 @@
+package drm
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+// keyPush takes key material pushed by a key orchestrator, see
+// drm.KeyPushClient, and answers with the activation decision
+func (h *DRMHandler) keyPush(w http.ResponseWriter, r *http.Request) error {
+	if !h.drm.Enabled() {
+		return errDisabled()
+	}
+
+	data := &drm.KeyPush{}
+	if err := utils.HttpJsonRequest(w, r, data); err != nil {
+		return err
+	}
+
+	actor := "unknown"
+	if session, ok := auth.GetSession(r); ok {
+		actor = session.ID()
+	}
+
+	result, err := h.drm.PushKey(actor, *data)
+	switch {
+	case err == nil:
+	case errors.Is(err, types.ErrDRMDisabled), errors.Is(err, types.ErrDRMUnsupported):
+		return utils.HttpUnprocessableEntity(err.Error())
+	case errors.Is(err, drm.ErrInvalidProfile):
+		return utils.HttpBadRequest(err.Error())
+	case errors.Is(err, drm.ErrKeyReplayed), errors.Is(err, drm.ErrProfilePending):
+		return utils.HttpError(http.StatusConflict, err.Error())
+	default:
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	return utils.HttpSuccess(w, result)
+}
@@ -0,0 +1,113 @@
+package drm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+func TestDRMHandler_keyPush(t *testing.T) {
+	admin := &dummySession{id: "admin", profile: types.MemberProfile{IsAdmin: true}}
+
+	// AAECAwQFBgcICQoLDA0ODw== is 000102030405060708090a0b0c0d0e0f
+	material := `"key_id":"AAECAwQFBgcICQoLDA0ODw==","key":"EBESExQVFhcYGRobHB0eHw==","iv":"ICEiIyQlJicoKSorLC0uLw=="`
+
+	tests := []struct {
+		name           string
+		session        types.Session
+		body           string
+		err            error
+		wantCode       int
+		wantActivation string
+	}{
+		{
+			name:     "not admin",
+			session:  &dummySession{profile: types.MemberProfile{CanWatch: true}},
+			body:     "{" + material + "}",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:           "next idr",
+			session:        admin,
+			body:           "{" + material + "}",
+			wantCode:       http.StatusOK,
+			wantActivation: drm.KeyActivationNextIDR,
+		},
+		{
+			name:           "immediate",
+			session:        admin,
+			body:           "{" + material + `,"activation":"immediate"}`,
+			wantCode:       http.StatusOK,
+			wantActivation: drm.KeyActivationImmediate,
+		},
+		{
+			name:     "unknown activation",
+			session:  admin,
+			body:     "{" + material + `,"activation":"later"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "short key",
+			session:  admin,
+			body:     `{"key_id":"AAECAwQFBgcICQoLDA0ODw==","key":"EBES","iv":"ICEiIyQlJicoKSorLC0uLw=="}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "no body",
+			session:  admin,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "replayed",
+			session:  admin,
+			body:     "{" + material + "}",
+			err:      drm.ErrKeyReplayed,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "session keys",
+			session:  admin,
+			body:     "{" + material + "}",
+			err:      types.ErrDRMUnsupported,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &dummyManager{enabled: true, err: tt.err}
+			router := newDummyRouter()
+			New(manager).Route(router)
+
+			r := httptest.NewRequest(http.MethodPut, "/keys", strings.NewReader(tt.body))
+			r = r.WithContext(auth.SetSession(r, tt.session))
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("keyPush() code = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var result drm.KeyPushResult
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("keyPush() response is no result: %s", err)
+			}
+			if result.KeyID != "000102030405060708090a0b0c0d0e0f" || result.Activation != tt.wantActivation {
+				t.Errorf("keyPush() result = %+v, want activation %s", result, tt.wantActivation)
+			}
+			if manager.pushed == nil || len(manager.pushed.Key) != 16 {
+				t.Errorf("PushKey() called with %+v, want the decoded key", manager.pushed)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package drm
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/utils"
+)
+
+type KeyRotatePayload struct {
+	// hex encoded 16 bytes each, generated when empty
+	KeyID string `json:"key_id"`
+	Key   string `json:"key"`
+	IV    string `json:"iv"`
+}
+
+// status tells operators whether drm is live, a disabled drm is reported
+// as such instead of failing
+func (h *DRMHandler) status(w http.ResponseWriter, r *http.Request) error {
+	return utils.HttpSuccess(w, h.drm.Status())
+}
+
+// keyRotate forces a switch to new key material without a restart, with
+// the material of the body or random one
+func (h *DRMHandler) keyRotate(w http.ResponseWriter, r *http.Request) error {
+	if !h.drm.Enabled() {
+		return errDisabled()
+	}
+
+	data := &KeyRotatePayload{}
+	if r.ContentLength != 0 {
+		if err := utils.HttpJsonRequest(w, r, data); err != nil {
+			return err
+		}
+	}
+
+	actor := "unknown"
+	if session, ok := auth.GetSession(r); ok {
+		actor = session.ID()
+	}
+
+	rotation, err := h.drm.RotateKey(actor, data.KeyID, data.Key, data.IV)
+	switch {
+	case err == nil:
+	case errors.Is(err, types.ErrDRMDisabled), errors.Is(err, types.ErrDRMUnsupported):
+		return utils.HttpUnprocessableEntity(err.Error())
+	case errors.Is(err, drm.ErrInvalidProfile):
+		return utils.HttpBadRequest(err.Error())
+	case errors.Is(err, drm.ErrProfilePending):
+		return utils.HttpError(http.StatusConflict, err.Error())
+	default:
+		return utils.HttpInternalServerError().WithInternalErr(err)
+	}
+
+	return utils.HttpSuccess(w, rotation)
+}
@@ -0,0 +1,98 @@
+package drm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/auth"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+func TestDRMHandler_keyRotate(t *testing.T) {
+	admin := &dummySession{id: "admin", profile: types.MemberProfile{IsAdmin: true}}
+
+	tests := []struct {
+		name        string
+		session     types.Session
+		body        string
+		err         error
+		wantCode    int
+		wantRotated []string
+	}{
+		{
+			name:     "not admin",
+			session:  &dummySession{profile: types.MemberProfile{CanWatch: true}},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:        "generated",
+			session:     admin,
+			wantCode:    http.StatusOK,
+			wantRotated: []string{"", "", ""},
+		},
+		{
+			name:        "provided",
+			session:     admin,
+			body:        `{"key_id":"000102030405060708090a0b0c0d0e0f","key":"101112131415161718191a1b1c1d1e1f","iv":"202122232425262728292a2b2c2d2e2f"}`,
+			wantCode:    http.StatusOK,
+			wantRotated: []string{"000102030405060708090a0b0c0d0e0f", "101112131415161718191a1b1c1d1e1f", "202122232425262728292a2b2c2d2e2f"},
+		},
+		{
+			name:     "malformed hex",
+			session:  admin,
+			body:     `{"key":"zz"}`,
+			err:      fmt.Errorf("%w: key: encoding/hex: invalid byte", drm.ErrInvalidProfile),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "profile pending",
+			session:  admin,
+			err:      drm.ErrProfilePending,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "session keys",
+			session:  admin,
+			err:      types.ErrDRMUnsupported,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &dummyManager{enabled: true, err: tt.err}
+			router := newDummyRouter()
+			New(manager).Route(router)
+
+			r := httptest.NewRequest(http.MethodPost, "/rotate", strings.NewReader(tt.body))
+			r = r.WithContext(auth.SetSession(r, tt.session))
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("keyRotate() code = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if !reflect.DeepEqual(manager.rotated, tt.wantRotated) {
+				t.Errorf("RotateKey() called with %q, want %q", manager.rotated, tt.wantRotated)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var rotation types.DRMKeyRotation
+			if err := json.NewDecoder(w.Body).Decode(&rotation); err != nil || rotation.KeyID == "" {
+				t.Errorf("keyRotate() response %+v, %v, want the new key ID", rotation, err)
+			}
+			if strings.Contains(w.Body.String(), "101112131415161718191a1b1c1d1e1f") {
+				t.Errorf("keyRotate() response contains the key")
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 
+	"github.com/m1k1o/neko/server/internal/api/drm"
 	"github.com/m1k1o/neko/server/internal/api/members"
 	"github.com/m1k1o/neko/server/internal/api/room"
 	"github.com/m1k1o/neko/server/internal/api/sessions"
@@ -18,6 +19,7 @@ type ApiManagerCtx struct {
 	members  types.MemberManager
 	desktop  types.DesktopManager
 	capture  types.CaptureManager
+	drm      types.DRMManager
 	routers  map[string]func(types.Router)
 }
 
@@ -26,6 +28,7 @@ func New(
 	members types.MemberManager,
 	desktop types.DesktopManager,
 	capture types.CaptureManager,
+	drm types.DRMManager,
 ) *ApiManagerCtx {
 
 	return &ApiManagerCtx{
@@ -33,6 +36,7 @@ func New(
 		members:  members,
 		desktop:  desktop,
 		capture:  capture,
+		drm:      drm,
 		routers:  make(map[string]func(types.Router)),
 	}
 }
@@ -59,6 +63,9 @@ func (api *ApiManagerCtx) Route(r types.Router) {
 		roomHandler := room.New(api.sessions, api.desktop, api.capture)
 		r.Route("/room", roomHandler.Route)
 
+		drmHandler := drm.New(api.drm)
+		r.Route("/drm", drmHandler.Route)
+
 		for path, router := range api.routers {
 			r.Route(path, router)
 		}
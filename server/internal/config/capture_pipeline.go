@@ -6,13 +6,16 @@ import (
 	"os"
 	"strings"
 
+	"github.com/spf13/viper"
+
 	"github.com/m1k1o/neko/server/pkg/gst"
 	"github.com/m1k1o/neko/server/pkg/types/codec"
 )
 
 // isDrmEnabled checks if DRM encryption is enabled via environment variable
+// and is not handled by the builtin encryptor instead
 func isDrmEnabled() bool {
-	return os.Getenv("NEKO_DRM_ENABLED") == "true"
+	return os.Getenv("NEKO_DRM_ENABLED") == "true" && viper.GetString("drm.engine") != DRMEngineBuiltin
 }
 
 // addDrmEncryptor adds the CastLabs cencryptor element to pipeline if DRM is enabled
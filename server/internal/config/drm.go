@@ -1,19 +1,303 @@
 package config
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/drm/provider"
+)
+
+const (
+	// hardened combination of options
+	DRMPresetStrict = "strict"
+	// most interoperable combination of options
+	DRMPresetCompat = "compat"
+)
+
+// drmStrictMinRatio is the smallest protected ratio allowed by the strict
+// preset, the 1:9 pattern
+const drmStrictMinRatio = 0.1
+
+// drmPresetOption is an option pinned by a preset
+type drmPresetOption struct {
+	key   string
+	value any
+	apply func(s *DRM)
+}
+
+// configured returns the value the option is configured to, of the type
+// of the pinned value
+func (o drmPresetOption) configured() any {
+	switch o.value.(type) {
+	case bool:
+		return viper.GetBool(o.key)
+	case int:
+		return viper.GetInt(o.key)
+	default:
+		return viper.GetString(o.key)
+	}
+}
+
+// drmPresets lists the options each preset pins, setting any of them
+// explicitly to another value is a configuration error
+var drmPresets = map[string][]drmPresetOption{
+	DRMPresetStrict: {
+		// constant IV with cenc reuses the keystream of every frame
+		{"drm.mode", "cbcs", func(s *DRM) { s.Mode = "cbcs" }},
+		{"drm.debug_page", false, func(s *DRM) { s.DebugPage = false }},
+		{"drm.clearkey_endpoint", false, func(s *DRM) { s.ClearKeyEndpoint = false }},
+		{"drm.allow_key_export", false, func(s *DRM) { s.AllowKeyExport = false }},
+		// fail closed rather than sending slices clear
+		{"drm.strict", true, func(s *DRM) { s.Strict = true }},
+		{"drm.strict_stream_checks", true, func(s *DRM) { s.StrictStreamChecks = true }},
+		{"drm.reject_reencryption", true, func(s *DRM) { s.RejectReencryption = true }},
+		{"drm.paranoid_checks", true, func(s *DRM) { s.ParanoidChecks = true }},
+		// a leaked key names its viewer and unlocks no other session
+		{"drm.session_keys", true, func(s *DRM) { s.SessionKeys = true }},
+	},
+	DRMPresetCompat: {
+		// cbcs 1:9 is understood by every CDM and by FairPlay
+		{"drm.mode", "cbcs", func(s *DRM) { s.Mode = "cbcs" }},
+		{"drm.crypt_blocks", 1, func(s *DRM) { s.CryptBlocks = 1 }},
+		{"drm.skip_blocks", 9, func(s *DRM) { s.SkipBlocks = 9 }},
+		{"drm.pattern", DRMPatternFixed, func(s *DRM) { s.Pattern = DRMPatternFixed }},
+		{"drm.encrypt_short_nals", drm.ShortNALsClear, func(s *DRM) { s.EncryptShortNALs = drm.ShortNALsClear }},
+	},
+}
+
+const (
+	// pattern stays as configured
+	DRMPatternFixed = "fixed"
+	// pattern follows CPU headroom within floor and ceiling
+	DRMPatternAdaptive = "adaptive"
+)
+
+const (
+	// CastLabs cencryptor element in the GStreamer pipeline
+	DRMEngineCencryptor = "cencryptor"
+	// builtin encryptor applied to the WebRTC video track
+	DRMEngineBuiltin = "builtin"
+)
+
+const (
+	// keys from the configuration, drm.key_id or drm.keys
+	DRMProviderStatic = "static"
+	// keys requested from a Widevine key server
+	DRMProviderWidevine = "widevine"
+	// keys requested from a SPEKE key server, CPIX signed with SigV4
+	DRMProviderSPEKE = "speke"
+	// key read from a secret of HashiCorp Vault
+	DRMProviderVault = "vault"
+	// keys decrypted from a ciphertext blob with AWS KMS
+	DRMProviderKMS = "kms"
 )
 
 // DRM configuration for CastLabs DRM encryption
 type DRM struct {
 	Enabled     bool
+	Preset      string // strict, compat or empty
+	Engine      string // cencryptor or builtin
 	KeyID       string
 	Key         string
 	IV          string
-	Mode        string // cbcs or cenc
+	Mode        string // cbcs, cenc, cens or cbc1
+	IVMode      string // constant, counter (or sequence) or derived, empty for the default of the mode
 	CryptBlocks int
 	SkipBlocks  int
+	Codec       string // h264 or h265, of the captured video
+	// the CBCS pattern has to span 10 blocks
+	StrictPattern bool
+	// annexb, avcc or auto, of the captured access units
+	NALFormat     string
+	NALLengthSize int
+
+	// drm.video.* alias the flat key, drm.audio.* encrypt the audio track
+	// with a key of its own
+	VideoKey drm.TrackKey
+	AudioKey drm.TrackKey
+	// drm.streams.<id>.* are the keys of single video streams by their
+	// capture video ID, the others are encrypted with the flat key
+	Streams map[string]drm.TrackKey
+	// tracks sent clear, audio is encrypted whenever it has a key unless
+	// drm.encrypt_audio is set
+	EncryptVideo    bool
+	EncryptAudio    bool
+	encryptAudioSet bool
+
+	// static, widevine, speke, vault or kms
+	Provider string
+	// content keys as key_id:key:iv, one per generation starting at 1
+	Keys []string
+	// secret files overriding drm.key_id, drm.key, drm.iv and drm.keys,
+	// to keep key material off the command line
+	KeyIDFile string
+	KeyFile   string
+	IVFile    string
+	KeysFile  string
+	// key IDs used or pushed, kept across restarts so pushes cannot
+	// replay them
+	SeenKeysFile string
+	// random key, key ID and IV on every start when none is configured
+	AutoGenerate bool
+	// hex encoded secret the key, key ID and IV are derived from with the
+	// context when no content key is configured, see deriveKey
+	MasterSecret      string
+	MasterSecretFile  string
+	DerivationContext string
+	// content keys per WebRTC session derived from the hex encoded
+	// secret, and how many sessions may hold them at once (0 unlimited)
+	SessionKeys       bool
+	SessionSecret     string
+	SessionSecretFile string
+	MaxSessions       int
+	// ordered key providers, keys, file:<path> or widevine
+	KeyProviders []string
+	// Widevine key server of drm.provider=widevine
+	Widevine DRMWidevine
+	// SPEKE key server of drm.provider=speke
+	SPEKE DRMSPEKE
+	// Vault secret of drm.provider=vault
+	Vault DRMVault
+	// KMS encrypted keys of drm.provider=kms
+	KMS DRMKMS
+	// CPIX document with the keys, overrides the static keys
+	CPIXFile string
+	CPIXURL  string
+	// alert when fewer pre-provisioned keys remain
+	KeyStockAlert int
+
+	Pattern        string // fixed or adaptive
+	PatternFloor   string // crypt:skip
+	PatternCeiling string // crypt:skip
+
+	EncryptShortNALs string // ctr or clear
+	// VCL payloads shorter than this stay clear
+	MinEncryptSize int
+	// NAL unit types encrypted instead of the slices
+	EncryptNALTypes []int
+	// clear bytes of H.264 slices whose header cannot be parsed
+	ClearLead int
+	// goroutines encrypting large cbcs access units
+	Parallelism int
+
+	// in-band KeySEI in every access unit
+	KeySEI bool
+	// rtc-drm-transform frame header before every encrypted frame
+	FrameHeader bool
+	// an IV of its own for every video stream
+	LayerIVs bool
+	// pssh boxes of the init data, cenc, widevine[:<provider>] or playready
+	PSSHSystems []string
+	// PlayReady header of the playready pssh box
+	PlayReady DRMPlayReady
+
+	// reject access units with an unsupported structure
+	StrictStreamChecks    bool
+	AllowDataPartitioning bool
+	MaxFillerRatio        float64
+	// drop access units that would leave slices clear
+	Strict bool
+	// refuse access units that come back encrypted
+	RejectReencryption bool
+
+	ActivationSkew time.Duration
+	// how long a rotated key waits for the clients to acknowledge it
+	KeyOverlap time.Duration
+	// rotates the content key automatically once it was used this long,
+	// every period shortened by up to the jitter
+	KeyRotationInterval time.Duration
+	KeyRotationJitter   time.Duration
+
+	// break-glass export of the current content key
+	AllowKeyExport    bool
+	KeyExportPassword string
+
+	DebugPage bool
+	// serve the content keys to ClearKey CDMs
+	ClearKeyEndpoint bool
+	// license server handed to clients, with the template variables of
+	// drm.ExpandLicenseURL
+	LicenseURL string
+	// FairPlay signaling, cbcs only
+	FairPlay DRMFairPlay
+
+	// verify the encryptor output on every access unit
+	ParanoidChecks bool
+	// describe every access unit at debug level
+	LogFrames bool
+
+	// smallest protected ratio of the cbcs or cens pattern, set by presets
+	MinEncryptedRatio float64
+
+	presetErr error
+	secretErr error
+}
+
+// DRMWidevine configures content key requests to a Widevine key server
+type DRMWidevine struct {
+	URL        string
+	Provider   string
+	SigningKey string
+	SigningIV  string
+	ContentID  string
+	Track      string
+	// license server of Widevine CDMs, overriding DRM.LicenseURL
+	LicenseURL string
+}
+
+// DRMSPEKE configures content key requests to a SPEKE key server
+type DRMSPEKE struct {
+	URL        string
+	ResourceID string
+	SystemIDs  []string
+	AWSRegion  string
+	AWSProfile string
+	AWSRole    string
+}
+
+// DRMVault configures reading the content key from a Vault secret
+type DRMVault struct {
+	Addr      string
+	Path      string
+	Namespace string
+	Auth      string // token or kubernetes
+	Token     string
+	Role      string
+	AuthMount string
+	Refresh   time.Duration
+}
+
+// DRMKMS configures decrypting the content keys with AWS KMS
+type DRMKMS struct {
+	KeyARN     string
+	Ciphertext string
+	AWSRegion  string
+	AWSProfile string
+	AWSRole    string
+}
+
+// DRMPlayReady configures the PlayReady header handed to clients
+type DRMPlayReady struct {
+	LAURL string
+	// license server of PlayReady CDMs, overriding DRM.LicenseURL
+	LicenseURL string
+}
+
+// DRMFairPlay configures the signaling of FairPlay Streaming clients
+type DRMFairPlay struct {
+	SKDURL         string
+	CertificateURL string
 }
 
 func (DRM) Init(cmd *cobra.Command) error {
@@ -22,45 +306,1662 @@ func (DRM) Init(cmd *cobra.Command) error {
 		return err
 	}
 
-	cmd.PersistentFlags().String("drm.key_id", "", "DRM key ID (16 bytes hex encoded)")
+	cmd.PersistentFlags().String("drm.profile", "", "preset of DRM options: strict selects the hardened combination failing closed with keys per session (builtin engine only, requires drm.session_secret), compat the most interoperable one; explicitly setting a pinned option to another value is an error")
+	if err := viper.BindPFlag("drm.profile", cmd.PersistentFlags().Lookup("drm.profile")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.engine", DRMEngineCencryptor, "DRM encryption engine: cencryptor (GStreamer plugin) or builtin (encrypts WebRTC video samples)")
+	if err := viper.BindPFlag("drm.engine", cmd.PersistentFlags().Lookup("drm.engine")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.key_id", "", "DRM key ID (16 bytes hex or base64 encoded)")
 	if err := viper.BindPFlag("drm.key_id", cmd.PersistentFlags().Lookup("drm.key_id")); err != nil {
 		return err
 	}
 
-	cmd.PersistentFlags().String("drm.key", "", "DRM encryption key (16 bytes hex encoded)")
+	cmd.PersistentFlags().String("drm.key", "", "DRM encryption key (16 bytes hex or base64 encoded)")
 	if err := viper.BindPFlag("drm.key", cmd.PersistentFlags().Lookup("drm.key")); err != nil {
 		return err
 	}
 
-	cmd.PersistentFlags().String("drm.iv", "", "DRM initialization vector (16 bytes hex encoded)")
+	cmd.PersistentFlags().String("drm.iv", "", "DRM initialization vector (16 bytes hex or base64 encoded, or 8 in cenc and cens mode)")
 	if err := viper.BindPFlag("drm.iv", cmd.PersistentFlags().Lookup("drm.iv")); err != nil {
 		return err
 	}
 
-	cmd.PersistentFlags().String("drm.mode", "cbcs", "DRM encryption mode (cbcs or cenc)")
+	cmd.PersistentFlags().String("drm.key_id_file", "", "file holding the DRM key ID (16 bytes raw, hex or base64 encoded), takes precedence over drm.key_id")
+	if err := viper.BindPFlag("drm.key_id_file", cmd.PersistentFlags().Lookup("drm.key_id_file")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.key_file", "", "file holding the DRM encryption key (16 bytes raw, hex or base64 encoded), takes precedence over drm.key and keeps it out of the process list")
+	if err := viper.BindPFlag("drm.key_file", cmd.PersistentFlags().Lookup("drm.key_file")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.iv_file", "", "file holding the DRM initialization vector (16 bytes raw, hex or base64 encoded), takes precedence over drm.iv")
+	if err := viper.BindPFlag("drm.iv_file", cmd.PersistentFlags().Lookup("drm.iv_file")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.video.key_id", "", "DRM key ID of the video track (16 bytes hex or base64 encoded), same as drm.key_id")
+	if err := viper.BindPFlag("drm.video.key_id", cmd.PersistentFlags().Lookup("drm.video.key_id")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.video.key", "", "DRM encryption key of the video track (16 bytes hex or base64 encoded), same as drm.key")
+	if err := viper.BindPFlag("drm.video.key", cmd.PersistentFlags().Lookup("drm.video.key")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.video.iv", "", "DRM initialization vector of the video track (16 bytes hex or base64 encoded, or 8 in cenc and cens mode), same as drm.iv")
+	if err := viper.BindPFlag("drm.video.iv", cmd.PersistentFlags().Lookup("drm.video.iv")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.audio.key_id", "", "DRM key ID of the audio track (16 bytes hex or base64 encoded), the audio track stays clear without an audio key (builtin engine only)")
+	if err := viper.BindPFlag("drm.audio.key_id", cmd.PersistentFlags().Lookup("drm.audio.key_id")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.audio.key", "", "DRM encryption key of the audio track (16 bytes hex or base64 encoded)")
+	if err := viper.BindPFlag("drm.audio.key", cmd.PersistentFlags().Lookup("drm.audio.key")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.audio.iv", "", "DRM initialization vector of the audio track (16 bytes hex or base64 encoded, or 8 in cenc and cens mode)")
+	if err := viper.BindPFlag("drm.audio.iv", cmd.PersistentFlags().Lookup("drm.audio.iv")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.encrypt_video", true, "encrypt the video track, disable it to encrypt audio only (builtin engine only)")
+	if err := viper.BindPFlag("drm.encrypt_video", cmd.PersistentFlags().Lookup("drm.encrypt_video")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.encrypt_audio", false, "encrypt the audio track, by default it is whenever drm.audio.*, drm.cpix_file or drm.cpix_url has a key for it; enabling it without such a key encrypts audio with the flat key when video is clear, or with a generated key of drm.auto_generate and drm.session_keys (builtin engine only)")
+	if err := viper.BindPFlag("drm.encrypt_audio", cmd.PersistentFlags().Lookup("drm.encrypt_audio")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().StringSlice("drm.keys", []string{}, "DRM content keys as key_id:key:iv (hex or base64 encoded), one per generation starting at 1, the last one is used; keys suffixed with @<RFC 3339 time> are pre-provisioned and rotated to at that time; replaces drm.key_id, drm.key and drm.iv")
+	if err := viper.BindPFlag("drm.keys", cmd.PersistentFlags().Lookup("drm.keys")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.keys_file", "", "file holding the DRM content keys as key_id:key:iv lines like drm.keys, # starts a comment; takes precedence over drm.keys, keys appended while running are rotated to")
+	if err := viper.BindPFlag("drm.keys_file", cmd.PersistentFlags().Lookup("drm.keys_file")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.seen_keys_file", "", "file the key IDs used or pushed so far are appended to and read back at startup, so keys pushed to /api/drm/keys are never taken again after a restart; without it only the key IDs seen since the start are rejected")
+	if err := viper.BindPFlag("drm.seen_keys_file", cmd.PersistentFlags().Lookup("drm.seen_keys_file")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.auto_generate", false, "generate a random DRM key, key ID and IV on every start where drm.key_id, drm.key or drm.iv are empty, for ephemeral sessions (builtin engine only)")
+	if err := viper.BindPFlag("drm.auto_generate", cmd.PersistentFlags().Lookup("drm.auto_generate")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.master_secret", "", "hex encoded master secret of at least 16 bytes the DRM key, key ID and IV are derived from with drm.derivation_context when drm.key_id, drm.key, drm.iv, drm.keys and drm.keys_file are empty")
+	if err := viper.BindPFlag("drm.master_secret", cmd.PersistentFlags().Lookup("drm.master_secret")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.master_secret_file", "", "file holding drm.master_secret hex encoded, takes precedence over it")
+	if err := viper.BindPFlag("drm.master_secret_file", cmd.PersistentFlags().Lookup("drm.master_secret_file")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.derivation_context", "", "context the DRM key is derived from drm.master_secret with, e.g. stream ID and date; another context derives another key")
+	if err := viper.BindPFlag("drm.derivation_context", cmd.PersistentFlags().Lookup("drm.derivation_context")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.session_keys", false, "encrypt every WebRTC session with content keys of its own derived from drm.session_secret, so that a leaked key names its viewer (builtin engine only)")
+	if err := viper.BindPFlag("drm.session_keys", cmd.PersistentFlags().Lookup("drm.session_keys")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.session_secret", "", "hex encoded master secret of at least 16 bytes the DRM session keys are derived from")
+	if err := viper.BindPFlag("drm.session_secret", cmd.PersistentFlags().Lookup("drm.session_secret")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.session_secret_file", "", "file holding drm.session_secret hex encoded, takes precedence over it")
+	if err := viper.BindPFlag("drm.session_secret_file", cmd.PersistentFlags().Lookup("drm.session_secret_file")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Int("drm.max_sessions", 0, "how many WebRTC sessions may be encrypted with session keys at once, each costs its own encryption; 0 is unlimited")
+	if err := viper.BindPFlag("drm.max_sessions", cmd.PersistentFlags().Lookup("drm.max_sessions")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.provider", DRMProviderStatic, "source of the DRM content keys: static (drm.key_id, drm.key and drm.iv or drm.keys), widevine (drm.widevine.*), speke (drm.speke.*), vault (drm.vault.*) or kms (drm.kms.*), all but static with the builtin engine only")
+	if err := viper.BindPFlag("drm.provider", cmd.PersistentFlags().Lookup("drm.provider")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.widevine.url", "", "Widevine key server URL, e.g. https://license.uat.widevine.com/cenc/getcontentkey/<provider>")
+	if err := viper.BindPFlag("drm.widevine.url", cmd.PersistentFlags().Lookup("drm.widevine.url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.widevine.provider", "", "provider name requests to the Widevine key server are signed as")
+	if err := viper.BindPFlag("drm.widevine.provider", cmd.PersistentFlags().Lookup("drm.widevine.provider")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.widevine.signing_key", "", "AES key requests to the Widevine key server are signed with (32 bytes hex encoded), set it out-of-band (e.g. NEKO_DRM_WIDEVINE_SIGNING_KEY)")
+	if err := viper.BindPFlag("drm.widevine.signing_key", cmd.PersistentFlags().Lookup("drm.widevine.signing_key")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.widevine.signing_iv", "", "AES IV requests to the Widevine key server are signed with (16 bytes hex encoded)")
+	if err := viper.BindPFlag("drm.widevine.signing_iv", cmd.PersistentFlags().Lookup("drm.widevine.signing_iv")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.widevine.content_id", "", "content ID the Widevine key server issues the key for, the same ID gets the same key")
+	if err := viper.BindPFlag("drm.widevine.content_id", cmd.PersistentFlags().Lookup("drm.widevine.content_id")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.widevine.track", provider.DefaultWidevineTrack, "track type the content key is requested for (SD, HD, UHD1, UHD2 or AUDIO)")
+	if err := viper.BindPFlag("drm.widevine.track", cmd.PersistentFlags().Lookup("drm.widevine.track")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.widevine.license_url", "", "license server URL of Widevine CDMs handed to clients, overriding drm.license_url")
+	if err := viper.BindPFlag("drm.widevine.license_url", cmd.PersistentFlags().Lookup("drm.widevine.license_url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.speke.url", "", "SPEKE key server URL the CPIX requests are posted to, signed with AWS SigV4")
+	if err := viper.BindPFlag("drm.speke.url", cmd.PersistentFlags().Lookup("drm.speke.url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.speke.resource_id", "", "resource ID the SPEKE key server issues the key for")
+	if err := viper.BindPFlag("drm.speke.resource_id", cmd.PersistentFlags().Lookup("drm.speke.resource_id")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().StringSlice("drm.speke.system_ids", []string{}, "key systems to request pssh boxes of from the SPEKE key server: common, widevine, playready, fairplay or a system ID UUID")
+	if err := viper.BindPFlag("drm.speke.system_ids", cmd.PersistentFlags().Lookup("drm.speke.system_ids")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.speke.aws_region", "", "AWS region requests to the SPEKE key server are signed for")
+	if err := viper.BindPFlag("drm.speke.aws_region", cmd.PersistentFlags().Lookup("drm.speke.aws_region")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.speke.aws_profile", "", "profile of the shared AWS credentials file to sign SPEKE requests with, the AWS_* environment variables when empty")
+	if err := viper.BindPFlag("drm.speke.aws_profile", cmd.PersistentFlags().Lookup("drm.speke.aws_profile")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.speke.aws_role", "", "ARN of an AWS role assumed to sign SPEKE requests")
+	if err := viper.BindPFlag("drm.speke.aws_role", cmd.PersistentFlags().Lookup("drm.speke.aws_role")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.vault.addr", "", "address of the Vault server the content key is read from, VAULT_ADDR when empty")
+	if err := viper.BindPFlag("drm.vault.addr", cmd.PersistentFlags().Lookup("drm.vault.addr")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.vault.path", "", "path of the Vault secret with the fields key_id, key and iv, secret/data/<name> with the KV version 2 engine whose version is the key generation")
+	if err := viper.BindPFlag("drm.vault.path", cmd.PersistentFlags().Lookup("drm.vault.path")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.vault.namespace", "", "Vault Enterprise namespace of the secret")
+	if err := viper.BindPFlag("drm.vault.namespace", cmd.PersistentFlags().Lookup("drm.vault.namespace")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.vault.auth", provider.VaultAuthToken, "Vault auth method: token (drm.vault.token or VAULT_TOKEN) or kubernetes (drm.vault.role with the service account token)")
+	if err := viper.BindPFlag("drm.vault.auth", cmd.PersistentFlags().Lookup("drm.vault.auth")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.vault.token", "", "Vault token of the token auth method, VAULT_TOKEN when empty")
+	if err := viper.BindPFlag("drm.vault.token", cmd.PersistentFlags().Lookup("drm.vault.token")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.vault.role", "", "Vault role of the kubernetes auth method")
+	if err := viper.BindPFlag("drm.vault.role", cmd.PersistentFlags().Lookup("drm.vault.role")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.vault.auth_mount", provider.VaultAuthKubernetes, "mount path of the Vault kubernetes auth method")
+	if err := viper.BindPFlag("drm.vault.auth_mount", cmd.PersistentFlags().Lookup("drm.vault.auth_mount")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Duration("drm.vault.refresh", provider.DefaultVaultRefresh, "how often the Vault secret is read again for a new key, earlier when its lease ends")
+	if err := viper.BindPFlag("drm.vault.refresh", cmd.PersistentFlags().Lookup("drm.vault.refresh")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.kms.key_arn", "", "ARN of the AWS KMS key drm.kms.ciphertext was encrypted with")
+	if err := viper.BindPFlag("drm.kms.key_arn", cmd.PersistentFlags().Lookup("drm.kms.key_arn")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.kms.ciphertext", "", "base64 ciphertext blob of AWS KMS encrypting one key_id:key:iv per line, decrypted on start")
+	if err := viper.BindPFlag("drm.kms.ciphertext", cmd.PersistentFlags().Lookup("drm.kms.ciphertext")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.kms.aws_region", "", "AWS region of the KMS key, the region of drm.kms.key_arn when empty")
+	if err := viper.BindPFlag("drm.kms.aws_region", cmd.PersistentFlags().Lookup("drm.kms.aws_region")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.kms.aws_profile", "", "profile of the shared AWS credentials file to call KMS with, the AWS_* environment variables when empty")
+	if err := viper.BindPFlag("drm.kms.aws_profile", cmd.PersistentFlags().Lookup("drm.kms.aws_profile")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.kms.aws_role", "", "ARN of an AWS role assumed to call KMS")
+	if err := viper.BindPFlag("drm.kms.aws_role", cmd.PersistentFlags().Lookup("drm.kms.aws_role")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.cpix_file", "", "CPIX document with plain content keys, usage rules assign them to the video and audio tracks; overrides drm.key_id, drm.key, drm.iv, drm.keys and drm.audio.* (builtin engine only)")
+	if err := viper.BindPFlag("drm.cpix_file", cmd.PersistentFlags().Lookup("drm.cpix_file")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.cpix_url", "", "URL of a CPIX document, as drm.cpix_file")
+	if err := viper.BindPFlag("drm.cpix_url", cmd.PersistentFlags().Lookup("drm.cpix_url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().StringSlice("drm.key_providers", []string{}, "ordered DRM key providers failing over to the next one when unavailable: keys (drm.keys), file:<path> with one key_id:key:iv per line, widevine (drm.widevine.*), speke (drm.speke.*), vault (drm.vault.*) or kms (drm.kms.*)")
+	if err := viper.BindPFlag("drm.key_providers", cmd.PersistentFlags().Lookup("drm.key_providers")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Int("drm.key_stock_alert", 2, "alert once fewer pre-provisioned keys (drm.keys with an @activation time) than this remain")
+	if err := viper.BindPFlag("drm.key_stock_alert", cmd.PersistentFlags().Lookup("drm.key_stock_alert")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.mode", "cbcs", "DRM protection scheme: cbcs or cens encrypting a pattern of blocks, cenc or cbc1 encrypting all of them; all but cbcs use a per-sample IV")
 	if err := viper.BindPFlag("drm.mode", cmd.PersistentFlags().Lookup("drm.mode")); err != nil {
 		return err
 	}
 
-	cmd.PersistentFlags().Int("drm.crypt_blocks", 1, "CBCS pattern: number of blocks to encrypt")
+	cmd.PersistentFlags().String("drm.iv_mode", "", "IV of the encrypted access units: constant (cbcs only), counter (or sequence) counting up from drm.iv mixed with a nonce drawn at startup or derived from the key and the sample number for packagers computing it, empty for constant with cbcs and counter with the other modes (builtin engine only)")
+	if err := viper.BindPFlag("drm.iv_mode", cmd.PersistentFlags().Lookup("drm.iv_mode")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.codec", drm.CodecH264, "codec of the encrypted video stream (h264 or h265), has to match the capture pipeline")
+	if err := viper.BindPFlag("drm.codec", cmd.PersistentFlags().Lookup("drm.codec")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.nal_format", drm.NALFormatAnnexB, "NAL unit format of the captured access units: annexb start codes, avcc length fields, or auto to detect it per access unit")
+	if err := viper.BindPFlag("drm.nal_format", cmd.PersistentFlags().Lookup("drm.nal_format")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Int("drm.nal_length_size", drm.DefaultNALLengthSize, "size of avcc NAL unit length fields in bytes (1, 2 or 4)")
+	if err := viper.BindPFlag("drm.nal_length_size", cmd.PersistentFlags().Lookup("drm.nal_length_size")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Int("drm.crypt_blocks", 1, "cbcs and cens pattern: number of blocks to encrypt")
 	if err := viper.BindPFlag("drm.crypt_blocks", cmd.PersistentFlags().Lookup("drm.crypt_blocks")); err != nil {
 		return err
 	}
 
-	cmd.PersistentFlags().Int("drm.skip_blocks", 9, "CBCS pattern: number of blocks to skip")
+	cmd.PersistentFlags().Int("drm.skip_blocks", 9, "cbcs and cens pattern: number of blocks to skip")
 	if err := viper.BindPFlag("drm.skip_blocks", cmd.PersistentFlags().Lookup("drm.skip_blocks")); err != nil {
 		return err
 	}
 
-	return nil
-}
+	cmd.PersistentFlags().Bool("drm.strict_pattern", false, "cbcs and cens pattern: require drm.crypt_blocks and drm.skip_blocks to add up to 10 blocks, as most players expect")
+	if err := viper.BindPFlag("drm.strict_pattern", cmd.PersistentFlags().Lookup("drm.strict_pattern")); err != nil {
+		return err
+	}
 
-func (s *DRM) Set() {
-	s.Enabled = viper.GetBool("drm.enabled")
-	s.KeyID = viper.GetString("drm.key_id")
-	s.Key = viper.GetString("drm.key")
-	s.IV = viper.GetString("drm.iv")
-	s.Mode = viper.GetString("drm.mode")
-	s.CryptBlocks = viper.GetInt("drm.crypt_blocks")
-	s.SkipBlocks = viper.GetInt("drm.skip_blocks")
+	cmd.PersistentFlags().String("drm.pattern", DRMPatternFixed, "cbcs and cens pattern selection: fixed uses drm.crypt_blocks and drm.skip_blocks, adaptive tunes them to the CPU headroom within drm.pattern_floor and drm.pattern_ceiling (builtin engine only)")
+	if err := viper.BindPFlag("drm.pattern", cmd.PersistentFlags().Lookup("drm.pattern")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.pattern_floor", "1:9", "adaptive pattern: least protective crypt:skip pattern, the protected ratio never drops below it")
+	if err := viper.BindPFlag("drm.pattern_floor", cmd.PersistentFlags().Lookup("drm.pattern_floor")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.pattern_ceiling", "5:5", "adaptive pattern: most protective crypt:skip pattern")
+	if err := viper.BindPFlag("drm.pattern_ceiling", cmd.PersistentFlags().Lookup("drm.pattern_ceiling")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.encrypt_short_nals", "", "handling of VCL NAL payloads shorter than 16 bytes: ctr (default) to encrypt them in cenc mode, or clear (the other modes always keep them clear, as does drm.min_encrypt_size above 16)")
+	if err := viper.BindPFlag("drm.encrypt_short_nals", cmd.PersistentFlags().Lookup("drm.encrypt_short_nals")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Int("drm.parallelism", 0, "goroutines encrypting the NAL units of large cbcs access units such as IDR frames, 0 or 1 encrypts them serially (builtin engine only)")
+	if err := viper.BindPFlag("drm.parallelism", cmd.PersistentFlags().Lookup("drm.parallelism")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Int("drm.min_encrypt_size", drm.DefaultMinEncryptSize, "VCL NAL payloads shorter than this many bytes stay clear, to save encrypting small slices; raised to 16, decryptors without drm.frame_header have to apply the same threshold (builtin engine only)")
+	if err := viper.BindPFlag("drm.min_encrypt_size", cmd.PersistentFlags().Lookup("drm.min_encrypt_size")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().IntSlice("drm.encrypt_nal_types", []int{}, "NAL unit types encrypted instead of the slices (1 to 5 for H.264, 0 to 31 for H.265), parameter sets are refused; slices not listed stay clear (builtin engine only)")
+	if err := viper.BindPFlag("drm.encrypt_nal_types", cmd.PersistentFlags().Lookup("drm.encrypt_nal_types")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Int("drm.clear_lead", drm.DefaultClearLead, "bytes of an H.264 slice payload kept clear when its slice header cannot be parsed, parsed slice headers stay clear up to the next block")
+	if err := viper.BindPFlag("drm.clear_lead", cmd.PersistentFlags().Lookup("drm.clear_lead")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.key_sei", false, "insert a clear SEI naming the key ID hash, generation and per-sample IV into every access unit, for recorders that only see the byte stream")
+	if err := viper.BindPFlag("drm.key_sei", cmd.PersistentFlags().Lookup("drm.key_sei")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.frame_header", false, "prepend the IV and subsample layout of every frame in the framing of the rtc-drm-transform decryptor, needed with key rotation or per-sample IVs (builtin engine only)")
+	if err := viper.BindPFlag("drm.frame_header", cmd.PersistentFlags().Lookup("drm.frame_header")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.layer_ivs", false, "encrypt every video stream with the shared key and an IV of its own derived from drm.iv, so that streams of the same source never share a keystream (builtin engine only)")
+	if err := viper.BindPFlag("drm.layer_ivs", cmd.PersistentFlags().Lookup("drm.layer_ivs")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().StringSlice("drm.pssh_systems", []string{drm.PSSHSystemCommon}, "pssh boxes of the init data handed to clients: cenc for the common system, widevine or widevine:<provider> for Widevine, playready for PlayReady (drm.mode=cenc or cbcs)")
+	if err := viper.BindPFlag("drm.pssh_systems", cmd.PersistentFlags().Lookup("drm.pssh_systems")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.playready.la_url", "", "PlayReady license acquisition URL of the header in the playready pssh box, drm.playready.license_url or drm.license_url when empty")
+	if err := viper.BindPFlag("drm.playready.la_url", cmd.PersistentFlags().Lookup("drm.playready.la_url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.playready.license_url", "", "license server URL of PlayReady CDMs handed to clients, overriding drm.license_url")
+	if err := viper.BindPFlag("drm.playready.license_url", cmd.PersistentFlags().Lookup("drm.playready.license_url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.strict_stream_checks", false, "drop access units with an unsupported structure instead of encrypting them partially: parameter set changes outside of IDR, data partitioning, filler data flooding")
+	if err := viper.BindPFlag("drm.strict_stream_checks", cmd.PersistentFlags().Lookup("drm.strict_stream_checks")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.strict", false, "drop video access units that would leave slices clear instead of sending them unencrypted: no start code, truncated NAL units, nothing of the slices encrypted (builtin engine only)")
+	if err := viper.BindPFlag("drm.strict", cmd.PersistentFlags().Lookup("drm.strict")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.reject_reencryption", false, "refuse access units that were encrypted already, recent output of the encryptor or carrying a KeySEI, instead of encrypting them twice (builtin engine only)")
+	if err := viper.BindPFlag("drm.reject_reencryption", cmd.PersistentFlags().Lookup("drm.reject_reencryption")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.allow_data_partitioning", false, "strict stream checks: accept data partitioning NAL units (types 2-4)")
+	if err := viper.BindPFlag("drm.allow_data_partitioning", cmd.PersistentFlags().Lookup("drm.allow_data_partitioning")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Float64("drm.max_filler_ratio", drm.DefaultMaxFillerRatio, "strict stream checks: largest share of an access unit filler data may take")
+	if err := viper.BindPFlag("drm.max_filler_ratio", cmd.PersistentFlags().Lookup("drm.max_filler_ratio")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Duration("drm.activation_skew", drm.DefaultActivationSkew, "how far in the past a scheduled profile activation time may be and still be applied at the next keyframe, older schedules are rejected")
+	if err := viper.BindPFlag("drm.activation_skew", cmd.PersistentFlags().Lookup("drm.activation_skew")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Duration("drm.key_overlap", 0, "how long a rotated key waits for all connected clients to acknowledge it before it is switched to at the next keyframe, frames keep the old key meanwhile; 0 switches without waiting (builtin engine only)")
+	if err := viper.BindPFlag("drm.key_overlap", cmd.PersistentFlags().Lookup("drm.key_overlap")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Duration("drm.key_rotation_interval", 0, "rotate the content key automatically once it was used this long, to a key of the key server or a random one with static keys; 0 disables it (builtin engine only)")
+	if err := viper.BindPFlag("drm.key_rotation_interval", cmd.PersistentFlags().Lookup("drm.key_rotation_interval")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Duration("drm.key_rotation_jitter", 0, "shorten every automatic key rotation interval by a random duration up to this, so that servers do not rotate in lockstep")
+	if err := viper.BindPFlag("drm.key_rotation_jitter", cmd.PersistentFlags().Lookup("drm.key_rotation_jitter")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.allow_key_export", false, "allow admins to export the current content key encrypted under their RSA public key at /api/drm/key/export, for break-glass recovery only")
+	if err := viper.BindPFlag("drm.allow_key_export", cmd.PersistentFlags().Lookup("drm.allow_key_export")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.key_export_password", "", "separate password required for exporting the content key, set it out-of-band (e.g. NEKO_DRM_KEY_EXPORT_PASSWORD); export stays disabled while empty")
+	if err := viper.BindPFlag("drm.key_export_password", cmd.PersistentFlags().Lookup("drm.key_export_password")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.debug_page", false, "serve a ClearKey test player page at /api/drm/debug for admins, for debugging only")
+	if err := viper.BindPFlag("drm.debug_page", cmd.PersistentFlags().Lookup("drm.debug_page")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.clearkey_endpoint", false, "serve the content keys as W3C ClearKey licenses at /api/drm/clearkey to sessions allowed to watch, for development and testing only")
+	if err := viper.BindPFlag("drm.clearkey_endpoint", cmd.PersistentFlags().Lookup("drm.clearkey_endpoint")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.license_url", "", "license server URL handed to clients in the system/drm message, an absolute https URL or a path on this server such as /api/drm/clearkey with drm.clearkey_endpoint; {keyId} is replaced by the hex encoded key ID, {keyIdUUID} by the key ID as UUID and {sessionId} by the session ID")
+	if err := viper.BindPFlag("drm.license_url", cmd.PersistentFlags().Lookup("drm.license_url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.fairplay.skd_url", "", "FairPlay key URI handed to clients, an skd:// URL in which {keyId} is replaced by the hex encoded key ID and {keyIdUUID} by the key ID as UUID; requires drm.mode=cbcs with the fixed 1:9 pattern (builtin engine only)")
+	if err := viper.BindPFlag("drm.fairplay.skd_url", cmd.PersistentFlags().Lookup("drm.fairplay.skd_url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().String("drm.fairplay.certificate_url", "", "URL of the FairPlay application certificate handed to clients")
+	if err := viper.BindPFlag("drm.fairplay.certificate_url", cmd.PersistentFlags().Lookup("drm.fairplay.certificate_url")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.paranoid_checks", false, "verify on every access unit that NAL units kept clear leave the encryptor unchanged and that key material was not modified, corrupted access units are dropped; costs CPU, for debugging")
+	if err := viper.BindPFlag("drm.paranoid_checks", cmd.PersistentFlags().Lookup("drm.paranoid_checks")); err != nil {
+		return err
+	}
+
+	cmd.PersistentFlags().Bool("drm.log_frames", false, "log the NAL units encrypted and kept clear of every access unit, and warn about access units of which nothing was encrypted; needs debug logging, for diagnosing playback failures (builtin engine only)")
+	if err := viper.BindPFlag("drm.log_frames", cmd.PersistentFlags().Lookup("drm.log_frames")); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *DRM) Set() {
+	s.Enabled = viper.GetBool("drm.enabled")
+	s.Engine = viper.GetString("drm.engine")
+	s.KeyID = viper.GetString("drm.key_id")
+	s.Key = viper.GetString("drm.key")
+	s.IV = viper.GetString("drm.iv")
+	s.KeyIDFile = viper.GetString("drm.key_id_file")
+	s.KeyFile = viper.GetString("drm.key_file")
+	s.IVFile = viper.GetString("drm.iv_file")
+	s.SessionKeys = viper.GetBool("drm.session_keys")
+	s.SessionSecret = viper.GetString("drm.session_secret")
+	s.SessionSecretFile = viper.GetString("drm.session_secret_file")
+	s.MasterSecret = viper.GetString("drm.master_secret")
+	s.MasterSecretFile = viper.GetString("drm.master_secret_file")
+	s.DerivationContext = viper.GetString("drm.derivation_context")
+	s.MaxSessions = viper.GetInt("drm.max_sessions")
+	s.secretErr = s.loadSecretFiles()
+	s.VideoKey = drm.TrackKey{
+		KeyID: viper.GetString("drm.video.key_id"),
+		Key:   viper.GetString("drm.video.key"),
+		IV:    viper.GetString("drm.video.iv"),
+	}
+	s.AudioKey = drm.TrackKey{
+		KeyID: viper.GetString("drm.audio.key_id"),
+		Key:   viper.GetString("drm.audio.key"),
+		IV:    viper.GetString("drm.audio.iv"),
+	}
+	// stream IDs are only known from the configuration file or environment,
+	// there are no flags for them
+	s.Streams = nil
+	for id := range viper.GetStringMap("drm.streams") {
+		if s.Streams == nil {
+			s.Streams = map[string]drm.TrackKey{}
+		}
+
+		prefix := "drm.streams." + id + "."
+		s.Streams[id] = drm.TrackKey{
+			KeyID: viper.GetString(prefix + "key_id"),
+			Key:   viper.GetString(prefix + "key"),
+			IV:    viper.GetString(prefix + "iv"),
+		}
+	}
+	s.normalizeKeys()
+	if s.KeyID == "" && s.Key == "" && s.IV == "" {
+		s.KeyID, s.Key, s.IV = s.VideoKey.KeyID, s.VideoKey.Key, s.VideoKey.IV
+	}
+	s.EncryptVideo = viper.GetBool("drm.encrypt_video")
+	s.EncryptAudio = viper.GetBool("drm.encrypt_audio")
+	s.encryptAudioSet = viper.IsSet("drm.encrypt_audio")
+	s.Keys = viper.GetStringSlice("drm.keys")
+	s.KeysFile = viper.GetString("drm.keys_file")
+	s.SeenKeysFile = viper.GetString("drm.seen_keys_file")
+	s.AutoGenerate = viper.GetBool("drm.auto_generate")
+	s.Provider = viper.GetString("drm.provider")
+	s.KeyProviders = viper.GetStringSlice("drm.key_providers")
+	s.Widevine = DRMWidevine{
+		URL:        viper.GetString("drm.widevine.url"),
+		Provider:   viper.GetString("drm.widevine.provider"),
+		SigningKey: viper.GetString("drm.widevine.signing_key"),
+		SigningIV:  viper.GetString("drm.widevine.signing_iv"),
+		ContentID:  viper.GetString("drm.widevine.content_id"),
+		Track:      viper.GetString("drm.widevine.track"),
+		LicenseURL: viper.GetString("drm.widevine.license_url"),
+	}
+	s.SPEKE = DRMSPEKE{
+		URL:        viper.GetString("drm.speke.url"),
+		ResourceID: viper.GetString("drm.speke.resource_id"),
+		SystemIDs:  viper.GetStringSlice("drm.speke.system_ids"),
+		AWSRegion:  viper.GetString("drm.speke.aws_region"),
+		AWSProfile: viper.GetString("drm.speke.aws_profile"),
+		AWSRole:    viper.GetString("drm.speke.aws_role"),
+	}
+	s.Vault = DRMVault{
+		Addr:      viper.GetString("drm.vault.addr"),
+		Path:      viper.GetString("drm.vault.path"),
+		Namespace: viper.GetString("drm.vault.namespace"),
+		Auth:      viper.GetString("drm.vault.auth"),
+		Token:     viper.GetString("drm.vault.token"),
+		Role:      viper.GetString("drm.vault.role"),
+		AuthMount: viper.GetString("drm.vault.auth_mount"),
+		Refresh:   viper.GetDuration("drm.vault.refresh"),
+	}
+	s.KMS = DRMKMS{
+		KeyARN:     viper.GetString("drm.kms.key_arn"),
+		Ciphertext: viper.GetString("drm.kms.ciphertext"),
+		AWSRegion:  viper.GetString("drm.kms.aws_region"),
+		AWSProfile: viper.GetString("drm.kms.aws_profile"),
+		AWSRole:    viper.GetString("drm.kms.aws_role"),
+	}
+	s.CPIXFile = viper.GetString("drm.cpix_file")
+	s.CPIXURL = viper.GetString("drm.cpix_url")
+	s.KeyStockAlert = viper.GetInt("drm.key_stock_alert")
+	s.Mode = strings.ToLower(viper.GetString("drm.mode"))
+	s.IVMode = strings.ToLower(viper.GetString("drm.iv_mode"))
+	s.CryptBlocks = viper.GetInt("drm.crypt_blocks")
+	s.SkipBlocks = viper.GetInt("drm.skip_blocks")
+	s.StrictPattern = viper.GetBool("drm.strict_pattern")
+	s.Codec = viper.GetString("drm.codec")
+	s.NALFormat = viper.GetString("drm.nal_format")
+	s.NALLengthSize = viper.GetInt("drm.nal_length_size")
+	s.Pattern = viper.GetString("drm.pattern")
+	s.PatternFloor = viper.GetString("drm.pattern_floor")
+	s.PatternCeiling = viper.GetString("drm.pattern_ceiling")
+	s.EncryptShortNALs = viper.GetString("drm.encrypt_short_nals")
+	s.MinEncryptSize = viper.GetInt("drm.min_encrypt_size")
+	s.EncryptNALTypes = viper.GetIntSlice("drm.encrypt_nal_types")
+	s.ClearLead = viper.GetInt("drm.clear_lead")
+	s.Parallelism = viper.GetInt("drm.parallelism")
+	s.KeySEI = viper.GetBool("drm.key_sei")
+	s.FrameHeader = viper.GetBool("drm.frame_header")
+	s.LayerIVs = viper.GetBool("drm.layer_ivs")
+	s.PSSHSystems = viper.GetStringSlice("drm.pssh_systems")
+	s.PlayReady = DRMPlayReady{
+		LAURL:      viper.GetString("drm.playready.la_url"),
+		LicenseURL: viper.GetString("drm.playready.license_url"),
+	}
+	s.StrictStreamChecks = viper.GetBool("drm.strict_stream_checks")
+	s.AllowDataPartitioning = viper.GetBool("drm.allow_data_partitioning")
+	s.MaxFillerRatio = viper.GetFloat64("drm.max_filler_ratio")
+	s.Strict = viper.GetBool("drm.strict")
+	s.RejectReencryption = viper.GetBool("drm.reject_reencryption")
+	s.ActivationSkew = viper.GetDuration("drm.activation_skew")
+	s.KeyOverlap = viper.GetDuration("drm.key_overlap")
+	s.KeyRotationInterval = viper.GetDuration("drm.key_rotation_interval")
+	s.KeyRotationJitter = viper.GetDuration("drm.key_rotation_jitter")
+	s.AllowKeyExport = viper.GetBool("drm.allow_key_export")
+	s.KeyExportPassword = viper.GetString("drm.key_export_password")
+	s.DebugPage = viper.GetBool("drm.debug_page")
+	s.ClearKeyEndpoint = viper.GetBool("drm.clearkey_endpoint")
+	s.LicenseURL = viper.GetString("drm.license_url")
+	s.FairPlay = DRMFairPlay{
+		SKDURL:         viper.GetString("drm.fairplay.skd_url"),
+		CertificateURL: viper.GetString("drm.fairplay.certificate_url"),
+	}
+	s.ParanoidChecks = viper.GetBool("drm.paranoid_checks")
+	s.LogFrames = viper.GetBool("drm.log_frames")
+
+	s.Preset = viper.GetString("drm.profile")
+	s.presetErr = s.applyPreset(viper.IsSet)
+
+	s.deriveKey()
+}
+
+// deriveKey sets the key, key ID and IV derived from drm.master_secret
+// unless content keys are configured otherwise, those win. An invalid
+// secret is reported by Validate.
+func (s *DRM) deriveKey() {
+	if s.MasterSecret == "" {
+		return
+	}
+
+	if s.explicitKeys() {
+		log.Warn().Msg("drm.master_secret is ignored, explicitly configured DRM keys take precedence")
+		return
+	}
+
+	if derived, err := drm.DeriveHex(s.MasterSecret, s.DerivationContext); err == nil {
+		s.KeyID, s.Key, s.IV = derived.KeyID, derived.Key, derived.IV
+	}
+}
+
+// normalizeKeys hex encodes key material given base64 encoded, keys are
+// compared and handed on hex encoded. What does not decode is left as it
+// is for the validation to report.
+func (s *DRM) normalizeKeys() {
+	normalize := func(field *string) {
+		if b, err := drm.DecodeKeyBytes(*field); err == nil && (len(b) == 8 || len(b) == 16) {
+			*field = hex.EncodeToString(b)
+		}
+	}
+
+	fields := []*string{
+		&s.KeyID, &s.Key, &s.IV,
+		&s.VideoKey.KeyID, &s.VideoKey.Key, &s.VideoKey.IV,
+		&s.AudioKey.KeyID, &s.AudioKey.Key, &s.AudioKey.IV,
+	}
+	for _, field := range fields {
+		normalize(field)
+	}
+
+	for id, key := range s.Streams {
+		normalize(&key.KeyID)
+		normalize(&key.Key)
+		normalize(&key.IV)
+		s.Streams[id] = key
+	}
+}
+
+// explicitKeys reports whether content keys are configured other than by
+// drm.master_secret
+func (s *DRM) explicitKeys() bool {
+	return s.KeyID != "" || s.Key != "" || s.IV != "" || len(s.Keys) > 0 || s.KeysFile != "" ||
+		s.CPIXFile != "" || s.CPIXURL != "" || s.keyServer()
+}
+
+// keyServer reports whether drm.provider takes the keys from a service
+// rather than the configuration
+func (s *DRM) keyServer() bool {
+	switch s.Provider {
+	case DRMProviderWidevine, DRMProviderSPEKE, DRMProviderVault, DRMProviderKMS:
+		return true
+	}
+	return false
+}
+
+// applyPreset pins the options of the selected preset, isSet reports
+// explicitly configured options
+func (s *DRM) applyPreset(isSet func(key string) bool) error {
+	if s.Preset == "" {
+		return nil
+	}
+
+	options, ok := drmPresets[s.Preset]
+	if !ok {
+		return fmt.Errorf("drm.profile must be %s or %s, got %q", DRMPresetStrict, DRMPresetCompat, s.Preset)
+	}
+
+	var errs []error
+	for _, option := range options {
+		if configured := option.configured(); isSet(option.key) && configured != option.value {
+			errs = append(errs, fmt.Errorf("%s=%v conflicts with drm.profile=%s which requires %v", option.key, configured, s.Preset, option.value))
+			continue
+		}
+		option.apply(s)
+	}
+
+	if s.Preset == DRMPresetStrict {
+		s.MinEncryptedRatio = drmStrictMinRatio
+		if s.Enabled && s.Engine != DRMEngineBuiltin {
+			errs = append(errs, fmt.Errorf("drm.profile=%s requires the builtin engine", s.Preset))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate reports preset conflicts and options violating the preset, all
+// of them as drm.ConfigErrors when there are several
+func (s *DRM) Validate() error {
+	errs := []error{s.presetErr, s.secretErr}
+
+	if s.Codec != "" && s.Codec != drm.CodecH264 && s.Codec != drm.CodecH265 {
+		errs = append(errs, fmt.Errorf("drm.codec must be %s or %s, got %q", drm.CodecH264, drm.CodecH265, s.Codec))
+	}
+
+	if !drm.ValidScheme(s.Mode) {
+		errs = append(errs, fmt.Errorf("drm.mode must be cbcs, cenc, cens or cbc1, got %q", s.Mode))
+	} else {
+		errs = append(errs, s.validateIVMode())
+	}
+
+	if s.Parallelism < 0 {
+		errs = append(errs, fmt.Errorf("drm.parallelism must not be negative, got %d", s.Parallelism))
+	}
+
+	if s.StrictPattern && drm.PatternScheme(s.Mode) {
+		if s.Pattern == DRMPatternAdaptive {
+			errs = append(errs, errors.New("drm.strict_pattern requires drm.pattern=fixed"))
+		} else if s.CryptBlocks+s.SkipBlocks != 10 {
+			errs = append(errs, fmt.Errorf("drm.strict_pattern requires drm.crypt_blocks and drm.skip_blocks to add up to 10, got %d:%d", s.CryptBlocks, s.SkipBlocks))
+		}
+	}
+
+	if s.AutoGenerate && s.Enabled && s.Engine != DRMEngineBuiltin {
+		errs = append(errs, errors.New("drm.auto_generate requires the builtin engine"))
+	}
+
+	if s.FrameHeader && s.Enabled && s.Engine != DRMEngineBuiltin {
+		errs = append(errs, errors.New("drm.frame_header requires the builtin engine"))
+	}
+
+	if s.LayerIVs && s.Enabled && s.Engine != DRMEngineBuiltin {
+		errs = append(errs, errors.New("drm.layer_ivs requires the builtin engine"))
+	}
+
+	if s.Strict && s.Enabled && s.Engine != DRMEngineBuiltin {
+		errs = append(errs, errors.New("drm.strict requires the builtin engine"))
+	}
+
+	if s.RejectReencryption && s.Enabled && s.Engine != DRMEngineBuiltin {
+		errs = append(errs, errors.New("drm.reject_reencryption requires the builtin engine"))
+	}
+
+	if s.KeyOverlap != 0 {
+		if s.Enabled && s.Engine != DRMEngineBuiltin {
+			errs = append(errs, errors.New("drm.key_overlap requires the builtin engine"))
+		}
+		if s.KeyOverlap < 0 {
+			errs = append(errs, errors.New("drm.key_overlap must not be negative"))
+		}
+		if s.LayerIVs {
+			errs = append(errs, errors.New("drm.key_overlap cannot be combined with drm.layer_ivs"))
+		}
+	}
+
+	errs = append(errs, s.validateKeyRotation())
+
+	if s.MinEncryptSize > drm.DefaultMinEncryptSize {
+		if s.Enabled && s.Engine != DRMEngineBuiltin {
+			errs = append(errs, errors.New("drm.min_encrypt_size requires the builtin engine"))
+		}
+		if s.EncryptShortNALs == drm.ShortNALsCTR {
+			errs = append(errs, fmt.Errorf("drm.min_encrypt_size above %d cannot be combined with drm.encrypt_short_nals=ctr", drm.DefaultMinEncryptSize))
+		}
+	}
+
+	if len(s.EncryptNALTypes) > 0 {
+		if s.Enabled && s.Engine != DRMEngineBuiltin {
+			errs = append(errs, errors.New("drm.encrypt_nal_types requires the builtin engine"))
+		}
+		if err := drm.CheckEncryptNALTypes(s.Codec, s.EncryptNALTypes, s.KeySEI); err != nil {
+			errs = append(errs, fmt.Errorf("drm.encrypt_nal_types: %w", err))
+		}
+	}
+
+	errs = append(errs, s.validateFairPlay())
+	errs = append(errs, s.validateLicenseURLs()...)
+
+	if s.MasterSecret != "" {
+		if _, err := drm.DeriveHex(s.MasterSecret, s.DerivationContext); err != nil {
+			errs = append(errs, errors.New("drm.master_secret must be at least 16 bytes hex encoded"))
+		}
+	}
+
+	errs = append(errs, s.validateKeys()...)
+	errs = append(errs,
+		s.validateSessionKeys(),
+		s.validateTrackKeys(),
+		s.validateClearTracks(),
+		s.validateStreams(),
+	)
+
+	if _, err := drm.BuildPSSH(s.PSSHSystems, nil); err != nil {
+		errs = append(errs, fmt.Errorf("drm.pssh_systems: %w", err))
+	}
+
+	errs = append(errs, s.validatePlayReady())
+
+	switch s.NALFormat {
+	case "", drm.NALFormatAnnexB, drm.NALFormatAVCC, drm.NALFormatAuto:
+	default:
+		errs = append(errs, fmt.Errorf("drm.nal_format must be %s, %s or %s, got %q", drm.NALFormatAnnexB, drm.NALFormatAVCC, drm.NALFormatAuto, s.NALFormat))
+	}
+
+	switch s.NALLengthSize {
+	case 0, 1, 2, 4:
+	default:
+		errs = append(errs, fmt.Errorf("drm.nal_length_size must be 1, 2 or 4, got %d", s.NALLengthSize))
+	}
+
+	errs = append(errs, s.validateMinEncryptedRatio())
+
+	return drm.JoinConfigErrors(errs...)
+}
+
+// validateKeys checks the shape of the flat and track keys, the size given
+// is reported but never the key material
+func (s *DRM) validateKeys() []error {
+	ivSize, ivSizes := 16, "16"
+	if drm.CTRScheme(s.Mode) {
+		ivSize, ivSizes = 8, "8 or 16"
+	}
+
+	var errs []error
+	check := func(name, value, size string, valid ...int) {
+		if value == "" {
+			return
+		}
+		b, err := drm.DecodeKeyBytes(value)
+		if err == nil && slices.Contains(valid, len(b)) {
+			return
+		}
+		errs = append(errs, drm.KeyBytesError(name, size, b, err))
+	}
+
+	type prefixedKey struct {
+		prefix string
+		key    drm.TrackKey
+	}
+	keys := []prefixedKey{
+		{"drm.", drm.TrackKey{KeyID: s.KeyID, Key: s.Key, IV: s.IV}},
+		{"drm.video.", s.VideoKey},
+		{"drm.audio.", s.AudioKey},
+	}
+	for _, id := range s.streamIDs() {
+		keys = append(keys, prefixedKey{"drm.streams." + id + ".", s.Streams[id]})
+	}
+
+	for _, key := range keys {
+		// the video key is the flat one once merged
+		if key.prefix == "drm.video." && key.key == (drm.TrackKey{KeyID: s.KeyID, Key: s.Key, IV: s.IV}) {
+			continue
+		}
+		check(key.prefix+"key_id", key.key.KeyID, "16", 16)
+		check(key.prefix+"key", key.key.Key, "16", 16)
+		check(key.prefix+"iv", key.key.IV, ivSizes, ivSize, 16)
+	}
+
+	return errs
+}
+
+// validateMinEncryptedRatio checks the pattern against the minimum ratio of
+// the strict preset
+func (s *DRM) validateMinEncryptedRatio() error {
+	if s.MinEncryptedRatio <= 0 || !drm.PatternScheme(s.Mode) {
+		return nil
+	}
+
+	pattern := drm.Pattern{CryptBlocks: s.CryptBlocks, SkipBlocks: s.SkipBlocks}
+	if s.Pattern == DRMPatternAdaptive {
+		floor, err := drm.ParsePattern(s.PatternFloor)
+		if err != nil {
+			return fmt.Errorf("drm.pattern_floor: %w", err)
+		}
+		pattern = floor
+	}
+
+	if pattern.CryptBlocks <= 0 || pattern.Ratio() < s.MinEncryptedRatio {
+		return fmt.Errorf("pattern %s protects less than the minimum ratio %.2f of drm.profile=%s", pattern, s.MinEncryptedRatio, s.Preset)
+	}
+
+	return nil
+}
+
+// validateTrackKeys reports drm.video.* differing from the flat key they
+// alias, Set copies them into an unset flat key and an incomplete or unsupported audio key
+func (s *DRM) validateTrackKeys() error {
+	flat := drm.TrackKey{KeyID: s.KeyID, Key: s.Key, IV: s.IV}
+	if s.VideoKey != (drm.TrackKey{}) && flat != (drm.TrackKey{}) && s.VideoKey != flat {
+		return errors.New("drm.video.key_id, drm.video.key and drm.video.iv conflict with drm.key_id, drm.key and drm.iv, set only one of them")
+	}
+
+	if s.AudioKey == (drm.TrackKey{}) {
+		return nil
+	}
+
+	if s.AudioKey.KeyID == "" || s.AudioKey.Key == "" || s.AudioKey.IV == "" {
+		return errors.New("drm.audio.key_id, drm.audio.key and drm.audio.iv have to be set together")
+	}
+
+	if s.Engine != DRMEngineBuiltin {
+		return errors.New("drm.audio.key_id requires the builtin engine")
+	}
+
+	return nil
+}
+
+// streamIDs returns the IDs of drm.streams, sorted
+func (s *DRM) streamIDs() []string {
+	ids := make([]string, 0, len(s.Streams))
+	for id := range s.Streams {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// validateStreams checks drm.streams, the keys of single video streams are
+// static and the pattern of the configuration, every stream has a key ID
+// of its own
+func (s *DRM) validateStreams() error {
+	if len(s.Streams) == 0 {
+		return nil
+	}
+
+	switch {
+	case s.Engine != DRMEngineBuiltin:
+		return errors.New("drm.streams requires the builtin engine")
+	case s.SessionKeys:
+		return errors.New("drm.streams cannot be combined with drm.session_keys")
+	case s.Pattern == DRMPatternAdaptive:
+		return errors.New("drm.streams requires drm.pattern=fixed")
+	case !s.EncryptVideo:
+		return errors.New("drm.streams requires drm.encrypt_video")
+	}
+
+	keyIDs := map[string]string{strings.ToLower(s.KeyID): ""}
+	for _, id := range s.streamIDs() {
+		key := s.Streams[id]
+		if key.KeyID == "" || key.Key == "" || key.IV == "" {
+			return fmt.Errorf("drm.streams.%s.key_id, key and iv have to be set together", id)
+		}
+
+		other, ok := keyIDs[strings.ToLower(key.KeyID)]
+		switch {
+		case ok && other == "":
+			return fmt.Errorf("drm.streams.%s.key_id is the key ID of drm.key_id, every stream needs a key of its own", id)
+		case ok:
+			return fmt.Errorf("drm.streams.%s.key_id is the key ID of drm.streams.%s, every stream needs a key of its own", id, other)
+		}
+		keyIDs[strings.ToLower(key.KeyID)] = id
+	}
+	return nil
+}
+
+// validateClearTracks checks drm.encrypt_video and drm.encrypt_audio, a
+// stream has to keep an encrypted track and the video key options only
+// apply to audio once video is clear
+func (s *DRM) validateClearTracks() error {
+	if s.EncryptVideo && (!s.encryptAudioSet || !s.EncryptAudio) {
+		return nil
+	}
+
+	if s.Enabled && s.Engine != DRMEngineBuiltin {
+		return errors.New("drm.encrypt_video and drm.encrypt_audio require the builtin engine")
+	}
+
+	if !s.EncryptVideo {
+		if !s.encryptsAudio() {
+			return errors.New("drm.encrypt_video=false requires drm.encrypt_audio, disable drm instead to send both tracks clear")
+		}
+		if s.SessionKeys {
+			return errors.New("drm.encrypt_video=false does not support drm.session_keys")
+		}
+		if s.Pattern == DRMPatternAdaptive {
+			return errors.New("drm.encrypt_video=false requires drm.pattern=fixed")
+		}
+		return nil
+	}
+
+	// the flat key stays with video, audio needs a key of its own
+	if s.AudioKey == (drm.TrackKey{}) && s.CPIXFile == "" && s.CPIXURL == "" && !s.AutoGenerate && !s.SessionKeys {
+		return errors.New("drm.encrypt_audio requires drm.audio.*, drm.cpix_file, drm.cpix_url, drm.auto_generate or drm.session_keys")
+	}
+
+	return nil
+}
+
+// encryptsAudio reports whether audio is encrypted, by default whenever
+// there is a key for it
+func (s *DRM) encryptsAudio() bool {
+	if s.encryptAudioSet {
+		return s.EncryptAudio
+	}
+	return s.AudioKey != (drm.TrackKey{}) || s.CPIXFile != "" || s.CPIXURL != ""
+}
+
+// ClearTracks returns the labels of the tracks sent clear
+func (s *DRM) ClearTracks() []string {
+	var tracks []string
+	if !s.EncryptVideo {
+		tracks = append(tracks, drm.TrackVideo)
+	}
+	if s.encryptAudioSet && !s.EncryptAudio {
+		tracks = append(tracks, drm.TrackAudio)
+	}
+	return tracks
+}
+
+// drmReloadable are the fields of DRM that take effect without a restart,
+// Enabled and those making up the key of the stream
+var drmReloadable = []string{"Enabled", "KeyID", "Key", "IV", "KeyIDFile", "KeyFile", "IVFile", "VideoKey"}
+
+// ReloadChanges compares the configuration with one read again from the
+// config file: whether the key changed, and the fields that differ but
+// only take effect with a restart. Whether Enabled can be switched is up
+// to the caller.
+func (s *DRM) ReloadChanges(next *DRM) (key bool, restart []string) {
+	key = s.KeyID != next.KeyID || s.Key != next.Key || s.IV != next.IV
+
+	current, changed := reflect.ValueOf(*s), reflect.ValueOf(*next)
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+		if !field.IsExported() || slices.Contains(drmReloadable, field.Name) {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), changed.Field(i).Interface()) {
+			restart = append(restart, field.Name)
+		}
+	}
+	return key, restart
+}
+
+// validateFairPlay checks the options of drm.fairplay, FairPlay clients
+// only decrypt cbcs with the 1:9 pattern
+func (s *DRM) validateFairPlay() error {
+	if s.FairPlay.SKDURL == "" {
+		if s.FairPlay.CertificateURL != "" {
+			return errors.New("drm.fairplay.certificate_url requires drm.fairplay.skd_url")
+		}
+		return nil
+	}
+
+	switch {
+	case s.Enabled && s.Engine != DRMEngineBuiltin:
+		return errors.New("drm.fairplay.skd_url requires the builtin engine")
+	case !strings.HasPrefix(s.FairPlay.SKDURL, "skd://"):
+		return fmt.Errorf("drm.fairplay.skd_url must be an skd:// URL, got %q", s.FairPlay.SKDURL)
+	case s.Mode != "cbcs":
+		return fmt.Errorf("drm.fairplay.skd_url requires drm.mode=cbcs, got %s", s.Mode)
+	case s.Pattern == DRMPatternAdaptive:
+		return errors.New("drm.fairplay.skd_url requires drm.pattern=fixed")
+	case s.CryptBlocks != 1 || s.SkipBlocks != 9:
+		return fmt.Errorf("drm.fairplay.skd_url requires drm.crypt_blocks=1 and drm.skip_blocks=9, got %d:%d", s.CryptBlocks, s.SkipBlocks)
+	}
+	return nil
+}
+
+// validateLicenseURLs checks that the license servers handed to clients are
+// https URLs or paths on this server
+func (s *DRM) validateLicenseURLs() []error {
+	var errs []error
+	for _, option := range []struct {
+		key string
+		url string
+	}{
+		{"drm.license_url", s.LicenseURL},
+		{"drm.widevine.license_url", s.Widevine.LicenseURL},
+		{"drm.playready.license_url", s.PlayReady.LicenseURL},
+		{"drm.playready.la_url", s.PlayReady.LAURL},
+	} {
+		if option.url == "" {
+			continue
+		}
+		if err := drm.ValidateLicenseURL(option.url); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", option.key, err))
+		}
+	}
+	return errs
+}
+
+// LicenseURLs returns the license servers of single systems overriding
+// LicenseURL, by pssh system name
+func (s *DRM) LicenseURLs() map[string]string {
+	urls := map[string]string{}
+	if s.Widevine.LicenseURL != "" {
+		urls[drm.PSSHSystemWidevine] = s.Widevine.LicenseURL
+	}
+	if s.PlayReady.LicenseURL != "" {
+		urls[drm.PSSHSystemPlayReady] = s.PlayReady.LicenseURL
+	}
+	return urls
+}
+
+// PlayReadyLAURL returns the license acquisition URL of the PlayReady
+// header, the license server of PlayReady CDMs unless set
+func (s *DRM) PlayReadyLAURL() string {
+	switch {
+	case s.PlayReady.LAURL != "":
+		return s.PlayReady.LAURL
+	case s.PlayReady.LicenseURL != "":
+		return s.PlayReady.LicenseURL
+	}
+	return s.LicenseURL
+}
+
+// validatePlayReady checks the options of the PlayReady header, it can
+// only signal cenc and cbcs
+func (s *DRM) validatePlayReady() error {
+	if !slices.Contains(s.PSSHSystems, drm.PSSHSystemPlayReady) {
+		if s.PlayReady.LAURL != "" {
+			return errors.New("drm.playready.la_url requires playready in drm.pssh_systems")
+		}
+		return nil
+	}
+
+	if s.Mode != "cenc" && s.Mode != "cbcs" {
+		return fmt.Errorf("drm.pssh_systems playready requires drm.mode=cenc or cbcs, got %s", s.Mode)
+	}
+	return nil
+}
+
+// validateIVMode checks drm.iv_mode against drm.mode
+func (s *DRM) validateIVMode() error {
+	if s.IVMode == "" {
+		return nil
+	}
+	if s.Enabled && s.Engine != DRMEngineBuiltin {
+		return errors.New("drm.iv_mode requires the builtin engine")
+	}
+	if _, err := drm.CheckIVMode(s.Mode, s.IVMode); err != nil {
+		return fmt.Errorf("drm.iv_mode: %w", err)
+	}
+	return nil
+}
+
+// validateKeyRotation checks the options of drm.key_rotation_interval
+func (s *DRM) validateKeyRotation() error {
+	if s.KeyRotationInterval == 0 {
+		if s.KeyRotationJitter != 0 {
+			return errors.New("drm.key_rotation_jitter requires drm.key_rotation_interval")
+		}
+		return nil
+	}
+
+	switch {
+	case s.Enabled && s.Engine != DRMEngineBuiltin:
+		return errors.New("drm.key_rotation_interval requires the builtin engine")
+	case s.SessionKeys && s.Preset == DRMPresetStrict:
+		return fmt.Errorf("drm.key_rotation_interval cannot be combined with drm.profile=%s, its session keys never change", s.Preset)
+	case s.SessionKeys:
+		return errors.New("drm.key_rotation_interval cannot be combined with drm.session_keys, the keys of a session never change")
+	}
+
+	if err := s.CryptoPeriod().Validate(); err != nil {
+		return fmt.Errorf("drm.key_rotation_interval: %w", err)
+	}
+	return nil
+}
+
+// CryptoPeriod returns the schedule of the automatic key rotation
+func (s *DRM) CryptoPeriod() drm.CryptoPeriod {
+	return drm.CryptoPeriod{
+		Interval: s.KeyRotationInterval,
+		Jitter:   s.KeyRotationJitter,
+	}
+}
+
+// RotatesFromProvider reports whether the automatic key rotation takes the
+// keys from the key provider, a key server or CPIX document, rather than
+// generating them as for keys of the configuration
+func (s *DRM) RotatesFromProvider() bool {
+	return s.CPIXFile != "" || s.CPIXURL != "" || s.keyServer() || len(s.KeyProviders) > 0
+}
+
+// validateSessionKeys checks the options of drm.session_keys, the keys of
+// a session never change so nothing may stage a profile
+func (s *DRM) validateSessionKeys() error {
+	if s.MaxSessions < 0 {
+		return fmt.Errorf("drm.max_sessions must not be negative, got %d", s.MaxSessions)
+	}
+
+	if !s.SessionKeys {
+		return nil
+	}
+
+	if s.Enabled && s.Engine != DRMEngineBuiltin {
+		return errors.New("drm.session_keys requires the builtin engine")
+	}
+
+	if s.Pattern == DRMPatternAdaptive {
+		return errors.New("drm.session_keys requires drm.pattern=fixed")
+	}
+
+	if _, err := s.SessionKeySecret(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SessionKeySecret returns the master secret of the session keys
+func (s *DRM) SessionKeySecret() ([]byte, error) {
+	secret, err := hex.DecodeString(s.SessionSecret)
+	if err != nil || len(secret) < 16 {
+		return nil, errors.New("drm.session_secret must be at least 16 bytes hex encoded")
+	}
+	return secret, nil
+}
+
+// TunerConfig returns bounds of the adaptive pattern, ok is false when the
+// pattern is fixed
+func (s *DRM) TunerConfig() (config drm.TunerConfig, ok bool, err error) {
+	switch s.Pattern {
+	case "", DRMPatternFixed:
+		return drm.TunerConfig{}, false, nil
+	case DRMPatternAdaptive:
+	default:
+		return drm.TunerConfig{}, false, fmt.Errorf("drm.pattern must be %s or %s, got %q", DRMPatternFixed, DRMPatternAdaptive, s.Pattern)
+	}
+
+	if !s.BuiltinEngine() || !drm.PatternScheme(s.Mode) {
+		return drm.TunerConfig{}, false, errors.New("drm.pattern=adaptive requires the builtin engine in cbcs or cens mode")
+	}
+
+	config.Floor, err = drm.ParsePattern(s.PatternFloor)
+	if err != nil {
+		return drm.TunerConfig{}, false, fmt.Errorf("drm.pattern_floor: %w", err)
+	}
+
+	config.Ceiling, err = drm.ParsePattern(s.PatternCeiling)
+	if err != nil {
+		return drm.TunerConfig{}, false, fmt.Errorf("drm.pattern_ceiling: %w", err)
+	}
+
+	return config, true, nil
+}
+
+// KeyExportConfig returns configuration for the break-glass key export
+func (s *DRM) KeyExportConfig() drm.KeyExportConfig {
+	return drm.KeyExportConfig{
+		Allowed:  s.AllowKeyExport,
+		Password: s.KeyExportPassword,
+	}
+}
+
+// BuiltinEngine reports whether the builtin encryptor is used
+func (s *DRM) BuiltinEngine() bool {
+	return s.Enabled && s.Engine == DRMEngineBuiltin
+}
+
+// KeyProviderName names the provider of KeyProvider in logs and errors
+func (s *DRM) KeyProviderName() string {
+	switch {
+	case s.CPIXFile != "" || s.CPIXURL != "":
+		return "cpix"
+	case s.keyServer():
+		return s.Provider
+	case len(s.KeyProviders) > 0:
+		return "key_providers"
+	case s.KeysFile != "":
+		return "file:" + s.KeysFile
+	default:
+		return DRMProviderStatic
+	}
+}
+
+// KeyProvider maps the key configuration to a provider, the legacy
+// drm.key_id, drm.key and drm.iv flags become a single key of generation 0
+func (s *DRM) KeyProvider() (drm.KeyProvider, error) {
+	if s.CPIXFile != "" || s.CPIXURL != "" {
+		return s.cpixKeyProvider()
+	}
+
+	switch s.Provider {
+	case "", DRMProviderStatic:
+	case DRMProviderWidevine, DRMProviderSPEKE, DRMProviderVault, DRMProviderKMS:
+		if len(s.KeyProviders) > 0 {
+			return nil, fmt.Errorf("drm.provider=%s cannot be combined with drm.key_providers, list %s in drm.key_providers instead", s.Provider, s.Provider)
+		}
+		if s.KeyID != "" || s.Key != "" || s.IV != "" || len(s.Keys) > 0 || s.KeysFile != "" {
+			return nil, fmt.Errorf("drm.provider=%s cannot be combined with static keys, remove drm.key_id, drm.key, drm.iv, drm.keys and drm.keys_file", s.Provider)
+		}
+		return s.keyServerProvider(s.Provider)
+	default:
+		return nil, fmt.Errorf("drm.provider must be %s, %s, %s, %s or %s, got %q", DRMProviderStatic, DRMProviderWidevine, DRMProviderSPEKE, DRMProviderVault, DRMProviderKMS, s.Provider)
+	}
+
+	if len(s.KeyProviders) == 0 {
+		return s.staticKeyProvider()
+	}
+
+	if s.Engine != DRMEngineBuiltin {
+		return nil, errors.New("drm.key_providers requires the builtin engine")
+	}
+
+	providers := make([]drm.NamedProvider, 0, len(s.KeyProviders))
+	for _, entry := range s.KeyProviders {
+		var provider drm.KeyProvider
+
+		switch kind, path, _ := strings.Cut(entry, ":"); kind {
+		case "keys":
+			static, err := s.staticKeyProvider()
+			if err != nil {
+				return nil, err
+			}
+			provider = static
+		case "file":
+			if path == "" {
+				return nil, errors.New("drm.key_providers file entry requires a path as file:<path>")
+			}
+			provider = drm.NewFileKeyProvider(path)
+		case DRMProviderWidevine, DRMProviderSPEKE, DRMProviderVault, DRMProviderKMS:
+			server, err := s.keyServerProvider(kind)
+			if err != nil {
+				return nil, err
+			}
+			provider = server
+		default:
+			return nil, fmt.Errorf("drm.key_providers entries must be keys, file:<path>, widevine, speke, vault or kms, got %q", entry)
+		}
+
+		providers = append(providers, drm.NamedProvider{Name: entry, Provider: provider})
+	}
+
+	return drm.NewFailoverProvider(providers...), nil
+}
+
+func (s *DRM) cpixKeyProvider() (drm.KeyProvider, error) {
+	if s.CPIXFile != "" && s.CPIXURL != "" {
+		return nil, errors.New("drm.cpix_file and drm.cpix_url cannot be combined")
+	}
+
+	if s.Engine != DRMEngineBuiltin {
+		return nil, errors.New("drm.cpix_file and drm.cpix_url require the builtin engine")
+	}
+
+	if len(s.KeyProviders) > 0 || s.keyServer() {
+		return nil, errors.New("drm.cpix_file and drm.cpix_url cannot be combined with drm.key_providers or a key server drm.provider")
+	}
+
+	source := s.CPIXFile
+	if source == "" {
+		source = s.CPIXURL
+	}
+	return provider.NewCPIXProvider(source), nil
+}
+
+// keyServerProvider creates the provider of a key server drm.provider
+func (s *DRM) keyServerProvider(name string) (drm.KeyProvider, error) {
+	switch name {
+	case DRMProviderWidevine:
+		return s.widevineKeyProvider()
+	case DRMProviderSPEKE:
+		return s.spekeKeyProvider()
+	case DRMProviderVault:
+		return s.vaultKeyProvider()
+	default:
+		return s.kmsKeyProvider()
+	}
+}
+
+func (s *DRM) widevineKeyProvider() (drm.KeyProvider, error) {
+	if s.Engine != DRMEngineBuiltin {
+		return nil, errors.New("drm.provider=widevine requires the builtin engine")
+	}
+
+	widevine, err := provider.NewWidevineProvider(provider.WidevineConfig{
+		URL:        s.Widevine.URL,
+		Provider:   s.Widevine.Provider,
+		SigningKey: s.Widevine.SigningKey,
+		SigningIV:  s.Widevine.SigningIV,
+		ContentID:  s.Widevine.ContentID,
+		Track:      s.Widevine.Track,
+		Scheme:     s.Mode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("drm.widevine: %w", err)
+	}
+	return widevine, nil
+}
+
+func (s *DRM) spekeKeyProvider() (drm.KeyProvider, error) {
+	if s.Engine != DRMEngineBuiltin {
+		return nil, errors.New("drm.provider=speke requires the builtin engine")
+	}
+
+	systemIDs := make([][16]byte, 0, len(s.SPEKE.SystemIDs))
+	for _, system := range s.SPEKE.SystemIDs {
+		id, err := provider.ParseSystemID(system)
+		if err != nil {
+			return nil, fmt.Errorf("drm.speke.system_ids: %w", err)
+		}
+		systemIDs = append(systemIDs, id)
+	}
+
+	speke, err := provider.NewSPEKEProvider(provider.SPEKEConfig{
+		URL:        s.SPEKE.URL,
+		ResourceID: s.SPEKE.ResourceID,
+		SystemIDs:  systemIDs,
+		Region:     s.SPEKE.AWSRegion,
+		Profile:    s.SPEKE.AWSProfile,
+		Role:       s.SPEKE.AWSRole,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("drm.speke: %w", err)
+	}
+	return speke, nil
+}
+
+func (s *DRM) vaultKeyProvider() (drm.KeyProvider, error) {
+	if s.Engine != DRMEngineBuiltin {
+		return nil, errors.New("drm.provider=vault requires the builtin engine")
+	}
+
+	vault, err := provider.NewVaultProvider(provider.VaultConfig{
+		Addr:      s.Vault.Addr,
+		Path:      s.Vault.Path,
+		Namespace: s.Vault.Namespace,
+		Auth:      s.Vault.Auth,
+		Token:     s.Vault.Token,
+		Role:      s.Vault.Role,
+		AuthMount: s.Vault.AuthMount,
+		Refresh:   s.Vault.Refresh,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("drm.vault: %w", err)
+	}
+	return vault, nil
+}
+
+func (s *DRM) kmsKeyProvider() (drm.KeyProvider, error) {
+	if s.Engine != DRMEngineBuiltin {
+		return nil, errors.New("drm.provider=kms requires the builtin engine")
+	}
+
+	kms, err := provider.NewKMSProvider(provider.KMSConfig{
+		KeyARN:     s.KMS.KeyARN,
+		Ciphertext: s.KMS.Ciphertext,
+		Region:     s.KMS.AWSRegion,
+		Profile:    s.KMS.AWSProfile,
+		Role:       s.KMS.AWSRole,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("drm.kms: %w", err)
+	}
+	return kms, nil
+}
+
+func (s *DRM) staticKeyProvider() (drm.KeyProvider, error) {
+	legacy := s.KeyID != "" || s.Key != "" || s.IV != ""
+
+	if legacy && s.KeysFile != "" {
+		return nil, errors.New("drm.key_id, drm.key and drm.iv cannot be combined with drm.keys_file, move the key into the file as key_id:key:iv")
+	}
+
+	if legacy && len(s.Keys) > 0 {
+		return nil, errors.New("drm.key_id, drm.key and drm.iv cannot be combined with drm.keys, move the key into drm.keys as key_id:key:iv and remove the legacy options")
+	}
+
+	if legacy {
+		return drm.NewStaticKeyProvider(drm.Key{
+			Generation: 0,
+			KeyID:      s.KeyID,
+			Key:        s.Key,
+			IV:         s.IV,
+		}), nil
+	}
+
+	if (len(s.Keys) > 0 || s.KeysFile != "") && s.Engine != DRMEngineBuiltin {
+		return nil, errors.New("drm.keys requires the builtin engine, the cencryptor engine only supports drm.key_id, drm.key and drm.iv")
+	}
+
+	// read on startup by the manager, errors name the line
+	if s.KeysFile != "" {
+		return drm.NewFileKeyProvider(s.KeysFile), nil
+	}
+
+	keys := make([]drm.Key, 0, len(s.Keys))
+	for i, entry := range s.Keys {
+		key, err := drm.ParseKey(entry)
+		if err != nil {
+			return nil, fmt.Errorf("drm.keys entry %d: %w", i+1, err)
+		}
+
+		key.Generation = uint64(i + 1)
+		keys = append(keys, key)
+	}
+
+	return drm.NewStaticKeyProvider(keys...), nil
+}
+
+// loadSecretFiles replaces the inline key material with the content of the
+// secret files, so that the key never shows up in the process list
+func (s *DRM) loadSecretFiles() error {
+	secrets := []struct {
+		flag  string
+		path  string
+		value *string
+	}{
+		{"drm.key_id_file", s.KeyIDFile, &s.KeyID},
+		{"drm.key_file", s.KeyFile, &s.Key},
+		{"drm.iv_file", s.IVFile, &s.IV},
+	}
+
+	var errs []error
+	if s.SessionSecretFile != "" {
+		data, err := os.ReadFile(s.SessionSecretFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("drm.session_secret_file: %w", err))
+		} else {
+			s.SessionSecret = strings.TrimSpace(string(data))
+		}
+	}
+	if s.MasterSecretFile != "" {
+		data, err := os.ReadFile(s.MasterSecretFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("drm.master_secret_file: %w", err))
+		} else {
+			s.MasterSecret = strings.TrimSpace(string(data))
+		}
+	}
+
+	for _, secret := range secrets {
+		if secret.path == "" {
+			continue
+		}
+
+		value, err := readSecretFile(secret.path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", secret.flag, err))
+			continue
+		}
+		*secret.value = value
+	}
+
+	return errors.Join(errs...)
+}
+
+// readSecretFile returns the 16 bytes of a secret file hex encoded, the
+// file holds them raw, hex or base64 encoded with surrounding whitespace
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) == 16 {
+		return hex.EncodeToString(data), nil
+	}
+
+	b, err := drm.DecodeKeyBytes(string(data))
+	if err != nil || len(b) != 16 {
+		return "", fmt.Errorf("%s must hold 16 bytes raw, hex or base64 encoded, got %d bytes", path, len(data))
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// EncryptorConfig returns configuration for the builtin encryptor using
+// the given key for video, the audio key stays as configured. Once video
+// is clear the given key is the audio key, unless audio has one.
+func (s *DRM) EncryptorConfig(key drm.Key) drm.Config {
+	var tracks map[string]drm.TrackKey
+	switch {
+	case s.AudioKey != (drm.TrackKey{}):
+		tracks = map[string]drm.TrackKey{drm.TrackAudio: s.AudioKey}
+	case !s.EncryptVideo:
+		tracks = map[string]drm.TrackKey{drm.TrackAudio: {KeyID: key.KeyID, Key: key.Key, IV: key.IV}}
+	case s.encryptAudioSet && s.EncryptAudio:
+		// generated along with the video key
+		tracks = map[string]drm.TrackKey{drm.TrackAudio: {}}
+	}
+
+	// the pattern flags have defaults, they only mean something with cbcs
+	// and cens
+	cryptBlocks, skipBlocks := s.CryptBlocks, s.SkipBlocks
+	if !drm.PatternScheme(s.Mode) {
+		cryptBlocks, skipBlocks = 0, 0
+	}
+
+	return drm.Config{
+		Enabled:          s.BuiltinEngine(),
+		KeyID:            key.KeyID,
+		Key:              key.Key,
+		IV:               key.IV,
+		Mode:             s.Mode,
+		IVMode:           s.IVMode,
+		CryptBlocks:      cryptBlocks,
+		SkipBlocks:       skipBlocks,
+		StrictPattern:    s.StrictPattern,
+		AutoGenerate:     s.AutoGenerate,
+		Codec:            s.Codec,
+		Tracks:           tracks,
+		ClearTracks:      s.ClearTracks(),
+		NALFormat:        s.NALFormat,
+		NALLengthSize:    s.NALLengthSize,
+		EncryptShortNALs: s.EncryptShortNALs,
+		MinEncryptSize:   s.MinEncryptSize,
+		EncryptNALTypes:  s.EncryptNALTypes,
+		ClearLead:        s.ClearLead,
+		Parallelism:      s.Parallelism,
+		ActivationSkew:   s.ActivationSkew,
+		KeyOverlap:       s.KeyOverlap,
+		Generation:       key.Generation,
+		KeySEI:           s.KeySEI,
+		PSSHSystems:      s.PSSHSystems,
+		PlayReady: drm.PlayReadyConfig{
+			LAURL: s.PlayReadyLAURL(),
+		},
+		FairPlay: drm.FairPlayConfig{
+			SKDURL:         s.FairPlay.SKDURL,
+			CertificateURL: s.FairPlay.CertificateURL,
+		},
+		Paranoid: s.ParanoidChecks,
+
+		PrependFrameHeader: s.FrameHeader,
+		LayerIVs:           s.LayerIVs,
+		StrictStreamChecks: s.StrictStreamChecks,
+		Strict:             s.Strict,
+		RejectReencryption: s.RejectReencryption,
+		StreamChecks: drm.StreamCheckConfig{
+			AllowDataPartitioning: s.AllowDataPartitioning,
+			MaxFillerRatio:        s.MaxFillerRatio,
+		},
+	}
 }
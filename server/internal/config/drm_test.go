@@ -0,0 +1,1446 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/drm/provider"
+)
+
+// configuration file as used by releases with a single flat key
+const legacyDRMConfig = `
+drm:
+  enabled: true
+  engine: builtin
+  key_id: "00000000000000000000000000000001"
+  key: 3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c
+  iv: d5fbd6b82ed93e4ef98ae40931ee33b7
+  mode: cbcs
+  crypt_blocks: 1
+  skip_blocks: 9
+`
+
+func loadDRMConfig(t *testing.T, content string) DRM {
+	t.Helper()
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	cmd := &cobra.Command{}
+	if err := (DRM{}).Init(cmd); err != nil {
+		t.Fatalf("Init() returned error: %s", err)
+	}
+
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(content)); err != nil {
+		t.Fatalf("unable to read config: %s", err)
+	}
+
+	var config DRM
+	config.Set()
+	return config
+}
+
+func TestDRM_legacyKeyMigration(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig)
+
+	provider, err := config.KeyProvider()
+	if err != nil {
+		t.Fatalf("KeyProvider() returned error: %s", err)
+	}
+
+	keys, err := provider.GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+
+	key, ok := drm.CurrentKey(keys)
+	if !ok || len(keys) != 1 || key.Generation != 0 {
+		t.Fatalf("legacy key = %+v (of %d), want single key of generation 0", key, len(keys))
+	}
+
+	migrated, err := drm.NewEncryptor(config.EncryptorConfig(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+
+	// the encryptor as configured before keys were introduced
+	previous, err := drm.NewEncryptor(drm.Config{
+		Enabled:     true,
+		KeyID:       "00000000000000000000000000000001",
+		Key:         "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c",
+		IV:          "d5fbd6b82ed93e4ef98ae40931ee33b7",
+		Mode:        "cbcs",
+		CryptBlocks: 1,
+		SkipBlocks:  9,
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+
+	frame := append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0xaa}, 300)...)
+
+	got, err := migrated.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	want, err := previous.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("migrated config produces different ciphertext")
+	}
+}
+
+func TestDRM_trackKeys(t *testing.T) {
+	const (
+		videoKeys = `
+  video:
+    key_id: "00000000000000000000000000000001"
+    key: 3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c
+    iv: d5fbd6b82ed93e4ef98ae40931ee33b7
+`
+		audioKeys = `
+  audio:
+    key_id: "00000000000000000000000000000002"
+    key: 4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d
+    iv: 0ffbd6b82ed93e4ef98ae40931ee33b7
+`
+	)
+
+	tests := []struct {
+		name      string
+		content   string
+		wantErr   string
+		wantAudio bool
+	}{
+		{"flat key is video", legacyDRMConfig, "", false},
+		{"video key", legacyDRMConfig[:strings.Index(legacyDRMConfig, "  key_id")] + videoKeys, "", false},
+		{"video key same as flat", legacyDRMConfig + videoKeys, "", false},
+		{"video key conflicts with flat", strings.Replace(legacyDRMConfig, "0001", "0003", 1) + videoKeys, "conflict with drm.key_id", false},
+		{"audio key", legacyDRMConfig + audioKeys, "", true},
+		{"incomplete audio key", legacyDRMConfig + strings.Replace(audioKeys, "    iv:", "    #iv:", 1), "set together", false},
+		{"audio key with cencryptor engine", strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1) + audioKeys, "requires the builtin engine", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadDRMConfig(t, tt.content)
+
+			err := config.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() returned error: %s", err)
+			}
+
+			provider, err := config.KeyProvider()
+			if err != nil {
+				t.Fatalf("KeyProvider() returned error: %s", err)
+			}
+			keys, err := provider.GetKeys(context.Background())
+			if err != nil {
+				t.Fatalf("GetKeys() returned error: %s", err)
+			}
+			key, _ := drm.CurrentKey(keys)
+
+			set, err := drm.NewEncryptorSet(config.EncryptorConfig(key))
+			if err != nil {
+				t.Fatalf("NewEncryptorSet() returned error: %s", err)
+			}
+
+			if got := hex.EncodeToString(set.KeyID(drm.TrackVideo)); got != "00000000000000000000000000000001" {
+				t.Errorf("KeyID(%q) = %s, want the video key", drm.TrackVideo, got)
+			}
+			if got := set.KeyID(drm.TrackAudio); (got != nil) != tt.wantAudio {
+				t.Errorf("KeyID(%q) = %x, want audio key %v", drm.TrackAudio, got, tt.wantAudio)
+			}
+		})
+	}
+}
+
+func TestDRM_modeAndPattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantErr  string
+		wantMode string
+	}{
+		{"cbcs", legacyDRMConfig, "", "cbcs"},
+		{"upper case mode", strings.Replace(legacyDRMConfig, "mode: cbcs", "mode: CENC", 1), "", "cenc"},
+		{"cens", strings.Replace(legacyDRMConfig, "mode: cbcs", "mode: cens", 1), "", "cens"},
+		{"cbc1", strings.Replace(legacyDRMConfig, "mode: cbcs", "mode: cbc1", 1), "", "cbc1"},
+		{"unknown mode", strings.Replace(legacyDRMConfig, "mode: cbcs", "mode: cbc2", 1), "must be cbcs, cenc, cens or cbc1", ""},
+		{"strict pattern", legacyDRMConfig + "  strict_pattern: true\n", "", "cbcs"},
+		{"strict pattern cens violated", strings.Replace(strings.Replace(legacyDRMConfig, "skip_blocks: 9", "skip_blocks: 0", 1), "mode: cbcs", "mode: cens", 1) + "  strict_pattern: true\n", "add up to 10", ""},
+		{"strict pattern violated", strings.Replace(legacyDRMConfig, "skip_blocks: 9", "skip_blocks: 0", 1) + "  strict_pattern: true\n", "add up to 10", ""},
+		{"strict pattern adaptive", legacyDRMConfig + "  strict_pattern: true\n  pattern: adaptive\n", "requires drm.pattern=fixed", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadDRMConfig(t, tt.content)
+
+			err := config.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() returned error: %s", err)
+			}
+
+			key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+			e, err := drm.NewEncryptor(config.EncryptorConfig(key))
+			if err != nil {
+				t.Fatalf("NewEncryptor() returned error: %s", err)
+			}
+			if got := e.Profile().Mode; got != tt.wantMode {
+				t.Errorf("Profile().Mode = %q, want %q", got, tt.wantMode)
+			}
+			if got := e.Warnings(); len(got) > 0 {
+				t.Errorf("Warnings() = %q, want none for the default pattern flags", got)
+			}
+		})
+	}
+}
+
+func TestDRM_autoGenerate(t *testing.T) {
+	const content = `
+drm:
+  enabled: true
+  engine: builtin
+  auto_generate: true
+`
+
+	config := loadDRMConfig(t, content)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	provider, err := config.KeyProvider()
+	if err != nil {
+		t.Fatalf("KeyProvider() returned error: %s", err)
+	}
+	keys, err := provider.GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if _, ok := drm.CurrentKey(keys); ok {
+		t.Fatalf("CurrentKey() found a key, want none configured")
+	}
+
+	e, err := drm.NewEncryptor(config.EncryptorConfig(drm.Key{}))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if got := e.KeyID(); len(got) != 16 {
+		t.Errorf("KeyID() = %x, want a generated key ID", got)
+	}
+
+	config = loadDRMConfig(t, strings.Replace(content, "builtin", "cencryptor", 1))
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "requires the builtin engine") {
+		t.Errorf("Validate() error = %v, want the builtin engine required", err)
+	}
+}
+
+func TestDRM_frameHeader(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig+"  frame_header: true\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+	e, err := drm.NewEncryptor(config.EncryptorConfig(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if !e.PrependsFrameHeader() {
+		t.Errorf("PrependsFrameHeader() = false with drm.frame_header")
+	}
+
+	config = loadDRMConfig(t, strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1)+"  frame_header: true\n")
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "requires the builtin engine") {
+		t.Errorf("Validate() error = %v, want the builtin engine required", err)
+	}
+}
+
+func TestDRM_layerIVs(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig+"  layer_ivs: true\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+	e, err := drm.NewEncryptor(config.EncryptorConfig(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if layer, err := e.ForLayer("hd"); err != nil || layer == e {
+		t.Errorf("ForLayer() = %p, %v, want an encryptor of its own with drm.layer_ivs", layer, err)
+	}
+
+	config = loadDRMConfig(t, strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1)+"  layer_ivs: true\n")
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "requires the builtin engine") {
+		t.Errorf("Validate() error = %v, want the builtin engine required", err)
+	}
+}
+
+func TestDRM_minEncryptSize(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig+"  min_encrypt_size: 48\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+	if got := config.EncryptorConfig(drm.Key{}).MinEncryptSize; got != 48 {
+		t.Errorf("EncryptorConfig().MinEncryptSize = %d, want 48", got)
+	}
+
+	for name, content := range map[string]string{
+		"cencryptor": strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1) + "  min_encrypt_size: 48\n",
+		"ctr":        legacyDRMConfig + "  min_encrypt_size: 48\n  encrypt_short_nals: ctr\n",
+	} {
+		config := loadDRMConfig(t, content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "drm.min_encrypt_size") {
+			t.Errorf("Validate() %s error = %v, want drm.min_encrypt_size rejected", name, err)
+		}
+	}
+}
+
+func TestDRM_encryptNALTypes(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig+"  encrypt_nal_types: [1, 5, 6]\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+	if got := config.EncryptorConfig(drm.Key{}).EncryptNALTypes; !reflect.DeepEqual(got, []int{1, 5, 6}) {
+		t.Errorf("EncryptorConfig().EncryptNALTypes = %v, want [1 5 6]", got)
+	}
+
+	for name, content := range map[string]string{
+		"cencryptor": strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1) + "  encrypt_nal_types: [1, 5]\n",
+		"SPS":        legacyDRMConfig + "  encrypt_nal_types: [1, 5, 7]\n",
+		"PPS":        legacyDRMConfig + "  encrypt_nal_types: [8]\n",
+		"key_sei":    legacyDRMConfig + "  encrypt_nal_types: [1, 5, 6]\n  key_sei: true\n",
+	} {
+		config := loadDRMConfig(t, content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "drm.encrypt_nal_types") {
+			t.Errorf("Validate() %s error = %v, want drm.encrypt_nal_types rejected", name, err)
+		}
+	}
+}
+
+func TestDRM_keyOverlap(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig+"  key_overlap: 30s\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+	if got := config.EncryptorConfig(drm.Key{}).KeyOverlap; got != 30*time.Second {
+		t.Errorf("EncryptorConfig().KeyOverlap = %s, want 30s", got)
+	}
+
+	for name, content := range map[string]string{
+		"cencryptor": strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1) + "  key_overlap: 30s\n",
+		"negative":   legacyDRMConfig + "  key_overlap: -1s\n",
+		"layer_ivs":  legacyDRMConfig + "  key_overlap: 30s\n  layer_ivs: true\n",
+	} {
+		config := loadDRMConfig(t, content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "drm.key_overlap") {
+			t.Errorf("Validate() %s error = %v, want drm.key_overlap rejected", name, err)
+		}
+	}
+}
+
+func TestDRM_keyRotation(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig+"  key_rotation_interval: 1h\n  key_rotation_jitter: 5m\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+	if got := config.CryptoPeriod(); got != (drm.CryptoPeriod{Interval: time.Hour, Jitter: 5 * time.Minute}) {
+		t.Errorf("CryptoPeriod() = %+v, want 1h with 5m jitter", got)
+	}
+	if config.RotatesFromProvider() {
+		t.Errorf("RotatesFromProvider() = true for static keys")
+	}
+
+	config.Provider = DRMProviderVault
+	if !config.RotatesFromProvider() {
+		t.Errorf("RotatesFromProvider() = false for drm.provider=vault")
+	}
+
+	for name, tt := range map[string]struct {
+		content string
+		wantErr string
+	}{
+		"cencryptor":      {strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1) + "  key_rotation_interval: 1h\n", "drm.key_rotation_interval"},
+		"negative":        {legacyDRMConfig + "  key_rotation_interval: -1h\n", "drm.key_rotation_interval"},
+		"jitter too long": {legacyDRMConfig + "  key_rotation_interval: 1h\n  key_rotation_jitter: 1h\n", "drm.key_rotation_interval"},
+		"jitter alone":    {legacyDRMConfig + "  key_rotation_jitter: 5m\n", "drm.key_rotation_jitter"},
+		"session keys":    {legacyDRMConfig + "  key_rotation_interval: 1h\n  session_keys: true\n  session_secret: 5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a\n", "drm.session_keys"},
+	} {
+		config := loadDRMConfig(t, tt.content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Validate() %s error = %v, want %s rejected", name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDRM_ivMode(t *testing.T) {
+	cenc := strings.Replace(legacyDRMConfig, "mode: cbcs", "mode: cenc", 1)
+	config := loadDRMConfig(t, cenc+"  iv_mode: derived\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+	e, err := drm.NewEncryptor(config.EncryptorConfig(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if got := e.Profile().IVMode; got != drm.IVModeDerived {
+		t.Errorf("Profile() iv mode = %s, want %s", got, drm.IVModeDerived)
+	}
+
+	// constant stays the default of cbcs
+	config = loadDRMConfig(t, legacyDRMConfig)
+	if e, err := drm.NewEncryptor(config.EncryptorConfig(key)); err != nil || e.Profile().IVMode != drm.IVModeConstant {
+		t.Errorf("NewEncryptor() of cbcs without drm.iv_mode = %v, want the constant IV", err)
+	}
+
+	for name, content := range map[string]string{
+		"cbcs":       legacyDRMConfig + "  iv_mode: sequence\n",
+		"cenc":       cenc + "  iv_mode: constant\n",
+		"unknown":    cenc + "  iv_mode: random\n",
+		"cencryptor": strings.Replace(cenc, "builtin", "cencryptor", 1) + "  iv_mode: derived\n",
+	} {
+		config := loadDRMConfig(t, content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "drm.iv_mode") {
+			t.Errorf("Validate() %s error = %v, want drm.iv_mode rejected", name, err)
+		}
+	}
+}
+
+func TestDRM_strict(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig+"  strict: true\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+	e, err := drm.NewEncryptor(config.EncryptorConfig(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if _, err := e.Encrypt([]byte{0x65, 0x88, 0x84, 0x00}); !errors.Is(err, drm.ErrNoStartCode) {
+		t.Errorf("Encrypt() error = %v, want %v with drm.strict", err, drm.ErrNoStartCode)
+	}
+
+	config = loadDRMConfig(t, strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1)+"  strict: true\n")
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "requires the builtin engine") {
+		t.Errorf("Validate() error = %v, want the builtin engine required", err)
+	}
+}
+
+func TestDRM_rejectReencryption(t *testing.T) {
+	config := loadDRMConfig(t, legacyDRMConfig+"  reject_reencryption: true\n")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+	e, err := drm.NewEncryptor(config.EncryptorConfig(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	frame := append([]byte{0, 0, 0, 1, 0x65, 0x88, 0x84}, make([]byte, 64)...)
+	out, err := e.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if _, err := e.Encrypt(out); !errors.Is(err, drm.ErrAlreadyEncrypted) {
+		t.Errorf("Encrypt() error = %v, want %v with drm.reject_reencryption", err, drm.ErrAlreadyEncrypted)
+	}
+
+	config = loadDRMConfig(t, strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1)+"  reject_reencryption: true\n")
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "drm.reject_reencryption requires the builtin engine") {
+		t.Errorf("Validate() error = %v, want the builtin engine required", err)
+	}
+}
+
+func TestDRM_fairPlay(t *testing.T) {
+	fairPlay := "  fairplay:\n    skd_url: skd://keys.example.com/{keyId}\n    certificate_url: https://keys.example.com/fps.cer\n"
+
+	config := loadDRMConfig(t, legacyDRMConfig+fairPlay)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+	e, err := drm.NewEncryptor(config.EncryptorConfig(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	info := e.Info().FairPlay
+	if info == nil || info.SKDURI != "skd://keys.example.com/00000000000000000000000000000001" || info.CertificateURL != "https://keys.example.com/fps.cer" {
+		t.Errorf("Info().FairPlay = %+v, want the skd URI of the key ID", info)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"cenc", strings.Replace(legacyDRMConfig, "mode: cbcs", "mode: cenc", 1) + fairPlay, "requires drm.mode=cbcs"},
+		{"pattern", strings.Replace(legacyDRMConfig, "skip_blocks: 9", "skip_blocks: 5", 1) + fairPlay, "drm.skip_blocks=9"},
+		{"adaptive pattern", legacyDRMConfig + "  pattern: adaptive\n" + fairPlay, "requires drm.pattern=fixed"},
+		{"https url", legacyDRMConfig + "  fairplay:\n    skd_url: https://keys.example.com\n", "must be an skd:// URL"},
+		{"certificate only", legacyDRMConfig + "  fairplay:\n    certificate_url: https://keys.example.com/fps.cer\n", "requires drm.fairplay.skd_url"},
+		{"cencryptor", strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1) + fairPlay, "requires the builtin engine"},
+	}
+
+	for _, tt := range tests {
+		config := loadDRMConfig(t, tt.content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Validate() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDRM_base64Keys(t *testing.T) {
+	// the legacy key as a KMS exports it
+	config := loadDRMConfig(t, `
+drm:
+  enabled: true
+  engine: builtin
+  key_id: AAAAAAAAAAAAAAAAAAAAAQ==
+  key: PDw8PDw8PDw8PDw8PDw8PA
+  iv: 1fvWuC7ZPk75iuQJMe4ztw==
+  mode: cbcs
+  crypt_blocks: 1
+  skip_blocks: 9
+`)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	legacy := loadDRMConfig(t, legacyDRMConfig)
+	if config.KeyID != legacy.KeyID || config.Key != legacy.Key || config.IV != legacy.IV {
+		t.Errorf("Set() key = %s:%s:%s, want %s:%s:%s", config.KeyID, config.Key, config.IV, legacy.KeyID, legacy.Key, legacy.IV)
+	}
+}
+
+func TestDRM_masterSecret(t *testing.T) {
+	const secret = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	derived, err := drm.DeriveHex(secret, "stream-1/2026-10-16")
+	if err != nil {
+		t.Fatalf("DeriveHex() returned error: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "master_secret")
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatalf("unable to write secret file: %s", err)
+	}
+
+	base := "drm:\n  enabled: true\n  engine: builtin\n  mode: cbcs\n  crypt_blocks: 1\n  skip_blocks: 9\n  derivation_context: stream-1/2026-10-16\n"
+	tests := []struct {
+		name    string
+		content string
+		want    drm.TrackKey
+		wantErr string
+	}{
+		{"derived", base + "  master_secret: " + secret + "\n", derived, ""},
+		{"secret file", base + "  master_secret_file: " + path + "\n", derived, ""},
+		{"explicit keys win", legacyDRMConfig + "  master_secret: " + secret + "\n", drm.TrackKey{KeyID: "00000000000000000000000000000001", Key: "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c", IV: "d5fbd6b82ed93e4ef98ae40931ee33b7"}, ""},
+		{"short secret", base + "  master_secret: 0001020304050607\n", drm.TrackKey{}, "drm.master_secret must be at least 16 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadDRMConfig(t, tt.content)
+			err := config.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() returned error: %s", err)
+			}
+
+			provider, err := config.KeyProvider()
+			if err != nil {
+				t.Fatalf("KeyProvider() returned error: %s", err)
+			}
+			keys, err := provider.GetKeys(context.Background())
+			if err != nil {
+				t.Fatalf("GetKeys() returned error: %s", err)
+			}
+			if got := (drm.TrackKey{KeyID: keys[0].KeyID, Key: keys[0].Key, IV: keys[0].IV}); len(keys) != 1 || got != tt.want {
+				t.Errorf("GetKeys() = %+v, want %+v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestDRM_playReady(t *testing.T) {
+	playReady := "  pssh_systems: [cenc, playready]\n  playready:\n    la_url: https://license.example.com/pr\n"
+
+	config := loadDRMConfig(t, legacyDRMConfig+playReady)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+
+	key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+	e, err := drm.NewEncryptor(config.EncryptorConfig(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	initData, err := e.InitData()
+	if err != nil {
+		t.Fatalf("InitData() returned error: %s", err)
+	}
+	want, _ := drm.BuildPSSHOptions([]string{drm.PSSHSystemCommon, drm.PSSHSystemPlayReady}, [][]byte{e.KeyID()}, drm.PSSHOptions{
+		Scheme:         "cbcs",
+		PlayReadyLAURL: "https://license.example.com/pr",
+	})
+	if !bytes.Equal(initData, want) {
+		t.Errorf("InitData() = %x, want %x", initData, want)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"cens", strings.Replace(legacyDRMConfig, "mode: cbcs", "mode: cens", 1) + playReady, "requires drm.mode=cenc or cbcs"},
+		{"without system", legacyDRMConfig + "  playready:\n    la_url: https://license.example.com/pr\n", "requires playready in drm.pssh_systems"},
+	}
+
+	for _, tt := range tests {
+		config := loadDRMConfig(t, tt.content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Validate() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDRM_licenseURL(t *testing.T) {
+	licenseURLs := "  license_url: https://license.example.com/{keyId}\n  pssh_systems: [cenc, playready]\n  playready:\n    license_url: https://pr.example.com/?session={sessionId}\n"
+
+	config := loadDRMConfig(t, legacyDRMConfig+licenseURLs)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+	if got, want := config.LicenseURLs(), map[string]string{drm.PSSHSystemPlayReady: "https://pr.example.com/?session={sessionId}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LicenseURLs() = %v, want %v", got, want)
+	}
+	if got := config.PlayReadyLAURL(); got != config.PlayReady.LicenseURL {
+		t.Errorf("PlayReadyLAURL() = %s, want the PlayReady license server", got)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"http", legacyDRMConfig + "  license_url: http://license.example.com\n", "drm.license_url: license url must be an absolute https URL"},
+		{"relative", legacyDRMConfig + "  license_url: license\n", "drm.license_url: license url must be an absolute https URL"},
+		{"widevine", legacyDRMConfig + "  widevine:\n    license_url: http://wv.example.com\n", "drm.widevine.license_url"},
+		{"playready", legacyDRMConfig + "  playready:\n    license_url: //pr.example.com\n", "drm.playready.license_url"},
+	}
+
+	for _, tt := range tests {
+		config := loadDRMConfig(t, tt.content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Validate() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDRM_streams(t *testing.T) {
+	streams := "  streams:\n    broadcast:\n      key_id: AAAAAAAAAAAAAAAAAAAAAg==\n      key: 4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c\n      iv: e5fbd6b82ed93e4ef98ae40931ee33b7\n"
+
+	config := loadDRMConfig(t, legacyDRMConfig+streams)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+	want := map[string]drm.TrackKey{"broadcast": {
+		KeyID: "00000000000000000000000000000002",
+		Key:   "4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c",
+		IV:    "e5fbd6b82ed93e4ef98ae40931ee33b7",
+	}}
+	if !reflect.DeepEqual(config.Streams, want) {
+		t.Errorf("Streams = %+v, want the base64 key ID hex encoded", config.Streams)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"flat key ID", legacyDRMConfig + strings.Replace(streams, "AAAAAAAAAAAAAAAAAAAAAg==", "\"00000000000000000000000000000001\"", 1), "drm.streams.broadcast.key_id is the key ID of drm.key_id"},
+		{"shared key ID", legacyDRMConfig + streams + strings.Replace(streams, "  streams:\n    broadcast", "    second", 1), "drm.streams.second.key_id is the key ID of drm.streams.broadcast"},
+		{"incomplete", legacyDRMConfig + "  streams:\n    broadcast:\n      key_id: \"00000000000000000000000000000002\"\n", "have to be set together"},
+		{"key size", legacyDRMConfig + strings.Replace(streams, "4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c", "4c4c", 1), "drm.streams.broadcast.key"},
+		{"session keys", legacyDRMConfig + streams + "  session_keys: true\n  session_secret: 00112233445566778899aabbccddeeff\n", "cannot be combined with drm.session_keys"},
+		{"cencryptor", strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1) + streams, "drm.streams requires the builtin engine"},
+	}
+
+	for _, tt := range tests {
+		config := loadDRMConfig(t, tt.content)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Validate() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDRM_clearTracks(t *testing.T) {
+	audio := "  audio:\n    key_id: a1a2a3a4a5a6a7a8a9aaabacadaeafa0\n    key: b1b2b3b4b5b6b7b8b9babbbcbdbebfb0\n    iv: c1c2c3c4c5c6c7c8c9cacbcccdcecfc0\n"
+
+	tests := []struct {
+		name          string
+		content       string
+		wantEncrypted []string
+		wantErr       string
+	}{
+		{"legacy", legacyDRMConfig, []string{drm.TrackVideo}, ""},
+		{"audio key", legacyDRMConfig + audio, []string{drm.TrackAudio, drm.TrackVideo}, ""},
+		{"video only", legacyDRMConfig + audio + "  encrypt_audio: false\n", []string{drm.TrackVideo}, ""},
+		{"audio only", legacyDRMConfig + "  encrypt_video: false\n  encrypt_audio: true\n", []string{drm.TrackAudio}, ""},
+		{"audio only with its key", legacyDRMConfig + audio + "  encrypt_video: false\n", []string{drm.TrackAudio}, ""},
+		{"generated audio key", legacyDRMConfig + "  auto_generate: true\n  encrypt_audio: true\n", []string{drm.TrackAudio, drm.TrackVideo}, ""},
+		{"nothing encrypted", legacyDRMConfig + "  encrypt_video: false\n", nil, "requires drm.encrypt_audio"},
+		{"no audio key", legacyDRMConfig + "  encrypt_audio: true\n", nil, "drm.encrypt_audio requires"},
+		{"cencryptor", strings.Replace(legacyDRMConfig, "builtin", "cencryptor", 1) + "  encrypt_video: false\n  encrypt_audio: true\n", nil, "require the builtin engine"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadDRMConfig(t, tt.content)
+
+			err := config.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() returned error: %s", err)
+			}
+
+			key := drm.Key{KeyID: config.KeyID, Key: config.Key, IV: config.IV}
+			set, err := drm.NewEncryptorSet(config.EncryptorConfig(key))
+			if err != nil {
+				t.Fatalf("NewEncryptorSet() returned error: %s", err)
+			}
+			if got := set.EncryptedTracks(); !reflect.DeepEqual(got, tt.wantEncrypted) {
+				t.Errorf("EncryptedTracks() = %v, want %v", got, tt.wantEncrypted)
+			}
+		})
+	}
+}
+
+func TestDRM_secretFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("unable to write %s: %s", name, err)
+		}
+		return path
+	}
+
+	hexKey := write("key.hex", "  4D4D4D4D4D4D4D4D4D4D4D4D4D4D4D4D\n")
+	rawKey := write("key.raw", strings.Repeat("\x4d", 16))
+	shortKey := write("key.short", "4d4d4d4d\n")
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+		wantKey string
+	}{
+		{"inline", legacyDRMConfig, "", "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c"},
+		{"hex file", legacyDRMConfig + "  key_file: " + hexKey + "\n", "", "4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d"},
+		{"raw file", legacyDRMConfig + "  key_file: " + rawKey + "\n", "", "4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d"},
+		{"wrong length", legacyDRMConfig + "  iv_file: " + shortKey + "\n", "drm.iv_file", ""},
+		{"unreadable file", legacyDRMConfig + "  key_id_file: " + filepath.Join(dir, "missing") + "\n", "drm.key_id_file", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadDRMConfig(t, tt.content)
+
+			err := config.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() returned error: %s", err)
+			}
+			if config.Key != tt.wantKey {
+				t.Errorf("Key = %s, want %s", config.Key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestDRM_sessionKeys(t *testing.T) {
+	const secret = "5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a"
+	const content = `
+drm:
+  enabled: true
+  engine: builtin
+  session_keys: true
+  max_sessions: 4
+`
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte(strings.ToUpper(secret)+"\n"), 0o600); err != nil {
+		t.Fatalf("unable to write secret: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"inline secret", content + "  session_secret: " + secret + "\n", ""},
+		{"secret file", content + "  session_secret_file: " + secretFile + "\n", ""},
+		{"missing secret", content, "drm.session_secret"},
+		{"short secret", content + "  session_secret: 5a5a5a5a\n", "drm.session_secret"},
+		{"unreadable secret file", content + "  session_secret_file: " + secretFile + ".missing\n", "drm.session_secret_file"},
+		{"adaptive pattern", content + "  session_secret: " + secret + "\n  pattern: adaptive\n", "drm.pattern=fixed"},
+		{"cencryptor", strings.Replace(content, "builtin", "cencryptor", 1) + "  session_secret: " + secret + "\n", "requires the builtin engine"},
+		{"negative limit", legacyDRMConfig + "  max_sessions: -1\n", "drm.max_sessions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadDRMConfig(t, tt.content)
+
+			err := config.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() returned error: %s", err)
+			}
+
+			got, err := config.SessionKeySecret()
+			if err != nil || hex.EncodeToString(got) != secret {
+				t.Errorf("SessionKeySecret() = %x, %v, want %s", got, err, secret)
+			}
+			if config.MaxSessions != 4 {
+				t.Errorf("MaxSessions = %d, want 4", config.MaxSessions)
+			}
+		})
+	}
+}
+
+func TestDRM_keysFile(t *testing.T) {
+	const entry = "00000000000000000000000000000001:3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c:d5fbd6b82ed93e4ef98ae40931ee33b7"
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+		wantGen uint64
+	}{
+		{"single key", entry + "\n", "", 1},
+		{"comments and blank lines", "# rotated weekly\n" + entry + "\n\n" + entry + "\n", "", 2},
+		{"missing field", entry + "\n00000000000000000000000000000002:3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c\n", ":2: key must be in key_id:key:iv form", 0},
+		{"short key", "00000000000000000000000000000001:3c3c:d5fbd6b82ed93e4ef98ae40931ee33b7\n", ":1: key must be 16 bytes", 0},
+		{"empty", "# nothing yet\n", "no keys", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatalf("unable to write keys file: %s", err)
+			}
+
+			config := DRM{Engine: DRMEngineBuiltin, Keys: []string{entry}, KeysFile: path}
+			provider, err := config.KeyProvider()
+			if err != nil {
+				t.Fatalf("KeyProvider() returned error: %s", err)
+			}
+
+			keys, err := provider.GetKeys(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GetKeys() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetKeys() returned error: %s", err)
+			}
+
+			key, _ := drm.CurrentKey(keys)
+			if key.Generation != tt.wantGen {
+				t.Errorf("CurrentKey() generation = %d, want %d", key.Generation, tt.wantGen)
+			}
+		})
+	}
+
+	for _, config := range []DRM{
+		{Engine: DRMEngineBuiltin, KeyID: "00000000000000000000000000000001", KeysFile: "keys"},
+		{Engine: DRMEngineCencryptor, KeysFile: "keys"},
+	} {
+		if _, err := config.KeyProvider(); err == nil {
+			t.Errorf("KeyProvider() expected error for %+v", config)
+		}
+	}
+}
+
+func TestDRM_allErrors(t *testing.T) {
+	config := loadDRMConfig(t, `
+drm:
+  enabled: true
+  engine: builtin
+  key_id: "0001"
+  key: 3c3c3c3c3c3c3c3c3c3c3c3c
+  iv: d5fbd6b8
+  mode: cbcs
+`)
+
+	err := config.Validate()
+	var errs drm.ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("Validate() = %v, want three errors", err)
+	}
+	for _, want := range []string{
+		"drm.key_id must be 16 bytes hex or base64 encoded, got 2 bytes",
+		"drm.key must be 16 bytes hex or base64 encoded, got 12 bytes",
+		"drm.iv must be 16 bytes hex or base64 encoded, got 4 bytes",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error %q does not contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "3c3c3c") {
+		t.Errorf("Validate() error contains the key")
+	}
+
+	// mode and pattern errors come along
+	config.Mode = "cbc2"
+	config.NALLengthSize = 3
+	if err := config.Validate(); !errors.As(err, &errs) || len(errs) != 5 {
+		t.Errorf("Validate() = %v, want five errors", err)
+	}
+}
+
+func TestDRM_speke(t *testing.T) {
+	config := loadDRMConfig(t, `
+drm:
+  enabled: true
+  engine: builtin
+  provider: speke
+  speke:
+    url: https://speke.example.com/v1
+    resource_id: stream-1
+    system_ids: [widevine, playready]
+    aws_region: eu-west-1
+`)
+
+	if config.SPEKE.ResourceID != "stream-1" || len(config.SPEKE.SystemIDs) != 2 || config.SPEKE.AWSRegion != "eu-west-1" {
+		t.Fatalf("SPEKE = %+v", config.SPEKE)
+	}
+	if _, ok := must(config.KeyProvider()).(*provider.SPEKEProvider); !ok {
+		t.Errorf("KeyProvider() is not a SPEKE provider")
+	}
+	if got := config.KeyProviderName(); got != "speke" {
+		t.Errorf("KeyProviderName() = %s, want speke", got)
+	}
+
+	for name, tweak := range map[string]func(c *DRM){
+		"without region": func(c *DRM) { c.SPEKE.AWSRegion = "" },
+		"unknown system": func(c *DRM) { c.SPEKE.SystemIDs = []string{"clearkey"} },
+		"with static keys": func(c *DRM) {
+			c.Keys = []string{"00000000000000000000000000000001:3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c:d5fbd6b82ed93e4ef98ae40931ee33b7"}
+		},
+		"cencryptor engine":  func(c *DRM) { c.Engine = DRMEngineCencryptor },
+		"with key_providers": func(c *DRM) { c.KeyProviders = []string{"keys"} },
+	} {
+		c := config
+		tweak(&c)
+		if _, err := c.KeyProvider(); err == nil {
+			t.Errorf("KeyProvider() %s returned no error", name)
+		}
+	}
+}
+
+func TestDRM_vault(t *testing.T) {
+	config := loadDRMConfig(t, `
+drm:
+  enabled: true
+  engine: builtin
+  provider: vault
+  vault:
+    addr: https://vault.example.com:8200
+    path: secret/data/neko
+    auth: kubernetes
+    role: neko
+    refresh: 30s
+`)
+
+	if config.Vault.Path != "secret/data/neko" || config.Vault.Role != "neko" || config.Vault.Refresh != 30*time.Second {
+		t.Fatalf("Vault = %+v", config.Vault)
+	}
+	if _, ok := must(config.KeyProvider()).(*provider.VaultProvider); !ok {
+		t.Errorf("KeyProvider() is not a Vault provider")
+	}
+	if got := config.KeyProviderName(); got != "vault" {
+		t.Errorf("KeyProviderName() = %s, want vault", got)
+	}
+
+	for name, tweak := range map[string]func(c *DRM){
+		"without path":       func(c *DRM) { c.Vault.Path = "" },
+		"without role":       func(c *DRM) { c.Vault.Role = "" },
+		"unknown auth":       func(c *DRM) { c.Vault.Auth = "approle" },
+		"cencryptor engine":  func(c *DRM) { c.Engine = DRMEngineCencryptor },
+		"with key_providers": func(c *DRM) { c.KeyProviders = []string{"keys"} },
+	} {
+		c := config
+		tweak(&c)
+		if _, err := c.KeyProvider(); err == nil {
+			t.Errorf("KeyProvider() %s returned no error", name)
+		}
+	}
+}
+
+func TestDRM_kms(t *testing.T) {
+	config := loadDRMConfig(t, `
+drm:
+  enabled: true
+  engine: builtin
+  provider: kms
+  kms:
+    key_arn: arn:aws:kms:eu-west-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab
+    ciphertext: AQICAHg=
+`)
+
+	if _, ok := must(config.KeyProvider()).(*provider.KMSProvider); !ok {
+		t.Errorf("KeyProvider() is not a KMS provider")
+	}
+
+	for name, tweak := range map[string]func(c *DRM){
+		"without ciphertext": func(c *DRM) { c.KMS.Ciphertext = "" },
+		"invalid ciphertext": func(c *DRM) { c.KMS.Ciphertext = "not base64" },
+		"ARN without region": func(c *DRM) { c.KMS.KeyARN = "alias/neko" },
+		"cencryptor engine":  func(c *DRM) { c.Engine = DRMEngineCencryptor },
+	} {
+		c := config
+		tweak(&c)
+		if _, err := c.KeyProvider(); err == nil {
+			t.Errorf("KeyProvider() %s returned no error", name)
+		}
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func TestDRM_KeyProviderName(t *testing.T) {
+	tests := map[string]DRM{
+		"static":         {KeyID: "00000000000000000000000000000001"},
+		"file:/etc/keys": {KeysFile: "/etc/keys"},
+		"key_providers":  {KeyProviders: []string{"keys", "widevine"}},
+		"widevine":       {Provider: DRMProviderWidevine},
+		"cpix":           {CPIXURL: "https://kms.example.com/cpix"},
+	}
+
+	for want, config := range tests {
+		if got := config.KeyProviderName(); got != want {
+			t.Errorf("KeyProviderName() of %+v = %s, want %s", config, got, want)
+		}
+	}
+}
+
+func TestDRM_KeyProvider(t *testing.T) {
+	const entry = "00000000000000000000000000000001:3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c:d5fbd6b82ed93e4ef98ae40931ee33b7"
+
+	tests := []struct {
+		name    string
+		config  DRM
+		wantErr string
+		wantGen uint64
+	}{
+		{
+			name:    "legacy mixed with keys",
+			config:  DRM{Engine: DRMEngineBuiltin, KeyID: "00000000000000000000000000000001", Keys: []string{entry}},
+			wantErr: "cannot be combined",
+		},
+		{
+			name:    "keys with cencryptor engine",
+			config:  DRM{Engine: DRMEngineCencryptor, Keys: []string{entry}},
+			wantErr: "requires the builtin engine",
+		},
+		{
+			name:    "malformed keys entry",
+			config:  DRM{Engine: DRMEngineBuiltin, Keys: []string{entry, "00:11"}},
+			wantErr: "drm.keys entry 2",
+		},
+		{
+			name:    "keys get generations in order",
+			config:  DRM{Engine: DRMEngineBuiltin, Keys: []string{entry, entry}},
+			wantGen: 2,
+		},
+		{
+			name:    "widevine provider with cencryptor engine",
+			config:  DRM{Engine: DRMEngineCencryptor, Provider: DRMProviderWidevine},
+			wantErr: "requires the builtin engine",
+		},
+		{
+			name:    "widevine provider with static keys",
+			config:  DRM{Engine: DRMEngineBuiltin, Provider: DRMProviderWidevine, Keys: []string{entry}},
+			wantErr: "cannot be combined with static keys",
+		},
+		{
+			name:    "widevine provider without key server",
+			config:  DRM{Engine: DRMEngineBuiltin, Provider: DRMProviderWidevine},
+			wantErr: "drm.widevine",
+		},
+		{
+			name:    "cpix with cencryptor engine",
+			config:  DRM{Engine: DRMEngineCencryptor, CPIXFile: "/etc/neko/keys.cpix.xml"},
+			wantErr: "require the builtin engine",
+		},
+		{
+			name:    "cpix file and url",
+			config:  DRM{Engine: DRMEngineBuiltin, CPIXFile: "/etc/neko/keys.cpix.xml", CPIXURL: "https://kms.example.com/cpix"},
+			wantErr: "cannot be combined",
+		},
+		{
+			name:    "cpix with key providers",
+			config:  DRM{Engine: DRMEngineBuiltin, CPIXURL: "https://kms.example.com/cpix", KeyProviders: []string{"keys"}},
+			wantErr: "cannot be combined with drm.key_providers",
+		},
+		{
+			name:    "unknown provider",
+			config:  DRM{Engine: DRMEngineBuiltin, Provider: "hsm"},
+			wantErr: "drm.provider must be",
+		},
+		{
+			name:    "unknown key provider",
+			config:  DRM{Engine: DRMEngineBuiltin, KeyProviders: []string{"https://keys.example.com"}},
+			wantErr: "drm.key_providers entries must be",
+		},
+		{
+			name:    "failover to keys when the file is missing",
+			config:  DRM{Engine: DRMEngineBuiltin, Keys: []string{entry, entry}, KeyProviders: []string{"file:/nonexistent/keys", "keys"}},
+			wantGen: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := tt.config.KeyProvider()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("KeyProvider() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("KeyProvider() returned error: %s", err)
+			}
+
+			keys, _ := provider.GetKeys(context.Background())
+			if key, ok := drm.CurrentKey(keys); !ok || key.Generation != tt.wantGen {
+				t.Errorf("CurrentKey() = %+v, want generation %d", key, tt.wantGen)
+			}
+		})
+	}
+}
+
+func TestDRM_TunerConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       DRM
+		wantAdaptive bool
+		wantErr      bool
+	}{
+		{
+			name:   "fixed",
+			config: DRM{Enabled: true, Engine: DRMEngineBuiltin, Mode: "cbcs", Pattern: DRMPatternFixed},
+		},
+		{
+			name:         "adaptive",
+			config:       DRM{Enabled: true, Engine: DRMEngineBuiltin, Mode: "cbcs", Pattern: DRMPatternAdaptive, PatternFloor: "1:9", PatternCeiling: "5:5"},
+			wantAdaptive: true,
+		},
+		{
+			name:    "adaptive with cenc",
+			config:  DRM{Enabled: true, Engine: DRMEngineBuiltin, Mode: "cenc", Pattern: DRMPatternAdaptive, PatternFloor: "1:9", PatternCeiling: "5:5"},
+			wantErr: true,
+		},
+		{
+			name:         "adaptive with cens",
+			config:       DRM{Enabled: true, Engine: DRMEngineBuiltin, Mode: "cens", Pattern: DRMPatternAdaptive, PatternFloor: "1:9", PatternCeiling: "5:5"},
+			wantAdaptive: true,
+		},
+		{
+			name:    "adaptive with cencryptor",
+			config:  DRM{Enabled: true, Engine: DRMEngineCencryptor, Mode: "cbcs", Pattern: DRMPatternAdaptive, PatternFloor: "1:9", PatternCeiling: "5:5"},
+			wantErr: true,
+		},
+		{
+			name:    "malformed floor",
+			config:  DRM{Enabled: true, Engine: DRMEngineBuiltin, Mode: "cbcs", Pattern: DRMPatternAdaptive, PatternFloor: "1/9", PatternCeiling: "5:5"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown pattern",
+			config:  DRM{Pattern: "dynamic"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, adaptive, err := tt.config.TunerConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TunerConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if adaptive != tt.wantAdaptive {
+				t.Errorf("TunerConfig() adaptive = %v, want %v", adaptive, tt.wantAdaptive)
+			}
+		})
+	}
+}
+
+func TestDRM_presets(t *testing.T) {
+	// effective configuration with every other option left at its default
+	defaults := DRM{
+		Enabled:         true,
+		Engine:          DRMEngineBuiltin,
+		Mode:            "cbcs",
+		CryptBlocks:     1,
+		SkipBlocks:      9,
+		Codec:           drm.CodecH264,
+		NALFormat:       drm.NALFormatAnnexB,
+		NALLengthSize:   drm.DefaultNALLengthSize,
+		EncryptVideo:    true,
+		Provider:        DRMProviderStatic,
+		Keys:            []string{},
+		KeyProviders:    []string{},
+		Widevine:        DRMWidevine{Track: provider.DefaultWidevineTrack},
+		SPEKE:           DRMSPEKE{SystemIDs: []string{}},
+		Vault:           DRMVault{Auth: provider.VaultAuthToken, AuthMount: provider.VaultAuthKubernetes, Refresh: provider.DefaultVaultRefresh},
+		KeyStockAlert:   2,
+		Pattern:         DRMPatternFixed,
+		PatternFloor:    "1:9",
+		PatternCeiling:  "5:5",
+		MinEncryptSize:  drm.DefaultMinEncryptSize,
+		EncryptNALTypes: []int{},
+		ClearLead:       drm.DefaultClearLead,
+		PSSHSystems:     []string{drm.PSSHSystemCommon},
+		ActivationSkew:  drm.DefaultActivationSkew,
+		MaxFillerRatio:  drm.DefaultMaxFillerRatio,
+	}
+
+	const secret = "5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a"
+	strictConfig := "drm:\n  enabled: true\n  engine: builtin\n  profile: strict\n  session_secret: " + secret + "\n"
+
+	// fail closed with keys per session
+	strict := defaults
+	strict.Preset = DRMPresetStrict
+	strict.MinEncryptedRatio = 0.1
+	strict.Strict = true
+	strict.StrictStreamChecks = true
+	strict.RejectReencryption = true
+	strict.ParanoidChecks = true
+	strict.SessionKeys = true
+	strict.SessionSecret = secret
+
+	compat := defaults
+	compat.Preset = DRMPresetCompat
+	compat.EncryptShortNALs = drm.ShortNALsClear
+
+	tests := []struct {
+		name    string
+		content string
+		want    DRM
+		wantErr string
+	}{
+		{
+			name:    "strict",
+			content: strictConfig,
+			want:    strict,
+		},
+		{
+			name:    "strict with matching explicit option",
+			content: strictConfig + "  mode: cbcs\n  debug_page: false\n  strict: true\n  session_keys: true\n",
+			want:    strict,
+		},
+		{
+			name:    "strict with matching option spelled otherwise",
+			content: strictConfig + "  debug_page: \"0\"\n  strict: \"1\"\n",
+			want:    strict,
+		},
+		{
+			name:    "strict with cenc",
+			content: strictConfig + "  mode: cenc\n",
+			wantErr: "drm.mode=cenc conflicts with drm.profile=strict",
+		},
+		{
+			name:    "strict with debug page",
+			content: strictConfig + "  debug_page: true\n",
+			wantErr: "drm.debug_page=true conflicts",
+		},
+		{
+			name:    "strict without session secret",
+			content: "drm:\n  enabled: true\n  engine: builtin\n  profile: strict\n",
+			wantErr: "drm.session_secret must be",
+		},
+		{
+			name:    "strict with cencryptor",
+			content: strings.Replace(strictConfig, "builtin", "cencryptor", 1),
+			wantErr: "drm.profile=strict requires the builtin engine",
+		},
+		{
+			name:    "strict with key rotation",
+			content: strictConfig + "  key_rotation_interval: 1h\n",
+			wantErr: "drm.key_rotation_interval cannot be combined with drm.profile=strict",
+		},
+		{
+			name:    "strict with weak pattern",
+			content: strictConfig + "  skip_blocks: 20\n",
+			wantErr: "minimum ratio",
+		},
+		{
+			name:    "strict with weak adaptive floor",
+			content: strictConfig + "  pattern: adaptive\n  pattern_floor: 1:15\n",
+			wantErr: "minimum ratio",
+		},
+		{
+			name:    "compat",
+			content: "drm:\n  enabled: true\n  engine: builtin\n  profile: compat\n",
+			want:    compat,
+		},
+		{
+			name:    "compat with other pattern",
+			content: "drm:\n  enabled: true\n  engine: builtin\n  profile: compat\n  crypt_blocks: 5\n  skip_blocks: 5\n",
+			wantErr: "drm.crypt_blocks=5 conflicts",
+		},
+		{
+			name:    "unknown codec",
+			content: "drm:\n  enabled: true\n  engine: builtin\n  codec: vp8\n",
+			wantErr: "drm.codec must be",
+		},
+		{
+			name:    "unknown nal format",
+			content: "drm:\n  enabled: true\n  engine: builtin\n  nal_format: rtp\n",
+			wantErr: "drm.nal_format must be",
+		},
+		{
+			name:    "3-byte nal lengths",
+			content: "drm:\n  enabled: true\n  engine: builtin\n  nal_format: avcc\n  nal_length_size: 3\n",
+			wantErr: "drm.nal_length_size must be",
+		},
+		{
+			name:    "unknown preset",
+			content: "drm:\n  profile: paranoid\n",
+			wantErr: "drm.profile must be",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadDRMConfig(t, tt.content)
+
+			err := config.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() returned error: %s", err)
+			}
+
+			if !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("effective config = %+v, want %+v", config, tt.want)
+			}
+		})
+	}
+
+	// every option the strict preset pins conflicts when set otherwise
+	for _, option := range drmPresets[DRMPresetStrict] {
+		other := "cenc"
+		if pinned, ok := option.value.(bool); ok {
+			other = fmt.Sprint(!pinned)
+		}
+
+		key := strings.TrimPrefix(option.key, "drm.")
+		config := loadDRMConfig(t, strictConfig+"  "+key+": "+other+"\n")
+
+		want := fmt.Sprintf("%s=%s conflicts with drm.profile=strict", option.key, other)
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestDRM_ReloadChanges(t *testing.T) {
+	rotated := strings.Replace(legacyDRMConfig, "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c", "4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d", 1)
+
+	tests := []struct {
+		name        string
+		content     string
+		wantKey     bool
+		wantRestart []string
+	}{
+		{"unchanged", legacyDRMConfig, false, nil},
+		{"key", rotated, true, nil},
+		{"key and pattern", strings.Replace(rotated, "skip_blocks: 9", "skip_blocks: 5", 1), true, []string{"SkipBlocks"}},
+		{"disabled", strings.Replace(legacyDRMConfig, "enabled: true", "enabled: false", 1), false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := loadDRMConfig(t, legacyDRMConfig)
+			next := loadDRMConfig(t, tt.content)
+
+			key, restart := current.ReloadChanges(&next)
+			if key != tt.wantKey || !reflect.DeepEqual(restart, tt.wantRestart) {
+				t.Errorf("ReloadChanges() = %v, %v; want %v, %v", key, restart, tt.wantKey, tt.wantRestart)
+			}
+		})
+	}
+}
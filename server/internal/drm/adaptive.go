@@ -0,0 +1,122 @@
+package drm
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// how often the adaptive pattern is reconsidered
+const patternTuneInterval = 5 * time.Second
+
+// cpuTimes are the cumulative busy and total jiffies of all CPUs
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// readCPUTimes parses the aggregate cpu line of /proc/stat
+func readCPUTimes() (cpuTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+
+		var times cpuTimes
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuTimes{}, err
+			}
+
+			times.total += v
+			// idle and iowait
+			if i == 3 || i == 4 {
+				times.idle += v
+			}
+		}
+
+		return times, nil
+	}
+
+	return cpuTimes{}, errors.New("cpu line not found in /proc/stat")
+}
+
+func (manager *DRMManagerCtx) tunePattern() {
+	defer manager.wg.Done()
+
+	ticker := time.NewTicker(patternTuneInterval)
+	defer ticker.Stop()
+
+	lastStats := manager.encryptor.Stats()
+	lastCPU, err := readCPUTimes()
+	if err != nil {
+		manager.logger.Err(err).Msg("unable to read cpu times, adaptive drm pattern is disabled")
+		return
+	}
+
+	for {
+		select {
+		case <-manager.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		stats := manager.encryptor.Stats()
+		cpu, err := readCPUTimes()
+		if err != nil {
+			manager.logger.Err(err).Msg("unable to read cpu times")
+			continue
+		}
+
+		frames := stats.Frames - lastStats.Frames
+		total := cpu.total - lastCPU.total
+		if frames == 0 || total == 0 {
+			lastStats, lastCPU = stats, cpu
+			continue
+		}
+
+		sample := drm.CostSample{
+			FrameCost:     (stats.EncryptTime - lastStats.EncryptTime) / time.Duration(frames),
+			FrameInterval: patternTuneInterval / time.Duration(frames),
+			Headroom:      float64(cpu.idle-lastCPU.idle) / float64(total),
+		}
+		lastStats, lastCPU = stats, cpu
+
+		previous := manager.tuner.Pattern()
+		pattern, changed := manager.tuner.Observe(sample)
+		if !changed {
+			continue
+		}
+
+		logger := manager.logger.With().
+			Str("from", previous.String()).
+			Str("to", pattern.String()).
+			Dur("frame_cost", sample.FrameCost).
+			Float64("headroom", sample.Headroom).
+			Logger()
+
+		// the switch is signaled to clients like any profile change, the
+		// tuner stays at the pattern in use when it cannot be staged
+		if err := manager.encryptor.SetPattern(pattern); err != nil {
+			manager.tuner.Revert()
+			logger.Warn().Err(err).Msg("unable to adjust drm pattern")
+			continue
+		}
+
+		logger.Info().Msg("drm pattern adjusted, switching at next keyframe")
+	}
+}
@@ -0,0 +1,183 @@
+package drm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+// errNoProviderKey is returned when the key provider has no active key to
+// rotate to
+var errNoProviderKey = errors.New("key provider returned no active key")
+
+// how long the key provider is given for a key of the automatic rotation
+const cryptoPeriodFetchTimeout = 30 * time.Second
+
+// rotateCryptoPeriods rotates the content key once it was used for a
+// crypto period. A key that cannot be obtained or staged leaves the
+// current one in use and is retried with backoff. The new key takes over
+// at the next keyframe, clients learn it from the key rotated event.
+func (manager *DRMManagerCtx) rotateCryptoPeriods() {
+	defer manager.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a provider request in flight is canceled with the server
+	go func() {
+		select {
+		case <-manager.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	period := manager.config.CryptoPeriod()
+	timer := time.NewTimer(manager.cryptoPeriodDelay(period.Next()))
+	defer timer.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		fetchCtx, fetchCancel := context.WithTimeout(ctx, cryptoPeriodFetchTimeout)
+		rotation, err := manager.rotateCryptoPeriod(fetchCtx)
+		fetchCancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			failures++
+			retry := period.Retry(failures)
+			manager.cryptoPeriods.WithLabelValues("failed").Inc()
+
+			manager.logger.Error().Err(err).
+				Str("key_id", manager.encryptor.KeyIDHex()).
+				Int("failures", failures).
+				Dur("retry_in", retry).
+				Msg("unable to rotate drm key, the current key stays in use")
+
+			timer.Reset(manager.cryptoPeriodDelay(retry))
+			continue
+		}
+
+		failures = 0
+		next := period.Next()
+		manager.cryptoPeriods.WithLabelValues("staged").Inc()
+
+		manager.logger.Info().
+			Str("key_id", rotation.KeyID).
+			Str("previous_key_id", rotation.PreviousKeyID).
+			Bool("from_provider", manager.cryptoPeriodProvider != nil).
+			Dur("next_in", next).
+			Msg("drm key rotation staged for the next keyframe at the end of the crypto period")
+
+		timer.Reset(manager.cryptoPeriodDelay(next))
+	}
+}
+
+// cryptoPeriodDelay returns how long to wait for a delay of the automatic
+// rotation
+func (manager *DRMManagerCtx) cryptoPeriodDelay(d time.Duration) time.Duration {
+	if manager.cryptoPeriodWait != nil {
+		return manager.cryptoPeriodWait(d)
+	}
+	return d
+}
+
+// rotateCryptoPeriod stages the key of the next crypto period
+func (manager *DRMManagerCtx) rotateCryptoPeriod(ctx context.Context) (types.DRMKeyRotation, error) {
+	key, err := manager.cryptoPeriodKey(ctx)
+	if err != nil {
+		return types.DRMKeyRotation{}, err
+	}
+
+	manager.pushMu.Lock()
+	defer manager.pushMu.Unlock()
+
+	// a key server still handing out the current key has none to rotate to
+	pending, _ := manager.encryptor.PendingKeyID()
+	if manager.seen(key.KeyID) || key.KeyID == pending {
+		return types.DRMKeyRotation{}, fmt.Errorf("%w: key provider returned key %s again", drm.ErrKeyReplayed, key.KeyID)
+	}
+
+	profile := manager.encryptor.Profile()
+	rotation := types.DRMKeyRotation{
+		KeyID:         key.KeyID,
+		PreviousKeyID: profile.KeyID,
+	}
+
+	profile.KeyID, profile.Key, profile.IV = key.KeyID, key.Key, key.IV
+	profile.Generation = key.Generation
+	if err := manager.encryptor.ApplyProfile(profile); err != nil {
+		return types.DRMKeyRotation{}, err
+	}
+
+	manager.seeKey(key.KeyID)
+	return rotation, nil
+}
+
+// cryptoPeriodKey returns the key of the next crypto period hex encoded,
+// from the key provider or generated; an IV the provider leaves out is
+// generated
+func (manager *DRMManagerCtx) cryptoPeriodKey(ctx context.Context) (drm.Key, error) {
+	var key drm.Key
+
+	if manager.cryptoPeriodProvider != nil {
+		keys, err := manager.cryptoPeriodProvider.GetKeys(ctx)
+		if err != nil {
+			return drm.Key{}, &drm.ProviderError{Provider: manager.config.KeyProviderName(), Err: err}
+		}
+
+		current, ok := drm.CurrentKey(keys)
+		if !ok || current.KeyID == "" || current.Key == "" {
+			return drm.Key{}, &drm.ProviderError{Provider: manager.config.KeyProviderName(), Err: errNoProviderKey}
+		}
+		key.Generation = current.Generation
+
+		for _, field := range []struct {
+			name  string
+			value string
+			dst   *string
+		}{
+			{"key ID", current.KeyID, &key.KeyID},
+			{"key", current.Key, &key.Key},
+			{"IV", current.IV, &key.IV},
+		} {
+			if field.value == "" {
+				continue
+			}
+			decoded, err := drm.DecodeKeyBytes(field.value)
+			if err != nil {
+				return drm.Key{}, fmt.Errorf("key provider returned an invalid %s: %w", field.name, err)
+			}
+			*field.dst = hex.EncodeToString(decoded)
+		}
+	}
+
+	for _, field := range []*string{&key.KeyID, &key.Key, &key.IV} {
+		if *field != "" {
+			continue
+		}
+
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return drm.Key{}, fmt.Errorf("unable to generate key material: %w", err)
+		}
+		*field = hex.EncodeToString(random)
+	}
+
+	return key, nil
+}
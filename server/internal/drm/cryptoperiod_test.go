@@ -0,0 +1,204 @@
+package drm
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types/event"
+	"github.com/m1k1o/neko/server/pkg/types/message"
+)
+
+const cryptoPeriodConfig = testDRMConfig + "  key_rotation_interval: 1h\n"
+
+// testKeyProvider answers every request with the next of its responses,
+// the last one repeated
+type testKeyProvider struct {
+	mu        sync.Mutex
+	responses []func(ctx context.Context) ([]drm.Key, error)
+	calls     int
+}
+
+func (p *testKeyProvider) GetKeys(ctx context.Context) ([]drm.Key, error) {
+	p.mu.Lock()
+	response := p.responses[min(p.calls, len(p.responses)-1)]
+	p.calls++
+	p.mu.Unlock()
+
+	return response(ctx)
+}
+
+func keysResponse(keys ...drm.Key) func(context.Context) ([]drm.Key, error) {
+	return func(context.Context) ([]drm.Key, error) { return keys, nil }
+}
+
+func errorResponse(err error) func(context.Context) ([]drm.Key, error) {
+	return func(context.Context) ([]drm.Key, error) { return nil, err }
+}
+
+// waitCryptoPeriods makes the automatic rotation report every delay it
+// waits for and wait for the one given back instead
+func waitCryptoPeriods(manager *DRMManagerCtx) (waits <-chan time.Duration, delays chan<- time.Duration) {
+	waitCh, delayCh := make(chan time.Duration), make(chan time.Duration)
+	manager.cryptoPeriodWait = func(d time.Duration) time.Duration {
+		select {
+		case waitCh <- d:
+			return <-delayCh
+		case <-manager.shutdown:
+			return d
+		}
+	}
+	return waitCh, delayCh
+}
+
+func TestDRMManager_rotateCryptoPeriods(t *testing.T) {
+	manager, sessions := newTestManager(t, cryptoPeriodConfig)
+
+	const current = "00000000000000000000000000000001"
+	next := drm.Key{
+		KeyID: "00000000000000000000000000000003",
+		Key:   "5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e",
+		IV:    "00112233445566778899aabbccddeeff",
+	}
+	provider := &testKeyProvider{responses: []func(context.Context) ([]drm.Key, error){
+		errorResponse(errors.New("key server unavailable")),
+		keysResponse(),
+		// a key server still handing out the current key
+		keysResponse(drm.Key{KeyID: current, Key: "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c"}),
+		keysResponse(next),
+	}}
+	manager.cryptoPeriodProvider = provider
+	waits, delays := waitCryptoPeriods(manager)
+	manager.Start()
+
+	period := manager.config.CryptoPeriod()
+	if d := <-waits; d != period.Interval {
+		t.Errorf("first wait = %s, want the crypto period %s", d, period.Interval)
+	}
+	delays <- time.Millisecond
+
+	// failures back off and keep the current key in use
+	for failures := 1; failures <= 3; failures++ {
+		d := <-waits
+		if want := period.Retry(failures); d != want {
+			t.Errorf("wait after %d failures = %s, want %s", failures, d, want)
+		}
+
+		if pending, ok := manager.encryptor.PendingKeyID(); ok {
+			t.Errorf("PendingKeyID() = %s after %d failures, want none", pending, failures)
+		}
+		if got := manager.encryptor.KeyIDHex(); got != current {
+			t.Errorf("KeyIDHex() = %s after %d failures, want %s", got, failures, current)
+		}
+		if got := testutil.ToFloat64(manager.cryptoPeriods.WithLabelValues("failed")); got != float64(failures) {
+			t.Errorf("failed rotations = %v, want %d", got, failures)
+		}
+
+		delays <- time.Millisecond
+	}
+
+	// the provider recovered, the next key is staged and the backoff reset
+	if d := <-waits; d != period.Interval {
+		t.Errorf("wait after the staged rotation = %s, want %s", d, period.Interval)
+	}
+	if pending, ok := manager.encryptor.PendingKeyID(); !ok || pending != next.KeyID {
+		t.Errorf("PendingKeyID() = %s, %v, want %s", pending, ok, next.KeyID)
+	}
+	if got := testutil.ToFloat64(manager.cryptoPeriods.WithLabelValues("staged")); got != 1 {
+		t.Errorf("staged rotations = %v, want 1", got)
+	}
+	delays <- time.Hour
+
+	manager.encryptor.Keyframe()
+	changed, ok := sessions.wait(t, event.DRM_KEY_CHANGED).(message.DRMKeyChanged)
+	if !ok || hex.EncodeToString(changed.KeyID) != next.KeyID {
+		t.Errorf("%s = %+v, want key ID %s", event.DRM_KEY_CHANGED, changed, next.KeyID)
+	}
+	if got := manager.encryptor.KeyIDHex(); got != next.KeyID {
+		t.Errorf("KeyIDHex() = %s after the keyframe, want %s", got, next.KeyID)
+	}
+}
+
+func TestDRMManager_rotateCryptoPeriodReplayed(t *testing.T) {
+	manager, _ := newTestManager(t, cryptoPeriodConfig)
+
+	staged := drm.Key{
+		KeyID: "00000000000000000000000000000003",
+		Key:   "5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e",
+	}
+	provider := &testKeyProvider{responses: []func(context.Context) ([]drm.Key, error){
+		keysResponse(drm.Key{KeyID: "00000000000000000000000000000001", Key: "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c"}),
+		keysResponse(staged),
+	}}
+	manager.cryptoPeriodProvider = provider
+	manager.Start()
+
+	// the key in use
+	if _, err := manager.rotateCryptoPeriod(context.Background()); !errors.Is(err, drm.ErrKeyReplayed) {
+		t.Errorf("rotateCryptoPeriod() of the current key returned error %v, want %v", err, drm.ErrKeyReplayed)
+	}
+
+	rotation, err := manager.rotateCryptoPeriod(context.Background())
+	if err != nil {
+		t.Fatalf("rotateCryptoPeriod() returned error: %s", err)
+	}
+	if rotation.KeyID != staged.KeyID {
+		t.Errorf("rotateCryptoPeriod() key ID = %s, want %s", rotation.KeyID, staged.KeyID)
+	}
+
+	// the key already staged, and once used
+	for _, keyframe := range []bool{false, true} {
+		if keyframe {
+			manager.encryptor.Keyframe()
+		}
+		if _, err := manager.rotateCryptoPeriod(context.Background()); !errors.Is(err, drm.ErrKeyReplayed) {
+			t.Errorf("rotateCryptoPeriod() of the staged key returned error %v, want %v", err, drm.ErrKeyReplayed)
+		}
+	}
+}
+
+func TestDRMManager_rotateCryptoPeriodsShutdown(t *testing.T) {
+	manager, _ := newTestManager(t, cryptoPeriodConfig)
+
+	fetching := make(chan struct{})
+	canceled := make(chan error, 1)
+	manager.cryptoPeriodProvider = &testKeyProvider{responses: []func(context.Context) ([]drm.Key, error){
+		func(ctx context.Context) ([]drm.Key, error) {
+			close(fetching)
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return nil, ctx.Err()
+		},
+	}}
+	waits, delays := waitCryptoPeriods(manager)
+	manager.Start()
+
+	<-waits
+	delays <- time.Millisecond
+	<-fetching
+
+	// the request in flight is canceled rather than waited for
+	done := make(chan struct{})
+	go func() {
+		manager.Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Shutdown() did not return while a key was fetched")
+	}
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("provider context ended with %v, want %v", err, context.Canceled)
+	}
+	if got := testutil.ToFloat64(manager.cryptoPeriods.WithLabelValues("failed")); got != 0 {
+		t.Errorf("failed rotations = %v after shutdown, want 0", got)
+	}
+}
@@ -0,0 +1,153 @@
+package drm
+
+import (
+	"encoding/hex"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/types/event"
+	"github.com/m1k1o/neko/server/pkg/types/message"
+)
+
+// events a consumer may fall behind by before they are dropped for it
+const eventBuffer = 64
+
+// consume subscribes a handler to the event bus, it runs until shutdown
+func (manager *DRMManagerCtx) consume(name string, handle func(ev drm.Event), filter ...drm.EventType) {
+	sub := manager.bus.Subscribe(name, eventBuffer, filter...)
+	manager.consumers = append(manager.consumers, sub)
+
+	manager.wg.Add(1)
+	go func() {
+		defer manager.wg.Done()
+
+		for ev := range sub.Events() {
+			handle(ev)
+		}
+	}()
+}
+
+func (manager *DRMManagerCtx) logEvent(ev drm.Event) {
+	switch ev := ev.(type) {
+	case drm.ProfileChanged:
+		manager.logger.Info().
+			Uint64("epoch", ev.Epoch).
+			Strs("changes", ev.Changes).
+			Str("mode", ev.Profile.Mode).
+			Str("key_id", ev.Profile.KeyID).
+			Int("crypt_blocks", ev.Profile.CryptBlocks).
+			Int("skip_blocks", ev.Profile.SkipBlocks).
+			Bool("enabled", ev.Enabled).
+			Msg("drm parameters updated")
+	case drm.KeyRotated:
+		manager.logger.Info().
+			Uint64("epoch", ev.Epoch).
+			Str("key_id", ev.KeyID).
+			Str("previous_key_id", ev.PreviousKeyID).
+			Uint64("frame", ev.Frame).
+			Msg("drm key rotated")
+	case drm.KeyRevoked:
+		manager.logger.Warn().
+			Str("key_id", ev.KeyID).
+			Str("reason", ev.Reason).
+			Msg("drm key revoked")
+	case drm.HandshakeFailed:
+		manager.logger.Warn().
+			Str("session_id", ev.SessionID).
+			Str("reason", ev.Reason).
+			Msg("drm handshake failed")
+	case drm.KeyStockLow:
+		logger := manager.logger.Warn().Int("remaining", ev.Remaining)
+		if ev.Remaining == 0 {
+			logger.Msg("pre-provisioned drm keys exhausted, the current key stays in use")
+		} else {
+			logger.Msg("pre-provisioned drm keys running low")
+		}
+	case drm.ErrorRateChanged:
+		manager.logger.Info().
+			Float64("previous", ev.Previous).
+			Float64("rate", ev.Rate).
+			Msg("drm error rate changed")
+	}
+}
+
+// signalEvent forwards events to the clients
+func (manager *DRMManagerCtx) signalEvent(ev drm.Event) {
+	switch ev := ev.(type) {
+	case drm.ProfileChanged:
+		manager.sessions.Broadcast(
+			event.DRM_UPDATED,
+			message.DRMUpdated{
+				DRMUpdate: types.DRMUpdate{
+					Epoch:   ev.Epoch,
+					Changes: ev.Changes,
+					Profile: profileToTypes(ev.Profile),
+					Enabled: ev.Enabled,
+				},
+			}, manager.exemptSessions()...)
+
+		// with session keys every session has a key ID of its own
+		for _, session := range manager.sessions.List() {
+			if session.State().IsConnected && !session.Profile().DRMExempt {
+				manager.sendClientInfo(session)
+			}
+		}
+	case drm.KeyRotated:
+		keyID, err := hex.DecodeString(ev.KeyID)
+		if err != nil {
+			return
+		}
+
+		// sessions connecting later are told the current key by system/drm
+		manager.sessions.Broadcast(
+			event.DRM_KEY_CHANGED,
+			message.DRMKeyChanged{
+				DRMKeyChange: types.DRMKeyChange{
+					Epoch: ev.Epoch,
+					KeyID: keyID,
+					IV:    ev.IV,
+					Frame: ev.Frame,
+					Time:  ev.Time,
+				},
+			}, manager.exemptSessions()...)
+	case drm.KeyExported:
+		payload := message.DRMKeyExport{
+			Time:     ev.Time,
+			Actor:    ev.Actor,
+			KeyID:    ev.KeyID,
+			Success:  ev.Err == nil,
+			Failures: ev.Failures,
+		}
+		if ev.Err != nil {
+			payload.Error = ev.Err.Error()
+		}
+		if !ev.LockedUntil.IsZero() {
+			payload.LockedUntil = &ev.LockedUntil
+		}
+
+		manager.sessions.AdminBroadcast(event.DRM_KEY_EXPORT, payload)
+	}
+}
+
+// exemptSessions returns the IDs of the sessions sent the stream clear,
+// which have no decryptor to tell about changes
+func (manager *DRMManagerCtx) exemptSessions() []string {
+	var exempt []string
+	for _, session := range manager.sessions.List() {
+		if session.Profile().DRMExempt {
+			exempt = append(exempt, session.ID())
+		}
+	}
+	return exempt
+}
+
+// sendClientInfo sends a session what to set up its decryptor with
+func (manager *DRMManagerCtx) sendClientInfo(session types.Session) {
+	info, err := manager.ClientInfo(session.ID())
+	if err != nil {
+		manager.logger.Warn().Err(err).Str("session_id", session.ID()).Msg("unable to build drm client info")
+		return
+	}
+
+	session.Send(event.SYSTEM_DRM, message.SystemDRMInfo{DRMInfo: info})
+}
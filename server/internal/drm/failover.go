@@ -0,0 +1,58 @@
+package drm
+
+import (
+	"context"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// how often the health of the key providers is probed
+const providerProbeInterval = 30 * time.Second
+
+// providerFailover is written to the audit log synchronously, startup
+// failovers happen before any event consumer is running
+func (manager *DRMManagerCtx) providerFailover(f drm.ProviderFailover) {
+	logger := manager.logger.Warn().
+		Str("from", f.From).
+		Str("to", f.To)
+	if f.Err != nil {
+		logger.Err(f.Err).Msg("drm key provider failed over")
+	} else {
+		logger.Msg("drm key provider failed back")
+	}
+
+	manager.bus.Publish(f)
+}
+
+func (manager *DRMManagerCtx) probeProviders() {
+	defer manager.wg.Done()
+
+	ticker := time.NewTicker(providerProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-manager.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), providerProbeInterval/2)
+		changed := manager.failover.Probe(ctx)
+		cancel()
+
+		for _, health := range changed {
+			if health.Healthy {
+				manager.logger.Info().
+					Str("provider", health.Name).
+					Msg("drm key provider recovered, used again from the next rotation")
+			} else {
+				manager.logger.Warn().
+					Err(health.Err).
+					Str("provider", health.Name).
+					Msg("drm key provider unhealthy")
+			}
+		}
+	}
+}
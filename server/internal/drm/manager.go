@@ -0,0 +1,1399 @@
+package drm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/m1k1o/neko/server/internal/config"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+type DRMManagerCtx struct {
+	logger    zerolog.Logger
+	config    *config.DRM
+	sessions  types.SessionManager
+	encryptor *drm.Encryptor
+	track     string // of the encryptor, video unless it is sent clear
+	tracks    *drm.EncryptorSet
+	pssh      []drm.SystemPSSH
+	exporter  *drm.KeyExporter
+	tuner     *drm.PatternTuner
+	failover  *drm.FailoverProvider
+	schedule  *drm.KeySchedule
+	// provider learning about new keys while the stream runs
+	watcher drm.KeyWatcher
+	// provider of the keys of drm.key_rotation_interval, nil when they
+	// are generated
+	cryptoPeriodProvider drm.KeyProvider
+	// automatic rotations staged and failed
+	cryptoPeriods *prometheus.CounterVec
+	// returns how long the automatic rotation waits instead of a crypto
+	// period or retry delay, nil waits for them; tests shorten them
+	cryptoPeriodWait func(time.Duration) time.Duration
+	// encryptors of the sessions with drm.session_keys
+	sessionKeys *drm.EncryptorFactory
+	// encryptors of the video streams with drm.streams keys of their own
+	streams   *drm.EncryptorRegistry
+	bus       *drm.Bus
+	consumers []*drm.Subscription
+	// time the stream switched to another key last, nil before
+	lastRotation atomic.Pointer[time.Time]
+
+	// pushes are applied one at a time, key IDs used or pushed so far are
+	// never taken again
+	pushMu   sync.Mutex
+	seenMu   sync.Mutex
+	seenKeys map[string]struct{}
+
+	// frame header versions negotiated by the sessions, pinned until they
+	// disconnect
+	wireMu       sync.Mutex
+	wireVersions map[string]int
+
+	// configuration as last applied from the config file
+	reloadMu sync.Mutex
+	applied  config.DRM
+	// drm.enabled as last applied, a reload can switch it
+	enabled atomic.Bool
+
+	wg       sync.WaitGroup
+	shutdown chan struct{}
+}
+
+func New(sessions types.SessionManager, config *config.DRM) *DRMManagerCtx {
+	logger := log.With().Str("module", "drm").Logger()
+
+	manager := &DRMManagerCtx{
+		logger:   logger,
+		config:   config,
+		sessions: sessions,
+		bus:      drm.NewBus(),
+		shutdown: make(chan struct{}),
+		applied:  *config,
+	}
+	manager.enabled.Store(config.Enabled)
+
+	if !config.Enabled {
+		return manager
+	}
+
+	if err := config.Validate(); err != nil {
+		panicConfig(logger, err, "invalid drm configuration")
+	}
+
+	provider, err := config.KeyProvider()
+	if err != nil {
+		logger.Panic().Err(err).Msg("invalid drm key configuration")
+	}
+
+	tunerConfig, adaptive, err := config.TunerConfig()
+	if err != nil {
+		logger.Panic().Err(err).Msg("invalid drm pattern configuration")
+	}
+
+	// only the builtin engine encrypts in this process
+	if !config.BuiltinEngine() {
+		return manager
+	}
+
+	if err := manager.loadSeenKeys(); err != nil {
+		logger.Panic().Err(err).Str("file", config.SeenKeysFile).Msg("unable to read seen drm key IDs")
+	}
+
+	if failover, ok := provider.(*drm.FailoverProvider); ok {
+		failover.OnFailover(manager.providerFailover)
+		manager.failover = failover
+	}
+
+	providerName := config.KeyProviderName()
+
+	keys, err := provider.GetKeys(context.Background())
+	if err != nil {
+		err = &drm.ProviderError{Provider: providerName, Err: err}
+		logger.Panic().Err(err).Msg("unable to get drm keys")
+	}
+
+	// the encryptor generates the key material of an empty key, with
+	// session keys it encrypts no session and needs none
+	key, configured := drm.CurrentKey(keys)
+	if !configured && !config.AutoGenerate && !config.SessionKeys {
+		logger.Panic().Msg("no drm key configured")
+	}
+
+	manager.schedule, err = drm.NewKeySchedule(keys, key)
+	if err != nil {
+		logger.Panic().Err(err).Msg("invalid drm key schedule")
+	}
+	manager.schedule.OnLowStock(config.KeyStockAlert, manager.keyStockLow)
+
+	if watcher, ok := provider.(drm.KeyWatcher); ok {
+		manager.watcher = watcher
+	}
+
+	if config.KeyRotationInterval > 0 && !config.SessionKeys {
+		if config.RotatesFromProvider() {
+			manager.cryptoPeriodProvider = provider
+		}
+
+		manager.cryptoPeriods = promauto.NewCounterVec(prometheus.CounterOpts{
+			Name:      "key_rotations_total",
+			Namespace: "neko",
+			Subsystem: "drm",
+			Help:      "Total number of automatic key rotations of drm.key_rotation_interval by result, staged or failed.",
+		}, []string{"result"})
+
+		logger.Info().
+			Dur("interval", config.KeyRotationInterval).
+			Dur("jitter", config.KeyRotationJitter).
+			Bool("from_provider", manager.cryptoPeriodProvider != nil).
+			Msg("automatic drm key rotation enabled")
+	}
+
+	encryptorConfig := config.EncryptorConfig(key)
+	if config.SessionKeys {
+		encryptorConfig.AutoGenerate = true
+	}
+
+	// keys of the other tracks come along with the video key
+	if trackProvider, ok := provider.(drm.TrackKeyProvider); ok {
+		tracks, err := trackProvider.GetTrackKeys(context.Background())
+		if err != nil {
+			err = &drm.ProviderError{Provider: providerName, Err: err}
+			logger.Panic().Err(err).Msg("unable to get drm track keys")
+		}
+
+		encryptorConfig.Tracks = tracks
+	}
+
+	if psshProvider, ok := provider.(drm.PSSHProvider); ok {
+		manager.pssh, err = psshProvider.GetPSSH(context.Background())
+		if err != nil {
+			err = &drm.ProviderError{Provider: providerName, Err: err}
+			logger.Panic().Err(err).Msg("unable to get drm pssh boxes")
+		}
+	}
+
+	if adaptive {
+		start := drm.Pattern{CryptBlocks: encryptorConfig.CryptBlocks, SkipBlocks: encryptorConfig.SkipBlocks}
+
+		manager.tuner, err = drm.NewPatternTuner(tunerConfig, start)
+		if err != nil {
+			logger.Panic().Err(err).Msg("invalid drm pattern configuration")
+		}
+
+		// configured pattern is clamped to the bounds
+		pattern := manager.tuner.Pattern()
+		encryptorConfig.CryptBlocks = pattern.CryptBlocks
+		encryptorConfig.SkipBlocks = pattern.SkipBlocks
+
+		logger.Info().
+			Str("floor", tunerConfig.Floor.String()).
+			Str("ceiling", tunerConfig.Ceiling.String()).
+			Str("pattern", pattern.String()).
+			Msg("adaptive drm pattern enabled")
+	}
+
+	tracks, err := drm.NewEncryptorSet(encryptorConfig)
+	if err != nil {
+		panicConfig(logger, err, "unable to create drm encryptor")
+	}
+
+	// the key of the first encrypted track is the one rotated and reported
+	track := drm.TrackVideo
+	if !config.EncryptVideo {
+		track = drm.TrackAudio
+	}
+	encryptor := tracks.Encryptor(track)
+	if encryptor == nil || !encryptor.Enabled() {
+		logger.Panic().Str("track", track).Msg("no drm key for the encrypted track")
+	}
+
+	for _, track := range tracks.Tracks() {
+		for _, warning := range tracks.Encryptor(track).Warnings() {
+			logger.Warn().Str("track", track).Msg(warning)
+		}
+
+		if config.LogFrames {
+			trackLogger := logger.With().Str("track", track).Logger()
+			tracks.Encryptor(track).SetLogger(&trackLogger)
+		}
+	}
+
+	created := logger.Info().
+		Uint64("generation", key.Generation).
+		Hex("key_id", encryptor.KeyID()).
+		Strs("tracks", tracks.EncryptedTracks())
+	if !configured {
+		created = created.Bool("auto_generated", true)
+	}
+	if manager.failover != nil {
+		active, _ := manager.failover.Active()
+		created = created.Str("provider", active)
+	}
+	if remaining := manager.schedule.Remaining(); remaining > 0 {
+		created = created.Int("pre_provisioned", remaining)
+	}
+	if keyID := tracks.KeyID(drm.TrackAudio); keyID != nil && track != drm.TrackAudio {
+		created = created.Hex("audio_key_id", keyID)
+	}
+	created.Msg("drm encryptor created")
+
+	manager.encryptor = encryptor
+	manager.track = track
+	manager.tracks = tracks
+
+	if len(config.Streams) > 0 {
+		manager.streams, err = drm.NewEncryptorRegistry(encryptorConfig, config.Streams, tracks.Encryptor(drm.TrackVideo))
+		if err != nil {
+			panicConfig(logger, err, "unable to create drm stream encryptors")
+		}
+
+		for _, id := range manager.streams.Streams() {
+			stream := manager.streams.Get(id)
+			for _, warning := range stream.Warnings() {
+				logger.Warn().Str("stream", id).Msg(warning)
+			}
+
+			if config.LogFrames {
+				streamLogger := logger.With().Str("stream", id).Logger()
+				stream.SetLogger(&streamLogger)
+			}
+
+			logger.Info().
+				Str("stream", id).
+				Hex("key_id", stream.KeyID()).
+				Msg("drm stream key configured")
+		}
+	}
+
+	if config.SessionKeys {
+		secret, err := config.SessionKeySecret()
+		if err != nil {
+			logger.Panic().Err(err).Msg("invalid drm session secret")
+		}
+
+		manager.sessionKeys, err = drm.NewEncryptorFactory(encryptorConfig, secret, config.MaxSessions)
+		if err != nil {
+			logger.Panic().Err(err).Msg("unable to create drm session encryptors")
+		}
+
+		logger.Info().
+			Int("max_sessions", config.MaxSessions).
+			Msg("drm session keys enabled, every session is encrypted with a key of its own")
+
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:      "sessions",
+			Namespace: "neko",
+			Subsystem: "drm",
+			Help:      "Sessions currently encrypted with keys of their own.",
+		}, func() float64 {
+			return float64(manager.sessionKeys.Sessions())
+		})
+	}
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name:      "internal_errors_total",
+		Namespace: "neko",
+		Subsystem: "drm",
+		Help:      "Total number of access units dropped by drm.paranoid_checks.",
+	}, func() float64 {
+		return float64(encryptor.Stats().InternalErrors)
+	})
+	registerEncryptorMetrics(tracks)
+
+	manager.exporter = drm.NewKeyExporter(encryptor, config.KeyExportConfig(), manager.auditKeyExport)
+
+	if config.AllowKeyExport {
+		logger.Warn().Msg("drm key export is allowed, disable it once the recovery is done")
+	}
+
+	if drm.PerSampleIV(encryptor.Profile().IVMode) && !config.KeySEI && !config.FrameHeader {
+		logger.Warn().Msgf("drm %s uses a per-sample IV, enable drm.key_sei or drm.frame_header for clients to learn it", encryptor.Mode())
+	}
+
+	return manager
+}
+
+// panicConfig gives up on an invalid configuration, every invalid option
+// of drm.ConfigErrors is logged on a line of its own first
+func panicConfig(logger zerolog.Logger, err error, msg string) {
+	var errs drm.ConfigErrors
+	if !errors.As(err, &errs) {
+		logger.Panic().Err(err).Msg(msg)
+	}
+
+	for _, err := range errs {
+		logger.Error().Err(err).Msg(msg)
+	}
+	logger.Panic().Int("invalid_options", len(errs)).Msg(msg)
+}
+
+func (manager *DRMManagerCtx) Start() {
+	if manager.encryptor == nil {
+		return
+	}
+
+	manager.consume("log", manager.logEvent)
+	manager.consume("signaling", manager.signalEvent,
+		drm.EventProfileChanged,
+		drm.EventKeyRotated,
+		drm.EventKeyExported,
+	)
+
+	manager.encryptor.OnUpdate(func(u drm.Update) {
+		manager.bus.Publish(drm.ProfileChanged{Time: time.Now(), Update: u})
+	})
+	manager.seeKey(manager.encryptor.KeyIDHex())
+	manager.encryptor.OnRotate(func(r drm.Rotation) {
+		now := time.Now()
+		manager.lastRotation.Store(&now)
+		manager.seeKey(hex.EncodeToString(r.KeyID))
+		manager.bus.Publish(drm.KeyRotated{
+			Time:          now,
+			Epoch:         r.Epoch,
+			KeyID:         hex.EncodeToString(r.KeyID),
+			PreviousKeyID: hex.EncodeToString(r.PreviousKeyID),
+			IV:            r.IV,
+			Frame:         r.Frame,
+		})
+	})
+
+	if manager.tuner != nil {
+		manager.wg.Add(1)
+		go manager.tunePattern()
+	}
+
+	if manager.failover != nil {
+		manager.wg.Add(1)
+		go manager.probeProviders()
+	}
+
+	// session keys never change, pre-provisioned keys are of no use
+	if manager.sessionKeys == nil && manager.watcher != nil {
+		manager.wg.Add(1)
+		go manager.watchKeys()
+	}
+	if manager.sessionKeys == nil && (manager.schedule.Remaining() > 0 || manager.watcher != nil) {
+		manager.wg.Add(1)
+		go manager.rotateKeys()
+	}
+	if manager.cryptoPeriods != nil {
+		manager.wg.Add(1)
+		go manager.rotateCryptoPeriods()
+	}
+
+	// the peer of the session is recreated, its client installs or
+	// removes the decryptor
+	manager.sessions.OnProfileChanged(func(session types.Session, new, old types.MemberProfile) {
+		if new.DRMExempt != old.DRMExempt && session.State().IsConnected {
+			manager.sendClientInfo(session)
+			manager.trackSession(session)
+		}
+	})
+
+	// a rotated key waits for the connected clients decrypting the stream
+	manager.sessions.OnConnected(manager.trackSession)
+	manager.sessions.OnDisconnected(func(session types.Session) {
+		manager.encryptor.RemoveSession(session.ID())
+
+		manager.wireMu.Lock()
+		delete(manager.wireVersions, session.ID())
+		manager.wireMu.Unlock()
+	})
+}
+
+// trackSession registers a connected session with the overlap window of
+// rotated keys, unless it is sent the stream clear
+func (manager *DRMManagerCtx) trackSession(session types.Session) {
+	if session.Profile().DRMExempt {
+		manager.encryptor.RemoveSession(session.ID())
+	} else {
+		manager.encryptor.AddSession(session.ID())
+	}
+}
+
+func (manager *DRMManagerCtx) Shutdown() error {
+	if manager.encryptor != nil {
+		manager.encryptor.OnUpdate(nil)
+		manager.encryptor.OnRotate(nil)
+	}
+
+	close(manager.shutdown)
+	manager.bus.Close()
+	manager.wg.Wait()
+
+	for _, sub := range manager.consumers {
+		if dropped := sub.Dropped(); dropped > 0 {
+			manager.logger.Warn().
+				Str("consumer", sub.Name()).
+				Uint64("dropped", dropped).
+				Msg("drm events were dropped for a slow consumer")
+		}
+	}
+
+	// the tracks stopped with the webrtc manager, the keys are of no use
+	// anymore and should not outlive the process in memory or core dumps
+	if manager.sessionKeys != nil {
+		manager.sessionKeys.Close()
+	}
+	if manager.tracks != nil {
+		manager.tracks.Close()
+	}
+	if manager.streams != nil {
+		manager.streams.Close()
+	}
+
+	return nil
+}
+
+// Enabled reports drm.enabled as last applied. A manager disabled at
+// startup has no encryptor, publishes no events and refuses every operation
+// with types.ErrDRMDisabled, one enabled at startup can be switched off and
+// on again by a reload.
+func (manager *DRMManagerCtx) Enabled() bool {
+	return manager.enabled.Load()
+}
+
+func (manager *DRMManagerCtx) DebugPage() bool {
+	return manager.config.DebugPage
+}
+
+func (manager *DRMManagerCtx) ClearKeyEndpoint() bool {
+	return manager.config.ClearKeyEndpoint
+}
+
+// Codec returns the codec of the encrypted video stream
+func (manager *DRMManagerCtx) Codec() string {
+	if manager.config.Codec == "" {
+		return drm.CodecH264
+	}
+	return manager.config.Codec
+}
+
+// Encryptor returns the encryptor of the key that is rotated and reported,
+// the one of video unless it is sent clear
+func (manager *DRMManagerCtx) Encryptor() *drm.Encryptor {
+	return manager.encryptor
+}
+
+// TrackEncryptor returns the encryptor of a track label, nil or disabled
+// when the track is not encrypted
+func (manager *DRMManagerCtx) TrackEncryptor(track string) *drm.Encryptor {
+	if manager.tracks == nil {
+		return nil
+	}
+	return manager.tracks.Encryptor(track)
+}
+
+// StreamEncryptors returns the encryptors of the video streams by their
+// ID, nil without drm.streams
+func (manager *DRMManagerCtx) StreamEncryptors() *drm.EncryptorRegistry {
+	return manager.streams
+}
+
+// streamEncryptor returns the encryptor of the video stream a session
+// watches, the shared one unless the stream has a key of its own
+func (manager *DRMManagerCtx) streamEncryptor(sessionID string) *drm.Encryptor {
+	if manager.streams == nil {
+		return manager.encryptor
+	}
+
+	session, ok := manager.sessions.Get(sessionID)
+	if !ok {
+		return manager.encryptor
+	}
+	peer := session.GetWebRTCPeer()
+	if peer == nil {
+		return manager.encryptor
+	}
+
+	if id := peer.Video().ID; manager.streams.Has(id) {
+		return manager.streams.Get(id)
+	}
+	return manager.encryptor
+}
+
+// StreamChanged tells the client of a session that switched to another
+// video stream the key of that stream, with drm.streams only
+func (manager *DRMManagerCtx) StreamChanged(session types.Session) {
+	if manager.streams == nil || session.Profile().DRMExempt {
+		return
+	}
+	manager.sendClientInfo(session)
+}
+
+func (manager *DRMManagerCtx) Events() *drm.Bus {
+	return manager.bus
+}
+
+func (manager *DRMManagerCtx) Epoch() uint64 {
+	if manager.encryptor == nil {
+		// cencryptor engine never changes its parameters
+		if manager.config.Enabled {
+			return 1
+		}
+		return 0
+	}
+
+	return manager.encryptor.Epoch()
+}
+
+func (manager *DRMManagerCtx) Profile() types.DRMProfile {
+	if manager.encryptor == nil {
+		// cencryptor engine is configured statically
+		return types.DRMProfile{
+			Mode:        manager.config.Mode,
+			CryptBlocks: manager.config.CryptBlocks,
+			SkipBlocks:  manager.config.SkipBlocks,
+			KeyID:       manager.config.KeyID,
+			IV:          manager.config.IV,
+			IVMode:      drm.IVModeConstant,
+		}
+	}
+
+	return profileToTypes(manager.encryptor.Profile())
+}
+
+func (manager *DRMManagerCtx) PendingProfile() (types.DRMProfile, bool) {
+	if manager.encryptor == nil {
+		return types.DRMProfile{}, false
+	}
+
+	p, ok := manager.encryptor.PendingProfile()
+	if !ok {
+		return types.DRMProfile{}, false
+	}
+
+	profile := profileToTypes(p)
+	if at, ok := manager.encryptor.PendingActivation(); ok && !at.IsZero() {
+		profile.ActivateAt = &at
+	}
+
+	return profile, true
+}
+
+func (manager *DRMManagerCtx) ApplyProfile(profile types.DRMProfile) error {
+	if !manager.config.Enabled {
+		return types.ErrDRMDisabled
+	}
+
+	// the keys of a session are derived once, nothing switches them
+	if manager.encryptor == nil || manager.sessionKeys != nil {
+		return types.ErrDRMUnsupported
+	}
+
+	var activateAt time.Time
+	if profile.ActivateAt != nil {
+		activateAt = *profile.ActivateAt
+	}
+
+	err := manager.encryptor.ApplyProfileAt(drm.Profile{
+		Mode:        profile.Mode,
+		CryptBlocks: profile.CryptBlocks,
+		SkipBlocks:  profile.SkipBlocks,
+		KeyID:       profile.KeyID,
+		Key:         profile.Key,
+		IV:          profile.IV,
+		IVMode:      profile.IVMode,
+	}, activateAt)
+
+	if err != nil && !errors.Is(err, drm.ErrInvalidProfile) {
+		manager.logger.Warn().Err(err).Msg("drm profile was not applied")
+		return err
+	}
+
+	if err == nil {
+		logger := manager.logger.Info().Str("key_id", profile.KeyID)
+		if !activateAt.IsZero() {
+			logger = logger.Time("activate_at", activateAt)
+		}
+		logger.Msg("drm profile staged until next keyframe")
+	}
+
+	return err
+}
+
+// Exempt returns whether a session is sent the stream clear because its
+// member profile is drm_exempt, only the builtin engine encrypts every
+// session on its own and can leave some clear
+func (manager *DRMManagerCtx) Exempt(sessionID string) bool {
+	if manager.encryptor == nil {
+		return false
+	}
+
+	session, ok := manager.sessions.Get(sessionID)
+	return ok && session.Profile().DRMExempt
+}
+
+// SessionProfile returns the profile a session is encrypted with, the
+// current one unless it has keys of its own or watches a stream with a key
+// of its own
+func (manager *DRMManagerCtx) SessionProfile(sessionID string) types.DRMProfile {
+	if manager.sessionKeys != nil {
+		profile := manager.Profile()
+		key := manager.sessionKeys.Keys(sessionID)[drm.TrackVideo]
+		profile.KeyID, profile.IV = key.KeyID, key.IV
+		return profile
+	}
+
+	if stream := manager.streamEncryptor(sessionID); stream != manager.encryptor {
+		return profileToTypes(stream.Profile())
+	}
+	return manager.Profile()
+}
+
+// AcquireSession returns the encryptors of a session with keys of its own,
+// nil without session keys; every call has to be paired with ReleaseSession
+func (manager *DRMManagerCtx) AcquireSession(sessionID string) (*drm.EncryptorSet, error) {
+	if manager.sessionKeys == nil {
+		return nil, nil
+	}
+
+	tracks, err := manager.sessionKeys.Acquire(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// attributes a leaked key to its viewer
+	logger := manager.logger.Info().
+		Str("session_id", sessionID).
+		Hex("key_id", tracks.KeyID(drm.TrackVideo))
+	if keyID := tracks.KeyID(drm.TrackAudio); keyID != nil {
+		logger = logger.Hex("audio_key_id", keyID)
+	}
+	logger.Msg("drm session key issued")
+
+	return tracks, nil
+}
+
+func (manager *DRMManagerCtx) ReleaseSession(sessionID string) {
+	if manager.sessionKeys != nil {
+		manager.sessionKeys.Release(sessionID)
+	}
+}
+
+// SetWireVersion pins the frame header version of a session to one of
+// drm.FrameHeaderVersions, as picked by its client. Picking it again is
+// fine, another version is rejected with types.ErrDRMWireVersionPinned.
+func (manager *DRMManagerCtx) SetWireVersion(sessionID string, version int) error {
+	if manager.encryptor == nil || !manager.config.FrameHeader {
+		return types.ErrDRMUnsupported
+	}
+	if !slices.Contains(drm.FrameHeaderVersions, version) {
+		return fmt.Errorf("%w: %d", drm.ErrFrameHeaderVersion, version)
+	}
+
+	manager.wireMu.Lock()
+	defer manager.wireMu.Unlock()
+
+	if pinned, ok := manager.wireVersions[sessionID]; ok {
+		if pinned != version {
+			return fmt.Errorf("%w to %d", types.ErrDRMWireVersionPinned, pinned)
+		}
+		return nil
+	}
+
+	if manager.wireVersions == nil {
+		manager.wireVersions = map[string]int{}
+	}
+	manager.wireVersions[sessionID] = version
+
+	manager.logger.Debug().
+		Str("session_id", sessionID).
+		Int("version", version).
+		Msg("drm frame header version pinned")
+	return nil
+}
+
+// WireVersion returns the frame header version the frames of a session
+// are sent with, that of the encryptor until the session picked one
+func (manager *DRMManagerCtx) WireVersion(sessionID string) int {
+	manager.wireMu.Lock()
+	version, ok := manager.wireVersions[sessionID]
+	manager.wireMu.Unlock()
+
+	if ok {
+		return version
+	}
+	if manager.encryptor != nil {
+		return manager.encryptor.WireVersion()
+	}
+	return drm.FrameHeaderVersion
+}
+
+// InitData assembles the EME init data for the current key of the session
+// and the staged one, if any
+func (manager *DRMManagerCtx) InitData(sessionID string) (types.DRMInitData, error) {
+	if !manager.config.Enabled {
+		return types.DRMInitData{}, types.ErrDRMDisabled
+	}
+
+	// epoch is read first, so a switch in between only makes the
+	// document newer than its epoch and never older
+	epoch := manager.Epoch()
+	profile := manager.SessionProfile(sessionID)
+
+	data := types.DRMInitData{
+		Epoch:        epoch,
+		Scheme:       profile.Mode,
+		CryptBlocks:  profile.CryptBlocks,
+		SkipBlocks:   profile.SkipBlocks,
+		IV:           profile.IV,
+		InitDataType: "cenc",
+		Keys: []types.DRMInitDataKey{
+			{KeyID: profile.KeyID, Track: manager.keyTrack()},
+		},
+	}
+
+	// streams with keys of their own are never rotated
+	if pending, ok := manager.PendingProfile(); ok && pending.KeyID != profile.KeyID && manager.streamEncryptor(sessionID) == manager.encryptor {
+		data.Keys = append(data.Keys, types.DRMInitDataKey{
+			KeyID:   pending.KeyID,
+			Pending: true,
+			Track:   manager.keyTrack(),
+		})
+	}
+
+	// the audio key is static, it is requested along with the video key
+	if manager.sessionKeys != nil {
+		if key, ok := manager.sessionKeys.Keys(sessionID)[drm.TrackAudio]; ok {
+			data.Keys = append(data.Keys, types.DRMInitDataKey{
+				KeyID: key.KeyID,
+				Track: drm.TrackAudio,
+			})
+		}
+	} else if manager.tracks != nil && manager.track != drm.TrackAudio {
+		if keyID := manager.tracks.KeyID(drm.TrackAudio); keyID != nil {
+			data.Keys = append(data.Keys, types.DRMInitDataKey{
+				KeyID: hex.EncodeToString(keyID),
+				Track: drm.TrackAudio,
+			})
+		}
+	}
+
+	keyIDs := make([][]byte, 0, len(data.Keys))
+	for _, key := range data.Keys {
+		keyID, err := hex.DecodeString(key.KeyID)
+		if err != nil {
+			return types.DRMInitData{}, err
+		}
+		keyIDs = append(keyIDs, keyID)
+	}
+
+	// the license URL names the current key
+	opts := manager.psshOptions(profile.Mode, keyIDs[0], sessionID)
+
+	data.PSSH = map[string][]byte{}
+	for _, system := range manager.psshSystems() {
+		pssh, err := drm.BuildPSSHOptions([]string{system}, keyIDs, opts)
+		if err != nil {
+			return types.DRMInitData{}, err
+		}
+
+		// the common system keeps its name from before widevine
+		name, _, _ := strings.Cut(system, ":")
+		if name == drm.PSSHSystemCommon {
+			name = "common"
+		}
+		data.PSSH[name] = pssh
+	}
+
+	// boxes of the key provider replace generated ones of their system
+	provided := map[string][]byte{}
+	for _, box := range manager.pssh {
+		for _, key := range data.Keys {
+			if key.KeyID == box.KeyID {
+				name := drm.SystemName(box.SystemID)
+				provided[name] = append(provided[name], box.Box...)
+				break
+			}
+		}
+	}
+	for name, pssh := range provided {
+		data.PSSH[name] = pssh
+	}
+
+	return data, nil
+}
+
+// ClearKeys returns the content keys of the requested key IDs, only keys
+// the stream is or is about to be encrypted with are known: the current
+// one, a staged one and the audio key. With session keys only those of
+// the session asking are, never the keys of another viewer.
+func (manager *DRMManagerCtx) ClearKeys(sessionID string, keyIDs [][]byte) ([]types.DRMClearKey, error) {
+	if !manager.config.Enabled {
+		return nil, types.ErrDRMDisabled
+	}
+
+	known := map[string]string{}
+	switch {
+	case manager.sessionKeys != nil:
+		for _, key := range manager.sessionKeys.Keys(sessionID) {
+			known[key.KeyID] = key.Key
+		}
+	case manager.encryptor == nil:
+		known[strings.ToLower(manager.config.KeyID)] = manager.config.Key
+	default:
+		// profiles never carry the key, sessions get the key of the stream
+		// they watch
+		stream := manager.streamEncryptor(sessionID)
+		for _, encryptor := range []*drm.Encryptor{stream, manager.TrackEncryptor(drm.TrackAudio)} {
+			if encryptor != nil && encryptor.Enabled() {
+				known[encryptor.KeyIDHex()] = hex.EncodeToString(encryptor.Key())
+			}
+		}
+
+		if keyID, key, ok := stream.PendingKey(); ok {
+			known[hex.EncodeToString(keyID)] = hex.EncodeToString(key)
+		}
+	}
+
+	var keys []types.DRMClearKey
+	for _, keyID := range keyIDs {
+		hexKey, ok := known[hex.EncodeToString(keyID)]
+		if !ok {
+			continue
+		}
+
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, types.DRMClearKey{KeyID: keyID, Key: key})
+	}
+
+	return keys, nil
+}
+
+func (manager *DRMManagerCtx) Capabilities() (types.DRMCapabilities, error) {
+	if !manager.config.Enabled {
+		return types.DRMCapabilities{}, types.ErrDRMDisabled
+	}
+
+	capabilities := types.DRMCapabilities{
+		Engine:       manager.config.Engine,
+		KeySEI:       manager.config.BuiltinEngine() && manager.config.KeySEI,
+		FrameHeader:  manager.config.BuiltinEngine() && manager.config.FrameHeader,
+		StreamChecks: []string{},
+	}
+
+	if manager.config.BuiltinEngine() && manager.config.StrictStreamChecks {
+		capabilities.StreamChecks = drm.StreamChecks()
+	}
+
+	return capabilities, nil
+}
+
+// ClientInfo returns what a session sets up its decryptor with, a disabled
+// manager tells clients so instead of refusing
+func (manager *DRMManagerCtx) ClientInfo(sessionID string) (types.DRMInfo, error) {
+	if !manager.config.Enabled {
+		return types.DRMInfo{}, nil
+	}
+
+	// the client must not decrypt the clear stream
+	if manager.Exempt(sessionID) {
+		return types.DRMInfo{Exempt: true}, nil
+	}
+
+	// as with InitData, the epoch is never newer than the parameters
+	epoch := manager.Epoch()
+
+	var info drm.ClientInfo
+	if manager.encryptor != nil {
+		var err error
+		if info, err = manager.streamEncryptor(sessionID).ClientInfo(); err != nil {
+			return types.DRMInfo{}, err
+		}
+	} else {
+		// cencryptor engine is configured statically
+		profile := manager.Profile()
+		info = drm.ClientInfo{
+			Enabled:     true,
+			Mode:        profile.Mode,
+			IVMode:      profile.IVMode,
+			CryptBlocks: profile.CryptBlocks,
+			SkipBlocks:  profile.SkipBlocks,
+		}
+	}
+
+	// the key of the session, or of the static configuration
+	if manager.sessionKeys != nil || manager.encryptor == nil {
+		profile := manager.SessionProfile(sessionID)
+
+		keyID, err := hex.DecodeString(profile.KeyID)
+		if err != nil {
+			return types.DRMInfo{}, err
+		}
+		info.KeyID = keyID
+
+		if !drm.PerSampleIV(info.IVMode) {
+			if info.IV, err = hex.DecodeString(profile.IV); err != nil {
+				return types.DRMInfo{}, err
+			}
+			if manager.sessionKeys != nil {
+				info.Layers = manager.sessionKeys.Layers(sessionID)
+			}
+		}
+
+		if info.InitData, err = drm.BuildPSSHOptions(manager.psshSystems(), [][]byte{keyID}, manager.psshOptions(profile.Mode, keyID, sessionID)); err != nil {
+			return types.DRMInfo{}, err
+		}
+	} else if info.Enabled && drm.LicenseURLPerSession(manager.config.PlayReadyLAURL()) {
+		// the shared init data leaves the session out of the PlayReady header
+		var err error
+		if info.InitData, err = drm.BuildPSSHOptions(manager.psshSystems(), [][]byte{info.KeyID}, manager.psshOptions(info.Mode, info.KeyID, sessionID)); err != nil {
+			return types.DRMInfo{}, err
+		}
+	}
+
+	var layers []types.DRMLayer
+	for _, layer := range info.Layers {
+		layers = append(layers, types.DRMLayer{ID: layer.RID, IV: layer.IV})
+	}
+
+	// the client picks the version of the frame headers
+	var wireVersions []int
+	if manager.encryptor != nil && manager.config.FrameHeader {
+		wireVersions = drm.FrameHeaderVersions
+	}
+
+	return types.DRMInfo{
+		Enabled:      info.Enabled,
+		Epoch:        epoch,
+		Mode:         info.Mode,
+		KeyID:        info.KeyID,
+		IV:           info.IV,
+		IVMode:       info.IVMode,
+		CryptBlocks:  info.CryptBlocks,
+		SkipBlocks:   info.SkipBlocks,
+		LicenseURL:   drm.ExpandLicenseURL(manager.config.LicenseURL, info.KeyID, sessionID),
+		LicenseURLs:  manager.licenseURLs(info.KeyID, sessionID),
+		InitData:     info.InitData,
+		Tracks:       manager.encryptedTracks(),
+		Layers:       layers,
+		WireVersions: wireVersions,
+	}, nil
+}
+
+// Info returns the DRM setup of a session for the client config endpoint,
+// a disabled manager reports itself so, as it does to exempt sessions
+func (manager *DRMManagerCtx) Info(sessionID string) (drm.DRMInfo, error) {
+	// exempt sessions see a disabled setup, the stream is sent clear
+	if !manager.config.Enabled || manager.Exempt(sessionID) {
+		return drm.DRMInfo{}, nil
+	}
+
+	var info drm.DRMInfo
+	if manager.encryptor != nil {
+		info = manager.streamEncryptor(sessionID).Info()
+	} else {
+		// cencryptor engine is configured statically
+		profile := manager.Profile()
+		info = drm.DRMInfo{Enabled: true, Scheme: profile.Mode}
+		if drm.PatternScheme(profile.Mode) {
+			info.CryptBlocks, info.SkipBlocks = profile.CryptBlocks, profile.SkipBlocks
+		}
+	}
+
+	// the key of the session, or of the static configuration
+	if manager.sessionKeys != nil || manager.encryptor == nil {
+		keyID, err := hex.DecodeString(manager.SessionProfile(sessionID).KeyID)
+		if err != nil {
+			return drm.DRMInfo{}, err
+		}
+		info.KeyID = keyID
+
+		// the skd:// URI names the key of the session too
+		if info.FairPlay != nil {
+			info.FairPlay.SKDURI = drm.FairPlayConfig{SKDURL: manager.config.FairPlay.SKDURL}.SKDURI(keyID)
+		}
+	}
+
+	info.LicenseURL = drm.ExpandLicenseURL(manager.config.LicenseURL, info.KeyID, sessionID)
+	info.LicenseURLs = manager.licenseURLs(info.KeyID, sessionID)
+	info.EncryptedTracks = manager.encryptedTracks()
+	return info, nil
+}
+
+// encryptedTracks returns the labels of the encrypted tracks, the cencryptor
+// engine encrypts video only
+func (manager *DRMManagerCtx) encryptedTracks() []string {
+	if manager.tracks == nil {
+		return []string{drm.TrackVideo}
+	}
+	return manager.tracks.EncryptedTracks()
+}
+
+// keyTrack returns the track label of the rotated key in init data, empty
+// for video
+func (manager *DRMManagerCtx) keyTrack() string {
+	if manager.track == drm.TrackVideo {
+		return ""
+	}
+	return manager.track
+}
+
+// psshSystems returns the systems of the generated pssh boxes
+func (manager *DRMManagerCtx) psshSystems() []string {
+	if len(manager.config.PSSHSystems) == 0 {
+		return []string{drm.PSSHSystemCommon}
+	}
+	return manager.config.PSSHSystems
+}
+
+// psshOptions returns the options of the pssh boxes of content protected
+// with the scheme under the key ID, handed to a session
+func (manager *DRMManagerCtx) psshOptions(scheme string, keyID []byte, sessionID string) drm.PSSHOptions {
+	return drm.PSSHOptions{
+		Scheme:         scheme,
+		PlayReadyLAURL: drm.ExpandLicenseURL(manager.config.PlayReadyLAURL(), keyID, sessionID),
+	}
+}
+
+// licenseURLs returns the license servers of single systems for a session,
+// nil when there are none
+func (manager *DRMManagerCtx) licenseURLs(keyID []byte, sessionID string) map[string]string {
+	urls := manager.config.LicenseURLs()
+	if len(urls) == 0 {
+		return nil
+	}
+	for system, url := range urls {
+		urls[system] = drm.ExpandLicenseURL(url, keyID, sessionID)
+	}
+	return urls
+}
+
+// Status reports whether the stream is encrypted, with which key and how
+// many frames were, counted over all tracks encrypted with shared keys
+func (manager *DRMManagerCtx) Status() types.DRMStatus {
+	if !manager.config.Enabled {
+		return types.DRMStatus{}
+	}
+
+	profile := manager.Profile()
+	status := types.DRMStatus{
+		Enabled:      true,
+		Mode:         profile.Mode,
+		KeyID:        profile.KeyID,
+		LastRotation: manager.lastRotation.Load(),
+	}
+
+	if drm.PatternScheme(profile.Mode) {
+		status.Pattern = drm.Pattern{CryptBlocks: profile.CryptBlocks, SkipBlocks: profile.SkipBlocks}.String()
+	}
+
+	if manager.encryptor != nil {
+		rotation := manager.encryptor.RotationState()
+		if rotation.Pending() {
+			status.PendingKeyID = rotation.PendingKeyID
+			status.PendingSinceFrame = &rotation.PendingFrame
+		}
+		if rotation.Last != nil {
+			status.LastRotationFrame = &rotation.Last.Frame
+		}
+		if acks, ok := manager.encryptor.KeyAcks(); ok {
+			status.AwaitingSessions = acks.Waiting
+			status.AckDeadline = &acks.Deadline
+		}
+	}
+
+	if manager.tracks != nil {
+		for _, track := range manager.tracks.EncryptedTracks() {
+			status.FramesEncrypted += manager.tracks.Encryptor(track).Stats().Frames
+		}
+	}
+
+	return status
+}
+
+// AcknowledgeKey records that the client of a session installed the key
+// of the hex encoded key ID, it reports whether that is the rotated key
+// waited for
+func (manager *DRMManagerCtx) AcknowledgeKey(sessionID, keyID string) bool {
+	if manager.encryptor == nil {
+		return false
+	}
+
+	ok := manager.encryptor.AcknowledgeKey(sessionID, keyID)
+	if ok {
+		manager.logger.Debug().
+			Str("session_id", sessionID).
+			Str("key_id", keyID).
+			Msg("drm key acknowledged")
+	}
+	return ok
+}
+
+// PushKey switches to key material pushed by a key orchestrator, with the
+// next access unit or at the next keyframe as the push asks. Key IDs the
+// stream used or that were pushed before, since the start or as recorded in
+// drm.seen_keys_file, are rejected with drm.ErrKeyReplayed. Every push is
+// written to the audit log.
+func (manager *DRMManagerCtx) PushKey(actor string, push drm.KeyPush) (drm.KeyPushResult, error) {
+	result, err := manager.pushKey(push)
+
+	var logger *zerolog.Event
+	if err != nil {
+		logger = manager.logger.Warn().Err(err)
+	} else {
+		logger = manager.logger.Info().
+			Str("previous_key_id", result.PreviousKeyID).
+			Bool("activated", result.Activated)
+	}
+	logger.
+		Str("actor", actor).
+		Hex("key_id", push.KeyID).
+		Str("activation", push.ActivationPolicy()).
+		Msg("drm key push")
+
+	return result, err
+}
+
+func (manager *DRMManagerCtx) pushKey(push drm.KeyPush) (drm.KeyPushResult, error) {
+	if !manager.config.Enabled {
+		return drm.KeyPushResult{}, types.ErrDRMDisabled
+	}
+
+	// the keys of a session are derived once, nothing switches them
+	if manager.encryptor == nil || manager.sessionKeys != nil {
+		return drm.KeyPushResult{}, types.ErrDRMUnsupported
+	}
+
+	if err := push.Validate(); err != nil {
+		return drm.KeyPushResult{}, err
+	}
+
+	manager.pushMu.Lock()
+	defer manager.pushMu.Unlock()
+
+	keyID := hex.EncodeToString(push.KeyID)
+	pending, _ := manager.encryptor.PendingKeyID()
+	if manager.seen(keyID) || keyID == pending {
+		return drm.KeyPushResult{}, drm.ErrKeyReplayed
+	}
+
+	result := drm.KeyPushResult{
+		KeyID:      keyID,
+		Activation: push.ActivationPolicy(),
+	}
+
+	if result.Activation == drm.KeyActivationImmediate {
+		prev, err := manager.encryptor.UpdateKey(push.KeyID, push.Key, push.IV)
+		if err != nil {
+			return drm.KeyPushResult{}, err
+		}
+		result.PreviousKeyID = hex.EncodeToString(prev)
+		result.Activated = true
+	} else {
+		profile := manager.encryptor.Profile()
+		result.PreviousKeyID = profile.KeyID
+		profile.KeyID, profile.Key, profile.IV = keyID, hex.EncodeToString(push.Key), hex.EncodeToString(push.IV)
+		profile.Generation = 0
+
+		if err := manager.encryptor.ApplyProfile(profile); err != nil {
+			return drm.KeyPushResult{}, err
+		}
+	}
+
+	// a failed push may be retried with the same key ID
+	manager.seeKey(keyID)
+	return result, nil
+}
+
+// seeKey remembers a key ID the stream used or was pushed, appending it to
+// drm.seen_keys_file when set
+func (manager *DRMManagerCtx) seeKey(keyID string) {
+	manager.seenMu.Lock()
+	defer manager.seenMu.Unlock()
+
+	if manager.seenKeys == nil {
+		manager.seenKeys = map[string]struct{}{}
+	}
+	if _, ok := manager.seenKeys[keyID]; ok {
+		return
+	}
+	manager.seenKeys[keyID] = struct{}{}
+
+	if manager.config.SeenKeysFile == "" {
+		return
+	}
+
+	file, err := os.OpenFile(manager.config.SeenKeysFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = file.WriteString(keyID + "\n")
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		manager.logger.Error().Err(err).
+			Str("file", manager.config.SeenKeysFile).
+			Str("key_id", keyID).
+			Msg("failed to persist seen drm key ID")
+	}
+}
+
+// loadSeenKeys reads the key IDs of drm.seen_keys_file, one per line, a
+// missing file has none
+func (manager *DRMManagerCtx) loadSeenKeys() error {
+	if manager.config.SeenKeysFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(manager.config.SeenKeysFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	manager.seenMu.Lock()
+	defer manager.seenMu.Unlock()
+
+	manager.seenKeys = map[string]struct{}{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if keyID := strings.TrimSpace(line); keyID != "" {
+			manager.seenKeys[keyID] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (manager *DRMManagerCtx) seen(keyID string) bool {
+	manager.seenMu.Lock()
+	defer manager.seenMu.Unlock()
+
+	_, ok := manager.seenKeys[keyID]
+	return ok
+}
+
+// RotateKey switches the encrypted track to new key material with the next
+// access unit, fields left empty are generated. Malformed material is
+// rejected before anything changes.
+func (manager *DRMManagerCtx) RotateKey(actor, keyID, key, iv string) (types.DRMKeyRotation, error) {
+	if !manager.config.Enabled {
+		return types.DRMKeyRotation{}, types.ErrDRMDisabled
+	}
+
+	// the keys of a session are derived once, nothing switches them
+	if manager.encryptor == nil || manager.sessionKeys != nil {
+		return types.DRMKeyRotation{}, types.ErrDRMUnsupported
+	}
+
+	for _, field := range []*string{&keyID, &key, &iv} {
+		if *field != "" {
+			continue
+		}
+
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return types.DRMKeyRotation{}, fmt.Errorf("unable to generate key material: %w", err)
+		}
+		*field = hex.EncodeToString(random)
+	}
+
+	// the new key takes over at the next keyframe, a clean switchover
+	// point for clients told by the drm/keychanged event
+	profile := manager.encryptor.Profile()
+	prev := profile.KeyID
+	profile.KeyID, profile.Key, profile.IV = keyID, key, iv
+	profile.Generation = 0
+
+	if err := manager.encryptor.ApplyProfile(profile); err != nil {
+		if !errors.Is(err, drm.ErrInvalidProfile) {
+			manager.logger.Warn().Err(err).Str("actor", actor).Msg("drm key was not rotated")
+		}
+		return types.DRMKeyRotation{}, err
+	}
+
+	rotation := types.DRMKeyRotation{
+		KeyID:         strings.ToLower(keyID),
+		PreviousKeyID: prev,
+	}
+
+	manager.logger.Info().
+		Str("actor", actor).
+		Str("key_id", rotation.KeyID).
+		Str("previous_key_id", rotation.PreviousKeyID).
+		Msg("drm key rotation staged manually for the next keyframe")
+
+	return rotation, nil
+}
+
+func (manager *DRMManagerCtx) ExportKey(actor, password string, publicKey *rsa.PublicKey) (types.DRMKeyExport, error) {
+	if !manager.config.Enabled {
+		return types.DRMKeyExport{}, types.ErrDRMDisabled
+	}
+
+	if manager.exporter == nil {
+		return types.DRMKeyExport{}, types.ErrDRMUnsupported
+	}
+
+	export, err := manager.exporter.Export(actor, password, publicKey)
+	if err != nil {
+		return types.DRMKeyExport{}, err
+	}
+
+	return types.DRMKeyExport{
+		KeyID:        export.KeyID,
+		Algorithm:    "RSA-OAEP-256",
+		EncryptedKey: export.EncryptedKey,
+	}, nil
+}
+
+// auditKeyExport records every key export attempt in the log, before the
+// export returns, and publishes it to notify all admins
+func (manager *DRMManagerCtx) auditKeyExport(a drm.KeyExportAttempt) {
+	switch {
+	case !a.LockedUntil.IsZero():
+		// repeated wrong passwords look like someone guessing
+		manager.logger.Error().
+			Err(a.Err).
+			Str("actor", a.Actor).
+			Int("failures", a.Failures).
+			Time("locked_until", a.LockedUntil).
+			Msg("!!! BREAK-GLASS: drm content key export locked after repeated wrong passwords !!!")
+	case a.Err != nil:
+		manager.logger.Warn().
+			Err(a.Err).
+			Str("actor", a.Actor).
+			Int("failures", a.Failures).
+			Msg("!!! BREAK-GLASS: drm content key export refused !!!")
+	default:
+		manager.logger.Warn().
+			Str("actor", a.Actor).
+			Str("key_id", a.KeyID).
+			Msg("!!! BREAK-GLASS: drm content key exported !!!")
+	}
+
+	manager.bus.Publish(drm.KeyExported{KeyExportAttempt: a})
+}
+
+func profileToTypes(p drm.Profile) types.DRMProfile {
+	return types.DRMProfile{
+		Mode:        p.Mode,
+		CryptBlocks: p.CryptBlocks,
+		SkipBlocks:  p.SkipBlocks,
+		KeyID:       p.KeyID,
+		IV:          p.IV,
+		IVMode:      p.IVMode,
+	}
+}
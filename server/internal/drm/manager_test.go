@@ -0,0 +1,213 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/m1k1o/neko/server/internal/config"
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/types"
+)
+
+const testDRMConfig = `
+drm:
+  enabled: true
+  engine: builtin
+  key_id: "00000000000000000000000000000001"
+  key: 3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c
+  iv: d5fbd6b82ed93e4ef98ae40931ee33b7
+  mode: cbcs
+  crypt_blocks: 1
+  skip_blocks: 9
+`
+
+// testSessions is a session manager without sessions, recording what is
+// broadcast to them
+type testSessions struct {
+	types.SessionManager
+	broadcasts chan testBroadcast
+}
+
+type testBroadcast struct {
+	event   string
+	payload any
+}
+
+func (s *testSessions) List() []types.Session                               { return nil }
+func (s *testSessions) Get(id string) (types.Session, bool)                 { return nil, false }
+func (s *testSessions) OnConnected(listener func(session types.Session))    {}
+func (s *testSessions) OnDisconnected(listener func(session types.Session)) {}
+func (s *testSessions) OnProfileChanged(func(types.Session, types.MemberProfile, types.MemberProfile)) {
+}
+
+func (s *testSessions) Broadcast(event string, payload any, exclude ...string) {
+	s.record(event, payload)
+}
+
+func (s *testSessions) AdminBroadcast(event string, payload any, exclude ...string) {
+	s.record(event, payload)
+}
+
+func (s *testSessions) record(event string, payload any) {
+	select {
+	case s.broadcasts <- testBroadcast{event, payload}:
+	default:
+	}
+}
+
+// wait returns the payload of the next broadcast of an event, failing the
+// test when none comes
+func (s *testSessions) wait(t *testing.T, event string) any {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case b := <-s.broadcasts:
+			if b.event == event {
+				return b.payload
+			}
+		case <-timeout:
+			t.Fatalf("%s was not broadcast", event)
+			return nil
+		}
+	}
+}
+
+func loadTestConfig(t *testing.T, content string) config.DRM {
+	t.Helper()
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	cmd := &cobra.Command{}
+	if err := (config.DRM{}).Init(cmd); err != nil {
+		t.Fatalf("Init() returned error: %s", err)
+	}
+
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(content)); err != nil {
+		t.Fatalf("unable to read config: %s", err)
+	}
+
+	var cfg config.DRM
+	cfg.Set()
+	return cfg
+}
+
+// newTestManager returns a manager of the configuration that is not
+// started yet, it is shut down with the test
+func newTestManager(t *testing.T, content string) (*DRMManagerCtx, *testSessions) {
+	t.Helper()
+
+	// metrics are registered again by every manager
+	registerer := prometheus.DefaultRegisterer
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+	t.Cleanup(func() { prometheus.DefaultRegisterer = registerer })
+
+	cfg := loadTestConfig(t, content)
+	sessions := &testSessions{broadcasts: make(chan testBroadcast, 64)}
+	manager := New(sessions, &cfg)
+
+	t.Cleanup(func() {
+		select {
+		case <-manager.shutdown:
+		default:
+			manager.Shutdown()
+		}
+	})
+	return manager, sessions
+}
+
+func TestDRMManager_ClearKeys(t *testing.T) {
+	manager, _ := newTestManager(t, testDRMConfig)
+	manager.Start()
+
+	keyID := mustDecodeHex(t, "00000000000000000000000000000001")
+	unknown := mustDecodeHex(t, "000000000000000000000000000000ff")
+
+	keys, err := manager.ClearKeys("", [][]byte{keyID, unknown})
+	if err != nil {
+		t.Fatalf("ClearKeys() returned error: %s", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].KeyID, keyID) || !bytes.Equal(keys[0].Key, mustDecodeHex(t, "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c")) {
+		t.Errorf("ClearKeys() = %+v, want the configured key alone", keys)
+	}
+
+	// a staged key is served before the switch
+	next := loadTestConfig(t, reloadedKeyConfig)
+	if err := manager.Reload(&next); err != nil {
+		t.Fatalf("Reload() returned error: %s", err)
+	}
+	nextKeyID := mustDecodeHex(t, next.KeyID)
+	keys, err = manager.ClearKeys("", [][]byte{nextKeyID})
+	if err != nil {
+		t.Fatalf("ClearKeys() returned error: %s", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Key, mustDecodeHex(t, next.Key)) {
+		t.Errorf("ClearKeys() of the staged key = %+v, want %s", keys, next.Key)
+	}
+}
+
+func TestDRMManager_ClearKeysSessionKeys(t *testing.T) {
+	content := testDRMConfig + "  session_keys: true\n  session_secret: 0123456789abcdef0123456789abcdef\n"
+	manager, _ := newTestManager(t, content)
+	manager.Start()
+
+	key := manager.sessionKeys.Keys("first")[drm.TrackVideo]
+	keyID := mustDecodeHex(t, key.KeyID)
+
+	keys, err := manager.ClearKeys("first", [][]byte{keyID})
+	if err != nil {
+		t.Fatalf("ClearKeys() returned error: %s", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Key, mustDecodeHex(t, key.Key)) {
+		t.Errorf("ClearKeys() = %+v, want the session key %s", keys, key.Key)
+	}
+
+	// sessions never get the keys of others
+	if keys, err := manager.ClearKeys("second", [][]byte{keyID}); err != nil || len(keys) != 0 {
+		t.Errorf("ClearKeys() of another session = %+v, %v, want none", keys, err)
+	}
+}
+
+func TestDRMManager_PushKeyReplayedAfterRestart(t *testing.T) {
+	content := testDRMConfig + "  seen_keys_file: " + filepath.Join(t.TempDir(), "seen_keys") + "\n"
+
+	push := drm.KeyPush{
+		KeyID: mustDecodeHex(t, "00000000000000000000000000000002"),
+		Key:   mustDecodeHex(t, "4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d"),
+		IV:    mustDecodeHex(t, "d5fbd6b82ed93e4ef98ae40931ee33b7"),
+	}
+
+	manager, _ := newTestManager(t, content)
+	manager.Start()
+	if _, err := manager.PushKey("test", push); err != nil {
+		t.Fatalf("PushKey() returned error: %s", err)
+	}
+	manager.Shutdown()
+
+	// the key IDs seen before the restart are still rejected
+	manager, _ = newTestManager(t, content)
+	manager.Start()
+	for _, keyID := range []string{"00000000000000000000000000000001", "00000000000000000000000000000002"} {
+		replayed := push
+		replayed.KeyID = mustDecodeHex(t, keyID)
+		if _, err := manager.PushKey("test", replayed); !errors.Is(err, drm.ErrKeyReplayed) {
+			t.Errorf("PushKey() of %s after a restart returned %v, want %s", keyID, err, drm.ErrKeyReplayed)
+		}
+	}
+
+	push.KeyID = mustDecodeHex(t, "00000000000000000000000000000003")
+	if _, err := manager.PushKey("test", push); err != nil {
+		t.Errorf("PushKey() of a new key ID returned error: %s", err)
+	}
+}
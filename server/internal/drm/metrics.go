@@ -0,0 +1,70 @@
+package drm
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// encryptor counters exported per track, read from the stats snapshot on
+// scrape so that encrypting costs no more than the atomic increments
+var encryptorCounters = []struct {
+	name  string
+	help  string
+	value func(s drm.Stats) uint64
+}{
+	{"access_units_total", "Total number of access units encrypted.", func(s drm.Stats) uint64 { return s.Frames }},
+	{"nal_units_encrypted_total", "Total number of NAL units encrypted, whole samples for audio.", func(s drm.Stats) uint64 { return s.NALsEncrypted }},
+	{"nal_units_clear_total", "Total number of NAL units passed through clear.", func(s drm.Stats) uint64 { return s.NALsClear }},
+	{"bytes_in_total", "Total size of the access units before encryption.", func(s drm.Stats) uint64 { return s.BytesIn }},
+	{"bytes_out_total", "Total size of the access units after encryption.", func(s drm.Stats) uint64 { return s.BytesOut }},
+	{"encrypt_errors_total", "Total number of access units that failed to encrypt.", func(s drm.Stats) uint64 { return s.Errors }},
+}
+
+// registerEncryptorMetrics exports the counters and the encryption latency
+// of every track encryptor
+func registerEncryptorMetrics(tracks *drm.EncryptorSet) {
+	latency := promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:      "encrypt_duration_seconds",
+		Namespace: "neko",
+		Subsystem: "drm",
+		Help:      "Time spent encrypting an access unit.",
+		// 10us to 20ms
+		Buckets: prometheus.ExponentialBuckets(0.00001, 2, 12),
+	}, []string{"mode", "track"})
+
+	for _, track := range tracks.EncryptedTracks() {
+		encryptor := tracks.Encryptor(track)
+
+		for _, counter := range encryptorCounters {
+			value := counter.value
+			promauto.NewCounterFunc(prometheus.CounterOpts{
+				Name:      counter.name,
+				Namespace: "neko",
+				Subsystem: "drm",
+				Help:      counter.help,
+				ConstLabels: map[string]string{
+					"track": track,
+				},
+			}, func() float64 {
+				return float64(value(encryptor.Stats()))
+			})
+		}
+
+		// label lookups stay off the encryption path
+		observers := map[string]prometheus.Observer{
+			"cbcs": latency.WithLabelValues("cbcs", track),
+			"cenc": latency.WithLabelValues("cenc", track),
+			"cens": latency.WithLabelValues("cens", track),
+			"cbc1": latency.WithLabelValues("cbc1", track),
+		}
+		encryptor.OnEncrypt(func(mode string, d time.Duration) {
+			if observer, ok := observers[mode]; ok {
+				observer.Observe(d.Seconds())
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package drm
+
+import (
+	"errors"
+
+	"github.com/m1k1o/neko/server/internal/config"
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// Reload applies the DRM configuration read again after the config file
+// changed. A new key is switched to like a rotation, clients learn it from
+// the key rotated event. drm.enabled switches the encryptors created at
+// startup on or off at the next keyframe, clients install or remove their
+// decryptor on the profile changed event; with session keys or without an
+// encryptor it needs a restart. The other options are only read at
+// startup and changes to them are just logged. An invalid configuration
+// is rejected and the current key stays in use.
+func (manager *DRMManagerCtx) Reload(next *config.DRM) error {
+	manager.reloadMu.Lock()
+	defer manager.reloadMu.Unlock()
+
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	key, restart := manager.applied.ReloadChanges(next)
+
+	toggle := next.Enabled != manager.applied.Enabled
+	if toggle && (manager.encryptor == nil || manager.sessionKeys != nil) {
+		restart = append(restart, "Enabled")
+		toggle = false
+	}
+
+	if len(restart) > 0 {
+		manager.logger.Warn().
+			Strs("fields", restart).
+			Msg("changed drm options take effect after a restart")
+	}
+
+	// empty fields would be generated, nobody could know the new key
+	rotate := key && manager.config.Enabled
+	if rotate && (next.KeyID == "" || next.Key == "" || next.IV == "") {
+		return errors.New("drm.key_id, drm.key and drm.iv must all be set to switch the key")
+	}
+
+	if toggle {
+		if err := manager.setEnabled(next.Enabled); err != nil {
+			return err
+		}
+		manager.applied.Enabled = next.Enabled
+		manager.enabled.Store(next.Enabled)
+	}
+
+	if !rotate {
+		return nil
+	}
+
+	if _, err := manager.RotateKey("config", next.KeyID, next.Key, next.IV); err != nil {
+		return err
+	}
+
+	manager.applied.KeyID = next.KeyID
+	manager.applied.Key = next.Key
+	manager.applied.IV = next.IV
+	return nil
+}
+
+// setEnabled switches the encryptors of the tracks and streams on or off
+// at their next keyframe
+func (manager *DRMManagerCtx) setEnabled(enabled bool) error {
+	var encryptors []*drm.Encryptor
+	for _, track := range manager.tracks.EncryptedTracks() {
+		encryptors = append(encryptors, manager.tracks.Encryptor(track))
+	}
+	if manager.streams != nil {
+		for _, id := range manager.streams.Streams() {
+			encryptors = append(encryptors, manager.streams.Get(id))
+		}
+	}
+
+	for _, encryptor := range encryptors {
+		if err := encryptor.SetEnabled(enabled); err != nil {
+			return err
+		}
+	}
+
+	manager.logger.Info().
+		Bool("enabled", enabled).
+		Msg("drm encryption switches at the next keyframe")
+	return nil
+}
@@ -0,0 +1,198 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/types/event"
+	"github.com/m1k1o/neko/server/pkg/types/message"
+)
+
+const reloadedKeyConfig = `
+drm:
+  enabled: true
+  engine: builtin
+  key_id: "00000000000000000000000000000002"
+  key: 4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d
+  iv: 0123456789abcdef0123456789abcdef
+  mode: cbcs
+  crypt_blocks: 1
+  skip_blocks: 9
+`
+
+func TestDRMManager_ReloadKey(t *testing.T) {
+	manager, sessions := newTestManager(t, testDRMConfig)
+	manager.Start()
+
+	next := loadTestConfig(t, reloadedKeyConfig)
+	if err := manager.Reload(&next); err != nil {
+		t.Fatalf("Reload() returned error: %s", err)
+	}
+
+	// the key is staged like a rotation, the current one stays until the
+	// next keyframe
+	if pending, ok := manager.encryptor.PendingKeyID(); !ok || pending != next.KeyID {
+		t.Errorf("PendingKeyID() = %s, %v, want %s", pending, ok, next.KeyID)
+	}
+	if got := manager.encryptor.KeyIDHex(); got != "00000000000000000000000000000001" {
+		t.Errorf("KeyIDHex() = %s before the keyframe, want the old key", got)
+	}
+	if manager.applied.KeyID != next.KeyID || manager.applied.Key != next.Key || manager.applied.IV != next.IV {
+		t.Errorf("applied key = %s:%s:%s, want %s:%s:%s", manager.applied.KeyID, manager.applied.Key, manager.applied.IV, next.KeyID, next.Key, next.IV)
+	}
+
+	manager.encryptor.Keyframe()
+	if got := manager.encryptor.KeyIDHex(); got != next.KeyID {
+		t.Errorf("KeyIDHex() = %s after the keyframe, want %s", got, next.KeyID)
+	}
+
+	changed, ok := sessions.wait(t, event.DRM_KEY_CHANGED).(message.DRMKeyChanged)
+	if !ok || hex.EncodeToString(changed.KeyID) != next.KeyID {
+		t.Errorf("%s = %+v, want key ID %s", event.DRM_KEY_CHANGED, changed, next.KeyID)
+	}
+
+	// reloading the same file again changes nothing
+	if err := manager.Reload(&next); err != nil {
+		t.Fatalf("Reload() of the same config returned error: %s", err)
+	}
+	if pending, ok := manager.encryptor.PendingKeyID(); ok {
+		t.Errorf("PendingKeyID() = %s after reloading the same key, want none", pending)
+	}
+}
+
+func TestDRMManager_ReloadRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name:    "invalid",
+			content: strings.Replace(reloadedKeyConfig, "mode: cbcs", "mode: ctr", 1),
+			err:     "drm.mode",
+		},
+		{
+			name:    "malformed key",
+			content: strings.Replace(reloadedKeyConfig, "4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d", "4d4d", 1),
+			err:     "drm.key",
+		},
+		{
+			name:    "missing key",
+			content: strings.Replace(reloadedKeyConfig, "  key: 4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d\n", "", 1),
+			err:     "must all be set",
+		},
+		{
+			name:    "missing key id",
+			content: strings.Replace(reloadedKeyConfig, `  key_id: "00000000000000000000000000000002"`+"\n", "", 1),
+			err:     "must all be set",
+		},
+		{
+			name:    "missing iv",
+			content: strings.Replace(reloadedKeyConfig, "  iv: 0123456789abcdef0123456789abcdef\n", "", 1),
+			err:     "must all be set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager, _ := newTestManager(t, testDRMConfig)
+			manager.Start()
+			applied := manager.applied
+
+			next := loadTestConfig(t, tt.content)
+			err := manager.Reload(&next)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Reload() returned error %v, want one containing %q", err, tt.err)
+			}
+
+			// the current key stays in use
+			if pending, ok := manager.encryptor.PendingKeyID(); ok {
+				t.Errorf("PendingKeyID() = %s after a rejected reload, want none", pending)
+			}
+			manager.encryptor.Keyframe()
+			if got := manager.encryptor.KeyIDHex(); got != applied.KeyID {
+				t.Errorf("KeyIDHex() = %s, want %s", got, applied.KeyID)
+			}
+			if manager.applied.KeyID != applied.KeyID || manager.applied.Key != applied.Key || manager.applied.IV != applied.IV {
+				t.Errorf("applied key changed to %s:%s:%s", manager.applied.KeyID, manager.applied.Key, manager.applied.IV)
+			}
+		})
+	}
+}
+
+func TestDRMManager_ReloadEnabled(t *testing.T) {
+	manager, sessions := newTestManager(t, testDRMConfig)
+	manager.Start()
+
+	for _, enabled := range []bool{false, true} {
+		content := testDRMConfig
+		if !enabled {
+			content = strings.Replace(content, "enabled: true", "enabled: false", 1)
+		}
+
+		next := loadTestConfig(t, content)
+		if err := manager.Reload(&next); err != nil {
+			t.Fatalf("Reload() of enabled %v returned error: %s", enabled, err)
+		}
+		if got, ok := manager.encryptor.PendingEnabled(); !ok || got != enabled {
+			t.Errorf("PendingEnabled() = %v, %v, want %v, true", got, ok, enabled)
+		}
+		if manager.applied.Enabled != enabled || manager.Enabled() != enabled {
+			t.Errorf("applied enabled = %v, Enabled() = %v, want %v", manager.applied.Enabled, manager.Enabled(), enabled)
+		}
+
+		// clients install or remove their decryptor on the update
+		manager.encryptor.Keyframe()
+		if got := manager.encryptor.Encrypting(); got != enabled {
+			t.Errorf("Encrypting() = %v after the keyframe, want %v", got, enabled)
+		}
+
+		updated, ok := sessions.wait(t, event.DRM_UPDATED).(message.DRMUpdated)
+		if !ok || updated.Enabled != enabled {
+			t.Errorf("%s = %+v, want enabled %v", event.DRM_UPDATED, updated, enabled)
+		}
+
+		info, err := manager.ClientInfo("")
+		if err != nil {
+			t.Fatalf("ClientInfo() returned error: %s", err)
+		}
+		if info.Enabled != enabled {
+			t.Errorf("ClientInfo() enabled = %v, want %v", info.Enabled, enabled)
+		}
+	}
+
+	// the encryptor keeps its key while switched off
+	if got := manager.encryptor.KeyID(); !bytes.Equal(got, mustDecodeHex(t, "00000000000000000000000000000001")) {
+		t.Errorf("KeyID() = %x after switching back on", got)
+	}
+}
+
+func TestDRMManager_ReloadEnabledSessionKeys(t *testing.T) {
+	content := testDRMConfig + "  session_keys: true\n  session_secret: 0123456789abcdef0123456789abcdef\n"
+	manager, _ := newTestManager(t, content)
+	manager.Start()
+
+	// every session has an encryptor of its own, the switch needs a restart
+	next := loadTestConfig(t, strings.Replace(content, "enabled: true", "enabled: false", 1))
+	if err := manager.Reload(&next); err != nil {
+		t.Fatalf("Reload() returned error: %s", err)
+	}
+	if _, ok := manager.encryptor.PendingEnabled(); ok {
+		t.Errorf("PendingEnabled() reports a switch with session keys")
+	}
+	if !manager.applied.Enabled || !manager.Enabled() {
+		t.Errorf("applied enabled = %v, Enabled() = %v, want the restart to apply it", manager.applied.Enabled, manager.Enabled())
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %s", s, err)
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package drm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// how often the pre-provisioned key schedule is checked
+const keyRotationInterval = time.Second
+
+// keyStockLow is raised from the rotation loop, after a key was staged
+func (manager *DRMManagerCtx) keyStockLow(remaining int) {
+	manager.bus.Publish(drm.KeyStockLow{
+		Time:      time.Now(),
+		Remaining: remaining,
+	})
+}
+
+// rotateKeys stages the pre-provisioned keys one after the other, the
+// encryptor switches at the first IDR frame after their activation time
+func (manager *DRMManagerCtx) rotateKeys() {
+	defer manager.wg.Done()
+
+	ticker := time.NewTicker(keyRotationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-manager.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		key, ok, err := manager.schedule.Stage(manager.encryptor)
+		if errors.Is(err, drm.ErrKeysExhausted) {
+			// the last key stays in use until new keys are provisioned
+			if manager.watcher == nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			manager.logger.Error().Err(err).
+				Uint64("generation", key.Generation).
+				Msg("unable to stage pre-provisioned drm key")
+			continue
+		}
+		if ok {
+			manager.logger.Info().
+				Uint64("generation", key.Generation).
+				Str("key_id", key.KeyID).
+				Time("activate_at", key.ActivateAt).
+				Int("remaining", manager.schedule.Remaining()).
+				Msg("pre-provisioned drm key staged")
+		}
+	}
+}
+
+// watchKeys provisions the keys a watched provider learns about, the
+// rotation loop stages them
+func (manager *DRMManagerCtx) watchKeys() {
+	defer manager.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	keys := manager.watcher.Watch(ctx)
+	for {
+		var watched []drm.Key
+		select {
+		case <-manager.shutdown:
+			return
+		case k, ok := <-keys:
+			if !ok {
+				return
+			}
+			watched = k
+		}
+
+		added, err := manager.schedule.Provision(watched)
+		if err != nil {
+			manager.logger.Error().Err(err).
+				Str("provider", manager.config.KeyProviderName()).
+				Msg("unable to provision watched drm keys")
+			continue
+		}
+		if added > 0 {
+			manager.logger.Info().
+				Str("provider", manager.config.KeyProviderName()).
+				Int("added", added).
+				Int("remaining", manager.schedule.Remaining()).
+				Msg("drm keys provisioned")
+		}
+	}
+}
@@ -753,6 +753,10 @@ func (s *session) wsToClient(msg []byte) error {
 	case event.SYSTEM_HEARTBEAT:
 		return nil
 
+	// legacy clients do not decrypt
+	case event.SYSTEM_DRM:
+		return nil
+
 	default:
 		return fmt.Errorf("unknown event type: %s", data.Event)
 	}
@@ -139,7 +139,7 @@ func (manager *SessionManagerCtx) Update(id string, profile types.MemberProfile)
 	manager.emmiter.Emit("profile_changed", session, profile, old)
 	manager.save()
 
-	session.profileChanged()
+	session.profileChanged(old)
 	return nil
 }
 
@@ -41,7 +41,7 @@ func (session *SessionCtx) Profile() types.MemberProfile {
 	return session.profile
 }
 
-func (session *SessionCtx) profileChanged() {
+func (session *SessionCtx) profileChanged(old types.MemberProfile) {
 	if !session.profile.CanHost && session.IsHost() {
 		session.ClearHost()
 	}
@@ -59,6 +59,14 @@ func (session *SessionCtx) profileChanged() {
 		session.DestroyWebSocketPeer("profile changed")
 	}
 
+	// tracks are encrypted or sent clear from the start, the client
+	// reconnects with a new peer
+	if session.profile.DRMExempt != old.DRMExempt && session.state.IsWatching {
+		if webrtcPeer := session.GetWebRTCPeer(); webrtcPeer != nil {
+			webrtcPeer.Destroy()
+		}
+	}
+
 	// update webrtc paused state
 	if webrtcPeer := session.GetWebRTCPeer(); webrtcPeer != nil {
 		webrtcPeer.SetPaused(session.PrivateModeEnabled())
@@ -50,7 +50,7 @@ const (
 	rtcpPLIInterval = 3 * time.Second
 )
 
-func New(desktop types.DesktopManager, capture types.CaptureManager, config *config.WebRTC) *WebRTCManagerCtx {
+func New(desktop types.DesktopManager, capture types.CaptureManager, drmManager types.DRMManager, config *config.WebRTC) *WebRTCManagerCtx {
 	logger := log.With().Str("module", "webrtc").Logger()
 
 	configuration := webrtc.Configuration{
@@ -77,11 +77,18 @@ func New(desktop types.DesktopManager, capture types.CaptureManager, config *con
 		configuration.ICEServers = ICEServers
 	}
 
-	// DRM encryption is now handled at the GStreamer pipeline level using CastLabs cencryptor plugin.
-	// The old Go-based encryptor is disabled. When NEKO_DRM_ENABLED=true, the GStreamer pipeline
-	// automatically adds the cencryptor element (see capture_pipeline.go).
-	var drmEncryptor *drm.Encryptor = nil
-	if os.Getenv("NEKO_DRM_ENABLED") == "true" {
+	// DRM encryption is handled at the GStreamer pipeline level using CastLabs cencryptor plugin
+	// by default. When NEKO_DRM_ENABLED=true, the GStreamer pipeline automatically adds the
+	// cencryptor element (see capture_pipeline.go). With the builtin engine, video samples
+	// are encrypted by the DRM manager's encryptor instead.
+	drmEncryptor := drmManager.TrackEncryptor(drm.TrackVideo)
+	drmAudioEncryptor := drmManager.TrackEncryptor(drm.TrackAudio)
+	if drmManager.Encryptor() != nil {
+		logger.Info().
+			Bool("video", drmEncryptor != nil && drmEncryptor.Enabled()).
+			Bool("audio", drmAudioEncryptor != nil && drmAudioEncryptor.Enabled()).
+			Msg("DRM encryption enabled via builtin encryptor")
+	} else if os.Getenv("NEKO_DRM_ENABLED") == "true" {
 		logger.Info().Msg("DRM encryption enabled via GStreamer cencryptor plugin")
 	}
 
@@ -96,7 +103,10 @@ func New(desktop types.DesktopManager, capture types.CaptureManager, config *con
 		capture:      capture,
 		curImage:     cursor.NewImage(logger, desktop),
 		curPosition:  cursor.NewPosition(logger),
+		drm:          drmManager,
 		drmEncryptor: drmEncryptor,
+
+		drmAudioEncryptor: drmAudioEncryptor,
 	}
 }
 
@@ -118,8 +128,11 @@ type WebRTCManagerCtx struct {
 
 	camStop, micStop *func()
 
-	// DRM encryption support
-	drmEncryptor *drm.Encryptor
+	// DRM encryption support, the encryptors are shared by all sessions
+	// unless they have keys of their own
+	drm               types.DRMManager
+	drmEncryptor      *drm.Encryptor
+	drmAudioEncryptor *drm.Encryptor
 }
 
 func (manager *WebRTCManagerCtx) Start() {
@@ -321,8 +334,55 @@ func (manager *WebRTCManagerCtx) CreatePeer(session types.Session) (*webrtc.Sess
 		})
 	}
 
-	// audio track
-	audioTrack, err := NewTrack(logger, audioCodec, connection)
+	// exempt sessions are sent both tracks clear
+	exempt := manager.drm.Exempt(session.ID())
+	if exempt {
+		logger.Info().Msg("DRM exempt session, tracks are sent clear")
+	}
+
+	// with DRM session keys the tracks are encrypted for this session only
+	var sessionTracks *drm.EncryptorSet
+	if !exempt {
+		sessionTracks, err = manager.drm.AcquireSession(session.ID())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	releaseSession := func() {
+		if sessionTracks != nil {
+			manager.drm.ReleaseSession(session.ID())
+		}
+	}
+
+	// a peer that was not created is never closed
+	created := false
+	defer func() {
+		if !created {
+			releaseSession()
+		}
+	}()
+
+	audioEncryptor, videoEncryptor := manager.drmAudioEncryptor, manager.drmEncryptor
+	if sessionTracks != nil {
+		audioEncryptor = sessionTracks.Encryptor(drm.TrackAudio)
+		videoEncryptor = sessionTracks.Encryptor(drm.TrackVideo)
+	}
+	if exempt {
+		audioEncryptor, videoEncryptor = nil, nil
+	}
+
+	// frame headers of the version the client negotiated
+	wireVersion := func() int {
+		return manager.drm.WireVersion(session.ID())
+	}
+
+	// audio track with optional DRM encryption using its own key
+	var audioOpts []trackOption
+	if audioEncryptor != nil && audioEncryptor.Enabled() {
+		audioOpts = append(audioOpts, WithEncryptor(audioEncryptor), WithWireVersion(wireVersion))
+		logger.Info().Bool("session_key", sessionTracks != nil).Msg("DRM encryption enabled for audio track")
+	}
+	audioTrack, err := NewTrack(logger, audioCodec, connection, audioOpts...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -339,9 +399,12 @@ func (manager *WebRTCManagerCtx) CreatePeer(session types.Session) (*webrtc.Sess
 	// video track with optional DRM encryption
 	videoRtcp := make(chan []rtcp.Packet, 1)
 	videoOpts := []trackOption{WithRtcpChan(videoRtcp)}
-	if manager.drmEncryptor != nil && manager.drmEncryptor.Enabled() {
-		videoOpts = append(videoOpts, WithEncryptor(manager.drmEncryptor))
-		logger.Info().Msg("DRM encryption enabled for video track")
+	if videoEncryptor != nil && videoEncryptor.Enabled() {
+		videoOpts = append(videoOpts, WithEncryptor(videoEncryptor), WithWireVersion(wireVersion))
+		if streams := manager.drm.StreamEncryptors(); streams != nil && sessionTracks == nil {
+			videoOpts = append(videoOpts, WithStreamEncryptors(streams))
+		}
+		logger.Info().Bool("session_key", sessionTracks != nil).Msg("DRM encryption enabled for video track")
 	}
 	videoTrack, err := NewTrack(logger, videoCodec, connection, videoOpts...)
 	if err != nil {
@@ -385,6 +448,8 @@ func (manager *WebRTCManagerCtx) CreatePeer(session types.Session) (*webrtc.Sess
 		videoTrack:  videoTrack,
 		dataChannel: dataChannel,
 		rtcpChannel: videoRtcp,
+		// drm signaling
+		drm: manager.drm,
 		// config
 		iceTrickle:      manager.config.ICETrickle,
 		estimatorConfig: manager.config.Estimator,
@@ -527,6 +592,7 @@ func (manager *WebRTCManagerCtx) CreatePeer(session types.Session) (*webrtc.Sess
 				audioTrack.Shutdown()
 				videoTrack.Shutdown()
 				close(videoRtcp)
+				releaseSession()
 			})
 		}
 
@@ -605,6 +671,7 @@ func (manager *WebRTCManagerCtx) CreatePeer(session types.Session) (*webrtc.Sess
 	// start estimator reader
 	go peer.estimatorReader()
 
+	created = true
 	return offer, peer, nil
 }
 
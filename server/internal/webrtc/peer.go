@@ -35,6 +35,8 @@ type WebRTCPeerCtx struct {
 	videoTrack  *Track
 	dataChannel *webrtc.DataChannel
 	rtcpChannel chan []rtcp.Packet
+	// tells the client the key of another video stream
+	drm types.DRMManager
 	// config
 	iceTrickle      bool
 	estimatorConfig config.WebRTCEstimator
@@ -340,6 +342,7 @@ func (peer *WebRTCPeerCtx) SetVideo(r types.PeerVideoRequest) error {
 	defer peer.mu.Unlock()
 
 	modified := false
+	streamChanged := false
 
 	// video disabled
 	if r.Disabled != nil {
@@ -378,6 +381,7 @@ func (peer *WebRTCPeerCtx) SetVideo(r types.PeerVideoRequest) error {
 
 			peer.logger.Info().Str("video_id", videoID).Msg("set video")
 			modified = true
+			streamChanged = true
 		}
 	}
 
@@ -404,6 +408,11 @@ func (peer *WebRTCPeerCtx) SetVideo(r types.PeerVideoRequest) error {
 		go func() {
 			// in goroutine because of mutex and we don't want to block
 			peer.session.Send(event.SIGNAL_VIDEO, peer.Video())
+
+			// the stream may be encrypted with another key
+			if streamChanged {
+				peer.drm.StreamChanged(peer.session)
+			}
 		}()
 	}
 
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
@@ -26,10 +27,20 @@ type Track struct {
 	stream   types.StreamSinkManager
 	streamMu sync.Mutex
 
-	// DRM encryption support
+	// DRM encryption support, layer is the encryptor of the stream
+	// listened to, see drm.Encryptor.ForLayer
 	encryptor *drm.Encryptor
+	layer     atomic.Pointer[drm.Encryptor]
+	// encryptors of the streams with keys of their own, by stream ID
+	streams *drm.EncryptorRegistry
+	// frame header version negotiated by the session, nil for the default
+	wireVersion func() int
 }
 
+// encryptBuffers hold the ciphertext of samples until they are written, the
+// samples themselves are shared by every track of the stream
+var encryptBuffers drm.BufferPool
+
 type trackOption func(*Track)
 
 func WithRtcpChan(rtcp chan []rtcp.Packet) trackOption {
@@ -45,6 +56,22 @@ func WithEncryptor(encryptor *drm.Encryptor) trackOption {
 	}
 }
 
+// WithStreamEncryptors sets the encryptors of streams with keys of their
+// own, the others are encrypted by the encryptor of WithEncryptor
+func WithStreamEncryptors(streams *drm.EncryptorRegistry) trackOption {
+	return func(t *Track) {
+		t.streams = streams
+	}
+}
+
+// WithWireVersion sets the frame header version of the session, looked up
+// for every frame as the client may pick one while the stream runs
+func WithWireVersion(version func() int) trackOption {
+	return func(t *Track) {
+		t.wireVersion = version
+	}
+}
+
 func NewTrack(logger zerolog.Logger, codec codec.RTPCodec, connection *webrtc.PeerConnection, opts ...trackOption) (*Track, error) {
 	id := codec.Type.String()
 	track, err := webrtc.NewTrackLocalStaticSample(codec.Capability, id, "stream")
@@ -62,6 +89,7 @@ func NewTrack(logger zerolog.Logger, codec codec.RTPCodec, connection *webrtc.Pe
 	for _, opt := range opts {
 		opt(t)
 	}
+	t.layer.Store(t.encryptor)
 
 	sender, err := connection.AddTrack(t.track)
 	if err != nil {
@@ -110,9 +138,46 @@ func (t *Track) sampleReader() {
 
 		// Apply DRM encryption if configured
 		data := sample.Data
-		if t.encryptor != nil && t.encryptor.Enabled() {
-			encrypted, err := t.encryptor.Encrypt(data)
-			if err != nil {
+		var encrypted []byte
+		if encryptor := t.layer.Load(); encryptor != nil && encryptor.Enabled() {
+			var err error
+			if encryptor.PrependsFrameHeader() {
+				// the header changes the length, never in place
+				var frame drm.EncryptedFrame
+				if t.wireVersion != nil {
+					frame, err = encryptor.EncryptFrameVersionTo(encryptBuffers.Get(len(data)), data, t.wireVersion())
+				} else {
+					frame, err = encryptor.EncryptFrameTo(encryptBuffers.Get(len(data)), data)
+				}
+				encrypted = frame.Data
+			} else {
+				encrypted = append(encryptBuffers.Get(len(data)), data...)
+
+				err = encryptor.EncryptInPlace(encrypted)
+				if errors.Is(err, drm.ErrNotInPlace) {
+					encrypted, err = encryptor.EncryptTo(encrypted, data)
+				}
+			}
+
+			if errors.Is(err, drm.ErrStreamViolation) {
+				// never sent, not even partially encrypted
+				t.logger.Warn().Err(err).Msg("DRM strict stream check failed, dropping sample")
+				encryptBuffers.Put(encrypted)
+				continue
+			} else if errors.Is(err, drm.ErrNoStartCode) || errors.Is(err, drm.ErrTruncatedNAL) || errors.Is(err, drm.ErrNothingEncrypted) {
+				// strict mode never sends slices clear
+				t.logger.Warn().Err(err).Msg("DRM strict mode rejected sample, dropping it")
+				encryptBuffers.Put(encrypted)
+				continue
+			} else if errors.Is(err, drm.ErrAlreadyEncrypted) {
+				// encrypted before reaching the track, once is enough
+				t.logger.Warn().Err(err).Msg("DRM sample was encrypted already, sending it as it is")
+			} else if errors.Is(err, drm.ErrInternal) {
+				// output would break decoders in ways hard to attribute
+				t.logger.Error().Err(err).Msg("DRM paranoid check failed, dropping sample")
+				encryptBuffers.Put(encrypted)
+				continue
+			} else if err != nil {
 				t.logger.Warn().Err(err).Msg("DRM encryption failed, sending unencrypted")
 			} else {
 				data = encrypted
@@ -128,6 +193,9 @@ func (t *Track) sampleReader() {
 		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
 			t.logger.Warn().Err(err).Msg("failed to write sample to track")
 		}
+
+		// packets were written, the ciphertext is not referenced anymore
+		encryptBuffers.Put(encrypted)
 	}
 }
 
@@ -146,9 +214,23 @@ func (t *Track) SetStream(stream types.StreamSinkManager) (bool, error) {
 		return false, nil
 	}
 
+	// every stream is a layer of its own with drm.layer_ivs, of the key
+	// of the stream with drm.streams
+	layer := t.encryptor
+	if layer != nil && t.streams != nil {
+		layer = t.streams.Get(stream.ID())
+	}
+	if layer != nil {
+		var err error
+		if layer, err = layer.ForLayer(stream.ID()); err != nil {
+			return false, err
+		}
+	}
+
 	// if paused, we switch the stream but don't add the listener
 	if t.paused {
 		t.stream = stream
+		t.layer.Store(layer)
 		return true, nil
 	}
 
@@ -163,6 +245,7 @@ func (t *Track) SetStream(stream types.StreamSinkManager) (bool, error) {
 	}
 
 	t.stream = stream
+	t.layer.Store(layer)
 	return true, nil
 }
 
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/types"
+	"github.com/m1k1o/neko/server/pkg/types/event"
+	"github.com/m1k1o/neko/server/pkg/types/message"
+)
+
+// drmRequestInterval is the least time between two drm/request of a session
+const drmRequestInterval = time.Second
+
+var ErrDRMRequestRateLimited = errors.New("drm info was requested too often")
+
+// drmRequest answers a client that set up its decryptor before the DRM info
+// arrived with the same message as pushed, telling it that DRM is disabled
+// when it is
+func (h *MessageHandlerCtx) drmRequest(session types.Session) error {
+	if !h.allowDRMRequest(session.ID(), time.Now()) {
+		return ErrDRMRequestRateLimited
+	}
+
+	return h.systemDRM(session)
+}
+
+// allowDRMRequest records a drm/request of a session, reporting whether it
+// is within the rate limit; requests of sessions long gone are forgotten
+func (h *MessageHandlerCtx) allowDRMRequest(sessionID string, now time.Time) bool {
+	h.drmRequestsMu.Lock()
+	defer h.drmRequestsMu.Unlock()
+
+	if last, ok := h.drmRequests[sessionID]; ok && now.Sub(last) < drmRequestInterval {
+		return false
+	}
+
+	for id, last := range h.drmRequests {
+		if now.Sub(last) >= drmRequestInterval {
+			delete(h.drmRequests, id)
+		}
+	}
+	if h.drmRequests == nil {
+		h.drmRequests = map[string]time.Time{}
+	}
+	h.drmRequests[sessionID] = now
+	return true
+}
+
+func (h *MessageHandlerCtx) drmKeyAck(session types.Session, payload *message.DRMKeyAck) error {
+	if !h.drm.Enabled() {
+		return types.ErrDRMDisabled
+	}
+
+	// acknowledgements of keys no longer waited for arrive late, they are
+	// of no consequence
+	h.drm.AcknowledgeKey(session.ID(), payload.KeyID)
+	return nil
+}
+
+func (h *MessageHandlerCtx) drmWireVersion(session types.Session, payload *message.DRMWireVersion) error {
+	if !h.drm.Enabled() {
+		return types.ErrDRMDisabled
+	}
+
+	if err := h.drm.SetWireVersion(session.ID(), payload.Version); err != nil {
+		return err
+	}
+
+	session.Send(event.DRM_WIRE_VERSION, message.DRMWireVersion{Version: payload.Version})
+	return nil
+}
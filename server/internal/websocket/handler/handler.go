@@ -1,6 +1,9 @@
 package handler
 
 import (
+	"sync"
+	"time"
+
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
@@ -15,6 +18,7 @@ func New(
 	desktop types.DesktopManager,
 	capture types.CaptureManager,
 	webrtc types.WebRTCManager,
+	drm types.DRMManager,
 ) *MessageHandlerCtx {
 	return &MessageHandlerCtx{
 		logger:   log.With().Str("module", "websocket").Str("submodule", "handler").Logger(),
@@ -22,6 +26,7 @@ func New(
 		desktop:  desktop,
 		capture:  capture,
 		webrtc:   webrtc,
+		drm:      drm,
 	}
 }
 
@@ -31,6 +36,11 @@ type MessageHandlerCtx struct {
 	webrtc   types.WebRTCManager
 	desktop  types.DesktopManager
 	capture  types.CaptureManager
+	drm      types.DRMManager
+
+	// last drm/request of every session, for the rate limit
+	drmRequestsMu sync.Mutex
+	drmRequests   map[string]time.Time
 }
 
 func (h *MessageHandlerCtx) Message(session types.Session, data types.WebSocketMessage) bool {
@@ -181,6 +191,20 @@ func (h *MessageHandlerCtx) Message(session types.Session, data types.WebSocketM
 			return h.keyboardModifiers(session, payload)
 		})
 
+	// DRM Events
+	case event.DRM_KEY_ACK:
+		payload := &message.DRMKeyAck{}
+		err = utils.Unmarshal(payload, data.Payload, func() error {
+			return h.drmKeyAck(session, payload)
+		})
+	case event.DRM_REQUEST:
+		err = h.drmRequest(session)
+	case event.DRM_WIRE_VERSION:
+		payload := &message.DRMWireVersion{}
+		err = utils.Unmarshal(payload, data.Payload, func() error {
+			return h.drmWireVersion(session, payload)
+		})
+
 	// Send Events
 	case event.SEND_UNICAST:
 		payload := &message.SendUnicast{}
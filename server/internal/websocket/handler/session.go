@@ -33,6 +33,11 @@ func (h *MessageHandlerCtx) SessionConnected(session types.Session) error {
 		return err
 	}
 
+	// clients joining mid-stream set up their decryptor right away
+	if err := h.systemDRM(session); err != nil {
+		return err
+	}
+
 	if session.Profile().IsAdmin {
 		if err := h.systemAdmin(session); err != nil {
 			return err
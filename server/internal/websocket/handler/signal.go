@@ -71,7 +71,7 @@ func (h *MessageHandlerCtx) signalRequest(session types.Session, payload *messag
 			Audio: peer.Audio(),
 		})
 
-	return nil
+	return h.systemDRM(session)
 }
 
 func (h *MessageHandlerCtx) signalRestart(session types.Session) error {
@@ -32,6 +32,16 @@ func (h *MessageHandlerCtx) systemInit(session types.Session) error {
 		}
 	}
 
+	// late joiners learn the current parameters and their epoch
+	var drm *message.SystemDRM
+	if h.drm.Enabled() {
+		drm = &message.SystemDRM{
+			Epoch:   h.drm.Epoch(),
+			Codec:   h.drm.Codec(),
+			Profile: h.drm.SessionProfile(session.ID()),
+		}
+	}
+
 	session.Send(
 		event.SYSTEM_INIT,
 		message.SystemInit{
@@ -45,11 +55,24 @@ func (h *MessageHandlerCtx) systemInit(session types.Session) error {
 			WebRTC: message.SystemWebRTC{
 				Videos: h.capture.Video().IDs(),
 			},
+			DRM: drm,
 		})
 
 	return nil
 }
 
+// systemDRM sends what to set up the decryptor with, also when DRM is
+// disabled so that clients know to skip it
+func (h *MessageHandlerCtx) systemDRM(session types.Session) error {
+	info, err := h.drm.ClientInfo(session.ID())
+	if err != nil {
+		return err
+	}
+
+	session.Send(event.SYSTEM_DRM, message.SystemDRMInfo{DRMInfo: info})
+	return nil
+}
+
 func (h *MessageHandlerCtx) systemAdmin(session types.Session) error {
 	configurations := h.desktop.ScreenConfigurations()
 
@@ -43,6 +43,7 @@ func New(
 	desktop types.DesktopManager,
 	capture types.CaptureManager,
 	webrtc types.WebRTCManager,
+	drm types.DRMManager,
 ) *WebSocketManagerCtx {
 	logger := log.With().Str("module", "websocket").Logger()
 
@@ -51,7 +52,7 @@ func New(
 		shutdown: make(chan struct{}),
 		sessions: sessions,
 		desktop:  desktop,
-		handler:  handler.New(sessions, desktop, capture, webrtc),
+		handler:  handler.New(sessions, desktop, capture, webrtc, drm),
 		handlers: []types.WebSocketHandler{},
 	}
 }
@@ -0,0 +1,225 @@
+package drm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pattern is a cbcs or cens crypt:skip block pattern
+type Pattern struct {
+	CryptBlocks int
+	SkipBlocks  int
+}
+
+// Ratio is the protected fraction of every pattern run
+func (p Pattern) Ratio() float64 {
+	return float64(p.CryptBlocks) / float64(p.CryptBlocks+p.SkipBlocks)
+}
+
+func (p Pattern) String() string {
+	return fmt.Sprintf("%d:%d", p.CryptBlocks, p.SkipBlocks)
+}
+
+// ParsePattern parses a pattern in crypt:skip form
+func ParsePattern(s string) (Pattern, error) {
+	crypt, skip, ok := strings.Cut(s, ":")
+	if !ok {
+		return Pattern{}, fmt.Errorf("pattern must be in crypt:skip form, got %q", s)
+	}
+
+	var p Pattern
+	var err1, err2 error
+	p.CryptBlocks, err1 = strconv.Atoi(crypt)
+	p.SkipBlocks, err2 = strconv.Atoi(skip)
+	if err1 != nil || err2 != nil || p.CryptBlocks <= 0 || p.SkipBlocks < 0 {
+		return Pattern{}, fmt.Errorf("pattern must have positive crypt and non-negative skip blocks, got %q", s)
+	}
+
+	return p, nil
+}
+
+// patternLadder are the steps the tuner moves through, floor and ceiling
+// are added to them
+var patternLadder = []Pattern{{1, 9}, {2, 8}, {3, 7}, {5, 5}, {1, 0}}
+
+// TunerConfig bounds the adaptive pattern, the protected ratio never drops
+// below Floor nor exceeds Ceiling
+type TunerConfig struct {
+	Floor   Pattern
+	Ceiling Pattern
+
+	// step down when the idle CPU fraction drops below LowHeadroom, step
+	// up after StableSamples samples above HighHeadroom
+	LowHeadroom   float64
+	HighHeadroom  float64
+	StableSamples int
+}
+
+// CostSample is one measurement of the encryption cost
+type CostSample struct {
+	// mean encryption time of a frame and the mean time between frames
+	FrameCost     time.Duration
+	FrameInterval time.Duration
+	// idle fraction of the CPU, 0 to 1
+	Headroom float64
+}
+
+// PatternTuner picks the most protective pattern the CPU can afford
+type PatternTuner struct {
+	config TunerConfig
+	ladder []Pattern
+	index  int
+	stable int
+
+	// index and stable count before the last Observe, for Revert
+	lastIndex  int
+	lastStable int
+}
+
+// NewPatternTuner creates a tuner starting at the given pattern, clamped to
+// the configured bounds
+func NewPatternTuner(config TunerConfig, start Pattern) (*PatternTuner, error) {
+	if config.Floor.Ratio() > config.Ceiling.Ratio() {
+		return nil, fmt.Errorf("pattern floor %s protects more than ceiling %s", config.Floor, config.Ceiling)
+	}
+
+	if config.LowHeadroom <= 0 {
+		config.LowHeadroom = 0.15
+	}
+	if config.HighHeadroom <= config.LowHeadroom {
+		config.HighHeadroom = config.LowHeadroom + 0.25
+	}
+	if config.StableSamples <= 0 {
+		config.StableSamples = 3
+	}
+
+	ladder := []Pattern{config.Floor}
+	for _, p := range patternLadder {
+		if p.Ratio() > config.Floor.Ratio() && p.Ratio() < config.Ceiling.Ratio() {
+			ladder = append(ladder, p)
+		}
+	}
+	if config.Ceiling.Ratio() > config.Floor.Ratio() {
+		ladder = append(ladder, config.Ceiling)
+	}
+
+	sort.SliceStable(ladder, func(i, j int) bool {
+		return ladder[i].Ratio() < ladder[j].Ratio()
+	})
+
+	// highest step not protecting more than the start pattern
+	index := 0
+	for i, p := range ladder {
+		if p.Ratio() <= start.Ratio() {
+			index = i
+		}
+	}
+
+	return &PatternTuner{
+		config: config,
+		ladder: ladder,
+		index:  index,
+	}, nil
+}
+
+// Pattern returns the pattern currently chosen
+func (t *PatternTuner) Pattern() Pattern {
+	return t.ladder[t.index]
+}
+
+// Observe feeds one sample and returns the pattern to use, changed reports
+// whether it differs from the previous one
+func (t *PatternTuner) Observe(s CostSample) (p Pattern, changed bool) {
+	current := t.ladder[t.index]
+	t.lastIndex, t.lastStable = t.index, t.stable
+
+	switch {
+	case s.Headroom < t.config.LowHeadroom:
+		t.stable = 0
+		if t.index > 0 {
+			t.index--
+			return t.ladder[t.index], true
+		}
+
+	case s.Headroom > t.config.HighHeadroom:
+		t.stable++
+		if t.stable < t.config.StableSamples || t.index == len(t.ladder)-1 {
+			break
+		}
+
+		// step up only if the predicted extra cost keeps the headroom
+		// above the low watermark
+		next := t.ladder[t.index+1]
+		if s.FrameInterval > 0 {
+			extra := float64(s.FrameCost) * (next.Ratio()/current.Ratio() - 1)
+			if s.Headroom-extra/float64(s.FrameInterval) < t.config.LowHeadroom {
+				break
+			}
+		}
+
+		t.stable = 0
+		t.index++
+		return next, true
+
+	default:
+		t.stable = 0
+	}
+
+	return current, false
+}
+
+// Revert undoes the last Observe, for a pattern the encryptor could not
+// switch to; the step is taken again with the next samples
+func (t *PatternTuner) Revert() {
+	t.index, t.stable = t.lastIndex, t.lastStable
+}
+
+// SetPattern stages the current parameters with a new pattern, the
+// switch happens at the next IDR frame like any profile change
+func (e *Encryptor) SetPattern(p Pattern) error {
+	if !e.enabled.Load() {
+		return ErrProfileDisabled
+	}
+
+	if p.CryptBlocks <= 0 || p.SkipBlocks < 0 {
+		return fmt.Errorf("%w: invalid pattern %s", ErrInvalidProfile, p)
+	}
+	if e.strictPattern {
+		if err := checkStrictPattern(p.CryptBlocks, p.SkipBlocks); err != nil {
+			return err
+		}
+	}
+	if e.fairPlay.Enabled() && !e.codec.isAudio() {
+		if err := checkFairPlayPattern(p.CryptBlocks, p.SkipBlocks); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.enabled.Load() {
+		return ErrProfileDisabled
+	}
+
+	current := e.state.Load()
+	if !PatternScheme(current.mode) {
+		return fmt.Errorf("%w: pattern requires cbcs or cens, got %s", ErrInvalidProfile, current.mode)
+	}
+
+	if e.pending != nil {
+		return ErrProfilePending
+	}
+
+	s := *current
+	s.cryptBlocks = p.CryptBlocks
+	s.skipBlocks = p.SkipBlocks
+
+	e.stage(&s, time.Time{})
+	e.stageLayers(&s, time.Time{})
+	e.stats.add(func(shard *statsShard) { shard.patternChanges.Add(1) })
+	return nil
+}
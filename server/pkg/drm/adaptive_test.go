@@ -0,0 +1,192 @@
+package drm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// costModel simulates a machine where encryption cost grows with the
+// protected ratio next to a fluctuating foreign load
+type costModel struct {
+	fullCost time.Duration // cost of a fully protected frame
+	interval time.Duration
+}
+
+func (m costModel) sample(p Pattern, load float64) CostSample {
+	cost := time.Duration(float64(m.fullCost) * p.Ratio())
+	return CostSample{
+		FrameCost:     cost,
+		FrameInterval: m.interval,
+		Headroom:      1 - load - float64(cost)/float64(m.interval),
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Pattern
+		wantErr bool
+	}{
+		{input: "1:9", want: Pattern{1, 9}},
+		{input: "10:0", want: Pattern{10, 0}},
+		{input: "0:9", wantErr: true},
+		{input: "1-9", wantErr: true},
+		{input: "a:b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParsePattern(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePattern() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePattern() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPatternTuner(t *testing.T) {
+	tuner, err := NewPatternTuner(TunerConfig{Floor: Pattern{2, 8}, Ceiling: Pattern{5, 5}}, Pattern{1, 9})
+	if err != nil {
+		t.Fatalf("NewPatternTuner() returned error: %s", err)
+	}
+
+	if want := []Pattern{{2, 8}, {3, 7}, {5, 5}}; !reflect.DeepEqual(tuner.ladder, want) {
+		t.Errorf("ladder = %v, want %v", tuner.ladder, want)
+	}
+
+	// a start below the floor is clamped to it
+	if got := tuner.Pattern(); got != (Pattern{2, 8}) {
+		t.Errorf("Pattern() = %v, want 2:8", got)
+	}
+
+	if _, err := NewPatternTuner(TunerConfig{Floor: Pattern{5, 5}, Ceiling: Pattern{1, 9}}, Pattern{1, 9}); err == nil {
+		t.Errorf("NewPatternTuner() accepted a floor above the ceiling")
+	}
+}
+
+func TestPatternTuner_simulation(t *testing.T) {
+	model := costModel{fullCost: 20 * time.Millisecond, interval: 33 * time.Millisecond}
+
+	tuner, err := NewPatternTuner(TunerConfig{Floor: Pattern{1, 9}, Ceiling: Pattern{1, 0}}, Pattern{1, 9})
+	if err != nil {
+		t.Fatalf("NewPatternTuner() returned error: %s", err)
+	}
+
+	run := func(load float64, samples int) []Pattern {
+		var changes []Pattern
+		for i := 0; i < samples; i++ {
+			if p, changed := tuner.Observe(model.sample(tuner.Pattern(), load)); changed {
+				changes = append(changes, p)
+			}
+		}
+		return changes
+	}
+
+	// moderately loaded machine climbs while there is headroom to spare
+	changes := run(0.3, 30)
+	if want := []Pattern{{2, 8}, {3, 7}, {5, 5}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("climbing adjustments = %v, want %v", changes, want)
+	}
+
+	// 5:5 leaves less than the high watermark, full protection is not tried
+	if got := tuner.Pattern(); got != (Pattern{5, 5}) {
+		t.Errorf("settled pattern = %v, want 5:5", got)
+	}
+
+	// heavy foreign load steps down one level per sample
+	changes = run(0.7, 2)
+	if want := []Pattern{{3, 7}, {2, 8}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("loaded adjustments = %v, want %v", changes, want)
+	}
+}
+
+func TestPatternTuner_floor(t *testing.T) {
+	model := costModel{fullCost: 20 * time.Millisecond, interval: 33 * time.Millisecond}
+
+	floor := Pattern{2, 8}
+	tuner, err := NewPatternTuner(TunerConfig{Floor: floor, Ceiling: Pattern{5, 5}}, Pattern{5, 5})
+	if err != nil {
+		t.Fatalf("NewPatternTuner() returned error: %s", err)
+	}
+
+	// no headroom at all for a long time
+	for i := 0; i < 50; i++ {
+		p, _ := tuner.Observe(model.sample(tuner.Pattern(), 1))
+		if p.Ratio() < floor.Ratio() {
+			t.Fatalf("sample %d: pattern %v below floor %v", i, p, floor)
+		}
+	}
+
+	if got := tuner.Pattern(); got != floor {
+		t.Errorf("Pattern() = %v, want floor %v", got, floor)
+	}
+}
+
+func TestPatternTuner_Revert(t *testing.T) {
+	tuner, err := NewPatternTuner(TunerConfig{Floor: Pattern{1, 9}, Ceiling: Pattern{5, 5}, LowHeadroom: 0.2, HighHeadroom: 0.5}, Pattern{3, 7})
+	if err != nil {
+		t.Fatalf("NewPatternTuner() returned error: %s", err)
+	}
+
+	p, changed := tuner.Observe(CostSample{Headroom: 0.1})
+	if !changed || p != (Pattern{2, 8}) {
+		t.Fatalf("Observe() = %v, %v, want a step down to 2:8", p, changed)
+	}
+
+	// the encryptor kept 3:7, so does the tuner, and it steps down again
+	tuner.Revert()
+	if got := tuner.Pattern(); got != (Pattern{3, 7}) {
+		t.Errorf("Pattern() after Revert() = %v, want 3:7", got)
+	}
+	if p, changed := tuner.Observe(CostSample{Headroom: 0.1}); !changed || p != (Pattern{2, 8}) {
+		t.Errorf("Observe() after Revert() = %v, %v, want a step down to 2:8", p, changed)
+	}
+}
+
+func TestEncryptor_SetPattern(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	var updates []Update
+	e.OnUpdate(func(u Update) {
+		updates = append(updates, u)
+	})
+
+	if err := e.SetPattern(Pattern{5, 5}); err != nil {
+		t.Fatalf("SetPattern() returned error: %s", err)
+	}
+
+	if err := e.SetPattern(Pattern{2, 8}); err != ErrProfilePending {
+		t.Errorf("SetPattern() while pending error = %v, want %v", err, ErrProfilePending)
+	}
+
+	if _, err := e.Encrypt(nalUnit(0x41, 64)); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if len(updates) != 0 {
+		t.Fatalf("pattern switched before IDR")
+	}
+
+	if _, err := e.Encrypt(nalUnit(0x65, 64)); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].Changes, []string{ChangePattern}) {
+		t.Fatalf("updates = %+v, want one pattern change", updates)
+	}
+
+	if p := e.Profile(); p.CryptBlocks != 5 || p.SkipBlocks != 5 || p.KeyID != testKeyID {
+		t.Errorf("Profile() = %+v, want 5:5 with the same key", p)
+	}
+
+	if stats := e.Stats(); stats.PatternChanges != 1 || stats.Frames != 2 {
+		t.Errorf("Stats() = %+v, want 1 pattern change and 2 frames", stats)
+	}
+
+	cenc := newTestEncryptor(t, Config{Mode: "cenc"})
+	if err := cenc.SetPattern(Pattern{5, 5}); err == nil {
+		t.Errorf("SetPattern() on cenc returned no error")
+	}
+}
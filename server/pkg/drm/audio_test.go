@@ -0,0 +1,106 @@
+package drm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// opusFrame returns an audio frame of size bytes starting with an Opus TOC
+// byte, the payload holds a start code to catch NAL parsing
+func opusFrame(size int) []byte {
+	frame := make([]byte, size)
+	for i := range frame {
+		frame[i] = byte(i*7 + 3)
+	}
+	frame[0] = 0xfc
+	if size > 8 {
+		copy(frame[4:], []byte{0, 0, 0, 1, 0x65})
+	}
+	return frame
+}
+
+func TestEncryptor_audio(t *testing.T) {
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"opus dtx", 3},
+		{"opus silence", 15},
+		{"one block", 16},
+		{"opus 20ms 32kbps", 80},
+		{"opus 20ms 64kbps", 160},
+		{"opus 20ms 510kbps", 1275},
+		{"aac-lc frame", 371},
+	}
+
+	for _, mode := range []string{"cbcs", "cenc", "cens", "cbc1"} {
+		for _, tt := range sizes {
+			t.Run(mode+" "+tt.name, func(t *testing.T) {
+				// the video pattern does not apply to audio
+				cfg := Config{
+					Enabled:     true,
+					Mode:        mode,
+					KeyID:       testKeyID,
+					Key:         testKey,
+					IV:          testIV,
+					IVNonce:     testIVNonce,
+					CryptBlocks: 1,
+					SkipBlocks:  9,
+					Codec:       CodecAudio,
+				}
+				e, err := NewEncryptor(cfg)
+				if err != nil {
+					t.Fatalf("NewEncryptor() returned error: %s", err)
+				}
+				d, err := NewDecryptor(cfg)
+				if err != nil {
+					t.Fatalf("NewDecryptor() returned error: %s", err)
+				}
+
+				frame := opusFrame(tt.size)
+				for i := 0; i < 3; i++ {
+					out, err := e.EncryptSample(frame)
+					if err != nil {
+						t.Fatalf("EncryptSample() returned error: %s", err)
+					}
+
+					// the block based schemes encrypt every whole block and
+					// leave the tail clear, cenc the whole frame
+					clear := 0
+					if mode != "cenc" {
+						clear = tt.size % 16
+					}
+					for pos := 0; pos+16 <= tt.size-clear; pos += 16 {
+						if bytes.Equal(out.Data[pos:pos+16], frame[pos:pos+16]) {
+							t.Errorf("block at %d = %x, want it encrypted", pos, out.Data[pos:pos+16])
+						}
+					}
+					if tail := tt.size - clear; !bytes.Equal(out.Data[tail:], frame[tail:]) {
+						t.Errorf("tail = %x, want it clear", out.Data[tail:])
+					}
+
+					wantProtected := tt.size
+					if mode != "cenc" && tt.size < 16 {
+						wantProtected = 0
+					}
+					var covered, protected int
+					for _, sub := range out.Subsamples {
+						covered += int(sub.BytesOfClearData) + int(sub.BytesOfProtectedData)
+						protected += int(sub.BytesOfProtectedData)
+					}
+					if covered != tt.size || protected != wantProtected {
+						t.Errorf("subsamples = %+v, want %d protected bytes of %d", out.Subsamples, wantProtected, tt.size)
+					}
+
+					got, err := d.Decrypt(out.Data)
+					if err != nil {
+						t.Fatalf("Decrypt() returned error: %s", err)
+					}
+					if !bytes.Equal(got, frame) {
+						t.Errorf("Decrypt() = %x, want %x", got, frame)
+					}
+				}
+			})
+		}
+	}
+}
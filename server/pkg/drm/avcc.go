@@ -0,0 +1,165 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// NAL unit formats of the access units passed to the encryptor
+const (
+	NALFormatAnnexB = "annexb" // start code prefixed byte stream
+	NALFormatAVCC   = "avcc"   // big-endian length prefixed, as in MP4
+	NALFormatAuto   = "auto"   // detected for every access unit
+)
+
+// DefaultNALLengthSize is the size of AVCC length fields unless configured
+const DefaultNALLengthSize = 4
+
+// ErrMalformedLength is returned for AVCC access units whose length fields
+// do not describe the buffer
+var ErrMalformedLength = errors.New("malformed NAL unit length")
+
+// nalFormat converts AVCC access units to the byte stream the encryptor
+// works on and back
+type nalFormat struct {
+	format     string
+	lengthSize int
+	// format of the encrypted access units, that of the input when empty
+	output string
+}
+
+func parseNALFormat(format string, lengthSize int, output string) (nalFormat, error) {
+	switch format {
+	case "":
+		format = NALFormatAnnexB
+	case NALFormatAnnexB, NALFormatAVCC, NALFormatAuto:
+	default:
+		return nalFormat{}, fmt.Errorf("nal format must be %s, %s or %s, got %q", NALFormatAnnexB, NALFormatAVCC, NALFormatAuto, format)
+	}
+
+	switch lengthSize {
+	case 0:
+		lengthSize = DefaultNALLengthSize
+	case 1, 2, 4:
+	default:
+		return nalFormat{}, fmt.Errorf("nal length size must be 1, 2 or 4, got %d", lengthSize)
+	}
+
+	switch output {
+	case "", NALFormatAnnexB, NALFormatAVCC:
+	default:
+		return nalFormat{}, fmt.Errorf("output nal format must be %s or %s, got %q", NALFormatAnnexB, NALFormatAVCC, output)
+	}
+	// nothing to convert
+	if output == format {
+		output = ""
+	}
+
+	return nalFormat{format: format, lengthSize: lengthSize, output: output}, nil
+}
+
+// outputAVCC reports whether an access unit is emitted length prefixed,
+// avcc is whether it was in the input
+func (f nalFormat) outputAVCC(avcc bool) bool {
+	switch f.output {
+	case NALFormatAnnexB:
+		return false
+	case NALFormatAVCC:
+		return true
+	}
+	return avcc
+}
+
+// encrypted returns the format of the access units encrypted in f, which
+// a Decryptor takes and returns
+func (f nalFormat) encrypted() nalFormat {
+	if f.output == "" {
+		return f
+	}
+	return nalFormat{format: f.output, lengthSize: f.lengthSize}
+}
+
+// annexB returns the access unit as byte stream and whether it was length
+// prefixed. In auto mode it is unless it begins with a start code, which a
+// length field may emulate, so then its length fields must not cover it.
+func (f nalFormat) annexB(au []byte) ([]byte, bool, error) {
+	switch f.format {
+	case NALFormatAVCC:
+		out, err := f.toAnnexB(au)
+		return out, true, err
+	case NALFormatAuto:
+		out, err := f.toAnnexB(au)
+		if err != nil && startCodeLen(au) > 0 {
+			return au, false, nil
+		}
+		return out, true, err
+	}
+	return au, false, nil
+}
+
+// toAnnexB replaces every length field by a 4-byte start code
+func (f nalFormat) toAnnexB(au []byte) ([]byte, error) {
+	out := make([]byte, 0, len(au)+(4-f.lengthSize)*(len(au)/16+1))
+	for pos := 0; pos < len(au); {
+		if len(au)-pos < f.lengthSize {
+			return nil, fmt.Errorf("%w: %d trailing bytes at offset %d", ErrMalformedLength, len(au)-pos, pos)
+		}
+
+		var size int
+		for _, b := range au[pos : pos+f.lengthSize] {
+			size = size<<8 | int(b)
+		}
+		pos += f.lengthSize
+
+		if size == 0 || size > len(au)-pos {
+			return nil, fmt.Errorf("%w: %d bytes at offset %d, %d remaining", ErrMalformedLength, size, pos-f.lengthSize, len(au)-pos)
+		}
+
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, au[pos:pos+size]...)
+		pos += size
+	}
+	return out, nil
+}
+
+// toAVCC replaces every start code of an encrypted access unit by a length
+// field into the storage of dst and moves the subsamples along. Length
+// fields only change when emulation prevention grew a NAL unit.
+func (f nalFormat) toAVCC(dst, au []byte, subsamples []SubsampleInfo) ([]byte, []SubsampleInfo, error) {
+	// protected ranges in the byte stream
+	type span struct{ pos, size int }
+	var protected []span
+	var pos int
+	for _, sub := range subsamples {
+		pos += int(sub.BytesOfClearData)
+		if sub.BytesOfProtectedData > 0 {
+			protected = append(protected, span{pos, int(sub.BytesOfProtectedData)})
+		}
+		pos += int(sub.BytesOfProtectedData)
+	}
+
+	out := slices.Grow(dst[:0], len(au))
+	var m subsampleMap
+	for _, r := range findNALUnits(nil, au) {
+		payload := r.nalu(au)
+		end := r.offset + r.length
+
+		if len(payload) >= 1<<(8*f.lengthSize) {
+			return nil, nil, fmt.Errorf("%w: %d bytes do not fit %d length bytes", ErrMalformedLength, len(payload), f.lengthSize)
+		}
+
+		shift := len(out) + f.lengthSize - r.offset - r.headerLen
+		for i := f.lengthSize - 1; i >= 0; i-- {
+			out = append(out, byte(len(payload)>>(8*i)))
+		}
+		out = append(out, payload...)
+
+		for len(protected) > 0 && protected[0].pos < end {
+			m.protect(protected[0].pos+shift, protected[0].size)
+			protected = protected[1:]
+		}
+	}
+
+	return out, m.finish(len(out)), nil
+}
@@ -0,0 +1,250 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// lengthPrefixed converts a byte stream access unit to AVCC with length
+// fields of size bytes
+func lengthPrefixed(au []byte, size int) []byte {
+	var out []byte
+	for _, nalu := range parseNALUnits(au) {
+		nalu = nalu[startCodeLen(nalu):]
+		for i := size - 1; i >= 0; i-- {
+			out = append(out, byte(len(nalu)>>(8*i)))
+		}
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+func TestEncryptor_avcc(t *testing.T) {
+	params := h264Params{}
+	slice, _ := params.slice(0x65, sliceHeaderCases[0].fields, 200)
+	frame := append(append(params.sps(), params.pps()...), slice...)
+	// slices starting with a length field of 00 00 01 2c, which emulates a
+	// start code
+	long := append(nalUnit(0x41, 299), nalUnit(0x41, 50)...)
+
+	tests := []struct {
+		name       string
+		format     string
+		lengthSize int
+		frame      []byte
+		avcc       bool
+	}{
+		{"avcc", NALFormatAVCC, 0, frame, true},
+		{"avcc 2-byte lengths", NALFormatAVCC, 2, frame, true},
+		{"avcc 1-byte lengths", NALFormatAVCC, 1, frame, true},
+		{"auto avcc", NALFormatAuto, 4, frame, true},
+		{"auto avcc emulating a start code", NALFormatAuto, 4, long, true},
+		{"auto annexb", NALFormatAuto, 4, frame, false},
+		{"auto annexb with 3-byte start codes", NALFormatAuto, 4, append([]byte{0, 0, 1}, frame[4:]...), false},
+	}
+
+	for _, mode := range []string{"cbcs", "cenc"} {
+		for _, tt := range tests {
+			t.Run(mode+" "+tt.name, func(t *testing.T) {
+				size := tt.lengthSize
+				if size == 0 {
+					size = DefaultNALLengthSize
+				}
+
+				in := tt.frame
+				if tt.avcc {
+					in = lengthPrefixed(tt.frame, size)
+				}
+
+				// the same access unit as byte stream is the reference
+				e := newTestEncryptor(t, Config{Mode: mode, KeySEI: true})
+				want, err := e.EncryptSample(tt.frame)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+				wantProtected := protectedBytes(want)
+				if tt.avcc {
+					want.Data = lengthPrefixed(want.Data, size)
+				}
+
+				e = newTestEncryptor(t, Config{Mode: mode, KeySEI: true, NALFormat: tt.format, NALLengthSize: tt.lengthSize})
+				got, err := e.EncryptSample(in)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+				if !bytes.Equal(got.Data, want.Data) {
+					t.Fatalf("EncryptSample() = %x, want %x", got.Data, want.Data)
+				}
+
+				// subsamples moved along with the NAL units
+				if protected := protectedBytes(got); len(protected) == 0 || !bytes.Equal(protected, wantProtected) {
+					t.Errorf("protected bytes = %x, want %x", protected, wantProtected)
+				}
+			})
+		}
+	}
+}
+
+// protectedBytes returns the protected ranges of the sample concatenated,
+// nil unless the subsamples cover it
+func protectedBytes(sample EncryptedSample) []byte {
+	var out []byte
+	var pos int
+	for _, sub := range sample.Subsamples {
+		pos += int(sub.BytesOfClearData)
+		out = append(out, sample.Data[pos:pos+int(sub.BytesOfProtectedData)]...)
+		pos += int(sub.BytesOfProtectedData)
+	}
+	if pos != len(sample.Data) {
+		return nil
+	}
+	return out
+}
+
+func TestEncryptor_avccMalformed(t *testing.T) {
+	frame := lengthPrefixed(append(nalUnit(0x67, 8), nalUnit(0x65, 100)...), 4)
+
+	tests := []struct {
+		name   string
+		format string
+		au     []byte
+	}{
+		{"length beyond the buffer", NALFormatAVCC, frame[:len(frame)-1]},
+		{"truncated length field", NALFormatAVCC, append(frame, 0, 0)},
+		{"zero length", NALFormatAVCC, append([]byte{0, 0, 0, 0}, frame...)},
+		{"auto without start code", NALFormatAuto, frame[:len(frame)-1]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{NALFormat: tt.format})
+			if _, err := e.Encrypt(tt.au); !errors.Is(err, ErrMalformedLength) {
+				t.Errorf("Encrypt() error = %v, want %v", err, ErrMalformedLength)
+			}
+		})
+	}
+}
+
+func TestNewEncryptor_nalFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		lengthSize int
+		wantErr    bool
+	}{
+		{"defaults", "", 0, false},
+		{"avcc with 2-byte lengths", NALFormatAVCC, 2, false},
+		{"unknown format", "rtp", 0, true},
+		{"3-byte lengths", NALFormatAVCC, 3, true},
+		{"auto output", NALFormatAuto, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{
+				Enabled:       true,
+				KeyID:         testKeyID,
+				Key:           testKey,
+				IV:            testIV,
+				NALFormat:     tt.format,
+				NALLengthSize: tt.lengthSize,
+			}
+			// the output cannot be detected
+			if tt.name == "auto output" {
+				cfg.NALFormat, cfg.OutputNALFormat = "", tt.format
+			}
+
+			_, err := NewEncryptor(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewEncryptor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptor_outputNALFormat(t *testing.T) {
+	params := h264Params{}
+	slice, _ := params.slice(0x65, sliceHeaderCases[0].fields, 200)
+	frame := append(append(params.sps(), params.pps()...), slice...)
+	// 3-byte start codes grow by a byte each as 4-byte length fields
+	short := append(append([]byte{0, 0, 1}, params.pps()[4:]...), append([]byte{0, 0, 1}, slice[4:]...)...)
+
+	tests := []struct {
+		name   string
+		format string
+		output string
+		in     []byte
+		want   func(annexB []byte) []byte
+	}{
+		{"annexb to avcc", NALFormatAnnexB, NALFormatAVCC, frame, func(b []byte) []byte { return lengthPrefixed(b, 4) }},
+		{"3-byte start codes to avcc", NALFormatAnnexB, NALFormatAVCC, short, func(b []byte) []byte { return lengthPrefixed(b, 4) }},
+		{"avcc to annexb", NALFormatAVCC, NALFormatAnnexB, lengthPrefixed(frame, 4), func(b []byte) []byte { return b }},
+	}
+
+	for _, mode := range []string{"cbcs", "cenc"} {
+		for _, tt := range tests {
+			t.Run(mode+" "+tt.name, func(t *testing.T) {
+				plain := tt.in
+				if tt.format == NALFormatAVCC {
+					plain = frame
+				}
+
+				// the access unit encrypted as byte stream is the reference
+				e := newTestEncryptor(t, Config{Mode: mode, KeySEI: true})
+				ref, err := e.EncryptSample(plain)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+
+				cfg := Config{Mode: mode, KeySEI: true, NALFormat: tt.format, OutputNALFormat: tt.output}
+				e = newTestEncryptor(t, cfg)
+				got, err := e.EncryptSample(tt.in)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+				if want := tt.want(ref.Data); !bytes.Equal(got.Data, want) {
+					t.Fatalf("EncryptSample() = %x, want %x", got.Data, want)
+				}
+				// start codes and length fields are clear bytes
+				if protected := protectedBytes(got); len(protected) == 0 || !bytes.Equal(protected, protectedBytes(ref)) {
+					t.Errorf("protected bytes = %x, want %x", protected, protectedBytes(ref))
+				}
+
+				// the decryptor takes the output format, the KeySEI stays
+				decrypt := func(cfg Config, data []byte) []byte {
+					cfg.KeyID, cfg.Key, cfg.IV, cfg.Enabled = testKeyID, testKey, testIV, true
+					d, err := NewDecryptor(cfg)
+					if err != nil {
+						t.Fatalf("NewDecryptor() returned error: %s", err)
+					}
+					out, err := d.Decrypt(data)
+					if err != nil {
+						t.Fatalf("Decrypt() returned error: %s", err)
+					}
+					return out
+				}
+				if dec, want := decrypt(cfg, got.Data), tt.want(decrypt(Config{Mode: mode, KeySEI: true}, ref.Data)); !bytes.Equal(dec, want) {
+					t.Errorf("Decrypt() = %x, want %x", dec, want)
+				}
+			})
+		}
+	}
+
+	e := newTestEncryptor(t, Config{OutputNALFormat: NALFormatAVCC})
+	if err := e.EncryptInPlace(bytes.Clone(frame)); !errors.Is(err, ErrNotInPlace) {
+		t.Errorf("EncryptInPlace() error = %v, want %v", err, ErrNotInPlace)
+	}
+
+	// paused at the keyframe, still converted
+	if err := e.SetEnabled(false); err != nil {
+		t.Fatalf("SetEnabled() returned error: %s", err)
+	}
+	got, err := e.EncryptSample(frame)
+	if err != nil {
+		t.Fatalf("EncryptSample() returned error: %s", err)
+	}
+	if want := lengthPrefixed(frame, 4); !bytes.Equal(got.Data, want) || len(protectedBytes(got)) != 0 || len(got.Subsamples) == 0 {
+		t.Errorf("EncryptSample() paused = %x, %+v; want %x clear", got.Data, got.Subsamples, want)
+	}
+}
@@ -0,0 +1,68 @@
+package drm
+
+import "errors"
+
+var errBitsEnd = errors.New("read past the end of the rbsp")
+
+// bitReader reads the fixed length and Exp-Golomb coded syntax elements of
+// an RBSP, errors are sticky and reads after one return zero
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+// u reads an unsigned integer of n bits, u(n)
+func (r *bitReader) u(n int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if n > 64 || r.pos+n > len(r.data)*8 {
+		r.err = errBitsEnd
+		return 0
+	}
+
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v
+}
+
+// flag reads a single bit, u(1)
+func (r *bitReader) flag() bool {
+	return r.u(1) == 1
+}
+
+// ue reads an unsigned Exp-Golomb code, ue(v)
+func (r *bitReader) ue() uint64 {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil {
+			return 0
+		}
+		zeros++
+		// larger values do not fit any syntax element
+		if zeros > 31 {
+			r.err = errors.New("exp-golomb code too long")
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.u(zeros)
+}
+
+// se reads a signed Exp-Golomb code, se(v)
+func (r *bitReader) se() int64 {
+	k := r.ue()
+	if k%2 == 1 {
+		return int64(k+1) / 2
+	}
+	return -int64(k / 2)
+}
+
+// bits returns how many bits were read
+func (r *bitReader) bits() int {
+	return r.pos
+}
@@ -0,0 +1,208 @@
+package drm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies the kind of a bus Event
+type EventType string
+
+const (
+	EventKeyRotated       EventType = "key_rotated"
+	EventKeyRevoked       EventType = "key_revoked"
+	EventKeyExported      EventType = "key_exported"
+	EventProfileChanged   EventType = "profile_changed"
+	EventHandshakeFailed  EventType = "handshake_failed"
+	EventErrorRateChanged EventType = "error_rate_changed"
+	EventProviderFailover EventType = "provider_failover"
+	EventKeyStockLow      EventType = "key_stock_low"
+)
+
+// Event is a DRM state change published on the Bus
+type Event interface {
+	Type() EventType
+}
+
+// KeyRotated is published when frames start being encrypted with a new key
+type KeyRotated struct {
+	Time          time.Time
+	Epoch         uint64
+	KeyID         string
+	PreviousKeyID string
+	// constant IV of the new key, nil when every access unit has its own
+	IV []byte
+	// access units encrypted before the first one with the new key
+	Frame uint64
+}
+
+// KeyRevoked is published when a key must no longer be used or licensed
+type KeyRevoked struct {
+	Time   time.Time
+	KeyID  string
+	Reason string
+}
+
+// KeyExported is published for every break-glass key export attempt
+type KeyExported struct {
+	KeyExportAttempt
+}
+
+// ProfileChanged is published for every transition of the encryption
+// parameters, at the frame they take effect
+type ProfileChanged struct {
+	Time time.Time
+	Update
+}
+
+// HandshakeFailed is published when a client could not obtain the
+// parameters or the key of the stream
+type HandshakeFailed struct {
+	Time      time.Time
+	SessionID string
+	Reason    string
+}
+
+// ErrorRateChanged is published when the encryption error rate crosses
+// a threshold
+type ErrorRateChanged struct {
+	Time     time.Time
+	Previous float64
+	Rate     float64
+}
+
+func (KeyRotated) Type() EventType       { return EventKeyRotated }
+func (KeyRevoked) Type() EventType       { return EventKeyRevoked }
+func (KeyExported) Type() EventType      { return EventKeyExported }
+func (ProfileChanged) Type() EventType   { return EventProfileChanged }
+func (HandshakeFailed) Type() EventType  { return EventHandshakeFailed }
+func (ErrorRateChanged) Type() EventType { return EventErrorRateChanged }
+
+// Bus fans out events to subscribers without ever blocking the publisher.
+//
+// Every subscriber receives the events it subscribed to in the order they
+// were published. When its buffer is full the event is dropped for that
+// subscriber only and counted, other subscribers are not affected.
+type Bus struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription is a bounded queue of events for one consumer
+type Subscription struct {
+	bus     *Bus
+	name    string
+	types   map[EventType]struct{}
+	events  chan Event
+	dropped atomic.Uint64
+}
+
+// Subscribe registers a consumer buffering up to buffer events, it receives
+// only the given event types or all of them when none are given
+func (b *Bus) Subscribe(name string, buffer int, types ...EventType) *Subscription {
+	s := &Subscription{
+		bus:    b,
+		name:   name,
+		types:  make(map[EventType]struct{}, len(types)),
+		events: make(chan Event, buffer),
+	}
+
+	for _, t := range types {
+		s.types[t] = struct{}{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(s.events)
+		return s
+	}
+
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Publish queues the event for every interested subscriber, it never blocks
+func (b *Bus) Publish(ev Event) {
+	// holding the lock for the whole fan out keeps concurrent publishers
+	// from interleaving differently for different subscribers
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		if !s.wants(ev.Type()) {
+			continue
+		}
+
+		select {
+		case s.events <- ev:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Close unsubscribes all consumers, their channels are closed after the
+// buffered events
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+func (s *Subscription) wants(t EventType) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+
+	_, ok := s.types[t]
+	return ok
+}
+
+// Name returns the consumer name given on subscribe
+func (s *Subscription) Name() string {
+	return s.name
+}
+
+// Events returns the channel of queued events, it is closed on unsubscribe
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns how many events did not fit into the buffer
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes the consumer and closes its channel
+func (s *Subscription) Close() {
+	b := s.bus
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+
+	delete(b.subs, s)
+	close(s.events)
+}
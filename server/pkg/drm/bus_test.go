@@ -0,0 +1,115 @@
+package drm
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBus_ordering(t *testing.T) {
+	const perType = 1000
+
+	bus := NewBus()
+	all := bus.Subscribe("all", 4*perType)
+	rotations := bus.Subscribe("rotations", perType, EventKeyRotated)
+
+	// concurrent producers of different event types
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= perType; i++ {
+			bus.Publish(KeyRotated{Epoch: uint64(i)})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= perType; i++ {
+			bus.Publish(ProfileChanged{Update: Update{Epoch: uint64(i)}})
+		}
+	}()
+	wg.Wait()
+	bus.Close()
+
+	last := map[EventType]uint64{}
+	for ev := range all.Events() {
+		var epoch uint64
+		switch ev := ev.(type) {
+		case KeyRotated:
+			epoch = ev.Epoch
+		case ProfileChanged:
+			epoch = ev.Epoch
+		}
+
+		if epoch != last[ev.Type()]+1 {
+			t.Fatalf("%s: got epoch %d after %d", ev.Type(), epoch, last[ev.Type()])
+		}
+		last[ev.Type()] = epoch
+	}
+
+	if last[EventKeyRotated] != perType || last[EventProfileChanged] != perType {
+		t.Errorf("received %v, want %d of each", last, perType)
+	}
+
+	count := 0
+	for ev := range rotations.Events() {
+		if ev.Type() != EventKeyRotated {
+			t.Fatalf("filtered subscription received %s", ev.Type())
+		}
+		count++
+	}
+	if count != perType {
+		t.Errorf("filtered subscription received %d events, want %d", count, perType)
+	}
+}
+
+func TestBus_slowConsumer(t *testing.T) {
+	bus := NewBus()
+	slow := bus.Subscribe("slow", 2)
+	fast := bus.Subscribe("fast", 10)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 10; i++ {
+			bus.Publish(KeyRotated{Epoch: uint64(i)})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish() blocked on a slow consumer")
+	}
+
+	if got := slow.Dropped(); got != 8 {
+		t.Errorf("slow Dropped() = %d, want 8", got)
+	}
+	if got := fast.Dropped(); got != 0 {
+		t.Errorf("fast Dropped() = %d, want 0", got)
+	}
+
+	// the oldest events are kept, later ones dropped
+	for _, want := range []uint64{1, 2} {
+		if ev := (<-slow.Events()).(KeyRotated); ev.Epoch != want {
+			t.Errorf("slow consumer got epoch %d, want %d", ev.Epoch, want)
+		}
+	}
+
+	// once drained the consumer receives again
+	bus.Publish(KeyRotated{Epoch: 11})
+	if ev := (<-slow.Events()).(KeyRotated); ev.Epoch != 11 {
+		t.Errorf("slow consumer got epoch %d, want 11", ev.Epoch)
+	}
+
+	slow.Close()
+	if _, ok := <-slow.Events(); ok {
+		t.Errorf("Events() not closed after Close()")
+	}
+
+	// publishing after a consumer left must not panic
+	bus.Publish(KeyRotated{Epoch: 12})
+	if got := len(fast.Events()); got != 10 {
+		t.Errorf("fast consumer has %d events queued, want 10", got)
+	}
+}
@@ -0,0 +1,43 @@
+package drm
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+)
+
+// checksum covers all key material of the state
+func (s *cipherState) checksum() [32]byte {
+	h := sha256.New()
+	h.Write(s.keyID)
+	h.Write(s.key)
+	h.Write(s.iv)
+
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// verifyCanary fails with ErrInternal when key material changed since the
+// state was created, which means a reference to it leaked and was written
+// to or the encryptor was closed meanwhile; the sample is dropped
+func (s *cipherState) verifyCanary() error {
+	if s == nil {
+		return fmt.Errorf("%w: encryptor closed while encrypting", ErrInternal)
+	}
+
+	sum := s.checksum()
+	if subtle.ConstantTimeCompare(sum[:], s.canary[:]) != 1 {
+		return fmt.Errorf("%w: key material changed unexpectedly", ErrInternal)
+	}
+	return nil
+}
+
+// zeroize overwrites the key material of the state, which must not be used
+// for encryption anymore
+func (s *cipherState) zeroize() {
+	clear(s.keyID)
+	clear(s.key)
+	clear(s.iv)
+	s.block = nil
+}
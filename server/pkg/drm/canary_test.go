@@ -0,0 +1,63 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptor_accessorsReturnCopies(t *testing.T) {
+	for _, mode := range []string{"cbcs", "cenc"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := Config{Mode: mode, CryptBlocks: 1, SkipBlocks: 9}
+			e, ref := newTestEncryptor(t, cfg), newTestEncryptor(t, cfg)
+			frame := nalUnit(0x65, 64)
+
+			// the IV may change with every sample, an untouched encryptor
+			// encrypts the same samples
+			for _, enc := range []*Encryptor{e, ref} {
+				if _, err := enc.Encrypt(frame); err != nil {
+					t.Fatalf("Encrypt() returned error: %s", err)
+				}
+			}
+
+			keyID, iv := e.KeyID(), e.IV()
+			for i := range keyID {
+				keyID[i] ^= 0xff
+			}
+			for i := range iv {
+				iv[i] ^= 0xff
+			}
+
+			if bytes.Equal(e.KeyID(), keyID) || bytes.Equal(e.IV(), iv) {
+				t.Fatalf("mutating returned slices changed the encryptor")
+			}
+
+			// paranoid mode would fail here if the canary was hit
+			got, err := e.Encrypt(frame)
+			if err != nil {
+				t.Fatalf("Encrypt() returned error: %s", err)
+			}
+			want, _ := ref.Encrypt(frame)
+			if !bytes.Equal(got, want) {
+				t.Errorf("mutating returned slices changed encryption")
+			}
+		})
+	}
+}
+
+func TestEncryptor_paranoidCanary(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+
+	// simulate a leaked reference being written to
+	e.state.Load().iv[0] ^= 0xff
+
+	// the sample is dropped instead of encrypted with the changed key
+	out, err := e.Encrypt(nalUnit(0x65, 64))
+	if !errors.Is(err, ErrInternal) || out != nil {
+		t.Errorf("Encrypt() = %x, %v, want %v", out, err, ErrInternal)
+	}
+	if stats := e.Stats(); stats.InternalErrors != 1 || stats.Errors != 1 {
+		t.Errorf("Stats() = %d internal errors of %d, want 1", stats.InternalErrors, stats.Errors)
+	}
+}
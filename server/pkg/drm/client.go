@@ -0,0 +1,142 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// ClientInfo holds what a client needs to set up its decryptor, such as
+// rtc-drm-transform in the browser, for the frames encrypted now
+type ClientInfo struct {
+	Enabled     bool
+	Mode        string // "cbcs", "cenc", "cens" or "cbc1"
+	KeyID       []byte
+	IV          []byte // constant IV, nil when every frame has its own
+	IVMode      string // "constant" or "counter"
+	CryptBlocks int    // for the cbcs and cens pattern
+	SkipBlocks  int    // for the cbcs and cens pattern
+	InitData    []byte // pssh boxes of the key, see InitData
+	// IVs of the layers of ForLayer, nil when every frame has its own
+	Layers []LayerInfo
+}
+
+// ClientInfo returns the parameters of the current profile for clients,
+// taken from a single state so that they always belong together; not
+// enabled while SetEnabled switched encryption off
+func (e *Encryptor) ClientInfo() (ClientInfo, error) {
+	s := e.state.Load()
+	if !e.Encrypting() || s == nil {
+		return ClientInfo{}, nil
+	}
+
+	initData, err := e.initData(s)
+	if err != nil {
+		return ClientInfo{}, err
+	}
+
+	info := ClientInfo{
+		Enabled:     true,
+		Mode:        s.mode,
+		KeyID:       bytes.Clone(s.keyID),
+		IVMode:      s.ivMode,
+		CryptBlocks: s.cryptBlocks,
+		SkipBlocks:  s.skipBlocks,
+		InitData:    initData,
+	}
+
+	// the pattern only means something with cbcs and cens
+	if !PatternScheme(s.mode) {
+		info.CryptBlocks, info.SkipBlocks = 0, 0
+	}
+
+	// per-sample IVs reach clients with every frame instead
+	if !PerSampleIV(s.ivMode) {
+		info.IV = bytes.Clone(s.iv)
+		if layers := e.Layers(); len(layers) > 0 {
+			info.Layers = layers
+		}
+	}
+
+	return info, nil
+}
+
+// DRMInfo describes the DRM setup to the client config endpoint as a single
+// document. The key ID is base64url encoded without padding like the key
+// IDs of EME, the key itself is never part of it.
+type DRMInfo struct {
+	Enabled     bool   `json:"enabled"`
+	Scheme      string `json:"scheme,omitempty"` // "cbcs", "cenc", "cens" or "cbc1"
+	KeyID       []byte `json:"-"`
+	CryptBlocks int    `json:"cryptBlocks,omitempty"` // for the cbcs and cens pattern
+	SkipBlocks  int    `json:"skipBlocks,omitempty"`  // for the cbcs and cens pattern
+	LicenseURL  string `json:"licenseUrl,omitempty"`
+	// license servers of single systems overriding LicenseURL, by pssh
+	// system name
+	LicenseURLs map[string]string `json:"licenseUrls,omitempty"`
+	// labels of the encrypted tracks, the others are sent clear
+	EncryptedTracks []string `json:"encryptedTracks,omitempty"`
+	// FairPlay signaling when configured
+	FairPlay *FairPlayInfo `json:"fairPlay,omitempty"`
+}
+
+// drmInfoJSON is DRMInfo with its key ID encoded
+type drmInfoJSON struct {
+	drmInfo
+	KeyID string `json:"keyId,omitempty"`
+}
+
+type drmInfo DRMInfo
+
+func (i DRMInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(drmInfoJSON{
+		drmInfo: drmInfo(i),
+		KeyID:   base64.RawURLEncoding.EncodeToString(i.KeyID),
+	})
+}
+
+func (i *DRMInfo) UnmarshalJSON(data []byte) error {
+	var v drmInfoJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	keyID, err := base64.RawURLEncoding.DecodeString(v.KeyID)
+	if err != nil {
+		return err
+	}
+
+	*i = DRMInfo(v.drmInfo)
+	if len(keyID) > 0 {
+		i.KeyID = keyID
+	}
+	return nil
+}
+
+// Info returns the DRM setup of the current profile for clients. The
+// encryptor only knows its own track, the license URL and the tracks of
+// the whole stream are up to the caller.
+func (e *Encryptor) Info() DRMInfo {
+	s := e.state.Load()
+	if !e.Encrypting() || s == nil {
+		return DRMInfo{}
+	}
+
+	info := DRMInfo{
+		Enabled:         true,
+		Scheme:          s.mode,
+		KeyID:           bytes.Clone(s.keyID),
+		EncryptedTracks: []string{TrackVideo},
+		FairPlay:        e.fairPlayInfo(s.keyID),
+	}
+
+	// the pattern only means something with cbcs and cens
+	if PatternScheme(s.mode) {
+		info.CryptBlocks, info.SkipBlocks = s.cryptBlocks, s.skipBlocks
+	}
+	if e.codec.isAudio() {
+		info.EncryptedTracks = []string{TrackAudio}
+	}
+
+	return info
+}
@@ -0,0 +1,133 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestEncryptor_ClientInfo(t *testing.T) {
+	tests := []struct {
+		cfg    Config
+		wantIV []byte
+	}{
+		{Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}, mustHex(testIV)},
+		{Config{Mode: "cenc"}, nil},
+	}
+
+	for _, tt := range tests {
+		e := newTestEncryptor(t, tt.cfg)
+
+		info, err := e.ClientInfo()
+		if err != nil {
+			t.Fatalf("%s: ClientInfo() returned error: %s", tt.cfg.Mode, err)
+		}
+		if !info.Enabled || info.Mode != tt.cfg.Mode || info.CryptBlocks != tt.cfg.CryptBlocks || info.SkipBlocks != tt.cfg.SkipBlocks {
+			t.Errorf("%s: ClientInfo() = %+v", tt.cfg.Mode, info)
+		}
+		if !bytes.Equal(info.KeyID, mustHex(testKeyID)) || !bytes.Equal(info.IV, tt.wantIV) {
+			t.Errorf("%s: ClientInfo() key ID %x and IV %x, want %s and %x", tt.cfg.Mode, info.KeyID, info.IV, testKeyID, tt.wantIV)
+		}
+
+		initData, _ := e.InitData()
+		if !bytes.Equal(info.InitData, initData) {
+			t.Errorf("%s: ClientInfo() init data differs from InitData()", tt.cfg.Mode)
+		}
+	}
+
+	disabled, _ := NewEncryptor(Config{})
+	if info, err := disabled.ClientInfo(); err != nil || info.Enabled {
+		t.Errorf("ClientInfo() of a disabled encryptor = %+v, %v", info, err)
+	}
+}
+
+func TestEncryptor_Info(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want DRMInfo
+	}{
+		{
+			Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+			DRMInfo{Enabled: true, Scheme: "cbcs", CryptBlocks: 1, SkipBlocks: 9, EncryptedTracks: []string{TrackVideo}},
+		},
+		{
+			Config{Mode: "cenc", CryptBlocks: 1, SkipBlocks: 9},
+			DRMInfo{Enabled: true, Scheme: "cenc", EncryptedTracks: []string{TrackVideo}},
+		},
+		{
+			Config{Mode: "cbcs", Codec: CodecAudio},
+			DRMInfo{Enabled: true, Scheme: "cbcs", CryptBlocks: 1, EncryptedTracks: []string{TrackAudio}},
+		},
+	}
+
+	for _, tt := range tests {
+		info := newTestEncryptor(t, tt.cfg).Info()
+		if !bytes.Equal(info.KeyID, mustHex(testKeyID)) {
+			t.Errorf("%s: Info() key ID = %x, want %s", tt.cfg.Mode, info.KeyID, testKeyID)
+		}
+
+		info.KeyID = nil
+		if info.Enabled != tt.want.Enabled || info.Scheme != tt.want.Scheme ||
+			info.CryptBlocks != tt.want.CryptBlocks || info.SkipBlocks != tt.want.SkipBlocks ||
+			!slices.Equal(info.EncryptedTracks, tt.want.EncryptedTracks) {
+			t.Errorf("%s: Info() = %+v, want %+v", tt.cfg.Mode, info, tt.want)
+		}
+	}
+
+	disabled, _ := NewEncryptor(Config{})
+	if info := disabled.Info(); info.Enabled || info.KeyID != nil {
+		t.Errorf("Info() of a disabled encryptor = %+v", info)
+	}
+}
+
+// TestDRMInfo_MarshalJSON pins the field names clients rely on
+func TestDRMInfo_MarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		info DRMInfo
+		want string
+	}{
+		{
+			name: "disabled",
+			want: `{"enabled":false}`,
+		},
+		{
+			name: "cbcs",
+			info: DRMInfo{
+				Enabled:         true,
+				Scheme:          "cbcs",
+				KeyID:           []byte{0xfb, 0xff, 0xbf, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+				CryptBlocks:     1,
+				SkipBlocks:      9,
+				LicenseURL:      "/api/drm/clearkey",
+				EncryptedTracks: []string{TrackVideo, TrackAudio},
+			},
+			want: `{"enabled":true,"scheme":"cbcs","cryptBlocks":1,"skipBlocks":9,"licenseUrl":"/api/drm/clearkey","encryptedTracks":["video","audio"],"keyId":"-_-_AAAAAAAAAAAAAAAAAQ"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.info)
+		if err != nil {
+			t.Fatalf("%s: Marshal() returned error: %s", tt.name, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: Marshal() = %s, want %s", tt.name, data, tt.want)
+		}
+
+		var got DRMInfo
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: Unmarshal() returned error: %s", tt.name, err)
+		}
+		if !bytes.Equal(got.KeyID, tt.info.KeyID) || got.Scheme != tt.info.Scheme || !slices.Equal(got.EncryptedTracks, tt.info.EncryptedTracks) {
+			t.Errorf("%s: Unmarshal() = %+v, want %+v", tt.name, got, tt.info)
+		}
+	}
+
+	// the raw key has no field to end up in
+	data, _ := json.Marshal(newTestEncryptor(t, Config{}).Info())
+	if bytes.Contains(data, []byte(testKey)) || bytes.Contains(bytes.ToLower(data), []byte(`"key"`)) {
+		t.Errorf("Marshal() = %s, want no key", data)
+	}
+}
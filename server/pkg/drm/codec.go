@@ -0,0 +1,212 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Codecs of the encrypted stream
+const (
+	CodecH264 = "h264"
+	CodecH265 = "h265"
+	// audio samples of any codec, they have no NAL units and are
+	// protected as a whole
+	CodecAudio = "audio"
+)
+
+// nalCodec interprets NAL unit headers of a codec, H.264 has a 1-byte
+// header with a 5-bit type and H.265 a 2-byte header with a 6-bit type
+type nalCodec string
+
+func parseCodec(codec string) (nalCodec, error) {
+	switch codec {
+	case "", CodecH264:
+		return CodecH264, nil
+	case CodecH265:
+		return CodecH265, nil
+	case CodecAudio:
+		return CodecAudio, nil
+	}
+	return "", fmt.Errorf("codec must be %s, %s or %s, got %q", CodecH264, CodecH265, CodecAudio, codec)
+}
+
+// isAudio reports audio samples, none of the NAL unit methods apply
+func (c nalCodec) isAudio() bool {
+	return c == CodecAudio
+}
+
+// headerLen is the size of the NAL unit header, it always stays clear
+func (c nalCodec) headerLen() int {
+	if c == CodecH265 {
+		return 2
+	}
+	return 1
+}
+
+// nalType returns the type of a NAL unit without start code
+func (c nalCodec) nalType(nalu []byte) byte {
+	if len(nalu) == 0 {
+		return 0xFF
+	}
+	if c == CodecH265 {
+		return (nalu[0] >> 1) & 0x3F
+	}
+	return nalu[0] & 0x1F
+}
+
+// isVCL reports slice NAL units, the only ones encrypted
+func (c nalCodec) isVCL(nalType byte) bool {
+	if c == CodecH265 {
+		// 0-21 defined, 22-31 reserved VCL types
+		return nalType <= 31
+	}
+	return nalType >= 1 && nalType <= 5
+}
+
+// nalTypes is a set of NAL unit types, of up to 64 types of H.265
+type nalTypes uint64
+
+func (t nalTypes) has(nalType byte) bool {
+	return nalType < 64 && t&(1<<nalType) != 0
+}
+
+// encryptTypes returns the set of NAL unit types to encrypt, the VCL types
+// when types is empty. Parameter sets are refused, decoders need them to
+// start decoding at all.
+func (c nalCodec) encryptTypes(types []int, keySEI bool) (nalTypes, error) {
+	var set nalTypes
+	if len(types) == 0 {
+		for nalType := byte(0); nalType < 64; nalType++ {
+			if c.isVCL(nalType) {
+				set |= 1 << nalType
+			}
+		}
+		return set, nil
+	}
+
+	maxType := 31
+	if c == CodecH265 {
+		maxType = 63
+	}
+
+	for _, nalType := range types {
+		switch {
+		case nalType < 0 || nalType > maxType:
+			return 0, fmt.Errorf("encrypt NAL types of %s must be 0 to %d, got %d", c, maxType, nalType)
+		case c.isSPS(byte(nalType)), c.isPPS(byte(nalType)), c == CodecH265 && nalType == 32:
+			return 0, fmt.Errorf("encrypt NAL types must not include the parameter set type %d", nalType)
+		}
+		set |= 1 << nalType
+	}
+
+	if keySEI && set.has(c.nalType(c.seiHeader())) {
+		return 0, errors.New("encrypt NAL types must not include SEI with KeySEI, the key SEI has to stay clear")
+	}
+	return set, nil
+}
+
+// CheckEncryptNALTypes reports whether types are valid for
+// Config.EncryptNALTypes of the codec, with or without KeySEI
+func CheckEncryptNALTypes(codec string, types []int, keySEI bool) error {
+	c, err := parseCodec(codec)
+	if err != nil {
+		return err
+	}
+	if c.isAudio() {
+		return nil
+	}
+	_, err = c.encryptTypes(types, keySEI)
+	return err
+}
+
+// isKeyframe reports NAL units a decoder can start at, profile switches
+// wait for them; for H.265 these are the IRAP pictures
+func (c nalCodec) isKeyframe(nalType byte) bool {
+	if c == CodecH265 {
+		return nalType >= 16 && nalType <= 21
+	}
+	return nalType == 5
+}
+
+// isSPS and isPPS report parameter set NAL units
+func (c nalCodec) isSPS(nalType byte) bool {
+	if c == CodecH265 {
+		return nalType == 33
+	}
+	return nalType == 7
+}
+
+func (c nalCodec) isPPS(nalType byte) bool {
+	if c == CodecH265 {
+		return nalType == 34
+	}
+	return nalType == 8
+}
+
+// isDataPartition reports H.264 data partitions, H.265 has none
+func (c nalCodec) isDataPartition(nalType byte) bool {
+	return c == CodecH264 && nalType >= 2 && nalType <= 4
+}
+
+func (c nalCodec) isFiller(nalType byte) bool {
+	if c == CodecH265 {
+		return nalType == 38
+	}
+	return nalType == 12
+}
+
+// seiHeader is the header of a SEI NAL unit, a prefix SEI for H.265
+func (c nalCodec) seiHeader() []byte {
+	if c == CodecH265 {
+		// type 39, layer 0, temporal id plus 1
+		return []byte{39 << 1, 1}
+	}
+	return []byte{6}
+}
+
+// containsKeyframe reports whether the access unit carries a keyframe slice
+func (c nalCodec) containsKeyframe(data []byte) bool {
+	// every audio sample is a sync sample
+	if c.isAudio() {
+		return true
+	}
+
+	for _, r := range findNALUnits(nil, data) {
+		if nalu := r.nalu(data); len(nalu) > 0 && c.isKeyframe(c.nalType(nalu)) {
+			return true
+		}
+	}
+	return false
+}
+
+// beginsAccessUnit reports whether a NAL unit without start code following
+// a slice starts the next access unit, ITU-T H.264 7.4.1.2.3 and H.265
+// 7.4.2.4.4. These are the delimiters, parameter sets and prefix SEI, and
+// the slices a picture starts with. ok is false while the NAL unit is too
+// short to tell.
+func (c nalCodec) beginsAccessUnit(nalu []byte) (begins, ok bool) {
+	headerLen := c.headerLen()
+	if len(nalu) < headerLen {
+		return false, false
+	}
+
+	nalType := c.nalType(nalu)
+	if c.isVCL(nalType) {
+		if c.isDataPartition(nalType) && nalType != 2 {
+			// partitions B and C follow partition A of their slice
+			return false, true
+		}
+		if len(nalu) == headerLen {
+			return false, false
+		}
+		// first_slice_segment_in_pic_flag of H.265, first_mb_in_slice of
+		// H.264 is 0 when its exp-golomb code is a single 1 bit
+		return nalu[headerLen]&0x80 != 0, true
+	}
+
+	if c == CodecH265 {
+		return nalType >= 32 && nalType <= 35 || nalType == 39 ||
+			nalType >= 41 && nalType <= 44 || nalType >= 48 && nalType <= 55, true
+	}
+	return nalType >= 6 && nalType <= 9 || nalType >= 14 && nalType <= 18, true
+}
@@ -0,0 +1,217 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+// hevcNAL builds a start code prefixed H.265 NAL unit of the given type
+// with a payload of size bytes
+func hevcNAL(nalType byte, size int) []byte {
+	nalu := []byte{0, 0, 0, 1, nalType << 1, 1}
+	for i := 0; i < size; i++ {
+		nalu = append(nalu, byte(i+1))
+	}
+	return nalu
+}
+
+func TestEncryptor_hevc(t *testing.T) {
+	key, _ := hex.DecodeString(testKey)
+	iv, _ := hex.DecodeString(testIV)
+	block, _ := aes.NewCipher(key)
+
+	// VPS, SPS, PPS, prefix SEI and an IDR slice, then a trailing slice
+	params := [][]byte{hevcNAL(32, 20), hevcNAL(33, 40), hevcNAL(34, 20), hevcNAL(39, 24)}
+	frames := [][]byte{
+		bytes.Join(append(params, hevcNAL(19, 500)), nil),
+		hevcNAL(1, 300),
+	}
+
+	for _, mode := range []string{"cbcs", "cenc"} {
+		t.Run(mode, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{Mode: mode, CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265})
+
+			for i, frame := range frames {
+				sample, err := e.EncryptSample(frame)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+				out := sample.Data
+
+				for j, nalu := range parseNALUnits(out) {
+					src := parseNALUnits(frame)[j]
+					nalType := nalCodec(CodecH265).nalType(src[4:])
+
+					// both header bytes are clear, non-VCL completely
+					if !bytes.Equal(nalu[:6], src[:6]) {
+						t.Errorf("frame %d: NAL unit type %d header changed", i, nalType)
+					}
+					if nalType >= 32 && !bytes.Equal(nalu, src) {
+						t.Errorf("frame %d: non-VCL NAL unit type %d was encrypted", i, nalType)
+					}
+					if nalType < 32 && bytes.Equal(nalu, src) {
+						t.Errorf("frame %d: VCL NAL unit type %d was not encrypted", i, nalType)
+					}
+				}
+
+				if got := clientDecryptCodec(CodecH265, nil, block, sampleIV(iv, sample), e.Profile(), out); !bytes.Equal(got, frame) {
+					t.Errorf("frame %d: decrypted access unit does not match source", i)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptor_hevcKeyframes(t *testing.T) {
+	tests := []struct {
+		name       string
+		nalType    byte
+		wantSwitch bool
+	}{
+		{name: "IDR_W_RADL", nalType: 19, wantSwitch: true},
+		{name: "IDR_N_LP", nalType: 20, wantSwitch: true},
+		{name: "CRA", nalType: 21, wantSwitch: true},
+		{name: "TRAIL_R", nalType: 1},
+		// the H.264 IDR header byte is no keyframe in H.265
+		{name: "H.264 IDR", nalType: 0x65 >> 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265})
+			if err := e.ApplyProfile(testProfile); err != nil {
+				t.Fatalf("ApplyProfile() returned error: %s", err)
+			}
+
+			if _, err := e.Encrypt(hevcNAL(tt.nalType, 64)); err != nil {
+				t.Fatalf("Encrypt() returned error: %s", err)
+			}
+
+			_, pending := e.PendingProfile()
+			if switched := !pending; switched != tt.wantSwitch {
+				t.Errorf("switched = %v, want %v", switched, tt.wantSwitch)
+			}
+		})
+	}
+}
+
+func TestKeySEI_hevc(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265, KeySEI: true, Generation: 3})
+
+	frame := bytes.Join([][]byte{hevcNAL(33, 40), hevcNAL(19, 300)}, nil)
+	out, err := e.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	nalus := parseNALUnits(out)
+	if len(nalus) != 3 || !bytes.Equal(nalus[1][4:6], []byte{39 << 1, 1}) {
+		t.Fatalf("prefix SEI not inserted before the slice: %x", out[:16])
+	}
+
+	keyID, _ := hex.DecodeString(testKeyID)
+	if sei, ok := ParseKeySEI(out); !ok || !sei.Matches(keyID) || sei.Generation != 3 {
+		t.Errorf("ParseKeySEI() = %+v, %v, want generation 3 of %s", sei, ok, testKeyID)
+	}
+}
+
+func TestNewEncryptor_codec(t *testing.T) {
+	for _, codec := range []string{"", CodecH264, CodecH265} {
+		if _, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Codec: codec}); err != nil {
+			t.Errorf("NewEncryptor() with codec %q returned error: %s", codec, err)
+		}
+	}
+
+	if _, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Codec: "vp8"}); err == nil {
+		t.Errorf("NewEncryptor() with codec vp8 returned no error")
+	}
+}
+
+func TestEncryptor_encryptNALTypes(t *testing.T) {
+	frames := h264Stream()
+	defaults := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	slices := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, EncryptNALTypes: []int{1, 2, 3, 4, 5}})
+	for i, frame := range frames {
+		want, _ := defaults.Encrypt(frame)
+		if got, _ := slices.Encrypt(frame); !bytes.Equal(got, want) {
+			t.Errorf("frame %d: Encrypt() with types 1 to 5 differs from the default", i)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		types     []int
+		encrypted []byte // types encrypted in the first two frames
+	}{
+		{"clear keyframes", []int{1, 2, 3, 4}, []byte{1, 1}},
+		{"SEI", []int{1, 2, 3, 4, 5, 6}, []byte{6, 5, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, EncryptNALTypes: tt.types}
+			e := newTestEncryptor(t, cfg)
+
+			cfg.Enabled, cfg.KeyID, cfg.Key, cfg.IV = true, testKeyID, testKey, testIV
+			d, err := NewDecryptor(cfg)
+			if err != nil {
+				t.Fatalf("NewDecryptor() returned error: %s", err)
+			}
+
+			var encrypted []byte
+			for i, frame := range frames[:2] {
+				out, err := e.Encrypt(frame)
+				if err != nil {
+					t.Fatalf("frame %d: Encrypt() returned error: %s", i, err)
+				}
+
+				in, got := parseNALUnits(frame), parseNALUnits(out)
+				for j := range in {
+					if !bytes.Equal(in[j], got[j]) {
+						nalu := in[j][startCodeLen(in[j]):]
+						encrypted = append(encrypted, nalCodec(CodecH264).nalType(nalu))
+					}
+				}
+
+				if plain, err := d.Decrypt(out); err != nil || !bytes.Equal(plain, frame) {
+					t.Errorf("frame %d: Decrypt() did not restore the access unit: %v", i, err)
+				}
+			}
+
+			if !bytes.Equal(encrypted, tt.encrypted) {
+				t.Errorf("encrypted NAL types = %v, want %v", encrypted, tt.encrypted)
+			}
+		})
+	}
+}
+
+func TestNewEncryptor_encryptNALTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"SPS", Config{EncryptNALTypes: []int{1, 7}}},
+		{"PPS", Config{EncryptNALTypes: []int{8}}},
+		{"H.264 type out of range", Config{EncryptNALTypes: []int{32}}},
+		{"negative type", Config{EncryptNALTypes: []int{-1}}},
+		{"H.265 VPS", Config{Codec: CodecH265, EncryptNALTypes: []int{19, 32}}},
+		{"H.265 SPS", Config{Codec: CodecH265, EncryptNALTypes: []int{33}}},
+		{"SEI with KeySEI", Config{KeySEI: true, EncryptNALTypes: []int{1, 5, 6}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Enabled, cfg.KeyID, cfg.Key, cfg.IV = true, testKeyID, testKey, testIV
+			if _, err := NewEncryptor(cfg); err == nil {
+				t.Errorf("NewEncryptor() returned no error")
+			}
+		})
+	}
+
+	if err := CheckEncryptNALTypes(CodecH265, []int{1, 19, 39}, false); err != nil {
+		t.Errorf("CheckEncryptNALTypes() returned error: %s", err)
+	}
+}
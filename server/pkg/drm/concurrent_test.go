@@ -0,0 +1,168 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEncryptor_concurrent(t *testing.T) {
+	const goroutines = 8
+	const rounds = 20
+
+	frames := h264Stream()
+	block, _ := aes.NewCipher(mustHex(testKey))
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}},
+		{"cenc", Config{Mode: "cenc"}},
+		{"keySEI", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeySEI: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, tt.cfg)
+			reference := newTestEncryptor(t, tt.cfg)
+
+			// the parameter sets are known before the goroutines start,
+			// the constant IV makes cbcs output independent of the order
+			want := make([][]byte, len(frames))
+			for i, frame := range frames {
+				if i == 0 {
+					if _, err := e.Encrypt(frame); err != nil {
+						t.Fatalf("Encrypt() returned error: %s", err)
+					}
+				}
+				sample, err := reference.Encrypt(frame)
+				if err != nil {
+					t.Fatalf("frame %d: Encrypt() returned error: %s", i, err)
+				}
+				want[i] = sample
+			}
+
+			var mu sync.Mutex
+			ivs := map[string]bool{}
+
+			var wg sync.WaitGroup
+			wg.Add(goroutines)
+			for g := 0; g < goroutines; g++ {
+				go func() {
+					defer wg.Done()
+					for round := 0; round < rounds; round++ {
+						for i, frame := range frames {
+							sample, err := e.EncryptSample(frame)
+							if err != nil {
+								t.Errorf("frame %d: EncryptSample() returned error: %s", i, err)
+								return
+							}
+
+							if sample.IV == nil {
+								if !bytes.Equal(sample.Data, want[i]) {
+									t.Errorf("frame %d: EncryptSample() = %x, want %x", i, sample.Data, want[i])
+								}
+								continue
+							}
+
+							got, err := DecryptSample(block, SampleParams{Scheme: "cenc", IV: sample.IV, Escaped: true}, sample.Data, sample.Subsamples)
+							if err != nil || !bytes.Equal(got, frame) {
+								t.Errorf("frame %d: DecryptSample() with sample IV %x does not match source: %v", i, sample.IV, err)
+							}
+
+							mu.Lock()
+							if ivs[string(sample.IV)] {
+								t.Errorf("frame %d: sample IV %x used twice", i, sample.IV)
+							}
+							ivs[string(sample.IV)] = true
+							mu.Unlock()
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got, want := e.Stats().Frames, uint64(1+goroutines*rounds*len(frames)); got != want {
+				t.Errorf("Stats() frames = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestEncryptor_concurrentSwitch(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	frame := h264Stream()[0]
+
+	var updates atomic.Int64
+	e.OnUpdate(func(u Update) {
+		updates.Add(1)
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(8)
+	for g := 0; g < 8; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if _, err := e.Encrypt(frame); err != nil {
+					t.Errorf("Encrypt() returned error: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	// every staged pattern is switched to by exactly one of the calls
+	for _, p := range []Pattern{{2, 8}, {1, 9}, {3, 7}} {
+		for {
+			err := e.SetPattern(p)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, ErrProfilePending) {
+				t.Fatalf("SetPattern() returned error: %s", err)
+			}
+			if _, err := e.Encrypt(frame); err != nil {
+				t.Fatalf("Encrypt() returned error: %s", err)
+			}
+		}
+	}
+	wg.Wait()
+
+	if _, ok := e.PendingProfile(); ok {
+		if _, err := e.Encrypt(frame); err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+	}
+
+	if p := e.Profile(); p.CryptBlocks != 3 || p.SkipBlocks != 7 {
+		t.Errorf("Profile() pattern = %d:%d, want 3:7", p.CryptBlocks, p.SkipBlocks)
+	}
+	if got := updates.Load(); got != 3 || e.Epoch() != 4 {
+		t.Errorf("updates = %d at epoch %d, want 3 at epoch 4", got, e.Epoch())
+	}
+}
+
+func BenchmarkEncryptor_concurrent(b *testing.B) {
+	e, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cenc"})
+	if err != nil {
+		b.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+
+	frames := h264Stream()
+	if _, err := e.Encrypt(frames[0]); err != nil {
+		b.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	b.SetBytes(int64(len(frames[1])))
+	b.RunParallel(func(pb *testing.PB) {
+		var buf []byte
+		for pb.Next() {
+			buf, _ = e.EncryptTo(buf, frames[1])
+		}
+	})
+}
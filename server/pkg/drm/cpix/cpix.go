@@ -0,0 +1,221 @@
+// Package cpix reads content keys from CPIX documents of key management
+// systems, as specified by DASH-IF Content Protection Information Exchange
+package cpix
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+var (
+	// ErrEncryptedKey is returned for content keys wrapped with a document
+	// key, only plain values are supported
+	ErrEncryptedKey = errors.New("encrypted cpix content keys are not supported")
+	ErrNoKeys       = errors.New("cpix document has no content keys")
+)
+
+// ContentKey is a plain content key with the tracks its usage rules allow,
+// key material is hex encoded as in drm.Config
+type ContentKey struct {
+	KeyID string
+	Key   string
+	// IV is empty unless the document has an explicit IV for the key
+	IV     string
+	Scheme string // commonEncryptionScheme, empty when not given
+	Tracks []string
+}
+
+// DRMSystem is the pssh box of a key system for a content key
+type DRMSystem struct {
+	KeyID    string // hex encoded
+	SystemID [16]byte
+	PSSH     []byte // complete box, nil when the document has none
+}
+
+// Document holds the content keys and key system data of a CPIX document
+type Document struct {
+	ContentID  string
+	Keys       []ContentKey
+	DRMSystems []DRMSystem
+}
+
+type xmlDocument struct {
+	ContentID string `xml:"contentId,attr"`
+	// SPEKE 1.0 responses name the content by id instead
+	ID         string `xml:"id,attr"`
+	ContentKey []struct {
+		KID          string    `xml:"kid,attr"`
+		ExplicitIV   string    `xml:"explicitIV,attr"`
+		Scheme       string    `xml:"commonEncryptionScheme,attr"`
+		PlainValue   string    `xml:"Data>Secret>PlainValue"`
+		EncryptedKey *struct{} `xml:"Data>Secret>EncryptedValue"`
+	} `xml:"ContentKeyList>ContentKey"`
+	DRMSystem []struct {
+		KID      string `xml:"kid,attr"`
+		SystemID string `xml:"systemId,attr"`
+		PSSH     string `xml:"PSSH"`
+	} `xml:"DRMSystemList>DRMSystem"`
+	UsageRule []struct {
+		KID               string     `xml:"kid,attr"`
+		IntendedTrackType string     `xml:"intendedTrackType,attr"`
+		VideoFilter       []struct{} `xml:"VideoFilter"`
+		AudioFilter       []struct{} `xml:"AudioFilter"`
+	} `xml:"ContentKeyUsageRuleList>ContentKeyUsageRule"`
+}
+
+// Parse reads a CPIX document, keys without usage rules are for video
+// unless the document has no usage rules at all
+func Parse(data []byte) (*Document, error) {
+	var x xmlDocument
+	if err := xml.Unmarshal(data, &x); err != nil {
+		return nil, fmt.Errorf("cpix: %w", err)
+	}
+
+	tracks := map[string][]string{}
+	for _, rule := range x.UsageRule {
+		kid, err := parseUUID(rule.KID)
+		if err != nil {
+			return nil, fmt.Errorf("cpix usage rule: %w", err)
+		}
+		tracks[kid] = appendTracks(tracks[kid], ruleTracks(rule.IntendedTrackType, len(rule.VideoFilter) > 0, len(rule.AudioFilter) > 0)...)
+	}
+
+	doc := &Document{ContentID: x.ContentID}
+	if doc.ContentID == "" {
+		doc.ContentID = x.ID
+	}
+	for _, ck := range x.ContentKey {
+		kid, err := parseUUID(ck.KID)
+		if err != nil {
+			return nil, fmt.Errorf("cpix content key: %w", err)
+		}
+
+		if ck.EncryptedKey != nil {
+			return nil, fmt.Errorf("%w: key %s", ErrEncryptedKey, kid)
+		}
+
+		key, err := decode16(ck.PlainValue)
+		if err != nil {
+			return nil, fmt.Errorf("cpix content key %s: %w", kid, err)
+		}
+
+		var iv string
+		if ck.ExplicitIV != "" {
+			iv, err = decode16(ck.ExplicitIV)
+			if err != nil {
+				return nil, fmt.Errorf("cpix content key %s explicit IV: %w", kid, err)
+			}
+		}
+
+		keyTracks := tracks[kid]
+		if len(x.UsageRule) == 0 {
+			keyTracks = []string{drm.TrackVideo}
+		}
+
+		doc.Keys = append(doc.Keys, ContentKey{
+			KeyID:  kid,
+			Key:    key,
+			IV:     iv,
+			Scheme: ck.Scheme,
+			Tracks: keyTracks,
+		})
+	}
+
+	if len(doc.Keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	for _, system := range x.DRMSystem {
+		kid, err := parseUUID(system.KID)
+		if err != nil {
+			return nil, fmt.Errorf("cpix drm system: %w", err)
+		}
+
+		systemID, err := parseUUID(system.SystemID)
+		if err != nil {
+			return nil, fmt.Errorf("cpix drm system: %w", err)
+		}
+
+		var pssh []byte
+		if data := strings.TrimSpace(system.PSSH); data != "" {
+			pssh, err = base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, fmt.Errorf("cpix drm system %s pssh: %w", systemID, err)
+			}
+		}
+
+		var id [16]byte
+		hex.Decode(id[:], []byte(systemID))
+		doc.DRMSystems = append(doc.DRMSystems, DRMSystem{KeyID: kid, SystemID: id, PSSH: pssh})
+	}
+
+	return doc, nil
+}
+
+// TrackKeys returns the keys usable for a track in document order
+func (d *Document) TrackKeys(track string) []ContentKey {
+	var keys []ContentKey
+	for _, key := range d.Keys {
+		if slices.Contains(key.Tracks, track) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ruleTracks maps an intended track type and the filters of a usage rule
+// to encryptor tracks; the type is free-form, commonly VIDEO, SD, HD, UHD,
+// AUDIO or ALL
+func ruleTracks(intended string, videoFilter, audioFilter bool) []string {
+	var tracks []string
+	switch t := strings.ToUpper(intended); {
+	case t == "ALL":
+		tracks = append(tracks, drm.TrackVideo, drm.TrackAudio)
+	case strings.Contains(t, "AUDIO"):
+		tracks = append(tracks, drm.TrackAudio)
+	case t == "VIDEO", t == "SD", t == "HD", strings.HasPrefix(t, "UHD"):
+		tracks = append(tracks, drm.TrackVideo)
+	}
+
+	if videoFilter {
+		tracks = appendTracks(tracks, drm.TrackVideo)
+	}
+	if audioFilter {
+		tracks = appendTracks(tracks, drm.TrackAudio)
+	}
+	return tracks
+}
+
+func appendTracks(tracks []string, add ...string) []string {
+	for _, track := range add {
+		if !slices.Contains(tracks, track) {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+// parseUUID returns a UUID as 32 hex characters
+func parseUUID(s string) (string, error) {
+	id := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), "-", ""))
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		return "", fmt.Errorf("%q is not a UUID", s)
+	}
+	return id, nil
+}
+
+// decode16 decodes base64 encoded 16 bytes to hex
+func decode16(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != 16 {
+		return "", errors.New("must be 16 bytes base64 encoded")
+	}
+	return hex.EncodeToString(b), nil
+}
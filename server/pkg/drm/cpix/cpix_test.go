@@ -0,0 +1,192 @@
+package cpix
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// testDocument is a CPIX 2.3 document as exported by key management
+// systems, with a video and an audio key
+const testDocument = `<?xml version="1.0" encoding="UTF-8"?>
+<cpix:CPIX contentId="desktop" version="2.3"
+	xmlns:cpix="urn:dashif:org:cpix"
+	xmlns:pskc="urn:ietf:params:xml:ns:keyprov:pskc">
+	<cpix:ContentKeyList>
+		<cpix:ContentKey kid="00000000-0000-0000-0000-000000000001" commonEncryptionScheme="cbcs" explicitIV="1fvWuC7ZPk75iuQJMe4ztw==">
+			<cpix:Data>
+				<pskc:Secret>
+					<pskc:PlainValue>PDw8PDw8PDw8PDw8PDw8PA==</pskc:PlainValue>
+				</pskc:Secret>
+			</cpix:Data>
+		</cpix:ContentKey>
+		<cpix:ContentKey kid="00000000-0000-0000-0000-000000000002" commonEncryptionScheme="cbcs">
+			<cpix:Data>
+				<pskc:Secret>
+					<pskc:PlainValue>TU1NTU1NTU1NTU1NTU1NTQ==</pskc:PlainValue>
+				</pskc:Secret>
+			</cpix:Data>
+		</cpix:ContentKey>
+	</cpix:ContentKeyList>
+	<cpix:DRMSystemList>
+		<cpix:DRMSystem kid="00000000-0000-0000-0000-000000000001" systemId="edef8ba9-79d6-4ace-a3c8-27dcd51d21ed">
+			<cpix:PSSH>%s</cpix:PSSH>
+		</cpix:DRMSystem>
+	</cpix:DRMSystemList>
+	<cpix:ContentKeyUsageRuleList>
+		<cpix:ContentKeyUsageRule kid="00000000-0000-0000-0000-000000000001" intendedTrackType="HD">
+			<cpix:VideoFilter minPixels="0"/>
+		</cpix:ContentKeyUsageRule>
+		<cpix:ContentKeyUsageRule kid="00000000-0000-0000-0000-000000000002" intendedTrackType="AUDIO">
+			<cpix:AudioFilter/>
+		</cpix:ContentKeyUsageRule>
+	</cpix:ContentKeyUsageRuleList>
+</cpix:CPIX>`
+
+func testPSSH(t *testing.T) []byte {
+	t.Helper()
+
+	kid, _ := hex.DecodeString("00000000000000000000000000000001")
+	pssh, err := drm.BuildPSSH([]string{"widevine:neko"}, [][]byte{kid})
+	if err != nil {
+		t.Fatalf("BuildPSSH() returned error: %s", err)
+	}
+	return pssh
+}
+
+func document(t *testing.T) string {
+	return strings.Replace(testDocument, "%s", base64.StdEncoding.EncodeToString(testPSSH(t)), 1)
+}
+
+func TestParse(t *testing.T) {
+	doc, err := Parse([]byte(document(t)))
+	if err != nil {
+		t.Fatalf("Parse() returned error: %s", err)
+	}
+
+	want := []ContentKey{
+		{
+			KeyID:  "00000000000000000000000000000001",
+			Key:    "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c",
+			IV:     "d5fbd6b82ed93e4ef98ae40931ee33b7",
+			Scheme: "cbcs",
+			Tracks: []string{drm.TrackVideo},
+		},
+		{
+			KeyID:  "00000000000000000000000000000002",
+			Key:    "4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d",
+			Scheme: "cbcs",
+			Tracks: []string{drm.TrackAudio},
+		},
+	}
+	if doc.ContentID != "desktop" || !reflect.DeepEqual(doc.Keys, want) {
+		t.Errorf("Parse() = %+v, want content ID desktop with keys %+v", doc, want)
+	}
+
+	if got := doc.TrackKeys(drm.TrackAudio); len(got) != 1 || got[0].KeyID != want[1].KeyID {
+		t.Errorf("TrackKeys(%q) = %+v, want the audio key", drm.TrackAudio, got)
+	}
+
+	if len(doc.DRMSystems) != 1 {
+		t.Fatalf("DRMSystems = %+v, want one", doc.DRMSystems)
+	}
+	system := doc.DRMSystems[0]
+	if system.KeyID != want[0].KeyID || system.SystemID != drm.SystemIDWidevine || !reflect.DeepEqual(system.PSSH, testPSSH(t)) {
+		t.Errorf("DRMSystems[0] = %+v, want the Widevine pssh of the video key", system)
+	}
+}
+
+func TestParse_tracks(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  []string
+	}{
+		{"no usage rules", "", []string{drm.TrackVideo}},
+		{"all tracks", `<cpix:ContentKeyUsageRule kid="00000000-0000-0000-0000-000000000001" intendedTrackType="ALL"/>`, []string{drm.TrackVideo, drm.TrackAudio}},
+		{"uhd", `<cpix:ContentKeyUsageRule kid="00000000-0000-0000-0000-000000000001" intendedTrackType="UHD1"/>`, []string{drm.TrackVideo}},
+		{"audio filter", `<cpix:ContentKeyUsageRule kid="00000000-0000-0000-0000-000000000001"><cpix:AudioFilter/></cpix:ContentKeyUsageRule>`, []string{drm.TrackAudio}},
+		{"rules of other keys", `<cpix:ContentKeyUsageRule kid="00000000-0000-0000-0000-000000000009" intendedTrackType="VIDEO"/>`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := Parse([]byte(`<cpix:CPIX xmlns:cpix="urn:dashif:org:cpix" xmlns:pskc="urn:ietf:params:xml:ns:keyprov:pskc">
+				<cpix:ContentKeyList>
+					<cpix:ContentKey kid="00000000-0000-0000-0000-000000000001">
+						<cpix:Data><pskc:Secret><pskc:PlainValue>PDw8PDw8PDw8PDw8PDw8PA==</pskc:PlainValue></pskc:Secret></cpix:Data>
+					</cpix:ContentKey>
+				</cpix:ContentKeyList>
+				<cpix:ContentKeyUsageRuleList>` + tt.rules + `</cpix:ContentKeyUsageRuleList>
+			</cpix:CPIX>`))
+			if err != nil {
+				t.Fatalf("Parse() returned error: %s", err)
+			}
+			if got := doc.Keys[0].Tracks; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Tracks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr error
+	}{
+		{
+			name: "encrypted key",
+			doc: strings.Replace(document(t), "<pskc:PlainValue>PDw8PDw8PDw8PDw8PDw8PA==</pskc:PlainValue>",
+				"<pskc:EncryptedValue><xenc:CipherData xmlns:xenc=\"http://www.w3.org/2001/04/xmlenc#\"/></pskc:EncryptedValue>", 1),
+			wantErr: ErrEncryptedKey,
+		},
+		{
+			name:    "no keys",
+			doc:     `<cpix:CPIX xmlns:cpix="urn:dashif:org:cpix"><cpix:ContentKeyList/></cpix:CPIX>`,
+			wantErr: ErrNoKeys,
+		},
+		{name: "short key", doc: strings.Replace(document(t), "PDw8PDw8PDw8PDw8PDw8PA==", "PDw8", 1)},
+		{name: "bad key ID", doc: strings.Replace(document(t), `kid="00000000-0000-0000-0000-000000000002"`, `kid="audio"`, 1)},
+		{name: "not xml", doc: "key_id:key:iv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.doc))
+			if err == nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequest_Marshal(t *testing.T) {
+	data, err := Request{
+		ContentID: "stream-1",
+		KeyIDs:    []string{"00000000000000000000000000000001"},
+		SystemIDs: [][16]byte{drm.SystemIDWidevine},
+	}.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error: %s", err)
+	}
+
+	for _, want := range []string{
+		`<cpix:CPIX id="stream-1" contentId="stream-1" xmlns:cpix="urn:dashif:org:cpix"`,
+		`<cpix:ContentKey kid="00000000-0000-0000-0000-000000000001"></cpix:ContentKey>`,
+		`<cpix:DRMSystem kid="00000000-0000-0000-0000-000000000001" systemId="edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"><cpix:PSSH></cpix:PSSH></cpix:DRMSystem>`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Marshal() = %s, missing %s", data, want)
+		}
+	}
+
+	if _, err := (Request{KeyIDs: []string{"01"}}).Marshal(); err == nil {
+		t.Errorf("Marshal() accepted a short key ID")
+	}
+}
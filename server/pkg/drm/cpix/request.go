@@ -0,0 +1,72 @@
+package cpix
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// Request asks a key server for the content keys of key IDs chosen by the
+// client and the pssh boxes of the key systems, as SPEKE does
+type Request struct {
+	ContentID string
+	KeyIDs    []string // hex encoded 16 bytes
+	SystemIDs [][16]byte
+}
+
+type xmlRequest struct {
+	XMLName    xml.Name `xml:"cpix:CPIX"`
+	ID         string   `xml:"id,attr"`
+	ContentID  string   `xml:"contentId,attr"`
+	CPIX       string   `xml:"xmlns:cpix,attr"`
+	PSKC       string   `xml:"xmlns:pskc,attr"`
+	SPEKE      string   `xml:"xmlns:speke,attr"`
+	ContentKey []struct {
+		KID string `xml:"kid,attr"`
+	} `xml:"cpix:ContentKeyList>cpix:ContentKey"`
+	DRMSystem []struct {
+		KID      string   `xml:"kid,attr"`
+		SystemID string   `xml:"systemId,attr"`
+		PSSH     struct{} `xml:"cpix:PSSH"`
+	} `xml:"cpix:DRMSystemList>cpix:DRMSystem"`
+}
+
+// Marshal returns the request document, every key system is asked for the
+// pssh box of every key
+func (r Request) Marshal() ([]byte, error) {
+	x := xmlRequest{
+		ID:        r.ContentID,
+		ContentID: r.ContentID,
+		CPIX:      "urn:dashif:org:cpix",
+		PSKC:      "urn:ietf:params:xml:ns:keyprov:pskc",
+		SPEKE:     "urn:aws:amazon:com:speke",
+	}
+
+	for _, keyID := range r.KeyIDs {
+		kid, err := hex.DecodeString(keyID)
+		if err != nil || len(kid) != 16 {
+			return nil, fmt.Errorf("cpix request key ID %q must be 16 bytes hex encoded", keyID)
+		}
+		uuid := drm.UUIDString(kid)
+
+		x.ContentKey = append(x.ContentKey, struct {
+			KID string `xml:"kid,attr"`
+		}{KID: uuid})
+
+		for _, systemID := range r.SystemIDs {
+			x.DRMSystem = append(x.DRMSystem, struct {
+				KID      string   `xml:"kid,attr"`
+				SystemID string   `xml:"systemId,attr"`
+				PSSH     struct{} `xml:"cpix:PSSH"`
+			}{KID: uuid, SystemID: drm.UUIDString(systemID[:])})
+		}
+	}
+
+	data, err := xml.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,58 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Delays between attempts of a CryptoPeriod rotation that failed, doubling
+// from the first to the last
+const (
+	CryptoPeriodRetryMin = 5 * time.Second
+	CryptoPeriodRetryMax = 5 * time.Minute
+)
+
+// CryptoPeriod is how long a content key is used before it is rotated
+// automatically. Jitter shortens every period by a random duration up to
+// it, so that servers started together do not rotate in lockstep while no
+// key is used for longer than Interval.
+type CryptoPeriod struct {
+	Interval time.Duration
+	Jitter   time.Duration
+}
+
+// Validate checks that the interval is positive and the jitter shorter
+func (p CryptoPeriod) Validate() error {
+	switch {
+	case p.Interval <= 0:
+		return fmt.Errorf("crypto period must be positive, got %s", p.Interval)
+	case p.Jitter < 0:
+		return fmt.Errorf("crypto period jitter must not be negative, got %s", p.Jitter)
+	case p.Jitter >= p.Interval:
+		return errors.New("crypto period jitter must be shorter than the interval")
+	}
+	return nil
+}
+
+// Next returns the length of the next period
+func (p CryptoPeriod) Next() time.Duration {
+	if p.Jitter <= 0 {
+		return p.Interval
+	}
+	return p.Interval - time.Duration(rand.Int63n(int64(p.Jitter)+1))
+}
+
+// Retry returns the delay before the next attempt after a number of
+// attempts failed in a row, doubling from CryptoPeriodRetryMin up to
+// CryptoPeriodRetryMax or the interval when shorter
+func (p CryptoPeriod) Retry(failures int) time.Duration {
+	limit := min(CryptoPeriodRetryMax, p.Interval)
+
+	delay := CryptoPeriodRetryMin
+	for i := 1; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
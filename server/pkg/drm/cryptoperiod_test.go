@@ -0,0 +1,66 @@
+package drm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCryptoPeriod_Validate(t *testing.T) {
+	tests := []struct {
+		period CryptoPeriod
+		valid  bool
+	}{
+		{CryptoPeriod{Interval: time.Hour}, true},
+		{CryptoPeriod{Interval: time.Hour, Jitter: 5 * time.Minute}, true},
+		{CryptoPeriod{}, false},
+		{CryptoPeriod{Interval: -time.Hour}, false},
+		{CryptoPeriod{Interval: time.Hour, Jitter: -time.Minute}, false},
+		{CryptoPeriod{Interval: time.Hour, Jitter: time.Hour}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.period.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: Validate() error = %v, want valid %v", tt.period, err, tt.valid)
+		}
+	}
+}
+
+func TestCryptoPeriod_Next(t *testing.T) {
+	p := CryptoPeriod{Interval: time.Hour}
+	if got := p.Next(); got != time.Hour {
+		t.Errorf("Next() without jitter = %s, want %s", got, time.Hour)
+	}
+
+	// never longer than the interval, and not always the same
+	p.Jitter = 10 * time.Minute
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		got := p.Next()
+		if got > p.Interval || got < p.Interval-p.Jitter {
+			t.Fatalf("Next() = %s, want within %s of %s", got, p.Jitter, p.Interval)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Next() with jitter returned the same period 100 times")
+	}
+}
+
+func TestCryptoPeriod_Retry(t *testing.T) {
+	p := CryptoPeriod{Interval: time.Hour}
+	want := []time.Duration{5 * time.Second, 5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second}
+	for failures, delay := range want {
+		if got := p.Retry(failures); got != delay {
+			t.Errorf("Retry(%d) = %s, want %s", failures, got, delay)
+		}
+	}
+	if got := p.Retry(100); got != CryptoPeriodRetryMax {
+		t.Errorf("Retry(100) = %s, want %s", got, CryptoPeriodRetryMax)
+	}
+
+	// a short period is retried at least once per period
+	p = CryptoPeriod{Interval: time.Minute}
+	if got := p.Retry(100); got != time.Minute {
+		t.Errorf("Retry(100) of a minute period = %s, want %s", got, time.Minute)
+	}
+}
@@ -0,0 +1,112 @@
+package drm
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// DASH scheme of the Common Encryption descriptor and the namespace of its
+// cenc attributes and elements
+const (
+	SchemeIDMP4Protection = "urn:mpeg:dash:mp4protection:2011"
+	NamespaceCENC         = "urn:mpeg:cenc:2013"
+)
+
+// ContentProtection is a ContentProtection descriptor of a DASH MPD. The
+// cenc namespace is declared on every descriptor, so that they can be put
+// into an MPD as they are.
+type ContentProtection struct {
+	XMLName     xml.Name `xml:"ContentProtection"`
+	XMLNSCENC   string   `xml:"xmlns:cenc,attr"`
+	SchemeIDURI string   `xml:"schemeIdUri,attr"`
+	Value       string   `xml:"value,attr,omitempty"`
+	DefaultKID  string   `xml:"cenc:default_KID,attr,omitempty"`
+	// base64 encoded pssh box of the key system
+	PSSH string `xml:"cenc:pssh,omitempty"`
+}
+
+// XML returns the descriptor serialized as an XML element
+func (c ContentProtection) XML() string {
+	// the descriptor has nothing xml.Marshal could fail on
+	out, _ := xml.Marshal(c)
+	return string(out)
+}
+
+// UUIDString formats 16 bytes, a key ID or system ID, as a hyphenated
+// lowercase UUID as in cenc:default_KID
+func UUIDString(b []byte) string {
+	h := hex.EncodeToString(b)
+	if len(h) != 32 {
+		return h
+	}
+	return strings.Join([]string{h[:8], h[8:12], h[12:16], h[16:20], h[20:]}, "-")
+}
+
+// ContentProtections returns the descriptors of content protected with the
+// key ID in the scheme: the mp4protection descriptor naming the scheme and
+// default KID, followed by one per PSSH system with its pssh box, see
+// BuildPSSH for the systems
+func ContentProtections(scheme string, keyID []byte, systems []string) ([]ContentProtection, error) {
+	if !ValidScheme(scheme) {
+		return nil, fmt.Errorf("scheme must be cbcs, cenc, cens or cbc1, got %q", scheme)
+	}
+
+	parsed, err := parsePSSHSystems(systems)
+	if err != nil {
+		return nil, err
+	}
+	return contentProtections(keyID, parsed, PSSHOptions{Scheme: scheme})
+}
+
+func contentProtections(keyID []byte, systems []psshSystem, opts PSSHOptions) ([]ContentProtection, error) {
+	if len(keyID) != 16 {
+		return nil, fmt.Errorf("key ID must be 16 bytes, got %d", len(keyID))
+	}
+
+	descriptors := []ContentProtection{{
+		XMLNSCENC:   NamespaceCENC,
+		SchemeIDURI: SchemeIDMP4Protection,
+		Value:       opts.Scheme,
+		DefaultKID:  UUIDString(keyID),
+	}}
+
+	for _, system := range systems {
+		pssh, err := buildPSSH([]psshSystem{system}, [][]byte{keyID}, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		systemID := SystemIDCommon
+		var value string
+		switch system.name {
+		case PSSHSystemWidevine:
+			systemID = SystemIDWidevine
+			value = "Widevine"
+		case PSSHSystemPlayReady:
+			systemID = SystemIDPlayReady
+			value = "MSPR 2.0"
+		}
+
+		descriptors = append(descriptors, ContentProtection{
+			XMLNSCENC:   NamespaceCENC,
+			SchemeIDURI: "urn:uuid:" + UUIDString(systemID[:]),
+			Value:       value,
+			PSSH:        base64.StdEncoding.EncodeToString(pssh),
+		})
+	}
+
+	return descriptors, nil
+}
+
+// ManifestDescriptors returns the ContentProtection descriptors of the
+// current profile for a DASH MPD, nil when disabled
+func (e *Encryptor) ManifestDescriptors() ([]ContentProtection, error) {
+	s := e.state.Load()
+	if !e.enabled.Load() || s == nil {
+		return nil, nil
+	}
+	return contentProtections(s.keyID, e.psshSystems, e.psshOptions(s))
+}
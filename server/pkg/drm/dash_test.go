@@ -0,0 +1,73 @@
+package drm
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestUUIDString(t *testing.T) {
+	got := UUIDString(mustHex("0123456789abcdef0123456789abcdef"))
+	if want := "01234567-89ab-cdef-0123-456789abcdef"; got != want {
+		t.Errorf("UUIDString() = %s, want %s", got, want)
+	}
+}
+
+func TestContentProtections(t *testing.T) {
+	descriptors, err := ContentProtections("cbcs", mustHex(testKeyID), []string{"cenc", "widevine:neko"})
+	if err != nil {
+		t.Fatalf("ContentProtections() returned error: %s", err)
+	}
+	if len(descriptors) != 3 {
+		t.Fatalf("ContentProtections() returned %d descriptors, want 3", len(descriptors))
+	}
+
+	want := `<ContentProtection xmlns:cenc="urn:mpeg:cenc:2013" schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cbcs" cenc:default_KID="00000000-0000-0000-0000-000000000001"></ContentProtection>`
+	if got := descriptors[0].XML(); got != want {
+		t.Errorf("mp4protection XML() = %s, want %s", got, want)
+	}
+
+	// the pssh boxes are those of the init data
+	for i, system := range []string{"cenc", "widevine:neko"} {
+		pssh, _ := BuildPSSH([]string{system}, [][]byte{mustHex(testKeyID)})
+		if got := descriptors[i+1].PSSH; got != base64.StdEncoding.EncodeToString(pssh) {
+			t.Errorf("%s pssh = %s, want %x", system, got, pssh)
+		}
+	}
+
+	want = `<ContentProtection xmlns:cenc="urn:mpeg:cenc:2013" schemeIdUri="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed" value="Widevine"><cenc:pssh>` + descriptors[2].PSSH + `</cenc:pssh></ContentProtection>`
+	if got := descriptors[2].XML(); got != want {
+		t.Errorf("widevine XML() = %s, want %s", got, want)
+	}
+	if got := descriptors[1].SchemeIDURI; got != "urn:uuid:1077efec-c0b2-4d02-ace3-3c1e52e2fb4b" {
+		t.Errorf("common schemeIdUri = %s", got)
+	}
+
+	if _, err := ContentProtections("aes", mustHex(testKeyID), nil); err == nil {
+		t.Errorf("ContentProtections() accepted an unknown scheme")
+	}
+	if _, err := ContentProtections("cenc", mustHex(testKeyID), []string{"fairplay"}); err == nil {
+		t.Errorf("ContentProtections() accepted an unknown pssh system")
+	}
+}
+
+func TestEncryptor_ManifestDescriptors(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cenc", PSSHSystems: []string{"cenc"}})
+
+	descriptors, err := e.ManifestDescriptors()
+	if err != nil {
+		t.Fatalf("ManifestDescriptors() returned error: %s", err)
+	}
+	if len(descriptors) != 2 || descriptors[0].Value != "cenc" || descriptors[0].DefaultKID != UUIDString(mustHex(testKeyID)) {
+		t.Errorf("ManifestDescriptors() = %+v, want cenc descriptors of %s", descriptors, testKeyID)
+	}
+
+	initData, _ := e.InitData()
+	if descriptors[1].PSSH != base64.StdEncoding.EncodeToString(initData) {
+		t.Errorf("ManifestDescriptors() pssh does not match InitData()")
+	}
+
+	disabled, _ := NewEncryptor(Config{})
+	if descriptors, err := disabled.ManifestDescriptors(); descriptors != nil || err != nil {
+		t.Errorf("ManifestDescriptors() of a disabled encryptor = %v, %v", descriptors, err)
+	}
+}
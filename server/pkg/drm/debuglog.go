@@ -0,0 +1,131 @@
+package drm
+
+import (
+	"github.com/rs/zerolog"
+)
+
+// SetLogger sets the logger access units are described to at debug level:
+// the NAL units encrypted and kept clear with their sizes, and warnings for
+// access units of which nothing was encrypted or with slices too short to.
+// Nothing is collected for it unless it logs debug events, nil removes it.
+func (e *Encryptor) SetLogger(logger *zerolog.Logger) {
+	if logger == nil {
+		e.logger.Store(nil)
+		return
+	}
+
+	l := *logger
+	e.logger.Store(&l)
+}
+
+// debugLogger returns the logger of SetLogger when it logs debug events,
+// nil otherwise
+func (e *Encryptor) debugLogger() *zerolog.Logger {
+	logger := e.logger.Load()
+	if logger == nil || logger.GetLevel() > zerolog.DebugLevel || zerolog.GlobalLevel() > zerolog.DebugLevel {
+		return nil
+	}
+	return logger
+}
+
+// protectedRanges returns the protected ranges of subsamples as offsets in
+// the sample
+func protectedRanges(subsamples []SubsampleInfo) [][2]int {
+	var ranges [][2]int
+	var pos int
+	for _, s := range subsamples {
+		pos += int(s.BytesOfClearData)
+		if s.BytesOfProtectedData > 0 {
+			ranges = append(ranges, [2]int{pos, pos + int(s.BytesOfProtectedData)})
+		}
+		pos += int(s.BytesOfProtectedData)
+	}
+	return ranges
+}
+
+// logAccessUnit describes an encrypted Annex B access unit, protected are
+// the ranges of it that were encrypted
+func (e *Encryptor) logAccessUnit(logger *zerolog.Logger, mode string, au []byte, protected [][2]int) {
+	var protectedBytes int
+	for _, r := range protected {
+		protectedBytes += r[1] - r[0]
+	}
+
+	if e.codec.isAudio() {
+		logger.Debug().
+			Str("mode", mode).
+			Int("size", len(au)).
+			Int("protected_bytes", protectedBytes).
+			Msg("encrypted audio sample")
+		return
+	}
+
+	hl := e.codec.headerLen()
+	ranges := findNALUnits(nil, au)
+
+	var encryptedTypes, clearTypes, sizes []int
+	var vcl bool
+	var short int
+
+	for _, r := range ranges {
+		nalu := r.nalu(au)
+		sizes = append(sizes, len(nalu))
+
+		// the type of a truncated NAL unit is unknown
+		nalType := -1
+		if len(nalu) >= hl {
+			nalType = int(e.codec.nalType(nalu))
+		}
+
+		encrypted := overlaps(protected, r.offset+r.headerLen, r.offset+r.length)
+		if encrypted {
+			encryptedTypes = append(encryptedTypes, nalType)
+		} else {
+			clearTypes = append(clearTypes, nalType)
+		}
+
+		if nalType < 0 || !e.encrypts(byte(nalType)) {
+			continue
+		}
+		vcl = true
+		if !encrypted && len(nalu) > hl && protectedLen(unescapeRBSP(nalu[hl:])) < e.minEncryptSize {
+			short++
+		}
+	}
+
+	logger.Debug().
+		Str("mode", mode).
+		Int("size", len(au)).
+		Int("nals", len(ranges)).
+		Ints("encrypted_types", encryptedTypes).
+		Ints("clear_types", clearTypes).
+		Ints("nal_sizes", sizes).
+		Int("protected_bytes", protectedBytes).
+		Msg("encrypted access unit")
+
+	if short > 0 {
+		logger.Warn().
+			Int("short_nals", short).
+			Int("threshold", e.minEncryptSize).
+			Msg("slices below the threshold were kept clear")
+	}
+	if vcl && len(protected) == 0 {
+		logger.Warn().
+			Int("nals", len(ranges)).
+			Ints("nal_sizes", sizes).
+			Msg("nothing of the access unit was encrypted")
+	}
+}
+
+// overlaps reports whether any of the sorted ranges overlaps [start, end)
+func overlaps(ranges [][2]int, start, end int) bool {
+	for _, r := range ranges {
+		if r[0] >= end {
+			return false
+		}
+		if r[1] > start {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// logEvents decodes the JSON events of a zerolog buffer
+func logEvents(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var events []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var event map[string]any
+		if err := dec.Decode(&event); err != nil {
+			t.Fatalf("Decode() returned error: %s", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEncryptor_SetLogger(t *testing.T) {
+	aus := h264Stream()
+
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).Level(zerolog.DebugLevel)
+
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	e.SetLogger(&logger)
+
+	if _, err := e.Encrypt(aus[0]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	events := logEvents(t, &buf)
+	if len(events) != 1 || events[0]["level"] != "debug" {
+		t.Fatalf("Encrypt() logged %v, want one debug event", events)
+	}
+
+	// AUD, SPS, PPS and SEI stay clear, the IDR slice is encrypted
+	event := events[0]
+	if event["nals"] != 5.0 || event["mode"] != "cbcs" {
+		t.Errorf("event = %v, want 5 NAL units in cbcs", event)
+	}
+	if got, _ := json.Marshal(event["encrypted_types"]); string(got) != "[5]" {
+		t.Errorf("encrypted_types = %s, want [5]", got)
+	}
+	if got, _ := json.Marshal(event["clear_types"]); string(got) != "[9,7,8,6]" {
+		t.Errorf("clear_types = %s, want [9,7,8,6]", got)
+	}
+	if sizes, _ := event["nal_sizes"].([]any); len(sizes) != 5 {
+		t.Errorf("nal_sizes = %v, want 5 sizes", event["nal_sizes"])
+	}
+
+	// short slices warn twice: below the threshold and nothing encrypted
+	if _, err := e.Encrypt(aus[3]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	events = logEvents(t, &buf)
+	if len(events) != 3 || events[1]["level"] != "warn" || events[1]["short_nals"] != 2.0 || events[2]["level"] != "warn" {
+		t.Errorf("Encrypt() of short slices logged %v, want a debug and two warn events", events)
+	}
+
+	// in place the same events
+	inPlace, _ := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cenc"})
+	inPlace.SetLogger(&logger)
+	if err := inPlace.EncryptInPlace(bytes.Clone(aus[1])); err != nil {
+		t.Fatalf("EncryptInPlace() returned error: %s", err)
+	}
+	events = logEvents(t, &buf)
+	if len(events) != 1 || events[0]["nals"] != 3.0 {
+		t.Errorf("EncryptInPlace() logged %v, want one event of 3 NAL units", events)
+	}
+
+	// nothing is logged above debug level or without logger
+	info := logger.Level(zerolog.InfoLevel)
+	e.SetLogger(&info)
+	e.Encrypt(aus[3])
+	e.SetLogger(nil)
+	e.Encrypt(aus[3])
+	if buf.Len() != 0 {
+		t.Errorf("Encrypt() logged %s, want nothing", buf.String())
+	}
+}
+
+// BenchmarkEncryptor_logger shows that an encryptor without a logger, or
+// with one above debug level, spends nothing on logging
+func BenchmarkEncryptor_logger(b *testing.B) {
+	info := zerolog.New(io.Discard).Level(zerolog.InfoLevel)
+	debug := zerolog.New(io.Discard).Level(zerolog.DebugLevel)
+
+	benchmarks := []struct {
+		name   string
+		logger *zerolog.Logger
+	}{
+		{"none", nil},
+		{"info", &info},
+		{"debug", &debug},
+	}
+
+	frame := h264Stream()[0]
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			e, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+			if err != nil {
+				b.Fatalf("NewEncryptor() returned error: %s", err)
+			}
+			e.SetLogger(bm.logger)
+
+			var buf []byte
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf, _ = e.EncryptTo(buf, frame)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package drm
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Decryptor reverses the Encryptor configured alike, to verify its output
+// on the server and to inspect recordings without a browser CDM. Access
+// units have to be decrypted in the order they were encrypted, unless they
+// carry a KeySEI naming their per-sample IV.
+type Decryptor struct {
+	mu      sync.Mutex
+	enabled bool
+	codec   nalCodec
+	format  nalFormat
+	state   *cipherState
+
+	shortNALs      string
+	minEncryptSize int
+	encryptTypes   nalTypes
+	headers        *sliceHeaders
+	clearLead      int
+}
+
+// NewDecryptor creates a decryptor from the configuration of an Encryptor
+func NewDecryptor(cfg Config) (*Decryptor, error) {
+	e, err := NewEncryptor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !e.enabled.Load() {
+		return &Decryptor{}, nil
+	}
+
+	return &Decryptor{
+		enabled:        true,
+		codec:          e.codec,
+		format:         e.format.encrypted(),
+		state:          e.state.Load(),
+		shortNALs:      e.shortNALs,
+		minEncryptSize: e.minEncryptSize,
+		encryptTypes:   e.encryptTypes,
+		headers:        e.headers,
+		clearLead:      e.clearLead,
+	}, nil
+}
+
+// Decrypt decrypts an access unit of the Encryptor, NAL units it kept
+// clear are copied as-is. The access unit is in the output format of the
+// Encryptor and stays in it.
+func (d *Decryptor) Decrypt(data []byte) ([]byte, error) {
+	if !d.enabled || len(data) == 0 {
+		return data, nil
+	}
+
+	data, avcc, err := d.format.annexB(data)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.state
+	sampleIV, _ := s.nextSampleIV()
+	if !d.codec.isAudio() {
+		if sei, ok := ParseKeySEI(data); ok && PerSampleIV(sei.IVMode) {
+			sampleIV = sei.SampleIV[:]
+		}
+	}
+
+	if d.codec.isAudio() {
+		out := bytes.Clone(data)
+		s.audioCipher(sampleIV, true).apply(out)
+		return out, nil
+	}
+
+	c := s.rangeCipher(sampleIV, true)
+	cenc := s.mode == "cenc"
+
+	hl := d.codec.headerLen()
+	ranges, err := nalUnits(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	out := append(make([]byte, 0, len(data)), prefix(ranges, data)...)
+	for _, r := range ranges {
+		out = append(out, data[r.offset:r.offset+r.headerLen]...)
+		nalu := r.nalu(data)
+
+		if len(nalu) <= hl || !d.encryptTypes.has(d.codec.nalType(nalu)) {
+			if d.headers != nil && len(nalu) > hl {
+				d.headers.update(nalu)
+			}
+			out = append(out, nalu...)
+			continue
+		}
+
+		// the same ranges as encrypted, the slice header and the tail
+		// from the last non-zero byte on are clear in the ciphertext too
+		rbsp := unescapeRBSP(nalu[hl:])
+		protected := protectedLen(rbsp)
+		header, lead := sliceLead(d.codec, d.headers, d.clearLead, nalu, rbsp)
+
+		switch {
+		case protected < minProtectedSize:
+			if !cenc || d.shortNALs != ShortNALsCTR || header >= protected {
+				out = append(out, nalu...)
+				continue
+			}
+			lead = header
+		case protected < d.minEncryptSize, !cenc && protected-lead < minProtectedSize, lead >= protected:
+			out = append(out, nalu...)
+			continue
+		}
+
+		c.apply(rbsp[lead:protected])
+
+		out = append(out, nalu[:hl]...)
+		out = append(out, escapeRBSP(rbsp)...)
+	}
+
+	if avcc {
+		out, _, err = d.format.toAVCC(nil, out, nil)
+	}
+	return out, err
+}
@@ -0,0 +1,140 @@
+package drm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// h264Stream is a GOP of real H.264 access units: parameter sets with an
+// IDR slice, then P and B slices of various header sizes, filler and short
+// slices
+func h264Stream() [][]byte {
+	params := h264Params{}
+	idr, _ := params.slice(0x65, sliceHeaderCases[0].fields, 1500)
+	p, _ := params.slice(0x41, sliceHeaderCases[1].fields, 600)
+	long, _ := params.slice(0x41, sliceHeaderCases[2].fields, 40)
+	b, _ := params.slice(0x21, sliceHeaderCases[5].fields, 300)
+
+	return [][]byte{
+		bytes.Join([][]byte{nalUnit(0x09, 1), params.sps(), params.pps(), nalUnit(0x06, 20), idr}, nil),
+		bytes.Join([][]byte{nalUnit(0x09, 1), p, long}, nil),
+		bytes.Join([][]byte{b, nalUnit(0x0c, 30)}, nil),
+		shortSliceFrame(2),
+	}
+}
+
+func TestDecryptor_roundTrip(t *testing.T) {
+	hevc := [][]byte{
+		bytes.Join([][]byte{hevcNAL(32, 20), hevcNAL(33, 40), hevcNAL(34, 20), hevcNAL(19, 500)}, nil),
+		hevcNAL(1, 300),
+	}
+
+	var avcc [][]byte
+	for _, frame := range h264Stream() {
+		avcc = append(avcc, lengthPrefixed(frame, 4))
+	}
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		frames [][]byte
+	}{
+		{"cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}, h264Stream()},
+		{"cbcs every block", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 0}, h264Stream()},
+		{"cenc", Config{Mode: "cenc"}, h264Stream()},
+		{"cenc short slices", Config{Mode: "cenc", EncryptShortNALs: ShortNALsCTR}, h264Stream()},
+		{"cens", Config{Mode: "cens", CryptBlocks: 1, SkipBlocks: 9}, h264Stream()},
+		{"cbc1", Config{Mode: "cbc1"}, h264Stream()},
+		{"hevc cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265}, hevc},
+		{"hevc cenc", Config{Mode: "cenc", Codec: CodecH265}, hevc},
+		{"hevc cens", Config{Mode: "cens", CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265}, hevc},
+		{"hevc cbc1", Config{Mode: "cbc1", Codec: CodecH265}, hevc},
+		{"avcc", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, NALFormat: NALFormatAVCC}, avcc},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, tt.cfg)
+
+			cfg := tt.cfg
+			cfg.Enabled = true
+			cfg.KeyID = testKeyID
+			cfg.Key = testKey
+			cfg.IV = testIV
+			cfg.IVNonce = testIVNonce
+			d, err := NewDecryptor(cfg)
+			if err != nil {
+				t.Fatalf("NewDecryptor() returned error: %s", err)
+			}
+
+			for i, frame := range tt.frames {
+				out, err := e.Encrypt(frame)
+				if err != nil {
+					t.Fatalf("frame %d: Encrypt() returned error: %s", i, err)
+				}
+
+				got, err := d.Decrypt(out)
+				if err != nil {
+					t.Fatalf("frame %d: Decrypt() returned error: %s", i, err)
+				}
+				if !bytes.Equal(got, frame) {
+					t.Errorf("frame %d: Decrypt() = %x, want %x", i, got, frame)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptor_keySEI(t *testing.T) {
+	cfg := Config{Mode: "cenc", KeySEI: true}
+	e := newTestEncryptor(t, cfg)
+
+	var encrypted [][]byte
+	for _, frame := range h264Stream() {
+		out, err := e.Encrypt(frame)
+		if err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+		encrypted = append(encrypted, out)
+	}
+
+	cfg.Enabled = true
+	cfg.KeyID = testKeyID
+	cfg.Key = testKey
+	cfg.IV = testIV
+	d, err := NewDecryptor(cfg)
+	if err != nil {
+		t.Fatalf("NewDecryptor() returned error: %s", err)
+	}
+
+	// the per-sample IVs come from the KeySEI, the B frame decrypts
+	// after the P frame before it was dropped
+	for _, i := range []int{0, 2} {
+		got, err := d.Decrypt(encrypted[i])
+		if err != nil {
+			t.Fatalf("frame %d: Decrypt() returned error: %s", i, err)
+		}
+
+		var nalus [][]byte
+		for _, nalu := range parseNALUnits(got) {
+			if _, ok := ParseKeySEINAL(nalu[startCodeLen(nalu):]); !ok {
+				nalus = append(nalus, nalu)
+			}
+		}
+		if got, want := bytes.Join(nalus, nil), h264Stream()[i]; !bytes.Equal(got, want) {
+			t.Errorf("frame %d: Decrypt() = %x, want %x", i, got, want)
+		}
+	}
+}
+
+func TestDecryptor_disabled(t *testing.T) {
+	d, err := NewDecryptor(Config{})
+	if err != nil {
+		t.Fatalf("NewDecryptor() returned error: %s", err)
+	}
+
+	frame := nalUnit(0x65, 100)
+	if got, err := d.Decrypt(frame); err != nil || !bytes.Equal(got, frame) {
+		t.Errorf("Decrypt() = %x, %v, want the access unit unchanged", got, err)
+	}
+}
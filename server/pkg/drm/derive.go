@@ -0,0 +1,39 @@
+package drm
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+// MinMasterSecretSize is the least number of bytes of a master secret
+const MinMasterSecretSize = 16
+
+var ErrMasterSecret = errors.New("master secret must be at least 16 bytes")
+
+// Derive derives the key ID, key and IV of content from a master secret
+// with HKDF-SHA256, the context is the info and tells the keys apart, e.g.
+// the stream ID and date. The same secret and context always derive the
+// same key.
+func Derive(secret []byte, context string) (TrackKey, error) {
+	if len(secret) < MinMasterSecretSize {
+		return TrackKey{}, ErrMasterSecret
+	}
+
+	info := []byte("neko drm content key\x00" + context)
+	okm := hkdfSHA256(secret, nil, info, 48)
+
+	return TrackKey{
+		KeyID: hex.EncodeToString(okm[:16]),
+		Key:   hex.EncodeToString(okm[16:32]),
+		IV:    hex.EncodeToString(okm[32:48]),
+	}, nil
+}
+
+// DeriveHex is Derive of a hex encoded master secret
+func DeriveHex(secret, context string) (TrackKey, error) {
+	b, err := hex.DecodeString(secret)
+	if err != nil {
+		return TrackKey{}, ErrMasterSecret
+	}
+	return Derive(b, context)
+}
@@ -0,0 +1,68 @@
+package drm
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+const testMasterSecret = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestDerive(t *testing.T) {
+	// HKDF-SHA256 computed independently
+	want := TrackKey{
+		KeyID: "effea520cb21518033c69d17e2b7808e",
+		Key:   "46be2bcb2d4ef46303991c437468d858",
+		IV:    "2f0a3e0ed3b0e8d213b1900fa4146ef0",
+	}
+
+	got, err := DeriveHex(testMasterSecret, "stream-1/2026-10-16")
+	if err != nil {
+		t.Fatalf("DeriveHex() returned error: %s", err)
+	}
+	if got != want {
+		t.Errorf("DeriveHex() = %+v, want %+v", got, want)
+	}
+
+	other, _ := DeriveHex(testMasterSecret, "stream-1/2026-10-17")
+	if other.KeyID == got.KeyID || other.Key == got.Key || other.IV == got.IV {
+		t.Errorf("DeriveHex() of another context = %+v, want other values", other)
+	}
+
+	for _, secret := range []string{"", "0001020304050607", "not hex"} {
+		if _, err := DeriveHex(secret, "stream-1"); !errors.Is(err, ErrMasterSecret) {
+			t.Errorf("DeriveHex(%q) error = %v, want %v", secret, err, ErrMasterSecret)
+		}
+	}
+}
+
+func TestNewEncryptor_masterSecret(t *testing.T) {
+	derived, _ := DeriveHex(testMasterSecret, "stream-1")
+
+	e, err := NewEncryptor(Config{Enabled: true, Mode: "cenc", MasterSecret: testMasterSecret, DerivationContext: "stream-1"})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if got := (TrackKey{KeyID: hex.EncodeToString(e.KeyID()), Key: hex.EncodeToString(e.Key()), IV: hex.EncodeToString(e.IV())}); got != derived {
+		t.Errorf("NewEncryptor() key = %+v, want the derived key %+v", got, derived)
+	}
+	if len(e.Warnings()) != 0 {
+		t.Errorf("Warnings() = %q, want none", e.Warnings())
+	}
+
+	// explicit key material wins
+	e, err = NewEncryptor(Config{Enabled: true, Mode: "cenc", KeyID: testKeyID, Key: testKey, IV: testIV, MasterSecret: testMasterSecret})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if hex.EncodeToString(e.KeyID()) != testKeyID || hex.EncodeToString(e.Key()) != testKey {
+		t.Errorf("NewEncryptor() key ID = %x, want the explicit key", e.KeyID())
+	}
+	if len(e.Warnings()) != 1 {
+		t.Errorf("Warnings() = %q, want the master secret ignored", e.Warnings())
+	}
+
+	if _, err := NewEncryptor(Config{Enabled: true, MasterSecret: "0001"}); !errors.Is(err, ErrMasterSecret) {
+		t.Errorf("NewEncryptor() error = %v, want %v", err, ErrMasterSecret)
+	}
+}
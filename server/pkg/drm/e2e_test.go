@@ -0,0 +1,371 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// End-to-end regression gate for the protected pipeline: a synthetic capture
+// source feeds the encryptor, a fake session follows profile signaling and
+// fetches ClearKey licenses, and a client model decrypts every frame.
+
+// fakeSource produces synthetic H.264 access units, an IDR with parameter
+// sets every gop frames and P frames in between
+type fakeSource struct {
+	rnd   *rand.Rand
+	gop   int
+	frame int
+}
+
+func (s *fakeSource) next() (au []byte, idr bool) {
+	idr = s.frame%s.gop == 0
+	s.frame++
+
+	nal := func(header byte, size int) []byte {
+		payload := make([]byte, size)
+		s.rnd.Read(payload)
+		// avoid start code emulation in synthetic payloads
+		for i := range payload {
+			if payload[i] <= 3 {
+				payload[i] = 0xaa
+			}
+		}
+		return append([]byte{0, 0, 0, 1, header}, payload...)
+	}
+
+	if idr {
+		au = append(au, nal(0x67, 12)...) // SPS
+		au = append(au, nal(0x68, 4)...)  // PPS
+		au = append(au, nal(0x65, 500+s.rnd.Intn(2000))...)
+		return au, true
+	}
+
+	// P frames with a few slices of varying size, some below 16 bytes
+	for i := 0; i < 1+s.rnd.Intn(3); i++ {
+		au = append(au, nal(0x41, 5+s.rnd.Intn(300))...)
+	}
+	return au, false
+}
+
+// fakeLicenseServer serves ClearKey licenses for known keys
+type fakeLicenseServer struct {
+	mu   sync.Mutex
+	keys map[string][]byte // hex keyID -> key
+}
+
+func (l *fakeLicenseServer) add(keyID, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k, _ := hex.DecodeString(key)
+	l.keys[keyID] = k
+}
+
+func (l *fakeLicenseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Kids []string `json:"kids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		K   string `json:"k"`
+	}
+	res := struct {
+		Keys []jwk  `json:"keys"`
+		Type string `json:"type"`
+	}{Type: "temporary"}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, kid := range req.Kids {
+		keyID, err := base64.RawURLEncoding.DecodeString(kid)
+		if err != nil {
+			continue
+		}
+		key, ok := l.keys[hex.EncodeToString(keyID)]
+		if !ok {
+			continue
+		}
+		res.Keys = append(res.Keys, jwk{
+			Kty: "oct",
+			Kid: kid,
+			K:   base64.RawURLEncoding.EncodeToString(key),
+		})
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// fakeSession models a connected client: it follows profile signaling,
+// acquires keys from the license server and decrypts delivered frames
+type fakeSession struct {
+	t          *testing.T
+	licenseURL string
+
+	mu      sync.Mutex
+	profile Profile
+	keys    map[string][]byte // hex keyID -> key
+	// parameter sets of the stream, kept by the depacketizer
+	headers *sliceHeaders
+}
+
+func (s *fakeSession) signal(p Profile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.profile = p
+}
+
+func (s *fakeSession) fetchLicense(keyID string) []byte {
+	s.t.Helper()
+
+	s.mu.Lock()
+	if key, ok := s.keys[keyID]; ok {
+		s.mu.Unlock()
+		return key
+	}
+	s.mu.Unlock()
+
+	kid, _ := hex.DecodeString(keyID)
+	body, _ := json.Marshal(map[string]any{
+		"kids": []string{base64.RawURLEncoding.EncodeToString(kid)},
+		"type": "temporary",
+	})
+
+	res, err := http.Post(s.licenseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatalf("license request failed: %s", err)
+	}
+	defer res.Body.Close()
+
+	var license struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&license); err != nil {
+		s.t.Fatalf("license response malformed: %s", err)
+	}
+	if len(license.Keys) != 1 {
+		s.t.Fatalf("license for %s contains %d keys", keyID, len(license.Keys))
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(license.Keys[0].K)
+	if err != nil {
+		s.t.Fatalf("license key malformed: %s", err)
+	}
+
+	s.mu.Lock()
+	s.keys[keyID] = key
+	s.mu.Unlock()
+
+	return key
+}
+
+// reconnect drops all client state and rejoins like a late joiner
+func (s *fakeSession) reconnect(current Profile) {
+	s.mu.Lock()
+	s.keys = map[string][]byte{}
+	s.mu.Unlock()
+
+	s.signal(current)
+}
+
+func (s *fakeSession) decrypt(sample EncryptedSample) []byte {
+	s.t.Helper()
+
+	s.mu.Lock()
+	p := s.profile
+	s.mu.Unlock()
+
+	key := s.fetchLicense(p.KeyID)
+	iv, _ := hex.DecodeString(p.IV)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		s.t.Fatalf("invalid license key: %s", err)
+	}
+
+	return clientDecryptCodec(CodecH264, s.headers, block, sampleIV(iv, sample), p, sample.Data)
+}
+
+// sampleIV returns the IV a client decrypts the sample with, the per-sample
+// IV when there is one
+func sampleIV(iv []byte, sample EncryptedSample) []byte {
+	if sample.IV != nil {
+		return sample.IV
+	}
+	return iv
+}
+
+// clientDecrypt mirrors what the browser side transform does, for access
+// units carrying the parameter sets their slices refer to
+func clientDecrypt(block cipher.Block, iv []byte, p Profile, au []byte) []byte {
+	return clientDecryptCodec(CodecH264, newSliceHeaders(), block, iv, p, au)
+}
+
+// clientDecryptCodec decrypts an access unit of a stream whose parameter
+// sets are followed by headers, nil for H.265
+func clientDecryptCodec(codec nalCodec, headers *sliceHeaders, block cipher.Block, iv []byte, p Profile, au []byte) []byte {
+	out := make([]byte, 0, len(au))
+	// per-sample IVs are followed by the block counter
+	ctr := cipher.NewCTR(block, append(bytes.Clone(iv), make([]byte, 16-len(iv))...))
+	hl := codec.headerLen()
+
+	for _, nalu := range parseNALUnits(au) {
+		sc := startCodeLen(nalu)
+		out = append(out, nalu[:sc]...)
+		nalu = nalu[sc:]
+
+		if len(nalu) <= hl || !codec.isVCL(codec.nalType(nalu)) {
+			if headers != nil && len(nalu) > hl {
+				headers.update(nalu)
+			}
+			out = append(out, nalu...)
+			continue
+		}
+
+		// the RBSP is protected from the first block after the slice
+		// header up to its last non-zero byte
+		rbsp := unescapeRBSP(nalu[hl:])
+		protected := protectedLen(rbsp)
+		lead := DefaultClearLead
+		if headers != nil {
+			if n, ok := headers.size(nalu, rbsp); ok {
+				lead = (n + 15) / 16 * 16
+			}
+		}
+
+		switch {
+		case protected < 16:
+			// short payloads are clear with the default policy
+			out = append(out, nalu...)
+			continue
+		case p.Mode == "cbcs" && protected-lead < 16, lead >= protected:
+			out = append(out, nalu...)
+			continue
+		}
+
+		payload := rbsp[lead:protected]
+		switch {
+		case p.Mode == "cbcs":
+			chain := append([]byte{}, iv...)
+			pattern := p.CryptBlocks + p.SkipBlocks
+			for pos, n := 0, 0; pos+16 <= len(payload); pos, n = pos+16, n+1 {
+				if n%pattern >= p.CryptBlocks {
+					continue
+				}
+				next := append([]byte{}, payload[pos:pos+16]...)
+				cipher.NewCBCDecrypter(block, chain).CryptBlocks(payload[pos:pos+16], payload[pos:pos+16])
+				chain = next
+			}
+		default:
+			ctr.XORKeyStream(payload, payload)
+		}
+
+		out = append(out, nalu[:hl]...)
+		out = append(out, escapeRBSP(rbsp)...)
+	}
+
+	return out
+}
+
+func TestEndToEnd(t *testing.T) {
+	initial := Profile{
+		Mode:        "cbcs",
+		CryptBlocks: 1,
+		SkipBlocks:  9,
+		KeyID:       testKeyID,
+		Key:         testKey,
+		IV:          testIV,
+	}
+	rotated := testProfile
+
+	license := &fakeLicenseServer{keys: map[string][]byte{}}
+	license.add(initial.KeyID, initial.Key)
+	license.add(rotated.KeyID, rotated.Key)
+
+	server := httptest.NewServer(license)
+	defer server.Close()
+
+	e := newTestProfileEncryptor(t, initial, nil)
+
+	session := &fakeSession{
+		t:          t,
+		licenseURL: server.URL,
+		keys:       map[string][]byte{},
+		headers:    newSliceHeaders(),
+	}
+	session.signal(e.Profile())
+
+	var signaled int
+	e.OnUpdate(func(u Update) {
+		signaled++
+		session.signal(u.Profile)
+	})
+
+	source := &fakeSource{rnd: rand.New(rand.NewSource(1)), gop: 10}
+
+	const frames = 60
+	var rotatedAt, encryptedFrames int
+	for i := 0; i < frames; i++ {
+		// rotate mid GOP, the switch must wait for the next IDR
+		if i == 25 {
+			if err := e.ApplyProfile(rotated); err != nil {
+				t.Fatalf("ApplyProfile() returned error: %s", err)
+			}
+		}
+
+		// simulated reconnect after the rotation
+		if i == 45 {
+			session.reconnect(e.Profile())
+		}
+
+		au, idr := source.next()
+		if _, pending := e.PendingProfile(); pending && idr {
+			rotatedAt = i
+		}
+
+		sample, err := e.EncryptSample(au)
+		if err != nil {
+			t.Fatalf("frame %d: EncryptSample() returned error: %s", i, err)
+		}
+		out := sample.Data
+		if len(out) != len(au) {
+			t.Fatalf("frame %d: Encrypt() changed length from %d to %d", i, len(au), len(out))
+		}
+		if !bytes.Equal(out, au) {
+			encryptedFrames++
+		}
+
+		if got := session.decrypt(sample); !bytes.Equal(got, au) {
+			t.Fatalf("frame %d: decrypted frame does not match source", i)
+		}
+	}
+
+	if rotatedAt != 30 {
+		t.Errorf("rotation applied at frame %d, want 30", rotatedAt)
+	}
+	if signaled != 1 {
+		t.Errorf("profile signaled %d times, want 1", signaled)
+	}
+	if encryptedFrames == 0 {
+		t.Errorf("no frame was encrypted")
+	}
+}
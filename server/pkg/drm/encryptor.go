@@ -1,28 +1,201 @@
-// Package drm provides CBCS/CENC encryption for H.264 streams
+// Package drm provides CENC common encryption (cbcs, cenc, cens and cbc1)
+// for H.264 and H.265 streams
 // Compatible with CastLabs rtc-drm-transform browser decryption
 package drm
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultActivationSkew is the default tolerance for activation times that
+// already passed when a profile is scheduled
+const DefaultActivationSkew = 2 * time.Second
+
+// minProtectedSize is the smallest payload that can be protected in every
+// scheme; CBC based schemes only ever encrypt whole 16-byte blocks
+const minProtectedSize = 16
+
+// DefaultMinEncryptSize is the default and smallest Config.MinEncryptSize
+const DefaultMinEncryptSize = minProtectedSize
+
+// Short NAL policies for VCL payloads below minProtectedSize
+const (
+	ShortNALsCTR   = "ctr"   // encrypt short payloads in CTR based schemes
+	ShortNALsClear = "clear" // leave short payloads clear in all schemes
 )
 
-// Encryptor handles CBCS encryption of H.264 NAL units
+// Encryptor handles CBCS encryption of H.264 and H.265 NAL units. It is
+// safe for concurrent use, access units are encrypted without holding the
+// mutex, which only guards staging and switching profiles.
 type Encryptor struct {
-	mu       sync.Mutex
-	enabled  bool
-	keyID    []byte
-	key      []byte
-	iv       []byte
-	block    cipher.Block
-	mode     string // "cbcs" or "cenc"
-
-	// CBCS pattern: encrypt cryptBlocks, skip skipBlocks (typically 1:9)
+	mu      sync.Mutex
+	enabled atomic.Bool
+	codec   nalCodec
+	format  nalFormat
+
+	// parameters frames are currently encrypted with, replaced as a whole
+	state atomic.Pointer[cipherState]
+	// profile staged by ApplyProfile, switched to at the next IDR frame
+	// at or after pendingAt; staged is set while there is one
+	pending   *cipherState
+	pendingAt time.Time
+	staged    atomic.Bool
+	// access units encrypted when the pending profile was staged, and
+	// the last switch to another key, see RotationState
+	pendingFrame uint64
+	rotated      *Rotation
+	// sessions a staged key waits for, see Config.KeyOverlap
+	overlap overlap
+
+	// access units are encrypted while active, SetEnabled toggles it at
+	// the next keyframe to pendingActive; toggling is set until then
+	active        atomic.Bool
+	pendingActive bool
+	toggling      atomic.Bool
+
+	// clock used for scheduled activation
+	now            func() time.Time
+	activationSkew time.Duration
+
+	// handling of VCL payloads shorter than minProtectedSize
+	shortNALs string
+	// VCL payloads shorter than this stay clear, at least minProtectedSize
+	minEncryptSize int
+	// types of the NAL units encrypted, see Config.EncryptNALTypes
+	encryptTypes nalTypes
+
+	// H.264 parameter sets seen so far, nil for other codecs; clearLead
+	// is used when a slice header cannot be parsed
+	headers   *sliceHeaders
+	clearLead int
+
+	// verify key material canary and clear NAL units on every frame
+	paranoid bool
+
+	// scratch space of the calls in progress, see encryption
+	encryptions sync.Pool
+	// goroutines encrypting the NAL units of large cbcs access units
+	parallelism int
+	// encrypts an access unit instead of the mode, replaced by tests
+	encryptAU func(e *encryption, s *cipherState, data []byte) ([]byte, error)
+
+	// prepend a KeySEI to every access unit
+	keySEI bool
+	// prepend the frame header to the ciphertext of EncryptFrame, of the
+	// version of SetWireVersion, FrameHeaderVersion while 0
+	prependFrameHeader bool
+	wireVersion        atomic.Int32
+	// systems of the pssh boxes of InitData
+	psshSystems []psshSystem
+	playReady   PlayReadyConfig
+
+	// strict stream checks, nil when disabled
+	checker *streamChecker
+	// fail access units that would leave VCL data clear
+	strict bool
+	// recent outputs, nil unless Config.RejectReencryption
+	fingerprints *outputFingerprints
+
+	// CBCS patterns have to span 10 blocks
+	strictPattern bool
+	fairPlay      FairPlayConfig
+	// questionable settings accepted by NewEncryptor
+	warnings []string
+
+	// configuration layers are created from, nil without LayerIVs, and
+	// the layers by RID; parent and layerIndex are set on a layer itself
+	layerConfig *Config
+	layers      map[string]*Encryptor
+	parent      *Encryptor
+	layerIndex  int
+
+	// incremented with every transition of state
+	epoch    uint64
+	onUpdate func(Update)
+	onRotate func(Rotation)
+	// observes the time spent encrypting every access unit
+	onEncrypt atomic.Pointer[func(mode string, d time.Duration)]
+	// describes every access unit at debug level, see SetLogger
+	logger atomic.Pointer[zerolog.Logger]
+	// wraps every access unit in a span, see SetTracer
+	tracer atomic.Pointer[trace.Tracer]
+
+	stats statsCounters
+}
+
+// cipherState holds everything a frame is encrypted with, it is only ever
+// replaced as a whole so that a frame never mixes two profiles. It is not
+// modified once in use, concurrent calls derive their cipher modes from it.
+type cipherState struct {
+	keyID []byte
+	key   []byte
+	iv    []byte
+	block cipher.Block
+	mode  string // "cbcs", "cenc", "cens" or "cbc1"
+
+	// IVModeCounter and IVModeDerived derive a fresh IV for every access
+	// unit from iv and the number of samples encrypted so far, shared with
+	// the state it continues; ivCipher derives them in derived mode
+	ivMode   string
+	ivCipher cipher.Block
+	samples  *atomic.Uint64
+	// mixed into the first 8 bytes of iv for the per-sample IVs, drawn for
+	// every key and IV unless configured
+	ivNonce []byte
+
+	// cbcs and cens pattern: encrypt cryptBlocks, skip skipBlocks
+	// (typically 1:9)
 	cryptBlocks int
 	skipBlocks  int
+
+	// key generation, 0 when unknown
+	generation uint64
+	// KeySEI NAL unit and pssh boxes, built on first use
+	built *builtBoxes
+
+	// checksum of key material taken when the state was created
+	canary [32]byte
+}
+
+// builtBoxes caches what is built from the key of a cipherState
+type builtBoxes struct {
+	sei  atomic.Pointer[[]byte]
+	pssh atomic.Pointer[[]byte]
+}
+
+// encryption is the scratch space of encrypting one access unit, taken
+// from the pool of the Encryptor so that concurrent calls share nothing
+// but the counters and the parameter sets seen
+type encryption struct {
+	*Encryptor
+
+	// subsamples of the access unit being encrypted
+	subsamples subsampleMap
+	// NAL units and unescaped payload of the access unit being encrypted
+	ranges []naluRange
+	rbsp   []byte
+	// ranges encrypted by EncryptInPlace, to revert them
+	inPlace [][2]int
+	// NAL units of a large cbcs access unit encrypted in parallel
+	jobs []cbcsJob
+	// clear NAL units verified by paranoid checks, nil otherwise
+	invariants *invariants
+	// counters of the access unit being encrypted, see statsCounters
+	stats *statsShard
 }
 
 // Config holds DRM encryption configuration
@@ -30,41 +203,237 @@ type Config struct {
 	Enabled     bool
 	KeyID       string // hex encoded 16 bytes
 	Key         string // hex encoded 16 bytes
-	IV          string // hex encoded 16 bytes
-	Mode        string // "cbcs" or "cenc"
-	CryptBlocks int    // for CBCS pattern (default 1)
-	SkipBlocks  int    // for CBCS pattern (default 9)
+	IV          string // hex encoded 16 bytes, or 8 with cenc and cens
+	Mode        string // "cbcs" (default), "cenc", "cens" or "cbc1", case insensitive
+	IVMode      string // "constant" with cbcs, "counter" (default) or "derived" with the others, see DeriveSampleIV
+	CryptBlocks int    // for the cbcs and cens pattern (default 1)
+	SkipBlocks  int    // for the cbcs and cens pattern (default 9)
+	Codec       string // "h264" (default), "h265" or "audio"
+
+	// StrictPattern requires the CBCS pattern to span exactly 10 blocks,
+	// as the 1:9 pattern of the specification and most players do
+	StrictPattern bool
+
+	// AutoGenerate fills an empty KeyID, Key or IV with random bytes, for
+	// ephemeral sessions using a fresh key on every start
+	AutoGenerate bool
+
+	// MasterSecret, hex encoded, derives KeyID, Key and IV when none is
+	// given, with the DerivationContext, see Derive
+	MasterSecret      string
+	DerivationContext string
+
+	// Tracks holds separate keys per track label, see EncryptorSet. The
+	// flat KeyID, Key and IV are the video key unless Tracks has one.
+	Tracks map[string]TrackKey
+
+	// ClearTracks are track labels of an EncryptorSet sent clear, their
+	// encryptors are disabled whether or not there is a key for them
+	ClearTracks []string
+
+	// NALFormat of the access units: "annexb" (default) start codes,
+	// "avcc" length fields of NALLengthSize bytes (1, 2 or 4, default 4)
+	// or "auto" to detect it for every access unit
+	NALFormat     string
+	NALLengthSize int
+	// OutputNALFormat of the encrypted access units, "annexb" or "avcc"
+	// with length fields of NALLengthSize bytes, the format of the input
+	// when empty. The subsamples count the start codes or length fields as
+	// clear bytes. Access units of a disabled encryptor pass unchanged.
+	OutputNALFormat string
+
+	// EncryptShortNALs selects how VCL payloads shorter than 16 bytes are
+	// handled: "ctr" (default) to encrypt them in cenc mode or "clear",
+	// cbcs always keeps them clear. The default is clear when
+	// MinEncryptSize keeps them clear anyway.
+	EncryptShortNALs string
+	// MinEncryptSize keeps VCL payloads shorter than this many bytes clear
+	// in every scheme, to save encrypting small slices of little content
+	// (default and at least 16). Above 16 it rules out EncryptShortNALs
+	// ctr, and decryptors finding the protected ranges themselves have to
+	// apply the same threshold.
+	MinEncryptSize int
+
+	// Parallelism is how many goroutines encrypt the NAL units of a cbcs
+	// access unit of at least ParallelMinSize bytes, 0 or 1 encrypts on the
+	// calling goroutine only
+	Parallelism int
+
+	// ClearLead is how many bytes of a VCL payload stay clear when its
+	// slice header cannot be parsed, because the parameter sets were not
+	// seen yet or the codec is H.265 (default 32)
+	ClearLead int
+
+	// ActivationSkew is how far in the past a scheduled activation time
+	// may be and still be accepted as due now (default 2s)
+	ActivationSkew time.Duration
+
+	// Generation of the key, signaled in-band by the KeySEI
+	Generation uint64
+
+	// KeySEI inserts a clear SEI NAL unit naming the key into every access
+	// unit, for consumers that only see the byte stream
+	KeySEI bool
+
+	// EncryptNALTypes are the types of the NAL units encrypted, instead of
+	// the slices (1 to 5 for H.264, 0 to 31 for H.265). Parameter sets are
+	// refused, as is SEI together with KeySEI. Slices of types not listed
+	// stay clear, NAL units of other types listed are encrypted from the
+	// first byte after their header.
+	EncryptNALTypes []int
+
+	// PrependFrameHeader prepends the FrameHeader to the ciphertext of
+	// EncryptFrame, for the rtc-drm-transform decryptor of the browser
+	PrependFrameHeader bool
+
+	// PSSHSystems of the init data, see BuildPSSH (default cenc)
+	PSSHSystems []string
+	// PlayReady header of the playready pssh system
+	PlayReady PlayReadyConfig
+
+	// FairPlay signaling of the key, restricting the profiles to those
+	// FairPlay takes
+	FairPlay FairPlayConfig
+
+	// StrictStreamChecks rejects access units violating the structural
+	// assumptions of the encryptor instead of encrypting them partially
+	StrictStreamChecks bool
+	StreamChecks       StreamCheckConfig
+
+	// Strict fails video access units that would leave VCL data clear
+	// instead of passing them through: without start code, with truncated
+	// NAL units or with slices of which nothing is encrypted, such as
+	// those too short to. The errors are ErrNoStartCode, ErrTruncatedNAL
+	// and ErrNothingEncrypted, for the caller to drop the access unit.
+	Strict bool
+
+	// RejectReencryption fails access units that were encrypted already
+	// with ErrAlreadyEncrypted: any of the last 16 the encryptor emitted,
+	// recognized by a hash of their content, and those carrying a KeySEI.
+	// It guards against frames routed through encryption twice, which
+	// leaves them undecryptable. See also IsLikelyEncrypted.
+	RejectReencryption bool
+
+	// Paranoid keeps a canary checksum of key material and verifies that
+	// it did not change unexpectedly and that NAL units kept clear by
+	// policy leave the encryptor unchanged, failing with ErrInternal
+	Paranoid bool
+
+	// LayerIVs encrypts every video layer of ForLayer with the shared key
+	// and an IV of its own, see LayerIV; without it every layer is
+	// encrypted by the encryptor itself
+	LayerIVs bool
+
+	// IVNonce is mixed into the per-sample IVs of counter and derived
+	// mode, 8 bytes hex encoded and random when empty; a Decryptor
+	// following an encryptor without KeySEI is given its
+	// Encryptor.IVNonce. Keys and IVs switched to later always draw one.
+	IVNonce string
+
+	// SkipSelfTest skips the known answer test of NewEncryptor, which
+	// encrypts a fixed access unit with cbcs and cenc and fails with
+	// ErrSelfTest unless the ciphertext matches a reference implementation
+	SkipSelfTest bool
+
+	// KeyOverlap holds a staged key back for up to this long after its
+	// activation while sessions registered with AddSession have not
+	// acknowledged it with AcknowledgeKey, frames stay encrypted with the
+	// current key meanwhile. The switch happens at the first keyframe
+	// once all of them did or the window ends. 0 switches without waiting,
+	// UpdateKey never waits. It cannot be combined with LayerIVs.
+	KeyOverlap time.Duration
+
+	// TracerProvider traces every access unit encrypted, see SetTracer;
+	// nil leaves encryption untraced
+	TracerProvider trace.TracerProvider
 }
 
 // NewEncryptor creates a new DRM encryptor
 func NewEncryptor(cfg Config) (*Encryptor, error) {
 	if !cfg.Enabled {
-		return &Encryptor{enabled: false}, nil
+		return &Encryptor{}, nil
+	}
+
+	if video, ok := cfg.Tracks[TrackVideo]; ok && cfg.KeyID == "" {
+		cfg.KeyID, cfg.Key, cfg.IV = video.KeyID, video.Key, video.IV
+	}
+
+	var warnings []string
+
+	// explicit key material wins over the master secret
+	if cfg.MasterSecret != "" {
+		if cfg.KeyID != "" || cfg.Key != "" || cfg.IV != "" {
+			warnings = append(warnings, "explicit key material given, the master secret is ignored")
+		} else {
+			derived, err := DeriveHex(cfg.MasterSecret, cfg.DerivationContext)
+			if err != nil {
+				return nil, err
+			}
+			cfg.KeyID, cfg.Key, cfg.IV = derived.KeyID, derived.Key, derived.IV
+		}
+	}
+
+	if cfg.AutoGenerate {
+		for _, field := range []*string{&cfg.KeyID, &cfg.Key, &cfg.IV} {
+			if *field != "" {
+				continue
+			}
+
+			random := make([]byte, 16)
+			if _, err := rand.Read(random); err != nil {
+				return nil, fmt.Errorf("unable to generate key material: %w", err)
+			}
+			*field = hex.EncodeToString(random)
+		}
 	}
 
-	keyID, err := hex.DecodeString(cfg.KeyID)
+	// every invalid option is reported, not only the first one
+	var errs []error
+
+	keyID, err := DecodeKeyBytes(cfg.KeyID)
 	if err != nil || len(keyID) != 16 {
-		return nil, errors.New("keyID must be 16 bytes hex encoded")
+		errs = append(errs, KeyBytesError("keyID", "16", keyID, err))
 	}
 
-	key, err := hex.DecodeString(cfg.Key)
+	key, err := DecodeKeyBytes(cfg.Key)
 	if err != nil || len(key) != 16 {
-		return nil, errors.New("key must be 16 bytes hex encoded")
+		errs = append(errs, KeyBytesError("key", "16", key, err))
 	}
 
-	iv, err := hex.DecodeString(cfg.IV)
-	if err != nil || len(iv) != 16 {
-		return nil, errors.New("iv must be 16 bytes hex encoded")
+	mode := strings.ToLower(cfg.Mode)
+	if mode == "" {
+		mode = "cbcs"
+	}
+	validMode := ValidScheme(mode)
+	if !validMode {
+		errs = append(errs, fmt.Errorf("mode must be cbcs, cenc, cens or cbc1, got %q", cfg.Mode))
 	}
 
-	block, err := aes.NewCipher(key)
+	iv, err := DecodeKeyBytes(cfg.IV)
 	if err != nil {
-		return nil, err
+		size := "16"
+		if CTRScheme(mode) {
+			size = "8 or 16"
+		}
+		errs = append(errs, KeyBytesError("iv", size, nil, err))
+	} else if validMode {
+		errs = append(errs, checkIV(mode, iv))
 	}
 
-	mode := cfg.Mode
-	if mode == "" {
-		mode = "cbcs"
+	ivMode, err := CheckIVMode(mode, strings.ToLower(cfg.IVMode))
+	if validMode {
+		errs = append(errs, err)
+	}
+
+	codec, err := parseCodec(cfg.Codec)
+	errs = append(errs, err)
+
+	switch {
+	case !validMode:
+	case !PatternScheme(mode) && (cfg.CryptBlocks != 0 || cfg.SkipBlocks != 0):
+		warnings = append(warnings, fmt.Sprintf("pattern %d:%d is ignored in %s mode", cfg.CryptBlocks, cfg.SkipBlocks, mode))
+	case PatternScheme(mode) && !codec.isAudio() && cfg.CryptBlocks+cfg.SkipBlocks == 0:
+		warnings = append(warnings, "pattern 0:0 given, every block is encrypted")
 	}
 
 	cryptBlocks := cfg.CryptBlocks
@@ -77,187 +446,1096 @@ func NewEncryptor(cfg Config) (*Encryptor, error) {
 		skipBlocks = 9
 	}
 
-	return &Encryptor{
-		enabled:     true,
+	if PatternScheme(mode) && !codec.isAudio() && cfg.StrictPattern {
+		errs = append(errs, checkStrictPattern(cryptBlocks, skipBlocks))
+	}
+
+	format, err := parseNALFormat(cfg.NALFormat, cfg.NALLengthSize, cfg.OutputNALFormat)
+	errs = append(errs, err)
+
+	// audio samples are encrypted completely, they have no NAL units to
+	// check or to signal the key in
+	if codec.isAudio() {
+		cryptBlocks, skipBlocks = 1, 0
+		format = nalFormat{format: NALFormatAnnexB}
+		cfg.KeySEI = false
+		cfg.StrictStreamChecks = false
+		cfg.Strict = false
+		cfg.Paranoid = false
+		cfg.LayerIVs = false
+		cfg.EncryptNALTypes = nil
+	}
+
+	systems := cfg.PSSHSystems
+	if len(systems) == 0 {
+		systems = []string{PSSHSystemCommon}
+	}
+	psshSystems, err := parsePSSHSystems(systems)
+	errs = append(errs, err)
+
+	shortNALs := cfg.EncryptShortNALs
+	switch {
+	case shortNALs != "":
+	case cfg.MinEncryptSize > minProtectedSize:
+		shortNALs = ShortNALsClear
+	default:
+		shortNALs = ShortNALsCTR
+	}
+	if shortNALs != ShortNALsClear && shortNALs != ShortNALsCTR {
+		errs = append(errs, fmt.Errorf("encrypt short NALs must be clear or ctr, got %q", cfg.EncryptShortNALs))
+	}
+
+	minEncryptSize := cfg.MinEncryptSize
+	switch {
+	case minEncryptSize == 0:
+		minEncryptSize = minProtectedSize
+	case minEncryptSize < minProtectedSize:
+		warnings = append(warnings, fmt.Sprintf("minimum encrypt size %d raised to %d", minEncryptSize, minProtectedSize))
+		minEncryptSize = minProtectedSize
+	case minEncryptSize > minProtectedSize && shortNALs == ShortNALsCTR:
+		errs = append(errs, fmt.Errorf("encrypt short NALs ctr cannot be combined with a minimum encrypt size above %d, got %d", minProtectedSize, minEncryptSize))
+	}
+
+	encryptTypes, err := codec.encryptTypes(cfg.EncryptNALTypes, cfg.KeySEI)
+	errs = append(errs, err)
+
+	if cfg.Parallelism < 0 {
+		errs = append(errs, fmt.Errorf("parallelism must not be negative, got %d", cfg.Parallelism))
+	}
+
+	switch {
+	case cfg.KeyOverlap < 0:
+		errs = append(errs, fmt.Errorf("key overlap must not be negative, got %s", cfg.KeyOverlap))
+	case cfg.KeyOverlap > 0 && cfg.LayerIVs:
+		errs = append(errs, errors.New("key overlap cannot be combined with layer IVs, layers switch on their own"))
+	}
+
+	if err := JoinConfigErrors(errs...); err != nil {
+		return nil, err
+	}
+
+	if !cfg.SkipSelfTest {
+		if err := selfTest(); err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	clearLead := cfg.ClearLead
+	if clearLead <= 0 {
+		clearLead = DefaultClearLead
+	}
+
+	var headers *sliceHeaders
+	if codec == CodecH264 {
+		headers = newSliceHeaders()
+	}
+
+	ivCipher, err := newIVCipher(ivMode, key)
+	if err != nil {
+		return nil, err
+	}
+	ivNonce, err := newIVNonce(ivMode, cfg.IVNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &cipherState{
 		keyID:       keyID,
 		key:         key,
 		iv:          iv,
+		ivMode:      ivMode,
+		ivCipher:    ivCipher,
+		ivNonce:     ivNonce,
 		block:       block,
 		mode:        mode,
 		cryptBlocks: cryptBlocks,
 		skipBlocks:  skipBlocks,
-	}, nil
+		generation:  cfg.Generation,
+		samples:     new(atomic.Uint64),
+		built:       &builtBoxes{},
+	}
+	state.canary = state.checksum()
+
+	if err := checkPlayReady(psshSystems, state); err != nil {
+		return nil, err
+	}
+
+	if cfg.FairPlay.Enabled() {
+		if err := cfg.FairPlay.validate(); err != nil {
+			return nil, err
+		}
+		if err := checkFairPlay(state, codec.isAudio()); err != nil {
+			return nil, err
+		}
+	}
+
+	activationSkew := cfg.ActivationSkew
+	if activationSkew <= 0 {
+		activationSkew = DefaultActivationSkew
+	}
+
+	var checker *streamChecker
+	if cfg.StrictStreamChecks {
+		checker = newStreamChecker(codec, cfg.StreamChecks)
+	}
+
+	e := &Encryptor{
+		codec:          codec,
+		format:         format,
+		shortNALs:      shortNALs,
+		encryptTypes:   encryptTypes,
+		minEncryptSize: minEncryptSize,
+		headers:        headers,
+		clearLead:      clearLead,
+		now:            time.Now,
+		activationSkew: activationSkew,
+		paranoid:       cfg.Paranoid,
+		keySEI:         cfg.KeySEI,
+		psshSystems:    psshSystems,
+		playReady:      cfg.PlayReady,
+		checker:        checker,
+		strict:         cfg.Strict,
+		strictPattern:  cfg.StrictPattern && !codec.isAudio(),
+		fairPlay:       cfg.FairPlay,
+		parallelism:    cfg.Parallelism,
+		overlap:        overlap{window: cfg.KeyOverlap},
+		warnings:       warnings,
+		epoch:          1,
+
+		prependFrameHeader: cfg.PrependFrameHeader,
+	}
+	if cfg.RejectReencryption {
+		e.fingerprints = newOutputFingerprints()
+	}
+	if cfg.LayerIVs {
+		e.layerConfig = layerConfig(cfg)
+	}
+	e.SetTracer(cfg.TracerProvider)
+	e.enabled.Store(true)
+	e.active.Store(true)
+	e.state.Store(state)
+	return e, nil
 }
 
-// Enabled returns whether encryption is active
+// checkStrictPattern rejects CBCS patterns not spanning 10 blocks
+func checkStrictPattern(cryptBlocks, skipBlocks int) error {
+	if cryptBlocks+skipBlocks != 10 {
+		return fmt.Errorf("%w: strict pattern must span 10 blocks, got %d:%d", ErrInvalidProfile, cryptBlocks, skipBlocks)
+	}
+	return nil
+}
+
+// Warnings returns the questionable but accepted settings of the
+// configuration, for the caller to log
+func (e *Encryptor) Warnings() []string {
+	return e.warnings
+}
+
+// Enabled returns whether encryption is active, false once closed
 func (e *Encryptor) Enabled() bool {
-	return e.enabled
+	return e.enabled.Load()
 }
 
-// KeyID returns the key ID for license requests
+// Close disables the encryptor and overwrites the key ID, key and IV of
+// the current and a staged profile with zeros, the AES ciphers holding the
+// expanded keys are dropped. Afterwards the encryptor behaves as a disabled
+// one: access units pass through unmodified and no key material is
+// returned. Close must only be called once nothing encrypts with the
+// encryptor anymore, calls in progress would see the key vanish; with
+// Config.Paranoid they fail with ErrInternal. Closing twice does nothing.
+func (e *Encryptor) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.enabled.Swap(false) {
+		return
+	}
+
+	e.state.Swap(nil).zeroize()
+	if e.pending != nil {
+		e.pending.zeroize()
+		e.pending = nil
+		e.staged.Store(false)
+	}
+
+	for _, layer := range e.layers {
+		layer.Close()
+	}
+}
+
+// KeyID returns a copy of the key ID for license requests
 func (e *Encryptor) KeyID() []byte {
-	return e.keyID
+	s := e.state.Load()
+	if s == nil {
+		return nil
+	}
+	return bytes.Clone(s.keyID)
+}
+
+// KeyIDHex returns the key ID as lowercase hex, empty when disabled
+func (e *Encryptor) KeyIDHex() string {
+	s := e.state.Load()
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.keyID)
+}
+
+// KeyIDUUID returns the key ID as a hyphenated UUID, the form of the DASH
+// cenc:default_KID, empty when disabled
+func (e *Encryptor) KeyIDUUID() string {
+	s := e.state.Load()
+	if s == nil {
+		return ""
+	}
+	return UUIDString(s.keyID)
+}
+
+// InitData returns the pssh boxes announcing the current key ID for EME,
+// they are rebuilt once the key changes
+func (e *Encryptor) InitData() ([]byte, error) {
+	return e.initData(e.state.Load())
 }
 
-// IV returns the initialization vector
+// initData returns the pssh boxes of the key of a state, nil for none
+func (e *Encryptor) initData(s *cipherState) ([]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	// concurrent callers may both build it, the boxes are identical
+	if pssh := s.built.pssh.Load(); pssh != nil {
+		return bytes.Clone(*pssh), nil
+	}
+	pssh, err := buildPSSH(e.psshSystems, [][]byte{s.keyID}, e.psshOptions(s))
+	if err != nil {
+		return nil, err
+	}
+	s.built.pssh.Store(&pssh)
+	return bytes.Clone(pssh), nil
+}
+
+// Key returns a copy of the content key, only to be delivered to
+// authorized clients by the license layer
+func (e *Encryptor) Key() []byte {
+	s := e.state.Load()
+	if s == nil {
+		return nil
+	}
+	return bytes.Clone(s.key)
+}
+
+// IV returns a copy of the initialization vector
 func (e *Encryptor) IV() []byte {
-	return e.iv
+	s := e.state.Load()
+	if s == nil {
+		return nil
+	}
+	return bytes.Clone(s.iv)
+}
+
+// IVHex returns the initialization vector as lowercase hex, empty when
+// disabled
+func (e *Encryptor) IVHex() string {
+	s := e.state.Load()
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.iv)
+}
+
+// Codec returns "h264" or "h265", empty when disabled
+func (e *Encryptor) Codec() string {
+	return string(e.codec)
 }
 
-// Mode returns "cbcs" or "cenc"
+// Mode returns "cbcs", "cenc", "cens" or "cbc1"
 func (e *Encryptor) Mode() string {
-	return e.mode
+	s := e.state.Load()
+	if s == nil {
+		return ""
+	}
+	return s.mode
 }
 
-// Encrypt encrypts H.264 NAL units using CBCS pattern encryption
-// Input: raw H.264 access unit (may contain multiple NAL units)
-// Output: encrypted H.264 access unit
+// OnEncrypt sets a listener called with the mode and the time spent after
+// every encrypted access unit, for latency metrics; it has to be cheap
+func (e *Encryptor) OnEncrypt(listener func(mode string, d time.Duration)) {
+	if listener == nil {
+		e.onEncrypt.Store(nil)
+		return
+	}
+	e.onEncrypt.Store(&listener)
+}
+
+// Encrypt encrypts H.264 or H.265 NAL units using CBCS pattern encryption,
+// or a whole audio sample with CodecAudio
+// Input: raw access unit of the configured codec and NAL format (may contain multiple NAL units)
+// Output: encrypted access unit in the format of the input, or Config.OutputNALFormat
+// NAL units or output that do not add up to the input fail with
+// ErrInternal instead of returning a corrupted access unit.
 func (e *Encryptor) Encrypt(data []byte) ([]byte, error) {
-	if !e.enabled || len(data) == 0 {
-		return data, nil
+	sample, err := e.EncryptSample(data)
+	return sample.Data, err
+}
+
+// EncryptedSample is an encrypted access unit with its subsamples, the
+// protected ranges carry emulation prevention bytes (SampleParams.Escaped).
+// The subsamples cover every byte of Data, NAL units that stay clear (also
+// those too short to encrypt) are part of the clear bytes.
+type EncryptedSample struct {
+	Data       []byte
+	Subsamples []SubsampleInfo
+	// per-sample IV in counter and derived mode, 8 bytes with cenc and
+	// cens followed by a block counter starting at zero, 16 bytes with
+	// cbc1; nil when the constant IV of the profile was used
+	IV []byte
+	// Index of the per-sample IV, counting the access units encrypted with
+	// the key and IV, see Encryptor.SampleIV; zero with the constant IV
+	Index uint64
+
+	// constant IV of the profile the sample was encrypted with
+	constantIV []byte
+	// state the sample was encrypted with, nil for clear samples
+	state *cipherState
+}
+
+// Profile returns the profile the sample was encrypted with, without the
+// key, and false for samples left clear
+func (s EncryptedSample) Profile() (Profile, bool) {
+	if s.state == nil {
+		return Profile{}, false
+	}
+	return s.state.profile(), true
+}
+
+// EncryptSample encrypts like Encrypt and returns the subsamples and IV
+// for packaging and signaling the access unit
+func (e *Encryptor) EncryptSample(data []byte) (EncryptedSample, error) {
+	return e.encryptSample(nil, data, keyframeDetect)
+}
+
+// EncryptTo encrypts like Encrypt into the storage of dst, its content is
+// overwritten; see BufferPool for reusing destination buffers across access
+// units. The ciphertext is backed by dst, or by a larger buffer when dst
+// is too small, and stays valid until the caller reuses that buffer, the
+// encryptor keeps no reference to it. dst must not overlap src.
+func (e *Encryptor) EncryptTo(dst, src []byte) ([]byte, error) {
+	if !e.enabled.Load() {
+		return append(dst[:0], src...), nil
+	}
+
+	sample, err := e.encryptSample(dst, src, keyframeDetect)
+	return sample.Data, err
+}
+
+// encryptSample encrypts an access unit into the storage of dst, a new
+// buffer when nil, in a span with SetTracer
+func (e *Encryptor) encryptSample(dst, data []byte, keyframe keyframeSignal) (EncryptedSample, error) {
+	if tracer := e.tracer.Load(); tracer != nil {
+		return e.encryptSampleTraced(*tracer, dst, data, keyframe)
+	}
+	return e.encryptAccessUnit(dst, data, keyframe)
+}
+
+// encryptAccessUnit is encryptSample without tracing
+func (e *Encryptor) encryptAccessUnit(dst, data []byte, keyframe keyframeSignal) (EncryptedSample, error) {
+	p, sample, err := e.prepareSample(dst, data, keyframe)
+	if p == nil {
+		return sample, err
+	}
+	return e.encryptPrepared(dst, p)
+}
+
+// preparedSample is an access unit taken through the steps of
+// encryptSample that depend on the order of the stream: it was checked,
+// a staged profile switched to and its sample IV taken
+type preparedSample struct {
+	enc   *encryption
+	input []byte
+	// Annex B access unit, the key SEI is not inserted yet
+	data []byte
+	avcc bool
+	vcl  bool
+
+	s           *cipherState
+	sampleIV    []byte
+	sampleIndex uint64
+}
+
+// prepareSample runs the ordered steps of encryptSample. A nil
+// preparedSample comes with the final sample or error of access units left
+// clear or rejected; the others are finished by encryptPrepared, which may
+// run concurrently for consecutive access units.
+func (e *Encryptor) prepareSample(dst, data []byte, keyframe keyframeSignal) (*preparedSample, EncryptedSample, error) {
+	if !e.enabled.Load() || len(data) == 0 {
+		var clear subsampleMap
+		return nil, EncryptedSample{Data: data, Subsamples: clear.finish(len(data))}, nil
+	}
+
+	// paused without a pending toggle, nothing to check either
+	if !e.active.Load() && !e.toggling.Load() {
+		sample, err := e.passThrough(dst, data)
+		return nil, sample, err
+	}
+
+	input := data
+
+	// length prefixed access units are encrypted as byte stream
+	data, avcc, err := e.format.annexB(data)
+	if err != nil {
+		e.stats.add(countError)
+		return nil, EncryptedSample{}, err
+	}
+
+	if err := e.checkReencryption(input, data); err != nil {
+		e.stats.add(countStrictRejection)
+		return nil, EncryptedSample{}, err
+	}
+
+	// rejected before a staged profile could be switched to
+	if e.checker != nil {
+		if err := e.checker.check(data); err != nil {
+			e.stats.add(countStreamViolation)
+			return nil, EncryptedSample{}, err
+		}
+	}
+
+	enc := e.encryption()
+
+	// the key SEI inserted later is no VCL data
+	var vcl bool
+	if e.strict {
+		if vcl, err = enc.checkStrict(data); err != nil {
+			e.encryptions.Put(enc)
+			e.stats.add(countStrictRejection)
+			return nil, EncryptedSample{}, err
+		}
+	}
+
+	// staged profile takes effect at IDR so the whole GOP uses it
+	e.switchIfDue(data, keyframe)
+	if !e.active.Load() {
+		e.encryptions.Put(enc)
+		sample, err := e.passThrough(dst, input)
+		return nil, sample, err
+	}
+
+	// a state zeroed by Close since the checks above is no state at all
+	s := e.state.Load()
+	if s == nil || e.paranoid {
+		if err := s.verifyCanary(); err != nil {
+			e.encryptions.Put(enc)
+			e.stats.add(countInternalError)
+			return nil, EncryptedSample{}, err
+		}
+	}
+
+	sampleIV, sampleIndex := s.nextSampleIV()
+	return &preparedSample{
+		enc:         enc,
+		input:       input,
+		data:        data,
+		avcc:        avcc,
+		vcl:         vcl,
+		s:           s,
+		sampleIV:    sampleIV,
+		sampleIndex: sampleIndex,
+	}, EncryptedSample{}, nil
+}
+
+// encryptPrepared encrypts an access unit of prepareSample into the
+// storage of dst, a new buffer when nil
+func (e *Encryptor) encryptPrepared(dst []byte, p *preparedSample) (EncryptedSample, error) {
+	enc, s, sampleIV, data := p.enc, p.s, p.sampleIV, p.data
+	defer e.encryptions.Put(enc)
+
+	// the access unit is counted into a single shard, left before calling
+	// out to listeners
+	enc.stats = e.stats.enter()
+
+	start := time.Now()
+
+	orig := data
+	if enc.invariants != nil {
+		enc.invariants.reset()
+	}
+
+	// SEI is not VCL and stays clear
+	if e.keySEI {
+		sei := s.keySEI(e.codec, sampleIV)
+
+		var pos int
+		data, pos = e.codec.insertBeforeVCL(data, sei)
+		enc.stats.overheadBytes.Add(uint64(len(sei)))
+
+		if enc.invariants != nil {
+			enc.invariants.insert(pos, sei)
+		}
+	}
+
+	enc.subsamples.reset()
+	enc.ranges = enc.ranges[:0]
+
+	// length prefixed access units are converted into dst afterwards
+	avcc := e.format.outputAVCC(p.avcc)
+	encryptDst := dst
+	if avcc {
+		encryptDst = nil
+	}
+
+	var out []byte
+	var err error
+	switch {
+	case e.encryptAU != nil:
+		out, err = e.encryptAU(enc, s, data)
+	case e.codec.isAudio():
+		out = enc.encryptAudio(encryptDst, s, sampleIV, data)
+	case s.mode == "cenc":
+		out, err = enc.encryptCENC(encryptDst, s, sampleIV, data)
+	default:
+		out, err = enc.encryptBlocks(encryptDst, s, sampleIV, data)
+	}
+
+	if err == nil && enc.invariants != nil {
+		err = enc.invariants.verify(orig, out)
+	}
+	// nor was the key zeroed while encrypting
+	if err == nil && e.paranoid {
+		err = s.verifyCanary()
+	}
+	if errors.Is(err, ErrInternal) {
+		enc.stats.internalErrors.Add(1)
+		out = nil
+	}
+
+	if err == nil && p.vcl && enc.subsamples.protected == 0 {
+		enc.stats.strictRejections.Add(1)
+		s.returnSampleIV(sampleIV, p.sampleIndex)
+		out, err = nil, ErrNothingEncrypted
+	}
+
+	elapsed := time.Since(start)
+	e.stats.encrypted(enc.stats, elapsed)
+
+	var subsamples []SubsampleInfo
+	if out != nil {
+		subsamples = enc.subsamples.finish(len(out))
+		if logger := e.debugLogger(); logger != nil {
+			e.logAccessUnit(logger, s.mode, out, protectedRanges(subsamples))
+		}
+		if avcc {
+			out, subsamples, err = e.format.toAVCC(dst, out, subsamples)
+		}
+	}
+	if err == nil && e.fingerprints != nil {
+		e.fingerprints.record(out)
+	}
+
+	enc.stats.processed.Add(1)
+	if err != nil {
+		enc.stats.errors.Add(1)
+	} else {
+		units := len(enc.ranges)
+		if e.codec.isAudio() {
+			units = 1
+		}
+		enc.stats.encrypted.Add(1)
+		enc.stats.nalsEncrypted.Add(uint64(enc.subsamples.protected))
+		enc.stats.nalsClear.Add(uint64(max(units-enc.subsamples.protected, 0)))
+		enc.stats.bytesIn.Add(uint64(len(p.input)))
+		enc.stats.bytesOut.Add(uint64(len(out)))
+		enc.stats.bytesEncrypted.Add(protectedSize(subsamples))
+	}
+	enc.stats.leave()
+	enc.stats = nil
+
+	if onEncrypt := e.onEncrypt.Load(); onEncrypt != nil {
+		(*onEncrypt)(s.mode, elapsed)
+	}
+
+	sample := EncryptedSample{Data: out, Subsamples: subsamples, IV: sampleIV, Index: p.sampleIndex, state: s}
+	if sampleIV == nil {
+		sample.constantIV = s.iv
+	}
+	return sample, err
+}
+
+// encryption returns scratch space for encrypting an access unit, to be
+// put back into e.encryptions once its buffers are no longer referenced
+func (e *Encryptor) encryption() *encryption {
+	if enc, ok := e.encryptions.Get().(*encryption); ok {
+		return enc
+	}
+
+	enc := &encryption{Encryptor: e}
+	if e.paranoid {
+		enc.invariants = &invariants{}
+	}
+	return enc
+}
+
+// switchIfDue switches to the staged profile when the access unit is a
+// keyframe, or the caller says it is, and the activation time has come.
+// A pending SetEnabled takes effect at the same keyframe. The mutex is
+// only taken while a profile or toggle is staged.
+func (e *Encryptor) switchIfDue(data []byte, keyframe keyframeSignal) {
+	if !e.staged.Load() && !e.toggling.Load() {
+		return
+	}
+	if !keyframe.is(e.codec, data) {
+		return
 	}
 
 	e.mu.Lock()
-	defer e.mu.Unlock()
+	var update *Update
+	var rotation *Rotation
+	switched := false
+	if e.pending != nil && !e.now().Before(e.pendingAt) && !e.holds() {
+		old := e.state.Load()
+		update = e.switchTo(e.pending)
+		rotation = e.rotationFrom(old, update)
+		e.stage(nil, time.Time{})
+		switched = true
+	}
+	if e.toggling.Load() {
+		update = e.toggle(update)
+		switched = true
+	}
+	onUpdate, onRotate := e.onUpdate, e.onRotate
+	e.mu.Unlock()
 
-	if e.mode == "cbcs" {
-		return e.encryptCBCS(data)
+	if update != nil && onUpdate != nil {
+		onUpdate(*update)
+	}
+	if rotation != nil && onRotate != nil {
+		onRotate(*rotation)
+	}
+
+	// the parent may never see a keyframe when only its layers encrypt, it
+	// follows the first of them to switch and reports the update
+	if switched && e.parent != nil {
+		e.parent.switchIfDue(nil, keyframeSignaled)
+	}
+}
+
+// stage sets the profile switched to at the first keyframe at or after
+// activateAt, nil discards it; e.mu is held. Its overlap window begins.
+func (e *Encryptor) stage(s *cipherState, activateAt time.Time) {
+	e.pending, e.pendingAt = s, activateAt
+	e.staged.Store(s != nil)
+	if s != nil {
+		e.pendingFrame = e.stats.position.Load()
+		e.overlap.start(e.now(), activateAt)
 	}
-	return e.encryptCENC(data)
 }
 
-// encryptCBCS implements CBCS (AES-CBC with pattern) encryption
-// Pattern: encrypt cryptBlocks of 16 bytes, skip skipBlocks of 16 bytes
-func (e *Encryptor) encryptCBCS(data []byte) ([]byte, error) {
+// encryptBlocks implements the schemes protecting whole 16-byte blocks,
+// cbcs and cens with their pattern and cbc1, into the storage of dst, a
+// new buffer when nil. The per-sample IV is nil in constant IV mode.
+func (e *encryption) encryptBlocks(dst []byte, s *cipherState, sampleIV, data []byte) ([]byte, error) {
 	// Find NAL units and encrypt their payloads
-	nalus := parseNALUnits(data)
-	result := make([]byte, 0, len(data))
+	var err error
+	if e.ranges, err = nalUnits(e.ranges[:0], data); err != nil {
+		return nil, err
+	}
+
+	// only the ranges of cbcs are independent of each other
+	if s.mode == "cbcs" && e.parallelism > 1 && len(data) >= ParallelMinSize {
+		return e.encryptCBCSParallel(dst, s, data)
+	}
 
-	for _, nalu := range nalus {
-		if len(nalu) < 2 {
+	result := slices.Grow(dst[:0], outputSize(len(data)))
+	result = append(result, prefix(e.ranges, data)...)
+	c := s.rangeCipher(sampleIV, false)
+	var escaped int
+
+	for _, r := range e.ranges {
+		// start codes are copied as-is
+		result = append(result, data[r.offset:r.offset+r.headerLen]...)
+		nalu := r.nalu(data)
+
+		// NAL unit header is first byte (or first 2 bytes for H.265)
+		// Keep header clear, encrypt payload with pattern
+		hl := e.codec.headerLen()
+		if len(nalu) <= hl {
+			e.keepClear(data, nalu, len(result))
 			result = append(result, nalu...)
 			continue
 		}
 
-		// NAL unit header is first byte (or first 2 bytes for H.265)
-		// Keep header clear, encrypt payload with pattern
-		header := nalu[0]
-		nalType := header & 0x1F
-
-		// Only encrypt VCL NAL units (1-5 for H.264)
-		if nalType >= 1 && nalType <= 5 && len(nalu) > 1 {
-			encrypted := e.encryptWithPattern(nalu[1:])
-			result = append(result, header)
-			result = append(result, encrypted...)
+		// Only encrypt VCL NAL units (1-5 for H.264, 0-31 for H.265)
+		if e.encrypts(e.codec.nalType(nalu)) {
+			rbsp, protected := e.protectedRBSP(nalu[hl:])
+
+			// CBC can't protect partial blocks, short payloads stay clear
+			if protected < minProtectedSize {
+				e.stats.shortNALs.Add(1)
+			}
+			if protected < e.minEncryptSize {
+				e.keepClear(data, nalu, len(result))
+				result = append(result, nalu...)
+				continue
+			}
+
+			// the pattern starts at the first block after the slice header
+			_, lead := e.sliceLead(nalu, rbsp)
+			if protected-lead < minProtectedSize {
+				e.keepClear(data, nalu, len(result))
+				result = append(result, nalu...)
+				continue
+			}
+
+			c.apply(rbsp[lead:protected])
+			start := len(result)
+			result = append(result, nalu[:hl]...)
+			result = e.appendProtected(result, rbsp[:lead], rbsp[lead:protected], rbsp[protected:])
+			escaped += len(result) - start - len(nalu)
 		} else {
+			e.observe(nalu)
+			e.keepClear(data, nalu, len(result))
 			result = append(result, nalu...)
 		}
 	}
 
-	return result, nil
+	return result, checkOutputSize(len(data), len(result), escaped)
+}
+
+// outputSize is the capacity of the output buffer for an access unit of
+// size bytes, with room for the emulation prevention bytes of ciphertext
+// emulating start codes, about one per 2^21 random bytes
+func outputSize(size int) int {
+	return size + size>>10 + 16
 }
 
-// encryptWithPattern applies CBCS pattern encryption
-func (e *Encryptor) encryptWithPattern(data []byte) []byte {
-	if len(data) < 16 {
-		return data // Too small to encrypt
+// protectedRBSP removes the emulation prevention bytes of a VCL payload,
+// ciphertext is escaped anew. The RBSP is valid until the next call and
+// may be encrypted in place.
+func (e *encryption) protectedRBSP(payload []byte) (rbsp []byte, protected int) {
+	e.rbsp = appendUnescaped(e.rbsp[:0], payload, 0)
+	return e.rbsp, protectedLen(e.rbsp)
+}
+
+// protectedLen returns how much of an RBSP may be protected. Everything
+// from the last non-zero byte on, the stop bit and cabac_zero_words, stays
+// clear so that the NAL unit never ends in ciphertext.
+func protectedLen(rbsp []byte) int {
+	protected := len(rbsp) - 1
+	for protected > 0 && rbsp[protected] == 0 {
+		protected--
 	}
+	return max(protected, 0)
+}
 
-	result := make([]byte, len(data))
-	copy(result, data)
+// appendProtected appends the clear lead of a payload, its encrypted part
+// and its clear tail with emulation prevention bytes, ciphertext may
+// emulate start codes. The escaped ciphertext is one protected subsample,
+// emulation prevention bytes at its boundaries belong to it.
+func (e *encryption) appendProtected(dst, lead, encrypted, tail []byte) []byte {
+	start := len(dst)
 
-	blockSize := 16
-	pattern := e.cryptBlocks + e.skipBlocks
-	iv := make([]byte, 16)
-	copy(iv, e.iv)
+	// the NAL unit header before the lead is never zero
+	dst, zeros := appendEscaped(dst, lead, 0)
+	pos := len(dst)
+	dst, zeros = appendEscaped(dst, encrypted, zeros)
+	if zeros >= 2 && tail[0] <= 3 {
+		dst = append(dst, 3)
+	}
+	e.subsamples.protect(pos, len(dst)-pos)
+
+	// the tail starts with a non-zero byte
+	dst, zeros = appendEscaped(dst, tail, 0)
+	if zeros >= 2 {
+		dst = append(dst, 3)
+	}
+	e.stats.emulationPrevention.Add(uint64(len(dst) - start - len(lead) - len(encrypted) - len(tail)))
+	return dst
+}
 
-	pos := 0
-	blockNum := 0
+// sliceLead returns how many bytes at the start of a VCL payload belong to
+// the slice header and how many stay clear, the header rounded up to whole
+// blocks
+func (e *Encryptor) sliceLead(nalu, rbsp []byte) (header, lead int) {
+	return sliceLead(e.codec, e.headers, e.clearLead, nalu, rbsp)
+}
 
-	for pos+blockSize <= len(data) {
-		patternPos := blockNum % pattern
+// sliceLead is Encryptor.sliceLead with the parameter sets of headers,
+// which may be nil, and a fallback of clearLead bytes. NAL units other
+// than slices have no header to keep clear.
+func sliceLead(codec nalCodec, headers *sliceHeaders, clearLead int, nalu, rbsp []byte) (header, lead int) {
+	if !codec.isVCL(codec.nalType(nalu)) {
+		return 0, 0
+	}
 
-		if patternPos < e.cryptBlocks {
-			// Encrypt this block using CBC
-			mode := cipher.NewCBCEncrypter(e.block, iv)
-			mode.CryptBlocks(result[pos:pos+blockSize], data[pos:pos+blockSize])
-			// Update IV for next encrypted block
-			copy(iv, result[pos:pos+blockSize])
+	header = clearLead
+	if headers != nil {
+		if n, ok := headers.size(nalu, rbsp); ok {
+			header = n
 		}
-		// Skip blocks are left as-is
+	}
+	return header, (header + 15) / 16 * 16
+}
 
-		pos += blockSize
-		blockNum++
+// encrypts reports whether NAL units of the type are encrypted
+func (e *Encryptor) encrypts(nalType byte) bool {
+	return e.encryptTypes.has(nalType)
+}
+
+// observe keeps track of the parameter sets slice headers refer to
+func (e *Encryptor) observe(nalu []byte) {
+	if e.headers != nil {
+		e.headers.update(nalu)
 	}
+}
 
-	return result
+// keepClear records a NAL unit kept clear by policy for the paranoid
+// checks, dst is its offset in the output
+func (e *encryption) keepClear(au, nalu []byte, dst int) {
+	if e.invariants != nil {
+		e.invariants.keep(au, nalu, dst)
+	}
 }
 
-// encryptCENC implements CENC (AES-CTR) encryption
-func (e *Encryptor) encryptCENC(data []byte) ([]byte, error) {
-	// CENC uses AES-CTR mode
-	nalus := parseNALUnits(data)
-	result := make([]byte, 0, len(data))
+// encryptCENC implements CENC (AES-CTR) encryption into the storage of dst
+// like encryptBlocks, with the per-sample IV unless it is nil
+func (e *encryption) encryptCENC(dst []byte, s *cipherState, sampleIV, data []byte) ([]byte, error) {
+	// CENC uses AES-CTR mode, the counter runs across all protected
+	// ranges of the access unit as in ISO/IEC 23001-7
+	var err error
+	if e.ranges, err = nalUnits(e.ranges[:0], data); err != nil {
+		return nil, err
+	}
+
+	result := slices.Grow(dst[:0], outputSize(len(data)))
+	result = append(result, prefix(e.ranges, data)...)
+	ctr := cipher.NewCTR(s.block, s.ctrIV(sampleIV))
+	var escaped int
 
-	for _, nalu := range nalus {
-		if len(nalu) < 2 {
+	for _, r := range e.ranges {
+		result = append(result, data[r.offset:r.offset+r.headerLen]...)
+		nalu := r.nalu(data)
+
+		hl := e.codec.headerLen()
+		if len(nalu) <= hl {
+			e.keepClear(data, nalu, len(result))
 			result = append(result, nalu...)
 			continue
 		}
 
-		header := nalu[0]
-		nalType := header & 0x1F
-
 		// Only encrypt VCL NAL units
-		if nalType >= 1 && nalType <= 5 && len(nalu) > 1 {
-			ctr := cipher.NewCTR(e.block, e.iv)
-			encrypted := make([]byte, len(nalu)-1)
-			ctr.XORKeyStream(encrypted, nalu[1:])
-			result = append(result, header)
-			result = append(result, encrypted...)
+		if e.encrypts(e.codec.nalType(nalu)) {
+			rbsp, protected := e.protectedRBSP(nalu[hl:])
+			header, lead := e.sliceLead(nalu, rbsp)
+
+			// CTR has no block size constraint, short payloads are
+			// encrypted only when explicitly requested and then right
+			// after the slice header
+			if protected < minProtectedSize {
+				e.stats.shortNALs.Add(1)
+				if e.shortNALs != ShortNALsCTR || header >= protected {
+					e.keepClear(data, nalu, len(result))
+					result = append(result, nalu...)
+					continue
+				}
+				e.stats.shortNALsEncrypted.Add(1)
+				lead = header
+			} else if lead >= protected || protected < e.minEncryptSize {
+				e.keepClear(data, nalu, len(result))
+				result = append(result, nalu...)
+				continue
+			}
+
+			ctr.XORKeyStream(rbsp[lead:protected], rbsp[lead:protected])
+			start := len(result)
+			result = append(result, nalu[:hl]...)
+			result = e.appendProtected(result, rbsp[:lead], rbsp[lead:protected], rbsp[protected:])
+			escaped += len(result) - start - len(nalu)
 		} else {
+			e.observe(nalu)
+			e.keepClear(data, nalu, len(result))
 			result = append(result, nalu...)
 		}
 	}
 
-	return result, nil
+	return result, checkOutputSize(len(data), len(result), escaped)
 }
 
-// parseNALUnits finds NAL unit boundaries in H.264 byte stream
-// Looks for start codes: 0x000001 or 0x00000001
-func parseNALUnits(data []byte) [][]byte {
-	var nalus [][]byte
-	start := -1
+// ctrIV returns the initial counter block of a sample, the constant IV
+// unless sampleIV is set. An IV of 8 bytes makes up the upper half of the
+// counter block.
+func (s *cipherState) ctrIV(sampleIV []byte) []byte {
+	iv := sampleIV
+	if iv == nil {
+		iv = s.iv
+	}
+	if len(iv) == aes.BlockSize {
+		return iv
+	}
+	// the block counter starts at zero for every sample
+	return append(append(make([]byte, 0, 16), iv...), make([]byte, 8)...)
+}
 
-	for i := 0; i < len(data)-2; i++ {
-		// Check for 3-byte start code (0x000001)
-		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
-			if start >= 0 {
-				nalus = append(nalus, data[start:i])
-			}
-			start = i + 3
-			continue
+// encryptAudio encrypts a whole audio sample as one protected range, no
+// NAL units are looked for. The block based schemes encrypt every block
+// whatever the pattern of the profile, as ISO/IEC 23001-7 asks for audio,
+// and leave a trailing partial block clear; samples shorter than a block
+// stay clear entirely.
+func (e *encryption) encryptAudio(dst []byte, s *cipherState, sampleIV, data []byte) []byte {
+	out := append(dst[:0], data...)
+	if s.mode != "cenc" && len(out) < aes.BlockSize {
+		return out
+	}
+
+	s.audioCipher(sampleIV, false).apply(out)
+	e.subsamples.protect(0, len(out))
+	return out
+}
+
+// naluRange locates a NAL unit in an access unit: a start code of
+// headerLen bytes at offset followed by the NAL unit, length bytes in total
+type naluRange struct {
+	offset    int
+	length    int
+	headerLen int
+}
+
+// nalu returns the NAL unit without its start code
+func (r naluRange) nalu(data []byte) []byte {
+	return data[r.offset+r.headerLen : r.offset+r.length]
+}
+
+// startCode is the 3-byte start code, a zero byte before it makes the
+// 4-byte one
+var startCode = []byte{0, 0, 1}
+
+// findNALUnits appends the NAL units of an H.264 or H.265 byte stream to
+// dst. NAL units begin with a start code, 0x000001 or 0x00000001, and end
+// where the next start code or the data begins or ends:
+//   - bytes before the first start code belong to no NAL unit, they are
+//     passed through clear (see prefix); without any start code the whole
+//     data is one NAL unit with a headerLen of 0
+//   - a zero byte before 0x000001 makes a 4-byte start code, further zero
+//     bytes before it are trailing bytes of the NAL unit before
+//   - a start code directly followed by another one or by the end of the
+//     data is an empty NAL unit, kept with a length of headerLen so that
+//     the ranges cover every byte from the first start code on
+//
+// Data of any length is accepted, shorter than a start code it is one NAL
+// unit or nothing when empty.
+func findNALUnits(dst []naluRange, data []byte) []naluRange {
+	first := len(dst)
+
+	// pos is where the NAL unit of the last start code begins
+	for pos := 0; pos <= len(data)-len(startCode); {
+		i := bytes.Index(data[pos:], startCode)
+		if i < 0 {
+			break
 		}
-		// Check for 4-byte start code (0x00000001)
-		if i < len(data)-3 && data[i] == 0 && data[i+1] == 0 && data[i+2] == 0 && data[i+3] == 1 {
-			if start >= 0 {
-				nalus = append(nalus, data[start:i])
-			}
-			start = i + 4
-			i++ // Skip extra byte
-			continue
+
+		start, headerLen := pos+i, len(startCode)
+		if i > 0 && data[start-1] == 0 {
+			start, headerLen = start-1, headerLen+1
 		}
+
+		if len(dst) > first {
+			last := &dst[len(dst)-1]
+			last.length = start - last.offset
+		}
+		dst = append(dst, naluRange{offset: start, headerLen: headerLen})
+		pos = start + headerLen
 	}
 
-	// Last NAL unit
-	if start >= 0 && start < len(data) {
-		nalus = append(nalus, data[start:])
+	switch {
+	case len(dst) > first:
+		last := &dst[len(dst)-1]
+		last.length = len(data) - last.offset
+	case len(data) > 0:
+		dst = append(dst, naluRange{length: len(data)})
 	}
+	return dst
+}
 
-	// If no start codes found, treat entire data as one NAL
-	if len(nalus) == 0 && len(data) > 0 {
-		nalus = append(nalus, data)
+// nalUnits is findNALUnits for the data to encrypt or decrypt, failing
+// with ErrInternal when the ranges found break its promises
+func nalUnits(dst []naluRange, data []byte) ([]naluRange, error) {
+	first := len(dst)
+	dst = findNALUnits(dst, data)
+	return dst, checkNALUnits(dst[first:], len(data))
+}
+
+// checkNALUnits verifies that ranges follow each other in order without
+// gap or overlap from the first start code on up to the end of size bytes
+// of data, and that none of them is negative
+func checkNALUnits(ranges []naluRange, size int) error {
+	if len(ranges) == 0 {
+		if size > 0 {
+			return fmt.Errorf("%w: no NAL unit in %d bytes", ErrInternal, size)
+		}
+		return nil
+	}
+
+	end := ranges[0].offset
+	for i, r := range ranges {
+		switch {
+		case r.offset < 0 || r.headerLen < 0 || r.length < r.headerLen:
+			return fmt.Errorf("%w: NAL unit %d has a negative range: offset %d, length %d, start code %d bytes", ErrInternal, i, r.offset, r.length, r.headerLen)
+		case r.offset < end:
+			return fmt.Errorf("%w: NAL unit %d at offset %d overlaps the one before ending at %d", ErrInternal, i, r.offset, end)
+		case r.offset > end:
+			return fmt.Errorf("%w: NAL unit %d at offset %d leaves a gap after offset %d", ErrInternal, i, r.offset, end)
+		}
+		end = r.offset + r.length
+	}
+
+	if end != size {
+		return fmt.Errorf("%w: NAL units end at offset %d of %d bytes", ErrInternal, end, size)
+	}
+	return nil
+}
+
+// checkOutputSize verifies that the output of an access unit of in bytes
+// accounts for every byte of it, escaped is how much the escaping of
+// ciphertext changed the size of the NAL units encrypted
+func checkOutputSize(in, out, escaped int) error {
+	if out != in+escaped {
+		return fmt.Errorf("%w: %d bytes of output for %d bytes of input and %d bytes of emulation prevention", ErrInternal, out, in, escaped)
 	}
+	return nil
+}
+
+// prefix returns the bytes of data before the first of its NAL units, such
+// as an access unit delimiter that lost its start code. They are copied to
+// the output as they are, so that it keeps the length of the input.
+func prefix(ranges []naluRange, data []byte) []byte {
+	if len(ranges) == 0 {
+		return nil
+	}
+	return data[:ranges[0].offset]
+}
 
+// parseNALUnits returns the NAL units found by findNALUnits including
+// their start codes, as subslices of data; empty NAL units are start codes
+// alone
+func parseNALUnits(data []byte) [][]byte {
+	var nalus [][]byte
+	for _, r := range findNALUnits(nil, data) {
+		nalus = append(nalus, data[r.offset:r.offset+r.length])
+	}
 	return nalus
 }
+
+// startCodeLen returns length of the start code the NAL unit begins with
+func startCodeLen(nalu []byte) int {
+	if len(nalu) >= 3 && nalu[0] == 0 && nalu[1] == 0 && nalu[2] == 1 {
+		return 3
+	}
+	if len(nalu) >= 4 && nalu[0] == 0 && nalu[1] == 0 && nalu[2] == 0 && nalu[3] == 1 {
+		return 4
+	}
+	return 0
+}
@@ -0,0 +1,1147 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testKeyID = "00000000000000000000000000000001"
+	testKey   = "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c"
+	testIV    = "d5fbd6b82ed93e4ef98ae40931ee33b7"
+	// pinned so that encryptors of the tests produce the same IVs
+	testIVNonce = "0000000000000000"
+)
+
+func newTestEncryptor(t testing.TB, cfg Config) *Encryptor {
+	t.Helper()
+
+	cfg.Enabled = true
+	cfg.KeyID = testKeyID
+	cfg.Key = testKey
+	cfg.IV = testIV
+	cfg.Paranoid = true
+	if cfg.IVNonce == "" {
+		cfg.IVNonce = testIVNonce
+	}
+
+	e, err := NewEncryptor(cfg)
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	return e
+}
+
+// nalUnit builds a start code prefixed NAL unit with the given header
+// byte and a payload of size bytes
+func nalUnit(header byte, size int) []byte {
+	nalu := []byte{0, 0, 0, 1, header}
+	for i := 0; i < size; i++ {
+		nalu = append(nalu, byte(i+1))
+	}
+	return nalu
+}
+
+// shortSliceFrame builds an access unit made only of 10-byte P-slices, each
+// with a 3-byte slice header for the parameter sets of h264Params{}
+func shortSliceFrame(slices int) []byte {
+	var frame []byte
+	for i := 0; i < slices; i++ {
+		slice, _ := h264Params{}.slice(0x41, func(w *bitWriter) {
+			w.ue(0)
+			w.ue(5)
+			w.ue(0)
+			w.u(4, 1)
+			w.u(6, 2)
+			w.flag(false)
+			w.flag(false)
+			w.flag(false)
+			w.se(0)
+			w.ue(1)
+		}, 5)
+		frame = append(frame, slice...)
+	}
+	return frame
+}
+
+func TestEncryptor_shortNALs(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		shortNALs     string
+		wantEncrypted bool
+	}{
+		{
+			name:          "cbcs keeps short payloads clear",
+			mode:          "cbcs",
+			wantEncrypted: false,
+		},
+		{
+			name:          "cbcs ignores ctr policy",
+			mode:          "cbcs",
+			shortNALs:     ShortNALsCTR,
+			wantEncrypted: false,
+		},
+		{
+			name:          "cenc encrypts short payloads by default",
+			mode:          "cenc",
+			wantEncrypted: true,
+		},
+		{
+			name:          "cenc keeps short payloads clear with clear policy",
+			mode:          "cenc",
+			shortNALs:     ShortNALsClear,
+			wantEncrypted: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{
+				Mode:             tt.mode,
+				EncryptShortNALs: tt.shortNALs,
+			})
+			if _, err := e.Encrypt(append(h264Params{}.sps(), h264Params{}.pps()...)); err != nil {
+				t.Fatalf("Encrypt() returned error: %s", err)
+			}
+
+			const slices = 4
+			frame := shortSliceFrame(slices)
+			out, err := e.Encrypt(frame)
+			if err != nil {
+				t.Fatalf("Encrypt() returned error: %s", err)
+			}
+
+			if len(out) != len(frame) {
+				t.Fatalf("Encrypt() output length = %d, want %d", len(out), len(frame))
+			}
+
+			for i := 0; i < slices; i++ {
+				in, got := frame[i*14:(i+1)*14], out[i*14:(i+1)*14]
+
+				// start code and NAL header always stay clear
+				if !bytes.Equal(in[:5], got[:5]) {
+					t.Errorf("slice %d: header changed", i)
+				}
+
+				if encrypted := !bytes.Equal(in[5:], got[5:]); encrypted != tt.wantEncrypted {
+					t.Errorf("slice %d: encrypted = %v, want %v", i, encrypted, tt.wantEncrypted)
+				}
+			}
+
+			stats := e.Stats()
+			if stats.ShortNALs != slices {
+				t.Errorf("Stats().ShortNALs = %d, want %d", stats.ShortNALs, slices)
+			}
+
+			var wantEncrypted uint64
+			if tt.wantEncrypted {
+				wantEncrypted = slices
+			}
+			if stats.ShortNALsEncrypted != wantEncrypted {
+				t.Errorf("Stats().ShortNALsEncrypted = %d, want %d", stats.ShortNALsEncrypted, wantEncrypted)
+			}
+		})
+	}
+}
+
+func TestNewEncryptor_shortNALsPolicy(t *testing.T) {
+	_, err := NewEncryptor(Config{
+		Enabled:          true,
+		KeyID:            testKeyID,
+		Key:              testKey,
+		IV:               testIV,
+		EncryptShortNALs: "always",
+	})
+	if err == nil {
+		t.Errorf("NewEncryptor() expected error for unknown short NAL policy")
+	}
+}
+
+func TestEncryptor_minEncryptSize(t *testing.T) {
+	params := h264Params{}
+	small, _ := params.slice(0x41, sliceHeaderCases[1].fields, 40)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		idr  int
+	}{
+		{"cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}, 1500},
+		{"cbcs parallel", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Parallelism: 4}, ParallelMinSize},
+		{"cenc", Config{Mode: "cenc"}, 1500},
+		{"cens", Config{Mode: "cens", CryptBlocks: 1, SkipBlocks: 9}, 1500},
+		{"cbc1", Config{Mode: "cbc1"}, 1500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idr, _ := params.slice(0x65, sliceHeaderCases[0].fields, tt.idr)
+			frame := bytes.Join([][]byte{params.sps(), params.pps(), idr, small}, nil)
+
+			for _, minEncryptSize := range []int{0, 64} {
+				cfg := tt.cfg
+				cfg.MinEncryptSize = minEncryptSize
+				e := newTestEncryptor(t, cfg)
+
+				sample, err := e.EncryptSample(frame)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+
+				// the small slice is the last NAL unit, its subsample clear
+				last := sample.Subsamples[len(sample.Subsamples)-1]
+				clear := last.BytesOfProtectedData == 0 && int(last.BytesOfClearData) >= len(small) &&
+					bytes.HasSuffix(sample.Data, small)
+				if want := minEncryptSize > 0; clear != want {
+					t.Errorf("MinEncryptSize %d: small slice clear = %v, want %v", minEncryptSize, clear, want)
+				}
+				wantEncrypted := uint64(2)
+				if minEncryptSize > 0 {
+					wantEncrypted = 1
+				}
+				if got := e.Stats().NALsEncrypted; got != wantEncrypted {
+					t.Errorf("MinEncryptSize %d: Stats().NALsEncrypted = %d, want %d", minEncryptSize, got, wantEncrypted)
+				}
+
+				cfg.Enabled, cfg.KeyID, cfg.Key, cfg.IV, cfg.IVNonce = true, testKeyID, testKey, testIV, testIVNonce
+				d, err := NewDecryptor(cfg)
+				if err != nil {
+					t.Fatalf("NewDecryptor() returned error: %s", err)
+				}
+				if got, err := d.Decrypt(sample.Data); err != nil || !bytes.Equal(got, frame) {
+					t.Errorf("MinEncryptSize %d: Decrypt() did not restore the access unit: %v", minEncryptSize, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewEncryptor_minEncryptSize(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, MinEncryptSize: 8})
+	if e.minEncryptSize != minProtectedSize {
+		t.Errorf("minEncryptSize = %d, want %d", e.minEncryptSize, minProtectedSize)
+	}
+	if warnings := e.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "minimum encrypt size 8") {
+		t.Errorf("Warnings() = %q, want the raised minimum encrypt size", warnings)
+	}
+
+	_, err := NewEncryptor(Config{
+		Enabled:          true,
+		KeyID:            testKeyID,
+		Key:              testKey,
+		IV:               testIV,
+		Mode:             "cenc",
+		EncryptShortNALs: ShortNALsCTR,
+		MinEncryptSize:   48,
+	})
+	if err == nil {
+		t.Errorf("NewEncryptor() expected error for ctr short NALs with a minimum encrypt size of 48")
+	}
+
+	// without a policy short NALs stay clear under the threshold
+	e = newTestEncryptor(t, Config{Mode: "cenc", MinEncryptSize: 48})
+	if e.shortNALs != ShortNALsClear {
+		t.Errorf("shortNALs = %q, want %q with a minimum encrypt size of 48", e.shortNALs, ShortNALsClear)
+	}
+}
+
+func TestNewEncryptor_modeAndPattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		mode     string
+		pattern  string
+		warnings int
+		wantErr  bool
+	}{
+		{"default", Config{CryptBlocks: 1, SkipBlocks: 9}, "cbcs", "1:9", 0, false},
+		{"upper case", Config{Mode: "CENC"}, "cenc", "0:0", 0, false},
+		{"mixed case", Config{Mode: "Cbcs", CryptBlocks: 1, SkipBlocks: 9}, "cbcs", "1:9", 0, false},
+		{"unknown mode", Config{Mode: "cbc2"}, "", "", 0, true},
+		{"pattern with cenc", Config{Mode: "cenc", CryptBlocks: 1, SkipBlocks: 9}, "cenc", "0:0", 1, false},
+		{"cens", Config{Mode: "cens", CryptBlocks: 1, SkipBlocks: 9}, "cens", "1:9", 0, false},
+		{"cbc1", Config{Mode: "CBC1"}, "cbc1", "0:0", 0, false},
+		{"pattern with cbc1", Config{Mode: "cbc1", CryptBlocks: 1, SkipBlocks: 9}, "cbc1", "0:0", 1, false},
+		{"zero pattern", Config{Mode: "cbcs"}, "cbcs", "1:0", 1, false},
+		{"audio zero pattern", Config{Mode: "cbcs", Codec: CodecAudio}, "cbcs", "1:0", 0, false},
+		{"strict", Config{Mode: "cbcs", CryptBlocks: 2, SkipBlocks: 8, StrictPattern: true}, "cbcs", "2:8", 0, false},
+		{"strict violated", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 0, StrictPattern: true}, "", "", 0, true},
+		{"strict cenc", Config{Mode: "cenc", StrictPattern: true}, "cenc", "0:0", 0, false},
+		{"strict cens violated", Config{Mode: "cens", CryptBlocks: 1, SkipBlocks: 8, StrictPattern: true}, "", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Enabled = true
+			cfg.KeyID = testKeyID
+			cfg.Key = testKey
+			cfg.IV = testIV
+
+			e, err := NewEncryptor(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewEncryptor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			p := e.Profile()
+			if p.Mode != tt.mode {
+				t.Errorf("Profile().Mode = %q, want %q", p.Mode, tt.mode)
+			}
+			if got := fmt.Sprintf("%d:%d", p.CryptBlocks, p.SkipBlocks); got != tt.pattern {
+				t.Errorf("Profile() pattern = %s, want %s", got, tt.pattern)
+			}
+			if got := e.Warnings(); len(got) != tt.warnings {
+				t.Errorf("Warnings() = %q, want %d warnings", got, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestNewEncryptor_shortIV(t *testing.T) {
+	short := testIV[:16]
+	cfg := Config{Enabled: true, KeyID: testKeyID, Key: testKey, IVNonce: testIVNonce}
+
+	for _, mode := range []string{"cenc", "cens"} {
+		cfg.Mode, cfg.IV = mode, short
+		e, err := NewEncryptor(cfg)
+		if err != nil {
+			t.Fatalf("%s: NewEncryptor() returned error: %s", mode, err)
+		}
+		if got := hex.EncodeToString(e.IV()); got != short {
+			t.Errorf("%s: IV() = %s, want %s", mode, got, short)
+		}
+		if got := e.Profile().IV; got != short {
+			t.Errorf("%s: Profile().IV = %s, want %s", mode, got, short)
+		}
+
+		// the 8-byte IV is the counter block with a zero block counter
+		cfg.IV = short + "0000000000000000"
+		padded, err := NewEncryptor(cfg)
+		if err != nil {
+			t.Fatalf("%s: NewEncryptor() returned error: %s", mode, err)
+		}
+		for i, au := range h264Stream() {
+			got, _ := e.Encrypt(au)
+			want, _ := padded.Encrypt(au)
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: access unit %d differs from the padded IV", mode, i)
+			}
+		}
+	}
+
+	for _, mode := range []string{"cbcs", "cbc1"} {
+		cfg.Mode, cfg.IV = mode, short
+		_, err := NewEncryptor(cfg)
+		if err == nil || !strings.Contains(err.Error(), "16 bytes") {
+			t.Errorf("%s: NewEncryptor() error = %v, want the allowed length", mode, err)
+		}
+	}
+
+	cfg.Mode, cfg.IV = "cenc", testIV[:10]
+	if _, err := NewEncryptor(cfg); err == nil || !strings.Contains(err.Error(), "8 or 16 bytes") {
+		t.Errorf("NewEncryptor() error = %v, want the allowed lengths", err)
+	}
+
+	// a profile change keeps checking the IV against the mode
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	p := e.Profile()
+	p.Key, p.IV = testKey, short
+	if err := e.ApplyProfile(p); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("ApplyProfile(8-byte iv) = %v, want ErrInvalidProfile", err)
+	}
+}
+
+func TestEncryptor_strictPattern(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, StrictPattern: true})
+
+	if err := e.SetPattern(Pattern{CryptBlocks: 1, SkipBlocks: 0}); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("SetPattern(1:0) = %v, want ErrInvalidProfile", err)
+	}
+
+	p := e.Profile()
+	p.Key = testKey
+	p.CryptBlocks, p.SkipBlocks = 2, 2
+	if err := e.ApplyProfile(p); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("ApplyProfile(2:2) = %v, want ErrInvalidProfile", err)
+	}
+
+	if err := e.SetPattern(Pattern{CryptBlocks: 5, SkipBlocks: 5}); err != nil {
+		t.Errorf("SetPattern(5:5) returned error: %s", err)
+	}
+}
+
+func TestNewEncryptor_autoGenerate(t *testing.T) {
+	if _, err := NewEncryptor(Config{Enabled: true}); err == nil {
+		t.Errorf("NewEncryptor() expected error without key material")
+	}
+
+	first, err := NewEncryptor(Config{Enabled: true, AutoGenerate: true})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	second, err := NewEncryptor(Config{Enabled: true, AutoGenerate: true})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+
+	for name, get := range map[string]func(e *Encryptor) []byte{
+		"KeyID": (*Encryptor).KeyID,
+		"Key":   (*Encryptor).Key,
+		"IV":    (*Encryptor).IV,
+	} {
+		if got := get(first); len(got) != 16 {
+			t.Errorf("%s() = %x, want 16 bytes", name, got)
+		}
+		if bytes.Equal(get(first), get(second)) {
+			t.Errorf("%s() = %x for both encryptors, want a fresh value", name, get(first))
+		}
+	}
+
+	// given values are kept
+	e, err := NewEncryptor(Config{Enabled: true, AutoGenerate: true, KeyID: testKeyID})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if got := e.KeyID(); !bytes.Equal(got, mustHex(testKeyID)) {
+		t.Errorf("KeyID() = %x, want %s", got, testKeyID)
+	}
+}
+
+func TestEncryptor_statsCounters(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	var observed []string
+	e.OnEncrypt(func(mode string, d time.Duration) {
+		observed = append(observed, mode)
+	})
+
+	var want Stats
+	for i, frame := range h264Stream() {
+		sample, err := e.EncryptSample(frame)
+		if err != nil {
+			t.Fatalf("frame %d: EncryptSample() returned error: %s", i, err)
+		}
+
+		var protected uint64
+		for _, sub := range sample.Subsamples {
+			if sub.BytesOfProtectedData > 0 {
+				protected++
+			}
+		}
+		want.NALsEncrypted += protected
+		want.NALsClear += uint64(len(parseNALUnits(frame))) - protected
+		want.BytesIn += uint64(len(frame))
+		want.BytesOut += uint64(len(sample.Data))
+	}
+
+	got := e.Stats()
+	if got.NALsEncrypted != want.NALsEncrypted || got.NALsClear != want.NALsClear {
+		t.Errorf("Stats() NAL units = %d encrypted, %d clear, want %d, %d", got.NALsEncrypted, got.NALsClear, want.NALsEncrypted, want.NALsClear)
+	}
+	if got.BytesIn != want.BytesIn || got.BytesOut != want.BytesOut {
+		t.Errorf("Stats() bytes = %d in, %d out, want %d, %d", got.BytesIn, got.BytesOut, want.BytesIn, want.BytesOut)
+	}
+	if got.NALsEncrypted == 0 || got.NALsClear == 0 {
+		t.Errorf("Stats() = %+v, want encrypted and clear NAL units", got)
+	}
+	if len(observed) != len(h264Stream()) || observed[0] != "cbcs" {
+		t.Errorf("OnEncrypt() observed %q, want cbcs for every access unit", observed)
+	}
+
+	avcc := newTestEncryptor(t, Config{NALFormat: NALFormatAVCC})
+	if _, err := avcc.Encrypt([]byte{0, 0, 0, 9, 0x65}); err == nil {
+		t.Fatalf("Encrypt() expected error for a truncated length field")
+	}
+	if got := avcc.Stats().Errors; got != 1 {
+		t.Errorf("Stats().Errors = %d, want 1", got)
+	}
+}
+
+// collidingSlice builds an IDR slice with an unparsed slice header, so that
+// its ciphertext starts with the given bytes after DefaultClearLead clear
+// bytes ending in two zero bytes. The clear bytes and the stop bit follow.
+func collidingSlice(t *testing.T, mode string, ciphertext, clear []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(mustHex(testKey))
+	if err != nil {
+		t.Fatalf("aes.NewCipher() returned error: %s", err)
+	}
+
+	plain := make([]byte, len(ciphertext))
+	if mode == "cbcs" {
+		cipher.NewCBCDecrypter(block, mustHex(testIV)).CryptBlocks(plain, ciphertext)
+	} else {
+		// first sample in counter mode
+		iv := append(mustHex(testIV)[:8], make([]byte, 8)...)
+		cipher.NewCTR(block, iv).XORKeyStream(plain, ciphertext)
+	}
+
+	lead := append(bytes.Repeat([]byte{0xcc}, DefaultClearLead-2), 0, 0)
+	rbsp := append(append(append(lead, plain...), clear...), 0x80)
+	return append([]byte{0, 0, 0, 1, 0x65}, escapeRBSP(rbsp)...)
+}
+
+func TestEncryptor_emulationPrevention(t *testing.T) {
+	// ciphertext emulating start codes, also across its start and end
+	ciphertext := []byte{
+		0x01, 0, 0, 1, 0xaa, 0, 0, 0, 0xaa, 0, 0, 3, 0xaa, 0xaa, 0, 0,
+	}
+
+	tests := []struct {
+		name   string
+		mode   string
+		clear  []byte
+		params SampleParams
+	}{
+		{
+			name:   "cbcs",
+			mode:   "cbcs",
+			clear:  append([]byte{1}, bytes.Repeat([]byte{0xbb}, 15)...),
+			params: SampleParams{Scheme: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+		},
+		{
+			name:   "cenc",
+			mode:   "cenc",
+			params: SampleParams{Scheme: "cenc"},
+		},
+	}
+
+	block, _ := aes.NewCipher(mustHex(testKey))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{Mode: tt.mode, CryptBlocks: 1, SkipBlocks: 9})
+
+			frame := append(nalUnit(0x67, 8), collidingSlice(t, tt.mode, ciphertext, tt.clear)...)
+			sample, err := e.EncryptSample(frame)
+			if err != nil {
+				t.Fatalf("EncryptSample() returned error: %s", err)
+			}
+
+			nalus := parseNALUnits(sample.Data)
+			if len(nalus) != 2 {
+				t.Fatalf("encrypted access unit has %d NAL units, want 2", len(nalus))
+			}
+			slice := nalus[1][startCodeLen(nalus[1]):]
+			for _, code := range [][]byte{{0, 0, 0}, {0, 0, 1}, {0, 0, 2}} {
+				if bytes.Contains(slice, code) {
+					t.Errorf("encrypted slice contains %x", code)
+				}
+			}
+			if got := unescapeRBSP(slice[1:])[DefaultClearLead:]; !bytes.HasPrefix(got, ciphertext) {
+				t.Fatalf("encrypted slice = %x, want ciphertext %x", got, ciphertext)
+			}
+
+			if got := clientDecrypt(block, sampleIV(mustHex(testIV), sample), e.Profile(), sample.Data); !bytes.Equal(got, frame) {
+				t.Errorf("clientDecrypt() = %x, want %x", got, frame)
+			}
+
+			var size int
+			for _, sub := range sample.Subsamples {
+				size += int(sub.BytesOfClearData) + int(sub.BytesOfProtectedData)
+			}
+			if size != len(sample.Data) {
+				t.Fatalf("subsamples cover %d bytes, want %d", size, len(sample.Data))
+			}
+
+			params := tt.params
+			params.IV = sampleIV(mustHex(testIV), sample)
+			params.Escaped = true
+			got, err := DecryptSample(block, params, sample.Data, sample.Subsamples)
+			if err != nil {
+				t.Fatalf("DecryptSample() returned error: %s", err)
+			}
+			if !bytes.Equal(got, frame) {
+				t.Errorf("DecryptSample() = %x, want %x", got, frame)
+			}
+
+			if e.Stats().EmulationPreventionBytes == 0 {
+				t.Errorf("Stats().EmulationPreventionBytes = 0, want escaped ciphertext counted")
+			}
+		})
+	}
+}
+
+func TestEncryptor_sampleIV(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+	if p := e.Profile(); p.IVMode != IVModeCounter {
+		t.Fatalf("Profile() iv mode = %s, want %s", p.IVMode, IVModeCounter)
+	}
+
+	block, _ := aes.NewCipher(mustHex(testKey))
+	frame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+
+	encrypt := func() EncryptedSample {
+		t.Helper()
+
+		sample, err := e.EncryptSample(frame)
+		if err != nil {
+			t.Fatalf("EncryptSample() returned error: %s", err)
+		}
+
+		got, err := DecryptSample(block, SampleParams{Scheme: "cenc", IV: sample.IV, Escaped: true}, sample.Data, sample.Subsamples)
+		if err != nil {
+			t.Fatalf("DecryptSample() returned error: %s", err)
+		}
+		if !bytes.Equal(got, frame) {
+			t.Errorf("DecryptSample() with sample IV %x does not match source", sample.IV)
+		}
+		return sample
+	}
+
+	// the first 8 bytes of the configured IV plus the sample number
+	var previous []byte
+	for i, want := range []string{"d5fbd6b82ed93e4e", "d5fbd6b82ed93e4f", "d5fbd6b82ed93e50"} {
+		sample := encrypt()
+		if !bytes.Equal(sample.IV, mustHex(want)) {
+			t.Errorf("sample %d IV = %x, want %s", i, sample.IV, want)
+		}
+		if bytes.Equal(sample.Data, previous) {
+			t.Errorf("sample %d has the ciphertext of the previous one", i)
+		}
+		previous = sample.Data
+	}
+
+	// staging identical parameters must not restart the sample numbers
+	if err := e.ApplyProfile(Profile{Mode: "cenc", KeyID: testKeyID, Key: testKey, IV: testIV}); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+	if sample := encrypt(); !bytes.Equal(sample.IV, mustHex("d5fbd6b82ed93e51")) {
+		t.Errorf("IV after identical profile = %x, want d5fbd6b82ed93e51", sample.IV)
+	}
+
+	err := e.ApplyProfile(Profile{Mode: "cenc", KeyID: testKeyID, Key: testKey, IV: testIV, IVMode: IVModeConstant})
+	if !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("ApplyProfile() of cenc with constant IV error = %v, want %v", err, ErrInvalidProfile)
+	}
+
+	cbcs := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if sample, _ := cbcs.EncryptSample(frame); sample.IV != nil {
+		t.Errorf("cbcs sample IV = %x, want constant IV", sample.IV)
+	}
+}
+
+func TestEncryptor_EncryptSample(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           Config
+		frame         []byte
+		wantProtected bool
+	}{
+		{
+			name:  "disabled",
+			frame: nalUnit(0x65, 100),
+		},
+		{
+			name:  "short slices are fully clear",
+			cfg:   Config{Enabled: true},
+			frame: shortSliceFrame(3),
+		},
+		{
+			name:          "slice after a parameter set",
+			cfg:           Config{Enabled: true},
+			frame:         append(nalUnit(0x67, 8), nalUnit(0x65, 100)...),
+			wantProtected: true,
+		},
+		{
+			name:          "clear range longer than a subsample entry",
+			cfg:           Config{Enabled: true},
+			frame:         append(nalUnit(0x06, 3*maxClearData), nalUnit(0x65, 100)...),
+			wantProtected: true,
+		},
+		{
+			name:          "cenc",
+			cfg:           Config{Enabled: true, Mode: "cenc"},
+			frame:         append(nalUnit(0x65, 100), nalUnit(0x41, 50)...),
+			wantProtected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.KeyID = testKeyID
+			cfg.Key = testKey
+			cfg.IV = testIV
+			e, err := NewEncryptor(cfg)
+			if err != nil {
+				t.Fatalf("NewEncryptor() returned error: %s", err)
+			}
+
+			sample, err := e.EncryptSample(tt.frame)
+			if err != nil {
+				t.Fatalf("EncryptSample() returned error: %s", err)
+			}
+
+			var size, protected int
+			for _, sub := range sample.Subsamples {
+				if sub.BytesOfClearData > maxClearData {
+					t.Errorf("subsample has %d clear bytes, more than %d", sub.BytesOfClearData, maxClearData)
+				}
+				size += int(sub.BytesOfClearData) + int(sub.BytesOfProtectedData)
+				protected += int(sub.BytesOfProtectedData)
+			}
+			if size != len(sample.Data) {
+				t.Errorf("subsamples cover %d bytes, want %d", size, len(sample.Data))
+			}
+			if (protected > 0) != tt.wantProtected {
+				t.Errorf("subsamples protect %d bytes, want protected = %v", protected, tt.wantProtected)
+			}
+
+			out, err := e.Encrypt(tt.frame)
+			if err != nil {
+				t.Fatalf("Encrypt() returned error: %s", err)
+			}
+			if len(out) != len(sample.Data) {
+				t.Errorf("Encrypt() output length = %d, want %d", len(out), len(sample.Data))
+			}
+		})
+	}
+}
+
+func TestEncryptor_accessors(t *testing.T) {
+	cfg := Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}
+	e := newTestEncryptor(t, cfg)
+	reference := newTestEncryptor(t, cfg)
+
+	if got := e.KeyIDHex(); got != testKeyID {
+		t.Errorf("KeyIDHex() = %s, want %s", got, testKeyID)
+	}
+	if got := e.IVHex(); got != testIV {
+		t.Errorf("IVHex() = %s, want %s", got, testIV)
+	}
+	if got, want := e.KeyIDUUID(), "00000000-0000-0000-0000-000000000001"; got != want {
+		t.Errorf("KeyIDUUID() = %s, want %s", got, want)
+	}
+
+	// redacting the returned bytes in place must not reach the encryptor
+	for _, b := range [][]byte{e.KeyID(), e.Key(), e.IV()} {
+		for i := range b {
+			b[i] = 'x'
+		}
+	}
+
+	if got := e.KeyIDHex(); got != testKeyID {
+		t.Errorf("KeyIDHex() after mutating KeyID() = %s, want %s", got, testKeyID)
+	}
+	if got := e.IVHex(); got != testIV {
+		t.Errorf("IVHex() after mutating IV() = %s, want %s", got, testIV)
+	}
+
+	for i, frame := range h264Stream() {
+		got, err := e.Encrypt(frame)
+		if err != nil {
+			t.Fatalf("Encrypt() frame %d returned error: %s", i, err)
+		}
+		want, err := reference.Encrypt(frame)
+		if err != nil {
+			t.Fatalf("Encrypt() frame %d returned error: %s", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Encrypt() frame %d differs after mutating the accessors", i)
+		}
+	}
+
+	var disabled Encryptor
+	if disabled.KeyIDHex() != "" || disabled.IVHex() != "" || disabled.KeyIDUUID() != "" {
+		t.Errorf("accessors of a disabled encryptor are not empty")
+	}
+}
+
+func TestEncryptor_Close(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if err := e.ApplyProfile(testProfile); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+
+	// the backing arrays of the current and the staged key material
+	var material [][]byte
+	for _, s := range []*cipherState{e.state.Load(), e.pending} {
+		material = append(material, s.keyID, s.key, s.iv)
+	}
+
+	e.Close()
+	e.Close()
+
+	for i, b := range material {
+		if !bytes.Equal(b, make([]byte, len(b))) {
+			t.Errorf("key material %d = %x after Close(), want zeros", i, b)
+		}
+	}
+	if e.state.Load() != nil || e.pending != nil {
+		t.Errorf("Close() kept references to the states")
+	}
+
+	if e.Enabled() || e.Key() != nil || e.KeyID() != nil || e.IV() != nil {
+		t.Errorf("Close() left the encryptor enabled or its key readable")
+	}
+
+	frame := h264Stream()[0]
+	got, err := e.Encrypt(frame)
+	if err != nil || !bytes.Equal(got, frame) {
+		t.Errorf("Encrypt() after Close() = %v, want the access unit unmodified", err)
+	}
+	if _, err := e.UpdateKeyHex(testKeyID, testKey, testIV); !errors.Is(err, ErrProfileDisabled) {
+		t.Errorf("UpdateKeyHex() error = %v, want %v", err, ErrProfileDisabled)
+	}
+}
+
+func TestFindNALUnits(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []naluRange
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "no start code",
+			data: []byte{0x65, 1, 2},
+			want: []naluRange{{0, 3, 0}},
+		},
+		{
+			name: "3 and 4-byte start codes",
+			data: []byte{0, 0, 0, 1, 0x67, 1, 0, 0, 1, 0x68, 2},
+			want: []naluRange{{0, 6, 4}, {6, 5, 3}},
+		},
+		{
+			name: "bytes before the first start code",
+			data: []byte{0xff, 0, 0, 1, 0x65, 1},
+			want: []naluRange{{1, 5, 3}},
+		},
+		{
+			name: "zero bytes before a start code",
+			data: []byte{0, 0, 1, 0x09, 0xf0, 0, 0, 0, 0, 1, 0x65},
+			want: []naluRange{{0, 6, 3}, {6, 5, 4}},
+		},
+		{
+			name: "start code at the end",
+			data: []byte{0, 0, 1, 0x65, 0, 0, 1},
+			want: []naluRange{{0, 4, 3}, {4, 3, 3}},
+		},
+		{
+			name: "one byte",
+			data: []byte{0x65},
+			want: []naluRange{{0, 1, 0}},
+		},
+		{
+			name: "two zero bytes",
+			data: []byte{0, 0},
+			want: []naluRange{{0, 2, 0}},
+		},
+		{
+			name: "start code alone",
+			data: []byte{0, 0, 1},
+			want: []naluRange{{0, 3, 3}},
+		},
+		{
+			name: "4-byte start code alone",
+			data: []byte{0, 0, 0, 1},
+			want: []naluRange{{0, 4, 4}},
+		},
+		{
+			name: "4-byte start code at the end",
+			data: []byte{0, 0, 1, 0x65, 1, 0, 0, 0, 1},
+			want: []naluRange{{0, 5, 3}, {5, 4, 4}},
+		},
+		{
+			name: "back-to-back start codes",
+			data: []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 1, 0x65},
+			want: []naluRange{{0, 3, 3}, {3, 3, 3}, {6, 5, 4}},
+		},
+		{
+			name: "4-byte start code right after a NAL unit header",
+			data: []byte{0, 0, 1, 0x09, 0, 0, 0, 1, 0x65},
+			want: []naluRange{{0, 4, 3}, {4, 5, 4}},
+		},
+		{
+			name: "trailing zero bytes",
+			data: []byte{0, 0, 1, 0x09, 0, 0, 0, 0, 0, 1, 0x65},
+			want: []naluRange{{0, 6, 3}, {6, 5, 4}},
+		},
+		{
+			name: "zero bytes alone before the first start code",
+			data: []byte{0, 0, 0, 0, 1, 0x65},
+			want: []naluRange{{1, 5, 4}},
+		},
+		{
+			name: "emulation prevention is no start code",
+			data: []byte{0, 0, 1, 0x65, 0, 0, 3, 1},
+			want: []naluRange{{0, 8, 3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findNALUnits(nil, tt.data)
+			if len(got) != len(tt.want) {
+				t.Fatalf("findNALUnits() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("findNALUnits() = %v, want %v", got, tt.want)
+				}
+			}
+
+			nalus := parseNALUnits(tt.data)
+			if len(nalus) != len(tt.want) {
+				t.Fatalf("parseNALUnits() returned %d NAL units, want %d", len(nalus), len(tt.want))
+			}
+			for i, nalu := range nalus {
+				r := tt.want[i]
+				if !bytes.Equal(nalu, tt.data[r.offset:r.offset+r.length]) || r.headerLen > 0 && startCodeLen(nalu) != r.headerLen {
+					t.Errorf("parseNALUnits()[%d] = %x, want %x", i, nalu, tt.data[r.offset:r.offset+r.length])
+				}
+			}
+		})
+	}
+}
+
+func FuzzFindNALUnits(f *testing.F) {
+	for _, seed := range [][]byte{
+		{}, {0}, {0, 0}, {0, 0, 1}, {0, 0, 0, 1}, {0, 0, 1, 0, 0, 1},
+		{0xff, 0, 0, 0, 0, 1, 0x65, 0, 0, 3, 1, 0, 0},
+		h264Stream()[0],
+	} {
+		f.Add(seed)
+	}
+
+	cbcs := newTestEncryptor(f, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	cenc := newTestEncryptor(f, Config{Mode: "cenc", EncryptShortNALs: ShortNALsCTR})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ranges := findNALUnits(nil, data)
+		if len(data) == 0 {
+			if len(ranges) != 0 {
+				t.Fatalf("findNALUnits() of no data = %v", ranges)
+			}
+			return
+		}
+		if len(ranges) == 0 {
+			t.Fatalf("findNALUnits() of %d bytes found nothing", len(data))
+		}
+
+		// contiguous up to the end, each beginning with its start code
+		end := ranges[0].offset
+		if ranges[0].headerLen == 0 && (len(ranges) > 1 || end != 0) {
+			t.Fatalf("findNALUnits() = %v, a range without start code is the whole data", ranges)
+		}
+		for _, r := range ranges {
+			if r.offset != end || r.length < r.headerLen {
+				t.Fatalf("findNALUnits() = %v, not contiguous", ranges)
+			}
+			if r.headerLen > 0 && startCodeLen(data[r.offset:r.offset+r.length]) != r.headerLen {
+				t.Fatalf("findNALUnits() = %v, range at %d does not begin with its start code", ranges, r.offset)
+			}
+			if bytes.Contains(r.nalu(data), startCode) {
+				t.Fatalf("findNALUnits() = %v, range at %d contains a start code", ranges, r.offset)
+			}
+			end += r.length
+		}
+		if end != len(data) {
+			t.Fatalf("findNALUnits() = %v, ends at %d of %d bytes", ranges, end, len(data))
+		}
+		if bytes.Contains(data[:ranges[0].offset], startCode) {
+			t.Fatalf("findNALUnits() = %v, skipped a start code", ranges)
+		}
+
+		// whatever the input, the encryptors do not panic and keep the
+		// bytes before the first start code
+		for _, e := range []*Encryptor{cbcs, cenc} {
+			if out, err := e.Encrypt(data); err == nil && !bytes.HasPrefix(out, prefix(ranges, data)) {
+				t.Fatalf("Encrypt() = %x, lost the prefix %x", out, prefix(ranges, data))
+			}
+		}
+	})
+}
+
+func TestCheckNALUnits(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []naluRange
+		size   int
+		ok     bool
+	}{
+		{"empty", nil, 0, true},
+		{"prefix", []naluRange{{offset: 2, length: 5, headerLen: 3}, {offset: 7, length: 3, headerLen: 3}}, 10, true},
+		{"no start code", []naluRange{{length: 4}}, 4, true},
+		{"nothing found", nil, 4, false},
+		{"negative offset", []naluRange{{offset: -1, length: 5, headerLen: 3}}, 4, false},
+		{"negative start code", []naluRange{{length: 4, headerLen: -1}}, 4, false},
+		{"shorter than start code", []naluRange{{length: 2, headerLen: 3}}, 2, false},
+		{"overlap", []naluRange{{length: 6, headerLen: 3}, {offset: 5, length: 5, headerLen: 3}}, 10, false},
+		{"gap", []naluRange{{length: 4, headerLen: 3}, {offset: 5, length: 5, headerLen: 3}}, 10, false},
+		{"short of the end", []naluRange{{length: 4, headerLen: 3}}, 5, false},
+		{"past the end", []naluRange{{length: 6, headerLen: 3}}, 5, false},
+	}
+
+	for _, tt := range tests {
+		err := checkNALUnits(tt.ranges, tt.size)
+		if tt.ok && err != nil {
+			t.Errorf("%s: checkNALUnits() returned error: %s", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInternal) {
+			t.Errorf("%s: checkNALUnits() error = %v, want %v", tt.name, err, ErrInternal)
+		}
+	}
+
+	if err := checkOutputSize(100, 102, 2); err != nil {
+		t.Errorf("checkOutputSize() returned error: %s", err)
+	}
+	if err := checkOutputSize(100, 101, 2); !errors.Is(err, ErrInternal) {
+		t.Errorf("checkOutputSize() error = %v, want %v", err, ErrInternal)
+	}
+}
+
+// fuzzConfigs are the profiles FuzzEncrypt picks from
+var fuzzConfigs = []Config{
+	{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+	{Mode: "cenc", EncryptShortNALs: ShortNALsCTR},
+	{Mode: "cens", CryptBlocks: 1, SkipBlocks: 9},
+	{Mode: "cbc1"},
+	{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265},
+	{Mode: "cenc", EncryptNALTypes: []int{1, 5, 6}},
+}
+
+func FuzzEncrypt(f *testing.F) {
+	for i, seed := range [][]byte{
+		{}, {0, 0, 1}, {0, 0, 1, 0x65},
+		{0xff, 0, 0, 0, 0, 1, 0x65, 0, 0, 3, 1, 0, 0},
+		append([]byte{0, 0, 1, 0x41}, bytes.Repeat([]byte{0, 0, 3, 0}, 20)...),
+		h264Stream()[0], h264Stream()[1], shortSliceFrame(2),
+		hevcNAL(19, 100),
+	} {
+		f.Add(byte(i), seed)
+	}
+
+	f.Fuzz(func(t *testing.T, profile byte, data []byte) {
+		cfg := fuzzConfigs[int(profile)%len(fuzzConfigs)]
+		e := newTestEncryptor(t, cfg)
+
+		cfg.Enabled, cfg.KeyID, cfg.Key, cfg.IV, cfg.IVNonce = true, testKeyID, testKey, testIV, testIVNonce
+		d, err := NewDecryptor(cfg)
+		if err != nil {
+			t.Fatalf("NewDecryptor() returned error: %s", err)
+		}
+
+		// paranoid checks included, any input encrypts
+		out, err := e.Encrypt(data)
+		if err != nil {
+			t.Fatalf("Encrypt(%x) returned error: %s", data, err)
+		}
+
+		// the same NAL units of the same length once unescaped, escaping
+		// ciphertext is all that changes the length
+		in, got := findNALUnits(nil, data), findNALUnits(nil, out)
+		if len(got) != len(in) || !bytes.Equal(prefix(got, out), prefix(in, data)) {
+			t.Fatalf("Encrypt(%x) = %x, NAL units %v, want %v", data, out, got, in)
+		}
+		if !bytes.Contains(data, []byte{0, 0, 3}) && !bytes.Contains(out, []byte{0, 0, 3}) && len(out) != len(data) {
+			t.Fatalf("Encrypt(%x) = %x, %d bytes, want %d", data, out, len(out), len(data))
+		}
+
+		hl := e.codec.headerLen()
+		for i := range in {
+			src, dst := in[i].nalu(data), got[i].nalu(out)
+			if in[i].headerLen != got[i].headerLen {
+				t.Fatalf("Encrypt(%x) = %x, start code of NAL unit %d changed", data, out, i)
+			}
+
+			// NAL units not encrypted are left as they are
+			if len(src) <= hl || !e.encrypts(e.codec.nalType(src)) {
+				if !bytes.Equal(src, dst) {
+					t.Fatalf("Encrypt(%x) = %x, NAL unit %d of type %d changed", data, out, i, e.codec.nalType(src))
+				}
+				continue
+			}
+
+			if !bytes.Equal(src[:hl], dst[:hl]) || len(unescapeRBSP(src[hl:])) != len(unescapeRBSP(dst[hl:])) {
+				t.Fatalf("Encrypt(%x) = %x, NAL unit %d changed its header or length", data, out, i)
+			}
+		}
+
+		// and decrypt to the same payloads
+		plain, err := d.Decrypt(out)
+		if err != nil {
+			t.Fatalf("Decrypt(%x) returned error: %s", out, err)
+		}
+		for i, r := range findNALUnits(nil, plain) {
+			if !bytes.Equal(unescapeRBSP(r.nalu(plain)), unescapeRBSP(in[i].nalu(data))) {
+				t.Fatalf("Decrypt(Encrypt(%x)) = %x, NAL unit %d differs", data, plain, i)
+			}
+		}
+	})
+}
+
+func TestEncryptor_prefix(t *testing.T) {
+	// an access unit delimiter without its start code and some junk
+	junk := []byte{0x09, 0xf0, 0xde, 0xad, 0xbe, 0xef, 0x42}
+
+	params := h264Params{}
+	idr, _ := params.slice(0x65, sliceHeaderCases[0].fields, ParallelMinSize)
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		frames [][]byte
+	}{
+		{"cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}, h264Stream()},
+		{"cbcs parallel", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Parallelism: 4}, [][]byte{bytes.Join([][]byte{params.sps(), params.pps(), idr}, nil)}},
+		{"cenc", Config{Mode: "cenc"}, h264Stream()},
+		{"cens", Config{Mode: "cens", CryptBlocks: 1, SkipBlocks: 9}, h264Stream()},
+		{"cbc1", Config{Mode: "cbc1"}, h264Stream()},
+		{"key SEI", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeySEI: true}, h264Stream()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, tt.cfg)
+
+			cfg := tt.cfg
+			cfg.Enabled, cfg.KeyID, cfg.Key, cfg.IV, cfg.IVNonce = true, testKeyID, testKey, testIV, testIVNonce
+			d, err := NewDecryptor(cfg)
+			if err != nil {
+				t.Fatalf("NewDecryptor() returned error: %s", err)
+			}
+
+			for i, frame := range tt.frames {
+				frame = append(bytes.Clone(junk), frame...)
+
+				sample, err := e.EncryptSample(frame)
+				if err != nil {
+					t.Fatalf("frame %d: EncryptSample() returned error: %s", i, err)
+				}
+				if !bytes.HasPrefix(sample.Data, junk) {
+					t.Fatalf("frame %d: EncryptSample() = %x..., want the prefix %x kept", i, sample.Data[:min(len(sample.Data), len(junk))], junk)
+				}
+				if !tt.cfg.KeySEI && len(sample.Data) != len(frame) {
+					t.Errorf("frame %d: EncryptSample() returned %d bytes, want %d", i, len(sample.Data), len(frame))
+				}
+				if first := sample.Subsamples[0]; int(first.BytesOfClearData) < len(junk) {
+					t.Errorf("frame %d: first subsample %+v does not keep the prefix clear", i, first)
+				}
+
+				// the inserted SEI stays in the decrypted access unit
+				if tt.cfg.KeySEI {
+					continue
+				}
+				if got, err := d.Decrypt(sample.Data); err != nil || !bytes.Equal(got, frame) {
+					t.Errorf("frame %d: Decrypt() did not restore the access unit: %v", i, err)
+				}
+			}
+		})
+	}
+}
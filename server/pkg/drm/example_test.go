@@ -0,0 +1,42 @@
+package drm_test
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+func ExampleEncryptor() {
+	encryptor, err := drm.NewEncryptor(drm.Config{
+		Enabled:     true,
+		KeyID:       "00000000000000000000000000000001",
+		Key:         "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c",
+		IV:          "d5fbd6b82ed93e4ef98ae40931ee33b7",
+		Mode:        "cbcs",
+		CryptBlocks: 1,
+		SkipBlocks:  9,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// IDR slice with an 80 byte payload, without parameter sets its slice
+	// header cannot be parsed and the first 32 bytes stay clear
+	frame := append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0xaa}, 80)...)
+
+	out, err := encryptor.Encrypt(frame)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("length preserved:", len(out) == len(frame))
+	fmt.Println("slice header clear:", bytes.Equal(out[:37], frame[:37]))
+	fmt.Println("first block encrypted:", !bytes.Equal(out[37:53], frame[37:53]))
+	fmt.Println("second block skipped:", bytes.Equal(out[53:], frame[53:]))
+	// Output:
+	// length preserved: true
+	// slice header clear: true
+	// first block encrypted: true
+	// second block skipped: true
+}
@@ -0,0 +1,183 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KeyExportInterval is the minimum time between two successful exports
+const KeyExportInterval = time.Hour
+
+// KeyExportMaxFailures wrong passwords in a row lock the export for
+// KeyExportLockout, doubling with every further one up to
+// KeyExportInterval; no password is checked while locked
+const (
+	KeyExportMaxFailures = 5
+	KeyExportLockout     = time.Minute
+)
+
+// minExportKeyBits is the smallest RSA key a content key is wrapped with
+const minExportKeyBits = 2048
+
+var (
+	ErrKeyExportDisabled    = errors.New("key export is disabled")
+	ErrKeyExportDenied      = errors.New("key export password is wrong")
+	ErrKeyExportRateLimited = errors.New("key export is rate limited")
+	ErrKeyExportPublicKey   = errors.New("invalid key export public key")
+
+	// ErrKeyExportLocked is a rate limit after too many wrong passwords
+	ErrKeyExportLocked = fmt.Errorf("%w after too many wrong passwords", ErrKeyExportRateLimited)
+)
+
+// KeyExportConfig gates the break-glass export of the current content key,
+// export stays disabled unless it is allowed and a password is set
+type KeyExportConfig struct {
+	Allowed  bool
+	Password string
+}
+
+// KeyExport is the current content key wrapped with RSA-OAEP (SHA-256,
+// no label) under the public key supplied by the caller
+type KeyExport struct {
+	KeyID        string // hex encoded 16 bytes
+	EncryptedKey []byte
+}
+
+// KeyExportAttempt is reported for every export attempt, Err is nil when
+// the key left the process
+type KeyExportAttempt struct {
+	Time  time.Time
+	Actor string
+	KeyID string
+	Err   error
+
+	// Failures is the number of wrong passwords in a row, this attempt
+	// included; LockedUntil is set while they lock the export
+	Failures    int
+	LockedUntil time.Time
+}
+
+// KeyExporter hands out the current content key of an encryptor to
+// operators recovering recordings; every attempt is audited and successful
+// exports are limited to one per KeyExportInterval, wrong passwords by
+// locking out after KeyExportMaxFailures
+type KeyExporter struct {
+	mu sync.Mutex
+
+	encryptor *Encryptor
+	config    KeyExportConfig
+	audit     func(KeyExportAttempt)
+
+	now        func() time.Time
+	lastExport time.Time
+
+	failures    int
+	lockedUntil time.Time
+}
+
+// NewKeyExporter creates an exporter for the encryptor, audit is called
+// synchronously for every attempt
+func NewKeyExporter(e *Encryptor, config KeyExportConfig, audit func(KeyExportAttempt)) *KeyExporter {
+	return &KeyExporter{
+		encryptor: e,
+		config:    config,
+		audit:     audit,
+		now:       time.Now,
+	}
+}
+
+// Export returns the current content key encrypted under pub, the key is
+// never returned in plaintext
+func (x *KeyExporter) Export(actor, password string, pub *rsa.PublicKey) (KeyExport, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	attempt := KeyExportAttempt{
+		Time:  x.now(),
+		Actor: actor,
+	}
+
+	export, err := x.export(attempt.Time, password, pub)
+	attempt.KeyID = export.KeyID
+	attempt.Err = err
+	attempt.Failures = x.failures
+	if attempt.Time.Before(x.lockedUntil) {
+		attempt.LockedUntil = x.lockedUntil
+	}
+
+	if x.audit != nil {
+		x.audit(attempt)
+	}
+
+	return export, err
+}
+
+func (x *KeyExporter) export(now time.Time, password string, pub *rsa.PublicKey) (KeyExport, error) {
+	if !x.config.Allowed || x.config.Password == "" || x.encryptor == nil || !x.encryptor.Enabled() {
+		return KeyExport{}, ErrKeyExportDisabled
+	}
+
+	if now.Before(x.lockedUntil) {
+		next := x.lockedUntil.Sub(now).Round(time.Second)
+		return KeyExport{}, fmt.Errorf("%w: next attempt possible in %s", ErrKeyExportLocked, next)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(password), []byte(x.config.Password)) != 1 {
+		x.failed(now)
+		return KeyExport{}, ErrKeyExportDenied
+	}
+	x.failures = 0
+
+	if !x.lastExport.IsZero() && now.Sub(x.lastExport) < KeyExportInterval {
+		next := x.lastExport.Add(KeyExportInterval).Sub(now).Round(time.Second)
+		return KeyExport{}, fmt.Errorf("%w: next export possible in %s", ErrKeyExportRateLimited, next)
+	}
+
+	if pub == nil || pub.N.BitLen() < minExportKeyBits {
+		return KeyExport{}, fmt.Errorf("%w: RSA key must have at least %d bits", ErrKeyExportPublicKey, minExportKeyBits)
+	}
+
+	keyID, key := x.encryptor.contentKey()
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	clear(key)
+	if err != nil {
+		return KeyExport{}, fmt.Errorf("%w: %w", ErrKeyExportPublicKey, err)
+	}
+
+	x.lastExport = now
+
+	return KeyExport{
+		KeyID:        hex.EncodeToString(keyID),
+		EncryptedKey: encrypted,
+	}, nil
+}
+
+// failed counts a wrong password and locks the export once there were too
+// many in a row
+func (x *KeyExporter) failed(now time.Time) {
+	x.failures++
+	if x.failures < KeyExportMaxFailures {
+		return
+	}
+
+	lockout := KeyExportLockout
+	for i := KeyExportMaxFailures; i < x.failures && lockout < KeyExportInterval; i++ {
+		lockout *= 2
+	}
+	x.lockedUntil = now.Add(min(lockout, KeyExportInterval))
+}
+
+// contentKey returns copies of the key ID and key frames are currently
+// encrypted with
+func (e *Encryptor) contentKey() (keyID, key []byte) {
+	s := e.state.Load()
+	return bytes.Clone(s.keyID), bytes.Clone(s.key)
+}
@@ -0,0 +1,248 @@
+package drm
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestExportKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() returned error: %s", err)
+	}
+	return priv
+}
+
+func TestKeyExporter_gating(t *testing.T) {
+	priv := newTestExportKey(t)
+
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey() returned error: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		config   KeyExportConfig
+		disabled bool
+		password string
+		pub      *rsa.PublicKey
+		wantErr  error
+	}{
+		{
+			name:     "allowed with password",
+			config:   KeyExportConfig{Allowed: true, Password: "secret"},
+			password: "secret",
+			pub:      &priv.PublicKey,
+		},
+		{
+			name:     "not allowed",
+			config:   KeyExportConfig{Allowed: false, Password: "secret"},
+			password: "secret",
+			pub:      &priv.PublicKey,
+			wantErr:  ErrKeyExportDisabled,
+		},
+		{
+			name:     "allowed without password configured",
+			config:   KeyExportConfig{Allowed: true},
+			password: "",
+			pub:      &priv.PublicKey,
+			wantErr:  ErrKeyExportDisabled,
+		},
+		{
+			name:     "encryptor disabled",
+			config:   KeyExportConfig{Allowed: true, Password: "secret"},
+			disabled: true,
+			password: "secret",
+			pub:      &priv.PublicKey,
+			wantErr:  ErrKeyExportDisabled,
+		},
+		{
+			name:     "wrong password",
+			config:   KeyExportConfig{Allowed: true, Password: "secret"},
+			password: "guess",
+			pub:      &priv.PublicKey,
+			wantErr:  ErrKeyExportDenied,
+		},
+		{
+			name:     "weak public key",
+			config:   KeyExportConfig{Allowed: true, Password: "secret"},
+			password: "secret",
+			pub:      &weak.PublicKey,
+			wantErr:  ErrKeyExportPublicKey,
+		},
+		{
+			name:     "missing public key",
+			config:   KeyExportConfig{Allowed: true, Password: "secret"},
+			password: "secret",
+			wantErr:  ErrKeyExportPublicKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{Mode: "cenc"})
+			if tt.disabled {
+				e, _ = NewEncryptor(Config{})
+			}
+
+			var attempts []KeyExportAttempt
+			x := NewKeyExporter(e, tt.config, func(a KeyExportAttempt) {
+				attempts = append(attempts, a)
+			})
+
+			export, err := x.Export("admin", tt.password, tt.pub)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Export() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && export.EncryptedKey != nil {
+				t.Errorf("Export() returned a key with error")
+			}
+
+			// every attempt is audited, failed ones included
+			if len(attempts) != 1 {
+				t.Fatalf("audited %d attempts, want 1", len(attempts))
+			}
+			if attempts[0].Actor != "admin" || !errors.Is(attempts[0].Err, tt.wantErr) {
+				t.Errorf("audited attempt = %+v, want actor admin and error %v", attempts[0], tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyExporter_encryption(t *testing.T) {
+	priv := newTestExportKey(t)
+
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+	x := NewKeyExporter(e, KeyExportConfig{Allowed: true, Password: "secret"}, nil)
+
+	export, err := x.Export("admin", "secret", &priv.PublicKey)
+	if err != nil {
+		t.Fatalf("Export() returned error: %s", err)
+	}
+
+	if export.KeyID != testKeyID {
+		t.Errorf("Export() key ID = %s, want %s", export.KeyID, testKeyID)
+	}
+
+	// the plaintext key is never part of the response
+	if hex.EncodeToString(export.EncryptedKey) == testKey {
+		t.Fatalf("Export() returned the plaintext key")
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, export.EncryptedKey, nil)
+	if err != nil {
+		t.Fatalf("DecryptOAEP() returned error: %s", err)
+	}
+
+	if got := hex.EncodeToString(key); got != testKey {
+		t.Errorf("decrypted key = %s, want %s", got, testKey)
+	}
+}
+
+func TestKeyExporter_rateLimit(t *testing.T) {
+	priv := newTestExportKey(t)
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+	x := NewKeyExporter(e, KeyExportConfig{Allowed: true, Password: "secret"}, nil)
+	x.now = clock.now
+
+	// offsets from the first successful export
+	steps := []struct {
+		after    time.Duration
+		password string
+		wantErr  error
+	}{
+		// failed attempts do not consume the allowance
+		{0, "guess", ErrKeyExportDenied},
+		{0, "secret", nil},
+		{time.Minute, "secret", ErrKeyExportRateLimited},
+		{59 * time.Minute, "secret", ErrKeyExportRateLimited},
+		{time.Hour, "secret", nil},
+	}
+
+	start := clock.t
+	for i, step := range steps {
+		clock.t = start.Add(step.after)
+
+		_, err := x.Export("admin", step.password, &priv.PublicKey)
+		if !errors.Is(err, step.wantErr) {
+			t.Errorf("step %d: Export() error = %v, want %v", i, err, step.wantErr)
+		}
+	}
+}
+
+func TestKeyExporter_lockout(t *testing.T) {
+	priv := newTestExportKey(t)
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+
+	var attempts []KeyExportAttempt
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+	x := NewKeyExporter(e, KeyExportConfig{Allowed: true, Password: "secret"}, func(a KeyExportAttempt) {
+		attempts = append(attempts, a)
+	})
+	x.now = clock.now
+
+	export := func(password string) error {
+		t.Helper()
+		_, err := x.Export("admin", password, &priv.PublicKey)
+		return err
+	}
+
+	// a good password in between resets the count
+	for i := 0; i < KeyExportMaxFailures-1; i++ {
+		if err := export("guess"); !errors.Is(err, ErrKeyExportDenied) {
+			t.Fatalf("guess %d: Export() error = %v, want %v", i, err, ErrKeyExportDenied)
+		}
+	}
+	if err := export("secret"); err != nil {
+		t.Fatalf("Export() returned error: %s", err)
+	}
+	if got := attempts[len(attempts)-1].Failures; got != 0 {
+		t.Errorf("Failures after a good password = %d, want 0", got)
+	}
+
+	for i := 0; i < KeyExportMaxFailures; i++ {
+		if err := export("guess"); !errors.Is(err, ErrKeyExportDenied) {
+			t.Fatalf("guess %d: Export() error = %v, want %v", i, err, ErrKeyExportDenied)
+		}
+	}
+	last := attempts[len(attempts)-1]
+	if last.Failures != KeyExportMaxFailures || !last.LockedUntil.Equal(clock.t.Add(KeyExportLockout)) {
+		t.Errorf("audited attempt = %+v, want %d failures locking for %s", last, KeyExportMaxFailures, KeyExportLockout)
+	}
+
+	// locked, not even the right password is checked
+	clock.t = clock.t.Add(KeyExportLockout - time.Second)
+	if err := export("secret"); !errors.Is(err, ErrKeyExportLocked) || !errors.Is(err, ErrKeyExportRateLimited) {
+		t.Errorf("Export() while locked error = %v, want %v", err, ErrKeyExportLocked)
+	}
+
+	// every further wrong password doubles the lockout up to the interval
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour} {
+		clock.t = x.lockedUntil
+		if err := export("guess"); !errors.Is(err, ErrKeyExportDenied) {
+			t.Fatalf("Export() error = %v, want %v", err, ErrKeyExportDenied)
+		}
+		if got := x.lockedUntil.Sub(clock.t); got != want {
+			t.Errorf("lockout after %d failures = %s, want %s", x.failures, got, want)
+		}
+	}
+
+	// the rate limit of successful exports still applies once unlocked
+	clock.t = x.lockedUntil
+	if err := export("secret"); err != nil {
+		t.Errorf("Export() after the lockout returned error: %s", err)
+	}
+	if x.failures != 0 {
+		t.Errorf("failures after a good password = %d, want 0", x.failures)
+	}
+}
@@ -0,0 +1,341 @@
+package drm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoProvider = errors.New("no key provider available")
+
+// ProviderProber is implemented by providers with a cheaper health check
+// than fetching all keys
+type ProviderProber interface {
+	Probe(ctx context.Context) error
+}
+
+// FileKeyProvider reads keys from a file on every request, one key_id:key:iv
+// per line with generations starting at 1, empty lines and lines starting
+// with # are skipped
+type FileKeyProvider struct {
+	path string
+	// how often Watch checks the file for changes
+	interval time.Duration
+}
+
+// FileWatchInterval is how often FileKeyProvider.Watch checks the file
+const FileWatchInterval = 5 * time.Second
+
+func NewFileKeyProvider(path string) *FileKeyProvider {
+	return &FileKeyProvider{path: path, interval: FileWatchInterval}
+}
+
+// GetKeys returns all keys of the file ordered by generation
+func (p *FileKeyProvider) GetKeys(ctx context.Context) ([]Key, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []Key
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, err := ParseKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", p.path, line, err)
+		}
+
+		key.Generation = uint64(len(keys) + 1)
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", p.path)
+	}
+
+	return keys, nil
+}
+
+// Watch sends the keys of the file whenever its modification time or size
+// changes, a file that cannot be read or parsed is retried at the next
+// check
+func (p *FileKeyProvider) Watch(ctx context.Context) <-chan []Key {
+	ch := make(chan []Key)
+
+	go func() {
+		defer close(ch)
+
+		var modTime time.Time
+		var size int64
+		if info, err := os.Stat(p.path); err == nil {
+			modTime, size = info.ModTime(), info.Size()
+		}
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(p.path)
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue
+			}
+
+			keys, err := p.GetKeys(ctx)
+			if err != nil {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+
+			select {
+			case ch <- keys:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// NamedProvider is a key provider identified in logs and key history
+type NamedProvider struct {
+	Name     string
+	Provider KeyProvider
+}
+
+// ProviderHealth is the last known state of a provider
+type ProviderHealth struct {
+	Name    string
+	Healthy bool
+	Err     error
+}
+
+// KeySource records which provider served a key generation
+type KeySource struct {
+	Time       time.Time
+	Generation uint64
+	KeyID      string
+	Provider   string
+}
+
+// ProviderFailover is published when keys are served by a different
+// provider than the previous generation, both when failing over and when
+// failing back
+type ProviderFailover struct {
+	Time time.Time
+	From string
+	To   string
+	// why the providers before To were skipped, nil on fail back
+	Err error
+}
+
+func (ProviderFailover) Type() EventType { return EventProviderFailover }
+
+// FailoverProvider serves keys from the highest priority healthy provider.
+//
+// GetKeys is meant to be called at generation boundaries only, the provider
+// chosen there serves the whole generation. A recovered primary is thus
+// used again from the next rotation on, never mid-generation.
+type FailoverProvider struct {
+	mu         sync.Mutex
+	providers  []NamedProvider
+	health     []ProviderHealth
+	active     int
+	history    []KeySource
+	onFailover func(f ProviderFailover)
+	now        func() time.Time
+}
+
+// NewFailoverProvider creates a provider trying the given providers in
+// order, all of them are considered healthy until probed
+func NewFailoverProvider(providers ...NamedProvider) *FailoverProvider {
+	health := make([]ProviderHealth, len(providers))
+	for i, p := range providers {
+		health[i] = ProviderHealth{Name: p.Name, Healthy: true}
+	}
+
+	return &FailoverProvider{
+		providers: providers,
+		health:    health,
+		active:    -1,
+		now:       time.Now,
+	}
+}
+
+// OnFailover sets a listener called whenever the serving provider changes
+func (p *FailoverProvider) OnFailover(listener func(f ProviderFailover)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.onFailover = listener
+}
+
+// Probe checks the health of all providers and returns those whose state
+// changed, it never changes the serving provider
+func (p *FailoverProvider) Probe(ctx context.Context) []ProviderHealth {
+	results := make([]error, len(p.providers))
+	for i, provider := range p.providers {
+		results[i] = probe(ctx, provider.Provider)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var changed []ProviderHealth
+	for i, err := range results {
+		healthy := err == nil
+		if p.health[i].Healthy != healthy {
+			changed = append(changed, ProviderHealth{Name: p.health[i].Name, Healthy: healthy, Err: err})
+		}
+		p.health[i].Healthy = healthy
+		p.health[i].Err = err
+	}
+
+	return changed
+}
+
+func probe(ctx context.Context, provider KeyProvider) error {
+	if prober, ok := provider.(ProviderProber); ok {
+		return prober.Probe(ctx)
+	}
+
+	_, err := provider.GetKeys(ctx)
+	return err
+}
+
+// Health returns the last known state of all providers in priority order
+func (p *FailoverProvider) Health() []ProviderHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health := make([]ProviderHealth, len(p.health))
+	copy(health, p.health)
+	return health
+}
+
+// GetKeys returns the keys of the highest priority healthy provider,
+// providers marked unhealthy are tried last. The providers are asked and
+// the failover listener is called without holding the lock.
+func (p *FailoverProvider) GetKeys(ctx context.Context) ([]Key, error) {
+	p.mu.Lock()
+	order := make([]int, 0, len(p.providers))
+	for _, healthy := range []bool{true, false} {
+		for i := range p.providers {
+			if p.health[i].Healthy == healthy {
+				order = append(order, i)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	var errs []error
+	for _, i := range order {
+		keys, err := p.providers[i].Provider.GetKeys(ctx)
+		if err == nil && len(keys) == 0 {
+			err = errors.New("no keys")
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.health[i].Healthy = false
+			p.health[i].Err = err
+			p.mu.Unlock()
+
+			errs = append(errs, fmt.Errorf("%s: %w", p.providers[i].Name, err))
+			continue
+		}
+
+		p.mu.Lock()
+		p.health[i].Healthy = true
+		p.health[i].Err = nil
+		failover, switched := p.serve(i, keys, errors.Join(errs...))
+		listener := p.onFailover
+		p.mu.Unlock()
+
+		if switched && listener != nil {
+			listener(failover)
+		}
+		return keys, nil
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrNoProvider, errors.Join(errs...))
+}
+
+// serve switches to the provider and records the current generation, it
+// returns the failover when the serving provider changed. The first keys
+// fail over from the primary provider when they come from another one.
+func (p *FailoverProvider) serve(i int, keys []Key, skipped error) (ProviderFailover, bool) {
+	now := p.now()
+
+	from := p.active
+	if from < 0 {
+		from = 0
+	}
+
+	var failover ProviderFailover
+	switched := from != i
+	if switched {
+		failover = ProviderFailover{
+			Time: now,
+			From: p.providers[from].Name,
+			To:   p.providers[i].Name,
+			Err:  skipped,
+		}
+	}
+	p.active = i
+
+	current, _ := CurrentKey(keys)
+	for _, source := range p.history {
+		if source.Generation == current.Generation && source.KeyID == current.KeyID {
+			return failover, switched
+		}
+	}
+
+	p.history = append(p.history, KeySource{
+		Time:       now,
+		Generation: current.Generation,
+		KeyID:      current.KeyID,
+		Provider:   p.providers[i].Name,
+	})
+	return failover, switched
+}
+
+// Active returns the name of the provider serving the current generation
+func (p *FailoverProvider) Active() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active < 0 {
+		return "", false
+	}
+	return p.providers[p.active].Name, true
+}
+
+// History returns the provider of every generation served so far
+func (p *FailoverProvider) History() []KeySource {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	history := make([]KeySource, len(p.history))
+	copy(history, p.history)
+	return history
+}
@@ -0,0 +1,185 @@
+package drm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// flakyProvider serves its keys unless it is down
+type flakyProvider struct {
+	keys []Key
+	down bool
+}
+
+func (p *flakyProvider) GetKeys(ctx context.Context) ([]Key, error) {
+	if p.down {
+		return nil, errors.New("connection refused")
+	}
+	return p.keys, nil
+}
+
+func TestFailoverProvider_rotation(t *testing.T) {
+	ctx := context.Background()
+
+	gen := func(g uint64) Key {
+		return Key{Generation: g, KeyID: testKeyID[:31] + string(rune('0'+g))}
+	}
+
+	primary := &flakyProvider{keys: []Key{gen(1)}}
+	secondary := &flakyProvider{keys: []Key{gen(1)}}
+
+	p := NewFailoverProvider(
+		NamedProvider{Name: "remote", Provider: primary},
+		NamedProvider{Name: "file", Provider: secondary},
+	)
+
+	var failovers []ProviderFailover
+	p.OnFailover(func(f ProviderFailover) {
+		failovers = append(failovers, f)
+	})
+
+	// startup
+	if _, err := p.GetKeys(ctx); err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+
+	// primary goes down right before a scheduled rotation
+	primary.down = true
+	primary.keys = append(primary.keys, gen(2))
+	secondary.keys = append(secondary.keys, gen(2))
+
+	keys, err := p.GetKeys(ctx)
+	if err != nil {
+		t.Fatalf("GetKeys() during outage returned error: %s", err)
+	}
+	if key, _ := CurrentKey(keys); key.Generation != 2 {
+		t.Errorf("rotated to generation %d, want 2", key.Generation)
+	}
+	if len(failovers) != 1 || failovers[0].From != "remote" || failovers[0].To != "file" || failovers[0].Err == nil {
+		t.Fatalf("failovers = %+v, want remote to file with the cause", failovers)
+	}
+
+	// primary recovers mid-generation, probing does not switch back
+	primary.down = false
+	changed := p.Probe(ctx)
+	if len(changed) != 1 || changed[0].Name != "remote" || !changed[0].Healthy {
+		t.Errorf("Probe() = %+v, want remote recovered", changed)
+	}
+	if active, _ := p.Active(); active != "file" {
+		t.Errorf("Active() after probe = %s, want file", active)
+	}
+
+	// fail back at the next rotation
+	primary.keys = append(primary.keys, gen(3))
+	if _, err := p.GetKeys(ctx); err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if len(failovers) != 2 || failovers[1].From != "file" || failovers[1].To != "remote" || failovers[1].Err != nil {
+		t.Errorf("failovers = %+v, want fail back to remote", failovers)
+	}
+
+	var got []string
+	for _, source := range p.History() {
+		got = append(got, source.Provider)
+	}
+	if want := []string{"remote", "file", "remote"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("History() providers = %v, want %v", got, want)
+	}
+
+	// all providers down
+	primary.down, secondary.down = true, true
+	if _, err := p.GetKeys(ctx); !errors.Is(err, ErrNoProvider) {
+		t.Errorf("GetKeys() error = %v, want %v", err, ErrNoProvider)
+	}
+}
+
+func TestFailoverProvider_startup(t *testing.T) {
+	primary := &flakyProvider{down: true}
+	secondary := &flakyProvider{keys: []Key{{Generation: 1, KeyID: testKeyID}}}
+
+	p := NewFailoverProvider(
+		NamedProvider{Name: "remote", Provider: primary},
+		NamedProvider{Name: "file", Provider: secondary},
+	)
+
+	// the listener may ask the provider about its state
+	var failovers []ProviderFailover
+	var health []ProviderHealth
+	p.OnFailover(func(f ProviderFailover) {
+		failovers = append(failovers, f)
+		health = p.Health()
+	})
+
+	if _, err := p.GetKeys(context.Background()); err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if len(failovers) != 1 || failovers[0].From != "remote" || failovers[0].To != "file" || failovers[0].Err == nil {
+		t.Errorf("failovers = %+v, want remote to file with the cause", failovers)
+	}
+	if len(health) != 2 || health[0].Healthy || !health[1].Healthy {
+		t.Errorf("Health() in the listener = %+v, want remote down and file up", health)
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# rotated weekly\n" +
+		testKeyID + ":" + testKey + ":" + testIV + "\n\n" +
+		testKeyID + ":" + testKey + ":" + testIV + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewFileKeyProvider(path).GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if len(keys) != 2 || keys[0].Generation != 1 || keys[1].Generation != 2 {
+		t.Errorf("GetKeys() = %+v, want generations 1 and 2", keys)
+	}
+
+	if _, err := NewFileKeyProvider(path + ".missing").GetKeys(context.Background()); err == nil {
+		t.Errorf("GetKeys() of a missing file returned no error")
+	}
+}
+
+func TestFileKeyProvider_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	line := testKeyID + ":" + testKey + ":" + testIV + "\n"
+	if err := os.WriteFile(path, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewFileKeyProvider(path)
+	p.interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := p.Watch(ctx)
+
+	// a broken file is skipped, the fixed one sent
+	if err := os.WriteFile(path, []byte(line+"broken\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte(line+line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case keys := <-ch:
+		if len(keys) != 2 || keys[1].Generation != 2 {
+			t.Errorf("Watch() sent %+v, want generations 1 and 2", keys)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Watch() sent no keys after the file changed")
+	}
+
+	cancel()
+	for range ch {
+	}
+}
@@ -0,0 +1,98 @@
+package drm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrFairPlayDisabled = errors.New("fairplay is not configured")
+	ErrFairPlayProfile  = errors.New("profile not supported by fairplay")
+)
+
+// FairPlayConfig enables FairPlay Streaming signaling. FairPlay only takes
+// cbcs with a constant IV, video with the 1:9 pattern.
+type FairPlayConfig struct {
+	// SKDURL is the skd:// key URI handed to clients, {keyId} is replaced
+	// by the hex encoded key ID and {keyIdUUID} by the key ID as UUID
+	SKDURL string
+	// CertificateURL serves the FairPlay application certificate clients
+	// set on their media keys before requesting a license
+	CertificateURL string
+}
+
+// Enabled reports whether FairPlay is configured
+func (c FairPlayConfig) Enabled() bool {
+	return c.SKDURL != ""
+}
+
+// SKDURI returns the key URI of a key ID
+func (c FairPlayConfig) SKDURI(keyID []byte) string {
+	return strings.NewReplacer(
+		"{keyId}", hex.EncodeToString(keyID),
+		"{keyIdUUID}", UUIDString(keyID),
+	).Replace(c.SKDURL)
+}
+
+func (c FairPlayConfig) validate() error {
+	if !strings.HasPrefix(c.SKDURL, "skd://") || strings.ContainsAny(c.SKDURL, "\"\r\n") {
+		return fmt.Errorf("fairplay skd url must be an skd:// URL, got %q", c.SKDURL)
+	}
+	return nil
+}
+
+// checkFairPlay rejects profiles FairPlay clients cannot decrypt, the
+// pattern does not apply to audio which is encrypted completely. The
+// constant IV comes with cbcs.
+func checkFairPlay(s *cipherState, audio bool) error {
+	if s.mode != "cbcs" {
+		return fmt.Errorf("%w: mode must be cbcs, got %s", ErrFairPlayProfile, s.mode)
+	}
+	if !audio {
+		return checkFairPlayPattern(s.cryptBlocks, s.skipBlocks)
+	}
+	return nil
+}
+
+func checkFairPlayPattern(cryptBlocks, skipBlocks int) error {
+	if cryptBlocks != 1 || skipBlocks != 9 {
+		return fmt.Errorf("%w: pattern must be 1:9, got %d:%d", ErrFairPlayProfile, cryptBlocks, skipBlocks)
+	}
+	return nil
+}
+
+// FairPlayInfo is the FairPlay signaling of DRMInfo
+type FairPlayInfo struct {
+	KeyFormat      string `json:"keyFormat"`
+	SKDURI         string `json:"skdUri"`
+	CertificateURL string `json:"certificateUrl,omitempty"`
+}
+
+// fairPlayInfo returns the FairPlay signaling of a key ID, nil when
+// FairPlay is not configured
+func (e *Encryptor) fairPlayInfo(keyID []byte) *FairPlayInfo {
+	if !e.fairPlay.Enabled() {
+		return nil
+	}
+	return &FairPlayInfo{
+		KeyFormat:      HLSKeyFormatFairPlay,
+		SKDURI:         e.fairPlay.SKDURI(keyID),
+		CertificateURL: e.fairPlay.CertificateURL,
+	}
+}
+
+// FairPlayKey returns the EXT-X-KEY of the current profile for FairPlay,
+// with the skd:// URI of its key ID
+func (e *Encryptor) FairPlayKey() (HLSKey, error) {
+	if !e.fairPlay.Enabled() {
+		return HLSKey{}, ErrFairPlayDisabled
+	}
+
+	s := e.state.Load()
+	if !e.enabled.Load() || s == nil {
+		return HLSKey{}, ErrProfileDisabled
+	}
+	return e.HLSKey(HLSKeyFormatFairPlay, e.fairPlay.SKDURI(s.keyID))
+}
@@ -0,0 +1,91 @@
+package drm
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testFairPlay = FairPlayConfig{
+	SKDURL:         "skd://keys.example.com/{keyId}?uuid={keyIdUUID}",
+	CertificateURL: "https://keys.example.com/fps.cer",
+}
+
+func TestFairPlayConfig_SKDURI(t *testing.T) {
+	got := testFairPlay.SKDURI(mustHex(testKeyID))
+	want := "skd://keys.example.com/00000000000000000000000000000001?uuid=00000000-0000-0000-0000-000000000001"
+	if got != want {
+		t.Errorf("SKDURI() = %s, want %s", got, want)
+	}
+}
+
+func TestNewEncryptor_fairPlay(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{"cbcs 1:9", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}, nil},
+		{"cbcs audio", Config{Mode: "cbcs", Codec: CodecAudio}, nil},
+		{"cenc", Config{Mode: "cenc"}, ErrFairPlayProfile},
+		{"cbcs 5:5", Config{Mode: "cbcs", CryptBlocks: 5, SkipBlocks: 5}, ErrFairPlayProfile},
+	}
+
+	for _, tt := range tests {
+		cfg := tt.cfg
+		cfg.Enabled, cfg.KeyID, cfg.Key, cfg.IV = true, testKeyID, testKey, testIV
+		cfg.FairPlay = testFairPlay
+
+		if _, err := NewEncryptor(cfg); !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+			t.Errorf("%s: NewEncryptor() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	cfg := Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, FairPlay: FairPlayConfig{SKDURL: "https://keys.example.com"}}
+	if _, err := NewEncryptor(cfg); err == nil || !strings.Contains(err.Error(), "skd://") {
+		t.Errorf("NewEncryptor() error = %v, want an skd:// URL required", err)
+	}
+}
+
+func TestEncryptor_fairPlay(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, FairPlay: testFairPlay})
+
+	key, err := e.FairPlayKey()
+	if err != nil {
+		t.Fatalf("FairPlayKey() returned error: %s", err)
+	}
+	want := `#EXT-X-KEY:METHOD=SAMPLE-AES,URI="` + testFairPlay.SKDURI(mustHex(testKeyID)) + `",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"`
+	if got := key.Tag(); got != want {
+		t.Errorf("FairPlayKey() tag = %s, want %s", got, want)
+	}
+
+	data, err := json.Marshal(e.Info())
+	if err != nil {
+		t.Fatalf("Marshal() returned error: %s", err)
+	}
+	var info struct {
+		FairPlay FairPlayInfo `json:"fairPlay"`
+	}
+	json.Unmarshal(data, &info)
+	if info.FairPlay.KeyFormat != HLSKeyFormatFairPlay || info.FairPlay.SKDURI != testFairPlay.SKDURI(mustHex(testKeyID)) || info.FairPlay.CertificateURL != testFairPlay.CertificateURL {
+		t.Errorf("Info() = %s, want the FairPlay signaling", data)
+	}
+
+	// profiles FairPlay cannot decrypt are refused
+	if err := e.ApplyProfile(Profile{Mode: "cenc", KeyID: testKeyID, Key: testKey, IV: testIV}); !errors.Is(err, ErrFairPlayProfile) {
+		t.Errorf("ApplyProfile() of cenc error = %v, want %v", err, ErrFairPlayProfile)
+	}
+	if err := e.SetPattern(Pattern{CryptBlocks: 2, SkipBlocks: 8}); !errors.Is(err, ErrFairPlayProfile) {
+		t.Errorf("SetPattern() error = %v, want %v", err, ErrFairPlayProfile)
+	}
+
+	// without FairPlay there is nothing to signal
+	plain := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if _, err := plain.FairPlayKey(); !errors.Is(err, ErrFairPlayDisabled) {
+		t.Errorf("FairPlayKey() error = %v, want %v", err, ErrFairPlayDisabled)
+	}
+	if plain.Info().FairPlay != nil {
+		t.Errorf("Info().FairPlay = %+v, want nil", plain.Info().FairPlay)
+	}
+}
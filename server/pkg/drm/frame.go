@@ -0,0 +1,316 @@
+package drm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Wire versions of the frame header, old clients only know the earlier
+const (
+	// FrameHeaderV1 carries the IV and the subsamples, the scheme and
+	// pattern are those of the DRM info of the client. It is the header
+	// of the constant IV cbcs and cenc streams.
+	FrameHeaderV1 = 1
+	// FrameHeaderV2 adds the scheme and pattern of every frame
+	FrameHeaderV2 = 2
+)
+
+// FrameHeaderVersion is the version of the frame header written unless
+// another was negotiated
+const FrameHeaderVersion = FrameHeaderV1
+
+// FrameHeaderVersions lists the frame header versions the encryptor
+// writes, for clients to pick from
+var FrameHeaderVersions = []int{FrameHeaderV1, FrameHeaderV2}
+
+// scheme identifiers of FrameHeaderV2, 0 is left for clear frames
+var frameSchemes = []string{"", "cenc", "cbc1", "cens", "cbcs"}
+
+var (
+	ErrFrameHeader           = errors.New("malformed frame header")
+	ErrFrameHeaderVersion    = errors.New("unsupported frame header version")
+	ErrFrameHeaderSubsamples = errors.New("too many subsamples for a frame header")
+	ErrFrameHeaderIV         = errors.New("frame header IV must be 8 or 16 bytes")
+)
+
+// FrameHeader is the per-frame metadata the rtc-drm-transform decryptor
+// of the browser needs to decrypt an encoded frame, once keys rotate or
+// per-sample IVs are used nothing about a frame is constant anymore:
+//
+//	version u8 | iv length u8 | iv | subsample count u16 |
+//	count * (clear u16, protected u32)
+//
+// FrameHeaderV2 follows the version with the scheme u8, 1 cenc, 2 cbc1,
+// 3 cens and 4 cbcs, and the pattern u8, crypt blocks in the high and skip
+// blocks in the low nibble.
+//
+// A frame without protected bytes, such as parameter sets delivered on
+// their own, has the IV length 0 and no subsamples, and with FrameHeaderV2
+// the scheme and pattern 0; the decryptor passes it through unchanged.
+type FrameHeader struct {
+	// FrameHeaderVersion when 0
+	Version int
+	// scheme and pattern of FrameHeaderV2, empty with FrameHeaderV1
+	Scheme      string
+	CryptBlocks int
+	SkipBlocks  int
+	// per-sample IV of SampleIVSize or 16-byte constant IV, nil for clear
+	// frames
+	IV         []byte
+	Subsamples []SubsampleInfo
+}
+
+// Encrypted reports whether the frame has protected bytes
+func (h FrameHeader) Encrypted() bool {
+	for _, s := range h.Subsamples {
+		if s.BytesOfProtectedData > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFrameHeaderVersion rejects versions the encryptor does not write
+func checkFrameHeaderVersion(version int) error {
+	if !slices.Contains(FrameHeaderVersions, version) {
+		return fmt.Errorf("%w: %d", ErrFrameHeaderVersion, version)
+	}
+	return nil
+}
+
+// Append appends the encoded header to dst
+func (h FrameHeader) Append(dst []byte) ([]byte, error) {
+	version := h.Version
+	if version == 0 {
+		version = FrameHeaderVersion
+	}
+	if err := checkFrameHeaderVersion(version); err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, byte(version))
+	if !h.Encrypted() {
+		if version == FrameHeaderV2 {
+			dst = append(dst, 0, 0)
+		}
+		return append(dst, 0, 0, 0), nil
+	}
+
+	if version == FrameHeaderV2 {
+		scheme := slices.Index(frameSchemes, h.Scheme)
+		if scheme <= 0 {
+			return nil, fmt.Errorf("%w: unknown scheme %q", ErrFrameHeader, h.Scheme)
+		}
+		if h.CryptBlocks < 0 || h.CryptBlocks > 15 || h.SkipBlocks < 0 || h.SkipBlocks > 15 {
+			return nil, fmt.Errorf("%w: pattern %d:%d does not fit", ErrFrameHeader, h.CryptBlocks, h.SkipBlocks)
+		}
+		dst = append(dst, byte(scheme), byte(h.CryptBlocks<<4|h.SkipBlocks))
+	}
+
+	if len(h.IV) != 8 && len(h.IV) != 16 {
+		return nil, fmt.Errorf("%w, got %d", ErrFrameHeaderIV, len(h.IV))
+	}
+	if len(h.Subsamples) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: %d", ErrFrameHeaderSubsamples, len(h.Subsamples))
+	}
+
+	dst = append(dst, byte(len(h.IV)))
+	dst = append(dst, h.IV...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(h.Subsamples)))
+
+	for _, s := range h.Subsamples {
+		if s.BytesOfClearData > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: %d clear bytes in a subsample", ErrFrameHeader, s.BytesOfClearData)
+		}
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.BytesOfClearData))
+		dst = binary.BigEndian.AppendUint32(dst, s.BytesOfProtectedData)
+	}
+
+	return dst, nil
+}
+
+// ParseFrameHeader splits a frame with a prepended header into the header
+// and the payload, both alias the frame. The subsamples of an encrypted
+// frame must cover the payload exactly.
+func ParseFrameHeader(frame []byte) (FrameHeader, []byte, error) {
+	if len(frame) < 4 {
+		return FrameHeader{}, nil, ErrFrameHeader
+	}
+
+	h := FrameHeader{Version: int(frame[0])}
+	if err := checkFrameHeaderVersion(h.Version); err != nil {
+		return FrameHeader{}, nil, err
+	}
+
+	pos := 1
+	var scheme int
+	if h.Version == FrameHeaderV2 {
+		if len(frame) < 6 {
+			return FrameHeader{}, nil, ErrFrameHeader
+		}
+		scheme = int(frame[1])
+		if scheme >= len(frameSchemes) {
+			return FrameHeader{}, nil, fmt.Errorf("%w: unknown scheme %d", ErrFrameHeader, scheme)
+		}
+		h.Scheme = frameSchemes[scheme]
+		h.CryptBlocks, h.SkipBlocks = int(frame[2]>>4), int(frame[2]&0x0f)
+		pos += 2
+	}
+
+	ivLen := int(frame[pos])
+	pos++
+	if len(frame) < pos+ivLen+2 {
+		return FrameHeader{}, nil, ErrFrameHeader
+	}
+
+	if ivLen > 0 {
+		h.IV = frame[pos : pos+ivLen]
+	}
+
+	pos += ivLen
+	count := int(binary.BigEndian.Uint16(frame[pos:]))
+	pos += 2
+
+	// the clear marker has neither IV nor subsamples, nor a scheme
+	if (ivLen == 0) != (count == 0) || h.Version == FrameHeaderV2 && (ivLen == 0) != (scheme == 0) {
+		return FrameHeader{}, nil, ErrFrameHeader
+	}
+	if ivLen == 0 {
+		return h, frame[pos:], nil
+	}
+	if ivLen != 8 && ivLen != 16 {
+		return FrameHeader{}, nil, fmt.Errorf("%w, got %d", ErrFrameHeaderIV, ivLen)
+	}
+
+	if len(frame) < pos+6*count {
+		return FrameHeader{}, nil, ErrFrameHeader
+	}
+
+	var total int
+	h.Subsamples = make([]SubsampleInfo, count)
+	for i := range h.Subsamples {
+		entry := frame[pos+6*i:]
+		h.Subsamples[i] = SubsampleInfo{
+			BytesOfClearData:     uint32(binary.BigEndian.Uint16(entry)),
+			BytesOfProtectedData: binary.BigEndian.Uint32(entry[2:]),
+		}
+		total += int(h.Subsamples[i].BytesOfClearData) + int(h.Subsamples[i].BytesOfProtectedData)
+	}
+
+	payload := frame[pos+6*count:]
+	if total != len(payload) {
+		return FrameHeader{}, nil, fmt.Errorf("%w: subsamples cover %d of %d bytes", ErrFrameHeader, total, len(payload))
+	}
+
+	return h, payload, nil
+}
+
+// EncryptedFrame is an encrypted access unit with its frame header
+type EncryptedFrame struct {
+	EncryptedSample
+	Header FrameHeader
+}
+
+// EncryptFrame encrypts like EncryptSample and returns the frame header
+// describing the ciphertext. With Config.PrependFrameHeader the encoded
+// header is prepended to Data, the subsamples describe the bytes after it.
+func (e *Encryptor) EncryptFrame(data []byte) (EncryptedFrame, error) {
+	return e.EncryptFrameTo(nil, data)
+}
+
+// EncryptFrameTo encrypts like EncryptFrame into the storage of dst, as
+// EncryptTo does. The input is never modified, also when the encryptor is
+// disabled and the frame is passed through clear.
+func (e *Encryptor) EncryptFrameTo(dst, src []byte) (EncryptedFrame, error) {
+	return e.EncryptFrameVersionTo(dst, src, e.WireVersion())
+}
+
+// EncryptFrameVersionTo encrypts like EncryptFrameTo with the frame header
+// of the given version, for consumers that negotiated their own
+func (e *Encryptor) EncryptFrameVersionTo(dst, src []byte, version int) (EncryptedFrame, error) {
+	if err := checkFrameHeaderVersion(version); err != nil {
+		return EncryptedFrame{}, err
+	}
+
+	var sample EncryptedSample
+	if !e.enabled.Load() || len(src) == 0 {
+		var clear subsampleMap
+		sample = EncryptedSample{Data: append(dst[:0], src...), Subsamples: clear.finish(len(src))}
+	} else {
+		var err error
+		if sample, err = e.encryptSample(dst, src, keyframeDetect); err != nil {
+			return EncryptedFrame{}, err
+		}
+	}
+
+	frame := EncryptedFrame{
+		EncryptedSample: sample,
+		Header:          FrameHeader{Version: version, IV: sample.IV, Subsamples: sample.Subsamples},
+	}
+	if frame.Header.IV == nil {
+		frame.Header.IV = sample.constantIV
+	}
+	if s := sample.state; version == FrameHeaderV2 && s != nil {
+		frame.Header.Scheme, frame.Header.CryptBlocks, frame.Header.SkipBlocks = s.mode, s.cryptBlocks, s.skipBlocks
+		if !PatternScheme(s.mode) {
+			frame.Header.CryptBlocks, frame.Header.SkipBlocks = 0, 0
+		}
+	}
+	if !frame.Header.Encrypted() {
+		frame.Header = FrameHeader{Version: version}
+	}
+
+	if !e.prependFrameHeader {
+		return frame, nil
+	}
+
+	header, err := frame.Header.Append(nil)
+	if err != nil {
+		return EncryptedFrame{}, err
+	}
+
+	// the ciphertext moves behind the header within its buffer
+	size, n := len(header), len(frame.Data)
+	data := slices.Grow(frame.Data, size)[:n+size]
+	copy(data[size:], data[:n])
+	copy(data, header)
+	e.stats.add(func(shard *statsShard) { shard.overheadBytes.Add(uint64(size)) })
+
+	frame.Data = data
+	return frame, nil
+}
+
+// PrependsFrameHeader reports whether EncryptFrame prepends the frame
+// header to the ciphertext
+func (e *Encryptor) PrependsFrameHeader() bool {
+	return e.prependFrameHeader
+}
+
+// SetWireVersion sets the frame header version EncryptFrame writes, also
+// for the layers of ForLayer, FrameHeaderVersion until set. Consumers that
+// negotiated a version of their own use EncryptFrameVersionTo instead.
+func (e *Encryptor) SetWireVersion(version int) error {
+	if err := checkFrameHeaderVersion(version); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.wireVersion.Store(int32(version))
+	for _, layer := range e.layers {
+		layer.wireVersion.Store(int32(version))
+	}
+	return nil
+}
+
+// WireVersion returns the frame header version EncryptFrame writes
+func (e *Encryptor) WireVersion() int {
+	if version := e.wireVersion.Load(); version != 0 {
+		return int(version)
+	}
+	return FrameHeaderVersion
+}
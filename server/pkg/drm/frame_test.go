@@ -0,0 +1,172 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptFrame(t *testing.T) {
+	block, _ := aes.NewCipher(mustHex(testKey))
+	params := h264Params{}
+	frames := append([][]byte{bytes.Join([][]byte{params.sps(), params.pps()}, nil)}, h264Stream()...)
+
+	for _, cfg := range []Config{
+		{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+		{Mode: "cenc"},
+	} {
+		cfg.PrependFrameHeader = true
+		e := newTestEncryptor(t, cfg)
+
+		for i, frame := range frames {
+			source := append([]byte{}, frame...)
+
+			got, err := e.EncryptFrame(frame)
+			if err != nil {
+				t.Fatalf("%s frame %d: EncryptFrame() returned error: %s", cfg.Mode, i, err)
+			}
+			if !bytes.Equal(frame, source) {
+				t.Fatalf("%s frame %d: EncryptFrame() modified its input", cfg.Mode, i)
+			}
+
+			header, payload, err := ParseFrameHeader(got.Data)
+			if err != nil {
+				t.Fatalf("%s frame %d: ParseFrameHeader() returned error: %s", cfg.Mode, i, err)
+			}
+			if !reflect.DeepEqual(header, got.Header) {
+				t.Errorf("%s frame %d: ParseFrameHeader() = %+v, want %+v", cfg.Mode, i, header, got.Header)
+			}
+
+			// parameter sets on their own and short slices pass through
+			if i == 0 && header.Encrypted() {
+				t.Errorf("%s: parameter sets have header %+v, want the clear marker", cfg.Mode, header)
+			}
+			if !header.Encrypted() {
+				if header.IV != nil || !bytes.Equal(payload, source) {
+					t.Errorf("%s frame %d: clear frame has header %+v and a modified payload", cfg.Mode, i, header)
+				}
+				continue
+			}
+
+			wantIV := mustHex(testIV)
+			if cfg.Mode == "cenc" {
+				wantIV = got.IV
+			}
+			if !bytes.Equal(header.IV, wantIV) {
+				t.Errorf("%s frame %d: header IV = %x, want %x", cfg.Mode, i, header.IV, wantIV)
+			}
+
+			sp := SampleParams{Scheme: cfg.Mode, IV: header.IV, CryptBlocks: cfg.CryptBlocks, SkipBlocks: cfg.SkipBlocks, Escaped: true}
+			plain, err := DecryptSample(block, sp, payload, header.Subsamples)
+			if err != nil || !bytes.Equal(plain, source) {
+				t.Errorf("%s frame %d: decrypted payload does not match source: %v", cfg.Mode, i, err)
+			}
+		}
+	}
+}
+
+func TestEncryptFrame_noPrepend(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	reference := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	for i, frame := range h264Stream() {
+		got, err := e.EncryptFrame(frame)
+		if err != nil {
+			t.Fatalf("frame %d: EncryptFrame() returned error: %s", i, err)
+		}
+		want, _ := reference.EncryptSample(frame)
+
+		if !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("frame %d: EncryptFrame() data differs from EncryptSample()", i)
+		}
+		if got.Header.Encrypted() && !reflect.DeepEqual(got.Header.Subsamples, want.Subsamples) {
+			t.Errorf("frame %d: header subsamples = %v, want %v", i, got.Header.Subsamples, want.Subsamples)
+		}
+	}
+}
+
+func TestParseFrameHeader_malformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"short", []byte{1, 0, 0}, ErrFrameHeader},
+		{"version", []byte{3, 0, 0, 0}, ErrFrameHeaderVersion},
+		{"v2 short", []byte{2, 0, 0, 0, 0}, ErrFrameHeader},
+		{"v2 scheme", append(append([]byte{2, 9, 0x19, 8}, make([]byte, 8)...), 0, 1, 0, 0, 0, 0, 0, 0), ErrFrameHeader},
+		{"v2 clear marker with scheme", []byte{2, 4, 0x19, 0, 0, 0}, ErrFrameHeader},
+		{"IV without subsamples", append(append([]byte{1, 8}, make([]byte, 8)...), 0, 0), ErrFrameHeader},
+		{"subsamples without IV", []byte{1, 0, 0, 1, 0, 0, 0, 0, 0, 0}, ErrFrameHeader},
+		{"IV length", append(append([]byte{1, 4}, make([]byte, 4)...), 0, 1, 0, 0, 0, 0, 0, 0), ErrFrameHeaderIV},
+		{"truncated subsamples", append(append([]byte{1, 8}, make([]byte, 8)...), 0, 2, 0, 0, 0, 0, 0, 0), ErrFrameHeader},
+		{"subsamples exceed payload", append(append([]byte{1, 8}, make([]byte, 8)...), 0, 1, 0, 1, 0, 0, 0, 16), ErrFrameHeader},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := ParseFrameHeader(tt.frame); !errors.Is(err, tt.err) {
+			t.Errorf("%s: ParseFrameHeader() error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestEncryptFrame_wireVersion(t *testing.T) {
+	block, _ := aes.NewCipher(mustHex(testKey))
+	frames := h264Stream()
+
+	for _, cfg := range []Config{
+		{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+		{Mode: "cenc"},
+	} {
+		cfg.PrependFrameHeader = true
+		e := newTestEncryptor(t, cfg)
+
+		for i, frame := range frames {
+			got, err := e.EncryptFrameVersionTo(nil, frame, FrameHeaderV2)
+			if err != nil {
+				t.Fatalf("%s frame %d: EncryptFrameVersionTo() returned error: %s", cfg.Mode, i, err)
+			}
+
+			header, payload, err := ParseFrameHeader(got.Data)
+			if err != nil {
+				t.Fatalf("%s frame %d: ParseFrameHeader() returned error: %s", cfg.Mode, i, err)
+			}
+			if !reflect.DeepEqual(header, got.Header) || header.Version != FrameHeaderV2 {
+				t.Errorf("%s frame %d: ParseFrameHeader() = %+v, want %+v", cfg.Mode, i, header, got.Header)
+			}
+			if !header.Encrypted() {
+				continue
+			}
+
+			// the frame names everything needed to decrypt it
+			if header.Scheme != cfg.Mode || header.CryptBlocks != cfg.CryptBlocks || header.SkipBlocks != cfg.SkipBlocks {
+				t.Errorf("%s frame %d: header scheme %s %d:%d", cfg.Mode, i, header.Scheme, header.CryptBlocks, header.SkipBlocks)
+			}
+			sp := SampleParams{Scheme: header.Scheme, IV: header.IV, CryptBlocks: header.CryptBlocks, SkipBlocks: header.SkipBlocks, Escaped: true}
+			if plain, err := DecryptSample(block, sp, payload, header.Subsamples); err != nil || !bytes.Equal(plain, frame) {
+				t.Errorf("%s frame %d: decrypted payload does not match source: %v", cfg.Mode, i, err)
+			}
+		}
+	}
+
+	// the default of EncryptFrame
+	e := newTestEncryptor(t, Config{Mode: "cbcs", PrependFrameHeader: true})
+	if err := e.SetWireVersion(3); !errors.Is(err, ErrFrameHeaderVersion) {
+		t.Errorf("SetWireVersion(3) error = %v, want %v", err, ErrFrameHeaderVersion)
+	}
+	if err := e.SetWireVersion(FrameHeaderV2); err != nil || e.WireVersion() != FrameHeaderV2 {
+		t.Fatalf("SetWireVersion() = %v, version %d", err, e.WireVersion())
+	}
+	got, err := e.EncryptFrame(frames[0])
+	if err != nil {
+		t.Fatalf("EncryptFrame() returned error: %s", err)
+	}
+	if got.Data[0] != FrameHeaderV2 || got.Header.Scheme != "cbcs" {
+		t.Errorf("EncryptFrame() header = %+v, want version 2", got.Header)
+	}
+	if _, err := e.EncryptFrameVersionTo(nil, frames[0], 0); !errors.Is(err, ErrFrameHeaderVersion) {
+		t.Errorf("EncryptFrameVersionTo() of version 0 error = %v, want %v", err, ErrFrameHeaderVersion)
+	}
+}
@@ -0,0 +1,113 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// TestEncryptor_golden pins the encrypted output and subsamples of a set of
+// streams, changes to how access units are walked must not change a byte
+func TestEncryptor_golden(t *testing.T) {
+	params := h264Params{high: true, cabac: true, weightedBipred: 1}
+	idr, _ := params.slice(0x65, sliceHeaderCases[0].fields, 700)
+	b, _ := params.slice(0x01, sliceHeaderCases[4].fields, 300)
+	h264 := [][]byte{
+		bytes.Join([][]byte{params.sps(), params.pps(), nalUnit(0x06, 30), idr}, nil),
+		bytes.Join([][]byte{nalUnit(0x09, 1), b, b}, nil),
+		// 3-byte start codes, an unparsed slice and trailing zero bytes
+		append(append([]byte{0, 0, 1, 0x41}, bytes.Repeat([]byte{0, 0, 3, 0xaa}, 60)...), 0x80, 0, 0),
+		shortSliceFrame(3),
+	}
+
+	hevc := [][]byte{
+		bytes.Join([][]byte{hevcNAL(32, 20), hevcNAL(33, 40), hevcNAL(34, 20), hevcNAL(19, 500)}, nil),
+		hevcNAL(1, 300),
+	}
+
+	var avcc [][]byte
+	for _, frame := range h264[:2] {
+		avcc = append(avcc, lengthPrefixed(frame, 2))
+	}
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		frames [][]byte
+		want   string
+	}{
+		{
+			name:   "cbcs",
+			cfg:    Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+			frames: h264,
+			want:   "40f0af267da9bdb6dde5a1df1850ff93f90122aa26e3cde99a187c802b4f03ba",
+		},
+		{
+			name:   "cbcs full",
+			cfg:    Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 0},
+			frames: h264,
+			want:   "de4fd42cd25ef08c2a50e25e96595124d6654df29d9d8ba2aeb8879bf53d9a6d",
+		},
+		{
+			name:   "cenc",
+			cfg:    Config{Mode: "cenc", EncryptShortNALs: ShortNALsCTR},
+			frames: h264,
+			want:   "b1f40c843411ead1485447b1e98b3d943db219e2752db4f7b7a10405330c2e38",
+		},
+		{
+			name:   "cbcs key sei",
+			cfg:    Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeySEI: true},
+			frames: h264,
+			want:   "43c6f35489daeb1033586d472521053c6f6f12991b00b4ce36a0a0ba48260511",
+		},
+		{
+			name:   "cenc key sei",
+			cfg:    Config{Mode: "cenc", KeySEI: true},
+			frames: h264,
+			want:   "2c50409291cdff3dc32e7d3ae4e5e122802176bb09f02f2945c2bce14acc6cef",
+		},
+		{
+			name:   "hevc cbcs",
+			cfg:    Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265},
+			frames: hevc,
+			want:   "8c6a431fc41319de6207ca9597d5ad549bfd7a1d1cb69b83ebb7ade4816c3426",
+		},
+		{
+			name:   "hevc cenc",
+			cfg:    Config{Mode: "cenc", Codec: CodecH265},
+			frames: hevc,
+			want:   "74dbce78291a0a4c93a6f9fe122d75f51de4fd800cbb4e1ba08b0b863871c4b6",
+		},
+		{
+			name:   "avcc",
+			cfg:    Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, NALFormat: NALFormatAVCC, NALLengthSize: 2},
+			frames: avcc,
+			want:   "5342b609adc04157b92ade8aa3db2c760529239cbebaf3cd0f23f0d4e3e077b2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, tt.cfg)
+
+			h := sha256.New()
+			for i, frame := range tt.frames {
+				sample, err := e.EncryptSample(frame)
+				if err != nil {
+					t.Fatalf("frame %d: EncryptSample() returned error: %s", i, err)
+				}
+
+				h.Write(sample.Data)
+				for _, sub := range sample.Subsamples {
+					binary.Write(h, binary.BigEndian, sub)
+				}
+			}
+
+			if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+				t.Errorf("output digest = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
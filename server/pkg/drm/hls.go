@@ -0,0 +1,91 @@
+package drm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Key formats of HLS EXT-X-KEY tags
+const (
+	HLSKeyFormatIdentity = "identity"
+	HLSKeyFormatFairPlay = "com.apple.streamingkeydelivery"
+	HLSKeyFormatClearKey = "org.w3.clearkey"
+)
+
+// HLSMethodSampleAES is the EXT-X-KEY method of cbcs protected fMP4
+const HLSMethodSampleAES = "SAMPLE-AES"
+
+var ErrHLSScheme = errors.New("SAMPLE-AES requires the cbcs scheme")
+
+// HLSKey holds the attributes of an EXT-X-KEY or EXT-X-SESSION-KEY tag,
+// empty ones are left out
+type HLSKey struct {
+	Method            string
+	URI               string
+	KeyFormat         string
+	KeyFormatVersions string
+	IV                string // 0x prefixed hex
+}
+
+// Attributes returns the attribute list of the tag
+func (k HLSKey) Attributes() string {
+	attrs := []string{"METHOD=" + k.Method}
+	if k.URI != "" {
+		attrs = append(attrs, `URI="`+k.URI+`"`)
+	}
+	if k.KeyFormat != "" {
+		attrs = append(attrs, `KEYFORMAT="`+k.KeyFormat+`"`)
+	}
+	if k.KeyFormatVersions != "" {
+		attrs = append(attrs, `KEYFORMATVERSIONS="`+k.KeyFormatVersions+`"`)
+	}
+	if k.IV != "" {
+		attrs = append(attrs, "IV="+k.IV)
+	}
+	return strings.Join(attrs, ",")
+}
+
+// Tag returns the EXT-X-KEY tag of media playlists
+func (k HLSKey) Tag() string {
+	return "#EXT-X-KEY:" + k.Attributes()
+}
+
+// SessionTag returns the EXT-X-SESSION-KEY tag of multivariant playlists,
+// letting clients prepare the key before loading a media playlist
+func (k HLSKey) SessionTag() string {
+	return "#EXT-X-SESSION-KEY:" + k.Attributes()
+}
+
+// HLSKey returns the key of the current profile for HLS in the key format,
+// identity when empty, with the key or license at uri, the key variables of
+// ExpandLicenseURL substituted. Only cbcs can be
+// signaled as SAMPLE-AES. The IV is given for constant IVs unless the key
+// format delivers it, FairPlay with the key; per-sample IVs are in senc.
+func (e *Encryptor) HLSKey(keyFormat, uri string) (HLSKey, error) {
+	s := e.state.Load()
+	if !e.enabled.Load() || s == nil {
+		return HLSKey{}, ErrProfileDisabled
+	}
+	if s.mode != "cbcs" {
+		return HLSKey{}, fmt.Errorf("%w, got %s", ErrHLSScheme, s.mode)
+	}
+	if uri == "" || strings.ContainsAny(uri, "\"\r\n") {
+		return HLSKey{}, fmt.Errorf("key uri must be a non-empty quoted-string, got %q", uri)
+	}
+
+	key := HLSKey{Method: HLSMethodSampleAES, URI: ExpandLicenseURL(uri, s.keyID, "")}
+
+	// identity is the default key format
+	if keyFormat != "" && keyFormat != HLSKeyFormatIdentity {
+		key.KeyFormat = keyFormat
+		key.KeyFormatVersions = "1"
+	}
+
+	if s.ivMode == IVModeConstant && keyFormat != HLSKeyFormatFairPlay {
+		key.IV = "0x" + strings.ToUpper(hex.EncodeToString(s.iv))
+	}
+
+	return key, nil
+}
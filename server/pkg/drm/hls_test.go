@@ -0,0 +1,71 @@
+package drm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEncryptor_HLSKey(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	tests := []struct {
+		name      string
+		keyFormat string
+		uri       string
+		want      string
+	}{
+		{
+			name: "identity",
+			uri:  "https://example.com/key",
+			want: `#EXT-X-KEY:METHOD=SAMPLE-AES,URI="https://example.com/key",IV=0xD5FBD6B82ED93E4EF98AE40931EE33B7`,
+		},
+		{
+			name:      "clearkey",
+			keyFormat: HLSKeyFormatClearKey,
+			uri:       "https://example.com/api/drm/license",
+			want:      `#EXT-X-KEY:METHOD=SAMPLE-AES,URI="https://example.com/api/drm/license",KEYFORMAT="org.w3.clearkey",KEYFORMATVERSIONS="1",IV=0xD5FBD6B82ED93E4EF98AE40931EE33B7`,
+		},
+		{
+			name: "key id of the template",
+			uri:  "https://example.com/license/{keyIdUUID}",
+			want: `#EXT-X-KEY:METHOD=SAMPLE-AES,URI="https://example.com/license/` + UUIDString(mustHex(testKeyID)) + `",IV=0xD5FBD6B82ED93E4EF98AE40931EE33B7`,
+		},
+		{
+			name:      "fairplay delivers the iv",
+			keyFormat: HLSKeyFormatFairPlay,
+			uri:       "skd://00000000000000000000000000000001",
+			want:      `#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://00000000000000000000000000000001",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		key, err := e.HLSKey(tt.keyFormat, tt.uri)
+		if err != nil {
+			t.Fatalf("%s: HLSKey() returned error: %s", tt.name, err)
+		}
+		if got := key.Tag(); got != tt.want {
+			t.Errorf("%s: Tag() = %s, want %s", tt.name, got, tt.want)
+		}
+		if got, want := key.SessionTag(), "#EXT-X-SESSION-KEY:"+key.Attributes(); got != want {
+			t.Errorf("%s: SessionTag() = %s, want %s", tt.name, got, want)
+		}
+	}
+
+	if _, err := e.HLSKey("", `https://example.com/"key"`); err == nil {
+		t.Errorf("HLSKey() accepted a uri with quotes")
+	}
+}
+
+func TestEncryptor_HLSKeyScheme(t *testing.T) {
+	for _, mode := range []string{"cenc", "cens", "cbc1"} {
+		e := newTestEncryptor(t, Config{Mode: mode, CryptBlocks: 1, SkipBlocks: 9})
+		if _, err := e.HLSKey("", "https://example.com/key"); !errors.Is(err, ErrHLSScheme) {
+			t.Errorf("%s: HLSKey() error = %v, want %v", mode, err, ErrHLSScheme)
+		}
+	}
+
+	disabled, _ := NewEncryptor(Config{})
+	if _, err := disabled.HLSKey("", "https://example.com/key"); !errors.Is(err, ErrProfileDisabled) {
+		t.Errorf("HLSKey() of a disabled encryptor error = %v, want %v", err, ErrProfileDisabled)
+	}
+}
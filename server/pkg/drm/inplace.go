@@ -0,0 +1,234 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"time"
+)
+
+// ErrNotInPlace is returned by EncryptInPlace when the ciphertext of an
+// access unit would not have the length of its plaintext, it has to be
+// encrypted with Encrypt instead
+var ErrNotInPlace = errors.New("access unit cannot be encrypted in place")
+
+// EncryptInPlace encrypts an access unit like Encrypt, but in the buffer
+// given instead of a new one. The buffer holds the ciphertext afterwards,
+// it must not be shared with anyone expecting the plaintext.
+//
+// Only Annex B access units whose length and format do not change are
+// encrypted in place: payloads carrying emulation prevention bytes or with
+// ciphertext that would need them, KeySEI, an OutputNALFormat and paranoid
+// checks fail with ErrNotInPlace and leave the buffer and the sample IV
+// untouched.
+func (e *Encryptor) EncryptInPlace(data []byte) error {
+	if !e.enabled.Load() || len(data) == 0 {
+		return nil
+	}
+
+	// paused without a pending toggle, the buffer stays clear
+	if !e.active.Load() && !e.toggling.Load() {
+		e.stats.add(countClear)
+		return nil
+	}
+
+	if e.format.format != NALFormatAnnexB || e.format.output != "" || e.keySEI || e.paranoid || e.encryptAU != nil {
+		return ErrNotInPlace
+	}
+
+	if err := e.checkReencryption(data, data); err != nil {
+		e.stats.add(countStrictRejection)
+		return err
+	}
+
+	// rejected before a staged profile could be switched to
+	if e.checker != nil {
+		if err := e.checker.check(data); err != nil {
+			e.stats.add(countStreamViolation)
+			return err
+		}
+	}
+
+	enc := e.encryption()
+	defer e.encryptions.Put(enc)
+
+	var vcl bool
+	if e.strict {
+		var err error
+		if vcl, err = enc.checkStrict(data); err != nil {
+			e.stats.add(countStrictRejection)
+			return err
+		}
+	}
+
+	// the switch stays when falling back to Encrypt, it is due either way
+	e.switchIfDue(data, keyframeDetect)
+	if !e.active.Load() {
+		e.stats.add(countClear)
+		return nil
+	}
+
+	// counted by Encrypt instead when falling back to it
+	enc.stats = e.stats.enter()
+
+	start := time.Now()
+
+	s := e.state.Load()
+	sampleIV, sampleIndex := s.nextSampleIV()
+
+	var err error
+	if e.codec.isAudio() {
+		enc.inPlace = enc.inPlace[:0]
+		if enc.encryptAudioInPlace(s, sampleIV, data) {
+			enc.inPlace = append(enc.inPlace, [2]int{0, len(data)})
+		}
+	} else {
+		err = enc.encryptNALsInPlace(s, sampleIV, data)
+		if err == nil && vcl && len(enc.inPlace) == 0 {
+			enc.stats.strictRejections.Add(1)
+			err = ErrNothingEncrypted
+		}
+		if err != nil {
+			// Encrypt takes the same sample IV
+			s.returnSampleIV(sampleIV, sampleIndex)
+		}
+	}
+
+	elapsed := time.Since(start)
+	if logger := e.debugLogger(); err == nil && logger != nil {
+		e.logAccessUnit(logger, s.mode, data, enc.inPlace)
+	}
+
+	switch {
+	case err == nil:
+		if e.fingerprints != nil {
+			e.fingerprints.record(data)
+		}
+		e.stats.encrypted(enc.stats, elapsed)
+		enc.stats.processed.Add(1)
+		enc.stats.encrypted.Add(1)
+		enc.stats.bytesIn.Add(uint64(len(data)))
+		enc.stats.bytesOut.Add(uint64(len(data)))
+		for _, r := range enc.inPlace {
+			enc.stats.bytesEncrypted.Add(uint64(r[1] - r[0]))
+		}
+	case !errors.Is(err, ErrNotInPlace):
+		enc.stats.processed.Add(1)
+		enc.stats.errors.Add(1)
+		if errors.Is(err, ErrInternal) {
+			enc.stats.internalErrors.Add(1)
+		}
+	}
+	enc.stats.leave()
+	enc.stats = nil
+
+	if onEncrypt := e.onEncrypt.Load(); err == nil && onEncrypt != nil {
+		(*onEncrypt)(s.mode, elapsed)
+	}
+
+	return err
+}
+
+// encryptAudioInPlace is encryptAudio on the sample itself, it reports
+// whether the sample was encrypted
+func (e *encryption) encryptAudioInPlace(s *cipherState, sampleIV, data []byte) bool {
+	if s.mode != "cenc" && len(data) < aes.BlockSize {
+		e.stats.nalsClear.Add(1)
+		return false
+	}
+
+	s.audioCipher(sampleIV, false).apply(data)
+	e.stats.nalsEncrypted.Add(1)
+	return true
+}
+
+// encryptNALsInPlace encrypts the ranges of the VCL payloads encryptBlocks
+// and encryptCENC protect, without unescaping them. Once a ciphertext would
+// emulate a start code the ranges encrypted so far are decrypted again.
+func (e *encryption) encryptNALsInPlace(s *cipherState, sampleIV, data []byte) error {
+	var err error
+	if e.ranges, err = nalUnits(e.ranges[:0], data); err != nil {
+		return err
+	}
+	hl := e.codec.headerLen()
+
+	// escaped payloads shrink once unescaped
+	for _, r := range e.ranges {
+		nalu := r.nalu(data)
+		if len(nalu) > hl && e.encrypts(e.codec.nalType(nalu)) && bytes.Contains(nalu[hl:], []byte{0, 0, 3}) {
+			return ErrNotInPlace
+		}
+	}
+
+	c := s.rangeCipher(sampleIV, false)
+	cenc := s.mode == "cenc"
+
+	var shortNALs, shortNALsEncrypted uint64
+	e.inPlace = e.inPlace[:0]
+
+	for _, r := range e.ranges {
+		nalu := r.nalu(data)
+		if len(nalu) <= hl {
+			continue
+		}
+		if !e.encrypts(e.codec.nalType(nalu)) {
+			e.observe(nalu)
+			continue
+		}
+
+		// without emulation prevention bytes the payload is the RBSP
+		payload := nalu[hl:]
+		protected := protectedLen(payload)
+		header, lead := e.sliceLead(nalu, payload)
+
+		switch {
+		case protected < minProtectedSize:
+			shortNALs++
+			if !cenc || e.shortNALs != ShortNALsCTR || header >= protected {
+				continue
+			}
+			shortNALsEncrypted++
+			lead = header
+		case protected < e.minEncryptSize, !cenc && protected-lead < minProtectedSize, lead >= protected:
+			continue
+		}
+
+		c.apply(payload[lead:protected])
+
+		offset := r.offset + r.headerLen + hl
+		e.inPlace = append(e.inPlace, [2]int{offset + lead, offset + protected})
+
+		// the clear bytes around the ciphertext may complete an emulated
+		// start code, the tail begins with a non-zero byte
+		if emulatesStartCode(payload[max(lead-2, 0) : protected+1]) {
+			e.revertInPlace(s, sampleIV, data)
+			return ErrNotInPlace
+		}
+	}
+
+	e.stats.shortNALs.Add(shortNALs)
+	e.stats.shortNALsEncrypted.Add(shortNALsEncrypted)
+	e.stats.nalsEncrypted.Add(uint64(len(e.inPlace)))
+	e.stats.nalsClear.Add(uint64(len(e.ranges) - len(e.inPlace)))
+	return nil
+}
+
+// revertInPlace decrypts the ranges encryptNALsInPlace encrypted so far,
+// the CTR keystream and the cbc1 chain run across them in the same order
+func (e *encryption) revertInPlace(s *cipherState, sampleIV, data []byte) {
+	c := s.rangeCipher(sampleIV, true)
+	for _, r := range e.inPlace {
+		c.apply(data[r[0]:r[1]])
+	}
+}
+
+// emulatesStartCode reports a sequence that needs an emulation prevention
+// byte, two zero bytes followed by a byte up to 3
+func emulatesStartCode(data []byte) bool {
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] <= 3 {
+			return true
+		}
+	}
+	return false
+}
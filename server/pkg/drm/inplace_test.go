@@ -0,0 +1,160 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// newInPlaceEncryptor is newTestEncryptor without the paranoid checks,
+// which need the plaintext next to the ciphertext
+func newInPlaceEncryptor(t *testing.T, cfg Config) *Encryptor {
+	t.Helper()
+
+	cfg.Enabled = true
+	cfg.KeyID = testKeyID
+	cfg.Key = testKey
+	cfg.IV = testIV
+	cfg.IVNonce = testIVNonce
+
+	e, err := NewEncryptor(cfg)
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	return e
+}
+
+func TestEncryptor_EncryptInPlace(t *testing.T) {
+	hevc := [][]byte{
+		bytes.Join([][]byte{hevcNAL(32, 20), hevcNAL(33, 40), hevcNAL(34, 20), hevcNAL(19, 500)}, nil),
+		hevcNAL(1, 300),
+	}
+	audio := [][]byte{opusFrame(120), opusFrame(7), opusFrame(250)}
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		frames [][]byte
+	}{
+		{"cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}, h264Stream()},
+		{"cbcs every block", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 0}, h264Stream()},
+		{"cenc", Config{Mode: "cenc"}, h264Stream()},
+		{"cenc short slices", Config{Mode: "cenc", EncryptShortNALs: ShortNALsCTR}, h264Stream()},
+		{"cens", Config{Mode: "cens", CryptBlocks: 1, SkipBlocks: 9}, h264Stream()},
+		{"cbc1", Config{Mode: "cbc1"}, h264Stream()},
+		{"hevc cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265}, hevc},
+		{"audio cbcs", Config{Mode: "cbcs", Codec: CodecAudio}, audio},
+		{"audio cenc", Config{Mode: "cenc", Codec: CodecAudio}, audio},
+		{"audio cens", Config{Mode: "cens", Codec: CodecAudio}, audio},
+		{"audio cbc1", Config{Mode: "cbc1", Codec: CodecAudio}, audio},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inPlace := newInPlaceEncryptor(t, tt.cfg)
+			copied := newInPlaceEncryptor(t, tt.cfg)
+
+			var encrypted int
+			for i, frame := range tt.frames {
+				want, err := copied.Encrypt(frame)
+				if err != nil {
+					t.Fatalf("frame %d: Encrypt() returned error: %s", i, err)
+				}
+
+				buf := bytes.Clone(frame)
+				err = inPlace.EncryptInPlace(buf)
+				if errors.Is(err, ErrNotInPlace) {
+					if !bytes.Equal(buf, frame) {
+						t.Fatalf("frame %d: EncryptInPlace() changed the buffer before falling back", i)
+					}
+					if buf, err = inPlace.Encrypt(frame); err != nil {
+						t.Fatalf("frame %d: Encrypt() returned error: %s", i, err)
+					}
+				} else if err != nil {
+					t.Fatalf("frame %d: EncryptInPlace() returned error: %s", i, err)
+				} else {
+					encrypted++
+				}
+
+				if !bytes.Equal(buf, want) {
+					t.Errorf("frame %d: EncryptInPlace() = %x, want %x", i, buf, want)
+				}
+			}
+
+			if encrypted == 0 {
+				t.Errorf("EncryptInPlace() fell back for every access unit")
+			}
+			if got, want := inPlace.Stats(), copied.Stats(); got.NALsEncrypted != want.NALsEncrypted || got.BytesOut != want.BytesOut {
+				t.Errorf("Stats() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestEncryptor_EncryptInPlaceFallback(t *testing.T) {
+	// an escaped payload, the zero bytes are followed by the escape
+	escaped := append(nalUnit(0x65, 64), 0, 0, 3, 1)
+	escaped = append(escaped, bytes.Repeat([]byte{0xaa}, 64)...)
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		frame func(t *testing.T) []byte
+	}{
+		{
+			name:  "escaped payload",
+			cfg:   Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+			frame: func(t *testing.T) []byte { return escaped },
+		},
+		{
+			name: "cbcs ciphertext emulates start code",
+			cfg:  Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+			frame: func(t *testing.T) []byte {
+				return collidingSlice(t, "cbcs", []byte{0x01, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}, bytes.Repeat([]byte{0xbb}, 16))
+			},
+		},
+		{
+			name: "cenc ciphertext emulates start code",
+			cfg:  Config{Mode: "cenc"},
+			frame: func(t *testing.T) []byte {
+				return collidingSlice(t, "cenc", []byte{0xaa, 0xaa, 0, 0, 2, 0xaa}, nil)
+			},
+		},
+		{
+			name:  "key sei",
+			cfg:   Config{Mode: "cenc", KeySEI: true},
+			frame: func(t *testing.T) []byte { return h264Stream()[0] },
+		},
+		{
+			name:  "avcc",
+			cfg:   Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, NALFormat: NALFormatAVCC},
+			frame: func(t *testing.T) []byte { return lengthPrefixed(h264Stream()[0], 4) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newInPlaceEncryptor(t, tt.cfg)
+			reference := newInPlaceEncryptor(t, tt.cfg)
+
+			frame := tt.frame(t)
+			buf := bytes.Clone(frame)
+			if err := e.EncryptInPlace(buf); !errors.Is(err, ErrNotInPlace) {
+				t.Fatalf("EncryptInPlace() = %v, want ErrNotInPlace", err)
+			}
+			if !bytes.Equal(buf, frame) {
+				t.Errorf("EncryptInPlace() changed the buffer to %x", buf)
+			}
+
+			// the sample IV was not consumed
+			got, err := e.Encrypt(frame)
+			if err != nil {
+				t.Fatalf("Encrypt() returned error: %s", err)
+			}
+			want, _ := reference.Encrypt(frame)
+			if !bytes.Equal(got, want) {
+				t.Errorf("Encrypt() after the fallback = %x, want %x", got, want)
+			}
+		})
+	}
+}
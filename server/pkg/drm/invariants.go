@@ -0,0 +1,103 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrInternal is returned when the encryptor broke one of its own
+// invariants, the output of such an access unit is discarded
+var ErrInternal = errors.New("drm internal error")
+
+// clearNAL is a NAL unit kept clear by policy, recorded while encrypting
+type clearNAL struct {
+	src  int // offset of the payload in the access unit being encrypted
+	size int
+	dst  int // offset of the payload in the output
+}
+
+// insertedNAL is a NAL unit the encryptor added to the access unit
+type insertedNAL struct {
+	pos  int
+	nalu []byte
+}
+
+// invariants verifies in paranoid mode that every NAL unit kept clear by
+// policy leaves the encryptor with the same logical payload it came in with
+type invariants struct {
+	clear    []clearNAL
+	inserted []insertedNAL
+}
+
+func (v *invariants) reset() {
+	v.clear = v.clear[:0]
+	v.inserted = v.inserted[:0]
+}
+
+// insert records a NAL unit inserted at pos before encryption
+func (v *invariants) insert(pos int, nalu []byte) {
+	v.inserted = append(v.inserted, insertedNAL{pos: pos, nalu: nalu})
+}
+
+// keep records a payload copied to the output at dst, payload has to be a
+// subslice of au
+func (v *invariants) keep(au, payload []byte, dst int) {
+	v.clear = append(v.clear, clearNAL{
+		src:  cap(au) - cap(payload),
+		size: len(payload),
+		dst:  dst,
+	})
+}
+
+// source maps a recorded payload back to the bytes handed to Encrypt, or to
+// the inserted NAL unit it belongs to
+func (v *invariants) source(orig []byte, c clearNAL) []byte {
+	shift := 0
+	for _, ins := range v.inserted {
+		end := ins.pos + len(ins.nalu)
+		if c.src >= ins.pos && c.src < end {
+			if c.src+c.size > end {
+				return nil
+			}
+			return ins.nalu[c.src-ins.pos : c.src-ins.pos+c.size]
+		}
+		if c.src >= end {
+			shift += len(ins.nalu)
+		}
+	}
+
+	start := c.src - shift
+	if start < 0 || start+c.size > len(orig) {
+		return nil
+	}
+	return orig[start : start+c.size]
+}
+
+// verify re-parses the output and compares every recorded payload with its
+// source, emulation prevention bytes are ignored
+func (v *invariants) verify(orig, out []byte) error {
+	payloads := map[int][]byte{}
+	for _, nalu := range parseNALUnits(out) {
+		payload := nalu[startCodeLen(nalu):]
+		payloads[cap(out)-cap(payload)] = payload
+	}
+
+	for _, c := range v.clear {
+		want := v.source(orig, c)
+		if want == nil {
+			return fmt.Errorf("%w: clear NAL unit at offset %d has no source", ErrInternal, c.src)
+		}
+
+		got, ok := payloads[c.dst]
+		if !ok {
+			return fmt.Errorf("%w: clear NAL unit at offset %d missing in output", ErrInternal, c.src)
+		}
+
+		if !bytes.Equal(unescapeRBSP(got), unescapeRBSP(want)) {
+			return fmt.Errorf("%w: clear NAL unit %x at offset %d changed by encryption", ErrInternal, want[:min(len(want), 2)], c.src)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptor_paranoidChecks(t *testing.T) {
+	sps := nalUnit(0x67, 12)
+	pps := nalUnit(0x68, 12)
+	frame := bytes.Join([][]byte{sps, pps, nalUnit(0x06, 8), nalUnit(0x65, 300)}, nil)
+
+	// deliberately broken encryptors, each runs the real one first
+	tests := []struct {
+		name    string
+		keySEI  bool
+		broken  func(e *encryption, s *cipherState, data []byte) ([]byte, error)
+		wantErr error
+	}{
+		{
+			name: "correct",
+			broken: func(e *encryption, s *cipherState, data []byte) ([]byte, error) {
+				return e.encryptBlocks(nil, s, nil, data)
+			},
+		},
+		{
+			name:   "correct with SEI injection",
+			keySEI: true,
+			broken: func(e *encryption, s *cipherState, data []byte) ([]byte, error) {
+				return e.encryptBlocks(nil, s, nil, data)
+			},
+		},
+		{
+			name: "SPS byte flipped",
+			broken: func(e *encryption, s *cipherState, data []byte) ([]byte, error) {
+				out, err := e.encryptBlocks(nil, s, nil, data)
+				out[len(sps)-1] ^= 0xff
+				return out, err
+			},
+			wantErr: ErrInternal,
+		},
+		{
+			name: "parameter sets swapped",
+			broken: func(e *encryption, s *cipherState, data []byte) ([]byte, error) {
+				out, err := e.encryptBlocks(nil, s, nil, data)
+				// same sizes, every byte still present in the output
+				copy(out, pps)
+				copy(out[len(pps):], sps)
+				return out, err
+			},
+			wantErr: ErrInternal,
+		},
+		{
+			name:   "injected SEI lost",
+			keySEI: true,
+			broken: func(e *encryption, s *cipherState, data []byte) ([]byte, error) {
+				out, err := e.encryptBlocks(nil, s, nil, data)
+				sei := s.keySEI(e.codec, nil)
+				pos := bytes.Index(out, sei)
+				return append(out[:pos:pos], out[pos+len(sei):]...), err
+			},
+			wantErr: ErrInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeySEI: tt.keySEI})
+			e.encryptAU = tt.broken
+
+			out, err := e.Encrypt(bytes.Clone(frame))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Encrypt() error = %v, want %v", err, tt.wantErr)
+			}
+
+			var want uint64
+			if tt.wantErr != nil {
+				want = 1
+				if out != nil {
+					t.Errorf("Encrypt() returned data for a corrupted access unit")
+				}
+			}
+			if got := e.Stats().InternalErrors; got != want {
+				t.Errorf("Stats().InternalErrors = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestInvariants_logicalPayload(t *testing.T) {
+	// source without emulation prevention where the output needs it
+	orig := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 2, 0x10}
+
+	tests := []struct {
+		name    string
+		out     []byte
+		wantErr error
+	}{
+		{
+			name: "identical",
+			out:  orig,
+		},
+		{
+			name: "emulation prevention byte inserted",
+			out:  []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 3, 2, 0x10},
+		},
+		{
+			name:    "logical payload changed",
+			out:     []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 3, 2, 0x11},
+			wantErr: ErrInternal,
+		},
+		{
+			name:    "payload moved",
+			out:     []byte{0, 0, 0, 0, 1, 0x67, 0x42, 0, 0, 2, 0x10},
+			wantErr: ErrInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &invariants{}
+			v.keep(orig, orig[4:], 4)
+
+			if err := v.verify(orig, tt.out); !errors.Is(err, tt.wantErr) {
+				t.Errorf("verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
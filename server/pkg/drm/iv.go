@@ -0,0 +1,199 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+)
+
+// CheckIVMode validates the IV mode of a scheme and returns it, the default
+// of the scheme when empty and counter for sequence. cenc, cens and cbc1
+// take a per-sample IV, cbcs keeps the constant IV its players expect.
+func CheckIVMode(mode, ivMode string) (string, error) {
+	switch ivMode {
+	case "":
+		return defaultIVMode(mode), nil
+	case IVModeSequence:
+		ivMode = IVModeCounter
+	}
+
+	switch {
+	case ivMode != IVModeConstant && ivMode != IVModeCounter && ivMode != IVModeDerived:
+		return "", fmt.Errorf("iv mode must be %s, %s or %s, got %q", IVModeConstant, IVModeCounter, IVModeDerived, ivMode)
+	case (mode == "cenc" || mode == "cens") && ivMode == IVModeConstant:
+		return "", fmt.Errorf("iv mode must be %s or %s with %s, a constant IV reuses the keystream", IVModeCounter, IVModeDerived, mode)
+	case mode == "cbc1" && ivMode == IVModeConstant:
+		return "", fmt.Errorf("iv mode must be %s or %s with cbc1, got %q", IVModeCounter, IVModeDerived, ivMode)
+	case mode == "cbcs" && ivMode != IVModeConstant:
+		return "", fmt.Errorf("iv mode must be %s with cbcs, got %q", IVModeConstant, ivMode)
+	}
+	return ivMode, nil
+}
+
+// PerSampleIV reports whether an IV mode gives every access unit an IV of
+// its own, signaled with the access unit rather than once
+func PerSampleIV(ivMode string) bool {
+	return ivMode == IVModeCounter || ivMode == IVModeDerived
+}
+
+// SampleIVSize returns the size of the per-sample IVs of a scheme: 8 bytes
+// with cenc and cens, whose block counter makes up the other half of the
+// counter block, and 16 bytes with cbc1, whose IV starts the CBC chain
+func SampleIVSize(mode string) int {
+	if CTRScheme(mode) {
+		return 8
+	}
+	return aes.BlockSize
+}
+
+// ivNonceSize is the size of the nonce mixed into the per-sample IVs
+const ivNonceSize = 8
+
+// zeroIVNonce leaves the per-sample IVs as counted from the IV alone, as
+// they were before the nonce
+const zeroIVNonce = "0000000000000000"
+
+// newIVNonce returns the nonce mixed into the first 8 bytes of the IV for
+// the per-sample IVs of a new key or IV, hex encoded in configured or
+// random when empty; nil in constant mode. Without it an encryptor created
+// again with the same key and IV, after a restart or for a session
+// reconnecting, would repeat the IVs of the last one and with cenc and
+// cens its keystream.
+func newIVNonce(ivMode, configured string) ([]byte, error) {
+	if !PerSampleIV(ivMode) {
+		return nil, nil
+	}
+
+	if configured != "" {
+		nonce, err := hex.DecodeString(configured)
+		if err != nil || len(nonce) != ivNonceSize {
+			return nil, fmt.Errorf("iv nonce must be %d bytes hex encoded", ivNonceSize)
+		}
+		return nonce, nil
+	}
+
+	nonce := make([]byte, ivNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate the iv nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+// ivNonceWord returns the nonce as the integer it is mixed in as, zero
+// without one
+func ivNonceWord(nonce []byte) uint64 {
+	if len(nonce) < ivNonceSize {
+		return 0
+	}
+	return binary.BigEndian.Uint64(nonce)
+}
+
+// newIVCipher returns the cipher deriving the sample IVs of a key in
+// derived mode, nil in the others
+func newIVCipher(ivMode string, key []byte) (cipher.Block, error) {
+	if ivMode != IVModeDerived {
+		return nil, nil
+	}
+	return aes.NewCipher(hkdfSHA256(key, nil, []byte("neko drm sample iv"), 16))
+}
+
+// DeriveSampleIV returns the IV of the access unit with the given index in
+// derived mode, for packagers computing the IVs of a key without the
+// encryptor: AES-ECB of the first 8 bytes of iv XOR the nonce of
+// Encryptor.IVNonce and the big endian index, under a key derived from the
+// content key with HKDF-SHA256. cenc and cens take the first 8 bytes of
+// the block, cbc1 the whole block.
+func DeriveSampleIV(mode string, key, iv, nonce []byte, index uint64) ([]byte, error) {
+	if len(iv) < 8 {
+		return nil, fmt.Errorf("iv must be at least 8 bytes, got %d", len(iv))
+	}
+	if len(nonce) != ivNonceSize {
+		return nil, fmt.Errorf("iv nonce must be %d bytes, got %d", ivNonceSize, len(nonce))
+	}
+	block, err := newIVCipher(IVModeDerived, key)
+	if err != nil {
+		return nil, err
+	}
+	return deriveSampleIV(block, mode, iv, nonce, index), nil
+}
+
+func deriveSampleIV(block cipher.Block, mode string, iv, nonce []byte, index uint64) []byte {
+	var in, out [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(in[:8], binary.BigEndian.Uint64(iv)^ivNonceWord(nonce))
+	binary.BigEndian.PutUint64(in[8:], index)
+	block.Encrypt(out[:], in[:])
+	return out[:SampleIVSize(mode)]
+}
+
+// counterSampleIV returns the IV of the access unit with the given index in
+// counter mode, the first 8 bytes of iv XOR the nonce plus the index with
+// cenc and cens, and with cbc1 the 16 bytes of iv so mixed plus the index
+func counterSampleIV(mode string, iv, nonce []byte, index uint64) []byte {
+	hi := binary.BigEndian.Uint64(iv) ^ ivNonceWord(nonce)
+	if CTRScheme(mode) {
+		return binary.BigEndian.AppendUint64(nil, hi+index)
+	}
+
+	lo, carry := bits.Add64(binary.BigEndian.Uint64(iv[8:aes.BlockSize]), index, 0)
+	out := binary.BigEndian.AppendUint64(make([]byte, 0, aes.BlockSize), hi+carry)
+	return binary.BigEndian.AppendUint64(out, lo)
+}
+
+// sampleIV returns the IV of the access unit with the given index, nil in
+// constant mode
+func (s *cipherState) sampleIV(index uint64) []byte {
+	switch s.ivMode {
+	case IVModeCounter:
+		return counterSampleIV(s.mode, s.iv, s.ivNonce, index)
+	case IVModeDerived:
+		return deriveSampleIV(s.ivCipher, s.mode, s.iv, s.ivNonce, index)
+	}
+	return nil
+}
+
+// nextSampleIV returns the IV of the next access unit with its index, nil
+// in constant mode
+func (s *cipherState) nextSampleIV() ([]byte, uint64) {
+	if !PerSampleIV(s.ivMode) {
+		return nil, 0
+	}
+
+	n := s.samples.Add(1) - 1
+	return s.sampleIV(n), n
+}
+
+// returnSampleIV gives the IV of nextSampleIV back when the access unit was
+// not encrypted with it, unless another one was taken in the meantime
+func (s *cipherState) returnSampleIV(sampleIV []byte, index uint64) {
+	if sampleIV == nil {
+		return
+	}
+	s.samples.CompareAndSwap(index+1, index)
+}
+
+// IVNonce returns the nonce mixed into the per-sample IVs of the current
+// key and IV, for a Decryptor following the encryptor without KeySEI
+// through Config.IVNonce; nil in constant mode
+func (e *Encryptor) IVNonce() []byte {
+	s := e.state.Load()
+	if s == nil {
+		return nil
+	}
+	return bytes.Clone(s.ivNonce)
+}
+
+// SampleIV returns the IV of the access unit with the given index, counting
+// from zero with the current key and IV, as EncryptedSample reports it: 8
+// bytes with cenc and cens, 16 bytes with cbc1; nil in constant mode
+func (e *Encryptor) SampleIV(index uint64) []byte {
+	s := e.state.Load()
+	if s == nil {
+		return nil
+	}
+	return s.sampleIV(index)
+}
@@ -0,0 +1,222 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"strings"
+	"testing"
+)
+
+func TestCheckIVMode(t *testing.T) {
+	tests := []struct {
+		mode   string
+		ivMode string
+		want   string
+	}{
+		{"cbcs", "", IVModeConstant},
+		{"cbcs", IVModeConstant, IVModeConstant},
+		{"cbcs", IVModeSequence, ""},
+		{"cbcs", IVModeDerived, ""},
+		{"cenc", "", IVModeCounter},
+		{"cenc", IVModeSequence, IVModeCounter},
+		{"cenc", IVModeCounter, IVModeCounter},
+		{"cenc", IVModeDerived, IVModeDerived},
+		{"cenc", IVModeConstant, ""},
+		{"cens", IVModeDerived, IVModeDerived},
+		{"cbc1", IVModeDerived, IVModeDerived},
+		{"cbc1", IVModeConstant, ""},
+		{"cenc", "random", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := CheckIVMode(tt.mode, tt.ivMode)
+		if (err == nil) != (tt.want != "") || got != tt.want {
+			t.Errorf("CheckIVMode(%q, %q) = %q, %v, want %q", tt.mode, tt.ivMode, got, err, tt.want)
+		}
+	}
+
+	// errors name the canonical mode, not its alias
+	if _, err := CheckIVMode("cenc", IVModeConstant); err == nil || !strings.Contains(err.Error(), IVModeCounter) || strings.Contains(err.Error(), IVModeSequence) {
+		t.Errorf("CheckIVMode() error = %v, want it to name %s", err, IVModeCounter)
+	}
+}
+
+func TestEncryptor_IVNonce(t *testing.T) {
+	frame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+
+	for _, ivMode := range []string{IVModeCounter, IVModeDerived} {
+		for _, mode := range []string{"cenc", "cbc1"} {
+			// encryptors of the same key and IV, as after a restart
+			cfg := Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: mode, IVMode: ivMode}
+			seen := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				e, err := NewEncryptor(cfg)
+				if err != nil {
+					t.Fatalf("NewEncryptor() returned error: %s", err)
+				}
+				if len(e.IVNonce()) != ivNonceSize {
+					t.Fatalf("%s %s: IVNonce() = %x, want %d bytes", mode, ivMode, e.IVNonce(), ivNonceSize)
+				}
+
+				for j := 0; j < 3; j++ {
+					sample, err := e.EncryptSample(frame)
+					if err != nil {
+						t.Fatalf("EncryptSample() returned error: %s", err)
+					}
+					if seen[string(sample.IV)] {
+						t.Errorf("%s %s: encryptor %d reuses IV %x", mode, ivMode, i, sample.IV)
+					}
+					seen[string(sample.IV)] = true
+				}
+			}
+		}
+	}
+
+	// a configured nonce is taken as it is
+	cfg := Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cenc", IVNonce: "0123456789abcdef"}
+	e, err := NewEncryptor(cfg)
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if got := e.IVNonce(); !bytes.Equal(got, mustHex(cfg.IVNonce)) {
+		t.Errorf("IVNonce() = %x, want %s", got, cfg.IVNonce)
+	}
+	if want := counterSampleIV("cenc", mustHex(testIV), mustHex(cfg.IVNonce), 0); !bytes.Equal(e.SampleIV(0), want) {
+		t.Errorf("SampleIV(0) = %x, want %x", e.SampleIV(0), want)
+	}
+
+	// and returned as a copy
+	e.IVNonce()[0] ^= 0xff
+	if got := e.IVNonce(); !bytes.Equal(got, mustHex(cfg.IVNonce)) {
+		t.Errorf("IVNonce() = %x after changing the returned slice", got)
+	}
+
+	for _, nonce := range []string{"0123", "zz23456789abcdef"} {
+		cfg.IVNonce = nonce
+		if _, err := NewEncryptor(cfg); err == nil {
+			t.Errorf("NewEncryptor() accepted the iv nonce %q", nonce)
+		}
+	}
+
+	// constant IVs have none
+	cbcs := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if nonce := cbcs.IVNonce(); nonce != nil {
+		t.Errorf("cbcs IVNonce() = %x, want nil", nonce)
+	}
+}
+
+func TestEncryptor_derivedIV(t *testing.T) {
+	for _, mode := range []string{"cenc", "cens", "cbc1"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := Config{Mode: mode, IVMode: IVModeDerived, KeySEI: true}
+			e := newTestEncryptor(t, cfg)
+			if p := e.Profile(); p.IVMode != IVModeDerived {
+				t.Fatalf("Profile() iv mode = %s, want %s", p.IVMode, IVModeDerived)
+			}
+
+			cfg.Enabled, cfg.KeyID, cfg.Key, cfg.IV = true, testKeyID, testKey, testIV
+			d, err := NewDecryptor(cfg)
+			if err != nil {
+				t.Fatalf("NewDecryptor() returned error: %s", err)
+			}
+
+			frame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+			seen := map[string]bool{}
+			for i := uint64(0); i < 3; i++ {
+				sample, err := e.EncryptSample(frame)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+
+				// the packager computes the same IV from the key alone
+				want, err := DeriveSampleIV(mode, mustHex(testKey), mustHex(testIV), e.IVNonce(), i)
+				if err != nil {
+					t.Fatalf("DeriveSampleIV() returned error: %s", err)
+				}
+				if len(want) != SampleIVSize(mode) {
+					t.Errorf("DeriveSampleIV() returned %d bytes, want %d", len(want), SampleIVSize(mode))
+				}
+				if sample.Index != i || !bytes.Equal(sample.IV, want) || !bytes.Equal(e.SampleIV(i), want) {
+					t.Errorf("sample %d: index %d IV %x, SampleIV() = %x, want %x", i, sample.Index, sample.IV, e.SampleIV(i), want)
+				}
+				if seen[string(sample.IV)] {
+					t.Errorf("sample %d reuses IV %x", i, sample.IV)
+				}
+				seen[string(sample.IV)] = true
+
+				got, err := d.Decrypt(sample.Data)
+				if err != nil {
+					t.Fatalf("Decrypt() returned error: %s", err)
+				}
+				if !bytes.Contains(got, frame[len(nalUnit(0x67, 8)):]) {
+					t.Errorf("sample %d: Decrypt() does not restore the slice", i)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptor_SampleIV(t *testing.T) {
+	for _, mode := range []string{"cenc", "cbc1"} {
+		t.Run(mode, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{Mode: mode, IVMode: IVModeSequence})
+			if p := e.Profile(); p.IVMode != IVModeCounter {
+				t.Fatalf("Profile() iv mode = %s, want %s", p.IVMode, IVModeCounter)
+			}
+
+			frame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+			block, _ := aes.NewCipher(mustHex(testKey))
+			for i := uint64(0); i < 2; i++ {
+				sample, err := e.EncryptSample(frame)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+				if sample.Index != i || !bytes.Equal(sample.IV, e.SampleIV(i)) {
+					t.Errorf("sample %d: index %d IV %x, SampleIV() = %x", i, sample.Index, sample.IV, e.SampleIV(i))
+				}
+				if len(sample.IV) != SampleIVSize(mode) {
+					t.Errorf("sample %d: IV of %d bytes, want %d", i, len(sample.IV), SampleIVSize(mode))
+				}
+
+				got, err := DecryptSample(block, SampleParams{Scheme: mode, IV: e.SampleIV(i), Escaped: true}, sample.Data, sample.Subsamples)
+				if err != nil || !bytes.Equal(got, frame) {
+					t.Errorf("DecryptSample() with SampleIV(%d) = %x, %v, want the source", i, got, err)
+				}
+			}
+		})
+	}
+
+	// cbcs keeps the constant IV of its players
+	cbcs := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if iv := cbcs.SampleIV(0); iv != nil {
+		t.Errorf("cbcs SampleIV() = %x, want nil", iv)
+	}
+	if _, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, IVMode: IVModeDerived}); err == nil {
+		t.Errorf("NewEncryptor() of cbcs with derived IVs returned no error")
+	}
+}
+
+func TestCounterSampleIV(t *testing.T) {
+	tests := []struct {
+		mode  string
+		iv    string
+		nonce string
+		index uint64
+		want  string
+	}{
+		{"cenc", "00000000000000ff0123456789abcdef", "", 1, "0000000000000100"},
+		{"cens", "0000000000000001", "", 2, "0000000000000003"},
+		{"cbc1", "000000000000000000000000000000ff", "", 1, "00000000000000000000000000000100"},
+		// the index carries into the upper half of the IV
+		{"cbc1", "0000000000000001ffffffffffffffff", "", 2, "00000000000000020000000000000001"},
+		// the nonce is mixed into the upper half before the index is added
+		{"cenc", "00000000000000ff0123456789abcdef", "ff000000000000ff", 1, "ff00000000000001"},
+		{"cbc1", "0000000000000001ffffffffffffffff", "0100000000000000", 2, "01000000000000020000000000000001"},
+	}
+
+	for _, tt := range tests {
+		if got := counterSampleIV(tt.mode, mustHex(tt.iv), mustHex(tt.nonce), tt.index); !bytes.Equal(got, mustHex(tt.want)) {
+			t.Errorf("counterSampleIV(%s, %s, %s, %d) = %x, want %s", tt.mode, tt.iv, tt.nonce, tt.index, got, tt.want)
+		}
+	}
+}
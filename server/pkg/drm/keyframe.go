@@ -0,0 +1,107 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"time"
+)
+
+// keyframeSignal tells whether an access unit is a keyframe, staged
+// profiles switch at keyframes only
+type keyframeSignal uint8
+
+const (
+	// the access unit is searched for IDR or IRAP slices
+	keyframeDetect keyframeSignal = iota
+	// the caller says it is a keyframe
+	keyframeSignaled
+	// the caller says it is none, whatever its NAL unit types
+	keyframeDelta
+)
+
+// is reports whether the access unit is a keyframe
+func (k keyframeSignal) is(codec nalCodec, data []byte) bool {
+	switch k {
+	case keyframeSignaled:
+		return true
+	case keyframeDelta:
+		return false
+	}
+	return codec.containsKeyframe(data)
+}
+
+// signalKeyframe maps the keyframe flag of a caller
+func signalKeyframe(keyframe bool) keyframeSignal {
+	if keyframe {
+		return keyframeSignaled
+	}
+	return keyframeDelta
+}
+
+// EncryptWithKeyframe encrypts like Encrypt, with the caller telling
+// whether the access unit is a keyframe rather than the encryptor looking
+// for IDR slices, for pipelines that know from their container or encoder
+// flags. A staged profile or pending SetEnabled takes effect with this
+// access unit when it is a keyframe and never when it is not. Unlike
+// Keyframe followed by Encrypt, no other access unit can come between.
+func (e *Encryptor) EncryptWithKeyframe(data []byte, keyframe bool) ([]byte, error) {
+	sample, err := e.EncryptSampleWithKeyframe(data, keyframe)
+	return sample.Data, err
+}
+
+// EncryptSampleWithKeyframe is EncryptSample with the keyframe signal of
+// EncryptWithKeyframe
+func (e *Encryptor) EncryptSampleWithKeyframe(data []byte, keyframe bool) (EncryptedSample, error) {
+	return e.encryptSample(nil, data, signalKeyframe(keyframe))
+}
+
+// RotationState tells when a key change takes effect, for signaling
+// clients the access unit the new key begins with. Positions count the
+// access units encrypted, as Rotation.Frame does.
+type RotationState struct {
+	// Frame is the number of access units encrypted so far
+	Frame uint64
+
+	// PendingKeyID is set while a profile with another key is staged, it
+	// takes effect at the first keyframe at or after PendingActivation,
+	// zero for the next one; PendingFrame is the number of access units
+	// encrypted when it was staged
+	PendingKeyID      string
+	PendingActivation time.Time
+	PendingFrame      uint64
+
+	// Last is the last switch to another key, with the number of access
+	// units encrypted before the first one with it; nil before
+	Last *Rotation
+}
+
+// Pending reports whether another key is staged
+func (s RotationState) Pending() bool {
+	return s.PendingKeyID != ""
+}
+
+// RotationState returns whether a key change is pending and where the
+// last one took effect
+func (e *Encryptor) RotationState() RotationState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state := RotationState{Frame: e.stats.position.Load()}
+
+	current := e.state.Load()
+	if e.pending != nil && current != nil && !bytes.Equal(e.pending.keyID, current.keyID) {
+		state.PendingKeyID = hex.EncodeToString(e.pending.keyID)
+		state.PendingActivation = e.pendingAt
+		state.PendingFrame = e.pendingFrame
+	}
+
+	if e.rotated != nil {
+		last := *e.rotated
+		last.KeyID = bytes.Clone(last.KeyID)
+		last.PreviousKeyID = bytes.Clone(last.PreviousKeyID)
+		last.IV = bytes.Clone(last.IV)
+		state.Last = &last
+	}
+
+	return state
+}
@@ -0,0 +1,138 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// gop returns two GOPs of an IDR frame followed by P frames
+func gop() [][]byte {
+	stream := h264Stream()
+	idr, p := stream[0], stream[1]
+	return [][]byte{idr, p, p, p, idr, p, p}
+}
+
+func TestEncryptor_rotationAtKeyframe(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	var rotations []Rotation
+	e.OnRotate(func(r Rotation) {
+		rotations = append(rotations, r)
+	})
+
+	frames := gop()
+	for _, frame := range frames[:2] {
+		if _, err := e.Encrypt(frame); err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+	}
+
+	// staged in the middle of the first GOP
+	if err := e.ApplyProfile(testProfile); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+	state := e.RotationState()
+	if !state.Pending() || state.PendingKeyID != testProfile.KeyID || state.PendingFrame != 2 || state.Last != nil {
+		t.Fatalf("RotationState() = %+v, want %s pending since frame 2", state, testProfile.KeyID)
+	}
+
+	var reference *Encryptor
+	for i, frame := range frames[2:] {
+		i += 2
+
+		got, err := e.Encrypt(frame)
+		if err != nil {
+			t.Fatalf("frame %d: Encrypt() returned error: %s", i, err)
+		}
+
+		// the rest of the GOP keeps the old key
+		if i < 4 {
+			if len(rotations) != 0 || !e.RotationState().Pending() {
+				t.Fatalf("frame %d: key switched before the keyframe", i)
+			}
+			continue
+		}
+
+		// the new key draws its own IV nonce
+		if reference == nil {
+			reference = newTestProfileEncryptor(t, testProfile, e.IVNonce())
+		}
+		want, _ := reference.Encrypt(frame)
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d: not encrypted with the new key", i)
+		}
+	}
+
+	if len(rotations) != 1 || rotations[0].Frame != 4 {
+		t.Fatalf("OnRotate() = %+v, want one rotation at frame 4", rotations)
+	}
+
+	state = e.RotationState()
+	if state.Pending() || state.Frame != uint64(len(frames)) {
+		t.Errorf("RotationState() = %+v, want nothing pending at frame %d", state, len(frames))
+	}
+	if state.Last == nil || state.Last.Frame != 4 || hex.EncodeToString(state.Last.KeyID) != testProfile.KeyID ||
+		hex.EncodeToString(state.Last.PreviousKeyID) != testKeyID {
+		t.Errorf("RotationState().Last = %+v, want the switch to %s at frame 4", state.Last, testProfile.KeyID)
+	}
+}
+
+func TestEncryptor_EncryptWithKeyframe(t *testing.T) {
+	frames := gop()
+	idr, p := frames[0], frames[1]
+
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if _, err := e.EncryptWithKeyframe(idr, true); err != nil {
+		t.Fatalf("EncryptWithKeyframe() returned error: %s", err)
+	}
+	if err := e.ApplyProfile(testProfile); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+
+	// the caller knows better than the NAL unit types, both ways
+	if _, err := e.EncryptWithKeyframe(idr, false); err != nil {
+		t.Fatalf("EncryptWithKeyframe() returned error: %s", err)
+	}
+	if !e.RotationState().Pending() {
+		t.Fatalf("key switched at an IDR frame not signaled as keyframe")
+	}
+
+	sample, err := e.EncryptSampleWithKeyframe(p, true)
+	if err != nil {
+		t.Fatalf("EncryptSampleWithKeyframe() returned error: %s", err)
+	}
+	if profile, ok := sample.Profile(); !ok || profile.KeyID != testProfile.KeyID {
+		t.Errorf("sample signaled as keyframe encrypted with %s, want %s", profile.KeyID, testProfile.KeyID)
+	}
+	if last := e.RotationState().Last; last == nil || last.Frame != 2 {
+		t.Errorf("RotationState().Last = %+v, want the switch at frame 2", last)
+	}
+}
+
+func TestEncryptor_RotationStateUpdateKey(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs"})
+	if _, err := e.Encrypt(h264Stream()[0]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	// a staged profile keeping the key is no rotation
+	same := e.Profile()
+	same.Key = testKey
+	same.CryptBlocks, same.SkipBlocks = 2, 8
+	if err := e.ApplyProfile(same); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+	if e.RotationState().Pending() {
+		t.Errorf("RotationState() is pending for a pattern change")
+	}
+	e.CancelProfile()
+
+	// UpdateKey switches right away
+	if _, err := e.UpdateKeyHex(testProfile.KeyID, testProfile.Key, testProfile.IV); err != nil {
+		t.Fatalf("UpdateKeyHex() returned error: %s", err)
+	}
+	if last := e.RotationState().Last; last == nil || last.Frame != 1 {
+		t.Errorf("RotationState().Last = %+v, want the switch at frame 1", last)
+	}
+}
@@ -0,0 +1,155 @@
+package drm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Activation policies of a pushed key
+const (
+	// KeyActivationImmediate switches with the next access unit, clients
+	// miss frames until they have the key
+	KeyActivationImmediate = "immediate"
+	// KeyActivationNextIDR stages the key for the next IDR frame
+	KeyActivationNextIDR = "next-idr"
+)
+
+// KeyPushPath is where a server takes pushed keys with PUT
+const KeyPushPath = "/api/drm/keys"
+
+// ErrKeyReplayed is returned for a pushed key ID that was seen before
+var ErrKeyReplayed = errors.New("key id was seen before")
+
+// KeyPush is content key material pushed to a running server by a key
+// orchestrator, the binary fields are base64 encoded in JSON
+type KeyPush struct {
+	KeyID []byte `json:"key_id"`
+	Key   []byte `json:"key"`
+	IV    []byte `json:"iv"`
+	// KeyActivationNextIDR when empty
+	Activation string `json:"activation,omitempty"`
+}
+
+// Validate checks the shape of the key material and the activation
+// policy, wrapping ErrInvalidProfile
+func (p KeyPush) Validate() error {
+	var errs []error
+	if len(p.KeyID) != 16 {
+		errs = append(errs, fmt.Errorf("key_id must be 16 bytes, got %d", len(p.KeyID)))
+	}
+	if len(p.Key) != 16 {
+		errs = append(errs, fmt.Errorf("key must be 16 bytes, got %d", len(p.Key)))
+	}
+	// the scheme decides whether 8 bytes are enough
+	if len(p.IV) != 8 && len(p.IV) != 16 {
+		errs = append(errs, fmt.Errorf("iv must be 8 or 16 bytes, got %d", len(p.IV)))
+	}
+	switch p.Activation {
+	case "", KeyActivationImmediate, KeyActivationNextIDR:
+	default:
+		errs = append(errs, fmt.Errorf("activation must be %s or %s, got %q", KeyActivationImmediate, KeyActivationNextIDR, p.Activation))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidProfile, errors.Join(errs...))
+	}
+	return nil
+}
+
+// ActivationPolicy returns the activation policy, the default filled in
+func (p KeyPush) ActivationPolicy() string {
+	if p.Activation == "" {
+		return KeyActivationNextIDR
+	}
+	return p.Activation
+}
+
+// KeyPushResult is the activation decision of the server for a pushed key
+type KeyPushResult struct {
+	KeyID         string `json:"key_id"` // hex encoded
+	PreviousKeyID string `json:"previous_key_id"`
+	Activation    string `json:"activation"`
+	// Activated is set when frames are encrypted with the key already,
+	// otherwise it takes over at the next IDR frame
+	Activated bool `json:"activated"`
+}
+
+// KeyPushError is a push the server refused: 400 for malformed material,
+// 409 for a replayed key ID or a profile staged already, 422 when the
+// server cannot switch keys
+type KeyPushError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *KeyPushError) Error() string {
+	return fmt.Sprintf("key push refused with %d: %s", e.StatusCode, e.Message)
+}
+
+// KeyPushClient pushes keys to a running server, for key orchestrators.
+// It is safe for concurrent use.
+type KeyPushClient struct {
+	// URL of the server without the API path, e.g. https://neko.example.com
+	URL string
+	// Token of an admin session, sent as bearer token
+	Token string
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+// Push sends the key to the server and returns its activation decision.
+// Pushes the server refuses fail with *KeyPushError.
+func (c *KeyPushClient) Push(ctx context.Context, push KeyPush) (KeyPushResult, error) {
+	// malformed material never leaves the orchestrator
+	if err := push.Validate(); err != nil {
+		return KeyPushResult{}, err
+	}
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		return KeyPushResult{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(c.URL, "/")+KeyPushPath, bytes.NewReader(body))
+	if err != nil {
+		return KeyPushResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return KeyPushResult{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		// the API answers errors with a JSON message
+		var payload struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		if json.Unmarshal(data, &payload) != nil || payload.Message == "" {
+			payload.Message = strings.TrimSpace(string(data))
+		}
+		return KeyPushResult{}, &KeyPushError{StatusCode: res.StatusCode, Message: payload.Message}
+	}
+
+	var result KeyPushResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return KeyPushResult{}, fmt.Errorf("unable to parse key push result: %w", err)
+	}
+	return result, nil
+}
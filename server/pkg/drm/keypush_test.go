@@ -0,0 +1,93 @@
+package drm
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testKeyPush() KeyPush {
+	keyID, _ := hex.DecodeString(testProfile.KeyID)
+	key, _ := hex.DecodeString(testProfile.Key)
+	iv, _ := hex.DecodeString(testProfile.IV)
+	return KeyPush{KeyID: keyID, Key: key, IV: iv}
+}
+
+func TestKeyPush_Validate(t *testing.T) {
+	valid := testKeyPush()
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %s", err)
+	}
+	if got := valid.ActivationPolicy(); got != KeyActivationNextIDR {
+		t.Errorf("ActivationPolicy() = %s, want %s", got, KeyActivationNextIDR)
+	}
+
+	tests := map[string]func(p *KeyPush){
+		"short key id": func(p *KeyPush) { p.KeyID = p.KeyID[:8] },
+		"no key":       func(p *KeyPush) { p.Key = nil },
+		"long iv":      func(p *KeyPush) { p.IV = append(p.IV, 0) },
+		"activation":   func(p *KeyPush) { p.Activation = "later" },
+	}
+	for name, modify := range tests {
+		p := testKeyPush()
+		modify(&p)
+		if err := p.Validate(); !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("%s: Validate() error = %v, want %v", name, err, ErrInvalidProfile)
+		}
+	}
+}
+
+func TestKeyPushClient(t *testing.T) {
+	push := testKeyPush()
+	push.Activation = KeyActivationImmediate
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodPut || r.URL.Path != KeyPushPath || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("request %s %s with %q, want PUT %s with the token", r.Method, r.URL.Path, r.Header.Get("Authorization"), KeyPushPath)
+		}
+
+		var got KeyPush
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil || !bytes.Equal(got.Key, push.Key) || got.Activation != push.Activation {
+			t.Errorf("request body = %+v, %v; want the pushed key", got, err)
+		}
+
+		// the second push of the same key is a replay
+		if requests > 1 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"code":409,"message":"key id was seen before"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(KeyPushResult{KeyID: testProfile.KeyID, PreviousKeyID: testKeyID, Activation: KeyActivationImmediate, Activated: true})
+	}))
+	defer server.Close()
+
+	client := &KeyPushClient{URL: server.URL + "/", Token: "token"}
+
+	result, err := client.Push(context.Background(), push)
+	if err != nil {
+		t.Fatalf("Push() returned error: %s", err)
+	}
+	want := KeyPushResult{KeyID: testProfile.KeyID, PreviousKeyID: testKeyID, Activation: KeyActivationImmediate, Activated: true}
+	if result != want {
+		t.Errorf("Push() = %+v, want %+v", result, want)
+	}
+
+	_, err = client.Push(context.Background(), push)
+	var pushErr *KeyPushError
+	if !errors.As(err, &pushErr) || pushErr.StatusCode != http.StatusConflict || pushErr.Message != ErrKeyReplayed.Error() {
+		t.Errorf("Push() of a replayed key error = %v, want the conflict", err)
+	}
+
+	// malformed material is not sent
+	push.Key = nil
+	if _, err := client.Push(context.Background(), push); !errors.Is(err, ErrInvalidProfile) || requests != 2 {
+		t.Errorf("Push() of a malformed key error = %v after %d requests, want %v before sending", err, requests, ErrInvalidProfile)
+	}
+}
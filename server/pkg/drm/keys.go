@@ -0,0 +1,238 @@
+package drm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Key is one content key of a stream, generations order the keys of a
+// stream; a legacy single key configuration is generation 0
+type Key struct {
+	Generation uint64
+	KeyID      string // hex encoded 16 bytes
+	Key        string // hex encoded 16 bytes
+	IV         string // hex encoded 16 bytes, or 8 with cenc and cens
+
+	// ActivateAt is set for pre-provisioned keys, the key is not used
+	// before this time
+	ActivateAt time.Time
+}
+
+// KeyProvider supplies the content keys of a stream
+type KeyProvider interface {
+	GetKeys(ctx context.Context) ([]Key, error)
+}
+
+// TrackKeyProvider is implemented by providers supplying keys of tracks
+// other than video, by track label
+type TrackKeyProvider interface {
+	GetTrackKeys(ctx context.Context) (map[string]TrackKey, error)
+}
+
+// PSSHProvider is implemented by providers handing out pssh boxes of key
+// systems for their keys
+type PSSHProvider interface {
+	GetPSSH(ctx context.Context) ([]SystemPSSH, error)
+}
+
+// KeyWatcher is implemented by providers learning about new keys while the
+// stream runs, for rotation. The channel receives the complete set of keys
+// on every change and is closed once ctx is done.
+type KeyWatcher interface {
+	Watch(ctx context.Context) <-chan []Key
+}
+
+// ProviderError is a failure of the named key provider
+type ProviderError struct {
+	Provider string
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("key provider %s: %s", e.Provider, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// ProviderConfig returns cfg with the current key of the provider, and the
+// keys of the other tracks when it is a TrackKeyProvider. Errors are
+// ProviderError naming the provider.
+func ProviderConfig(ctx context.Context, p NamedProvider, cfg Config) (Config, error) {
+	keys, err := p.Provider.GetKeys(ctx)
+	if err != nil {
+		return cfg, &ProviderError{Provider: p.Name, Err: err}
+	}
+
+	key, ok := CurrentKey(keys)
+	if !ok {
+		return cfg, &ProviderError{Provider: p.Name, Err: errors.New("no key active")}
+	}
+	cfg.KeyID, cfg.Key, cfg.IV = key.KeyID, key.Key, key.IV
+	cfg.Generation = key.Generation
+
+	if trackProvider, ok := p.Provider.(TrackKeyProvider); ok {
+		tracks, err := trackProvider.GetTrackKeys(ctx)
+		if err != nil {
+			return cfg, &ProviderError{Provider: p.Name, Err: fmt.Errorf("track keys: %w", err)}
+		}
+		cfg.Tracks = tracks
+	}
+
+	return cfg, nil
+}
+
+// NewEncryptorFromProvider creates an encryptor with the current key of the
+// provider, the key material of cfg is replaced. NewEncryptor is the same
+// with a StaticKeyProvider serving the key of cfg.
+func NewEncryptorFromProvider(ctx context.Context, p NamedProvider, cfg Config) (*Encryptor, error) {
+	cfg, err := ProviderConfig(ctx, p, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEncryptor(cfg)
+}
+
+// StaticKeyProvider serves a fixed set of keys
+type StaticKeyProvider struct {
+	keys []Key
+}
+
+// NewStaticKeyProvider creates a provider serving the given keys ordered by
+// generation
+func NewStaticKeyProvider(keys ...Key) *StaticKeyProvider {
+	sorted := make([]Key, len(keys))
+	copy(sorted, keys)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Generation < sorted[j].Generation
+	})
+
+	return &StaticKeyProvider{keys: sorted}
+}
+
+// GetKeys returns a copy of all keys ordered by generation
+func (p *StaticKeyProvider) GetKeys(ctx context.Context) ([]Key, error) {
+	keys := make([]Key, len(p.keys))
+	copy(keys, p.keys)
+	return keys, nil
+}
+
+// CurrentKey returns the key with the highest generation, pre-provisioned
+// keys are skipped until their activation time
+func CurrentKey(keys []Key) (Key, bool) {
+	return CurrentKeyAt(keys, time.Now())
+}
+
+// CurrentKeyAt returns the key with the highest generation active at the
+// given time
+func CurrentKeyAt(keys []Key, now time.Time) (Key, bool) {
+	var current Key
+	var found bool
+
+	for _, key := range keys {
+		if key.ActivateAt.After(now) {
+			continue
+		}
+		if !found || key.Generation >= current.Generation {
+			current, found = key, true
+		}
+	}
+
+	return current, found
+}
+
+// ParseKey parses a key in key_id:key:iv form, all hex encoded 16 bytes
+// but an IV of 8 bytes, which the encryptor only takes with cenc and cens;
+// pre-provisioned keys are suffixed with @ and their RFC 3339 activation
+// time
+func ParseKey(s string) (Key, error) {
+	s, at, scheduled := strings.Cut(strings.TrimSpace(s), "@")
+
+	var activateAt time.Time
+	if scheduled {
+		var err error
+		activateAt, err = time.Parse(time.RFC3339, at)
+		if err != nil {
+			return Key{}, fmt.Errorf("activation time must be RFC 3339: %w", err)
+		}
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return Key{}, fmt.Errorf("key must be in key_id:key:iv form, got %d fields", len(parts))
+	}
+
+	// normalized to hex, the form keys are compared in
+	names := []string{"keyID", "key", "iv"}
+	for i, part := range parts {
+		b, err := DecodeKeyBytes(part)
+		switch {
+		case err == nil && (len(b) == 16 || i == 2 && len(b) == 8):
+			parts[i] = hex.EncodeToString(b)
+		case i == 2:
+			return Key{}, KeyBytesError("iv", "8 or 16", b, err)
+		default:
+			return Key{}, KeyBytesError(names[i], "16", b, err)
+		}
+	}
+
+	return Key{
+		KeyID:      parts[0],
+		Key:        parts[1],
+		IV:         parts[2],
+		ActivateAt: activateAt,
+	}, nil
+}
+
+// keyBytesEncodings are the base64 encodings key material is accepted in
+var keyBytesEncodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// DecodeKeyBytes decodes a key ID, key or IV given hex encoded or base64
+// encoded, standard or URL-safe and with or without padding, surrounding
+// whitespace is trimmed. A string both could decode is taken as the one
+// giving 8 or 16 bytes, hex when both do. The bytes decoded are returned
+// whatever their length, for the caller to check it.
+func DecodeKeyBytes(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+
+	decoded, err := hex.DecodeString(s)
+	if err == nil && (len(decoded) == 8 || len(decoded) == 16) {
+		return decoded, nil
+	}
+	hexOK := err == nil
+
+	for _, encoding := range keyBytesEncodings {
+		b, err := encoding.DecodeString(s)
+		if err == nil && (len(b) == 8 || len(b) == 16 || !hexOK) {
+			return b, nil
+		}
+	}
+
+	if hexOK {
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("%d characters are neither hex nor base64", len(s))
+}
+
+// KeyBytesError describes key material of DecodeKeyBytes that is not of
+// the given size, naming both accepted formats
+func KeyBytesError(name, size string, decoded []byte, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s must be %s bytes hex or base64 encoded, got %w", name, size, err)
+	}
+	return fmt.Errorf("%s must be %s bytes hex or base64 encoded, got %d bytes", name, size, len(decoded))
+}
@@ -0,0 +1,216 @@
+package drm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			input: testKeyID + ":" + testKey + ":" + testIV,
+		},
+		{
+			name:  "surrounding whitespace",
+			input: " " + testKeyID + ":" + testKey + ":" + testIV + "\n",
+		},
+		{
+			name:  "base64",
+			input: base64.StdEncoding.EncodeToString(mustHex(testKeyID)) + ":" + base64.RawURLEncoding.EncodeToString(mustHex(testKey)) + ":" + base64.StdEncoding.EncodeToString(mustHex(testIV)),
+		},
+		{
+			name:    "missing iv",
+			input:   testKeyID + ":" + testKey,
+			wantErr: true,
+		},
+		{
+			name:  "8-byte iv",
+			input: testKeyID + ":" + testKey + ":" + testIV[:16],
+		},
+		{
+			name:    "short key",
+			input:   testKeyID + ":3c3c:" + testIV,
+			wantErr: true,
+		},
+		{
+			name:    "not hex",
+			input:   testKeyID + ":" + testKey + ":zz" + testIV[2:],
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseKey(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (key.KeyID != testKeyID || key.Key != testKey || !strings.HasPrefix(testIV, key.IV)) {
+				t.Errorf("ParseKey() = %+v", key)
+			}
+		})
+	}
+}
+
+func TestDecodeKeyBytes(t *testing.T) {
+	key := mustHex("fbeffe3c3c3c3c3c3c3c3c3c3c3cfbff")
+
+	tests := []struct {
+		name  string
+		input string
+		want  []byte
+	}{
+		{"hex", "fbeffe3c3c3c3c3c3c3c3c3c3c3cfbff", key},
+		{"upper case hex", "FBEFFE3C3C3C3C3C3C3C3C3C3C3CFBFF", key},
+		{"padded base64", "++/+PDw8PDw8PDw8PDz7/w==", key},
+		{"unpadded base64", "++/+PDw8PDw8PDw8PDz7/w", key},
+		{"url-safe base64", "--_-PDw8PDw8PDw8PDz7_w==", key},
+		{"unpadded url-safe base64", "--_-PDw8PDw8PDw8PDz7_w", key},
+		{"trailing newline", "++/+PDw8PDw8PDw8PDz7/w==\n", key},
+		{"8-byte base64", "1fvWuC7ZPk4=", mustHex("d5fbd6b82ed93e4e")},
+		{"8-byte hex", "d5fbd6b82ed93e4e", mustHex("d5fbd6b82ed93e4e")},
+		// valid hex of 11 bytes, base64 of 16
+		{"hex-like base64", "AAAAAAAAAAAAAAAAAAAAAA", make([]byte, 16)},
+	}
+
+	for _, tt := range tests {
+		got, err := DecodeKeyBytes(tt.input)
+		if err != nil {
+			t.Errorf("%s: DecodeKeyBytes() returned error: %s", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: DecodeKeyBytes() = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := DecodeKeyBytes("not key material!"); err == nil {
+		t.Errorf("DecodeKeyBytes() accepted neither hex nor base64")
+	}
+}
+
+func TestNewEncryptor_base64(t *testing.T) {
+	e, err := NewEncryptor(Config{
+		Enabled: true,
+		KeyID:   base64.StdEncoding.EncodeToString(mustHex(testKeyID)),
+		Key:     base64.RawURLEncoding.EncodeToString(mustHex(testKey)) + "\n",
+		IV:      " " + base64.URLEncoding.EncodeToString(mustHex(testIV)),
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if !bytes.Equal(e.KeyID(), mustHex(testKeyID)) || !bytes.Equal(e.Key(), mustHex(testKey)) || !bytes.Equal(e.IV(), mustHex(testIV)) {
+		t.Errorf("NewEncryptor() key = %x:%x:%x, want the decoded key", e.KeyID(), e.Key(), e.IV())
+	}
+
+	// the error names both formats and what was decoded
+	_, err = NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, 12)), IV: testIV})
+	if err == nil || err.Error() != "key must be 16 bytes hex or base64 encoded, got 12 bytes" {
+		t.Errorf("NewEncryptor() error = %v, want the length decoded", err)
+	}
+}
+
+func TestStaticKeyProvider(t *testing.T) {
+	p := NewStaticKeyProvider(
+		Key{Generation: 2, KeyID: "02"},
+		Key{Generation: 0, KeyID: "00"},
+		Key{Generation: 1, KeyID: "01"},
+	)
+
+	keys, err := p.GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+
+	for i, key := range keys {
+		if key.Generation != uint64(i) {
+			t.Errorf("GetKeys()[%d] generation = %d, want %d", i, key.Generation, i)
+		}
+	}
+
+	// returned keys are copies
+	keys[0].KeyID = "ff"
+	if again, _ := p.GetKeys(context.Background()); again[0].KeyID != "00" {
+		t.Errorf("GetKeys() returned the internal slice")
+	}
+
+	current, ok := CurrentKey(keys)
+	if !ok || current.Generation != 2 {
+		t.Errorf("CurrentKey() = %+v, %v, want generation 2", current, ok)
+	}
+
+	if _, ok := CurrentKey(nil); ok {
+		t.Errorf("CurrentKey(nil) returned a key")
+	}
+}
+
+// trackProvider serves a video key and the keys of other tracks
+type trackProvider struct {
+	flakyProvider
+	tracks map[string]TrackKey
+}
+
+func (p *trackProvider) GetTrackKeys(ctx context.Context) (map[string]TrackKey, error) {
+	return p.tracks, nil
+}
+
+func TestNewEncryptorFromProvider(t *testing.T) {
+	keys := []Key{
+		{Generation: 1, KeyID: "00000000000000000000000000000002", Key: testKey, IV: testIV},
+		{Generation: 2, KeyID: testKeyID, Key: testKey, IV: testIV},
+	}
+	audio := TrackKey{KeyID: "00000000000000000000000000000003", Key: testKey, IV: testIV}
+	p := &trackProvider{
+		flakyProvider: flakyProvider{keys: keys},
+		tracks:        map[string]TrackKey{TrackAudio: audio},
+	}
+
+	// the key material of the config is replaced
+	cfg := Config{Enabled: true, Mode: "cenc", KeyID: "ffffffffffffffffffffffffffffffff"}
+	e, err := NewEncryptorFromProvider(context.Background(), NamedProvider{Name: "kms", Provider: p}, cfg)
+	if err != nil {
+		t.Fatalf("NewEncryptorFromProvider() returned error: %s", err)
+	}
+	if got := e.Profile(); got.KeyID != testKeyID || got.Generation != 2 {
+		t.Errorf("NewEncryptorFromProvider() key ID = %s, generation %d, want %s of generation 2", got.KeyID, got.Generation, testKeyID)
+	}
+
+	withTracks, err := ProviderConfig(context.Background(), NamedProvider{Name: "kms", Provider: p}, cfg)
+	if err != nil {
+		t.Fatalf("ProviderConfig() returned error: %s", err)
+	}
+	if withTracks.Tracks[TrackAudio] != audio {
+		t.Errorf("ProviderConfig() tracks = %v, want the audio key", withTracks.Tracks)
+	}
+
+	// a static provider of the config key is the same as NewEncryptor
+	static := NewStaticKeyProvider(Key{KeyID: testKeyID, Key: testKey, IV: testIV})
+	e, err = NewEncryptorFromProvider(context.Background(), NamedProvider{Name: "static", Provider: static}, cfg)
+	if err != nil || e.Profile().KeyID != testKeyID {
+		t.Errorf("NewEncryptorFromProvider() of a static provider = %v, %v", e, err)
+	}
+
+	p.down = true
+	_, err = NewEncryptorFromProvider(context.Background(), NamedProvider{Name: "kms", Provider: p}, cfg)
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) || providerErr.Provider != "kms" {
+		t.Fatalf("NewEncryptorFromProvider() of a failing provider = %v, want a ProviderError of kms", err)
+	}
+	if want := "key provider kms: connection refused"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+
+	empty := NewStaticKeyProvider()
+	if _, err := NewEncryptorFromProvider(context.Background(), NamedProvider{Name: "empty", Provider: empty}, cfg); !errors.As(err, &providerErr) {
+		t.Errorf("NewEncryptorFromProvider() without keys = %v, want a ProviderError", err)
+	}
+}
@@ -0,0 +1,174 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrKeysExhausted = errors.New("no pre-provisioned keys left")
+
+// KeyStockLow is published when fewer pre-provisioned keys than the alert
+// threshold remain, Remaining is 0 once they are exhausted
+type KeyStockLow struct {
+	Time      time.Time
+	Remaining int
+}
+
+func (KeyStockLow) Type() EventType { return EventKeyStockLow }
+
+// KeySchedule stages pre-provisioned keys on an encryptor one after the
+// other in generation order, without contacting any key provider
+type KeySchedule struct {
+	mu   sync.Mutex
+	keys []Key
+	// newest generation known, staged or not
+	last uint64
+
+	lowStock   int
+	onLowStock func(remaining int)
+}
+
+// NewKeySchedule takes the pre-provisioned keys newer than the current one,
+// their activation times have to increase with the generation
+func NewKeySchedule(keys []Key, current Key) (*KeySchedule, error) {
+	var future []Key
+	for _, key := range keys {
+		if !key.ActivateAt.IsZero() && key.Generation > current.Generation {
+			future = append(future, key)
+		}
+	}
+
+	sort.SliceStable(future, func(i, j int) bool {
+		return future[i].Generation < future[j].Generation
+	})
+
+	for i := 1; i < len(future); i++ {
+		if !future[i].ActivateAt.After(future[i-1].ActivateAt) {
+			return nil, fmt.Errorf("key generation %d activates at %s, not after generation %d",
+				future[i].Generation, future[i].ActivateAt.Format(time.RFC3339), future[i-1].Generation)
+		}
+	}
+
+	last := current.Generation
+	if len(future) > 0 {
+		last = future[len(future)-1].Generation
+	}
+
+	return &KeySchedule{keys: future, last: last}, nil
+}
+
+// Provision adds the keys newer than all keys known so far, as watched
+// from a KeyWatcher, and returns how many were added. Keys without an
+// activation time are switched to at the next IDR frame once staged.
+func (s *KeySchedule) Provision(keys []Key) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var added []Key
+	for _, key := range keys {
+		if key.Generation > s.last {
+			added = append(added, key)
+		}
+	}
+
+	sort.SliceStable(added, func(i, j int) bool {
+		return added[i].Generation < added[j].Generation
+	})
+
+	// activation times are checked against the keys still to be staged
+	all := append(append([]Key{}, s.keys...), added...)
+	for i := 1; i < len(all); i++ {
+		if all[i].ActivateAt.IsZero() || all[i-1].ActivateAt.IsZero() {
+			continue
+		}
+		if !all[i].ActivateAt.After(all[i-1].ActivateAt) {
+			return 0, fmt.Errorf("key generation %d activates at %s, not after generation %d",
+				all[i].Generation, all[i].ActivateAt.Format(time.RFC3339), all[i-1].Generation)
+		}
+	}
+
+	if len(added) > 0 {
+		s.keys = all
+		s.last = added[len(added)-1].Generation
+	}
+	return len(added), nil
+}
+
+// OnLowStock sets a listener called after a key is staged while fewer than
+// threshold keys remain
+func (s *KeySchedule) OnLowStock(threshold int, listener func(remaining int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lowStock = threshold
+	s.onLowStock = listener
+}
+
+// Remaining returns how many keys were not staged yet
+func (s *KeySchedule) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.keys)
+}
+
+// Stage stages the next key with the current parameters of the encryptor
+// once its activation time is within the activation skew of the encryptor,
+// it does nothing before or while another profile is pending. Staged
+// earlier, the key would block other profile changes and be handed out
+// through PendingKey until it activates. A key whose activation time
+// passed while it could not be staged is switched to at the next IDR
+// frame. Once all keys are used ErrKeysExhausted is returned and the
+// current key stays in use.
+func (s *KeySchedule) Stage(e *Encryptor) (Key, bool, error) {
+	if _, pending := e.PendingProfile(); pending {
+		return Key{}, false, nil
+	}
+
+	s.mu.Lock()
+
+	if len(s.keys) == 0 {
+		s.mu.Unlock()
+		return Key{}, false, ErrKeysExhausted
+	}
+
+	next := s.keys[0]
+	if !next.ActivateAt.IsZero() && e.now().Before(next.ActivateAt.Add(-e.activationSkew)) {
+		s.mu.Unlock()
+		return Key{}, false, nil
+	}
+
+	p := e.Profile()
+	p.KeyID = next.KeyID
+	p.Key = next.Key
+	p.IV = next.IV
+	p.Generation = next.Generation
+
+	err := e.ApplyProfileAt(p, next.ActivateAt)
+	if errors.Is(err, ErrActivationPast) {
+		err = e.ApplyProfile(p)
+	}
+	if errors.Is(err, ErrProfilePending) {
+		s.mu.Unlock()
+		return Key{}, false, nil
+	}
+	if err != nil {
+		s.mu.Unlock()
+		return Key{}, false, err
+	}
+
+	s.keys = s.keys[1:]
+	remaining := len(s.keys)
+	onLowStock := s.onLowStock
+	lowStock := remaining < s.lowStock
+	s.mu.Unlock()
+
+	if lowStock && onLowStock != nil {
+		onLowStock(remaining)
+	}
+
+	return next, true, nil
+}
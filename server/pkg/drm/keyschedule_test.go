@@ -0,0 +1,158 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func futureKeys(start time.Time, n int) []Key {
+	keys := make([]Key, n)
+	for i := range keys {
+		keys[i] = Key{
+			Generation: uint64(i + 1),
+			KeyID:      fmt.Sprintf("%032x", i+1),
+			Key:        fmt.Sprintf("%032x", i+101),
+			IV:         fmt.Sprintf("%032x", i+201),
+			ActivateAt: start.Add(time.Duration(i+1) * time.Hour),
+		}
+	}
+	return keys
+}
+
+func TestKeySchedule_Stage(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{t: start}
+
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	e.now = clock.now
+
+	keys := futureKeys(start, 3)
+	s, err := NewKeySchedule(keys, Key{})
+	if err != nil {
+		t.Fatalf("NewKeySchedule() returned error: %s", err)
+	}
+
+	var alerts []int
+	s.OnLowStock(2, func(remaining int) {
+		alerts = append(alerts, remaining)
+	})
+
+	idrFrame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+
+	for i, key := range keys {
+		// the key is not staged hours before its activation
+		if _, ok, err := s.Stage(e); ok || err != nil {
+			t.Errorf("Stage() #%d before the activation = %v, %v, want false, nil", i, ok, err)
+		}
+		if _, _, pending := e.PendingKey(); pending {
+			t.Fatalf("Stage() #%d staged the key before the activation", i)
+		}
+
+		clock.t = key.ActivateAt.Add(-time.Second)
+		staged, ok, err := s.Stage(e)
+		if err != nil || !ok {
+			t.Fatalf("Stage() #%d = %v, %v", i, ok, err)
+		}
+		if staged.Generation != key.Generation {
+			t.Errorf("Stage() #%d staged generation %d, want %d", i, staged.Generation, key.Generation)
+		}
+
+		// nothing is staged while the key waits for its activation
+		if _, ok, err := s.Stage(e); ok || err != nil {
+			t.Errorf("Stage() while pending = %v, %v, want false, nil", ok, err)
+		}
+
+		clock.t = key.ActivateAt
+		if _, err := e.Encrypt(idrFrame); err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+		if p := e.Profile(); p.KeyID != key.KeyID || p.Generation != key.Generation {
+			t.Errorf("Profile() after activation = %s gen %d, want %s gen %d", p.KeyID, p.Generation, key.KeyID, key.Generation)
+		}
+	}
+
+	if want := []int{1, 0}; fmt.Sprint(alerts) != fmt.Sprint(want) {
+		t.Errorf("low stock alerts = %v, want %v", alerts, want)
+	}
+
+	// exhausted, the last key stays in use
+	if _, ok, err := s.Stage(e); ok || !errors.Is(err, ErrKeysExhausted) {
+		t.Errorf("Stage() after last key = %v, %v, want %v", ok, err, ErrKeysExhausted)
+	}
+	if p := e.Profile(); p.KeyID != keys[2].KeyID {
+		t.Errorf("Profile() after exhaustion = %s, want %s", p.KeyID, keys[2].KeyID)
+	}
+}
+
+func TestKeySchedule_activationPassed(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+	e.now = (&fakeClock{t: start.Add(5 * time.Hour)}).now
+
+	s, err := NewKeySchedule(futureKeys(start, 1), Key{})
+	if err != nil {
+		t.Fatalf("NewKeySchedule() returned error: %s", err)
+	}
+
+	if _, ok, err := s.Stage(e); !ok || err != nil {
+		t.Fatalf("Stage() = %v, %v, want true, nil", ok, err)
+	}
+	if at, ok := e.PendingActivation(); !ok || !at.IsZero() {
+		t.Errorf("PendingActivation() = %v, %v, want next IDR", at, ok)
+	}
+}
+
+func TestNewKeySchedule(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	keys := futureKeys(start, 3)
+	s, err := NewKeySchedule(append([]Key{{Generation: 0}}, keys...), keys[0])
+	if err != nil {
+		t.Fatalf("NewKeySchedule() returned error: %s", err)
+	}
+	if got := s.Remaining(); got != 2 {
+		t.Errorf("Remaining() = %d, want 2", got)
+	}
+
+	keys[2].ActivateAt = keys[1].ActivateAt
+	if _, err := NewKeySchedule(keys, Key{}); err == nil {
+		t.Errorf("NewKeySchedule() with unordered activation returned no error")
+	}
+}
+
+func TestKeySchedule_Provision(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	keys := futureKeys(start, 4)
+	s, err := NewKeySchedule(keys[:2], Key{})
+	if err != nil {
+		t.Fatalf("NewKeySchedule() returned error: %s", err)
+	}
+
+	// watched key sets repeat the keys known already
+	added, err := s.Provision(keys[:3])
+	if err != nil || added != 1 {
+		t.Fatalf("Provision() = %d, %v, want 1, nil", added, err)
+	}
+	if added, _ := s.Provision(keys[:3]); added != 0 {
+		t.Errorf("Provision() of known keys added %d", added)
+	}
+	if got := s.Remaining(); got != 3 {
+		t.Errorf("Remaining() = %d, want 3", got)
+	}
+
+	early := keys[3]
+	early.ActivateAt = start
+	if _, err := s.Provision([]Key{early}); err == nil {
+		t.Errorf("Provision() of a key activating before the staged ones returned no error")
+	}
+
+	// keys without activation time are due right away
+	now := Key{Generation: 5, KeyID: testKeyID, Key: testKey, IV: testIV}
+	if added, err := s.Provision([]Key{keys[3], now}); err != nil || added != 2 {
+		t.Errorf("Provision() = %d, %v, want 2, nil", added, err)
+	}
+}
@@ -0,0 +1,188 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// MaxLayers is how many layers ForLayer creates, the index has to fit the
+// two bytes of the IV it is mixed into
+const MaxLayers = 0xffff
+
+// LayerInfo describes the IV a video layer is encrypted with, the key is
+// the one of the encryptor
+type LayerInfo struct {
+	RID   string
+	Index int
+	IV    []byte
+}
+
+// LayerIV derives the IV of a layer from the base IV by XORing the layer
+// index into its first two bytes. The per-sample counter of counter IV
+// mode and the block counter of cenc only ever change the low bytes, so
+// layers sharing a key never share a keystream.
+func LayerIV(iv []byte, index int) []byte {
+	layer := bytes.Clone(iv)
+	if len(layer) < 2 {
+		return layer
+	}
+
+	binary.BigEndian.PutUint16(layer, binary.BigEndian.Uint16(layer)^uint16(index))
+	return layer
+}
+
+// layerConfig returns the configuration layers are created from, without
+// the key material, which is taken from the current profile instead
+func layerConfig(cfg Config) *Config {
+	cfg.KeyID, cfg.Key, cfg.IV = "", "", ""
+	cfg.MasterSecret, cfg.DerivationContext = "", ""
+	cfg.AutoGenerate = false
+	cfg.Tracks = nil
+	cfg.LayerIVs = false
+	// the self-test passed for the encryptor the layers belong to
+	cfg.SkipSelfTest = true
+	return &cfg
+}
+
+// ForLayer returns the encryptor of a video layer such as a simulcast
+// encoding, identified by its RID. With LayerIVs every layer gets an
+// encryptor of its own, created on first use with the key and profile of
+// e and an IV derived by LayerIV, indexed from 1 in order of creation so
+// that no layer reuses the IV of e. Profile changes, SetPattern,
+// SetEnabled and Close of e are passed on to its layers, each of which
+// switches at a keyframe of its own; e switches with the first of them
+// and reports the update to OnUpdate, the layers report none. Without
+// LayerIVs, for a disabled or closed encryptor and for a layer itself, e
+// is returned.
+func (e *Encryptor) ForLayer(rid string) (*Encryptor, error) {
+	if e.layerConfig == nil || !e.enabled.Load() {
+		return e, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.enabled.Load() {
+		return e, nil
+	}
+	if layer, ok := e.layers[rid]; ok {
+		return layer, nil
+	}
+
+	index := len(e.layers) + 1
+	if index > MaxLayers {
+		return nil, fmt.Errorf("%w: more than %d layers", ErrInvalidProfile, MaxLayers)
+	}
+
+	s := e.state.Load()
+	cfg := *e.layerConfig
+	cfg.KeyID = hex.EncodeToString(s.keyID)
+	cfg.Key = hex.EncodeToString(s.key)
+	cfg.IV = hex.EncodeToString(LayerIV(s.iv, index))
+	cfg.Mode = s.mode
+	cfg.CryptBlocks, cfg.SkipBlocks = s.cryptBlocks, s.skipBlocks
+	cfg.Generation = s.generation
+
+	layer, err := NewEncryptor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("layer %s: %w", rid, err)
+	}
+	layer.parent, layer.layerIndex = e, index
+	layer.now = e.now
+	layer.logger.Store(e.logger.Load())
+	layer.tracer.Store(e.tracer.Load())
+	layer.onEncrypt.Store(e.onEncrypt.Load())
+	layer.wireVersion.Store(e.wireVersion.Load())
+
+	// a layer starts where e is, including what it waits for
+	if e.pending != nil {
+		layer.stage(e.pending.forLayer(index), e.pendingAt)
+	}
+	layer.active.Store(e.active.Load())
+	layer.pendingActive = e.pendingActive
+	layer.toggling.Store(e.toggling.Load())
+
+	if e.layers == nil {
+		e.layers = make(map[string]*Encryptor)
+	}
+	e.layers[rid] = layer
+	return layer, nil
+}
+
+// Layers describes the layers created by ForLayer in order of their index
+func (e *Encryptor) Layers() []LayerInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	layers := make([]LayerInfo, 0, len(e.layers))
+	for rid, layer := range e.layers {
+		s := layer.state.Load()
+		if s == nil {
+			continue
+		}
+		layers = append(layers, LayerInfo{
+			RID:   rid,
+			Index: layer.layerIndex,
+			IV:    bytes.Clone(s.iv),
+		})
+	}
+
+	sort.Slice(layers, func(i, j int) bool {
+		return layers[i].Index < layers[j].Index
+	})
+	return layers
+}
+
+// forLayer returns a copy of the state with the IV of a layer and its own
+// sample numbers and key material, so that zeroizing one leaves the other
+func (s *cipherState) forLayer(index int) *cipherState {
+	layer := *s
+	layer.keyID = bytes.Clone(s.keyID)
+	layer.key = bytes.Clone(s.key)
+	layer.iv = LayerIV(s.iv, index)
+	layer.samples = new(atomic.Uint64)
+	layer.built = &builtBoxes{}
+	layer.canary = layer.checksum()
+	return &layer
+}
+
+// stageLayers stages the layer variants of a profile staged by e, nil
+// discards theirs; e.mu is held
+func (e *Encryptor) stageLayers(s *cipherState, activateAt time.Time) {
+	for _, layer := range e.layers {
+		layer.mu.Lock()
+		if layer.enabled.Load() {
+			if s == nil {
+				layer.stage(nil, time.Time{})
+			} else {
+				layer.stage(s.forLayer(layer.layerIndex), activateAt)
+			}
+		}
+		layer.mu.Unlock()
+	}
+}
+
+// switchLayers switches the layers to the variants of the state e switched
+// to right away; e.mu is held. Only e reports the update.
+func (e *Encryptor) switchLayers(s *cipherState) {
+	for _, layer := range e.layers {
+		layer.mu.Lock()
+		if layer.enabled.Load() {
+			layer.switchTo(s.forLayer(layer.layerIndex))
+		}
+		layer.mu.Unlock()
+	}
+}
+
+// toggleLayers passes SetEnabled on to the layers; e.mu is held
+func (e *Encryptor) toggleLayers(enabled bool) {
+	for _, layer := range e.layers {
+		// closed layers have nothing to toggle
+		_ = layer.SetEnabled(enabled)
+	}
+}
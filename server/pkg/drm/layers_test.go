@@ -0,0 +1,181 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestLayerIV(t *testing.T) {
+	iv := mustHex(testIV)
+
+	if got := LayerIV(iv, 0); !bytes.Equal(got, iv) {
+		t.Errorf("LayerIV(0) = %x, want the base IV", got)
+	}
+
+	got := LayerIV(iv, 0x0102)
+	if got[0] != iv[0]^0x01 || got[1] != iv[1]^0x02 || !bytes.Equal(got[2:], iv[2:]) {
+		t.Errorf("LayerIV(0x0102) = %x, want the index XORed into the first two bytes of %x", got, iv)
+	}
+	if got := LayerIV(iv[:8], 1); len(got) != 8 {
+		t.Errorf("LayerIV() of an 8 byte IV = %x, want 8 bytes", got)
+	}
+	if bytes.Equal(iv, got) {
+		t.Errorf("LayerIV() modified the base IV")
+	}
+}
+
+func TestEncryptor_ForLayer(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, LayerIVs: true})
+
+	hd, err := e.ForLayer("hd")
+	if err != nil {
+		t.Fatalf("ForLayer() returned error: %s", err)
+	}
+	sd, err := e.ForLayer("sd")
+	if err != nil {
+		t.Fatalf("ForLayer() returned error: %s", err)
+	}
+	if again, _ := e.ForLayer("hd"); again != hd {
+		t.Errorf("ForLayer() created a second encryptor for the same layer")
+	}
+	if hd == e || sd == e || hd == sd {
+		t.Fatalf("ForLayer() = %p, %p for %p, want encryptors of their own", hd, sd, e)
+	}
+	if self, _ := hd.ForLayer("hd"); self != hd {
+		t.Errorf("ForLayer() of a layer did not return the layer")
+	}
+
+	// the key is shared, the IVs are not
+	base := e.Profile()
+	for i, layer := range []*Encryptor{hd, sd} {
+		p := layer.Profile()
+		if p.KeyID != base.KeyID || !bytes.Equal(layer.Key(), e.Key()) {
+			t.Errorf("layer %d key ID = %s, want %s", i+1, p.KeyID, base.KeyID)
+		}
+		if want := hex.EncodeToString(LayerIV(mustHex(testIV), i+1)); p.IV != want {
+			t.Errorf("layer %d IV = %s, want %s", i+1, p.IV, want)
+		}
+	}
+
+	frame := h264Stream()[0]
+	hdFrame, err := hd.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	sdFrame, err := sd.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if bytes.Equal(hdFrame, sdFrame) {
+		t.Errorf("layers encrypted a frame to the same ciphertext")
+	}
+
+	layers := e.Layers()
+	if len(layers) != 2 || layers[0].RID != "hd" || layers[0].Index != 1 || layers[1].RID != "sd" || layers[1].Index != 2 {
+		t.Fatalf("Layers() = %+v, want hd and sd in order", layers)
+	}
+
+	info, err := e.ClientInfo()
+	if err != nil {
+		t.Fatalf("ClientInfo() returned error: %s", err)
+	}
+	if len(info.Layers) != 2 || !bytes.Equal(info.Layers[1].IV, sd.IV()) {
+		t.Errorf("ClientInfo() layers = %+v, want the IVs of both layers", info.Layers)
+	}
+
+	e.Close()
+	if hd.Enabled() || sd.Enabled() {
+		t.Errorf("layers still enabled after Close()")
+	}
+	if layer, _ := e.ForLayer("ld"); layer != e {
+		t.Errorf("ForLayer() of a closed encryptor created a layer")
+	}
+}
+
+func TestEncryptor_ForLayer_withoutLayerIVs(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if layer, err := e.ForLayer("hd"); err != nil || layer != e {
+		t.Errorf("ForLayer() = %p, %v, want the encryptor itself", layer, err)
+	}
+
+	disabled, _ := NewEncryptor(Config{LayerIVs: true})
+	if layer, err := disabled.ForLayer("hd"); err != nil || layer != disabled {
+		t.Errorf("ForLayer() of a disabled encryptor = %p, %v, want the encryptor itself", layer, err)
+	}
+
+	audio := newTestEncryptor(t, Config{Codec: CodecAudio, LayerIVs: true})
+	if layer, err := audio.ForLayer("hd"); err != nil || layer != audio {
+		t.Errorf("ForLayer() of an audio encryptor = %p, %v, want the encryptor itself", layer, err)
+	}
+}
+
+func TestEncryptor_ForLayer_profile(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, LayerIVs: true})
+
+	var updates []Update
+	e.OnUpdate(func(u Update) {
+		updates = append(updates, u)
+	})
+
+	hd, _ := e.ForLayer("hd")
+	sd, _ := e.ForLayer("sd")
+
+	next := Profile{
+		Mode:        "cbcs",
+		CryptBlocks: 1,
+		SkipBlocks:  9,
+		KeyID:       "00000000000000000000000000000002",
+		Key:         "4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d4d",
+		IV:          "0102030405060708090a0b0c0d0e0f10",
+		Generation:  2,
+	}
+	if err := e.ApplyProfile(next); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+	for _, layer := range []*Encryptor{hd, sd} {
+		if _, ok := layer.PendingProfile(); !ok {
+			t.Fatalf("profile not staged on the layers")
+		}
+	}
+
+	// the first layer to see a keyframe switches the encryptor along
+	frames := h264Stream()
+	if _, err := hd.Encrypt(frames[0]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if got := hd.Profile(); got.KeyID != next.KeyID || got.IV != hex.EncodeToString(LayerIV(mustHex(next.IV), 1)) {
+		t.Errorf("layer profile = %+v, want the new key with the IV of the layer", got)
+	}
+	if got := e.Profile(); got.KeyID != next.KeyID || got.IV != next.IV {
+		t.Errorf("Profile() = %+v, want the new profile with the first layer", got)
+	}
+	if len(updates) != 1 || updates[0].Profile.KeyID != next.KeyID {
+		t.Fatalf("OnUpdate() = %+v, want a single update", updates)
+	}
+
+	// the other layer waits for a keyframe of its own
+	if _, err := sd.Encrypt(frames[1]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if sd.Profile().KeyID != testKeyID {
+		t.Errorf("layer switched before its keyframe")
+	}
+	if _, err := sd.Encrypt(frames[0]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if got := sd.Profile(); got.KeyID != next.KeyID || got.IV != hex.EncodeToString(LayerIV(mustHex(next.IV), 2)) {
+		t.Errorf("layer profile = %+v, want the new key with the IV of the layer", got)
+	}
+	if len(updates) != 1 {
+		t.Errorf("OnUpdate() called %d times, want once for all layers", len(updates))
+	}
+
+	// switching encryption off reaches the layers as well
+	if err := e.SetEnabled(false); err != nil {
+		t.Fatalf("SetEnabled() returned error: %s", err)
+	}
+	if enabled, ok := sd.PendingEnabled(); enabled || !ok {
+		t.Errorf("PendingEnabled() of a layer = %v, %v, want false, true", enabled, ok)
+	}
+}
@@ -0,0 +1,59 @@
+package drm
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Template variables of license URLs, substituted by ExpandLicenseURL
+const (
+	LicenseURLKeyID     = "{keyId}"
+	LicenseURLKeyIDUUID = "{keyIdUUID}"
+	LicenseURLSessionID = "{sessionId}"
+)
+
+// ExpandLicenseURL substitutes the template variables of a license URL:
+// {keyId} by the hex encoded key ID, {keyIdUUID} by the key ID as UUID and
+// {sessionId} by the query escaped session ID, empty where the URL is the
+// same for every session such as in the shared PlayReady header
+func ExpandLicenseURL(template string, keyID []byte, sessionID string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	return strings.NewReplacer(
+		LicenseURLKeyID, hex.EncodeToString(keyID),
+		LicenseURLKeyIDUUID, UUIDString(keyID),
+		LicenseURLSessionID, url.QueryEscape(sessionID),
+	).Replace(template)
+}
+
+// LicenseURLPerSession reports whether a license URL names the session, so
+// that it differs between sessions sharing a key
+func LicenseURLPerSession(template string) bool {
+	return strings.Contains(template, LicenseURLSessionID)
+}
+
+// ValidateLicenseURL checks that a license URL is an absolute https URL, or
+// an absolute path on the server itself such as /api/drm/clearkey, once
+// its template variables are substituted. Quotes and line breaks are
+// rejected as they end the attributes of HLS tags.
+func ValidateLicenseURL(template string) error {
+	if strings.ContainsAny(template, "\"\r\n") {
+		return fmt.Errorf("license url must not contain quotes or line breaks, got %q", template)
+	}
+
+	u, err := url.Parse(ExpandLicenseURL(template, make([]byte, 16), "session"))
+	if err != nil {
+		return fmt.Errorf("license url %q: %w", template, err)
+	}
+
+	switch {
+	case u.Scheme == "https" && u.Host != "":
+		return nil
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/"):
+		return nil
+	}
+	return fmt.Errorf("license url must be an absolute https URL or a path on this server, got %q", template)
+}
@@ -0,0 +1,39 @@
+package drm
+
+import "testing"
+
+func TestExpandLicenseURL(t *testing.T) {
+	keyID := mustHex(testKeyID)
+
+	got := ExpandLicenseURL("https://license.example.com/{keyId}?session={sessionId}&kid={keyIdUUID}", keyID, "a b&c")
+	want := "https://license.example.com/" + testKeyID + "?session=a+b%26c&kid=" + UUIDString(keyID)
+	if got != want {
+		t.Errorf("ExpandLicenseURL() = %s, want %s", got, want)
+	}
+
+	if !LicenseURLPerSession("https://license.example.com/?s={sessionId}") || LicenseURLPerSession("https://license.example.com/{keyId}") {
+		t.Errorf("LicenseURLPerSession() does not match the session variable")
+	}
+}
+
+func TestValidateLicenseURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://license.example.com/widevine", true},
+		{"https://license.example.com/{keyId}?session={sessionId}", true},
+		{"/api/drm/clearkey", true},
+		{"http://license.example.com/widevine", false},
+		{"license.example.com/widevine", false},
+		{"//license.example.com/widevine", false},
+		{"https:///widevine", false},
+		{`https://license.example.com/"key"`, false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateLicenseURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("ValidateLicenseURL(%q) error = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
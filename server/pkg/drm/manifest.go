@@ -0,0 +1,165 @@
+package drm
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ManifestVersion is the version of the Manifest format written
+const ManifestVersion = 1
+
+// ManifestSuffix is appended to the path of a recording for its manifest
+const ManifestSuffix = ".drm.json"
+
+// Manifest is the sidecar of a recording naming the protection of every
+// part of it, so that the recording can still be decrypted after the keys
+// rotated. It never holds a key, only the key IDs to look them up.
+type Manifest struct {
+	Version int              `json:"version"`
+	Created time.Time        `json:"created"`
+	Periods []ManifestPeriod `json:"periods"`
+}
+
+// ManifestPeriod is a run of samples encrypted with the same parameters,
+// it lasts until the next period starts
+type ManifestPeriod struct {
+	// wall clock time the first sample was recorded at, its index in the
+	// recording and the byte offset of its data
+	Start  time.Time `json:"start"`
+	Sample uint64    `json:"sample"`
+	Offset int64     `json:"offset"`
+
+	// Scheme is empty for samples left clear
+	Scheme      string `json:"scheme"`
+	KeyID       string `json:"key_id,omitempty"` // hex encoded 16 bytes
+	Generation  uint64 `json:"generation,omitempty"`
+	CryptBlocks int    `json:"crypt_blocks,omitempty"`
+	SkipBlocks  int    `json:"skip_blocks,omitempty"`
+	IVMode      string `json:"iv_mode,omitempty"`
+	// constant IV, or the IV per-sample IVs are counted from and the
+	// nonce mixed into it, see Config.IVNonce
+	IV      string `json:"iv,omitempty"`
+	IVNonce string `json:"iv_nonce,omitempty"`
+}
+
+// sameParameters reports whether both periods protect alike
+func (p ManifestPeriod) sameParameters(o ManifestPeriod) bool {
+	p.Start, p.Sample, p.Offset = o.Start, o.Sample, o.Offset
+	return p == o
+}
+
+// PeriodAt returns the period of the sample with the given index
+func (m Manifest) PeriodAt(sample uint64) (ManifestPeriod, bool) {
+	for i := len(m.Periods) - 1; i >= 0; i-- {
+		if m.Periods[i].Sample <= sample {
+			return m.Periods[i], true
+		}
+	}
+	return ManifestPeriod{}, false
+}
+
+// ManifestRecorder builds the Manifest of a recording from the samples of
+// the Encryptor written to it, a period starts with every sample encrypted
+// with other parameters than the one before. It is safe for concurrent use.
+type ManifestRecorder struct {
+	mu       sync.Mutex
+	manifest Manifest
+	state    *cipherState
+	samples  uint64
+}
+
+// NewManifestRecorder creates the recorder of a recording starting now
+func NewManifestRecorder() *ManifestRecorder {
+	return &ManifestRecorder{
+		manifest: Manifest{
+			Version: ManifestVersion,
+			Created: time.Now().UTC(),
+			Periods: []ManifestPeriod{},
+		},
+	}
+}
+
+// Record notes the next sample of the recording, written at offset bytes
+// from its start
+func (r *ManifestRecorder) Record(sample EncryptedSample, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := r.samples
+	r.samples++
+
+	// most samples share the state of the one before
+	if len(r.manifest.Periods) > 0 && sample.state == r.state {
+		return
+	}
+	r.state = sample.state
+
+	period := ManifestPeriod{
+		Start:  time.Now().UTC(),
+		Sample: index,
+		Offset: offset,
+	}
+	if p, ok := sample.Profile(); ok {
+		period.Scheme = p.Mode
+		period.KeyID = p.KeyID
+		period.Generation = p.Generation
+		period.CryptBlocks = p.CryptBlocks
+		period.SkipBlocks = p.SkipBlocks
+		period.IVMode = p.IVMode
+		period.IV = p.IV
+		period.IVNonce = hex.EncodeToString(sample.state.ivNonce)
+	}
+
+	// switching states without a change is no new period
+	if n := len(r.manifest.Periods); n > 0 && r.manifest.Periods[n-1].sameParameters(period) {
+		return
+	}
+	r.manifest.Periods = append(r.manifest.Periods, period)
+}
+
+// Manifest returns a copy of the manifest recorded so far
+func (r *ManifestRecorder) Manifest() Manifest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := r.manifest
+	m.Periods = append([]ManifestPeriod{}, m.Periods...)
+	return m
+}
+
+// WriteManifest writes the manifest of a recording next to it, replacing
+// an earlier one at once
+func WriteManifest(recording string, m Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := recording + ManifestSuffix
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadManifest reads a manifest written by WriteManifest
+func ReadManifest(path string) (Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, fmt.Errorf("manifest %s: %w", path, err)
+	}
+	if m.Version != ManifestVersion {
+		return Manifest{}, fmt.Errorf("manifest %s: unsupported version %d", path, m.Version)
+	}
+	return m, nil
+}
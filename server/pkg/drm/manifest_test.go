@@ -0,0 +1,94 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestRecorder(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	r := NewManifestRecorder()
+
+	var offset int64
+	record := func(frame []byte) {
+		t.Helper()
+
+		sample, err := e.EncryptSample(frame)
+		if err != nil {
+			t.Fatalf("EncryptSample() returned error: %s", err)
+		}
+		r.Record(sample, offset)
+		offset += int64(len(sample.Data))
+	}
+
+	aus := h264Stream()
+	for _, au := range aus {
+		record(au)
+	}
+
+	nextKeyID := "00000000000000000000000000000002"
+	rotatedAt := offset
+	if _, err := e.UpdateKeyHex(nextKeyID, testKey, testIV); err != nil {
+		t.Fatalf("UpdateKeyHex() returned error: %s", err)
+	}
+	for _, au := range aus {
+		record(au)
+	}
+
+	m := r.Manifest()
+	if len(m.Periods) != 2 {
+		t.Fatalf("Manifest() has %d periods, want 2", len(m.Periods))
+	}
+
+	first, second := m.Periods[0], m.Periods[1]
+	if first.KeyID != testKeyID || first.Scheme != "cbcs" || first.CryptBlocks != 1 || first.SkipBlocks != 9 || first.IVMode != IVModeConstant {
+		t.Errorf("first period = %+v, want the cbcs 1:9 profile of %s", first, testKeyID)
+	}
+	if second.KeyID != nextKeyID || second.Sample != uint64(len(aus)) || second.Offset != rotatedAt {
+		t.Errorf("second period = %+v, want %s from sample %d at offset %d", second, nextKeyID, len(aus), rotatedAt)
+	}
+
+	if p, ok := m.PeriodAt(uint64(len(aus) - 1)); !ok || p.KeyID != testKeyID {
+		t.Errorf("PeriodAt(%d) = %+v, want the first period", len(aus)-1, p)
+	}
+
+	recording := filepath.Join(t.TempDir(), "recording.mp4")
+	if err := WriteManifest(recording, m); err != nil {
+		t.Fatalf("WriteManifest() returned error: %s", err)
+	}
+	got, err := ReadManifest(recording + ManifestSuffix)
+	if err != nil {
+		t.Fatalf("ReadManifest() returned error: %s", err)
+	}
+	if len(got.Periods) != 2 || got.Periods[1] != second {
+		t.Errorf("ReadManifest() = %+v, want %+v", got, m)
+	}
+}
+
+func TestManifestRecorder_noKey(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+	r := NewManifestRecorder()
+
+	sample, err := e.EncryptSample(h264Stream()[0])
+	if err != nil {
+		t.Fatalf("EncryptSample() returned error: %s", err)
+	}
+	r.Record(sample, 0)
+
+	recording := filepath.Join(t.TempDir(), "recording.mp4")
+	if err := WriteManifest(recording, r.Manifest()); err != nil {
+		t.Fatalf("WriteManifest() returned error: %s", err)
+	}
+
+	// only the key ID to look the key up
+	got, _ := ReadManifest(recording + ManifestSuffix)
+	data, _ := json.Marshal(got)
+	if bytes.Contains(data, []byte(testKey)) {
+		t.Errorf("manifest %s contains the key", data)
+	}
+	if got.Periods[0].KeyID != testKeyID {
+		t.Errorf("manifest key ID = %s, want %s", got.Periods[0].KeyID, testKeyID)
+	}
+}
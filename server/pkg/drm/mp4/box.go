@@ -0,0 +1,148 @@
+// Package mp4 is a minimal ISO-BMFF parser for the boxes needed to decrypt
+// Common Encryption protected fragments (tenc, senc, saiz, saio), a builder
+// for the pssh boxes announcing them, and a writer packaging encrypted
+// samples as fragmented MP4
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTruncated = errors.New("truncated box")
+	ErrNotFound  = errors.New("box not found")
+)
+
+// Box is a single parsed box, Offset is relative to the parsed buffer
+type Box struct {
+	Type    string
+	Offset  int
+	Payload []byte
+}
+
+// ReadBoxes parses consecutive boxes filling the whole buffer
+func ReadBoxes(data []byte) ([]Box, error) {
+	var boxes []Box
+
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			return nil, ErrTruncated
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		header := 8
+
+		switch size {
+		case 0:
+			// box extends to the end of the buffer
+			size = uint64(len(data) - pos)
+		case 1:
+			if len(data)-pos < 16 {
+				return nil, ErrTruncated
+			}
+			size = binary.BigEndian.Uint64(data[pos+8:])
+			header = 16
+		}
+
+		if size < uint64(header) || size > uint64(len(data)-pos) {
+			return nil, fmt.Errorf("%w: %s of size %d", ErrTruncated, typ, size)
+		}
+
+		boxes = append(boxes, Box{
+			Type:    typ,
+			Offset:  pos,
+			Payload: data[pos+header : pos+int(size)],
+		})
+		pos += int(size)
+	}
+
+	return boxes, nil
+}
+
+// FindBox descends the given path of box types and returns the first match
+func FindBox(data []byte, path ...string) (Box, error) {
+	var box Box
+
+	for i, typ := range path {
+		boxes, err := ReadBoxes(data)
+		if err != nil {
+			return Box{}, err
+		}
+
+		found := false
+		for _, b := range boxes {
+			if b.Type == typ {
+				box, found = b, true
+				break
+			}
+		}
+
+		if !found {
+			return Box{}, fmt.Errorf("%w: %s", ErrNotFound, typ)
+		}
+
+		if i < len(path)-1 {
+			data = box.Payload
+		}
+	}
+
+	return box, nil
+}
+
+// reader is a bounds checked big-endian cursor over a box payload
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data)-r.pos < n {
+		r.err = ErrTruncated
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) u64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// fullBox reads the version and flags of a full box
+func (r *reader) fullBox() (version uint8, flags uint32) {
+	v := r.u32()
+	return uint8(v >> 24), v & 0xffffff
+}
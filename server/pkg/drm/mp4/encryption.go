@@ -0,0 +1,165 @@
+package mp4
+
+import (
+	"fmt"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// TrackEncryption holds the track defaults from the tenc box
+type TrackEncryption struct {
+	CryptBlocks     int
+	SkipBlocks      int
+	IsProtected     bool
+	PerSampleIVSize int
+	KID             []byte
+	ConstantIV      []byte
+}
+
+// ParseTenc parses the payload of a tenc box
+func ParseTenc(payload []byte) (TrackEncryption, error) {
+	r := &reader{data: payload}
+	version, _ := r.fullBox()
+
+	var t TrackEncryption
+
+	r.u8() // reserved
+	if version == 0 {
+		r.u8() // reserved
+	} else {
+		pattern := r.u8()
+		t.CryptBlocks = int(pattern >> 4)
+		t.SkipBlocks = int(pattern & 0x0f)
+	}
+
+	t.IsProtected = r.u8() == 1
+	t.PerSampleIVSize = int(r.u8())
+	t.KID = r.bytes(16)
+
+	if t.IsProtected && t.PerSampleIVSize == 0 {
+		t.ConstantIV = r.bytes(int(r.u8()))
+	}
+
+	if r.err != nil {
+		return TrackEncryption{}, fmt.Errorf("tenc: %w", r.err)
+	}
+
+	return t, nil
+}
+
+// SampleEncryption is one entry of a senc box or of the sample auxiliary
+// information referenced by saiz/saio
+type SampleEncryption struct {
+	IV         []byte
+	Subsamples []drm.SubsampleInfo
+}
+
+// parseSampleEncryption parses a single auxiliary information entry
+func parseSampleEncryption(r *reader, ivSize int, withSubsamples bool) SampleEncryption {
+	var s SampleEncryption
+
+	if ivSize > 0 {
+		s.IV = r.bytes(ivSize)
+	}
+
+	if withSubsamples {
+		count := int(r.u16())
+		for i := 0; i < count && r.err == nil; i++ {
+			s.Subsamples = append(s.Subsamples, drm.SubsampleInfo{
+				BytesOfClearData:     uint32(r.u16()),
+				BytesOfProtectedData: r.u32(),
+			})
+		}
+	}
+
+	return s
+}
+
+// ParseSenc parses the payload of a senc box, ivSize comes from tenc
+func ParseSenc(payload []byte, ivSize int) ([]SampleEncryption, error) {
+	r := &reader{data: payload}
+	_, flags := r.fullBox()
+
+	count := int(r.u32())
+
+	var samples []SampleEncryption
+	for i := 0; i < count && r.err == nil; i++ {
+		samples = append(samples, parseSampleEncryption(r, ivSize, flags&0x2 != 0))
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("senc: %w", r.err)
+	}
+
+	return samples, nil
+}
+
+// AuxInfoSizes holds the parsed saiz box
+type AuxInfoSizes struct {
+	DefaultSize int
+	Sizes       []int
+	SampleCount int
+}
+
+// Size returns the auxiliary information size of the sample
+func (a AuxInfoSizes) Size(i int) int {
+	if a.DefaultSize != 0 {
+		return a.DefaultSize
+	}
+	return a.Sizes[i]
+}
+
+// ParseSaiz parses the payload of a saiz box
+func ParseSaiz(payload []byte) (AuxInfoSizes, error) {
+	r := &reader{data: payload}
+	_, flags := r.fullBox()
+
+	if flags&0x1 != 0 {
+		r.u32() // aux_info_type
+		r.u32() // aux_info_type_parameter
+	}
+
+	var a AuxInfoSizes
+	a.DefaultSize = int(r.u8())
+	a.SampleCount = int(r.u32())
+
+	if a.DefaultSize == 0 {
+		for i := 0; i < a.SampleCount && r.err == nil; i++ {
+			a.Sizes = append(a.Sizes, int(r.u8()))
+		}
+	}
+
+	if r.err != nil {
+		return AuxInfoSizes{}, fmt.Errorf("saiz: %w", r.err)
+	}
+
+	return a, nil
+}
+
+// ParseSaio parses the payload of a saio box
+func ParseSaio(payload []byte) ([]int64, error) {
+	r := &reader{data: payload}
+	version, flags := r.fullBox()
+
+	if flags&0x1 != 0 {
+		r.u32() // aux_info_type
+		r.u32() // aux_info_type_parameter
+	}
+
+	count := int(r.u32())
+
+	var offsets []int64
+	for i := 0; i < count && r.err == nil; i++ {
+		if version == 0 {
+			offsets = append(offsets, int64(r.u32()))
+		} else {
+			offsets = append(offsets, int64(r.u64()))
+		}
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("saio: %w", r.err)
+	}
+
+	return offsets, nil
+}
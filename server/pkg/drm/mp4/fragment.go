@@ -0,0 +1,356 @@
+package mp4
+
+import (
+	"crypto/aes"
+	"fmt"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// Track holds the protection parameters of the first protected track of
+// an initialization segment
+type Track struct {
+	Scheme     string // schm scheme_type, "cenc" or "cbcs"
+	Encryption TrackEncryption
+	Timescale  uint32 // mdhd timescale, 0 when missing
+
+	// Escaped is set by the caller for recordings of drm.Encryptor output,
+	// nothing in the boxes signals it
+	Escaped bool
+}
+
+// Sample is one protected sample of a fragment with its encryption info
+type Sample struct {
+	Data       []byte
+	Encryption SampleEncryption
+
+	// decode time and duration in track timescale units
+	DecodeTime uint64
+	Duration   uint32
+	// KID the sample is protected with, from its seig sample group or
+	// the tenc default
+	KID []byte
+}
+
+// ParseInit finds the protection scheme and tenc defaults in an
+// initialization segment
+func ParseInit(data []byte) (*Track, error) {
+	stsd, err := FindBox(data, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stsd.Payload) < 8 {
+		return nil, fmt.Errorf("stsd: %w", ErrTruncated)
+	}
+
+	entries, err := ReadBoxes(stsd.Payload[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// child boxes follow the fixed sample entry fields
+		var skip int
+		switch entry.Type {
+		case "encv":
+			skip = 78
+		case "enca":
+			skip = 28
+		default:
+			continue
+		}
+
+		if len(entry.Payload) < skip {
+			return nil, fmt.Errorf("%s: %w", entry.Type, ErrTruncated)
+		}
+
+		track, err := parseSinf(entry.Payload[skip:])
+		if err != nil {
+			return nil, err
+		}
+
+		if mdhd, err := FindBox(data, "moov", "trak", "mdia", "mdhd"); err == nil {
+			r := &reader{data: mdhd.Payload}
+			if version, _ := r.fullBox(); version == 1 {
+				r.u64() // creation_time
+				r.u64() // modification_time
+			} else {
+				r.u32() // creation_time
+				r.u32() // modification_time
+			}
+			track.Timescale = r.u32()
+			if r.err != nil {
+				return nil, fmt.Errorf("mdhd: %w", r.err)
+			}
+		}
+
+		return track, nil
+	}
+
+	return nil, fmt.Errorf("%w: encv or enca", ErrNotFound)
+}
+
+func parseSinf(data []byte) (*Track, error) {
+	schm, err := FindBox(data, "sinf", "schm")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{data: schm.Payload}
+	r.fullBox()
+	scheme := r.bytes(4)
+	if r.err != nil {
+		return nil, fmt.Errorf("schm: %w", r.err)
+	}
+
+	tenc, err := FindBox(data, "sinf", "schi", "tenc")
+	if err != nil {
+		return nil, err
+	}
+
+	encryption, err := ParseTenc(tenc.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Track{
+		Scheme:     string(scheme),
+		Encryption: encryption,
+	}, nil
+}
+
+// ParseFragment extracts the samples of the first track fragment of a
+// moof followed by its mdat, along with their encryption info from senc
+// or, when missing, from saiz/saio
+func (t *Track) ParseFragment(data []byte) ([]Sample, error) {
+	moof, err := FindBox(data, "moof")
+	if err != nil {
+		return nil, err
+	}
+
+	traf, err := FindBox(moof.Payload, "traf")
+	if err != nil {
+		return nil, err
+	}
+
+	tfhd, err := FindBox(traf.Payload, "tfhd")
+	if err != nil {
+		return nil, err
+	}
+
+	// moof start is the base unless an explicit base is set
+	base := int64(moof.Offset)
+	var defaultSize, defaultDuration uint32
+
+	r := &reader{data: tfhd.Payload}
+	_, flags := r.fullBox()
+	r.u32() // track_ID
+	if flags&0x1 != 0 {
+		base = int64(r.u64())
+	}
+	if flags&0x2 != 0 {
+		r.u32() // sample_description_index
+	}
+	if flags&0x8 != 0 {
+		defaultDuration = r.u32()
+	}
+	if flags&0x10 != 0 {
+		defaultSize = r.u32()
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("tfhd: %w", r.err)
+	}
+
+	var decodeTime uint64
+	if tfdt, err := FindBox(traf.Payload, "tfdt"); err == nil {
+		r := &reader{data: tfdt.Payload}
+		if version, _ := r.fullBox(); version == 1 {
+			decodeTime = r.u64()
+		} else {
+			decodeTime = uint64(r.u32())
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("tfdt: %w", r.err)
+		}
+	}
+
+	trun, err := FindBox(traf.Payload, "trun")
+	if err != nil {
+		return nil, err
+	}
+
+	r = &reader{data: trun.Payload}
+	_, flags = r.fullBox()
+	count := int(r.u32())
+
+	offset := base
+	if flags&0x1 != 0 {
+		offset += int64(int32(r.u32()))
+	}
+	if flags&0x4 != 0 {
+		r.u32() // first_sample_flags
+	}
+
+	// the count is untrusted, it may not claim more entries than the box
+	// holds or, with default entries, more samples than the data does
+	entrySize := 0
+	for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&flag != 0 {
+			entrySize += 4
+		}
+	}
+	maxCount := len(data)
+	if entrySize > 0 {
+		maxCount = (len(r.data) - r.pos) / entrySize
+	} else if defaultSize > 0 {
+		maxCount = len(data) / int(defaultSize)
+	}
+	if r.err == nil && count > maxCount {
+		return nil, fmt.Errorf("trun: %d samples: %w", count, ErrTruncated)
+	}
+
+	samples := make([]Sample, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		duration := defaultDuration
+		if flags&0x100 != 0 {
+			duration = r.u32()
+		}
+		size := defaultSize
+		if flags&0x200 != 0 {
+			size = r.u32()
+		}
+		if flags&0x400 != 0 {
+			r.u32() // sample_flags
+		}
+		if flags&0x800 != 0 {
+			r.u32() // sample_composition_time_offset
+		}
+
+		if offset < 0 || offset+int64(size) > int64(len(data)) {
+			return nil, fmt.Errorf("trun: sample %d: %w", i, ErrTruncated)
+		}
+
+		samples = append(samples, Sample{
+			Data:       data[offset : offset+int64(size)],
+			DecodeTime: decodeTime,
+			Duration:   duration,
+			KID:        t.Encryption.KID,
+		})
+		offset += int64(size)
+		decodeTime += uint64(duration)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("trun: %w", r.err)
+	}
+
+	entries, err := t.sampleEncryption(data, traf.Payload, base)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) != len(samples) {
+		return nil, fmt.Errorf("fragment has %d samples but %d encryption entries", len(samples), len(entries))
+	}
+
+	for i := range samples {
+		samples[i].Encryption = entries[i]
+	}
+
+	if err := applySampleGroups(traf.Payload, samples); err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+func (t *Track) sampleEncryption(data, traf []byte, base int64) ([]SampleEncryption, error) {
+	ivSize := t.Encryption.PerSampleIVSize
+
+	if senc, err := FindBox(traf, "senc"); err == nil {
+		return ParseSenc(senc.Payload, ivSize)
+	}
+
+	saizBox, err := FindBox(traf, "saiz")
+	if err != nil {
+		return nil, err
+	}
+	saioBox, err := FindBox(traf, "saio")
+	if err != nil {
+		return nil, err
+	}
+
+	saiz, err := ParseSaiz(saizBox.Payload)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := ParseSaio(saioBox.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// either one offset for contiguous entries or one per sample
+	if len(offsets) != 1 && len(offsets) != saiz.SampleCount {
+		return nil, fmt.Errorf("saio has %d offsets for %d samples", len(offsets), saiz.SampleCount)
+	}
+
+	var entries []SampleEncryption
+	pos := base + offsets[0]
+	for i := 0; i < saiz.SampleCount; i++ {
+		if len(offsets) > 1 {
+			pos = base + offsets[i]
+		}
+
+		size := saiz.Size(i)
+		if pos < 0 || pos+int64(size) > int64(len(data)) {
+			return nil, fmt.Errorf("saio: sample %d: %w", i, ErrTruncated)
+		}
+
+		r := &reader{data: data[pos : pos+int64(size)]}
+		entries = append(entries, parseSampleEncryption(r, ivSize, size > ivSize))
+		if r.err != nil {
+			return nil, fmt.Errorf("aux info: %w", r.err)
+		}
+
+		pos += int64(size)
+	}
+
+	return entries, nil
+}
+
+// Decrypt decrypts the samples with the given key and returns their clear
+// content in order
+func (t *Track) Decrypt(key []byte, samples []Sample) ([][]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]byte, 0, len(samples))
+	for i, sample := range samples {
+		if !t.Encryption.IsProtected {
+			out = append(out, sample.Data)
+			continue
+		}
+
+		iv := sample.Encryption.IV
+		if t.Encryption.PerSampleIVSize == 0 {
+			iv = t.Encryption.ConstantIV
+		}
+
+		clear, err := drm.DecryptSample(block, drm.SampleParams{
+			Scheme:      t.Scheme,
+			IV:          iv,
+			CryptBlocks: t.Encryption.CryptBlocks,
+			SkipBlocks:  t.Encryption.SkipBlocks,
+			Escaped:     t.Escaped,
+		}, sample.Data, sample.Encryption.Subsamples)
+		if err != nil {
+			return nil, fmt.Errorf("sample %d: %w", i, err)
+		}
+
+		out = append(out, clear)
+	}
+
+	return out, nil
+}
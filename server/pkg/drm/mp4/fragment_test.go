@@ -0,0 +1,300 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+const (
+	testKeyID = "00000000000000000000000000000001"
+	testKey   = "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c"
+	testIV    = "d5fbd6b82ed93e4ef98ae40931ee33b7"
+)
+
+func box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+func fullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	vf := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return box(typ, append([][]byte{vf}, payload...)...)
+}
+
+func u8(v uint8) []byte   { return []byte{v} }
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// buildInit builds an initialization segment with a protected video track,
+// with a constant IV for cbcs and 8-byte per-sample IVs for cenc like the
+// encryptor produces
+func buildInit(scheme string, crypt, skip int) []byte {
+	iv := [][]byte{u8(0), mustHex(testKeyID), u8(16), mustHex(testIV)}
+	if scheme == "cenc" {
+		iv = [][]byte{u8(8), mustHex(testKeyID)}
+	}
+
+	tenc := fullBox("tenc", 1, 0, append([][]byte{u8(0), u8(uint8(crypt<<4 | skip)), u8(1)}, iv...)...)
+
+	sinf := box("sinf",
+		box("frma", []byte("avc1")),
+		fullBox("schm", 0, 0, []byte(scheme), u32(0x10000)),
+		box("schi", tenc),
+	)
+
+	encv := box("encv", make([]byte, 78), sinf)
+	stsd := fullBox("stsd", 0, 0, u32(1), encv)
+
+	// 90kHz video clock
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(90000), u32(0), u16(0x55c4), u16(0))
+
+	return box("moov", box("trak", box("mdia", mdhd, box("minf", box("stbl", stsd)))))
+}
+
+// subsamples reconstructs the subsample map of an encrypted access unit
+func subsamples(au []byte) []drm.SubsampleInfo {
+	var subs []drm.SubsampleInfo
+	var clear uint32
+
+	for pos := 0; pos < len(au); {
+		// start code and header are clear
+		end := bytes.Index(au[pos+4:], []byte{0, 0, 0, 1})
+		if end < 0 {
+			end = len(au)
+		} else {
+			end += pos + 4
+		}
+
+		nalu := au[pos:end]
+		nalType := nalu[4] & 0x1f
+		if nalType >= 1 && nalType <= 5 && len(nalu)-5 >= 16 {
+			subs = append(subs, drm.SubsampleInfo{
+				BytesOfClearData:     clear + 5,
+				BytesOfProtectedData: uint32(len(nalu) - 5),
+			})
+			clear = 0
+		} else {
+			clear += uint32(len(nalu))
+		}
+
+		pos = end
+	}
+
+	if clear > 0 {
+		subs = append(subs, drm.SubsampleInfo{BytesOfClearData: clear})
+	}
+
+	return subs
+}
+
+// auxInfo builds the sample auxiliary information, iv is nil for a
+// constant IV
+func auxInfo(iv []byte, subs []drm.SubsampleInfo) []byte {
+	b := append(bytes.Clone(iv), u16(uint16(len(subs)))...)
+	for _, s := range subs {
+		b = append(b, u16(uint16(s.BytesOfClearData))...)
+		b = append(b, u32(s.BytesOfProtectedData)...)
+	}
+	return b
+}
+
+// packaged wraps access units with subsamples found by parsing them and
+// zero per-sample IVs of ivSize bytes
+func packaged(frames [][]byte, ivSize int) []drm.EncryptedSample {
+	var samples []drm.EncryptedSample
+	for _, frame := range frames {
+		sample := drm.EncryptedSample{Data: frame, Subsamples: subsamples(frame)}
+		if ivSize > 0 {
+			sample.IV = make([]byte, ivSize)
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// buildFragment packages the samples into moof+mdat, with a senc box or
+// with aux info referenced only by saiz/saio
+func buildFragment(samples []drm.EncryptedSample, withSenc bool) []byte {
+	var aux, sizes, trunEntries, mdat []byte
+	for _, s := range samples {
+		info := auxInfo(s.IV, s.Subsamples)
+		aux = append(aux, info...)
+		sizes = append(sizes, u8(uint8(len(info)))...)
+		trunEntries = append(trunEntries, u32(uint32(len(s.Data)))...)
+		mdat = append(mdat, s.Data...)
+	}
+
+	build := func(dataOffset, auxOffset uint32) (moof, free []byte) {
+		tfhd := fullBox("tfhd", 0, 0x20000, u32(1))
+		trun := fullBox("trun", 0, 0x201, u32(uint32(len(samples))), u32(dataOffset), trunEntries)
+
+		var encryption []byte
+		if withSenc {
+			encryption = fullBox("senc", 0, 0x2, u32(uint32(len(samples))), aux)
+		} else {
+			encryption = append(
+				fullBox("saiz", 0, 0, u8(0), u32(uint32(len(samples))), sizes),
+				fullBox("saio", 0, 0, u32(1), u32(auxOffset))...,
+			)
+			free = box("free", aux)
+		}
+
+		moof = box("moof", fullBox("mfhd", 0, 0, u32(1)), box("traf", tfhd, trun, encryption))
+		return moof, free
+	}
+
+	// offsets depend on the moof size, which does not depend on them
+	moof, free := build(0, 0)
+	auxOffset := uint32(len(moof) + 8)
+	dataOffset := uint32(len(moof) + len(free) + 8)
+	moof, free = build(dataOffset, auxOffset)
+
+	return bytes.Join([][]byte{moof, free, box("mdat", mdat)}, nil)
+}
+
+// testFrames builds access units with parameter sets, short and long
+// slices
+func testFrames() [][]byte {
+	nal := func(header byte, size int) []byte {
+		b := []byte{0, 0, 0, 1, header}
+		for i := 0; i < size; i++ {
+			b = append(b, byte(i%200+10))
+		}
+		return b
+	}
+
+	return [][]byte{
+		bytes.Join([][]byte{nal(0x67, 12), nal(0x68, 4), nal(0x65, 1000)}, nil),
+		nal(0x41, 300),
+		bytes.Join([][]byte{nal(0x41, 8), nal(0x41, 97)}, nil),
+		nal(0x41, 15),
+		// several protected slices in one sample
+		bytes.Join([][]byte{nal(0x41, 40), nal(0x41, 50)}, nil),
+	}
+}
+
+func TestTrack_Decrypt(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		crypt    int
+		skip     int
+		withSenc bool
+	}{
+		{name: "cbcs 1:9 senc", mode: "cbcs", crypt: 1, skip: 9, withSenc: true},
+		{name: "cbcs 1:9 saiz/saio", mode: "cbcs", crypt: 1, skip: 9},
+		{name: "cenc senc", mode: "cenc", withSenc: true},
+		{name: "cenc saiz/saio", mode: "cenc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := drm.NewEncryptor(drm.Config{
+				Enabled:     true,
+				KeyID:       testKeyID,
+				Key:         testKey,
+				IV:          testIV,
+				Mode:        tt.mode,
+				CryptBlocks: tt.crypt,
+				SkipBlocks:  tt.skip,
+			})
+			if err != nil {
+				t.Fatalf("NewEncryptor() returned error: %s", err)
+			}
+
+			frames := testFrames()
+			var encrypted []drm.EncryptedSample
+			for _, frame := range frames {
+				sample, err := e.EncryptSample(frame)
+				if err != nil {
+					t.Fatalf("EncryptSample() returned error: %s", err)
+				}
+				encrypted = append(encrypted, sample)
+			}
+
+			track, err := ParseInit(buildInit(tt.mode, tt.crypt, tt.skip))
+			if err != nil {
+				t.Fatalf("ParseInit() returned error: %s", err)
+			}
+			if track.Scheme != tt.mode {
+				t.Errorf("ParseInit() scheme = %s, want %s", track.Scheme, tt.mode)
+			}
+			if !bytes.Equal(track.Encryption.KID, mustHex(testKeyID)) {
+				t.Errorf("ParseInit() KID = %x, want %s", track.Encryption.KID, testKeyID)
+			}
+
+			track.Escaped = true
+
+			samples, err := track.ParseFragment(buildFragment(encrypted, tt.withSenc))
+			if err != nil {
+				t.Fatalf("ParseFragment() returned error: %s", err)
+			}
+
+			got, err := track.Decrypt(mustHex(testKey), samples)
+			if err != nil {
+				t.Fatalf("Decrypt() returned error: %s", err)
+			}
+
+			if len(got) != len(frames) {
+				t.Fatalf("Decrypt() returned %d samples, want %d", len(got), len(frames))
+			}
+			for i := range frames {
+				if !bytes.Equal(got[i], frames[i]) {
+					t.Errorf("sample %d does not match source", i)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFragment_truncated(t *testing.T) {
+	track, err := ParseInit(buildInit("cenc", 0, 0))
+	if err != nil {
+		t.Fatalf("ParseInit() returned error: %s", err)
+	}
+
+	fragment := buildFragment(packaged(testFrames(), 8), true)
+	if _, err := track.ParseFragment(fragment[:len(fragment)-1]); err == nil {
+		t.Errorf("ParseFragment() of truncated fragment returned no error")
+	}
+}
+
+func TestParseFragment_sampleCount(t *testing.T) {
+	track, err := ParseInit(buildInit("cenc", 0, 0))
+	if err != nil {
+		t.Fatalf("ParseInit() returned error: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		trun []byte
+	}{
+		{"more entries than the box holds", fullBox("trun", 0, 0x201, u32(0xffffffff), u32(0), u32(16))},
+		{"default entries", fullBox("trun", 0, 0x1, u32(0xffffffff), u32(0))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tfhd := fullBox("tfhd", 0, 0x20000, u32(1))
+			moof := box("moof", fullBox("mfhd", 0, 0, u32(1)), box("traf", tfhd, tt.trun))
+			fragment := append(moof, box("mdat", make([]byte, 16))...)
+
+			if _, err := track.ParseFragment(fragment); !errors.Is(err, ErrTruncated) {
+				t.Errorf("ParseFragment() returned %v, want %s", err, ErrTruncated)
+			}
+		})
+	}
+}
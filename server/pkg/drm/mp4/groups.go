@@ -0,0 +1,145 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+)
+
+// group description indexes above this refer to the fragment local sgpd
+const fragmentGroupBase = 0x10000
+
+// ErrGlobalSampleGroup is returned for seig groups described in the moov,
+// only fragment local descriptions are supported
+var ErrGlobalSampleGroup = errors.New("seig group described outside of the fragment")
+
+// SeigEntry is a CENC sample group entry overriding the tenc defaults for
+// the samples mapped to it, typically a new KID after a key rotation
+type SeigEntry struct {
+	CryptBlocks     int
+	SkipBlocks      int
+	IsProtected     bool
+	PerSampleIVSize int
+	KID             []byte
+	ConstantIV      []byte
+}
+
+// ParseSeigDescriptions parses the payload of a sgpd box with the seig
+// grouping type, other grouping types return no entries
+func ParseSeigDescriptions(payload []byte) ([]SeigEntry, error) {
+	r := &reader{data: payload}
+	version, _ := r.fullBox()
+
+	if string(r.bytes(4)) != "seig" {
+		return nil, r.err
+	}
+
+	var defaultLength uint32
+	if version == 1 {
+		defaultLength = r.u32()
+	}
+	if version >= 2 {
+		r.u32() // default_sample_description_index
+	}
+
+	count := int(r.u32())
+	entries := make([]SeigEntry, 0)
+	for i := 0; i < count && r.err == nil; i++ {
+		length := defaultLength
+		if version == 1 && length == 0 {
+			length = r.u32()
+		}
+
+		entry := r
+		if length > 0 {
+			entry = &reader{data: r.bytes(int(length))}
+		}
+
+		var e SeigEntry
+		entry.u8() // reserved
+		pattern := entry.u8()
+		e.CryptBlocks = int(pattern >> 4)
+		e.SkipBlocks = int(pattern & 0x0f)
+		e.IsProtected = entry.u8() == 1
+		e.PerSampleIVSize = int(entry.u8())
+		e.KID = entry.bytes(16)
+		if e.IsProtected && e.PerSampleIVSize == 0 {
+			e.ConstantIV = entry.bytes(int(entry.u8()))
+		}
+
+		if entry.err != nil {
+			return nil, fmt.Errorf("sgpd: entry %d: %w", i, entry.err)
+		}
+		entries = append(entries, e)
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("sgpd: %w", r.err)
+	}
+
+	return entries, nil
+}
+
+// applySampleGroups sets the KID of samples mapped to a seig group of the
+// track fragment
+func applySampleGroups(traf []byte, samples []Sample) error {
+	boxes, err := ReadBoxes(traf)
+	if err != nil {
+		return err
+	}
+
+	var descriptions []SeigEntry
+	for _, b := range boxes {
+		if b.Type != "sgpd" {
+			continue
+		}
+		entries, err := ParseSeigDescriptions(b.Payload)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			descriptions = entries
+		}
+	}
+
+	for _, b := range boxes {
+		if b.Type != "sbgp" {
+			continue
+		}
+
+		r := &reader{data: b.Payload}
+		version, _ := r.fullBox()
+		if string(r.bytes(4)) != "seig" {
+			continue
+		}
+		if version == 1 {
+			r.u32() // grouping_type_parameter
+		}
+
+		count := int(r.u32())
+		sample := 0
+		for i := 0; i < count && r.err == nil; i++ {
+			run := int(r.u32())
+			index := r.u32()
+
+			for j := 0; j < run && sample < len(samples); j++ {
+				switch {
+				case index == 0:
+					// not in any group, tenc defaults apply
+				case index <= fragmentGroupBase:
+					return ErrGlobalSampleGroup
+				case int(index-fragmentGroupBase) > len(descriptions):
+					return fmt.Errorf("sbgp: group %d: %w", index, ErrNotFound)
+				default:
+					samples[sample].KID = descriptions[index-fragmentGroupBase-1].KID
+				}
+				sample++
+			}
+		}
+
+		if r.err != nil {
+			return fmt.Errorf("sbgp: %w", r.err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+var ErrNoSampleAt = errors.New("no sample at the given time")
+
+// KeyUsage describes which key protected a sample of a recording
+type KeyUsage struct {
+	KeyID string // hex encoded
+	// Generation of the key, only valid when Known
+	Generation uint64
+	Known      bool
+
+	// Sample is the index of the sample in the recording
+	Sample int
+
+	// decode time of the sample and the span of consecutive samples
+	// protected with the same key around it
+	DecodeTime time.Duration
+	ValidFrom  time.Duration
+	ValidTo    time.Duration
+
+	Subsamples []drm.SubsampleInfo
+
+	// the key was found from the KeySEI of the sample, the recording has
+	// no KID for it
+	InBand bool
+}
+
+// Fragments splits the media part of a recording into fragments, each
+// starting at a moof and including the boxes up to the next one
+func Fragments(data []byte) ([][]byte, error) {
+	boxes, err := ReadBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var starts []int
+	for _, b := range boxes {
+		if b.Type == "moof" {
+			starts = append(starts, b.Offset)
+		}
+	}
+
+	fragments := make([][]byte, 0, len(starts))
+	for i, start := range starts {
+		end := len(data)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		fragments = append(fragments, data[start:end])
+	}
+
+	return fragments, nil
+}
+
+// WhichKey finds the sample decoded at ts in a fragmented recording and
+// reports the key protecting it. The key follows the KID stamped on the
+// sample, never the time, so samples in a rotation overlap are attributed
+// to the key they were really encrypted with. Keys map KIDs to generations.
+func WhichKey(recording []byte, ts time.Duration, keys []drm.Key) (KeyUsage, error) {
+	return whichKey(recording, ts, keys, nil)
+}
+
+// WhichKeyManifest is WhichKey for a recording with its sidecar manifest,
+// whose periods name the key of every sample, also after rotations the
+// boxes of the recording do not signal
+func WhichKeyManifest(recording []byte, ts time.Duration, keys []drm.Key, manifest drm.Manifest) (KeyUsage, error) {
+	return whichKey(recording, ts, keys, &manifest)
+}
+
+func whichKey(recording []byte, ts time.Duration, keys []drm.Key, manifest *drm.Manifest) (KeyUsage, error) {
+	track, err := ParseInit(recording)
+	if err != nil {
+		return KeyUsage{}, err
+	}
+	if track.Timescale == 0 {
+		return KeyUsage{}, fmt.Errorf("%w: mdhd timescale", ErrNotFound)
+	}
+
+	fragments, err := Fragments(recording)
+	if err != nil {
+		return KeyUsage{}, err
+	}
+
+	var samples []Sample
+	for i, fragment := range fragments {
+		s, err := track.ParseFragment(fragment)
+		if err != nil {
+			return KeyUsage{}, fmt.Errorf("fragment %d: %w", i, err)
+		}
+		samples = append(samples, s...)
+	}
+
+	// the manifest knows better than the tenc default
+	var generations map[string]uint64
+	if manifest != nil {
+		generations = map[string]uint64{}
+		for i := range samples {
+			period, ok := manifest.PeriodAt(uint64(i))
+			if !ok || period.KeyID == "" {
+				continue
+			}
+			kid, err := hex.DecodeString(period.KeyID)
+			if err != nil || len(kid) != 16 {
+				return KeyUsage{}, fmt.Errorf("manifest period at sample %d: invalid key ID %q", period.Sample, period.KeyID)
+			}
+			samples[i].KID = kid
+			if period.Generation > 0 {
+				generations[strings.ToLower(period.KeyID)] = period.Generation
+			}
+		}
+	}
+
+	toTime := func(units uint64) time.Duration {
+		return unitsToDuration(units, track.Timescale)
+	}
+
+	found := -1
+	for i, s := range samples {
+		start := toTime(s.DecodeTime)
+		end := toTime(s.DecodeTime + uint64(s.Duration))
+		if ts >= start && ts < end {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		return KeyUsage{}, fmt.Errorf("%w: %s", ErrNoSampleAt, ts)
+	}
+
+	sample := samples[found]
+	usage := KeyUsage{
+		KeyID:      hex.EncodeToString(sample.KID),
+		Sample:     found,
+		DecodeTime: toTime(sample.DecodeTime),
+		Subsamples: sample.Encryption.Subsamples,
+	}
+
+	// span of the key around the sample
+	first, last := found, found
+	for first > 0 && bytes.Equal(samples[first-1].KID, sample.KID) {
+		first--
+	}
+	for last < len(samples)-1 && bytes.Equal(samples[last+1].KID, sample.KID) {
+		last++
+	}
+	usage.ValidFrom = toTime(samples[first].DecodeTime)
+	usage.ValidTo = toTime(samples[last].DecodeTime + uint64(samples[last].Duration))
+
+	// without a KID the in-band signaling is the fallback
+	if bytes.Equal(sample.KID, make([]byte, 16)) || len(sample.KID) == 0 {
+		if sei, ok := sampleKeySEI(sample.Data); ok {
+			usage.InBand = true
+			usage.KeyID = ""
+			usage.Generation = sei.Generation
+
+			for _, key := range keys {
+				if keyID, err := hex.DecodeString(key.KeyID); err == nil && sei.Matches(keyID) {
+					usage.KeyID = key.KeyID
+					usage.Known = true
+				}
+			}
+
+			return usage, nil
+		}
+	}
+
+	if generation, ok := generations[usage.KeyID]; ok {
+		usage.Generation = generation
+		usage.Known = true
+	}
+	for _, key := range keys {
+		if strings.EqualFold(key.KeyID, usage.KeyID) {
+			usage.Generation = key.Generation
+			usage.Known = true
+		}
+	}
+
+	return usage, nil
+}
+
+// unitsToDuration converts timescale units to a duration, in whole seconds
+// and the rest so that long recordings do not overflow
+func unitsToDuration(units uint64, timescale uint32) time.Duration {
+	ts := uint64(timescale)
+	return time.Duration(units/ts*uint64(time.Second) + units%ts*uint64(time.Second)/ts)
+}
+
+// sampleKeySEI finds the KeySEI of a sample with 4 byte NAL unit lengths,
+// samples in Annex-B format are accepted too
+func sampleKeySEI(sample []byte) (drm.KeySEI, bool) {
+	for r := (&reader{data: sample}); r.pos < len(r.data); {
+		nalu := r.bytes(int(r.u32()))
+		if r.err != nil {
+			return drm.ParseKeySEI(sample)
+		}
+		if sei, ok := drm.ParseKeySEINAL(nalu); ok {
+			return sei, true
+		}
+	}
+
+	return drm.ParseKeySEI(sample)
+}
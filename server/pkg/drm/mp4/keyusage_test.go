@@ -0,0 +1,242 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+const testNextKeyID = "00000000000000000000000000000002"
+
+// buildKeyedFragment packages the samples with a tfdt and a seig sample
+// group stamping every sample not protected with the tenc KID
+func buildKeyedFragment(decodeTime, duration uint32, samples [][]byte, kids []string) []byte {
+	var aux, trunEntries, mdat, groups, descriptions []byte
+	var described []string
+	for i, s := range samples {
+		aux = append(aux, auxInfo(nil, subsamples(s))...)
+		trunEntries = append(trunEntries, u32(uint32(len(s)))...)
+		mdat = append(mdat, s...)
+
+		index := uint32(0)
+		if kids[i] != testKeyID {
+			found := false
+			for j, kid := range described {
+				if kid == kids[i] {
+					index, found = fragmentGroupBase+uint32(j+1), true
+				}
+			}
+			if !found {
+				described = append(described, kids[i])
+				index = fragmentGroupBase + uint32(len(described))
+				descriptions = append(descriptions, bytes.Join([][]byte{
+					u8(0), u8(1<<4 | 9), u8(1), u8(0), mustHex(kids[i]), u8(16), mustHex(testIV),
+				}, nil)...)
+			}
+		}
+		groups = append(groups, u32(1)...)
+		groups = append(groups, u32(index)...)
+	}
+
+	build := func(dataOffset uint32) []byte {
+		tfhd := fullBox("tfhd", 0, 0x20008, u32(1), u32(duration))
+		tfdt := fullBox("tfdt", 0, 0, u32(decodeTime))
+		trun := fullBox("trun", 0, 0x201, u32(uint32(len(samples))), u32(dataOffset), trunEntries)
+		senc := fullBox("senc", 0, 0x2, u32(uint32(len(samples))), aux)
+		// entries with a 16 byte constant IV are 37 bytes long
+		sgpd := fullBox("sgpd", 1, 0, []byte("seig"), u32(37), u32(uint32(len(described))), descriptions)
+		sbgp := fullBox("sbgp", 0, 0, []byte("seig"), u32(uint32(len(samples))), groups)
+
+		return box("moof", fullBox("mfhd", 0, 0, u32(1)), box("traf", tfhd, tfdt, trun, senc, sgpd, sbgp))
+	}
+
+	moof := build(0)
+	moof = build(uint32(len(moof) + 8))
+
+	return append(moof, box("mdat", mdat)...)
+}
+
+func TestWhichKey(t *testing.T) {
+	frames := testFrames()
+	old := []string{testKeyID, testKeyID, testKeyID, testKeyID, testKeyID}
+	// the rotation is announced at the second fragment but the first two
+	// frames were still encrypted with the old key
+	rotated := []string{testKeyID, testKeyID, testNextKeyID, testNextKeyID, testNextKeyID}
+
+	recording := bytes.Join([][]byte{
+		buildInit("cbcs", 1, 9),
+		buildKeyedFragment(0, 3000, frames, old),
+		buildKeyedFragment(15000, 3000, frames, rotated),
+	}, nil)
+
+	keys := []drm.Key{
+		{Generation: 1, KeyID: testKeyID},
+		{Generation: 2, KeyID: testNextKeyID},
+	}
+
+	at := func(units int) time.Duration {
+		return time.Duration(units) * time.Second / 90000
+	}
+
+	tests := []struct {
+		name string
+		ts   time.Duration
+		want KeyUsage
+	}{
+		{
+			name: "first frame",
+			ts:   0,
+			want: KeyUsage{KeyID: testKeyID, Generation: 1, Known: true, DecodeTime: 0, ValidFrom: 0, ValidTo: at(21000)},
+		},
+		{
+			name: "overlap frame stamped with the old key",
+			ts:   at(18000) + time.Millisecond,
+			want: KeyUsage{KeyID: testKeyID, Generation: 1, Known: true, DecodeTime: at(18000), ValidFrom: 0, ValidTo: at(21000)},
+		},
+		{
+			name: "after rotation",
+			ts:   at(21000),
+			want: KeyUsage{KeyID: testNextKeyID, Generation: 2, Known: true, DecodeTime: at(21000), ValidFrom: at(21000), ValidTo: at(30000)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WhichKey(recording, tt.ts, keys)
+			if err != nil {
+				t.Fatalf("WhichKey() returned error: %s", err)
+			}
+
+			if got.KeyID != tt.want.KeyID || got.Generation != tt.want.Generation || got.Known != tt.want.Known ||
+				got.DecodeTime != tt.want.DecodeTime || got.ValidFrom != tt.want.ValidFrom || got.ValidTo != tt.want.ValidTo {
+				t.Errorf("WhichKey() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// key missing from the provider is still identified by its KID
+	got, err := WhichKey(recording, at(27000), keys[:1])
+	if err != nil {
+		t.Fatalf("WhichKey() returned error: %s", err)
+	}
+	if got.Known || got.KeyID != testNextKeyID {
+		t.Errorf("WhichKey() = %+v, want unknown %s", got, testNextKeyID)
+	}
+
+	if _, err := WhichKey(recording, time.Second, keys); !errors.Is(err, ErrNoSampleAt) {
+		t.Errorf("WhichKey() past the end error = %v, want %v", err, ErrNoSampleAt)
+	}
+}
+
+func TestWhichKey_inBand(t *testing.T) {
+	keyID := mustHex(testNextKeyID)
+	sei := drm.BuildKeySEI(drm.KeySEI{KeyIDHash: drm.KeyIDHash(keyID), Generation: 2})
+
+	var frames [][]byte
+	var kids []string
+	for _, frame := range testFrames() {
+		frames = append(frames, append(append([]byte{}, sei...), frame...))
+		// packager without the KID of the stream
+		kids = append(kids, "00000000000000000000000000000000")
+	}
+
+	recording := append(buildInit("cbcs", 1, 9), buildKeyedFragment(0, 3000, frames, kids)...)
+	keys := []drm.Key{
+		{Generation: 1, KeyID: testKeyID},
+		{Generation: 2, KeyID: testNextKeyID},
+	}
+
+	got, err := WhichKey(recording, 0, keys)
+	if err != nil {
+		t.Fatalf("WhichKey() returned error: %s", err)
+	}
+	if !got.InBand || !got.Known || got.KeyID != testNextKeyID || got.Generation != 2 {
+		t.Errorf("WhichKey() = %+v, want generation 2 found in-band", got)
+	}
+}
+
+func TestWhichKeyManifest(t *testing.T) {
+	e, err := drm.NewEncryptor(drm.Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	info, _ := e.ClientInfo()
+
+	frames := testFrames()
+	sps, pps := ParameterSets(frames[0])
+	w, err := NewWriter(WriterConfig{Protection: info, SPS: sps, PPS: pps, Width: 640, Height: 480})
+	if err != nil {
+		t.Fatalf("NewWriter() returned error: %s", err)
+	}
+
+	// the key rotates after the first frame, the boxes keep the tenc KID
+	var samples []MediaSample
+	for i, frame := range frames {
+		if i == 1 {
+			if _, err := e.UpdateKeyHex(testNextKeyID, testKey, testIV); err != nil {
+				t.Fatalf("UpdateKeyHex() returned error: %s", err)
+			}
+		}
+		sample, err := e.EncryptSample(frame)
+		if err != nil {
+			t.Fatalf("EncryptSample() returned error: %s", err)
+		}
+		samples = append(samples, MediaSample{EncryptedSample: sample, Time: time.Duration(i) * time.Second, Duration: time.Second})
+	}
+
+	recording := w.Init()
+	segment, err := w.Segment(samples)
+	if err != nil {
+		t.Fatalf("Segment() returned error: %s", err)
+	}
+	recording = append(recording, segment...)
+
+	manifest := w.Manifest()
+	if len(manifest.Periods) != 2 {
+		t.Fatalf("Manifest() has %d periods, want 2", len(manifest.Periods))
+	}
+	if offset := manifest.Periods[1].Offset; !bytes.HasPrefix(recording[offset:], avcc(frames[1])[:5]) {
+		t.Errorf("second period starts at offset %d, not at the data of the second sample", offset)
+	}
+
+	keys := []drm.Key{{KeyID: testNextKeyID, Generation: 2}}
+	usage, err := WhichKeyManifest(recording, 2500*time.Millisecond, keys, manifest)
+	if err != nil {
+		t.Fatalf("WhichKeyManifest() returned error: %s", err)
+	}
+	if usage.KeyID != testNextKeyID || !usage.Known || usage.Generation != 2 || usage.Sample != 2 {
+		t.Errorf("WhichKeyManifest() = %+v, want generation 2 of %s at sample 2", usage, testNextKeyID)
+	}
+	if usage.ValidFrom != time.Second || usage.ValidTo != time.Duration(len(frames))*time.Second {
+		t.Errorf("WhichKeyManifest() valid %s-%s, want 1s-%ds", usage.ValidFrom, usage.ValidTo, len(frames))
+	}
+
+	// without the manifest the rotation is invisible
+	if usage, err := WhichKey(recording, 2500*time.Millisecond, keys); err != nil || usage.KeyID != testKeyID {
+		t.Errorf("WhichKey() = %+v, %v, want %s", usage, err, testKeyID)
+	}
+}
+
+func TestUnitsToDuration(t *testing.T) {
+	tests := []struct {
+		units     uint64
+		timescale uint32
+		want      time.Duration
+	}{
+		{0, 90000, 0},
+		{45000, 90000, 500 * time.Millisecond},
+		{3, 1000, 3 * time.Millisecond},
+		// units times a second no longer fits 64 bits after 56 hours
+		{90000 * 3600 * 100, 90000, 100 * time.Hour},
+		{90000*3600*1000 + 9, 90000, 1000*time.Hour + 100*time.Microsecond},
+	}
+
+	for _, tt := range tests {
+		if got := unitsToDuration(tt.units, tt.timescale); got != tt.want {
+			t.Errorf("unitsToDuration(%d, %d) = %s, want %s", tt.units, tt.timescale, got, tt.want)
+		}
+	}
+}
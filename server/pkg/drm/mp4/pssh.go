@@ -0,0 +1,79 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// SystemIDCommon is the W3C Common PSSH system, understood by ClearKey and
+// used to announce key IDs to every key system
+var SystemIDCommon = drm.SystemIDCommon
+
+// PSSH is a Protection System Specific Header box
+type PSSH struct {
+	SystemID [16]byte
+	KeyIDs   [][]byte // 16 bytes each, only in version 1 boxes
+	Data     []byte
+}
+
+// BuildPSSH encodes a complete pssh box, version 1 when key IDs are
+// present and version 0 otherwise
+func BuildPSSH(p PSSH) ([]byte, error) {
+	version := uint8(0)
+	size := 8 + 4 + 16 + 4 + len(p.Data)
+
+	if len(p.KeyIDs) > 0 {
+		version = 1
+		size += 4 + 16*len(p.KeyIDs)
+	}
+
+	for _, kid := range p.KeyIDs {
+		if len(kid) != 16 {
+			return nil, fmt.Errorf("key ID must be 16 bytes, got %d", len(kid))
+		}
+	}
+
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, "pssh"...)
+	b = binary.BigEndian.AppendUint32(b, uint32(version)<<24)
+	b = append(b, p.SystemID[:]...)
+
+	if version == 1 {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(p.KeyIDs)))
+		for _, kid := range p.KeyIDs {
+			b = append(b, kid...)
+		}
+	}
+
+	b = binary.BigEndian.AppendUint32(b, uint32(len(p.Data)))
+	return append(b, p.Data...), nil
+}
+
+// ParsePSSH parses the payload of a pssh box
+func ParsePSSH(payload []byte) (PSSH, error) {
+	r := &reader{data: payload}
+	version, _ := r.fullBox()
+
+	var p PSSH
+	copy(p.SystemID[:], r.bytes(16))
+
+	if version > 0 {
+		count := int(r.u32())
+		if count > (len(r.data)-r.pos)/16 {
+			return PSSH{}, fmt.Errorf("%w: pssh with %d key IDs", ErrTruncated, count)
+		}
+		for i := 0; i < count; i++ {
+			p.KeyIDs = append(p.KeyIDs, r.bytes(16))
+		}
+	}
+
+	p.Data = r.bytes(int(r.u32()))
+
+	if r.err != nil {
+		return PSSH{}, r.err
+	}
+	return p, nil
+}
@@ -0,0 +1,81 @@
+package mp4
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPSSH_roundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		pssh        PSSH
+		wantVersion uint8
+	}{
+		{
+			name: "common with key IDs",
+			pssh: PSSH{
+				SystemID: SystemIDCommon,
+				KeyIDs: [][]byte{
+					mustHex("00000000000000000000000000000001"),
+					mustHex("00000000000000000000000000000002"),
+				},
+				Data: []byte{},
+			},
+			wantVersion: 1,
+		},
+		{
+			name: "system data only",
+			pssh: PSSH{
+				SystemID: [16]byte{0xed, 0xef, 0x8b, 0xa9},
+				Data:     []byte{1, 2, 3},
+			},
+			wantVersion: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := BuildPSSH(tt.pssh)
+			if err != nil {
+				t.Fatalf("BuildPSSH() returned error: %s", err)
+			}
+
+			box, err := FindBox(b, "pssh")
+			if err != nil {
+				t.Fatalf("FindBox() returned error: %s", err)
+			}
+			if box.Payload[0] != tt.wantVersion {
+				t.Errorf("pssh version = %d, want %d", box.Payload[0], tt.wantVersion)
+			}
+
+			got, err := ParsePSSH(box.Payload)
+			if err != nil {
+				t.Fatalf("ParsePSSH() returned error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.pssh) {
+				t.Errorf("ParsePSSH() = %+v, want %+v", got, tt.pssh)
+			}
+		})
+	}
+}
+
+func TestBuildPSSH_commonVector(t *testing.T) {
+	// W3C Common PSSH example with a single key ID
+	want := mustHex("00000034" + "70737368" + "01000000" +
+		"1077efecc0b24d02ace33c1e52e2fb4b" +
+		"00000001" + "00000000000000000000000000000001" +
+		"00000000")
+
+	got, err := BuildPSSH(PSSH{
+		SystemID: SystemIDCommon,
+		KeyIDs:   [][]byte{mustHex("00000000000000000000000000000001")},
+	})
+	if err != nil {
+		t.Fatalf("BuildPSSH() returned error: %s", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("BuildPSSH() = %x, want %x", got, want)
+	}
+}
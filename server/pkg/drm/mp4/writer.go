@@ -0,0 +1,640 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// DefaultTimescale is the track timescale of a Writer unless configured,
+// the 90kHz clock of RTP video
+const DefaultTimescale = 90000
+
+// writerTrackID is the ID of the single track a Writer packages
+const writerTrackID = 1
+
+var ErrNoStartCode = errors.New("access unit has no start code")
+
+// WriterConfig describes the protected H.264 track of a Writer
+type WriterConfig struct {
+	// Protection of the samples, from ClientInfo of the encryptor
+	// producing them; its pssh boxes go into the initialization segment
+	Protection drm.ClientInfo
+
+	// SPS and PPS of the stream without start code, see ParameterSets
+	SPS    []byte
+	PPS    []byte
+	Width  int
+	Height int
+
+	// Timescale of the track, DefaultTimescale when 0
+	Timescale uint32
+}
+
+// MediaSample is an access unit of drm.Encryptor in Annex B format with its
+// timing
+type MediaSample struct {
+	drm.EncryptedSample
+
+	// Time is the decode time from the start of the recording, Duration
+	// how long the access unit is shown; only the duration of the last
+	// sample of a segment is taken, the others end where the next begins
+	Time     time.Duration
+	Duration time.Duration
+}
+
+// Writer packages the output of drm.EncryptSample as fragmented MP4 (CMAF):
+// an initialization segment announcing the protection with tenc and pssh,
+// and media segments carrying the subsamples and IVs of every sample in
+// senc, referenced by saiz and saio.
+//
+// The encryptor escapes its ciphertext (drm.SampleParams.Escaped), which
+// players do not expect. The writer removes those emulation prevention
+// bytes again so that the protected ranges decrypt as stored, to the
+// payload the encryptor encrypted. Emulation prevention bytes the encoder
+// put into a protected range are not part of that payload, the rare slice
+// that has one does not decode after decryption.
+//
+// The boxes only signal the profile of WriterConfig.Protection, the scheme
+// and IV mode of all samples have to match it. Key rotations are recorded
+// in the Manifest, for which Init and the segments are taken to be written
+// to the recording in the order they were returned. A Writer is not safe
+// for concurrent use.
+type Writer struct {
+	config   WriterConfig
+	ivSize   int // per-sample IV size, 0 with a constant IV
+	sequence uint32
+
+	manifest *drm.ManifestRecorder
+	written  int64 // bytes returned so far
+}
+
+// NewWriter checks the configuration and creates a Writer
+func NewWriter(config WriterConfig) (*Writer, error) {
+	p := config.Protection
+
+	switch {
+	case !p.Enabled:
+		return nil, fmt.Errorf("protection is not enabled")
+	case !drm.ValidScheme(p.Mode):
+		return nil, fmt.Errorf("scheme must be cbcs, cenc, cens or cbc1, got %q", p.Mode)
+	case len(p.KeyID) != 16:
+		return nil, fmt.Errorf("key ID must be 16 bytes, got %d", len(p.KeyID))
+	case p.IV != nil && len(p.IV) != 8 && len(p.IV) != 16:
+		return nil, fmt.Errorf("constant iv must be 8 or 16 bytes, got %d", len(p.IV))
+	case p.CryptBlocks < 0 || p.CryptBlocks > 15 || p.SkipBlocks < 0 || p.SkipBlocks > 15:
+		return nil, fmt.Errorf("pattern %d:%d does not fit tenc", p.CryptBlocks, p.SkipBlocks)
+	case len(config.SPS) < 4 || config.SPS[0]&0x1f != 7:
+		return nil, fmt.Errorf("sps is missing")
+	case len(config.PPS) < 2 || config.PPS[0]&0x1f != 8:
+		return nil, fmt.Errorf("pps is missing")
+	case len(config.SPS) > 0xffff || len(config.PPS) > 0xffff:
+		return nil, fmt.Errorf("parameter sets do not fit avcC")
+	case config.Width <= 0 || config.Width > 0xffff || config.Height <= 0 || config.Height > 0xffff:
+		return nil, fmt.Errorf("invalid size %dx%d", config.Width, config.Height)
+	}
+
+	if config.Timescale == 0 {
+		config.Timescale = DefaultTimescale
+	}
+
+	w := &Writer{config: config, manifest: drm.NewManifestRecorder()}
+	if p.IV == nil {
+		w.ivSize = drm.SampleIVSize(p.Mode)
+	}
+	return w, nil
+}
+
+// ParameterSets returns the first SPS and PPS of an H.264 access unit in
+// Annex B format without start code, the encryptor keeps them clear
+func ParameterSets(au []byte) (sps, pps []byte) {
+	for _, u := range nalUnits(au) {
+		nalu := au[u[0]:u[1]]
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & 0x1f {
+		case 7:
+			if sps == nil {
+				sps = nalu
+			}
+		case 8:
+			if pps == nil {
+				pps = nalu
+			}
+		}
+	}
+	return sps, pps
+}
+
+// Init returns the initialization segment: ftyp and moov with the encv
+// sample entry, its protection scheme and the pssh boxes
+func (w *Writer) Init() []byte {
+	c := w.config
+	p := c.Protection
+
+	var b builder
+	b.start("ftyp")
+	b.str("iso6")
+	b.u32(0)
+	b.str("iso6", "cmfc", "dash", "mp41")
+	b.end()
+
+	b.start("moov")
+
+	b.startFull("mvhd", 0, 0)
+	b.u32(0, 0)              // creation_time, modification_time
+	b.u32(c.Timescale, 0)    // timescale, duration
+	b.u32(0x00010000)        // rate
+	b.u16(0x0100, 0)         // volume, reserved
+	b.u32(0, 0)              // reserved
+	b.u32(unityMatrix[:]...) // matrix
+	b.u32(0, 0, 0, 0, 0, 0)  // pre_defined
+	b.u32(writerTrackID + 1)
+	b.end()
+
+	b.start("trak")
+
+	// track enabled and in movie
+	b.startFull("tkhd", 0, 0x3)
+	b.u32(0, 0)             // creation_time, modification_time
+	b.u32(writerTrackID, 0) // track_ID, reserved
+	b.u32(0, 0, 0)          // duration, reserved
+	b.u16(0, 0, 0, 0)       // layer, alternate_group, volume, reserved
+	b.u32(unityMatrix[:]...)
+	b.u32(uint32(c.Width)<<16, uint32(c.Height)<<16)
+	b.end()
+
+	b.start("mdia")
+
+	b.startFull("mdhd", 0, 0)
+	b.u32(0, 0)           // creation_time, modification_time
+	b.u32(c.Timescale, 0) // timescale, duration
+	b.u16(0x55c4, 0)      // language "und", pre_defined
+	b.end()
+
+	b.startFull("hdlr", 0, 0)
+	b.u32(0) // pre_defined
+	b.str("vide")
+	b.u32(0, 0, 0) // reserved
+	b.bytes([]byte("VideoHandler\x00"))
+	b.end()
+
+	b.start("minf")
+
+	b.startFull("vmhd", 0, 0x1)
+	b.u16(0, 0, 0, 0) // graphicsmode, opcolor
+	b.end()
+
+	b.start("dinf")
+	b.startFull("dref", 0, 0)
+	b.u32(1)
+	// media data is in the same file
+	b.startFull("url ", 0, 0x1)
+	b.end()
+	b.end()
+	b.end()
+
+	b.start("stbl")
+
+	b.startFull("stsd", 0, 0)
+	b.u32(1)
+	w.sampleEntry(&b)
+	b.end()
+
+	// samples are described by the fragments
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		b.startFull(typ, 0, 0)
+		b.u32(0)
+		b.end()
+	}
+	b.startFull("stsz", 0, 0)
+	b.u32(0, 0) // sample_size, sample_count
+	b.end()
+
+	b.end() // stbl
+	b.end() // minf
+	b.end() // mdia
+	b.end() // trak
+
+	b.start("mvex")
+	b.startFull("trex", 0, 0)
+	b.u32(writerTrackID, 1) // track_ID, default_sample_description_index
+	b.u32(0, 0, 0)          // default duration, size and flags
+	b.end()
+	b.end()
+
+	b.bytes(p.InitData)
+
+	b.end() // moov
+
+	w.written += int64(len(b.buf))
+	return b.buf
+}
+
+// Manifest returns the sidecar manifest of the recording written so far,
+// see drm.WriteManifest
+func (w *Writer) Manifest() drm.Manifest {
+	return w.manifest.Manifest()
+}
+
+// unityMatrix is the identity transformation of mvhd and tkhd
+var unityMatrix = [9]uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// sampleEntry appends the encv sample entry with avcC and the protection
+// scheme information of ISO/IEC 23001-7 4
+func (w *Writer) sampleEntry(b *builder) {
+	c := w.config
+	p := c.Protection
+
+	b.start("encv")
+	b.u16(0, 0, 0, 1) // reserved, data_reference_index
+	b.u32(0, 0, 0, 0) // pre_defined, reserved
+	b.u16(uint16(c.Width), uint16(c.Height))
+	b.u32(0x00480000, 0x00480000, 0) // 72 dpi, reserved
+	b.u16(1)                         // frame_count
+	b.bytes(make([]byte, 32))        // compressorname
+	b.u16(0x0018, 0xffff)            // depth, pre_defined
+
+	b.start("avcC")
+	b.u8(1, c.SPS[1], c.SPS[2], c.SPS[3])
+	// 4-byte NAL unit lengths, one SPS
+	b.u8(0xff, 0xe1)
+	b.u16(uint16(len(c.SPS)))
+	b.bytes(c.SPS)
+	b.u8(1)
+	b.u16(uint16(len(c.PPS)))
+	b.bytes(c.PPS)
+	b.end()
+
+	b.start("sinf")
+	b.start("frma")
+	b.str("avc1")
+	b.end()
+	b.startFull("schm", 0, 0)
+	b.str(p.Mode)
+	b.u32(0x10000)
+	b.end()
+
+	b.start("schi")
+	if drm.PatternScheme(p.Mode) {
+		b.startFull("tenc", 1, 0)
+		b.u8(0, uint8(p.CryptBlocks<<4|p.SkipBlocks))
+	} else {
+		b.startFull("tenc", 0, 0)
+		b.u8(0, 0)
+	}
+	b.u8(1, uint8(w.ivSize)) // default_isProtected, default_Per_Sample_IV_Size
+	b.bytes(p.KeyID)
+	if w.ivSize == 0 {
+		b.u8(uint8(len(p.IV)))
+		b.bytes(p.IV)
+	}
+	b.end() // tenc
+	b.end() // schi
+	b.end() // sinf
+
+	b.end() // encv
+}
+
+// trun sample flags of sync samples and of samples depending on others
+const (
+	syncSampleFlags    = 0x02000000
+	nonSyncSampleFlags = 0x01010000
+)
+
+// Segment packages samples as the next media segment: styp, moof and mdat.
+// The first sample should be a keyframe for the segment to start playback.
+func (w *Writer) Segment(samples []MediaSample) ([]byte, error) {
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("segment without samples")
+	}
+
+	type packed struct {
+		data       []byte
+		subsamples []drm.SubsampleInfo
+		keyframe   bool
+		duration   uint32
+	}
+
+	var mdatSize int
+	packs := make([]packed, len(samples))
+	for i, s := range samples {
+		if len(s.IV) != w.ivSize {
+			return nil, fmt.Errorf("sample %d: iv must be %d bytes, got %d", i, w.ivSize, len(s.IV))
+		}
+		if s.Time < 0 || s.Duration < 0 || i > 0 && s.Time < samples[i-1].Time {
+			return nil, fmt.Errorf("sample %d: invalid time %s", i, s.Time)
+		}
+
+		data, subsamples, keyframe, err := lengthPrefixed(s.EncryptedSample)
+		if err != nil {
+			return nil, fmt.Errorf("sample %d: %w", i, err)
+		}
+		if 2+6*len(subsamples)+len(s.IV) > 0xff {
+			return nil, fmt.Errorf("sample %d: %d subsamples do not fit saiz", i, len(subsamples))
+		}
+
+		end := s.Time + s.Duration
+		if i+1 < len(samples) {
+			end = samples[i+1].Time
+		}
+		duration := w.units(end) - w.units(s.Time)
+		if duration > 0xffffffff {
+			return nil, fmt.Errorf("sample %d: duration %s too long", i, end-s.Time)
+		}
+
+		packs[i] = packed{data, subsamples, keyframe, uint32(duration)}
+		mdatSize += len(data)
+	}
+
+	w.sequence++
+
+	var b builder
+	b.start("styp")
+	b.str("msdh")
+	b.u32(0)
+	b.str("msdh", "msix")
+	b.end()
+
+	moof := len(b.buf)
+	b.start("moof")
+
+	b.startFull("mfhd", 0, 0)
+	b.u32(w.sequence)
+	b.end()
+
+	b.start("traf")
+
+	// default-base-is-moof
+	b.startFull("tfhd", 0, 0x20000)
+	b.u32(writerTrackID)
+	b.end()
+
+	b.startFull("tfdt", 1, 0)
+	b.u64(w.units(samples[0].Time))
+	b.end()
+
+	// data-offset, sample duration, size and flags present
+	b.startFull("trun", 0, 0x701)
+	b.u32(uint32(len(samples)))
+	dataOffset := len(b.buf)
+	b.u32(0)
+	for _, p := range packs {
+		flags := uint32(nonSyncSampleFlags)
+		if p.keyframe {
+			flags = syncSampleFlags
+		}
+		b.u32(p.duration, uint32(len(p.data)), flags)
+	}
+	b.end()
+
+	b.startFull("saiz", 0, 0)
+	b.u8(0) // default_sample_info_size
+	b.u32(uint32(len(samples)))
+	for i, p := range packs {
+		b.u8(uint8(len(samples[i].IV) + 2 + 6*len(p.subsamples)))
+	}
+	b.end()
+
+	b.startFull("saio", 0, 0)
+	b.u32(1)
+	auxOffset := len(b.buf)
+	b.u32(0)
+	b.end()
+
+	// with subsample encryption
+	b.startFull("senc", 0, 0x2)
+	b.u32(uint32(len(samples)))
+	aux := len(b.buf)
+	for i, p := range packs {
+		b.bytes(samples[i].IV)
+		b.u16(uint16(len(p.subsamples)))
+		for _, sub := range p.subsamples {
+			b.u16(uint16(sub.BytesOfClearData))
+			b.u32(sub.BytesOfProtectedData)
+		}
+	}
+	b.end()
+
+	b.end() // traf
+	b.end() // moof
+
+	// offsets are relative to the moof, the samples follow the mdat header
+	binary.BigEndian.PutUint32(b.buf[auxOffset:], uint32(aux-moof))
+	binary.BigEndian.PutUint32(b.buf[dataOffset:], uint32(len(b.buf)-moof+8))
+
+	b.buf = binary.BigEndian.AppendUint32(b.buf, uint32(8+mdatSize))
+	b.str("mdat")
+	for i, p := range packs {
+		w.manifest.Record(samples[i].EncryptedSample, w.written+int64(len(b.buf)))
+		b.bytes(p.data)
+	}
+
+	w.written += int64(len(b.buf))
+	return b.buf, nil
+}
+
+// units converts a time to the nearest track timescale unit
+func (w *Writer) units(d time.Duration) uint64 {
+	ts := time.Duration(w.config.Timescale)
+	return uint64(d/time.Second*ts + (d%time.Second*ts+time.Second/2)/time.Second)
+}
+
+// lengthPrefixed converts an encrypted Annex B access unit to NAL units
+// with 4-byte length fields, removes the emulation prevention bytes from
+// its protected ranges and moves the subsamples along. It reports whether
+// the access unit has an IDR slice.
+func lengthPrefixed(sample drm.EncryptedSample) ([]byte, []drm.SubsampleInfo, bool, error) {
+	au := sample.Data
+
+	var protected [][2]int
+	var pos int
+	for _, sub := range sample.Subsamples {
+		pos += int(sub.BytesOfClearData)
+		if sub.BytesOfProtectedData > 0 {
+			protected = append(protected, [2]int{pos, pos + int(sub.BytesOfProtectedData)})
+		}
+		pos += int(sub.BytesOfProtectedData)
+	}
+	if pos != len(au) {
+		return nil, nil, false, fmt.Errorf("%w: %d != %d", drm.ErrInvalidSubsamples, pos, len(au))
+	}
+
+	units := nalUnits(au)
+	if len(units) == 0 {
+		return nil, nil, false, ErrNoStartCode
+	}
+
+	out := make([]byte, 0, len(au)+4)
+	var subsamples subsampleList
+	var keyframe bool
+
+	for _, u := range units {
+		if u[0] < u[1] && au[u[0]]&0x1f == 5 {
+			keyframe = true
+		}
+
+		lengthPos := len(out)
+		out = append(out, 0, 0, 0, 0)
+
+		for pos := u[0]; pos < u[1]; {
+			for len(protected) > 0 && protected[0][1] <= pos {
+				protected = protected[1:]
+			}
+			if len(protected) == 0 || protected[0][0] >= u[1] {
+				out = append(out, au[pos:u[1]]...)
+				break
+			}
+
+			r := protected[0]
+			if r[0] < u[0] || r[1] > u[1] {
+				return nil, nil, false, fmt.Errorf("protected range %d-%d crosses a start code", r[0], r[1])
+			}
+
+			out = append(out, au[pos:r[0]]...)
+			start := len(out)
+			out = unescape(out, au[r[0]:r[1]], trailingZeros(out[lengthPos+4:]))
+			subsamples.protect(start, len(out)-start)
+			pos = r[1]
+		}
+
+		binary.BigEndian.PutUint32(out[lengthPos:], uint32(len(out)-lengthPos-4))
+	}
+
+	return out, subsamples.finish(len(out)), keyframe, nil
+}
+
+// nalUnits returns the NAL units of an Annex B access unit as offsets
+// without their start codes, zero bytes before a start code belong to it
+func nalUnits(au []byte) [][2]int {
+	var units [][2]int
+	start := -1
+	for i := 0; i+2 < len(au); i++ {
+		if au[i] != 0 || au[i+1] != 0 || au[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && au[end-1] == 0 {
+				end--
+			}
+			units = append(units, [2]int{start, end})
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		units = append(units, [2]int{start, len(au)})
+	}
+	return units
+}
+
+// unescape appends data without emulation prevention bytes to dst, zeros
+// is the number of zero bytes preceding data
+func unescape(dst, data []byte, zeros int) []byte {
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		dst = append(dst, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return dst
+}
+
+// trailingZeros returns the number of zero bytes data ends with
+func trailingZeros(data []byte) int {
+	var zeros int
+	for i := len(data) - 1; i >= 0 && data[i] == 0; i-- {
+		zeros++
+	}
+	return zeros
+}
+
+// subsampleList collects the protected ranges of a sample in order as
+// subsamples, clear runs too long for one subsample are split
+type subsampleList struct {
+	subsamples []drm.SubsampleInfo
+	pos        int
+}
+
+func (l *subsampleList) protect(pos, size int) {
+	l.add(pos-l.pos, size)
+	l.pos = pos + size
+}
+
+// finish returns the subsamples of a sample of size bytes
+func (l *subsampleList) finish(size int) []drm.SubsampleInfo {
+	if size > l.pos || len(l.subsamples) == 0 {
+		l.add(size-l.pos, 0)
+	}
+	return l.subsamples
+}
+
+func (l *subsampleList) add(clear, protected int) {
+	for clear > 0xffff {
+		l.subsamples = append(l.subsamples, drm.SubsampleInfo{BytesOfClearData: 0xffff})
+		clear -= 0xffff
+	}
+	l.subsamples = append(l.subsamples, drm.SubsampleInfo{
+		BytesOfClearData:     uint32(clear),
+		BytesOfProtectedData: uint32(protected),
+	})
+}
+
+// builder appends boxes to a buffer, their sizes are set when they end
+type builder struct {
+	buf  []byte
+	open []int // offsets of the boxes not ended yet
+}
+
+func (b *builder) start(typ string) {
+	b.open = append(b.open, len(b.buf))
+	b.buf = append(b.buf, 0, 0, 0, 0)
+	b.buf = append(b.buf, typ...)
+}
+
+func (b *builder) startFull(typ string, version uint8, flags uint32) {
+	b.start(typ)
+	b.u32(uint32(version)<<24 | flags)
+}
+
+func (b *builder) end() {
+	pos := b.open[len(b.open)-1]
+	b.open = b.open[:len(b.open)-1]
+	binary.BigEndian.PutUint32(b.buf[pos:], uint32(len(b.buf)-pos))
+}
+
+func (b *builder) u8(v ...uint8) { b.buf = append(b.buf, v...) }
+
+func (b *builder) u16(v ...uint16) {
+	for _, x := range v {
+		b.buf = binary.BigEndian.AppendUint16(b.buf, x)
+	}
+}
+
+func (b *builder) u32(v ...uint32) {
+	for _, x := range v {
+		b.buf = binary.BigEndian.AppendUint32(b.buf, x)
+	}
+}
+
+func (b *builder) u64(v uint64) { b.buf = binary.BigEndian.AppendUint64(b.buf, v) }
+
+func (b *builder) str(v ...string) {
+	for _, s := range v {
+		b.buf = append(b.buf, s...)
+	}
+}
+
+func (b *builder) bytes(v []byte) { b.buf = append(b.buf, v...) }
@@ -0,0 +1,188 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// avcc converts an Annex B access unit with 4-byte start codes to 4-byte
+// length fields
+func avcc(au []byte) []byte {
+	var out []byte
+	for _, nalu := range bytes.Split(au, []byte{0, 0, 0, 1})[1:] {
+		out = append(out, u32(uint32(len(nalu)))...)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// writeSegment encrypts frames 1/30s apart and packages them with a Writer
+// of the encryptor's profile, returning the parsed initialization segment
+// and the samples of the media segment
+func writeSegment(t *testing.T, e *drm.Encryptor, frames [][]byte) (*Track, []Sample) {
+	t.Helper()
+
+	info, err := e.ClientInfo()
+	if err != nil {
+		t.Fatalf("ClientInfo() returned error: %s", err)
+	}
+
+	sps, pps := ParameterSets(frames[0])
+	w, err := NewWriter(WriterConfig{Protection: info, SPS: sps, PPS: pps, Width: 1280, Height: 720})
+	if err != nil {
+		t.Fatalf("NewWriter() returned error: %s", err)
+	}
+
+	var samples []MediaSample
+	for i, frame := range frames {
+		sample, err := e.EncryptSample(frame)
+		if err != nil {
+			t.Fatalf("EncryptSample() returned error: %s", err)
+		}
+		samples = append(samples, MediaSample{
+			EncryptedSample: sample,
+			Time:            time.Second + time.Duration(i)*time.Second/30,
+			Duration:        time.Second / 30,
+		})
+	}
+
+	track, err := ParseInit(w.Init())
+	if err != nil {
+		t.Fatalf("ParseInit() returned error: %s", err)
+	}
+
+	segment, err := w.Segment(samples)
+	if err != nil {
+		t.Fatalf("Segment() returned error: %s", err)
+	}
+
+	boxes, err := ReadBoxes(segment)
+	if err != nil {
+		t.Fatalf("ReadBoxes() returned error: %s", err)
+	}
+	if len(boxes) != 3 || boxes[0].Type != "styp" || boxes[1].Type != "moof" || boxes[2].Type != "mdat" {
+		t.Fatalf("Segment() returned %v, want styp, moof and mdat", boxes)
+	}
+
+	parsed, err := track.ParseFragment(segment[boxes[1].Offset:])
+	if err != nil {
+		t.Fatalf("ParseFragment() returned error: %s", err)
+	}
+	return track, parsed
+}
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		crypt int
+		skip  int
+	}{
+		{name: "cbcs 1:9", mode: "cbcs", crypt: 1, skip: 9},
+		{name: "cenc", mode: "cenc"},
+		{name: "cbc1", mode: "cbc1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := drm.NewEncryptor(drm.Config{
+				Enabled:     true,
+				KeyID:       testKeyID,
+				Key:         testKey,
+				IV:          testIV,
+				Mode:        tt.mode,
+				CryptBlocks: tt.crypt,
+				SkipBlocks:  tt.skip,
+			})
+			if err != nil {
+				t.Fatalf("NewEncryptor() returned error: %s", err)
+			}
+
+			frames := testFrames()
+			track, samples := writeSegment(t, e, frames)
+
+			if track.Scheme != tt.mode || track.Timescale != DefaultTimescale {
+				t.Errorf("ParseInit() scheme = %s, timescale = %d, want %s at %d", track.Scheme, track.Timescale, tt.mode, DefaultTimescale)
+			}
+			if !bytes.Equal(track.Encryption.KID, mustHex(testKeyID)) {
+				t.Errorf("ParseInit() KID = %x, want %s", track.Encryption.KID, testKeyID)
+			}
+			if track.Encryption.CryptBlocks != tt.crypt || track.Encryption.SkipBlocks != tt.skip {
+				t.Errorf("ParseInit() pattern = %d:%d, want %d:%d", track.Encryption.CryptBlocks, track.Encryption.SkipBlocks, tt.crypt, tt.skip)
+			}
+			if drm.PerSampleIV(e.Profile().IVMode) && track.Encryption.PerSampleIVSize != drm.SampleIVSize(tt.mode) {
+				t.Errorf("ParseInit() per-sample IV size = %d, want %d", track.Encryption.PerSampleIVSize, drm.SampleIVSize(tt.mode))
+			}
+
+			if len(samples) != len(frames) {
+				t.Fatalf("ParseFragment() returned %d samples, want %d", len(samples), len(frames))
+			}
+			for i, s := range samples {
+				if want := uint64(90000 + i*3000); s.DecodeTime != want || s.Duration != 3000 {
+					t.Errorf("sample %d at %d for %d, want %d for 3000", i, s.DecodeTime, s.Duration, want)
+				}
+			}
+
+			got, err := track.Decrypt(mustHex(testKey), samples)
+			if err != nil {
+				t.Fatalf("Decrypt() returned error: %s", err)
+			}
+			for i := range frames {
+				if !bytes.Equal(got[i], avcc(frames[i])) {
+					t.Errorf("sample %d does not match source", i)
+				}
+			}
+		})
+	}
+}
+
+func TestWriter_emulationPrevention(t *testing.T) {
+	// the nonce is pinned for a ciphertext known to emulate start codes
+	e, err := drm.NewEncryptor(drm.Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, IVNonce: "0000000000000000", Mode: "cenc"})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+
+	// enough ciphertext to emulate start codes
+	sps, pps := ParameterSets(testFrames()[0])
+	frame := bytes.Join([][]byte{{0, 0, 0, 1}, sps, {0, 0, 0, 1}, pps, {0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0x80}, 4<<20)}, nil)
+	track, samples := writeSegment(t, e, [][]byte{frame})
+	if e.Stats().EmulationPreventionBytes == 0 {
+		t.Fatalf("ciphertext has no emulation prevention bytes")
+	}
+
+	// players decrypt protected ranges as stored
+	got, err := track.Decrypt(mustHex(testKey), samples)
+	if err != nil {
+		t.Fatalf("Decrypt() returned error: %s", err)
+	}
+	if !bytes.Equal(got[0], avcc(frame)) {
+		t.Errorf("sample does not match source")
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	info := drm.ClientInfo{Enabled: true, Mode: "cbcs", KeyID: mustHex(testKeyID), IV: mustHex(testIV)}
+	sps, pps := ParameterSets(testFrames()[0])
+
+	tests := []struct {
+		name   string
+		config WriterConfig
+		ok     bool
+	}{
+		{"valid", WriterConfig{Protection: info, SPS: sps, PPS: pps, Width: 640, Height: 480}, true},
+		{"disabled", WriterConfig{SPS: sps, PPS: pps, Width: 640, Height: 480}, false},
+		{"without sps", WriterConfig{Protection: info, PPS: pps, Width: 640, Height: 480}, false},
+		{"swapped parameter sets", WriterConfig{Protection: info, SPS: pps, PPS: sps, Width: 640, Height: 480}, false},
+		{"without size", WriterConfig{Protection: info, SPS: sps, PPS: pps}, false},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewWriter(tt.config); (err == nil) != tt.ok {
+			t.Errorf("%s: NewWriter() error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
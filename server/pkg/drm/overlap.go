@@ -0,0 +1,156 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyAcks describes the overlap window of a staged key, see
+// Config.KeyOverlap
+type KeyAcks struct {
+	// KeyID of the staged key, hex encoded
+	KeyID string
+	// Waiting lists the sessions that have not acknowledged it yet, sorted
+	Waiting []string
+	// Deadline is when the key is switched to without them, at the next
+	// keyframe
+	Deadline time.Time
+}
+
+// overlap tracks the sessions holding back the switch to a staged key in
+// the overlap window; e.mu guards it
+type overlap struct {
+	// the longest a staged key waits for acknowledgements, 0 disables it
+	window time.Duration
+	// connected sessions, and those of them that acknowledged the key
+	sessions map[string]struct{}
+	acks     map[string]struct{}
+	deadline time.Time
+}
+
+// start begins the overlap window of a key staged to activate at
+// activateAt, zero time meaning now
+func (o *overlap) start(now, activateAt time.Time) {
+	clear(o.acks)
+	if activateAt.Before(now) {
+		activateAt = now
+	}
+	o.deadline = activateAt.Add(o.window)
+}
+
+// waiting returns the sessions that have not acknowledged the staged key
+func (o *overlap) waiting() []string {
+	var waiting []string
+	for id := range o.sessions {
+		if _, ok := o.acks[id]; !ok {
+			waiting = append(waiting, id)
+		}
+	}
+	sort.Strings(waiting)
+	return waiting
+}
+
+// overlapping reports whether a key other than the current one is staged
+// with an overlap window; e.mu is held
+func (e *Encryptor) overlapping() bool {
+	return e.overlap.window > 0 && e.pending != nil && !bytes.Equal(e.pending.keyID, e.state.Load().keyID)
+}
+
+// holds reports whether the switch to the staged state has to wait: it
+// brings a key the connected sessions did not all acknowledge and the
+// deadline has not passed yet; e.mu is held
+func (e *Encryptor) holds() bool {
+	if !e.overlapping() || !e.now().Before(e.overlap.deadline) {
+		return false
+	}
+	for id := range e.overlap.sessions {
+		if _, ok := e.overlap.acks[id]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSession registers a connected session, which has to acknowledge
+// staged keys with AcknowledgeKey before the switch in the overlap window.
+// Sessions connecting while a key is staged are waited for too.
+func (e *Encryptor) AddSession(sessionID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.overlap.sessions == nil {
+		e.overlap.sessions = map[string]struct{}{}
+	}
+	e.overlap.sessions[sessionID] = struct{}{}
+}
+
+// RemoveSession forgets a disconnected session, the switch does not wait
+// for it anymore
+func (e *Encryptor) RemoveSession(sessionID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.overlap.sessions, sessionID)
+	delete(e.overlap.acks, sessionID)
+}
+
+// AcknowledgeKey records that a session installed the key of the hex
+// encoded key ID, as the signaling layer learns from its client. It
+// reports whether that is the staged key and the session is connected,
+// acknowledging any other key has no effect.
+func (e *Encryptor) AcknowledgeKey(sessionID, keyID string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pending == nil || !strings.EqualFold(hex.EncodeToString(e.pending.keyID), keyID) {
+		return false
+	}
+	if _, ok := e.overlap.sessions[sessionID]; !ok {
+		return false
+	}
+
+	if e.overlap.acks == nil {
+		e.overlap.acks = map[string]struct{}{}
+	}
+	e.overlap.acks[sessionID] = struct{}{}
+	return true
+}
+
+// CurrentKeyID returns the hex encoded ID of the key frames are currently
+// encrypted with, empty when disabled
+func (e *Encryptor) CurrentKeyID() string {
+	return e.KeyIDHex()
+}
+
+// PendingKeyID returns the hex encoded ID of the staged key, which takes
+// over at a keyframe once due. Both keys are known to clients in the
+// overlap window.
+func (e *Encryptor) PendingKeyID() (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pending == nil {
+		return "", false
+	}
+	return hex.EncodeToString(e.pending.keyID), true
+}
+
+// KeyAcks returns the overlap window of the staged key, false unless a key
+// other than the current one is staged with Config.KeyOverlap
+func (e *Encryptor) KeyAcks() (KeyAcks, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.overlapping() {
+		return KeyAcks{}, false
+	}
+
+	return KeyAcks{
+		KeyID:    hex.EncodeToString(e.pending.keyID),
+		Waiting:  e.overlap.waiting(),
+		Deadline: e.overlap.deadline,
+	}, true
+}
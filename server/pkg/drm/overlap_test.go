@@ -0,0 +1,159 @@
+package drm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newOverlapEncryptor returns an encryptor with a minute of key overlap on
+// a fake clock, sessions connected
+func newOverlapEncryptor(t *testing.T, sessions ...string) (*Encryptor, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeyOverlap: time.Minute})
+	e.now = clock.now
+
+	for _, id := range sessions {
+		e.AddSession(id)
+	}
+	if err := e.ApplyProfile(testProfile); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+	return e, clock
+}
+
+func TestEncryptor_KeyOverlap(t *testing.T) {
+	idrFrame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+	pFrame := nalUnit(0x41, 64)
+
+	e, clock := newOverlapEncryptor(t, "a", "b")
+	encrypt := func(frame []byte, want string) {
+		t.Helper()
+		if _, err := e.Encrypt(frame); err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+		if got := e.CurrentKeyID(); got != want {
+			t.Fatalf("CurrentKeyID() = %s, want %s", got, want)
+		}
+	}
+
+	if pending, ok := e.PendingKeyID(); !ok || pending != testProfile.KeyID {
+		t.Errorf("PendingKeyID() = %s, %v; want %s", pending, ok, testProfile.KeyID)
+	}
+
+	// slow acknowledgements hold the key back at keyframes
+	encrypt(idrFrame, testKeyID)
+
+	if e.AcknowledgeKey("a", testKeyID) {
+		t.Errorf("AcknowledgeKey() of the current key = true, want false")
+	}
+	if e.AcknowledgeKey("c", testProfile.KeyID) {
+		t.Errorf("AcknowledgeKey() of an unknown session = true, want false")
+	}
+	if !e.AcknowledgeKey("a", strings.ToUpper(testProfile.KeyID)) {
+		t.Errorf("AcknowledgeKey() = false, want true")
+	}
+
+	acks, ok := e.KeyAcks()
+	want := KeyAcks{KeyID: testProfile.KeyID, Waiting: []string{"b"}, Deadline: clock.t.Add(time.Minute)}
+	if !ok || !reflect.DeepEqual(acks, want) {
+		t.Errorf("KeyAcks() = %+v, %v; want %+v", acks, ok, want)
+	}
+
+	clock.t = clock.t.Add(30 * time.Second)
+	encrypt(idrFrame, testKeyID)
+
+	// the last acknowledgement switches at the next keyframe
+	e.AcknowledgeKey("b", testProfile.KeyID)
+	encrypt(pFrame, testKeyID)
+	encrypt(idrFrame, testProfile.KeyID)
+
+	if _, ok := e.PendingKeyID(); ok {
+		t.Errorf("PendingKeyID() after the switch = true, want false")
+	}
+	if _, ok := e.KeyAcks(); ok {
+		t.Errorf("KeyAcks() after the switch = true, want false")
+	}
+}
+
+func TestEncryptor_KeyOverlapTimeout(t *testing.T) {
+	idrFrame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+	pFrame := nalUnit(0x41, 64)
+
+	e, clock := newOverlapEncryptor(t, "a", "b")
+	e.AcknowledgeKey("a", testProfile.KeyID)
+
+	steps := []struct {
+		at    time.Duration
+		frame []byte
+		want  string
+	}{
+		{59 * time.Second, idrFrame, testKeyID},
+		{time.Minute, pFrame, testKeyID},
+		{time.Minute, idrFrame, testProfile.KeyID},
+	}
+
+	start := clock.t
+	for i, step := range steps {
+		clock.t = start.Add(step.at)
+		if _, err := e.Encrypt(step.frame); err != nil {
+			t.Fatalf("%d: Encrypt() returned error: %s", i, err)
+		}
+		if got := e.CurrentKeyID(); got != step.want {
+			t.Errorf("%d: CurrentKeyID() = %s, want %s", i, got, step.want)
+		}
+	}
+}
+
+func TestEncryptor_KeyOverlapSessions(t *testing.T) {
+	idrFrame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+
+	// a session connecting in the window is waited for, one leaving is not
+	e, _ := newOverlapEncryptor(t, "a")
+	e.AddSession("b")
+	e.AcknowledgeKey("a", testProfile.KeyID)
+	e.Encrypt(idrFrame)
+	if got := e.CurrentKeyID(); got != testKeyID {
+		t.Errorf("CurrentKeyID() = %s with a session waited for, want %s", got, testKeyID)
+	}
+
+	e.RemoveSession("b")
+	e.Encrypt(idrFrame)
+	if got := e.CurrentKeyID(); got != testProfile.KeyID {
+		t.Errorf("CurrentKeyID() = %s after the session left, want %s", got, testProfile.KeyID)
+	}
+
+	// without sessions and for profiles keeping the key nothing waits
+	e, _ = newOverlapEncryptor(t)
+	e.Encrypt(idrFrame)
+	if got := e.CurrentKeyID(); got != testProfile.KeyID {
+		t.Errorf("CurrentKeyID() = %s without sessions, want %s", got, testProfile.KeyID)
+	}
+
+	e.AddSession("a")
+	p := e.Profile()
+	p.Key, p.CryptBlocks, p.SkipBlocks = testProfile.Key, 0, 0
+	if err := e.ApplyProfile(p); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+	if _, ok := e.KeyAcks(); ok {
+		t.Errorf("KeyAcks() of a profile keeping the key ID = true, want false")
+	}
+	e.Encrypt(idrFrame)
+	if _, ok := e.PendingKeyID(); ok {
+		t.Errorf("PendingKeyID() = true, want the profile keeping the key ID switched to")
+	}
+}
+
+func TestNewEncryptor_keyOverlap(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"negative":  {KeyOverlap: -time.Second},
+		"layer ivs": {KeyOverlap: time.Second, LayerIVs: true},
+	} {
+		cfg.Enabled, cfg.KeyID, cfg.Key, cfg.IV = true, testKeyID, testKey, testIV
+		if _, err := NewEncryptor(cfg); err == nil {
+			t.Errorf("%s: NewEncryptor() returned no error", name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package drm
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// ParallelMinSize is the size from which access units are encrypted by
+// several goroutines with Config.Parallelism, smaller ones cost less than
+// starting them
+const ParallelMinSize = 64 << 10
+
+// cbcsJob is a NAL unit of an access unit encrypted in parallel, the
+// protected range of its RBSP in the scratch buffer of the encryption
+type cbcsJob struct {
+	encrypt    bool
+	start, end int // RBSP in encryption.rbsp
+	lead       int
+	protected  int
+}
+
+// encryptCBCSParallel is encryptBlocks of cbcs with the pattern encryption
+// of the NAL units spread over the workers. Every chain restarts from the
+// constant IV, so NAL units are independent; parsing and assembling the
+// output stay serial and in order, the result is byte-identical.
+func (e *encryption) encryptCBCSParallel(dst []byte, s *cipherState, data []byte) ([]byte, error) {
+	hl := e.codec.headerLen()
+
+	// slice headers refer to the parameter sets before them
+	jobs := slices.Grow(e.jobs[:0], len(e.ranges))
+	e.rbsp = e.rbsp[:0]
+	var encrypted int
+	for _, r := range e.ranges {
+		nalu := r.nalu(data)
+
+		var job cbcsJob
+		switch {
+		case len(nalu) <= hl:
+		case !e.encrypts(e.codec.nalType(nalu)):
+			e.observe(nalu)
+		default:
+			job.start = len(e.rbsp)
+			e.rbsp = appendUnescaped(e.rbsp, nalu[hl:], 0)
+			job.end = len(e.rbsp)
+
+			rbsp := e.rbsp[job.start:job.end]
+			job.protected = protectedLen(rbsp)
+			if job.protected < minProtectedSize {
+				e.stats.shortNALs.Add(1)
+			}
+			if job.protected < e.minEncryptSize {
+				break
+			}
+
+			_, job.lead = e.sliceLead(nalu, rbsp)
+			job.encrypt = job.protected-job.lead >= minProtectedSize
+			if job.encrypt {
+				encrypted++
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	e.jobs = jobs
+
+	workers := min(e.parallelism, encrypted)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < len(jobs); i = int(next.Add(1) - 1) {
+				if job := jobs[i]; job.encrypt {
+					s.rangeCipher(nil, false).apply(e.rbsp[job.start+job.lead : job.start+job.protected])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := slices.Grow(dst[:0], outputSize(len(data)))
+	result = append(result, prefix(e.ranges, data)...)
+	var escaped int
+	for i, r := range e.ranges {
+		result = append(result, data[r.offset:r.offset+r.headerLen]...)
+		nalu := r.nalu(data)
+
+		job := jobs[i]
+		if !job.encrypt {
+			e.keepClear(data, nalu, len(result))
+			result = append(result, nalu...)
+			continue
+		}
+
+		rbsp := e.rbsp[job.start:job.end]
+		start := len(result)
+		result = append(result, nalu[:hl]...)
+		result = e.appendProtected(result, rbsp[:job.lead], rbsp[job.lead:job.protected], rbsp[job.protected:])
+		escaped += len(result) - start - len(nalu)
+	}
+
+	return result, checkOutputSize(len(data), len(result), escaped)
+}
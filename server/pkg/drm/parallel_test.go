@@ -0,0 +1,85 @@
+package drm
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// largeIDRFrame builds an access unit of parameter sets and several IDR
+// slices with random payloads, which carry emulation prevention bytes
+func largeIDRFrame(slices, size int) []byte {
+	rnd := rand.New(rand.NewSource(int64(slices*size + 1)))
+	params := h264Params{}
+
+	frame := bytes.Join([][]byte{nalUnit(0x09, 1), params.sps(), params.pps()}, nil)
+	for i := 0; i < slices; i++ {
+		slice, _ := params.slice(0x65, sliceHeaderCases[0].fields, 0)
+		rbsp := make([]byte, size)
+		rnd.Read(rbsp)
+		for j := 100; j+3 < size; j += 4099 {
+			rbsp[j], rbsp[j+1], rbsp[j+2] = 0, 0, 1
+		}
+
+		// the slice without its trailing bits, then the random payload
+		frame = append(frame, h264NAL(0x65, append(unescapeRBSP(slice[5:len(slice)-1]), rbsp...))...)
+	}
+	return append(frame, nalUnit(0x0c, 30)...)
+}
+
+func TestEncryptor_parallel(t *testing.T) {
+	frames := [][]byte{
+		largeIDRFrame(8, 80<<10),
+		largeIDRFrame(1, 200<<10),
+		largeIDRFrame(3, 30<<10),
+		append(largeIDRFrame(4, 20<<10), shortSliceFrame(3)...),
+	}
+	frames = append(frames, h264Stream()...)
+
+	if !bytes.Contains(frames[0], []byte{0, 0, 3}) {
+		t.Fatalf("large frame has no emulation prevention bytes")
+	}
+
+	for _, cfg := range []Config{
+		{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9},
+		{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 0},
+		{Mode: "cbcs", CryptBlocks: 2, SkipBlocks: 8, NALFormat: NALFormatAVCC},
+	} {
+		serial := newTestEncryptor(t, cfg)
+		cfg.Parallelism = 4
+		parallel := newTestEncryptor(t, cfg)
+
+		for i, frame := range frames {
+			if cfg.NALFormat == NALFormatAVCC {
+				frame = lengthPrefixed(frame, 4)
+			}
+
+			want, err := serial.EncryptSample(frame)
+			if err != nil {
+				t.Fatalf("frame %d: EncryptSample() returned error: %s", i, err)
+			}
+			got, err := parallel.EncryptSample(frame)
+			if err != nil {
+				t.Fatalf("frame %d: EncryptSample() parallel returned error: %s", i, err)
+			}
+
+			if !bytes.Equal(got.Data, want.Data) {
+				t.Errorf("%d:%d frame %d: parallel ciphertext differs from the serial one", cfg.CryptBlocks, cfg.SkipBlocks, i)
+			}
+			if !reflect.DeepEqual(got.Subsamples, want.Subsamples) {
+				t.Errorf("%d:%d frame %d: Subsamples = %v, want %v", cfg.CryptBlocks, cfg.SkipBlocks, i, got.Subsamples, want.Subsamples)
+			}
+		}
+
+		if got, want := parallel.Stats(), serial.Stats(); got.ShortNALs != want.ShortNALs || got.EmulationPreventionBytes != want.EmulationPreventionBytes {
+			t.Errorf("Stats() = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestNewEncryptor_parallelism(t *testing.T) {
+	if _, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Parallelism: -1}); err == nil {
+		t.Errorf("NewEncryptor() expected error for negative parallelism")
+	}
+}
@@ -0,0 +1,314 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Overflow policies of an EncryptPipeline with a full queue
+const (
+	// PipelineOverflowBlock blocks Submit until a result was taken
+	PipelineOverflowBlock = "block"
+	// PipelineOverflowDropOldest drops the oldest access unit not being
+	// encrypted yet that is no keyframe and carries no parameter sets,
+	// Submit blocks when there is none
+	PipelineOverflowDropOldest = "drop-oldest"
+)
+
+// DefaultPipelineQueueSize is the default PipelineConfig.QueueSize
+const DefaultPipelineQueueSize = 16
+
+// ErrPipelineClosed is returned by Submit after Close
+var ErrPipelineClosed = errors.New("encryption pipeline is closed")
+
+// PipelineConfig configures an EncryptPipeline
+type PipelineConfig struct {
+	// Workers encrypting access units concurrently (default 2)
+	Workers int
+	// QueueSize is the number of access units submitted and not yet taken
+	// from the output (default DefaultPipelineQueueSize)
+	QueueSize int
+	// Overflow is PipelineOverflowBlock (default) or
+	// PipelineOverflowDropOldest
+	Overflow string
+}
+
+// PipelineResult is an encrypted access unit of an EncryptPipeline, or
+// the error encrypting it
+type PipelineResult struct {
+	EncryptedSample
+	Err error
+	// Seq is the index of the access unit in submission order, counting
+	// from zero; dropped access units leave gaps
+	Seq uint64
+}
+
+// PipelineStats are the counters of an EncryptPipeline
+type PipelineStats struct {
+	// access units submitted and not yet taken from the output
+	QueueDepth int
+	Submitted  uint64
+	Dropped    uint64
+}
+
+// EncryptPipeline encrypts access units of an Encryptor on several
+// goroutines, for bitrates a single one cannot keep up with. Results are
+// released in submission order: the steps depending on the stream, the
+// stream checks, switching profiles and taking sample IVs, run in Submit,
+// only encrypting the access units runs concurrently. With H.264 the
+// parameter sets are observed in order, access units carrying them are
+// encrypted after those before and before those after them.
+//
+// The synchronous Encrypt and its variants stay the default; the
+// ciphertext is the same, encrypted into a new buffer for every result.
+type EncryptPipeline struct {
+	e        *Encryptor
+	overflow string
+	size     int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// access units submitted and not yet released, in submission order
+	queue  []*pipelineJob
+	seq    uint64
+	closed bool
+
+	dropped uint64
+	out     chan PipelineResult
+	workers sync.WaitGroup
+}
+
+// pipelineJob is an access unit in the queue of an EncryptPipeline
+type pipelineJob struct {
+	seq      uint64
+	prepared *preparedSample
+	// keyframes and parameter sets are never dropped, parameter sets of
+	// H.264 are barriers to the encryption of other access units
+	keep    bool
+	barrier bool
+
+	started bool
+	done    bool
+	result  PipelineResult
+}
+
+// NewEncryptPipeline starts the workers of a pipeline encrypting with e,
+// Close stops them
+func NewEncryptPipeline(e *Encryptor, cfg PipelineConfig) (*EncryptPipeline, error) {
+	if cfg.Workers < 0 {
+		return nil, fmt.Errorf("pipeline workers must not be negative, got %d", cfg.Workers)
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = 2
+	}
+	if cfg.QueueSize < 0 {
+		return nil, fmt.Errorf("pipeline queue size must not be negative, got %d", cfg.QueueSize)
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = DefaultPipelineQueueSize
+	}
+	switch cfg.Overflow {
+	case "":
+		cfg.Overflow = PipelineOverflowBlock
+	case PipelineOverflowBlock, PipelineOverflowDropOldest:
+	default:
+		return nil, fmt.Errorf("pipeline overflow must be %s or %s, got %q", PipelineOverflowBlock, PipelineOverflowDropOldest, cfg.Overflow)
+	}
+
+	p := &EncryptPipeline{
+		e:        e,
+		overflow: cfg.Overflow,
+		size:     cfg.QueueSize,
+		out:      make(chan PipelineResult),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.workers.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go p.work()
+	}
+	go p.release()
+	return p, nil
+}
+
+// Submit queues an access unit for encryption, it must not be modified
+// until its result was taken from Output. With a full queue Submit blocks
+// or drops an older access unit, see PipelineConfig.Overflow. Access units
+// are in the order of the stream, concurrent calls are serialized.
+func (p *EncryptPipeline) Submit(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for !p.closed && len(p.queue) >= p.size {
+		if p.overflow == PipelineOverflowDropOldest && p.dropOldest() {
+			continue
+		}
+		p.cond.Wait()
+	}
+	if p.closed {
+		return ErrPipelineClosed
+	}
+
+	job := &pipelineJob{seq: p.seq}
+	p.seq++
+
+	// in submission order, holding the mutex
+	prepared, sample, err := p.e.prepareSample(nil, data, keyframeDetect)
+	if prepared == nil {
+		job.done = true
+		job.result = PipelineResult{EncryptedSample: sample, Err: err}
+	} else {
+		job.prepared = prepared
+		job.keep, job.barrier = p.classify(prepared.data)
+	}
+	job.result.Seq = job.seq
+
+	p.queue = append(p.queue, job)
+	p.cond.Broadcast()
+	return nil
+}
+
+// classify reports whether an access unit is a keyframe or carries
+// parameter sets, and whether it is a barrier to the others
+func (p *EncryptPipeline) classify(data []byte) (keep, barrier bool) {
+	codec := p.e.codec
+	if codec.isAudio() {
+		return false, false
+	}
+
+	for _, r := range findNALUnits(nil, data) {
+		nalu := r.nalu(data)
+		if len(nalu) < codec.headerLen() {
+			continue
+		}
+		switch nalType := codec.nalType(nalu); {
+		case codec.isKeyframe(nalType):
+			keep = true
+		case codec.isSPS(nalType) || codec.isPPS(nalType):
+			keep = true
+			barrier = p.e.headers != nil
+		}
+	}
+	return keep, barrier
+}
+
+// dropOldest drops the oldest access unit no worker took that may be
+// dropped, reporting whether there was one
+func (p *EncryptPipeline) dropOldest() bool {
+	for i, job := range p.queue {
+		if job.started || job.done || job.keep {
+			continue
+		}
+
+		p.e.encryptions.Put(job.prepared.enc)
+		p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		p.dropped++
+		return true
+	}
+	return false
+}
+
+// next returns the oldest job a worker may encrypt, nil when none may
+func (p *EncryptPipeline) next() *pipelineJob {
+	pending := false // an older job is not done
+	for _, job := range p.queue {
+		switch {
+		case job.done:
+			continue
+		case job.started:
+		case !job.barrier || !pending:
+			return job
+		}
+
+		// nothing passes an unfinished barrier
+		if job.barrier {
+			return nil
+		}
+		pending = true
+	}
+	return nil
+}
+
+// work encrypts jobs until the pipeline is closed and drained
+func (p *EncryptPipeline) work() {
+	defer p.workers.Done()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		job := p.next()
+		if job == nil {
+			if p.closed && len(p.queue) == 0 {
+				return
+			}
+			p.cond.Wait()
+			continue
+		}
+
+		job.started = true
+		p.mu.Unlock()
+		sample, err := p.e.encryptPrepared(nil, job.prepared)
+		p.mu.Lock()
+
+		job.done = true
+		job.result.EncryptedSample, job.result.Err = sample, err
+		p.cond.Broadcast()
+	}
+}
+
+// release sends the results to the output in submission order
+func (p *EncryptPipeline) release() {
+	defer close(p.out)
+
+	p.mu.Lock()
+	for {
+		for len(p.queue) == 0 && !p.closed || len(p.queue) > 0 && !p.queue[0].done {
+			p.cond.Wait()
+		}
+		// closed and drained
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			p.workers.Wait()
+			return
+		}
+
+		job := p.queue[0]
+		p.mu.Unlock()
+		p.out <- job.result
+		p.mu.Lock()
+
+		// taken from the output, making room for another access unit
+		p.queue = p.queue[1:]
+		p.cond.Broadcast()
+	}
+}
+
+// Output returns the channel of the results in submission order, it is
+// closed once the pipeline was closed and drained
+func (p *EncryptPipeline) Output() <-chan PipelineResult {
+	return p.out
+}
+
+// Close stops taking access units, the queued ones are still encrypted
+// and released to Output before it is closed. It does not wait for them.
+func (p *EncryptPipeline) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// Stats returns the counters of the pipeline, for metrics
+func (p *EncryptPipeline) Stats() PipelineStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PipelineStats{
+		QueueDepth: len(p.queue),
+		Submitted:  p.seq,
+		Dropped:    p.dropped,
+	}
+}
@@ -0,0 +1,167 @@
+package drm
+
+import (
+	"bytes"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+// pipelineResults submits the access units and collects the results
+func pipelineResults(t *testing.T, p *EncryptPipeline, aus [][]byte) []PipelineResult {
+	t.Helper()
+
+	go func() {
+		for _, au := range aus {
+			if err := p.Submit(au); err != nil {
+				t.Errorf("Submit() returned error: %s", err)
+			}
+		}
+		p.Close()
+	}()
+
+	var results []PipelineResult
+	for result := range p.Output() {
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestEncryptPipeline_order(t *testing.T) {
+	var aus [][]byte
+	for i := 0; i < 8; i++ {
+		aus = append(aus, streamAccessUnits()...)
+	}
+
+	for _, cfg := range []Config{
+		{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeySEI: true},
+		// sample IVs are taken in submission order
+		{Mode: "cenc"},
+	} {
+		ref := newTestEncryptor(t, cfg)
+		e := newTestEncryptor(t, cfg)
+		if cfg.Mode == "cbcs" {
+			// workers finish in random order
+			e.encryptAU = func(enc *encryption, s *cipherState, data []byte) ([]byte, error) {
+				time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+				return enc.encryptBlocks(nil, s, nil, data)
+			}
+		}
+
+		p, err := NewEncryptPipeline(e, PipelineConfig{Workers: 4, QueueSize: 8})
+		if err != nil {
+			t.Fatalf("NewEncryptPipeline() returned error: %s", err)
+		}
+
+		results := pipelineResults(t, p, aus)
+		if len(results) != len(aus) {
+			t.Fatalf("%s: pipeline released %d results, want %d", cfg.Mode, len(results), len(aus))
+		}
+		for i, result := range results {
+			want, err := ref.EncryptSample(aus[i])
+			if err != nil {
+				t.Fatalf("EncryptSample() returned error: %s", err)
+			}
+			if result.Err != nil || result.Seq != uint64(i) || !bytes.Equal(result.Data, want.Data) || !bytes.Equal(result.IV, want.IV) {
+				t.Errorf("%s: result %d = seq %d, %v; want the synchronous ciphertext", cfg.Mode, i, result.Seq, result.Err)
+			}
+		}
+
+		if stats := p.Stats(); stats != (PipelineStats{Submitted: uint64(len(aus))}) {
+			t.Errorf("%s: Stats() = %+v, want %d submitted", cfg.Mode, stats, len(aus))
+		}
+	}
+}
+
+func TestEncryptPipeline_dropOldest(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	gate := make(chan struct{})
+	e.encryptAU = func(enc *encryption, s *cipherState, data []byte) ([]byte, error) {
+		<-gate
+		return enc.encryptBlocks(nil, s, nil, data)
+	}
+
+	p, err := NewEncryptPipeline(e, PipelineConfig{Workers: 2, QueueSize: 3, Overflow: PipelineOverflowDropOldest})
+	if err != nil {
+		t.Fatalf("NewEncryptPipeline() returned error: %s", err)
+	}
+
+	// the IDR with the parameter sets holds the others back and is never
+	// dropped, the frames after it make room for the newest ones
+	aus := streamAccessUnits()
+	for _, au := range aus {
+		if err := p.Submit(au); err != nil {
+			t.Fatalf("Submit() returned error: %s", err)
+		}
+	}
+
+	if stats := p.Stats(); stats != (PipelineStats{QueueDepth: 3, Submitted: 5, Dropped: 2}) {
+		t.Errorf("Stats() = %+v, want two dropped", stats)
+	}
+
+	close(gate)
+	p.Close()
+
+	var seqs []uint64
+	for result := range p.Output() {
+		if result.Err != nil {
+			t.Errorf("result %d error = %s", result.Seq, result.Err)
+		}
+		seqs = append(seqs, result.Seq)
+	}
+	if want := []uint64{0, 3, 4}; !slices.Equal(seqs, want) {
+		t.Errorf("pipeline released %v, want %v", seqs, want)
+	}
+
+	if err := p.Submit(aus[0]); err != ErrPipelineClosed {
+		t.Errorf("Submit() after Close() error = %v, want %v", err, ErrPipelineClosed)
+	}
+}
+
+func TestEncryptPipeline_block(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	p, err := NewEncryptPipeline(e, PipelineConfig{QueueSize: 1})
+	if err != nil {
+		t.Fatalf("NewEncryptPipeline() returned error: %s", err)
+	}
+	defer p.Close()
+
+	aus := streamAccessUnits()
+	if err := p.Submit(aus[0]); err != nil {
+		t.Fatalf("Submit() returned error: %s", err)
+	}
+
+	submitted := make(chan error)
+	go func() { submitted <- p.Submit(aus[1]) }()
+
+	select {
+	case err := <-submitted:
+		t.Fatalf("Submit() to a full queue returned %v, want it to block", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if result := <-p.Output(); result.Seq != 0 {
+		t.Errorf("first result seq = %d, want 0", result.Seq)
+	}
+	if err := <-submitted; err != nil {
+		t.Errorf("Submit() returned error: %s", err)
+	}
+	if result := <-p.Output(); result.Seq != 1 || p.Stats().Dropped != 0 {
+		t.Errorf("second result seq = %d with %d dropped, want 1 with none", result.Seq, p.Stats().Dropped)
+	}
+}
+
+func TestNewEncryptPipeline_config(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs"})
+
+	for _, cfg := range []PipelineConfig{
+		{Workers: -1},
+		{QueueSize: -1},
+		{Overflow: "drop-newest"},
+	} {
+		if _, err := NewEncryptPipeline(e, cfg); err == nil {
+			t.Errorf("NewEncryptPipeline(%+v) expected error", cfg)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package drm
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// PlayReady header versions, 4.3 is the first to know AESCBC
+const (
+	WRMHeaderVersionCTR = "4.2.0.0"
+	WRMHeaderVersionCBC = "4.3.0.0"
+)
+
+// PlayReady algorithms of the content keys
+const (
+	PlayReadyAlgAESCTR = "AESCTR"
+	PlayReadyAlgAESCBC = "AESCBC"
+)
+
+const wrmHeaderNamespace = "http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader"
+
+// playReadyRecordWRMHeader is the record type of a PlayReady Object
+// holding a WRMHEADER
+const playReadyRecordWRMHeader = 1
+
+// PlayReadyHeader describes the WRMHEADER of content keys
+type PlayReadyHeader struct {
+	// Scheme of the content, cenc or cbcs; PlayReady takes no other
+	Scheme string
+	KeyIDs [][]byte
+	// Keys are the content keys of the key IDs, optional; with them the
+	// CHECKSUM of AESCTR keys is added for clients to verify the key
+	Keys [][]byte
+	// LAURL is the license acquisition URL, optional
+	LAURL string
+}
+
+// PlayReadyGUID returns a 16 byte key ID in the GUID byte order PlayReady
+// uses, the first three fields of the UUID little-endian
+func PlayReadyGUID(keyID []byte) []byte {
+	guid := make([]byte, 16)
+	copy(guid, keyID)
+	guid[0], guid[1], guid[2], guid[3] = guid[3], guid[2], guid[1], guid[0]
+	guid[4], guid[5] = guid[5], guid[4]
+	guid[6], guid[7] = guid[7], guid[6]
+	return guid
+}
+
+// playReadyAlgorithm returns the ALGID and header version of a scheme
+func playReadyAlgorithm(scheme string) (string, string, error) {
+	switch scheme {
+	case "", "cenc":
+		return PlayReadyAlgAESCTR, WRMHeaderVersionCTR, nil
+	case "cbcs":
+		return PlayReadyAlgAESCBC, WRMHeaderVersionCBC, nil
+	}
+	return "", "", fmt.Errorf("playready requires the cenc or cbcs scheme, got %q", scheme)
+}
+
+// playReadyChecksum returns the CHECKSUM of a key: the first 8 bytes of
+// the GUID of the key ID encrypted with the key by AES-ECB
+func playReadyChecksum(guid, key []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, aes.BlockSize)
+	block.Encrypt(out, guid)
+	return base64.StdEncoding.EncodeToString(out[:8]), nil
+}
+
+// WRMHeader returns the WRMHEADER XML, version 4.2 for cenc and 4.3 for
+// cbcs; AESCBC keys have no CHECKSUM
+func (h PlayReadyHeader) WRMHeader() (string, error) {
+	alg, version, err := playReadyAlgorithm(h.Scheme)
+	if err != nil {
+		return "", err
+	}
+	if len(h.Keys) > 0 && len(h.Keys) != len(h.KeyIDs) {
+		return "", fmt.Errorf("playready header has %d keys for %d key IDs", len(h.Keys), len(h.KeyIDs))
+	}
+
+	var b strings.Builder
+	b.WriteString(`<WRMHEADER xmlns="` + wrmHeaderNamespace + `" version="` + version + `"><DATA>`)
+
+	if len(h.KeyIDs) > 0 {
+		b.WriteString("<PROTECTINFO><KIDS>")
+		for i, kid := range h.KeyIDs {
+			if len(kid) != 16 {
+				return "", fmt.Errorf("key ID must be 16 bytes, got %d", len(kid))
+			}
+			guid := PlayReadyGUID(kid)
+
+			b.WriteString(`<KID ALGID="` + alg + `"`)
+			if len(h.Keys) > 0 && alg == PlayReadyAlgAESCTR {
+				checksum, err := playReadyChecksum(guid, h.Keys[i])
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(` CHECKSUM="` + checksum + `"`)
+			}
+			b.WriteString(` VALUE="` + base64.StdEncoding.EncodeToString(guid) + `"></KID>`)
+		}
+		b.WriteString("</KIDS></PROTECTINFO>")
+	}
+
+	if h.LAURL != "" {
+		b.WriteString("<LA_URL>")
+		// writing to a strings.Builder does not fail
+		_ = xml.EscapeText(&b, []byte(h.LAURL))
+		b.WriteString("</LA_URL>")
+	}
+
+	b.WriteString("</DATA></WRMHEADER>")
+	return b.String(), nil
+}
+
+// PlayReadyObject returns the PlayReady Object holding the WRMHEADER as
+// its only record, everything little-endian and the XML UTF-16
+func (h PlayReadyHeader) PlayReadyObject() ([]byte, error) {
+	header, err := h.WRMHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var record []byte
+	for _, c := range utf16.Encode([]rune(header)) {
+		record = binary.LittleEndian.AppendUint16(record, c)
+	}
+	if len(record) > 0xffff {
+		return nil, fmt.Errorf("playready header of %d bytes does not fit a record", len(record))
+	}
+
+	out := binary.LittleEndian.AppendUint32(nil, uint32(4+2+2+2+len(record)))
+	out = binary.LittleEndian.AppendUint16(out, 1)
+	out = binary.LittleEndian.AppendUint16(out, playReadyRecordWRMHeader)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(record)))
+	return append(out, record...), nil
+}
+
+// PSSH returns the version 0 pssh box of the PlayReady system carrying the
+// PlayReady Object
+func (h PlayReadyHeader) PSSH() ([]byte, error) {
+	pro, err := h.PlayReadyObject()
+	if err != nil {
+		return nil, err
+	}
+	return appendPSSHBox(nil, SystemIDPlayReady, nil, pro), nil
+}
+
+// PlayReadyConfig configures the PlayReady header of the playready pssh
+// system
+type PlayReadyConfig struct {
+	// LAURL is the license acquisition URL PlayReady clients request
+	// licenses from unless the application overrides it, with the key
+	// variables of ExpandLicenseURL
+	LAURL string
+}
+
+// hasPlayReady reports whether the init data carries a PlayReady header
+func hasPlayReady(systems []psshSystem) bool {
+	for _, system := range systems {
+		if system.name == PSSHSystemPlayReady {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlayReady rejects schemes PlayReady cannot signal when its header is
+// part of the init data
+func checkPlayReady(systems []psshSystem, s *cipherState) error {
+	if !hasPlayReady(systems) {
+		return nil
+	}
+	_, _, err := playReadyAlgorithm(s.mode)
+	return err
+}
+
+// psshOptions returns the options of the pssh boxes of a state
+func (e *Encryptor) psshOptions(s *cipherState) PSSHOptions {
+	return PSSHOptions{
+		Scheme:         s.mode,
+		Keys:           [][]byte{s.key},
+		PlayReadyLAURL: ExpandLicenseURL(e.playReady.LAURL, s.keyID, ""),
+	}
+}
@@ -0,0 +1,154 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestPlayReadyGUID(t *testing.T) {
+	kid := mustHex("00112233445566778899aabbccddeeff")
+
+	// the first three UUID fields are little-endian, the rest as is
+	want := mustHex("33221100554477668899aabbccddeeff")
+	if got := PlayReadyGUID(kid); !bytes.Equal(got, want) {
+		t.Errorf("PlayReadyGUID() = %x, want %x", got, want)
+	}
+	if got := base64.StdEncoding.EncodeToString(PlayReadyGUID(kid)); got != "MyIRAFVEd2aImaq7zN3u/w==" {
+		t.Errorf("PlayReadyGUID() base64 = %s, want MyIRAFVEd2aImaq7zN3u/w==", got)
+	}
+	if !bytes.Equal(kid, mustHex("00112233445566778899aabbccddeeff")) {
+		t.Errorf("PlayReadyGUID() modified the key ID")
+	}
+}
+
+func TestPlayReadyHeader_WRMHeader(t *testing.T) {
+	kid := mustHex("00112233445566778899aabbccddeeff")
+	key := mustHex("000102030405060708090a0b0c0d0e0f")
+
+	tests := []struct {
+		name   string
+		header PlayReadyHeader
+		want   string
+	}{
+		{
+			name:   "cenc",
+			header: PlayReadyHeader{Scheme: "cenc", KeyIDs: [][]byte{kid}, Keys: [][]byte{key}, LAURL: "https://license.example.com/pr?a=1&b=2"},
+			want: `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.2.0.0"><DATA>` +
+				`<PROTECTINFO><KIDS><KID ALGID="AESCTR" CHECKSUM="KpOvXRLUXfs=" VALUE="MyIRAFVEd2aImaq7zN3u/w=="></KID></KIDS></PROTECTINFO>` +
+				`<LA_URL>https://license.example.com/pr?a=1&amp;b=2</LA_URL></DATA></WRMHEADER>`,
+		},
+		{
+			name:   "cenc without key",
+			header: PlayReadyHeader{Scheme: "cenc", KeyIDs: [][]byte{kid}},
+			want: `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.2.0.0"><DATA>` +
+				`<PROTECTINFO><KIDS><KID ALGID="AESCTR" VALUE="MyIRAFVEd2aImaq7zN3u/w=="></KID></KIDS></PROTECTINFO></DATA></WRMHEADER>`,
+		},
+		{
+			name:   "cbcs",
+			header: PlayReadyHeader{Scheme: "cbcs", KeyIDs: [][]byte{kid}, Keys: [][]byte{key}},
+			want: `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.3.0.0"><DATA>` +
+				`<PROTECTINFO><KIDS><KID ALGID="AESCBC" VALUE="MyIRAFVEd2aImaq7zN3u/w=="></KID></KIDS></PROTECTINFO></DATA></WRMHEADER>`,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.header.WRMHeader()
+		if err != nil {
+			t.Fatalf("%s: WRMHeader() returned error: %s", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: WRMHeader() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	for _, header := range []PlayReadyHeader{
+		{Scheme: "cens", KeyIDs: [][]byte{kid}},
+		{Scheme: "cenc", KeyIDs: [][]byte{kid[:8]}},
+		{Scheme: "cenc", KeyIDs: [][]byte{kid}, Keys: [][]byte{key, key}},
+	} {
+		if _, err := header.WRMHeader(); err == nil {
+			t.Errorf("WRMHeader() of %+v returned no error", header)
+		}
+	}
+}
+
+func TestPlayReadyHeader_PSSH(t *testing.T) {
+	header := PlayReadyHeader{Scheme: "cbcs", KeyIDs: [][]byte{mustHex(testKeyID)}, LAURL: "https://license.example.com/pr"}
+	xml, err := header.WRMHeader()
+	if err != nil {
+		t.Fatalf("WRMHeader() returned error: %s", err)
+	}
+
+	pssh, err := header.PSSH()
+	if err != nil {
+		t.Fatalf("PSSH() returned error: %s", err)
+	}
+	if string(pssh[4:8]) != "pssh" || pssh[8] != 0 || !bytes.Equal(pssh[12:28], SystemIDPlayReady[:]) {
+		t.Fatalf("PSSH() = %x, want a version 0 PlayReady pssh box", pssh[:28])
+	}
+	if size := binary.BigEndian.Uint32(pssh); int(size) != len(pssh) {
+		t.Errorf("PSSH() size = %d, want %d", size, len(pssh))
+	}
+
+	// PlayReady Object: length, record count, then type, length and the
+	// UTF-16LE header of the record
+	pro := pssh[32:]
+	if int(binary.BigEndian.Uint32(pssh[28:])) != len(pro) || int(binary.LittleEndian.Uint32(pro)) != len(pro) {
+		t.Fatalf("PlayReady Object of %d bytes has the wrong length", len(pro))
+	}
+	if count, typ := binary.LittleEndian.Uint16(pro[4:]), binary.LittleEndian.Uint16(pro[6:]); count != 1 || typ != 1 {
+		t.Errorf("PlayReady Object has %d records of type %d, want 1 of type 1", count, typ)
+	}
+	record := pro[10:]
+	if int(binary.LittleEndian.Uint16(pro[8:])) != len(record) {
+		t.Fatalf("record length = %d, want %d", binary.LittleEndian.Uint16(pro[8:]), len(record))
+	}
+	units := make([]uint16, len(record)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(record[2*i:])
+	}
+	if got := string(utf16.Decode(units)); got != xml {
+		t.Errorf("record = %s, want %s", got, xml)
+	}
+}
+
+func TestEncryptor_playReady(t *testing.T) {
+	laURL := "https://license.example.com/pr?kid={keyId}"
+	e := newTestEncryptor(t, Config{
+		Mode:        "cbcs",
+		CryptBlocks: 1,
+		SkipBlocks:  9,
+		PSSHSystems: []string{PSSHSystemCommon, PSSHSystemPlayReady},
+		PlayReady:   PlayReadyConfig{LAURL: laURL},
+	})
+
+	initData, err := e.InitData()
+	if err != nil {
+		t.Fatalf("InitData() returned error: %s", err)
+	}
+	common, _ := BuildPSSH([]string{PSSHSystemCommon}, [][]byte{mustHex(testKeyID)})
+	playReady, _ := PlayReadyHeader{Scheme: "cbcs", KeyIDs: [][]byte{mustHex(testKeyID)}, LAURL: "https://license.example.com/pr?kid=" + testKeyID}.PSSH()
+	if want := append(common, playReady...); !bytes.Equal(initData, want) {
+		t.Errorf("InitData() = %x, want %x", initData, want)
+	}
+
+	descriptors, err := e.ManifestDescriptors()
+	if err != nil {
+		t.Fatalf("ManifestDescriptors() returned error: %s", err)
+	}
+	if got := descriptors[2]; got.SchemeIDURI != "urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95" || got.Value != "MSPR 2.0" || got.PSSH != base64.StdEncoding.EncodeToString(playReady) {
+		t.Errorf("ManifestDescriptors() playready = %+v", got)
+	}
+
+	// PlayReady has no cens
+	if err := e.ApplyProfile(Profile{Mode: "cens", CryptBlocks: 1, SkipBlocks: 9, KeyID: testKeyID, Key: testKey, IV: testIV}); err == nil || !strings.Contains(err.Error(), "playready") {
+		t.Errorf("ApplyProfile() of cens error = %v, want playready to reject it", err)
+	}
+	if _, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cbc1", PSSHSystems: []string{PSSHSystemPlayReady}}); err == nil {
+		t.Errorf("NewEncryptor() accepted cbc1 with playready")
+	}
+}
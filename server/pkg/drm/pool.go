@@ -0,0 +1,57 @@
+package drm
+
+import "sync"
+
+// size classes of BufferPool, powers of two from 4 KiB to 1 MiB
+const (
+	minPooledBuffer = 4 << 10
+	maxPooledBuffer = 1 << 20
+	pooledClasses   = 9
+)
+
+// BufferPool reuses the destination buffers of EncryptTo across access
+// units. Buffers are kept by size class so that delta frames do not hold
+// on to keyframe sized buffers, and only up to 1 MiB: larger access units
+// get a buffer of their own that is collected once released. Like any
+// sync.Pool it drops idle buffers on garbage collection, so a burst of
+// large keyframes does not stay pinned. The zero value is ready to use.
+//
+// A buffer belongs to the caller from Get until Put, slices of it must not
+// be used after Put.
+type BufferPool struct {
+	classes [pooledClasses]sync.Pool
+}
+
+// Get returns an empty buffer with room for at least size bytes
+func (p *BufferPool) Get(size int) []byte {
+	if size > maxPooledBuffer {
+		return make([]byte, 0, size)
+	}
+
+	class := 0
+	for minPooledBuffer<<class < size {
+		class++
+	}
+
+	if buf, ok := p.classes[class].Get().(*[]byte); ok {
+		return (*buf)[:0]
+	}
+	return make([]byte, 0, minPooledBuffer<<class)
+}
+
+// Put releases a buffer of Get, or one grown from it, for reuse
+func (p *BufferPool) Put(buf []byte) {
+	size := cap(buf)
+	if size < minPooledBuffer || size > maxPooledBuffer {
+		return
+	}
+
+	// the largest class the buffer satisfies
+	class := 0
+	for class+1 < pooledClasses && minPooledBuffer<<(class+1) <= size {
+		class++
+	}
+
+	buf = buf[:0]
+	p.classes[class].Put(&buf)
+}
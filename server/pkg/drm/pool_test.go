@@ -0,0 +1,122 @@
+package drm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	var p BufferPool
+
+	tests := []struct {
+		size    int
+		wantCap int
+	}{
+		{0, minPooledBuffer},
+		{100, minPooledBuffer},
+		{minPooledBuffer + 1, 2 * minPooledBuffer},
+		{200 << 10, 256 << 10},
+		{maxPooledBuffer, maxPooledBuffer},
+		{2 << 20, 2 << 20},
+	}
+
+	for _, tt := range tests {
+		buf := p.Get(tt.size)
+		if len(buf) != 0 || cap(buf) < tt.wantCap {
+			t.Errorf("Get(%d) = len %d cap %d, want empty with cap %d", tt.size, len(buf), cap(buf), tt.wantCap)
+		}
+		p.Put(buf)
+	}
+
+	// a keyframe above the largest class is never handed out again
+	p.Put(make([]byte, 3<<20))
+	for i := 0; i < 10; i++ {
+		if buf := p.Get(10); cap(buf) > maxPooledBuffer {
+			t.Fatalf("Get(10) = cap %d, want an oversized buffer never pooled", cap(buf))
+		}
+	}
+
+	// buffers grown past their class satisfy the class below
+	p.Put(make([]byte, 0, 3*minPooledBuffer))
+	if buf := p.Get(2 * minPooledBuffer); cap(buf) < 2*minPooledBuffer {
+		t.Errorf("Get() = cap %d, want at least %d", cap(buf), 2*minPooledBuffer)
+	}
+}
+
+func TestEncryptor_EncryptTo(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}},
+		{"cenc", Config{Mode: "cenc"}},
+		{"avcc", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, NALFormat: NALFormatAVCC}},
+		{"audio", Config{Mode: "cenc", Codec: CodecAudio}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, tt.cfg)
+			reference := newTestEncryptor(t, tt.cfg)
+
+			var pool BufferPool
+			var previous []byte
+			var previousData []byte
+
+			for i, frame := range h264Stream() {
+				switch {
+				case tt.cfg.NALFormat == NALFormatAVCC:
+					frame = lengthPrefixed(frame, 4)
+				case tt.cfg.Codec == CodecAudio:
+					frame = opusFrame(len(frame))
+				}
+
+				want, err := reference.Encrypt(frame)
+				if err != nil {
+					t.Fatalf("frame %d: Encrypt() returned error: %s", i, err)
+				}
+
+				dst := pool.Get(outputSize(len(frame)))
+				got, err := e.EncryptTo(dst, frame)
+				if err != nil {
+					t.Fatalf("frame %d: EncryptTo() returned error: %s", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("frame %d: EncryptTo() = %x, want %x", i, got, want)
+				}
+				if cap(dst) > 0 && &got[:1][0] != &dst[:1][0] {
+					t.Errorf("frame %d: EncryptTo() did not reuse a large enough dst", i)
+				}
+
+				// the previous output is owned by the caller until released
+				if previous != nil {
+					if !bytes.Equal(previous, previousData) {
+						t.Errorf("frame %d: previous output changed before it was released", i)
+					}
+					pool.Put(previous)
+				}
+				previous, previousData = got, bytes.Clone(got)
+			}
+		})
+	}
+}
+
+func TestEncryptor_EncryptToGrows(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	frame := h264Stream()[0]
+	dst := make([]byte, 5, 8)
+	got, err := e.EncryptTo(dst, frame)
+	if err != nil {
+		t.Fatalf("EncryptTo() returned error: %s", err)
+	}
+	if len(got) < len(frame) || &got[0] == &dst[0] {
+		t.Errorf("EncryptTo() = %d bytes in dst, want a larger buffer", len(got))
+	}
+
+	disabled, _ := NewEncryptor(Config{})
+	got, _ = disabled.EncryptTo(dst, frame[:8])
+	if !bytes.Equal(got, frame[:8]) || &got[0] != &dst[0] {
+		t.Errorf("EncryptTo() disabled = %x, want the plaintext copied into dst", got)
+	}
+}
@@ -0,0 +1,367 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// IV modes
+const (
+	IVModeConstant = "constant" // the configured IV is used for every sample
+	IVModeCounter  = "counter"  // per-sample IV, the configured IV mixed with the IV nonce plus the sample number, its first 8 bytes with cenc and cens
+	IVModeDerived  = "derived"  // per-sample IV, see DeriveSampleIV
+
+	// IVModeSequence is accepted for IVModeCounter
+	IVModeSequence = "sequence"
+)
+
+// defaultIVMode returns the IV mode of a scheme, only cbcs has a constant
+// IV and the keystream of cenc and cens must never be reused
+func defaultIVMode(mode string) string {
+	if mode == "cbcs" {
+		return IVModeConstant
+	}
+	return IVModeCounter
+}
+
+var (
+	ErrProfileDisabled   = errors.New("encryptor is disabled")
+	ErrProfilePending    = errors.New("another profile change is pending")
+	ErrInvalidProfile    = errors.New("invalid profile")
+	ErrProfileRolledBack = errors.New("profile rolled back")
+	ErrActivationPast    = errors.New("activation time has already passed")
+)
+
+// Profile bundles every parameter a client needs to decrypt the stream,
+// the parameters only ever change together
+type Profile struct {
+	Mode        string // "cbcs", "cenc", "cens" or "cbc1"
+	CryptBlocks int    // for the cbcs and cens pattern
+	SkipBlocks  int    // for the cbcs and cens pattern
+	KeyID       string // hex encoded 16 bytes
+	Key         string // hex encoded 16 bytes, never returned by getters
+	IV          string // hex encoded 16 bytes, or 8 with cenc and cens
+	IVMode      string // "constant" for cbcs, "counter" (default) or "derived" for the others
+	Generation  uint64 // key generation, 0 when unknown
+}
+
+// newCipherState validates the complete profile and builds its cipher
+func newCipherState(p Profile) (*cipherState, error) {
+	var errs []error
+
+	if !ValidScheme(p.Mode) {
+		errs = append(errs, fmt.Errorf("mode must be cbcs, cenc, cens or cbc1, got %q", p.Mode))
+	}
+
+	if PatternScheme(p.Mode) && (p.CryptBlocks <= 0 || p.SkipBlocks < 0) {
+		errs = append(errs, fmt.Errorf("%s pattern must have positive crypt and non-negative skip blocks, got %d:%d", p.Mode, p.CryptBlocks, p.SkipBlocks))
+	}
+
+	ivMode, err := CheckIVMode(p.Mode, p.IVMode)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	keyID, err := hex.DecodeString(p.KeyID)
+	if err != nil || len(keyID) != 16 {
+		errs = append(errs, errors.New("keyID must be 16 bytes hex encoded"))
+	}
+
+	key, err := hex.DecodeString(p.Key)
+	if err != nil || len(key) != 16 {
+		errs = append(errs, errors.New("key must be 16 bytes hex encoded"))
+	}
+
+	iv, _ := hex.DecodeString(p.IV)
+	if err := checkIV(p.Mode, iv); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProfile, errors.Join(errs...))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ivCipher, err := newIVCipher(ivMode, key)
+	if err != nil {
+		return nil, err
+	}
+	ivNonce, err := newIVNonce(ivMode, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &cipherState{
+		keyID:      keyID,
+		key:        key,
+		iv:         iv,
+		ivMode:     ivMode,
+		ivCipher:   ivCipher,
+		ivNonce:    ivNonce,
+		block:      block,
+		mode:       p.Mode,
+		generation: p.Generation,
+		samples:    new(atomic.Uint64),
+		built:      &builtBoxes{},
+	}
+
+	if PatternScheme(p.Mode) {
+		s.cryptBlocks = p.CryptBlocks
+		s.skipBlocks = p.SkipBlocks
+	}
+
+	s.canary = s.checksum()
+	return s, nil
+}
+
+// profile describes the state without its key
+func (s *cipherState) profile() Profile {
+	p := Profile{
+		Mode:       s.mode,
+		KeyID:      hex.EncodeToString(s.keyID),
+		IV:         hex.EncodeToString(s.iv),
+		IVMode:     s.ivMode,
+		Generation: s.generation,
+	}
+
+	if PatternScheme(s.mode) {
+		p.CryptBlocks = s.cryptBlocks
+		p.SkipBlocks = s.skipBlocks
+	}
+
+	return p
+}
+
+// Profile returns the profile frames are currently encrypted with, the key
+// is never included
+func (e *Encryptor) Profile() Profile {
+	s := e.state.Load()
+	if s == nil {
+		return Profile{}
+	}
+	return s.profile()
+}
+
+// PendingProfile returns the staged profile waiting for the next IDR frame
+func (e *Encryptor) PendingProfile() (Profile, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pending == nil {
+		return Profile{}, false
+	}
+	return e.pending.profile(), true
+}
+
+// PendingKey returns the key ID and key of the staged profile, for
+// delivering it to authorized clients before the switch
+func (e *Encryptor) PendingKey() (keyID, key []byte, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pending == nil {
+		return nil, nil, false
+	}
+	return bytes.Clone(e.pending.keyID), bytes.Clone(e.pending.key), true
+}
+
+// PendingActivation returns when the staged profile becomes due, zero
+// time means at the next IDR frame
+func (e *Encryptor) PendingActivation() (time.Time, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pending == nil {
+		return time.Time{}, false
+	}
+	return e.pendingAt, true
+}
+
+// ApplyProfile validates the complete target profile and stages it, the
+// switch happens at the next IDR frame. Prepare steps run after validation
+// and before staging; if any of them fails the new profile is discarded
+// and the current one stays untouched.
+func (e *Encryptor) ApplyProfile(p Profile, prepare ...func(Profile) error) error {
+	return e.ApplyProfileAt(p, time.Time{}, prepare...)
+}
+
+// ApplyProfileAt stages the profile like ApplyProfile, the switch happens
+// at the first IDR frame at or after activateAt so that instances fed the
+// same schedule switch together. An activation time in the past is due
+// immediately when within the activation skew and rejected otherwise, the
+// schedule has to be reissued then.
+func (e *Encryptor) ApplyProfileAt(p Profile, activateAt time.Time, prepare ...func(Profile) error) error {
+	if !e.enabled.Load() {
+		return ErrProfileDisabled
+	}
+
+	if !activateAt.IsZero() {
+		if late := e.now().Sub(activateAt); late > e.activationSkew {
+			return fmt.Errorf("%w: %s ago", ErrActivationPast, late.Round(time.Millisecond))
+		}
+	}
+
+	s, err := newCipherState(p)
+	if err != nil {
+		return err
+	}
+	if e.strictPattern && PatternScheme(s.mode) {
+		if err := checkStrictPattern(s.cryptBlocks, s.skipBlocks); err != nil {
+			return err
+		}
+	}
+	if err := checkPlayReady(e.psshSystems, s); err != nil {
+		return err
+	}
+	if e.fairPlay.Enabled() {
+		if err := checkFairPlay(s, e.codec.isAudio()); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	pending := e.pending != nil
+	e.mu.Unlock()
+
+	if pending {
+		return ErrProfilePending
+	}
+
+	for _, step := range prepare {
+		if err := step(s.profile()); err != nil {
+			return fmt.Errorf("%w: %w", ErrProfileRolledBack, err)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// closed or someone else staged a profile while preparing
+	if !e.enabled.Load() {
+		return ErrProfileDisabled
+	}
+	if e.pending != nil {
+		return ErrProfilePending
+	}
+
+	e.stage(s, activateAt)
+	e.stageLayers(s, activateAt)
+	return nil
+}
+
+// CancelProfile discards a staged profile that has not been switched to yet
+func (e *Encryptor) CancelProfile() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	canceled := e.pending != nil
+	e.stage(nil, time.Time{})
+	if canceled {
+		e.stageLayers(nil, time.Time{})
+	}
+	return canceled
+}
+
+// UpdateKey switches to new key material with the next access unit, unlike
+// ApplyProfile without waiting for an IDR frame; scheme and pattern stay.
+// It returns the previous key ID for signaling clients. An access unit is
+// always encrypted with either the old or the new key and IV, never with
+// a mix of both.
+func (e *Encryptor) UpdateKey(keyID, key, iv []byte) ([]byte, error) {
+	if !e.enabled.Load() {
+		return nil, ErrProfileDisabled
+	}
+
+	var errs []error
+	if len(keyID) != 16 {
+		errs = append(errs, fmt.Errorf("keyID must be 16 bytes, got %d", len(keyID)))
+	}
+	if len(key) != 16 {
+		errs = append(errs, fmt.Errorf("key must be 16 bytes, got %d", len(key)))
+	}
+	// the scheme decides whether 8 bytes are enough
+	if len(iv) != 8 && len(iv) != 16 {
+		errs = append(errs, fmt.Errorf("iv must be 8 or 16 bytes, got %d", len(iv)))
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProfile, errors.Join(errs...))
+	}
+
+	e.mu.Lock()
+
+	if !e.enabled.Load() {
+		e.mu.Unlock()
+		return nil, ErrProfileDisabled
+	}
+
+	// the staged profile would undo the new key at the next IDR frame
+	if e.pending != nil {
+		e.mu.Unlock()
+		return nil, ErrProfilePending
+	}
+
+	// the generation of the new key is unknown
+	p := e.state.Load().profile()
+	p.KeyID = hex.EncodeToString(keyID)
+	p.Key = hex.EncodeToString(key)
+	p.IV = hex.EncodeToString(iv)
+	p.Generation = 0
+
+	s, err := newCipherState(p)
+	if err != nil {
+		e.mu.Unlock()
+		return nil, err
+	}
+
+	old := e.state.Load()
+	prev := bytes.Clone(old.keyID)
+	update := e.switchTo(s)
+	rotation := e.rotationFrom(old, update)
+	e.switchLayers(s)
+	onUpdate, onRotate := e.onUpdate, e.onRotate
+	e.mu.Unlock()
+
+	if update != nil && onUpdate != nil {
+		onUpdate(*update)
+	}
+	if rotation != nil && onRotate != nil {
+		onRotate(*rotation)
+	}
+	return prev, nil
+}
+
+// UpdateKeyHex is UpdateKey with hex encoded key material as in Config, it
+// returns the hex encoded previous key ID
+func (e *Encryptor) UpdateKeyHex(keyID, key, iv string) (string, error) {
+	var errs []error
+
+	rawKeyID, err := hex.DecodeString(keyID)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("keyID: %w", err))
+	}
+	rawKey, err := hex.DecodeString(key)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("key: %w", err))
+	}
+	rawIV, err := hex.DecodeString(iv)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("iv: %w", err))
+	}
+	if len(errs) > 0 {
+		return "", fmt.Errorf("%w: %w", ErrInvalidProfile, errors.Join(errs...))
+	}
+
+	prev, err := e.UpdateKey(rawKeyID, rawKey, rawIV)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(prev), nil
+}
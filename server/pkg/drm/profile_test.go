@@ -0,0 +1,357 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testProfile = Profile{
+	Mode:   "cenc",
+	KeyID:  "000102030405060708090a0b0c0d0e0f",
+	Key:    "101112131415161718191a1b1c1d1e1f",
+	IV:     "202122232425262728292a2b2c2d2e2f",
+	IVMode: IVModeCounter,
+}
+
+func TestEncryptor_ApplyProfile(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	old := e.Profile()
+
+	var applied []Profile
+	e.OnUpdate(func(u Update) {
+		applied = append(applied, u.Profile)
+	})
+
+	if err := e.ApplyProfile(testProfile); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+
+	pending, ok := e.PendingProfile()
+	if !ok || pending.KeyID != testProfile.KeyID {
+		t.Fatalf("PendingProfile() = %v, %v, want staged profile", pending, ok)
+	}
+
+	// non IDR frames keep the old profile
+	pFrame := nalUnit(0x41, 64)
+	if _, err := e.Encrypt(pFrame); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if p := e.Profile(); p != old || len(applied) != 0 {
+		t.Fatalf("profile switched before IDR frame")
+	}
+
+	// the switch happens at the IDR frame as a whole
+	idrFrame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+	got, err := e.Encrypt(idrFrame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	want, err := newTestProfileEncryptor(t, testProfile, e.IVNonce()).Encrypt(idrFrame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("IDR frame is not encrypted with the new profile")
+	}
+
+	if len(applied) != 1 {
+		t.Fatalf("OnUpdate() called %d times, want 1", len(applied))
+	}
+
+	wantProfile := testProfile
+	wantProfile.Key = ""
+	if applied[0] != wantProfile {
+		t.Errorf("OnUpdate() profile = %+v, want %+v", applied[0], wantProfile)
+	}
+	if e.Profile() != wantProfile {
+		t.Errorf("Profile() = %+v, want %+v", e.Profile(), wantProfile)
+	}
+	if _, ok := e.PendingProfile(); ok {
+		t.Errorf("PendingProfile() still set after switch")
+	}
+
+	// later IDR frames do not emit another update
+	if _, err := e.Encrypt(idrFrame); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if len(applied) != 1 {
+		t.Errorf("OnUpdate() called %d times, want 1", len(applied))
+	}
+}
+
+func TestEncryptor_ApplyProfileValidation(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs"})
+	old := e.Profile()
+
+	err := e.ApplyProfile(Profile{
+		Mode:   "cbc1",
+		KeyID:  "0011",
+		Key:    "zz",
+		IV:     testIV,
+		IVMode: "random",
+	})
+	if !errors.Is(err, ErrInvalidProfile) {
+		t.Fatalf("ApplyProfile() error = %v, want ErrInvalidProfile", err)
+	}
+
+	// the complete target state is validated at once
+	for _, want := range []string{"mode", "iv mode", "keyID", "key must"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ApplyProfile() error %q does not mention %q", err, want)
+		}
+	}
+
+	if _, ok := e.PendingProfile(); ok {
+		t.Errorf("invalid profile was staged")
+	}
+	if e.Profile() != old {
+		t.Errorf("invalid profile changed current profile")
+	}
+}
+
+func TestEncryptor_ApplyProfileRollback(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs"})
+
+	frame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+	before, err := e.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	var called []string
+	err = e.ApplyProfile(testProfile,
+		func(p Profile) error {
+			called = append(called, "first")
+			return nil
+		},
+		func(p Profile) error {
+			called = append(called, "second")
+			return errors.New("signaling unavailable")
+		},
+		func(p Profile) error {
+			called = append(called, "third")
+			return nil
+		},
+	)
+	if !errors.Is(err, ErrProfileRolledBack) {
+		t.Fatalf("ApplyProfile() error = %v, want ErrProfileRolledBack", err)
+	}
+	if len(called) != 2 {
+		t.Errorf("prepare steps called = %v, want first two only", called)
+	}
+
+	if _, ok := e.PendingProfile(); ok {
+		t.Errorf("rolled back profile was staged")
+	}
+
+	after, err := e.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("rolled back profile changed encryption")
+	}
+
+	// a clean apply is still possible afterwards
+	if err := e.ApplyProfile(testProfile); err != nil {
+		t.Errorf("ApplyProfile() after rollback returned error: %s", err)
+	}
+}
+
+func TestEncryptor_ApplyProfilePending(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs"})
+
+	if err := e.ApplyProfile(testProfile); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+	if err := e.ApplyProfile(testProfile); !errors.Is(err, ErrProfilePending) {
+		t.Errorf("ApplyProfile() error = %v, want ErrProfilePending", err)
+	}
+
+	if !e.CancelProfile() {
+		t.Errorf("CancelProfile() = false, want true")
+	}
+	if err := e.ApplyProfile(testProfile); err != nil {
+		t.Errorf("ApplyProfile() after cancel returned error: %s", err)
+	}
+}
+
+// newTestProfileEncryptor returns an encryptor of the profile, its per-sample
+// IVs those of an encryptor switched to it with the IV nonce when given
+func newTestProfileEncryptor(t *testing.T, p Profile, ivNonce []byte) *Encryptor {
+	t.Helper()
+
+	nonce := testIVNonce
+	if ivNonce != nil {
+		nonce = hex.EncodeToString(ivNonce)
+	}
+
+	e, err := NewEncryptor(Config{
+		Enabled:     true,
+		KeyID:       p.KeyID,
+		Key:         p.Key,
+		IV:          p.IV,
+		IVNonce:     nonce,
+		Mode:        p.Mode,
+		CryptBlocks: p.CryptBlocks,
+		SkipBlocks:  p.SkipBlocks,
+		Paranoid:    true,
+	})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	return e
+}
+
+func TestEncryptor_UpdateKey(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	var updates []Update
+	e.OnUpdate(func(u Update) {
+		updates = append(updates, u)
+	})
+
+	stream := h264Stream()
+	if _, err := e.Encrypt(stream[0]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	prev, err := e.UpdateKeyHex(testProfile.KeyID, testProfile.Key, testProfile.IV)
+	if err != nil {
+		t.Fatalf("UpdateKeyHex() returned error: %s", err)
+	}
+	if prev != testKeyID {
+		t.Errorf("UpdateKeyHex() = %s, want %s", prev, testKeyID)
+	}
+
+	// no IDR frame is needed for the switch
+	if got := e.Profile().KeyID; got != testProfile.KeyID {
+		t.Errorf("Profile().KeyID = %s, want %s", got, testProfile.KeyID)
+	}
+	if len(updates) != 1 || strings.Join(updates[0].Changes, ",") != ChangeKeys+","+ChangeIV {
+		t.Fatalf("OnUpdate() updates = %+v, want one changing keys and iv", updates)
+	}
+
+	d, err := NewDecryptor(Config{
+		Enabled:     true,
+		KeyID:       testProfile.KeyID,
+		Key:         testProfile.Key,
+		IV:          testProfile.IV,
+		Mode:        "cbcs",
+		CryptBlocks: 1,
+		SkipBlocks:  9,
+	})
+	if err != nil {
+		t.Fatalf("NewDecryptor() returned error: %s", err)
+	}
+
+	// the P frame is encrypted with the new key, parameter sets first
+	d.Decrypt(stream[0])
+	out, err := e.Encrypt(stream[1])
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if got, err := d.Decrypt(out); err != nil || !bytes.Equal(got, stream[1]) {
+		t.Errorf("Decrypt() with the new key = %v, does not match source", err)
+	}
+}
+
+func TestEncryptor_UpdateKeyValidation(t *testing.T) {
+	key := mustHex(testKey)
+
+	tests := []struct {
+		name    string
+		keyID   []byte
+		key     []byte
+		iv      []byte
+		pending bool
+		want    error
+	}{
+		{"short key ID", key[:8], key, key, false, ErrInvalidProfile},
+		{"long key", key, append(key, 1), key, false, ErrInvalidProfile},
+		{"missing iv", key, key, nil, false, ErrInvalidProfile},
+		{"pending profile", key, key, key, true, ErrProfilePending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{Mode: "cbcs"})
+			if tt.pending {
+				if err := e.ApplyProfile(testProfile); err != nil {
+					t.Fatalf("ApplyProfile() returned error: %s", err)
+				}
+			}
+
+			if _, err := e.UpdateKey(tt.keyID, tt.key, tt.iv); !errors.Is(err, tt.want) {
+				t.Errorf("UpdateKey() error = %v, want %v", err, tt.want)
+			}
+			if got := e.Profile().KeyID; got != testKeyID {
+				t.Errorf("Profile().KeyID = %s, want it unchanged", got)
+			}
+		})
+	}
+
+	e := newTestEncryptor(t, Config{})
+	if _, err := e.UpdateKeyHex("zz", testKey, testIV); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("UpdateKeyHex() error = %v, want %v", err, ErrInvalidProfile)
+	}
+
+	disabled, _ := NewEncryptor(Config{})
+	if _, err := disabled.UpdateKey(key, key, key); !errors.Is(err, ErrProfileDisabled) {
+		t.Errorf("UpdateKey() error = %v, want %v", err, ErrProfileDisabled)
+	}
+}
+
+func TestEncryptor_UpdateKeyConcurrent(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	frame := h264Stream()[0]
+
+	keys := []Profile{
+		{KeyID: testKeyID, Key: testKey, IV: testIV},
+		{KeyID: testProfile.KeyID, Key: testProfile.Key, IV: testProfile.IV},
+	}
+
+	var decryptors []*Decryptor
+	for _, k := range keys {
+		d, err := NewDecryptor(Config{Enabled: true, KeyID: k.KeyID, Key: k.Key, IV: k.IV, Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+		if err != nil {
+			t.Fatalf("NewDecryptor() returned error: %s", err)
+		}
+		decryptors = append(decryptors, d)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			k := keys[i%2]
+			if _, err := e.UpdateKeyHex(k.KeyID, k.Key, k.IV); err != nil {
+				t.Errorf("UpdateKeyHex() returned error: %s", err)
+				return
+			}
+		}
+	}()
+
+	// every access unit decrypts with exactly one of the keys
+	for i := 0; i < 200; i++ {
+		out, err := e.Encrypt(frame)
+		if err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+
+		var matches int
+		for _, d := range decryptors {
+			if got, err := d.Decrypt(out); err == nil && bytes.Equal(got, frame) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			t.Fatalf("access unit %d decrypts with %d keys, want 1", i, matches)
+		}
+	}
+	<-done
+}
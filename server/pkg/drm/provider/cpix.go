@@ -0,0 +1,137 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/drm/cpix"
+)
+
+// CPIXProvider reads the content keys of a CPIX document from a file or an
+// HTTP URL on every request. Video keys become generations in document
+// order, IVs the document does not set are chosen once per key ID.
+type CPIXProvider struct {
+	source string
+	client *http.Client
+	ivs    ivMemo
+}
+
+// NewCPIXProvider creates a provider for a document at an http(s) URL or a
+// file path
+func NewCPIXProvider(source string) *CPIXProvider {
+	return &CPIXProvider{
+		source: source,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *CPIXProvider) document(ctx context.Context) (*cpix.Document, error) {
+	if !strings.HasPrefix(p.source, "http://") && !strings.HasPrefix(p.source, "https://") {
+		data, err := os.ReadFile(p.source)
+		if err != nil {
+			return nil, err
+		}
+		return cpix.Parse(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cpix document request returned %s", res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	return cpix.Parse(data)
+}
+
+// GetKeys returns the video keys of the document with generations starting
+// at 1
+func (p *CPIXProvider) GetKeys(ctx context.Context) ([]drm.Key, error) {
+	doc, err := p.document(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []drm.Key
+	for i, ck := range doc.TrackKeys(drm.TrackVideo) {
+		iv, err := p.ivs.iv(ck.KeyID, ck.IV)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, drm.Key{
+			Generation: uint64(i + 1),
+			KeyID:      ck.KeyID,
+			Key:        ck.Key,
+			IV:         iv,
+		})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no video key", p.source)
+	}
+	return keys, nil
+}
+
+// GetTrackKeys returns the last key of the document for every other track
+func (p *CPIXProvider) GetTrackKeys(ctx context.Context) (map[string]drm.TrackKey, error) {
+	doc, err := p.document(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := map[string]drm.TrackKey{}
+	for _, track := range []string{drm.TrackAudio} {
+		keys := doc.TrackKeys(track)
+		if len(keys) == 0 {
+			continue
+		}
+
+		ck := keys[len(keys)-1]
+		iv, err := p.ivs.iv(ck.KeyID, ck.IV)
+		if err != nil {
+			return nil, err
+		}
+		tracks[track] = drm.TrackKey{KeyID: ck.KeyID, Key: ck.Key, IV: iv}
+	}
+	return tracks, nil
+}
+
+// GetPSSH returns the pssh boxes of the DRM system list
+func (p *CPIXProvider) GetPSSH(ctx context.Context) ([]drm.SystemPSSH, error) {
+	doc, err := p.document(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var boxes []drm.SystemPSSH
+	for _, system := range doc.DRMSystems {
+		if system.PSSH == nil {
+			continue
+		}
+		boxes = append(boxes, drm.SystemPSSH{
+			KeyID:    system.KeyID,
+			SystemID: system.SystemID,
+			Box:      system.PSSH,
+		})
+	}
+	return boxes, nil
+}
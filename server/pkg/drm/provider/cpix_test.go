@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+const testCPIX = `<cpix:CPIX contentId="desktop" xmlns:cpix="urn:dashif:org:cpix" xmlns:pskc="urn:ietf:params:xml:ns:keyprov:pskc">
+	<cpix:ContentKeyList>
+		<cpix:ContentKey kid="00000000-0000-0000-0000-000000000001" explicitIV="1fvWuC7ZPk75iuQJMe4ztw==">
+			<cpix:Data><pskc:Secret><pskc:PlainValue>PDw8PDw8PDw8PDw8PDw8PA==</pskc:PlainValue></pskc:Secret></cpix:Data>
+		</cpix:ContentKey>
+		<cpix:ContentKey kid="00000000-0000-0000-0000-000000000002">
+			<cpix:Data><pskc:Secret><pskc:PlainValue>TU1NTU1NTU1NTU1NTU1NTQ==</pskc:PlainValue></pskc:Secret></cpix:Data>
+		</cpix:ContentKey>
+	</cpix:ContentKeyList>
+	<cpix:DRMSystemList>
+		<cpix:DRMSystem kid="00000000-0000-0000-0000-000000000001" systemId="edef8ba9-79d6-4ace-a3c8-27dcd51d21ed">
+			<cpix:PSSH>AAAAGHBzc2gAAAAA7e+LqXnWSs6jyCfc1R0h7QAAAAA=</cpix:PSSH>
+		</cpix:DRMSystem>
+		<cpix:DRMSystem kid="00000000-0000-0000-0000-000000000002" systemId="9a04f079-9840-4286-ab92-e65be0885f95"/>
+	</cpix:DRMSystemList>
+	<cpix:ContentKeyUsageRuleList>
+		<cpix:ContentKeyUsageRule kid="00000000-0000-0000-0000-000000000001" intendedTrackType="VIDEO"/>
+		<cpix:ContentKeyUsageRule kid="00000000-0000-0000-0000-000000000002" intendedTrackType="AUDIO"/>
+	</cpix:ContentKeyUsageRuleList>
+</cpix:CPIX>`
+
+func TestCPIXProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.cpix.xml")
+	if err := os.WriteFile(path, []byte(testCPIX), 0o600); err != nil {
+		t.Fatalf("unable to write document: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testCPIX))
+	}))
+	defer server.Close()
+
+	for name, source := range map[string]string{"file": path, "url": server.URL} {
+		t.Run(name, func(t *testing.T) {
+			p := NewCPIXProvider(source)
+
+			keys, err := p.GetKeys(context.Background())
+			if err != nil {
+				t.Fatalf("GetKeys() returned error: %s", err)
+			}
+			want := drm.Key{
+				Generation: 1,
+				KeyID:      "00000000000000000000000000000001",
+				Key:        "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c",
+				IV:         "d5fbd6b82ed93e4ef98ae40931ee33b7",
+			}
+			if len(keys) != 1 || keys[0] != want {
+				t.Errorf("GetKeys() = %+v, want %+v", keys, want)
+			}
+
+			tracks, err := p.GetTrackKeys(context.Background())
+			if err != nil {
+				t.Fatalf("GetTrackKeys() returned error: %s", err)
+			}
+			audio, ok := tracks[drm.TrackAudio]
+			if !ok || len(tracks) != 1 || audio.KeyID != "00000000000000000000000000000002" || len(audio.IV) != 32 {
+				t.Errorf("GetTrackKeys() = %+v, want the audio key with an IV", tracks)
+			}
+
+			// the chosen IV stays for the key
+			again, _ := p.GetTrackKeys(context.Background())
+			if again[drm.TrackAudio].IV != audio.IV {
+				t.Errorf("GetTrackKeys() IV = %s, want %s as before", again[drm.TrackAudio].IV, audio.IV)
+			}
+
+			pssh, err := p.GetPSSH(context.Background())
+			if err != nil {
+				t.Fatalf("GetPSSH() returned error: %s", err)
+			}
+			if len(pssh) != 1 || pssh[0].SystemID != drm.SystemIDWidevine || pssh[0].KeyID != want.KeyID {
+				t.Errorf("GetPSSH() = %+v, want the Widevine pssh of the video key", pssh)
+			}
+		})
+	}
+}
+
+func TestCPIXProvider_unavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	for _, source := range []string{filepath.Join(t.TempDir(), "missing.xml"), server.URL} {
+		if _, err := NewCPIXProvider(source).GetKeys(context.Background()); err == nil {
+			t.Errorf("GetKeys() of %s returned no error", source)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package provider
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// ivMemo chooses the IV of key servers that do not hand one out, once per
+// key ID so that a key keeps its IV across requests
+type ivMemo struct {
+	mu  sync.Mutex
+	ivs map[string]string
+}
+
+// iv returns explicit if set, otherwise the IV chosen for the key ID
+func (m *ivMemo) iv(keyID, explicit string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ivs == nil {
+		m.ivs = map[string]string{}
+	}
+
+	iv, ok := m.ivs[keyID]
+	switch {
+	case explicit != "":
+		iv = explicit
+	case !ok:
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		iv = hex.EncodeToString(b)
+	}
+
+	m.ivs[keyID] = iv
+	return iv, nil
+}
@@ -0,0 +1,173 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// KMSConfig configures decrypting the content keys from a ciphertext blob
+// with an AWS KMS key
+type KMSConfig struct {
+	// KeyARN of the KMS key the blob was encrypted with
+	KeyARN string
+	// Ciphertext is the base64 encoded CiphertextBlob of kms encrypt, the
+	// plaintext holds one key_id:key:iv per line like drm.keys
+	Ciphertext string
+
+	Region string // default the region of KeyARN
+	// Profile of the shared credentials file, the environment is used when
+	// empty
+	Profile string
+	// Role is assumed with the credentials of the profile or environment
+	Role        string
+	STSEndpoint string // default https://sts.<region>.amazonaws.com
+	Endpoint    string // default https://kms.<region>.amazonaws.com
+
+	// Credentials are used instead of the profile or environment
+	Credentials *AWSCredentials
+	Client      *http.Client // default http.DefaultClient with a 10s timeout
+}
+
+// KMSProvider decrypts the content keys with AWS KMS on every GetKeys, the
+// plaintext is never kept. The keys are generations 1 and up in order.
+type KMSProvider struct {
+	config     KMSConfig
+	ciphertext []byte
+	signer     sigV4Signer
+	client     *http.Client
+	creds      *awsCredentialSource
+}
+
+func NewKMSProvider(config KMSConfig) (*KMSProvider, error) {
+	if config.KeyARN == "" || config.Ciphertext == "" {
+		return nil, errors.New("kms key ARN and ciphertext are required")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(config.Ciphertext))
+	if err != nil || len(ciphertext) == 0 {
+		return nil, errors.New("kms ciphertext must be base64 encoded")
+	}
+
+	// arn:aws:kms:<region>:<account>:key/<id>
+	if config.Region == "" {
+		parts := strings.Split(config.KeyARN, ":")
+		if len(parts) < 6 || parts[0] != "arn" || parts[2] != "kms" || parts[3] == "" {
+			return nil, fmt.Errorf("kms key ARN must name the region as arn:aws:kms:<region>:..., got %q", config.KeyARN)
+		}
+		config.Region = parts[3]
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://kms." + config.Region + ".amazonaws.com"
+	}
+	if config.STSEndpoint == "" {
+		config.STSEndpoint = "https://sts." + config.Region + ".amazonaws.com"
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	signer := sigV4Signer{region: config.Region, service: "kms", now: time.Now}
+	return &KMSProvider{
+		config:     config,
+		ciphertext: ciphertext,
+		signer:     signer,
+		client:     client,
+		creds: &awsCredentialSource{
+			profile:     config.Profile,
+			role:        config.Role,
+			stsEndpoint: config.STSEndpoint,
+			client:      client,
+			signer:      signer,
+			creds:       config.Credentials,
+		},
+	}, nil
+}
+
+// decrypt returns the plaintext of the ciphertext blob
+func (p *KMSProvider) decrypt(ctx context.Context) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{
+		"CiphertextBlob": base64.StdEncoding.EncodeToString(p.ciphertext),
+		"KeyId":          p.config.KeyARN,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := p.creds.credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("kms credentials: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	p.signer.sign(req, body, creds)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Plaintext []byte `json:"Plaintext"`
+		Type      string `json:"__type"`
+		Message   string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&response); err != nil && res.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("kms decrypt response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		if response.Type != "" {
+			return nil, fmt.Errorf("kms decrypt returned %s: %s %s", res.Status, response.Type, response.Message)
+		}
+		return nil, fmt.Errorf("kms decrypt returned %s", res.Status)
+	}
+	return response.Plaintext, nil
+}
+
+// GetKeys decrypts the keys, a blob without a valid key is an error
+func (p *KMSProvider) GetKeys(ctx context.Context) ([]drm.Key, error) {
+	plaintext, err := p.decrypt(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plaintext)
+
+	var keys []drm.Key
+	for line, text := range strings.Split(string(plaintext), "\n") {
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, err := drm.ParseKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("kms plaintext line %d: %w", line+1, err)
+		}
+
+		key.Generation = uint64(len(keys) + 1)
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("kms plaintext has no keys")
+	}
+	return keys, nil
+}
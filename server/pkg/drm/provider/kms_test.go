@@ -0,0 +1,134 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testKMSKey = "arn:aws:kms:eu-west-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+// kmsServer emulates KMS decrypting blobs by decoding them, reversed
+func kmsServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/kms/aws4_request") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "InvalidSignatureException", "message": "bad request"})
+			return
+		}
+
+		var req struct {
+			CiphertextBlob []byte
+			KeyId          string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.KeyId != testKMSKey {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "IncorrectKeyException", "message": "wrong key"})
+			return
+		}
+
+		plaintext := []byte(string(req.CiphertextBlob))
+		for i, j := 0, len(plaintext)-1; i < j; i, j = i+1, j-1 {
+			plaintext[i], plaintext[j] = plaintext[j], plaintext[i]
+		}
+		json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": plaintext})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// kmsCiphertext encrypts a plaintext for kmsServer
+func kmsCiphertext(plaintext string) string {
+	b := []byte(plaintext)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestKMSProvider_GetKeys(t *testing.T) {
+	server := kmsServer(t)
+
+	plaintext := "# neko\n" + testKeyID + ":" + testKey + ":" + testIV + "\n00000000000000000000000000000002:" + testKey + ":" + testIV + "\n"
+	p, err := NewKMSProvider(KMSConfig{
+		KeyARN:      testKMSKey,
+		Ciphertext:  kmsCiphertext(plaintext),
+		Endpoint:    server.URL,
+		Credentials: &testAWSCredentials,
+	})
+	if err != nil {
+		t.Fatalf("NewKMSProvider() returned error: %s", err)
+	}
+
+	keys, err := p.GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if len(keys) != 2 || keys[0].KeyID != testKeyID || keys[0].Generation != 1 || keys[1].Generation != 2 {
+		t.Errorf("GetKeys() = %+v, want both keys as generations 1 and 2", keys)
+	}
+
+	p.config.KeyARN = strings.Replace(testKMSKey, "1234abcd", "ffffffff", 1)
+	if _, err := p.GetKeys(context.Background()); err == nil || !strings.Contains(err.Error(), "IncorrectKeyException") {
+		t.Errorf("GetKeys() error = %v, want the KMS error", err)
+	}
+}
+
+func TestKMSProvider_malformed(t *testing.T) {
+	server := kmsServer(t)
+
+	for _, plaintext := range []string{"# no keys\n", testKeyID + ":" + testKey} {
+		p, err := NewKMSProvider(KMSConfig{
+			KeyARN:      testKMSKey,
+			Ciphertext:  kmsCiphertext(plaintext),
+			Endpoint:    server.URL,
+			Credentials: &testAWSCredentials,
+		})
+		if err != nil {
+			t.Fatalf("NewKMSProvider() returned error: %s", err)
+		}
+		if _, err := p.GetKeys(context.Background()); err == nil {
+			t.Errorf("GetKeys() of %q returned no error", plaintext)
+		}
+	}
+}
+
+func TestNewKMSProvider(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     KMSConfig
+		wantRegion string
+	}{
+		{"region of the ARN", KMSConfig{KeyARN: testKMSKey, Ciphertext: "AQID"}, "eu-west-1"},
+		{"explicit region", KMSConfig{KeyARN: "alias/neko", Ciphertext: "AQID", Region: "us-east-1"}, "us-east-1"},
+		{"alias without region", KMSConfig{KeyARN: "alias/neko", Ciphertext: "AQID"}, ""},
+		{"missing ciphertext", KMSConfig{KeyARN: testKMSKey}, ""},
+		{"bad ciphertext", KMSConfig{KeyARN: testKMSKey, Ciphertext: "not base64!"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewKMSProvider(tt.config)
+			if tt.wantRegion == "" {
+				if err == nil {
+					t.Errorf("NewKMSProvider() returned no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewKMSProvider() returned error: %s", err)
+			}
+			if p.config.Region != tt.wantRegion || p.config.Endpoint != "https://kms."+tt.wantRegion+".amazonaws.com" {
+				t.Errorf("region = %s, endpoint = %s, want %s", p.config.Region, p.config.Endpoint, tt.wantRegion)
+			}
+		})
+	}
+}
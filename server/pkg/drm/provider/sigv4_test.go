@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// credentials and requests of the AWS Signature Version 4 test suite
+var testAWSCredentials = AWSCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSigV4Signer(t *testing.T) {
+	signer := sigV4Signer{
+		region:  "us-east-1",
+		service: "service",
+		now: func() time.Time {
+			return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+		},
+	}
+
+	tests := []struct {
+		name      string
+		url       string
+		signature string
+	}{
+		{
+			name:      "get-vanilla",
+			url:       "https://example.amazonaws.com/",
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:      "get-vanilla-query-order-key",
+			url:       "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			signer.sign(req, nil, testAWSCredentials)
+
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + tt.signature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization = %s, want %s", got, want)
+			}
+		})
+	}
+
+	// the session token is signed along
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := testAWSCredentials
+	creds.SessionToken = "token"
+	signer.sign(req, nil, creds)
+	if req.Header.Get("X-Amz-Security-Token") != "token" || !strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("session token not signed: %s", req.Header.Get("Authorization"))
+	}
+}
+
+func TestAWSCredentialsFromProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	content := "[default]\naws_access_key_id = AKIDDEFAULT\naws_secret_access_key = default\n\n" +
+		"# streaming account\n[neko]\naws_access_key_id=AKIDNEKO\naws_secret_access_key=secret\naws_session_token=token\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", path)
+
+	creds, err := AWSCredentialsFromProfile("neko")
+	if err != nil {
+		t.Fatalf("AWSCredentialsFromProfile() returned error: %s", err)
+	}
+	if creds != (AWSCredentials{AccessKeyID: "AKIDNEKO", SecretAccessKey: "secret", SessionToken: "token"}) {
+		t.Errorf("AWSCredentialsFromProfile() = %+v", creds)
+	}
+
+	if _, err := AWSCredentialsFromProfile("missing"); err == nil {
+		t.Errorf("AWSCredentialsFromProfile() of a missing profile returned no error")
+	}
+}
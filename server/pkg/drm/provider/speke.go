@@ -0,0 +1,207 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+	"github.com/m1k1o/neko/server/pkg/drm/cpix"
+)
+
+// DefaultSPEKEService is the SigV4 service of SPEKE endpoints behind an API
+// Gateway
+const DefaultSPEKEService = "execute-api"
+
+// SPEKEConfig configures requests to a SPEKE key server, CPIX documents
+// posted over HTTPS and signed with AWS Signature Version 4
+type SPEKEConfig struct {
+	URL string
+	// ResourceID identifies the content, the key server hands out the same
+	// key for a resource ID and key ID
+	ResourceID string
+	// SystemIDs of the key systems to get pssh boxes of
+	SystemIDs [][16]byte
+
+	Region  string
+	Service string // default execute-api
+	// Profile of the shared credentials file, the environment is used when
+	// empty
+	Profile string
+	// Role is assumed with the credentials of the profile or environment
+	Role        string
+	STSEndpoint string // default https://sts.<region>.amazonaws.com
+
+	// Credentials are used instead of the profile or environment
+	Credentials *AWSCredentials
+	Client      *http.Client // default http.DefaultClient with a 10s timeout
+}
+
+// SPEKEProvider requests the content key of the resource from a SPEKE key
+// server on every GetKeys. The key ID is chosen once, so that the server
+// hands out the same key for the lifetime of the provider.
+type SPEKEProvider struct {
+	config SPEKEConfig
+	keyID  string
+	signer sigV4Signer
+	client *http.Client
+	creds  *awsCredentialSource
+
+	ivs ivMemo
+}
+
+func NewSPEKEProvider(config SPEKEConfig) (*SPEKEProvider, error) {
+	if config.URL == "" || config.ResourceID == "" || config.Region == "" {
+		return nil, errors.New("speke url, resource ID and aws region are required")
+	}
+
+	if config.Service == "" {
+		config.Service = DefaultSPEKEService
+	}
+	if config.STSEndpoint == "" {
+		config.STSEndpoint = "https://sts." + config.Region + ".amazonaws.com"
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	keyID := make([]byte, 16)
+	if _, err := rand.Read(keyID); err != nil {
+		return nil, err
+	}
+
+	signer := sigV4Signer{region: config.Region, service: config.Service, now: time.Now}
+	return &SPEKEProvider{
+		config: config,
+		keyID:  hex.EncodeToString(keyID),
+		signer: signer,
+		client: client,
+		creds: &awsCredentialSource{
+			profile:     config.Profile,
+			role:        config.Role,
+			stsEndpoint: config.STSEndpoint,
+			client:      client,
+			signer:      signer,
+			creds:       config.Credentials,
+		},
+	}, nil
+}
+
+// ParseSystemID takes a key system by name, common, widevine, playready or
+// fairplay, or by its UUID
+func ParseSystemID(s string) ([16]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "common", drm.PSSHSystemCommon:
+		return drm.SystemIDCommon, nil
+	case "widevine":
+		return drm.SystemIDWidevine, nil
+	case drm.PSSHSystemPlayReady:
+		return drm.SystemIDPlayReady, nil
+	case "fairplay":
+		return drm.SystemIDFairPlay, nil
+	}
+
+	var id [16]byte
+	b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), "-", ""))
+	if err != nil || len(b) != 16 {
+		return id, fmt.Errorf("system ID must be common, widevine, playready, fairplay or a UUID, got %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func (p *SPEKEProvider) document(ctx context.Context) (*cpix.Document, error) {
+	body, err := cpix.Request{
+		ContentID: p.config.ResourceID,
+		KeyIDs:    []string{p.keyID},
+		SystemIDs: p.config.SystemIDs,
+	}.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := p.creds.credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("speke credentials: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	p.signer.sign(req, body, creds)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("speke key server returned %s", res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	return cpix.Parse(data)
+}
+
+// GetKeys returns the content key of the resource as generation 1
+func (p *SPEKEProvider) GetKeys(ctx context.Context) ([]drm.Key, error) {
+	doc, err := p.document(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ck := range doc.Keys {
+		if ck.KeyID != p.keyID {
+			continue
+		}
+
+		iv, err := p.ivs.iv(ck.KeyID, ck.IV)
+		if err != nil {
+			return nil, err
+		}
+
+		return []drm.Key{{
+			Generation: 1,
+			KeyID:      ck.KeyID,
+			Key:        ck.Key,
+			IV:         iv,
+		}}, nil
+	}
+	return nil, fmt.Errorf("speke key server response has no key %s", p.keyID)
+}
+
+// GetPSSH returns the pssh boxes of the requested key systems
+func (p *SPEKEProvider) GetPSSH(ctx context.Context) ([]drm.SystemPSSH, error) {
+	doc, err := p.document(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var boxes []drm.SystemPSSH
+	for _, system := range doc.DRMSystems {
+		if system.PSSH == nil || system.KeyID != p.keyID {
+			continue
+		}
+		boxes = append(boxes, drm.SystemPSSH{
+			KeyID:    system.KeyID,
+			SystemID: system.SystemID,
+			Box:      system.PSSH,
+		})
+	}
+	return boxes, nil
+}
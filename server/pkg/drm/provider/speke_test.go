@@ -0,0 +1,180 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+const testIV = "d5fbd6b82ed93e4ef98ae40931ee33b7"
+
+// spekeServer emulates a key server answering with the key and pssh boxes
+// of the requested key ID, status other than 200 fails every request
+func spekeServer(t *testing.T, status int) (*httptest.Server, *http.Request) {
+	t.Helper()
+
+	var last http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last = *r.Clone(context.Background())
+		if status != http.StatusOK {
+			http.Error(w, "forbidden", status)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			ID         string `xml:"id,attr"`
+			ContentKey []struct {
+				KID string `xml:"kid,attr"`
+			} `xml:"ContentKeyList>ContentKey"`
+			DRMSystem []struct {
+				KID      string `xml:"kid,attr"`
+				SystemID string `xml:"systemId,attr"`
+			} `xml:"DRMSystemList>DRMSystem"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil || len(req.ContentKey) != 1 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		kid := req.ContentKey[0].KID
+		var systems string
+		for _, system := range req.DRMSystem {
+			systems += fmt.Sprintf(`<cpix:DRMSystem kid="%s" systemId="%s"><cpix:PSSH>%s</cpix:PSSH></cpix:DRMSystem>`,
+				system.KID, system.SystemID, base64.StdEncoding.EncodeToString([]byte("pssh of "+system.SystemID)))
+		}
+
+		fmt.Fprintf(w, `<cpix:CPIX id="%s" xmlns:cpix="urn:dashif:org:cpix" xmlns:pskc="urn:ietf:params:xml:ns:keyprov:pskc">`+
+			`<cpix:ContentKeyList><cpix:ContentKey kid="%s" explicitIV="%s"><cpix:Data><pskc:Secret><pskc:PlainValue>%s</pskc:PlainValue></pskc:Secret></cpix:Data></cpix:ContentKey></cpix:ContentKeyList>`+
+			`<cpix:DRMSystemList>%s</cpix:DRMSystemList></cpix:CPIX>`,
+			req.ID, kid, b64hex(testIV), b64hex(testKey), systems)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &last
+}
+
+func newTestSPEKEProvider(t *testing.T, url string) *SPEKEProvider {
+	t.Helper()
+
+	p, err := NewSPEKEProvider(SPEKEConfig{
+		URL:         url,
+		ResourceID:  "stream-1",
+		SystemIDs:   [][16]byte{drm.SystemIDWidevine, drm.SystemIDPlayReady},
+		Region:      "eu-west-1",
+		Credentials: &testAWSCredentials,
+	})
+	if err != nil {
+		t.Fatalf("NewSPEKEProvider() returned error: %s", err)
+	}
+	return p
+}
+
+func TestSPEKEProvider(t *testing.T) {
+	server, last := spekeServer(t, http.StatusOK)
+	p := newTestSPEKEProvider(t, server.URL)
+
+	keys, err := p.GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if len(keys) != 1 || keys[0].Key != testKey || keys[0].IV != testIV || keys[0].KeyID != p.keyID {
+		t.Errorf("GetKeys() = %+v", keys)
+	}
+
+	auth := last.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/execute-api/aws4_request") {
+		t.Errorf("request not signed for execute-api in eu-west-1: %s", auth)
+	}
+	if !strings.Contains(auth, "SignedHeaders=content-type;host;x-amz-date,") {
+		t.Errorf("signed headers of %s", auth)
+	}
+
+	// the same key ID in every request, for the same key
+	again, _ := p.GetKeys(context.Background())
+	if len(again) != 1 || again[0] != keys[0] {
+		t.Errorf("GetKeys() = %+v, then %+v", keys, again)
+	}
+
+	boxes, err := p.GetPSSH(context.Background())
+	if err != nil {
+		t.Fatalf("GetPSSH() returned error: %s", err)
+	}
+	if len(boxes) != 2 || boxes[0].SystemID != drm.SystemIDWidevine || boxes[1].SystemID != drm.SystemIDPlayReady || boxes[0].KeyID != p.keyID {
+		t.Errorf("GetPSSH() = %+v", boxes)
+	}
+}
+
+func TestSPEKEProvider_status(t *testing.T) {
+	server, _ := spekeServer(t, http.StatusForbidden)
+	p := newTestSPEKEProvider(t, server.URL)
+
+	_, err := p.GetKeys(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("GetKeys() of a refusing server = %v, want the status", err)
+	}
+}
+
+func TestSPEKEProvider_assumeRole(t *testing.T) {
+	server, last := spekeServer(t, http.StatusOK)
+
+	var action string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action = r.URL.Query().Get("Action") + " " + r.URL.Query().Get("RoleArn")
+		fmt.Fprint(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>`+
+			`<AccessKeyId>ASIAROLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>`+
+			`<SessionToken>token</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration>`+
+			`</Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	}))
+	defer sts.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	p, err := NewSPEKEProvider(SPEKEConfig{
+		URL:         server.URL,
+		ResourceID:  "stream-1",
+		Region:      "eu-west-1",
+		Role:        "arn:aws:iam::123456789012:role/speke",
+		STSEndpoint: sts.URL,
+	})
+	if err != nil {
+		t.Fatalf("NewSPEKEProvider() returned error: %s", err)
+	}
+
+	if _, err := p.GetKeys(context.Background()); err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if action != "AssumeRole arn:aws:iam::123456789012:role/speke" {
+		t.Errorf("sts request = %s", action)
+	}
+	if !strings.Contains(last.Header.Get("Authorization"), "Credential=ASIAROLE/") || last.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Errorf("request not signed with the role: %s", last.Header.Get("Authorization"))
+	}
+}
+
+func TestParseSystemID(t *testing.T) {
+	for name, want := range map[string][16]byte{
+		"widevine":                             drm.SystemIDWidevine,
+		"PlayReady":                            drm.SystemIDPlayReady,
+		"cenc":                                 drm.SystemIDCommon,
+		"94ce86fb-07ff-4f43-adb8-93d2fa968ca2": drm.SystemIDFairPlay,
+	} {
+		if got, err := ParseSystemID(name); err != nil || got != want {
+			t.Errorf("ParseSystemID(%s) = %x, %v", name, got, err)
+		}
+	}
+
+	if _, err := ParseSystemID("clearkey"); err == nil {
+		t.Errorf("ParseSystemID() accepted an unknown system")
+	}
+}
@@ -0,0 +1,339 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// Vault auth methods
+const (
+	VaultAuthToken      = "token"      // the configured token or VAULT_TOKEN
+	VaultAuthKubernetes = "kubernetes" // login with the service account token
+)
+
+const (
+	// DefaultVaultRefresh is how often VaultProvider.Watch reads the secret
+	// again unless its lease ends earlier
+	DefaultVaultRefresh = time.Minute
+	// DefaultVaultJWTFile is the service account token of a pod
+	DefaultVaultJWTFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+var ErrVaultSecretNotFound = errors.New("vault secret not found")
+
+// VaultConfig configures reading the content key from a secret of Vault,
+// with the fields key_id, key and iv
+type VaultConfig struct {
+	Addr string // default VAULT_ADDR
+	// Path of the secret, secret/data/<name> with the KV version 2 engine
+	// or secret/<name> with version 1
+	Path      string
+	Namespace string // Vault Enterprise namespace, if any
+
+	Auth  string // token (default) or kubernetes
+	Token string // default VAULT_TOKEN
+	// kubernetes auth: role, mount of the auth method (default kubernetes)
+	// and the service account token (default DefaultVaultJWTFile)
+	Role      string
+	AuthMount string
+	JWTFile   string
+
+	Refresh time.Duration // default DefaultVaultRefresh
+	Client  *http.Client  // default http.DefaultClient with a 10s timeout
+}
+
+// VaultProvider reads the content key from a Vault secret. The version of a
+// KV version 2 secret is the generation of the key, a version 1 secret
+// names it in a generation field or is generation 1.
+type VaultProvider struct {
+	config VaultConfig
+	client *http.Client
+	now    func() time.Time
+
+	// token of the kubernetes login and when to log in again
+	mu      sync.Mutex
+	token   string
+	renewAt time.Time
+}
+
+func NewVaultProvider(config VaultConfig) (*VaultProvider, error) {
+	if config.Addr == "" {
+		config.Addr = os.Getenv("VAULT_ADDR")
+	}
+	if config.Addr == "" || config.Path == "" {
+		return nil, errors.New("vault address and secret path are required")
+	}
+	config.Addr = strings.TrimSuffix(config.Addr, "/")
+	config.Path = strings.Trim(config.Path, "/")
+
+	switch config.Auth {
+	case "", VaultAuthToken:
+		config.Auth = VaultAuthToken
+		if config.Token == "" {
+			config.Token = os.Getenv("VAULT_TOKEN")
+		}
+		if config.Token == "" {
+			return nil, errors.New("vault token auth requires a token or VAULT_TOKEN")
+		}
+	case VaultAuthKubernetes:
+		if config.Role == "" {
+			return nil, errors.New("vault kubernetes auth requires a role")
+		}
+		if config.AuthMount == "" {
+			config.AuthMount = VaultAuthKubernetes
+		}
+		if config.JWTFile == "" {
+			config.JWTFile = DefaultVaultJWTFile
+		}
+	default:
+		return nil, fmt.Errorf("vault auth must be %s or %s, got %q", VaultAuthToken, VaultAuthKubernetes, config.Auth)
+	}
+
+	if config.Refresh <= 0 {
+		config.Refresh = DefaultVaultRefresh
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &VaultProvider{
+		config: config,
+		client: client,
+		now:    time.Now,
+	}, nil
+}
+
+// do sends a request to the Vault API and decodes the JSON response into v
+func (p *VaultProvider) do(ctx context.Context, method, path, token string, body, v any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.config.Addr+"/v1/"+path, payload)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if p.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.config.Namespace)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrVaultSecretNotFound, path)
+	}
+	if res.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&failure)
+		if len(failure.Errors) > 0 {
+			return fmt.Errorf("vault %s returned %s: %s", path, res.Status, strings.Join(failure.Errors, ", "))
+		}
+		return fmt.Errorf("vault %s returned %s", path, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// authToken returns the token to read the secret with, the kubernetes
+// login is repeated when two thirds of its lease have passed
+func (p *VaultProvider) authToken(ctx context.Context) (string, error) {
+	if p.config.Auth == VaultAuthToken {
+		return p.config.Token, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && (p.renewAt.IsZero() || p.now().Before(p.renewAt)) {
+		return p.token, nil
+	}
+
+	jwt, err := os.ReadFile(p.config.JWTFile)
+	if err != nil {
+		return "", fmt.Errorf("vault kubernetes auth: %w", err)
+	}
+
+	var login struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	body := map[string]string{
+		"role": p.config.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}
+	if err := p.do(ctx, http.MethodPost, "auth/"+p.config.AuthMount+"/login", "", body, &login); err != nil {
+		return "", fmt.Errorf("vault kubernetes auth: %w", err)
+	}
+	if login.Auth.ClientToken == "" {
+		return "", errors.New("vault kubernetes auth returned no token")
+	}
+
+	p.token = login.Auth.ClientToken
+	p.renewAt = time.Time{}
+	if lease := time.Duration(login.Auth.LeaseDuration) * time.Second; lease > 0 {
+		p.renewAt = p.now().Add(lease * 2 / 3)
+	}
+	return p.token, nil
+}
+
+// read returns the key of the secret and the lease of the secret, zero
+// when it has none as with KV version 2
+func (p *VaultProvider) read(ctx context.Context) (drm.Key, time.Duration, error) {
+	token, err := p.authToken(ctx)
+	if err != nil {
+		return drm.Key{}, 0, err
+	}
+
+	var secret struct {
+		LeaseDuration int64           `json:"lease_duration"`
+		Data          json.RawMessage `json:"data"`
+	}
+	if err := p.do(ctx, http.MethodGet, p.config.Path, token, nil, &secret); err != nil {
+		return drm.Key{}, 0, err
+	}
+
+	// KV version 2 nests the fields and has a version instead of a lease
+	var fields map[string]any
+	var kv2 struct {
+		Data     map[string]any `json:"data"`
+		Metadata *struct {
+			Version uint64 `json:"version"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(secret.Data, &kv2); err == nil && kv2.Data != nil && kv2.Metadata != nil {
+		fields = kv2.Data
+		fields["generation"] = kv2.Metadata.Version
+	} else if err := json.Unmarshal(secret.Data, &fields); err != nil || fields == nil {
+		return drm.Key{}, 0, fmt.Errorf("vault secret %s has no data", p.config.Path)
+	}
+
+	key, err := vaultKey(fields)
+	if err != nil {
+		return drm.Key{}, 0, fmt.Errorf("vault secret %s: %w", p.config.Path, err)
+	}
+	return key, time.Duration(secret.LeaseDuration) * time.Second, nil
+}
+
+// vaultKey takes the key from the fields of a secret
+func vaultKey(fields map[string]any) (drm.Key, error) {
+	var parts []string
+	for _, name := range []string{"key_id", "key", "iv"} {
+		value, _ := fields[name].(string)
+		if value == "" {
+			return drm.Key{}, fmt.Errorf("%s is missing", name)
+		}
+		parts = append(parts, value)
+	}
+
+	key, err := drm.ParseKey(strings.Join(parts, ":"))
+	if err != nil {
+		return drm.Key{}, err
+	}
+
+	key.Generation = 1
+	switch generation := fields["generation"].(type) {
+	case nil:
+	case uint64:
+		key.Generation = generation
+	case float64:
+		if generation < 1 || generation != float64(uint64(generation)) {
+			return drm.Key{}, fmt.Errorf("generation must be a positive integer, got %v", generation)
+		}
+		key.Generation = uint64(generation)
+	case string:
+		if key.Generation, err = strconv.ParseUint(generation, 10, 64); err != nil || key.Generation == 0 {
+			return drm.Key{}, fmt.Errorf("generation must be a positive integer, got %q", generation)
+		}
+	default:
+		return drm.Key{}, fmt.Errorf("generation must be a positive integer, got %v", generation)
+	}
+
+	return key, nil
+}
+
+// GetKeys reads the key from the secret, a missing or malformed secret is
+// an error rather than no key
+func (p *VaultProvider) GetKeys(ctx context.Context) ([]drm.Key, error) {
+	key, _, err := p.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []drm.Key{key}, nil
+}
+
+// Watch reads the secret again every refresh interval, or at half of its
+// lease when that ends earlier, and sends the key whenever its generation
+// changed. A secret that cannot be read is retried at the next interval.
+func (p *VaultProvider) Watch(ctx context.Context) <-chan []drm.Key {
+	ch := make(chan []drm.Key)
+
+	go func() {
+		defer close(ch)
+
+		var generation uint64
+		var keyID string
+		next := p.config.Refresh
+
+		timer := time.NewTimer(next)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			key, lease, err := p.read(ctx)
+
+			next = p.config.Refresh
+			if lease > 0 && lease/2 < next {
+				next = max(lease/2, time.Second)
+			}
+			timer.Reset(next)
+
+			if err != nil || key.Generation == generation && key.KeyID == keyID {
+				continue
+			}
+			generation, keyID = key.Generation, key.KeyID
+
+			select {
+			case ch <- []drm.Key{key}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,271 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// vaultServer emulates Vault serving a secret, kubernetes logins hand out
+// the token the secret is read with
+type vaultServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	secret map[string]any
+	logins int
+}
+
+func newVaultServer(t *testing.T, token string) *vaultServer {
+	t.Helper()
+
+	s := &vaultServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			var login map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login["role"] != "neko" || login["jwt"] != "service-account" {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+				return
+			}
+			s.logins++
+			json.NewEncoder(w).Encode(map[string]any{
+				"auth": map[string]any{"client_token": token, "lease_duration": 3600},
+			})
+		case "/v1/secret/data/neko", "/v1/kv/neko":
+			if r.Header.Get("X-Vault-Token") != token {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+				return
+			}
+			if s.secret == nil {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]any{"errors": []string{}})
+				return
+			}
+			json.NewEncoder(w).Encode(s.secret)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *vaultServer) set(secret map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.secret = secret
+}
+
+// kv2 is a KV version 2 read response
+func kv2(version int, fields map[string]any) map[string]any {
+	return map[string]any{
+		"lease_duration": 0,
+		"data": map[string]any{
+			"data":     fields,
+			"metadata": map[string]any{"version": version},
+		},
+	}
+}
+
+func testKeyFields() map[string]any {
+	return map[string]any{"key_id": testKeyID, "key": testKey, "iv": testIV}
+}
+
+func TestVaultProvider_GetKeys(t *testing.T) {
+	server := newVaultServer(t, "s.token")
+	server.set(kv2(3, testKeyFields()))
+
+	p, err := NewVaultProvider(VaultConfig{Addr: server.URL, Path: "secret/data/neko", Token: "s.token"})
+	if err != nil {
+		t.Fatalf("NewVaultProvider() returned error: %s", err)
+	}
+
+	keys, err := p.GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if len(keys) != 1 || keys[0].KeyID != testKeyID || keys[0].Key != testKey || keys[0].IV != testIV || keys[0].Generation != 3 {
+		t.Errorf("GetKeys() = %+v, want the key of the secret as generation 3", keys)
+	}
+
+	// KV version 1 names the generation
+	fields := testKeyFields()
+	fields["generation"] = "7"
+	server.set(map[string]any{"lease_duration": 60, "data": fields})
+
+	p, _ = NewVaultProvider(VaultConfig{Addr: server.URL, Path: "/kv/neko/", Token: "s.token"})
+	if keys, err := p.GetKeys(context.Background()); err != nil || keys[0].Generation != 7 {
+		t.Errorf("GetKeys() = %+v, %v, want generation 7", keys, err)
+	}
+}
+
+func TestVaultProvider_kubernetes(t *testing.T) {
+	server := newVaultServer(t, "s.login")
+	server.set(kv2(1, testKeyFields()))
+
+	jwt := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwt, []byte("service-account\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewVaultProvider(VaultConfig{
+		Addr:    server.URL,
+		Path:    "secret/data/neko",
+		Auth:    VaultAuthKubernetes,
+		Role:    "neko",
+		JWTFile: jwt,
+	})
+	if err != nil {
+		t.Fatalf("NewVaultProvider() returned error: %s", err)
+	}
+
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.GetKeys(context.Background()); err != nil {
+			t.Fatalf("GetKeys() returned error: %s", err)
+		}
+	}
+	if server.logins != 1 {
+		t.Errorf("logged in %d times, want the token reused", server.logins)
+	}
+
+	// two thirds of the lease later the login is repeated
+	now = now.Add(41 * time.Minute)
+	if _, err := p.GetKeys(context.Background()); err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if server.logins != 2 {
+		t.Errorf("logged in %d times, want a new token", server.logins)
+	}
+
+	p.config.Role = "other"
+	p.token = ""
+	if _, err := p.GetKeys(context.Background()); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("GetKeys() error = %v, want the login refused", err)
+	}
+}
+
+func TestVaultProvider_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  map[string]any
+		wantErr string
+	}{
+		{"missing", nil, "not found"},
+		{"no key", kv2(1, map[string]any{"key_id": testKeyID, "iv": testIV}), "key is missing"},
+		{"short key", kv2(1, map[string]any{"key_id": testKeyID, "key": "3c3c", "iv": testIV}), "key must be 16 bytes"},
+		{"bad generation", map[string]any{"data": map[string]any{"key_id": testKeyID, "key": testKey, "iv": testIV, "generation": "zero"}}, "generation"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newVaultServer(t, "s.token")
+			server.set(tt.secret)
+
+			p, _ := NewVaultProvider(VaultConfig{Addr: server.URL, Path: "secret/data/neko", Token: "s.token"})
+			_, err := p.GetKeys(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("GetKeys() error = %v, want %q", err, tt.wantErr)
+			}
+			if tt.secret == nil && !errors.Is(err, ErrVaultSecretNotFound) {
+				t.Errorf("GetKeys() error = %v, want ErrVaultSecretNotFound", err)
+			}
+		})
+	}
+
+	server := newVaultServer(t, "s.token")
+	server.set(kv2(1, testKeyFields()))
+	p, _ := NewVaultProvider(VaultConfig{Addr: server.URL, Path: "secret/data/neko", Token: "s.wrong"})
+	if _, err := p.GetKeys(context.Background()); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("GetKeys() error = %v, want the token refused", err)
+	}
+}
+
+func TestNewVaultProvider(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("VAULT_TOKEN", "")
+
+	tests := []struct {
+		name    string
+		config  VaultConfig
+		wantErr bool
+	}{
+		{"token", VaultConfig{Addr: "https://vault:8200", Path: "secret/data/neko", Token: "s.token"}, false},
+		{"kubernetes", VaultConfig{Addr: "https://vault:8200", Path: "secret/data/neko", Auth: VaultAuthKubernetes, Role: "neko"}, false},
+		{"missing addr", VaultConfig{Path: "secret/data/neko", Token: "s.token"}, true},
+		{"missing path", VaultConfig{Addr: "https://vault:8200", Token: "s.token"}, true},
+		{"missing token", VaultConfig{Addr: "https://vault:8200", Path: "secret/data/neko"}, true},
+		{"missing role", VaultConfig{Addr: "https://vault:8200", Path: "secret/data/neko", Auth: VaultAuthKubernetes}, true},
+		{"unknown auth", VaultConfig{Addr: "https://vault:8200", Path: "secret/data/neko", Auth: "approle"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewVaultProvider(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("NewVaultProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Setenv("VAULT_ADDR", "https://vault:8200")
+	t.Setenv("VAULT_TOKEN", "s.env")
+	p, err := NewVaultProvider(VaultConfig{Path: "secret/data/neko"})
+	if err != nil || p.config.Addr != "https://vault:8200" || p.config.Token != "s.env" {
+		t.Errorf("NewVaultProvider() = %+v, %v, want the address and token of the environment", p, err)
+	}
+}
+
+func TestVaultProvider_Watch(t *testing.T) {
+	server := newVaultServer(t, "s.token")
+	server.set(kv2(1, testKeyFields()))
+
+	p, _ := NewVaultProvider(VaultConfig{Addr: server.URL, Path: "secret/data/neko", Token: "s.token", Refresh: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := p.Watch(ctx)
+
+	receive := func() uint64 {
+		t.Helper()
+		select {
+		case keys := <-ch:
+			return keys[0].Generation
+		case <-time.After(2 * time.Second):
+			t.Fatal("Watch() sent no keys")
+			return 0
+		}
+	}
+
+	if got := receive(); got != 1 {
+		t.Fatalf("Watch() generation = %d, want 1", got)
+	}
+
+	fields := testKeyFields()
+	fields["key_id"] = "00000000000000000000000000000002"
+	server.set(kv2(2, fields))
+	if got := receive(); got != 2 {
+		t.Errorf("Watch() generation = %d, want the new version", got)
+	}
+
+	cancel()
+	for range ch {
+	}
+}
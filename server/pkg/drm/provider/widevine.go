@@ -0,0 +1,231 @@
+// Package provider fetches content keys from key servers
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// DefaultWidevineTrack is the track type the content key is requested for
+const DefaultWidevineTrack = "SD"
+
+var ErrWidevineStatus = errors.New("widevine key server refused the request")
+
+// WidevineConfig configures requests to a Widevine common encryption key
+// server
+type WidevineConfig struct {
+	URL      string
+	Provider string // signer name registered with the key server
+	// SigningKey and SigningIV are hex encoded, the key is 32 bytes
+	SigningKey string
+	SigningIV  string
+	// ContentID identifies the stream, keys are stable per content ID
+	ContentID string
+	Track     string // track type, default SD
+	Scheme    string // cbcs or cenc, default cbcs
+
+	Client *http.Client // default http.DefaultClient with a 10s timeout
+}
+
+// WidevineProvider requests the content key of a track from a Widevine key
+// server on every GetKeys, the IV the server does not hand out is chosen
+// once per key ID
+type WidevineProvider struct {
+	config WidevineConfig
+	block  cipher.Block
+	iv     []byte
+	client *http.Client
+
+	ivs ivMemo
+}
+
+func NewWidevineProvider(config WidevineConfig) (*WidevineProvider, error) {
+	if config.URL == "" || config.Provider == "" || config.ContentID == "" {
+		return nil, errors.New("widevine url, provider and content ID are required")
+	}
+
+	key, err := hex.DecodeString(config.SigningKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("widevine signing key must be 32 bytes hex encoded")
+	}
+
+	iv, err := hex.DecodeString(config.SigningIV)
+	if err != nil || len(iv) != 16 {
+		return nil, errors.New("widevine signing iv must be 16 bytes hex encoded")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Track == "" {
+		config.Track = DefaultWidevineTrack
+	}
+	switch config.Scheme {
+	case "":
+		config.Scheme = "cbcs"
+	case "cbcs", "cenc":
+	default:
+		return nil, fmt.Errorf("widevine scheme must be cbcs or cenc, got %q", config.Scheme)
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &WidevineProvider{
+		config: config,
+		block:  block,
+		iv:     iv,
+		client: client,
+	}, nil
+}
+
+type widevineTrack struct {
+	Type  string `json:"type"`
+	KeyID string `json:"key_id,omitempty"`
+	Key   string `json:"key,omitempty"`
+	IV    string `json:"iv,omitempty"`
+}
+
+type widevineKeyRequest struct {
+	ContentID        string          `json:"content_id"`
+	Tracks           []widevineTrack `json:"tracks"`
+	DRMTypes         []string        `json:"drm_types"`
+	ProtectionScheme string          `json:"protection_scheme"`
+}
+
+type widevineKeyResponse struct {
+	Status string          `json:"status"`
+	Tracks []widevineTrack `json:"tracks"`
+}
+
+// GetKeys returns the content key of the track as generation 1
+func (p *WidevineProvider) GetKeys(ctx context.Context) ([]drm.Key, error) {
+	request, err := json.Marshal(widevineKeyRequest{
+		ContentID:        base64.StdEncoding.EncodeToString([]byte(p.config.ContentID)),
+		Tracks:           []widevineTrack{{Type: p.config.Track}},
+		DRMTypes:         []string{"WIDEVINE"},
+		ProtectionScheme: strings.ToUpper(p.config.Scheme),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"request":   base64.StdEncoding.EncodeToString(request),
+		"signature": base64.StdEncoding.EncodeToString(p.sign(request)),
+		"signer":    p.config.Provider,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("widevine key server returned %s", res.Status)
+	}
+
+	var envelope struct {
+		Response string `json:"response"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("widevine key server response: %w", err)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(envelope.Response)
+	if err != nil {
+		return nil, fmt.Errorf("widevine key server response: %w", err)
+	}
+
+	var response widevineKeyResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return nil, fmt.Errorf("widevine key server response: %w", err)
+	}
+
+	if response.Status != "OK" {
+		return nil, fmt.Errorf("%w: status %s", ErrWidevineStatus, response.Status)
+	}
+
+	for _, track := range response.Tracks {
+		if track.Type == p.config.Track {
+			return p.key(track)
+		}
+	}
+	return nil, fmt.Errorf("widevine key server response has no %s track", p.config.Track)
+}
+
+// sign returns the signature of a request: the SHA-1 of the request
+// encrypted with AES-CBC under the signing key and IV
+func (p *WidevineProvider) sign(request []byte) []byte {
+	digest := sha1.Sum(request)
+
+	// PKCS#7 padding to the block size
+	padding := aes.BlockSize - len(digest)%aes.BlockSize
+	signature := append(digest[:], bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	cipher.NewCBCEncrypter(p.block, p.iv).CryptBlocks(signature, signature)
+	return signature
+}
+
+// key decodes the key of a track, keeping the IV for a key ID seen before
+func (p *WidevineProvider) key(track widevineTrack) ([]drm.Key, error) {
+	keyID, err := base64.StdEncoding.DecodeString(track.KeyID)
+	if err != nil || len(keyID) != 16 {
+		return nil, errors.New("widevine key ID must be 16 bytes base64 encoded")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(track.Key)
+	if err != nil || len(key) != 16 {
+		return nil, errors.New("widevine key must be 16 bytes base64 encoded")
+	}
+
+	var explicit string
+	if track.IV != "" {
+		b, err := base64.StdEncoding.DecodeString(track.IV)
+		if err != nil || len(b) != 16 {
+			return nil, errors.New("widevine iv must be 16 bytes base64 encoded")
+		}
+		explicit = hex.EncodeToString(b)
+	}
+
+	kid := hex.EncodeToString(keyID)
+	iv, err := p.ivs.iv(kid, explicit)
+	if err != nil {
+		return nil, err
+	}
+
+	return []drm.Key{{
+		Generation: 1,
+		KeyID:      kid,
+		Key:        hex.EncodeToString(key),
+		IV:         iv,
+	}}, nil
+}
@@ -0,0 +1,211 @@
+package provider
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testSigningKey = "1ae8ccd0e7985cc0b6203a55855a1034afc252980e970ca90e5202689f947ab9"
+	testSigningIV  = "d58ce954203b7c9a9a9d467f59839249"
+	testKeyID      = "00000000000000000000000000000001"
+	testKey        = "3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c"
+)
+
+// widevineServer emulates a key server checking the signature of requests,
+// respond builds the inner response
+func widevineServer(t *testing.T, respond func(req widevineKeyRequest) widevineKeyResponse) *httptest.Server {
+	t.Helper()
+
+	key, _ := hex.DecodeString(testSigningKey)
+	iv, _ := hex.DecodeString(testSigningIV)
+	block, _ := aes.NewCipher(key)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Request   string `json:"request"`
+			Signature string `json:"signature"`
+			Signer    string `json:"signer"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		request, _ := base64.StdEncoding.DecodeString(body.Request)
+		signature, _ := base64.StdEncoding.DecodeString(body.Signature)
+		if len(signature) != 32 {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(signature, signature)
+		digest := sha1.Sum(request)
+		if body.Signer != "neko" || string(signature[:20]) != string(digest[:]) {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+
+		var req widevineKeyRequest
+		if err := json.Unmarshal(request, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response, _ := json.Marshal(respond(req))
+		json.NewEncoder(w).Encode(map[string]string{
+			"response": base64.StdEncoding.EncodeToString(response),
+		})
+	}))
+}
+
+func b64hex(s string) string {
+	b, _ := hex.DecodeString(s)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func newTestProvider(t *testing.T, url string) *WidevineProvider {
+	t.Helper()
+
+	p, err := NewWidevineProvider(WidevineConfig{
+		URL:        url,
+		Provider:   "neko",
+		SigningKey: testSigningKey,
+		SigningIV:  testSigningIV,
+		ContentID:  "desktop",
+	})
+	if err != nil {
+		t.Fatalf("NewWidevineProvider() returned error: %s", err)
+	}
+	return p
+}
+
+func TestWidevineProvider_GetKeys(t *testing.T) {
+	var got widevineKeyRequest
+	server := widevineServer(t, func(req widevineKeyRequest) widevineKeyResponse {
+		got = req
+		return widevineKeyResponse{
+			Status: "OK",
+			Tracks: []widevineTrack{
+				{Type: "AUDIO", KeyID: b64hex("00000000000000000000000000000002"), Key: b64hex(testKey)},
+				{Type: "SD", KeyID: b64hex(testKeyID), Key: b64hex(testKey)},
+			},
+		}
+	})
+	defer server.Close()
+
+	p := newTestProvider(t, server.URL)
+	keys, err := p.GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+
+	if got.ContentID != base64.StdEncoding.EncodeToString([]byte("desktop")) ||
+		len(got.Tracks) != 1 || got.Tracks[0].Type != "SD" ||
+		strings.Join(got.DRMTypes, ",") != "WIDEVINE" || got.ProtectionScheme != "CBCS" {
+		t.Errorf("key request = %+v, want content ID, SD track, WIDEVINE and CBCS", got)
+	}
+
+	if len(keys) != 1 || keys[0].KeyID != testKeyID || keys[0].Key != testKey || keys[0].Generation != 1 {
+		t.Fatalf("GetKeys() = %+v, want the SD key as generation 1", keys)
+	}
+	if iv, err := hex.DecodeString(keys[0].IV); err != nil || len(iv) != 16 {
+		t.Errorf("GetKeys() IV = %q, want 16 bytes hex encoded", keys[0].IV)
+	}
+
+	// the IV stays for the same key ID
+	again, err := p.GetKeys(context.Background())
+	if err != nil {
+		t.Fatalf("GetKeys() returned error: %s", err)
+	}
+	if again[0].IV != keys[0].IV {
+		t.Errorf("GetKeys() IV = %s, want %s as before", again[0].IV, keys[0].IV)
+	}
+}
+
+func TestWidevineProvider_errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response widevineKeyResponse
+		wantErr  error
+	}{
+		{"status", widevineKeyResponse{Status: "SIGNATURE_FAILED"}, ErrWidevineStatus},
+		{"missing track", widevineKeyResponse{Status: "OK", Tracks: []widevineTrack{{Type: "HD", KeyID: b64hex(testKeyID), Key: b64hex(testKey)}}}, nil},
+		{"short key", widevineKeyResponse{Status: "OK", Tracks: []widevineTrack{{Type: "SD", KeyID: b64hex(testKeyID), Key: b64hex("3c3c")}}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := widevineServer(t, func(widevineKeyRequest) widevineKeyResponse { return tt.response })
+			defer server.Close()
+
+			_, err := newTestProvider(t, server.URL).GetKeys(context.Background())
+			if err == nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("GetKeys() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWidevineProvider_badSignature(t *testing.T) {
+	server := widevineServer(t, func(widevineKeyRequest) widevineKeyResponse {
+		return widevineKeyResponse{Status: "OK"}
+	})
+	defer server.Close()
+
+	p, err := NewWidevineProvider(WidevineConfig{
+		URL:        server.URL,
+		Provider:   "neko",
+		SigningKey: strings.Repeat("00", 32),
+		SigningIV:  testSigningIV,
+		ContentID:  "desktop",
+	})
+	if err != nil {
+		t.Fatalf("NewWidevineProvider() returned error: %s", err)
+	}
+
+	if _, err := p.GetKeys(context.Background()); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("GetKeys() error = %v, want the key server refusing the signature", err)
+	}
+}
+
+func TestNewWidevineProvider(t *testing.T) {
+	valid := WidevineConfig{
+		URL:        "https://license.example.com/cenc/getcontentkey/neko",
+		Provider:   "neko",
+		SigningKey: testSigningKey,
+		SigningIV:  testSigningIV,
+		ContentID:  "desktop",
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *WidevineConfig)
+		wantErr bool
+	}{
+		{"valid", func(c *WidevineConfig) {}, false},
+		{"missing url", func(c *WidevineConfig) { c.URL = "" }, true},
+		{"short signing key", func(c *WidevineConfig) { c.SigningKey = testSigningKey[:32] }, true},
+		{"bad signing iv", func(c *WidevineConfig) { c.SigningIV = "zz" }, true},
+		{"unknown scheme", func(c *WidevineConfig) { c.Scheme = "cens" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid
+			tt.modify(&config)
+			if _, err := NewWidevineProvider(config); (err != nil) != tt.wantErr {
+				t.Errorf("NewWidevineProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
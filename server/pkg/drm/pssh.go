@@ -0,0 +1,202 @@
+package drm
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// PSSH systems of BuildPSSH, a Widevine provider is given as
+// widevine:<provider>
+const (
+	PSSHSystemCommon    = "cenc"
+	PSSHSystemWidevine  = "widevine"
+	PSSHSystemPlayReady = "playready"
+)
+
+// SystemIDCommon is the W3C Common PSSH system, SystemIDWidevine the
+// Widevine one
+var (
+	SystemIDCommon = [16]byte{
+		0x10, 0x77, 0xef, 0xec, 0xc0, 0xb2, 0x4d, 0x02,
+		0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b,
+	}
+	SystemIDWidevine = [16]byte{
+		0xed, 0xef, 0x8b, 0xa9, 0x79, 0xd6, 0x4a, 0xce,
+		0xa3, 0xc8, 0x27, 0xdc, 0xd5, 0x1d, 0x21, 0xed,
+	}
+)
+
+// SystemIDPlayReady is the PlayReady system, SystemIDFairPlay is only
+// named, BuildPSSH does not build its boxes
+var (
+	SystemIDPlayReady = [16]byte{
+		0x9a, 0x04, 0xf0, 0x79, 0x98, 0x40, 0x42, 0x86,
+		0xab, 0x92, 0xe6, 0x5b, 0xe0, 0x88, 0x5f, 0x95,
+	}
+	SystemIDFairPlay = [16]byte{
+		0x94, 0xce, 0x86, 0xfb, 0x07, 0xff, 0x4f, 0x43,
+		0xad, 0xb8, 0x93, 0xd2, 0xfa, 0x96, 0x8c, 0xa2,
+	}
+)
+
+// SystemPSSH is a pssh box of a key system for a key ID, as handed out by
+// a key management system
+type SystemPSSH struct {
+	KeyID    string // hex encoded
+	SystemID [16]byte
+	Box      []byte
+}
+
+// SystemName names a key system as in init data, common, widevine,
+// playready or fairplay, other systems by their hex encoded ID
+func SystemName(systemID [16]byte) string {
+	switch systemID {
+	case SystemIDCommon:
+		return "common"
+	case SystemIDWidevine:
+		return "widevine"
+	case SystemIDPlayReady:
+		return "playready"
+	case SystemIDFairPlay:
+		return "fairplay"
+	}
+	return hex.EncodeToString(systemID[:])
+}
+
+// psshSystem is a parsed entry of the systems of BuildPSSH
+type psshSystem struct {
+	name     string
+	provider string
+}
+
+func parsePSSHSystems(systems []string) ([]psshSystem, error) {
+	parsed := make([]psshSystem, 0, len(systems))
+	for _, entry := range systems {
+		name, provider, _ := strings.Cut(entry, ":")
+		switch {
+		case name == PSSHSystemCommon && provider == "":
+		case name == PSSHSystemWidevine:
+		case name == PSSHSystemPlayReady && provider == "":
+		default:
+			return nil, fmt.Errorf("pssh system must be %s, %s[:<provider>] or %s, got %q", PSSHSystemCommon, PSSHSystemWidevine, PSSHSystemPlayReady, entry)
+		}
+		parsed = append(parsed, psshSystem{name: name, provider: provider})
+	}
+	return parsed, nil
+}
+
+// PSSHOptions are the parameters of the content some systems announce
+// beyond its key IDs
+type PSSHOptions struct {
+	// Scheme of the content, cenc when empty
+	Scheme string
+	// Keys are the content keys of the key IDs, optional, see
+	// PlayReadyHeader
+	Keys [][]byte
+	// PlayReadyLAURL is the license acquisition URL of the PlayReady header
+	PlayReadyLAURL string
+}
+
+// BuildPSSH encodes a pssh box per system announcing the key IDs, in the
+// order of systems: cenc is a version 1 Common PSSH listing them, widevine
+// a version 0 box with WidevinePsshData carrying them and the provider of
+// widevine:<provider>, playready a version 0 box with the PlayReady Object
+// of cenc content, see BuildPSSHOptions for other schemes
+func BuildPSSH(systems []string, keyIDs [][]byte) ([]byte, error) {
+	return BuildPSSHOptions(systems, keyIDs, PSSHOptions{})
+}
+
+// BuildPSSHOptions is BuildPSSH for content with the given options
+func BuildPSSHOptions(systems []string, keyIDs [][]byte, opts PSSHOptions) ([]byte, error) {
+	parsed, err := parsePSSHSystems(systems)
+	if err != nil {
+		return nil, err
+	}
+	return buildPSSH(parsed, keyIDs, opts)
+}
+
+// BuildPSSHBase64 is BuildPSSH encoded for EME generateRequest calls made
+// from JSON
+func BuildPSSHBase64(systems []string, keyIDs [][]byte) (string, error) {
+	pssh, err := BuildPSSH(systems, keyIDs)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pssh), nil
+}
+
+func buildPSSH(systems []psshSystem, keyIDs [][]byte, opts PSSHOptions) ([]byte, error) {
+	for _, kid := range keyIDs {
+		if len(kid) != 16 {
+			return nil, fmt.Errorf("key ID must be 16 bytes, got %d", len(kid))
+		}
+	}
+
+	var out []byte
+	for _, system := range systems {
+		switch system.name {
+		case PSSHSystemCommon:
+			out = appendPSSHBox(out, SystemIDCommon, keyIDs, nil)
+			continue
+		case PSSHSystemPlayReady:
+			pssh, err := PlayReadyHeader{
+				Scheme: opts.Scheme,
+				KeyIDs: keyIDs,
+				Keys:   opts.Keys,
+				LAURL:  opts.PlayReadyLAURL,
+			}.PSSH()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, pssh...)
+			continue
+		}
+
+		// WidevinePsshData: repeated bytes key_id = 2, string provider = 3
+		var data []byte
+		for _, kid := range keyIDs {
+			data = appendProtobufBytes(data, 2, kid)
+		}
+		if system.provider != "" {
+			data = appendProtobufBytes(data, 3, []byte(system.provider))
+		}
+		out = appendPSSHBox(out, SystemIDWidevine, nil, data)
+	}
+	return out, nil
+}
+
+// appendPSSHBox appends a pssh box, version 1 when key IDs are present and
+// version 0 otherwise
+func appendPSSHBox(b []byte, systemID [16]byte, keyIDs [][]byte, data []byte) []byte {
+	version := uint32(0)
+	size := 8 + 4 + 16 + 4 + len(data)
+	if len(keyIDs) > 0 {
+		version = 1
+		size += 4 + 16*len(keyIDs)
+	}
+
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, "pssh"...)
+	b = binary.BigEndian.AppendUint32(b, version<<24)
+	b = append(b, systemID[:]...)
+
+	if version == 1 {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(keyIDs)))
+		for _, kid := range keyIDs {
+			b = append(b, kid...)
+		}
+	}
+
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// appendProtobufBytes appends a length-delimited protobuf field
+func appendProtobufBytes(b []byte, field int, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
@@ -0,0 +1,104 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestBuildPSSH(t *testing.T) {
+	kid := mustHex("00000000000000000000000000000001")
+	common := "00000034" + "70737368" + "01000000" +
+		"1077efecc0b24d02ace33c1e52e2fb4b" +
+		"00000001" + "00000000000000000000000000000001" +
+		"00000000"
+	widevine := "00000038" + "70737368" + "00000000" +
+		"edef8ba979d64acea3c827dcd51d21ed" +
+		"00000018" + "1210" + "00000000000000000000000000000001" +
+		"1a04" + "6e656b6f"
+
+	tests := []struct {
+		name    string
+		systems []string
+		keyIDs  [][]byte
+		want    string
+		wantErr bool
+	}{
+		{"common", []string{PSSHSystemCommon}, [][]byte{kid}, common, false},
+		{"widevine with provider", []string{"widevine:neko"}, [][]byte{kid}, widevine, false},
+		{"both in order", []string{"widevine:neko", PSSHSystemCommon}, [][]byte{kid}, widevine + common, false},
+		{"unknown system", []string{"fairplay"}, [][]byte{kid}, "", true},
+		{"common with provider", []string{"cenc:neko"}, [][]byte{kid}, "", true},
+		{"short key ID", []string{PSSHSystemCommon}, [][]byte{kid[:8]}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildPSSH(tt.systems, tt.keyIDs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BuildPSSH() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if want := mustHex(tt.want); !bytes.Equal(got, want) {
+				t.Errorf("BuildPSSH() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildPSSHBase64(t *testing.T) {
+	systems := []string{PSSHSystemCommon, "widevine:neko"}
+	keyIDs := [][]byte{mustHex(testKeyID)}
+
+	raw, err := BuildPSSH(systems, keyIDs)
+	if err != nil {
+		t.Fatalf("BuildPSSH() returned error: %s", err)
+	}
+	got, err := BuildPSSHBase64(systems, keyIDs)
+	if err != nil {
+		t.Fatalf("BuildPSSHBase64() returned error: %s", err)
+	}
+	if want := base64.StdEncoding.EncodeToString(raw); got != want {
+		t.Errorf("BuildPSSHBase64() = %s, want %s", got, want)
+	}
+}
+
+func TestEncryptor_InitData(t *testing.T) {
+	e := newTestEncryptor(t, Config{PSSHSystems: []string{PSSHSystemCommon, PSSHSystemWidevine}})
+
+	got, err := e.InitData()
+	if err != nil {
+		t.Fatalf("InitData() returned error: %s", err)
+	}
+	want, _ := BuildPSSH([]string{PSSHSystemCommon, PSSHSystemWidevine}, [][]byte{mustHex(testKeyID)})
+	if !bytes.Equal(got, want) {
+		t.Errorf("InitData() = %x, want %x", got, want)
+	}
+
+	// a rotated key is announced right away
+	newKeyID := mustHex("0102030405060708090a0b0c0d0e0f10")
+	if _, err := e.UpdateKey(newKeyID, mustHex(testKey), mustHex(testIV)); err != nil {
+		t.Fatalf("UpdateKey() returned error: %s", err)
+	}
+
+	got, err = e.InitData()
+	if err != nil {
+		t.Fatalf("InitData() returned error: %s", err)
+	}
+	want, _ = BuildPSSH([]string{PSSHSystemCommon, PSSHSystemWidevine}, [][]byte{newKeyID})
+	if !bytes.Equal(got, want) {
+		t.Errorf("InitData() after UpdateKey() = %x, want %x", got, want)
+	}
+}
+
+func TestNewEncryptor_psshSystems(t *testing.T) {
+	_, err := NewEncryptor(Config{
+		Enabled:     true,
+		KeyID:       testKeyID,
+		Key:         testKey,
+		IV:          testIV,
+		PSSHSystems: []string{"fairplay"},
+	})
+	if err == nil {
+		t.Errorf("NewEncryptor() returned no error for an unknown pssh system")
+	}
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package drm
+
+// the race detector drops pooled items at random, allocations vary
+const raceEnabled = true
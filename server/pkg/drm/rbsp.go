@@ -0,0 +1,70 @@
+package drm
+
+// escapeRBSP inserts emulation prevention bytes into the payload of a NAL
+// unit, a final 0x03 follows cabac_zero_words so that it never ends in a
+// zero byte
+func escapeRBSP(rbsp []byte) []byte {
+	out, zeros := appendEscaped(make([]byte, 0, len(rbsp)+4), rbsp, 0)
+	if zeros >= 2 {
+		out = append(out, 3)
+	}
+	return out
+}
+
+// appendEscaped appends rbsp with emulation prevention bytes, zeros is the
+// number of zero bytes dst ends with. It returns the number of zero bytes
+// the result ends with.
+func appendEscaped(dst, rbsp []byte, zeros int) ([]byte, int) {
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			dst = append(dst, 3)
+			zeros = 0
+		}
+		dst = append(dst, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return dst, zeros
+}
+
+// unescapeRBSP removes emulation prevention bytes
+func unescapeRBSP(data []byte) []byte {
+	return unescapeAfter(data, 0)
+}
+
+// unescapeAfter removes emulation prevention bytes from a part of a payload
+// following zeros zero bytes
+func unescapeAfter(data []byte, zeros int) []byte {
+	return appendUnescaped(make([]byte, 0, len(data)), data, zeros)
+}
+
+// appendUnescaped appends data without emulation prevention bytes to dst,
+// zeros is the number of zero bytes preceding data
+func appendUnescaped(dst, data []byte, zeros int) []byte {
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		dst = append(dst, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return dst
+}
+
+// trailingZeros returns the number of zero bytes data ends with, which is
+// all emulation prevention needs to know about it
+func trailingZeros(data []byte) int {
+	zeros := 0
+	for i := len(data) - 1; i >= 0 && data[i] == 0 && zeros < 2; i-- {
+		zeros++
+	}
+	return zeros
+}
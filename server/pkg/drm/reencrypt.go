@@ -0,0 +1,124 @@
+package drm
+
+import (
+	"errors"
+	"hash/maphash"
+	"math"
+	"sync/atomic"
+)
+
+// ErrAlreadyEncrypted is returned with Config.RejectReencryption for an
+// access unit that was encrypted already
+var ErrAlreadyEncrypted = errors.New("access unit was encrypted already")
+
+// recentOutputs is the number of access units of the output recognized
+// when they come back
+const recentOutputs = 16
+
+// outputFingerprints keeps hashes of the last access units an Encryptor
+// emitted. Hashing the content rather than remembering buffers keeps
+// pooled buffers reused for fresh plaintext from being mistaken.
+type outputFingerprints struct {
+	seed  maphash.Seed
+	next  atomic.Uint64
+	slots [recentOutputs]atomic.Uint64
+}
+
+func newOutputFingerprints() *outputFingerprints {
+	return &outputFingerprints{seed: maphash.MakeSeed()}
+}
+
+// hash of an access unit, never 0 which marks an empty slot
+func (f *outputFingerprints) hash(data []byte) uint64 {
+	return max(maphash.Bytes(f.seed, data), 1)
+}
+
+// record remembers an encrypted access unit
+func (f *outputFingerprints) record(out []byte) {
+	slot := (f.next.Add(1) - 1) % recentOutputs
+	f.slots[slot].Store(f.hash(out))
+}
+
+// seen reports whether the access unit is one of the recent outputs
+func (f *outputFingerprints) seen(data []byte) bool {
+	h := f.hash(data)
+	for i := range f.slots {
+		if f.slots[i].Load() == h {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReencryption fails access units that come back from the output of
+// the encryptor, as given and as Annex B, or that carry a KeySEI
+func (e *Encryptor) checkReencryption(input, data []byte) error {
+	if e.fingerprints == nil {
+		return nil
+	}
+
+	if e.fingerprints.seen(input) {
+		return ErrAlreadyEncrypted
+	}
+	if !e.codec.isAudio() {
+		if _, ok := ParseKeySEI(data); ok {
+			return ErrAlreadyEncrypted
+		}
+	}
+	return nil
+}
+
+// likelyEncryptedMin is the number of slice data bytes IsLikelyEncrypted
+// needs to tell anything
+const likelyEncryptedMin = 512
+
+// IsLikelyEncrypted guesses whether an access unit of the configured codec
+// and NAL format was encrypted already: it carries a KeySEI, or the bytes
+// of its slices past a header allowance pass a chi-square test for
+// uniformly distributed bytes, as ciphertext does.
+//
+// It is a hint for diagnostics. Entropy coded slice data of high bitrate
+// streams comes close to random, and patterns leaving most blocks clear
+// such as the cbcs 1:9 are missed without KeySEI. Config.RejectReencryption
+// does not rely on it.
+func (e *Encryptor) IsLikelyEncrypted(data []byte) bool {
+	if e.codec.isAudio() {
+		return false
+	}
+
+	data, _, err := e.format.annexB(data)
+	if err != nil {
+		return false
+	}
+	if _, ok := ParseKeySEI(data); ok {
+		return true
+	}
+
+	var counts [256]int
+	var n int
+	hl := e.codec.headerLen()
+	for _, r := range findNALUnits(nil, data) {
+		nalu := r.nalu(data)
+		if len(nalu) <= hl+minProtectedSize || !e.codec.isVCL(e.codec.nalType(nalu)) {
+			continue
+		}
+		// the slice header stays clear
+		for _, b := range unescapeRBSP(nalu[hl+minProtectedSize:]) {
+			counts[b]++
+			n++
+		}
+	}
+	if n < likelyEncryptedMin {
+		return false
+	}
+
+	// random bytes give 255 on average with a deviation of about 22.6, the
+	// statistic of data with structure is higher, of counters far lower
+	expected := float64(n) / 256
+	var chi2 float64
+	for _, c := range counts {
+		d := float64(c) - expected
+		chi2 += d * d / expected
+	}
+	return math.Abs(chi2-255) < 4*math.Sqrt(2*255)
+}
@@ -0,0 +1,113 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptor_rejectReencryption(t *testing.T) {
+	frame := streamAccessUnits()[0]
+
+	// the double call of the outage goes through without the guard
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	once, err := e.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if _, err := e.Encrypt(once); err != nil {
+		t.Fatalf("Encrypt() of encrypted data without the guard returned error: %s", err)
+	}
+
+	e = newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, RejectReencryption: true})
+	once, err = e.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if _, err := e.Encrypt(once); !errors.Is(err, ErrAlreadyEncrypted) {
+		t.Errorf("Encrypt() of its own output error = %v, want %v", err, ErrAlreadyEncrypted)
+	}
+	if _, err := e.EncryptTo(make([]byte, len(once)), once); !errors.Is(err, ErrAlreadyEncrypted) {
+		t.Errorf("EncryptTo() of its own output error = %v, want %v", err, ErrAlreadyEncrypted)
+	}
+
+	// the plaintext still encrypts, as often as it comes
+	if again, err := e.Encrypt(frame); err != nil || !bytes.Equal(again, once) {
+		t.Errorf("Encrypt() of the plaintext = %v, want the same ciphertext", err)
+	}
+
+	// the buffer of an in-place encryption comes back
+	e = newInPlaceEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, RejectReencryption: true})
+	buf := bytes.Clone(frame)
+	if err := e.EncryptInPlace(buf); err != nil {
+		t.Fatalf("EncryptInPlace() returned error: %s", err)
+	}
+	encrypted := bytes.Clone(buf)
+	if err := e.EncryptInPlace(buf); !errors.Is(err, ErrAlreadyEncrypted) || !bytes.Equal(buf, encrypted) {
+		t.Errorf("EncryptInPlace() of its own output error = %v, want %v with the buffer untouched", err, ErrAlreadyEncrypted)
+	}
+
+	if stats := e.Stats(); stats.StrictRejections != 1 || stats.Errors != 1 {
+		t.Errorf("Stats() = %d strict rejections and %d errors, want 1", stats.StrictRejections, stats.Errors)
+	}
+}
+
+func TestEncryptor_rejectReencryptionKeySEI(t *testing.T) {
+	frame := streamAccessUnits()[0]
+
+	// encrypted by another encryptor, the capture layer of the outage
+	first := newTestEncryptor(t, Config{Mode: "cbcs", KeySEI: true})
+	once, err := first.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	e := newTestEncryptor(t, Config{Mode: "cbcs", RejectReencryption: true, NALFormat: NALFormatAVCC})
+	if _, err := e.Encrypt(lengthPrefixed(once, 4)); !errors.Is(err, ErrAlreadyEncrypted) {
+		t.Errorf("Encrypt() of a sample with KeySEI error = %v, want %v", err, ErrAlreadyEncrypted)
+	}
+}
+
+func TestOutputFingerprints(t *testing.T) {
+	f := newOutputFingerprints()
+	f.record([]byte("first"))
+	if !f.seen([]byte("first")) || f.seen([]byte("second")) {
+		t.Fatalf("seen() does not match the recorded output")
+	}
+
+	// the oldest output is forgotten
+	for i := 0; i < recentOutputs; i++ {
+		f.record([]byte{byte(i)})
+	}
+	if f.seen([]byte("first")) || !f.seen([]byte{0}) {
+		t.Errorf("seen() remembers more than the last %d outputs", recentOutputs)
+	}
+}
+
+func TestEncryptor_IsLikelyEncrypted(t *testing.T) {
+	frame := streamAccessUnits()[0]
+
+	cenc := newTestEncryptor(t, Config{Mode: "cenc"})
+	if cenc.IsLikelyEncrypted(frame) {
+		t.Errorf("IsLikelyEncrypted() of the plaintext = true")
+	}
+	encrypted, err := cenc.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if !cenc.IsLikelyEncrypted(encrypted) {
+		t.Errorf("IsLikelyEncrypted() of cenc ciphertext = false")
+	}
+
+	// too little of the cbcs pattern is encrypted to tell, unless signaled
+	for _, keySEI := range []bool{false, true} {
+		cbcs := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeySEI: keySEI})
+		encrypted, err := cbcs.Encrypt(frame)
+		if err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+		if got := cbcs.IsLikelyEncrypted(encrypted); got != keySEI {
+			t.Errorf("IsLikelyEncrypted() of cbcs ciphertext with KeySEI %v = %v", keySEI, got)
+		}
+	}
+}
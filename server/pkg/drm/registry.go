@@ -0,0 +1,97 @@
+package drm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// EncryptorRegistry holds an Encryptor per video stream of a process, such
+// as capture pipelines of a main display and a broadcast that must not
+// share a content key. Streams without a key of their own are encrypted by
+// the fallback encryptor.
+type EncryptorRegistry struct {
+	fallback   *Encryptor
+	encryptors map[string]*Encryptor
+}
+
+// NewEncryptorRegistry creates an Encryptor for every stream of streams,
+// with cfg and the key of the stream. The key IDs must differ from each
+// other and from that of fallback, a stream is one content key. The
+// encryptors keep the profile of cfg, keys are rotated and profiles
+// applied with the fallback only.
+func NewEncryptorRegistry(cfg Config, streams map[string]TrackKey, fallback *Encryptor) (*EncryptorRegistry, error) {
+	cfg.Tracks = nil
+	cfg.ClearTracks = nil
+	cfg.AutoGenerate = false
+	cfg.MasterSecret, cfg.DerivationContext = "", ""
+
+	names := make([]string, 0, len(streams))
+	for name := range streams {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	keyIDs := map[string]string{}
+	if fallback != nil {
+		keyIDs[fallback.KeyIDHex()] = ""
+	}
+
+	r := &EncryptorRegistry{fallback: fallback, encryptors: map[string]*Encryptor{}}
+	for _, name := range names {
+		key := streams[name]
+		if other, ok := keyIDs[strings.ToLower(key.KeyID)]; ok {
+			r.Close()
+			if other == "" {
+				return nil, fmt.Errorf("%s stream: key ID is the one of the default stream", name)
+			}
+			return nil, fmt.Errorf("%s stream: key ID is the one of the %s stream", name, other)
+		}
+		keyIDs[strings.ToLower(key.KeyID)] = name
+
+		streamCfg := cfg
+		streamCfg.KeyID, streamCfg.Key, streamCfg.IV = key.KeyID, key.Key, key.IV
+
+		encryptor, err := NewEncryptor(streamCfg)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s stream: %w", name, err)
+		}
+		r.encryptors[name] = encryptor
+	}
+
+	return r, nil
+}
+
+// Get returns the encryptor of a stream by its ID, the fallback for
+// streams without a key of their own
+func (r *EncryptorRegistry) Get(streamID string) *Encryptor {
+	if encryptor, ok := r.encryptors[streamID]; ok {
+		return encryptor
+	}
+	return r.fallback
+}
+
+// Has reports whether a stream has a key of its own
+func (r *EncryptorRegistry) Has(streamID string) bool {
+	_, ok := r.encryptors[streamID]
+	return ok
+}
+
+// Streams returns the IDs of the streams with a key of their own, sorted
+func (r *EncryptorRegistry) Streams() []string {
+	streams := make([]string, 0, len(r.encryptors))
+	for stream := range r.encryptors {
+		streams = append(streams, stream)
+	}
+	slices.Sort(streams)
+	return streams
+}
+
+// Close closes the encryptors of the streams, see Encryptor.Close, the
+// fallback belongs to the caller
+func (r *EncryptorRegistry) Close() {
+	for _, encryptor := range r.encryptors {
+		encryptor.Close()
+	}
+}
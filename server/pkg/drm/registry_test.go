@@ -0,0 +1,74 @@
+package drm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewEncryptorRegistry(t *testing.T) {
+	cfg := Config{Enabled: true, Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeyID: testKeyID, Key: testKey, IV: testIV}
+	fallback, err := NewEncryptor(cfg)
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+
+	broadcast := TrackKey{KeyID: testAudioKeyID, Key: testAudioKey, IV: testAudioIV}
+	r, err := NewEncryptorRegistry(cfg, map[string]TrackKey{"broadcast": broadcast}, fallback)
+	if err != nil {
+		t.Fatalf("NewEncryptorRegistry() returned error: %s", err)
+	}
+	defer r.Close()
+
+	if got := r.Streams(); !reflect.DeepEqual(got, []string{"broadcast"}) {
+		t.Errorf("Streams() = %v, want [broadcast]", got)
+	}
+	if got := r.Get("broadcast"); got == fallback || got.KeyIDHex() != testAudioKeyID || !r.Has("broadcast") {
+		t.Errorf("Get(broadcast) has key ID %s, want %s", got.KeyIDHex(), testAudioKeyID)
+	}
+	if got := r.Get("main"); got != fallback || r.Has("main") {
+		t.Errorf("Get(main) did not return the fallback")
+	}
+
+	// the streams encrypt with keys of their own
+	frame := streamAccessUnits()[0]
+	main, err := r.Get("main").Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	other, err := r.Get("broadcast").Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if bytes.Equal(main, other) {
+		t.Errorf("streams encrypted with the same key")
+	}
+}
+
+func TestNewEncryptorRegistry_sharedKeyID(t *testing.T) {
+	cfg := Config{Enabled: true, Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, KeyID: testKeyID, Key: testKey, IV: testIV}
+	fallback, err := NewEncryptor(cfg)
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		streams map[string]TrackKey
+		wantErr string
+	}{
+		{"default", map[string]TrackKey{"broadcast": {KeyID: testKeyID, Key: testAudioKey, IV: testAudioIV}}, "the one of the default stream"},
+		{"streams", map[string]TrackKey{
+			"a": {KeyID: testAudioKeyID, Key: testAudioKey, IV: testAudioIV},
+			"b": {KeyID: strings.ToUpper(testAudioKeyID), Key: testKey, IV: testIV},
+		}, "b stream: key ID is the one of the a stream"},
+		{"invalid key", map[string]TrackKey{"broadcast": {KeyID: testAudioKeyID, Key: "00", IV: testAudioIV}}, "broadcast stream"},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewEncryptorRegistry(cfg, tt.streams, fallback); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: NewEncryptorRegistry() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+)
+
+// SubsampleInfo describes one region of a sample: clear bytes followed by
+// protected bytes, as in the ISO/IEC 23001-7 subsample encryption entry.
+// BytesOfClearData is written with 16 bits, the subsamples of a sample
+// never exceed maxClearData.
+type SubsampleInfo struct {
+	BytesOfClearData     uint32
+	BytesOfProtectedData uint32
+}
+
+// maxClearData is the most clear bytes a subsample entry can describe,
+// longer clear ranges are split over entries without protected data
+const maxClearData = 1<<16 - 1
+
+// subsampleMap collects the subsamples of an access unit while it is
+// encrypted, every byte outside of a protected range is clear
+type subsampleMap struct {
+	subsamples []SubsampleInfo
+	end        int // end of the last protected range
+	protected  int // number of protected ranges
+}
+
+func (m *subsampleMap) reset() {
+	m.subsamples = nil
+	m.end = 0
+	m.protected = 0
+}
+
+// protect adds the protected range of size bytes at offset pos
+func (m *subsampleMap) protect(pos, size int) {
+	if size == 0 {
+		return
+	}
+	m.subsamples = appendClear(m.subsamples, pos-m.end, size)
+	m.end = pos + size
+	m.protected++
+}
+
+// finish returns the subsamples of an access unit of the given size, the
+// subsamples cover all of it
+func (m *subsampleMap) finish(size int) []SubsampleInfo {
+	if size > m.end {
+		m.subsamples = appendClear(m.subsamples, size-m.end, 0)
+	}
+	return m.subsamples
+}
+
+// appendClear appends a subsample of clear bytes followed by protected
+// bytes, preceded by clear-only entries while clear exceeds maxClearData
+func appendClear(subsamples []SubsampleInfo, clear, protected int) []SubsampleInfo {
+	for clear > maxClearData {
+		subsamples = append(subsamples, SubsampleInfo{BytesOfClearData: maxClearData})
+		clear -= maxClearData
+	}
+	return append(subsamples, SubsampleInfo{
+		BytesOfClearData:     uint32(clear),
+		BytesOfProtectedData: uint32(protected),
+	})
+}
+
+// SampleParams holds the per-sample parameters needed to decrypt a sample
+// packaged per ISO/IEC 23001-7
+type SampleParams struct {
+	Scheme      string // "cbcs", "cenc", "cens" or "cbc1"
+	IV          []byte // 8 or 16 bytes, per-sample or constant
+	CryptBlocks int    // for the cbcs and cens pattern, 0:0 means every block
+	SkipBlocks  int    // for the cbcs and cens pattern
+
+	// Escaped is set for samples of the Encryptor, whose protected ranges
+	// carry emulation prevention bytes inserted after encryption; they
+	// are removed before decrypting and inserted anew afterwards
+	Escaped bool
+}
+
+var ErrInvalidSubsamples = errors.New("subsamples do not match sample size")
+
+// DecryptSample decrypts a single sample. Without subsamples the whole
+// sample is protected. In cenc and cens the counter and in cbc1 the chain
+// runs across all protected ranges of the sample, in cbcs the chain
+// restarts from the IV in every protected range. Trailing partial blocks
+// stay clear in all schemes but cenc.
+func DecryptSample(block cipher.Block, params SampleParams, sample []byte, subsamples []SubsampleInfo) ([]byte, error) {
+	if len(params.IV) != 8 && len(params.IV) != 16 {
+		return nil, fmt.Errorf("iv must be 8 or 16 bytes, got %d", len(params.IV))
+	}
+
+	// 8-byte IVs are padded with zeros, which is the block counter of the
+	// CTR schemes
+	iv := make([]byte, 16)
+	copy(iv, params.IV)
+
+	if len(subsamples) == 0 {
+		subsamples = []SubsampleInfo{{BytesOfProtectedData: uint32(len(sample))}}
+	}
+
+	var total int
+	for _, sub := range subsamples {
+		total += int(sub.BytesOfClearData) + int(sub.BytesOfProtectedData)
+	}
+	if total != len(sample) {
+		return nil, fmt.Errorf("%w: %d != %d", ErrInvalidSubsamples, total, len(sample))
+	}
+
+	out := make([]byte, 0, len(sample))
+
+	if !ValidScheme(params.Scheme) {
+		return nil, fmt.Errorf("scheme must be cbcs, cenc, cens or cbc1, got %q", params.Scheme)
+	}
+	c := newRangeCipher(block, params.Scheme, iv, params.CryptBlocks, params.SkipBlocks, true)
+
+	pos := 0
+	for _, sub := range subsamples {
+		out = append(out, sample[pos:pos+int(sub.BytesOfClearData)]...)
+		pos += int(sub.BytesOfClearData)
+
+		protected := sample[pos : pos+int(sub.BytesOfProtectedData)]
+
+		// emulation prevention bytes at the boundaries of a protected
+		// range belong to it
+		if params.Escaped {
+			protected = unescapeAfter(protected, trailingZeros(sample[:pos]))
+		} else {
+			protected = bytes.Clone(protected)
+		}
+
+		c.apply(protected)
+		pos += int(sub.BytesOfProtectedData)
+
+		if !params.Escaped {
+			out = append(out, protected...)
+			continue
+		}
+
+		var zeros int
+		out, zeros = appendEscaped(out, protected, trailingZeros(out))
+		// the clear tail decides about the last emulation prevention byte
+		if zeros >= 2 && pos < len(sample) && sample[pos] <= 3 {
+			out = append(out, 3)
+		}
+	}
+
+	return out, nil
+}
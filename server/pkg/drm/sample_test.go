@@ -0,0 +1,118 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// NIST SP 800-38A test vectors, AES-128
+const (
+	nistKey       = "2b7e151628aed2a6abf7158809cf4f3c"
+	nistPlaintext = "6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" +
+		"f69f2445df4f9b17ad2b417be66c3710"
+
+	// F.2.1 CBC-AES128
+	nistCBCIV         = "000102030405060708090a0b0c0d0e0f"
+	nistCBCCiphertext = "7649abac8119b246cee98e9b12e9197d" +
+		"5086cb9b507219ee95db113a917678b2" +
+		"73bed6b8e3c1743b7116e69e22229516" +
+		"3ff1caa1681fac09120eca307586e1a7"
+
+	// F.5.1 CTR-AES128
+	nistCTRCounter    = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+	nistCTRCiphertext = "874d6191b620e3261bef6864990db6ce" +
+		"9806f66b7970fdff8617187bb9fffdff" +
+		"5ae4df3edbd5d35e5b4f09020db03eab" +
+		"1e031dda2fbe03d1792170a0f3009cee"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDecryptSample_cenc(t *testing.T) {
+	block, _ := aes.NewCipher(mustHex(nistKey))
+	plaintext := mustHex(nistPlaintext)
+	ciphertext := mustHex(nistCTRCiphertext)
+
+	// the counter must run across protected ranges, clear bytes between
+	// them do not consume keystream
+	clearA, clearB := []byte{1, 2, 3}, []byte{4, 5, 6, 7, 8}
+	sample := bytes.Join([][]byte{clearA, ciphertext[:20], clearB, ciphertext[20:]}, nil)
+	want := bytes.Join([][]byte{clearA, plaintext[:20], clearB, plaintext[20:]}, nil)
+
+	got, err := DecryptSample(block, SampleParams{
+		Scheme: "cenc",
+		IV:     mustHex(nistCTRCounter),
+	}, sample, []SubsampleInfo{
+		{BytesOfClearData: 3, BytesOfProtectedData: 20},
+		{BytesOfClearData: 5, BytesOfProtectedData: 44},
+	})
+	if err != nil {
+		t.Fatalf("DecryptSample() returned error: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("DecryptSample() = %x, want %x", got, want)
+	}
+}
+
+func TestDecryptSample_cbcs(t *testing.T) {
+	block, _ := aes.NewCipher(mustHex(nistKey))
+	plaintext := mustHex(nistPlaintext)
+	ciphertext := mustHex(nistCBCCiphertext)
+	skip := bytes.Repeat([]byte{0xee}, 16)
+	partial := []byte{9, 9, 9}
+
+	// 1:1 pattern, the chain links only encrypted blocks, a trailing
+	// partial block stays clear
+	var sample, want []byte
+	for i := 0; i < 4; i++ {
+		sample = append(sample, ciphertext[i*16:i*16+16]...)
+		sample = append(sample, skip...)
+		want = append(want, plaintext[i*16:i*16+16]...)
+		want = append(want, skip...)
+	}
+	sample = append(sample, partial...)
+	want = append(want, partial...)
+
+	// second range restarts the chain from the IV
+	sample = append(append(sample, 0x65), ciphertext[:16]...)
+	want = append(append(want, 0x65), plaintext[:16]...)
+
+	got, err := DecryptSample(block, SampleParams{
+		Scheme:      "cbcs",
+		IV:          mustHex(nistCBCIV),
+		CryptBlocks: 1,
+		SkipBlocks:  1,
+	}, sample, []SubsampleInfo{
+		{BytesOfClearData: 0, BytesOfProtectedData: 4*32 + 3},
+		{BytesOfClearData: 1, BytesOfProtectedData: 16},
+	})
+	if err != nil {
+		t.Fatalf("DecryptSample() returned error: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("DecryptSample() = %x, want %x", got, want)
+	}
+}
+
+func TestDecryptSample_invalidSubsamples(t *testing.T) {
+	block, _ := aes.NewCipher(mustHex(nistKey))
+
+	_, err := DecryptSample(block, SampleParams{
+		Scheme: "cenc",
+		IV:     mustHex(nistCTRCounter),
+	}, make([]byte, 32), []SubsampleInfo{{BytesOfClearData: 1, BytesOfProtectedData: 16}})
+	if !errors.Is(err, ErrInvalidSubsamples) {
+		t.Errorf("DecryptSample() error = %v, want %v", err, ErrInvalidSubsamples)
+	}
+}
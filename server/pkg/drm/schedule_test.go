@@ -0,0 +1,123 @@
+package drm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func TestEncryptor_ApplyProfileAt(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	idrFrame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+	pFrame := nalUnit(0x41, 64)
+
+	tests := []struct {
+		name       string
+		activateAt time.Time
+		wantErr    error
+		// frames encrypted at clock offsets, in order
+		frames     []time.Duration
+		idr        []bool
+		wantSwitch int // index of the frame that switches, -1 for none
+	}{
+		{
+			name:       "future activation waits for time and IDR",
+			activateAt: start.Add(10 * time.Second),
+			frames:     []time.Duration{0, 5 * time.Second, 10 * time.Second, 11 * time.Second},
+			idr:        []bool{true, true, false, true},
+			wantSwitch: 3,
+		},
+		{
+			name:       "IDR exactly at activation time",
+			activateAt: start.Add(10 * time.Second),
+			frames:     []time.Duration{9 * time.Second, 10 * time.Second},
+			idr:        []bool{true, true},
+			wantSwitch: 1,
+		},
+		{
+			name:       "past activation within skew is due now",
+			activateAt: start.Add(-time.Second),
+			frames:     []time.Duration{0, 0},
+			idr:        []bool{false, true},
+			wantSwitch: 1,
+		},
+		{
+			name:       "past activation beyond skew is rejected",
+			activateAt: start.Add(-time.Minute),
+			wantErr:    ErrActivationPast,
+		},
+		{
+			name:       "zero activation time switches at next IDR",
+			frames:     []time.Duration{0},
+			idr:        []bool{true},
+			wantSwitch: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: start}
+			e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+			e.now = clock.now
+
+			var switchedAt = -1
+			var frame int
+			e.OnUpdate(func(u Update) {
+				switchedAt = frame
+			})
+
+			err := e.ApplyProfileAt(testProfile, tt.activateAt)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ApplyProfileAt() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, ok := e.PendingProfile(); ok {
+					t.Errorf("rejected profile is pending")
+				}
+				return
+			}
+
+			if at, ok := e.PendingActivation(); !ok || !at.Equal(tt.activateAt) {
+				t.Errorf("PendingActivation() = %v, %v, want %v", at, ok, tt.activateAt)
+			}
+
+			for i, offset := range tt.frames {
+				frame = i
+				clock.t = start.Add(offset)
+
+				data := pFrame
+				if tt.idr[i] {
+					data = idrFrame
+				}
+				if _, err := e.Encrypt(data); err != nil {
+					t.Fatalf("Encrypt() returned error: %s", err)
+				}
+			}
+
+			if switchedAt != tt.wantSwitch {
+				t.Errorf("switched at frame %d, want %d", switchedAt, tt.wantSwitch)
+			}
+			if _, ok := e.PendingActivation(); ok {
+				t.Errorf("PendingActivation() still set after switch")
+			}
+		})
+	}
+}
+
+func TestEncryptor_ActivationSkew(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	e := newTestEncryptor(t, Config{Mode: "cenc", ActivationSkew: time.Minute})
+	e.now = (&fakeClock{t: start}).now
+
+	if err := e.ApplyProfileAt(testProfile, start.Add(-30*time.Second)); err != nil {
+		t.Errorf("ApplyProfileAt() within configured skew returned error: %s", err)
+	}
+}
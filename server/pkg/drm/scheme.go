@@ -0,0 +1,149 @@
+package drm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"fmt"
+	"slices"
+)
+
+// schemes are the protection schemes of ISO/IEC 23001-7 the encryptor
+// implements: cenc (AES-CTR) and cbc1 (AES-CBC) protect every block, cens
+// (AES-CTR) and cbcs (AES-CBC) encrypt with a pattern
+var schemes = []string{"cbcs", "cenc", "cens", "cbc1"}
+
+// ValidScheme reports whether the encryptor implements the scheme
+func ValidScheme(mode string) bool {
+	return slices.Contains(schemes, mode)
+}
+
+// PatternScheme reports whether the scheme encrypts with a pattern of
+// crypt and skip blocks
+func PatternScheme(mode string) bool {
+	return mode == "cbcs" || mode == "cens"
+}
+
+// CTRScheme reports whether the scheme encrypts with AES-CTR, which also
+// takes 8-byte IVs: the block counter makes up the other half of the
+// counter block
+func CTRScheme(mode string) bool {
+	return mode == "cenc" || mode == "cens"
+}
+
+// checkIV rejects IVs of a size the scheme does not take, 16 bytes and for
+// the CTR based schemes also 8 bytes, ISO/IEC 23001-7 9.2
+func checkIV(mode string, iv []byte) error {
+	switch {
+	case len(iv) == 16 || len(iv) == 8 && CTRScheme(mode):
+		return nil
+	case CTRScheme(mode):
+		return fmt.Errorf("iv must be 8 or 16 bytes hex or base64 encoded in %s mode, got %d bytes", mode, len(iv))
+	}
+	return fmt.Errorf("iv must be 16 bytes hex or base64 encoded in %s mode, 8 bytes only with cenc or cens, got %d bytes", mode, len(iv))
+}
+
+// rangeCipher encrypts or decrypts the protected ranges of one sample in
+// place, in the order they appear in the sample. The CTR counter of cenc
+// and cens and the CBC chain of cbc1 run across all ranges of the sample,
+// while cbcs restarts the chain from the IV in every range. Skipped blocks
+// neither advance the counter nor take part in the chain, and the block
+// based schemes leave a trailing partial block of a range clear.
+type rangeCipher struct {
+	mode        string
+	block       cipher.Block
+	iv          []byte
+	cryptBlocks int
+	skipBlocks  int
+	decrypt     bool
+
+	// keystream of cenc and cens
+	ctr cipher.Stream
+	// CBC chain of cbc1 and cbcs, the last ciphertext block; scratch holds
+	// the ciphertext of a block while it is decrypted in place
+	chain   [aes.BlockSize]byte
+	scratch [aes.BlockSize]byte
+}
+
+// newRangeCipher creates the cipher of a sample with the 16-byte IV, the
+// pattern is ignored by cenc and cbc1 and 0:0 protects every block
+func newRangeCipher(block cipher.Block, mode string, iv []byte, cryptBlocks, skipBlocks int, decrypt bool) *rangeCipher {
+	if !PatternScheme(mode) || cryptBlocks <= 0 && skipBlocks <= 0 {
+		cryptBlocks, skipBlocks = 1, 0
+	}
+
+	c := &rangeCipher{
+		mode:        mode,
+		block:       block,
+		iv:          iv,
+		cryptBlocks: cryptBlocks,
+		skipBlocks:  skipBlocks,
+		decrypt:     decrypt,
+	}
+
+	if CTRScheme(mode) {
+		c.ctr = cipher.NewCTR(block, iv)
+	} else {
+		copy(c.chain[:], iv)
+	}
+	return c
+}
+
+// rangeCipher returns the cipher of a sample, sampleIV is nil in constant
+// IV mode
+func (s *cipherState) rangeCipher(sampleIV []byte, decrypt bool) *rangeCipher {
+	return newRangeCipher(s.block, s.mode, s.ctrIV(sampleIV), s.cryptBlocks, s.skipBlocks, decrypt)
+}
+
+// audioCipher returns the cipher of an audio sample, which is protected
+// completely whatever the pattern of the profile
+func (s *cipherState) audioCipher(sampleIV []byte, decrypt bool) *rangeCipher {
+	return newRangeCipher(s.block, s.mode, s.ctrIV(sampleIV), 1, 0, decrypt)
+}
+
+// apply encrypts or decrypts the next protected range of the sample
+func (c *rangeCipher) apply(data []byte) {
+	if c.mode == "cenc" {
+		c.ctr.XORKeyStream(data, data)
+		return
+	}
+
+	if c.mode == "cbcs" {
+		copy(c.chain[:], c.iv)
+	}
+
+	blocks := len(data) / aes.BlockSize * aes.BlockSize
+	crypt, stride := blocks, blocks
+	if c.skipBlocks > 0 {
+		crypt = c.cryptBlocks * aes.BlockSize
+		stride = crypt + c.skipBlocks*aes.BlockSize
+	}
+
+	for pos := 0; pos < blocks; pos += stride {
+		run := data[pos:min(pos+crypt, blocks)]
+		if c.ctr != nil {
+			c.ctr.XORKeyStream(run, run)
+		} else {
+			c.cryptCBC(run)
+		}
+	}
+}
+
+// cryptCBC encrypts or decrypts whole blocks in place, continuing the
+// chain. The chain is kept instead of a cipher.BlockMode, which would have
+// to be created again for every range of cbcs.
+func (c *rangeCipher) cryptCBC(run []byte) {
+	for pos := 0; pos < len(run); pos += aes.BlockSize {
+		b := run[pos : pos+aes.BlockSize]
+		if c.decrypt {
+			copy(c.scratch[:], b)
+			c.block.Decrypt(b, b)
+			subtle.XORBytes(b, b, c.chain[:])
+			c.chain = c.scratch
+		} else {
+			subtle.XORBytes(b, b, c.chain[:])
+			c.block.Encrypt(b, b)
+			copy(c.chain[:], b)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"math/rand"
+	"testing"
+)
+
+// TestRangeCipher_knownAnswer encrypts and decrypts two protected ranges
+// of a sample in every scheme, the expected ciphertext is taken block by
+// block from the NIST SP 800-38A vectors
+func TestRangeCipher_knownAnswer(t *testing.T) {
+	block, _ := aes.NewCipher(mustHex(nistKey))
+
+	split := func(s string) [][]byte {
+		var blocks [][]byte
+		for b := mustHex(s); len(b) > 0; b = b[16:] {
+			blocks = append(blocks, b[:16])
+		}
+		return blocks
+	}
+	p, ctr, cbc := split(nistPlaintext), split(nistCTRCiphertext), split(nistCBCCiphertext)
+	skip := bytes.Repeat([]byte{0xee}, 16)
+	partial := []byte{9, 9, 9}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		scheme      string
+		iv          string
+		cryptBlocks int
+		skipBlocks  int
+		plain       [2][]byte
+		want        [2][]byte
+	}{
+		{
+			// the counter runs across the ranges and encrypts partial blocks
+			scheme: "cenc",
+			iv:     nistCTRCounter,
+			plain:  [2][]byte{join(p[0], p[1][:4]), join(p[1][4:], p[2], p[3])},
+			want:   [2][]byte{join(ctr[0], ctr[1][:4]), join(ctr[1][4:], ctr[2], ctr[3])},
+		},
+		{
+			// the counter advances only over encrypted blocks
+			scheme:      "cens",
+			iv:          nistCTRCounter,
+			cryptBlocks: 1,
+			skipBlocks:  1,
+			plain:       [2][]byte{join(p[0], skip, p[1], skip, partial), join(p[2], skip, p[3])},
+			want:        [2][]byte{join(ctr[0], skip, ctr[1], skip, partial), join(ctr[2], skip, ctr[3])},
+		},
+		{
+			// the chain runs across the ranges, partial blocks stay clear
+			scheme: "cbc1",
+			iv:     nistCBCIV,
+			plain:  [2][]byte{join(p[0], p[1], partial), join(p[2], p[3])},
+			want:   [2][]byte{join(cbc[0], cbc[1], partial), join(cbc[2], cbc[3])},
+		},
+		{
+			// the chain links only encrypted blocks and restarts per range
+			scheme:      "cbcs",
+			iv:          nistCBCIV,
+			cryptBlocks: 1,
+			skipBlocks:  1,
+			plain:       [2][]byte{join(p[0], skip, p[1], skip, partial), join(p[0], skip, p[1])},
+			want:        [2][]byte{join(cbc[0], skip, cbc[1], skip, partial), join(cbc[0], skip, cbc[1])},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			c := newRangeCipher(block, tt.scheme, mustHex(tt.iv), tt.cryptBlocks, tt.skipBlocks, false)
+			for i, plain := range tt.plain {
+				got := bytes.Clone(plain)
+				c.apply(got)
+				if !bytes.Equal(got, tt.want[i]) {
+					t.Errorf("range %d: encrypted = %x, want %x", i, got, tt.want[i])
+				}
+			}
+
+			// a clear byte between the ranges
+			sample := join([]byte{0x65}, tt.want[0], []byte{0x65}, tt.want[1])
+			got, err := DecryptSample(block, SampleParams{
+				Scheme:      tt.scheme,
+				IV:          mustHex(tt.iv),
+				CryptBlocks: tt.cryptBlocks,
+				SkipBlocks:  tt.skipBlocks,
+			}, sample, []SubsampleInfo{
+				{BytesOfClearData: 1, BytesOfProtectedData: uint32(len(tt.want[0]))},
+				{BytesOfClearData: 1, BytesOfProtectedData: uint32(len(tt.want[1]))},
+			})
+			if err != nil {
+				t.Fatalf("DecryptSample() returned error: %s", err)
+			}
+			if want := join([]byte{0x65}, tt.plain[0], []byte{0x65}, tt.plain[1]); !bytes.Equal(got, want) {
+				t.Errorf("DecryptSample() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+// referenceCBC applies a CBC scheme to the protected ranges of a sample
+// with a cipher.BlockMode of the standard library, created for every range
+// of cbcs, as the encryptor once did
+func referenceCBC(block cipher.Block, mode string, iv []byte, cryptBlocks, skipBlocks int, decrypt bool, ranges [][]byte) {
+	newCBC := func() cipher.BlockMode {
+		if decrypt {
+			return cipher.NewCBCDecrypter(block, iv)
+		}
+		return cipher.NewCBCEncrypter(block, iv)
+	}
+
+	if mode == "cbc1" || cryptBlocks <= 0 && skipBlocks <= 0 {
+		cryptBlocks, skipBlocks = 1, 0
+	}
+
+	cbc := newCBC()
+	for _, data := range ranges {
+		if mode == "cbcs" {
+			cbc = newCBC()
+		}
+
+		blocks := len(data) / aes.BlockSize * aes.BlockSize
+		crypt, stride := blocks, blocks
+		if skipBlocks > 0 {
+			crypt = cryptBlocks * aes.BlockSize
+			stride = crypt + skipBlocks*aes.BlockSize
+		}
+		for pos := 0; pos < blocks; pos += stride {
+			run := data[pos:min(pos+crypt, blocks)]
+			cbc.CryptBlocks(run, run)
+		}
+	}
+}
+
+// TestRangeCipher_cbcReference guards the CBC chain of the range cipher
+// against the standard library on random ranges and patterns
+func TestRangeCipher_cbcReference(t *testing.T) {
+	block, _ := aes.NewCipher(mustHex(testKey))
+	iv := mustHex(testIV)
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 200; i++ {
+		mode := []string{"cbcs", "cbc1"}[i%2]
+		cryptBlocks, skipBlocks := rnd.Intn(4), rnd.Intn(10)
+
+		var ranges [][]byte
+		for n := rnd.Intn(5) + 1; n > 0; n-- {
+			r := make([]byte, rnd.Intn(600))
+			rnd.Read(r)
+			ranges = append(ranges, r)
+		}
+
+		for _, decrypt := range []bool{false, true} {
+			want := make([][]byte, len(ranges))
+			for j, r := range ranges {
+				want[j] = bytes.Clone(r)
+			}
+			referenceCBC(block, mode, iv, cryptBlocks, skipBlocks, decrypt, want)
+
+			c := newRangeCipher(block, mode, iv, cryptBlocks, skipBlocks, decrypt)
+			for j, r := range ranges {
+				got := bytes.Clone(r)
+				c.apply(got)
+				if !bytes.Equal(got, want[j]) {
+					t.Fatalf("%s %d:%d decrypt %v: range %d differs from the standard library", mode, cryptBlocks, skipBlocks, decrypt, j)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkRangeCipher encrypts the ranges of a cbcs sample with the 1:9
+// pattern, a range per NAL unit, against a cipher.BlockMode per range
+func BenchmarkRangeCipher(b *testing.B) {
+	block, _ := aes.NewCipher(mustHex(testKey))
+	iv := mustHex(testIV)
+
+	ranges := make([][]byte, 64)
+	for i := range ranges {
+		ranges[i] = make([]byte, 1500)
+	}
+
+	b.Run("chain", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(64 * 1500)
+		for i := 0; i < b.N; i++ {
+			c := newRangeCipher(block, "cbcs", iv, 1, 9, false)
+			for _, r := range ranges {
+				c.apply(r)
+			}
+		}
+	})
+
+	b.Run("blockmode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(64 * 1500)
+		for i := 0; i < b.N; i++ {
+			referenceCBC(block, "cbcs", iv, 1, 9, false, ranges)
+		}
+	})
+}
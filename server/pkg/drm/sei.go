@@ -0,0 +1,208 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// KeySEIUUID identifies the user data unregistered SEI carrying KeySEI
+var KeySEIUUID = [16]byte{
+	0x6e, 0x65, 0x6b, 0x6f, 0x2d, 0x64, 0x72, 0x6d,
+	0x9c, 0x41, 0x4b, 0x2e, 0x8f, 0x3a, 0x51, 0xd7,
+}
+
+const (
+	keySEIVersion = 3
+	// version, key ID hash, generation, IV mode and sample IV
+	keySEISize = 1 + 8 + 8 + 1 + 16
+	// version 2 carries an 8-byte sample IV, version 1 none
+	keySEISizeV2 = keySEISize - 8
+	keySEISizeV1 = keySEISize - 16
+
+	seiUserDataUnregistered = 5
+)
+
+// IV modes as signaled in the key SEI
+var keySEIIVModes = []string{IVModeConstant, IVModeCounter, IVModeDerived}
+
+// KeySEI is the in-band signaling of the key protecting an access unit, for
+// consumers that only see the byte stream
+type KeySEI struct {
+	// first 8 bytes of the SHA-256 of the key ID
+	KeyIDHash  [8]byte
+	Generation uint64
+	IVMode     string
+	// IV of the access unit in counter and derived mode, zero otherwise;
+	// the 8-byte IVs of cenc and cens are followed by zeros, the block
+	// counter of their counter block
+	SampleIV [16]byte
+}
+
+// KeyIDHash returns the truncated key ID hash as carried in the KeySEI
+func KeyIDHash(keyID []byte) [8]byte {
+	sum := sha256.Sum256(keyID)
+
+	var hash [8]byte
+	copy(hash[:], sum[:])
+	return hash
+}
+
+// Matches reports whether the SEI was written for the given key ID
+func (s KeySEI) Matches(keyID []byte) bool {
+	return s.KeyIDHash == KeyIDHash(keyID)
+}
+
+// BuildKeySEI returns a start code prefixed H.264 SEI NAL unit carrying s
+func BuildKeySEI(s KeySEI) []byte {
+	return buildKeySEI(CodecH264, s)
+}
+
+// BuildHEVCKeySEI returns a start code prefixed H.265 prefix SEI NAL unit
+// carrying s
+func BuildHEVCKeySEI(s KeySEI) []byte {
+	return buildKeySEI(CodecH265, s)
+}
+
+func buildKeySEI(codec nalCodec, s KeySEI) []byte {
+	payload := make([]byte, 0, 16+keySEISize)
+	payload = append(payload, KeySEIUUID[:]...)
+	payload = append(payload, keySEIVersion)
+	payload = append(payload, s.KeyIDHash[:]...)
+	payload = binary.BigEndian.AppendUint64(payload, s.Generation)
+
+	mode := byte(0)
+	for i, m := range keySEIIVModes {
+		if m == s.IVMode {
+			mode = byte(i)
+		}
+	}
+	payload = append(payload, mode)
+	payload = append(payload, s.SampleIV[:]...)
+
+	// payload type, size, message and rbsp trailing bits
+	rbsp := []byte{seiUserDataUnregistered, byte(len(payload))}
+	rbsp = append(rbsp, payload...)
+	rbsp = append(rbsp, 0x80)
+
+	nalu := append([]byte{0, 0, 0, 1}, codec.seiHeader()...)
+	return append(nalu, escapeRBSP(rbsp)...)
+}
+
+// keySEI returns the KeySEI NAL unit of the state for an access unit, an
+// encryptor always asks for the same codec. It is built once unless the IV
+// changes with every sample.
+func (s *cipherState) keySEI(codec nalCodec, sampleIV []byte) []byte {
+	if sei := s.built.sei.Load(); sei != nil {
+		return *sei
+	}
+
+	sei := KeySEI{
+		KeyIDHash:  KeyIDHash(s.keyID),
+		Generation: s.generation,
+		IVMode:     s.ivMode,
+	}
+	if sampleIV != nil {
+		copy(sei.SampleIV[:], sampleIV)
+		return buildKeySEI(codec, sei)
+	}
+
+	nalu := buildKeySEI(codec, sei)
+	s.built.sei.Store(&nalu)
+	return nalu
+}
+
+// ParseKeySEI finds the KeySEI in an Annex-B access unit
+func ParseKeySEI(au []byte) (KeySEI, bool) {
+	for _, nalu := range parseNALUnits(au) {
+		if s, ok := ParseKeySEINAL(nalu[startCodeLen(nalu):]); ok {
+			return s, true
+		}
+	}
+	return KeySEI{}, false
+}
+
+// ParseKeySEINAL parses a single H.264 or H.265 NAL unit without start
+// code, it reports false for anything but a KeySEI
+func ParseKeySEINAL(nalu []byte) (KeySEI, bool) {
+	// the H.265 prefix SEI header is no H.264 SEI and vice versa
+	var hl int
+	switch {
+	case len(nalu) > 2 && nalCodec(CodecH265).nalType(nalu) == 39:
+		hl = 2
+	case len(nalu) > 1 && nalCodec(CodecH264).nalType(nalu) == 6:
+		hl = 1
+	default:
+		return KeySEI{}, false
+	}
+
+	rbsp := unescapeRBSP(nalu[hl:])
+	for len(rbsp) > 1 {
+		var payloadType, payloadSize int
+		for len(rbsp) > 0 && rbsp[0] == 0xFF {
+			payloadType += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			break
+		}
+		payloadType += int(rbsp[0])
+		rbsp = rbsp[1:]
+
+		for len(rbsp) > 0 && rbsp[0] == 0xFF {
+			payloadSize += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			break
+		}
+		payloadSize += int(rbsp[0])
+		rbsp = rbsp[1:]
+
+		if payloadSize > len(rbsp) {
+			break
+		}
+		payload := rbsp[:payloadSize]
+		rbsp = rbsp[payloadSize:]
+
+		if payloadType != seiUserDataUnregistered || payloadSize < 16+keySEISizeV1 ||
+			!bytes.Equal(payload[:16], KeySEIUUID[:]) {
+			continue
+		}
+
+		version := payload[16]
+		if !(version == 1 && payloadSize == 16+keySEISizeV1) &&
+			!(version == 2 && payloadSize == 16+keySEISizeV2) &&
+			!(version == keySEIVersion && payloadSize == 16+keySEISize) {
+			continue
+		}
+
+		var s KeySEI
+		copy(s.KeyIDHash[:], payload[17:25])
+		s.Generation = binary.BigEndian.Uint64(payload[25:33])
+		if mode := int(payload[33]); mode < len(keySEIIVModes) {
+			s.IVMode = keySEIIVModes[mode]
+		}
+		copy(s.SampleIV[:], payload[34:])
+		return s, true
+	}
+
+	return KeySEI{}, false
+}
+
+// insertBeforeVCL inserts the NAL unit before the first slice of the access
+// unit, where SEI has to be placed, and returns where it was inserted
+func (c nalCodec) insertBeforeVCL(au, nalu []byte) ([]byte, int) {
+	pos := len(au)
+	for _, r := range findNALUnits(nil, au) {
+		if payload := r.nalu(au); len(payload) > 0 && c.isVCL(c.nalType(payload)) {
+			pos = r.offset
+			break
+		}
+	}
+
+	out := make([]byte, 0, len(au)+len(nalu))
+	out = append(out, au[:pos]...)
+	out = append(out, nalu...)
+	return append(out, au[pos:]...), pos
+}
@@ -0,0 +1,159 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestKeySEI_roundTrip(t *testing.T) {
+	for _, mode := range []string{"cbcs", "cenc"} {
+		t.Run(mode, func(t *testing.T) {
+			// a small generation has zero bytes needing emulation prevention
+			e := newTestEncryptor(t, Config{Mode: mode, CryptBlocks: 1, SkipBlocks: 9, KeySEI: true, Generation: 7})
+
+			keyID, _ := hex.DecodeString(testKeyID)
+			key, _ := hex.DecodeString(testKey)
+			iv, _ := hex.DecodeString(testIV)
+			block, _ := aes.NewCipher(key)
+
+			frames := [][]byte{
+				append(append(nalUnit(0x67, 12), nalUnit(0x68, 4)...), nalUnit(0x65, 500)...),
+				append(nalUnit(0x41, 300), nalUnit(0x41, 40)...),
+			}
+
+			headers := newSliceHeaders()
+			var overhead int
+			for i, frame := range frames {
+				out, err := e.Encrypt(frame)
+				if err != nil {
+					t.Fatalf("Encrypt() returned error: %s", err)
+				}
+
+				sei, ok := ParseKeySEI(out)
+				if !ok {
+					t.Fatalf("frame %d: ParseKeySEI() found no SEI", i)
+				}
+				if !sei.Matches(keyID) || sei.Generation != 7 || sei.IVMode != defaultIVMode(mode) {
+					t.Errorf("frame %d: ParseKeySEI() = %+v, want generation 7 of %s", i, sei, testKeyID)
+				}
+
+				// the per-sample IV is all a byte stream consumer has
+				auIV := iv
+				if sei.IVMode == IVModeCounter {
+					auIV = sei.SampleIV[:]
+				}
+
+				// SEI sits before the first slice and is the only addition
+				nalu := BuildKeySEI(sei)
+				overhead += len(nalu)
+				want, _ := nalCodec(CodecH264).insertBeforeVCL(frame, nalu)
+				if got := clientDecryptCodec(CodecH264, headers, block, auIV, e.Profile(), out); !bytes.Equal(got, want) {
+					t.Errorf("frame %d: decrypted access unit does not match source with SEI", i)
+				}
+			}
+
+			if got := e.Stats().OverheadBytes; got != uint64(overhead) {
+				t.Errorf("Stats().OverheadBytes = %d, want %d", got, overhead)
+			}
+		})
+	}
+}
+
+func TestKeySEI_cbc1SampleIV(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbc1", KeySEI: true})
+
+	frame := append(nalUnit(0x67, 12), nalUnit(0x65, 500)...)
+	for i := uint64(0); i < 2; i++ {
+		out, err := e.Encrypt(frame)
+		if err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+
+		// the whole 16-byte IV that starts the CBC chain
+		sei, ok := ParseKeySEI(out)
+		if !ok || !bytes.Equal(sei.SampleIV[:], e.SampleIV(i)) {
+			t.Errorf("frame %d: ParseKeySEI() sample IV = %x, want %x", i, sei.SampleIV, e.SampleIV(i))
+		}
+	}
+}
+
+func TestKeySEI_disabled(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Generation: 7})
+
+	frame := append(nalUnit(0x67, 12), nalUnit(0x65, 500)...)
+	out, err := e.Encrypt(frame)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+
+	if _, ok := ParseKeySEI(out); ok {
+		t.Errorf("ParseKeySEI() found a SEI with the feature off")
+	}
+	if len(out) != len(frame) {
+		t.Errorf("Encrypt() changed the size from %d to %d", len(frame), len(out))
+	}
+	if got := e.Stats().OverheadBytes; got != 0 {
+		t.Errorf("Stats().OverheadBytes = %d, want 0", got)
+	}
+}
+
+func TestParseKeySEINAL_foreign(t *testing.T) {
+	// SEI with a different user data UUID and a recovery point
+	foreign := []byte{0x06,
+		0x05, 0x12, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 0xaa, 0xbb,
+		0x06, 0x01, 0xc4,
+		0x80,
+	}
+	if _, ok := ParseKeySEINAL(foreign); ok {
+		t.Errorf("ParseKeySEINAL() accepted a foreign SEI")
+	}
+
+	// all zero fields stress emulation prevention
+	nalu := BuildKeySEI(KeySEI{IVMode: IVModeConstant})
+	if bytes.Contains(nalu[4:], []byte{0, 0, 0}) || bytes.Contains(nalu[4:], []byte{0, 0, 1}) {
+		t.Errorf("BuildKeySEI() emulates a start code: %x", nalu)
+	}
+	if got, ok := ParseKeySEINAL(nalu[4:]); !ok || got != (KeySEI{IVMode: IVModeConstant}) {
+		t.Errorf("ParseKeySEINAL() = %+v, %v, want zero SEI", got, ok)
+	}
+}
+
+func TestParseKeySEINAL_version1(t *testing.T) {
+	// written before the sample IV was added
+	payload := append(KeySEIUUID[:], 1)
+	payload = append(payload, 1, 2, 3, 4, 5, 6, 7, 8)
+	payload = append(payload, 0, 0, 0, 0, 0, 0, 0, 9)
+	payload = append(payload, 0)
+
+	rbsp := append([]byte{seiUserDataUnregistered, byte(len(payload))}, payload...)
+	nalu := append([]byte{0x06}, escapeRBSP(append(rbsp, 0x80))...)
+
+	want := KeySEI{KeyIDHash: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, Generation: 9, IVMode: IVModeConstant}
+	if got, ok := ParseKeySEINAL(nalu); !ok || got != want {
+		t.Errorf("ParseKeySEINAL() = %+v, %v, want %+v", got, ok, want)
+	}
+}
+
+func TestParseKeySEINAL_version2(t *testing.T) {
+	// written while sample IVs were 8 bytes
+	payload := append(KeySEIUUID[:], 2)
+	payload = append(payload, 1, 2, 3, 4, 5, 6, 7, 8)
+	payload = append(payload, 0, 0, 0, 0, 0, 0, 0, 9)
+	payload = append(payload, 1)
+	payload = append(payload, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8)
+
+	rbsp := append([]byte{seiUserDataUnregistered, byte(len(payload))}, payload...)
+	nalu := append([]byte{0x06}, escapeRBSP(append(rbsp, 0x80))...)
+
+	want := KeySEI{
+		KeyIDHash:  [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Generation: 9,
+		IVMode:     IVModeCounter,
+		SampleIV:   [16]byte{0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8},
+	}
+	if got, ok := ParseKeySEINAL(nalu); !ok || got != want {
+		t.Errorf("ParseKeySEINAL() = %+v, %v, want %+v", got, ok, want)
+	}
+}
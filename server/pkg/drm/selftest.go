@@ -0,0 +1,95 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrSelfTest is returned by NewEncryptor when the known answer test fails,
+// the AES implementation of the build does not produce what decryptors
+// expect
+var ErrSelfTest = errors.New("encryptor self-test failed")
+
+// Key material of the known answer test, the AES key and IV of the
+// examples of NIST SP 800-38A
+const (
+	selfTestKeyID = "00112233445566778899aabbccddeeff"
+	selfTestKey   = "2b7e151628aed2a6abf7158809cf4f3c"
+	selfTestIV    = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+)
+
+// selfTestAccessUnit is an H.264 access unit of an SPS, a PPS and an IDR
+// slice of which the header is parsed
+const selfTestAccessUnit = "" +
+	"000000016742001feca02802dc800000000168ce3c8000000001658881000f4c" +
+	"1415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f30313233" +
+	"3435363738393a3b3c3d3e3f404142434445464748494a4b4c4d4e4f50515253" +
+	"5455565758595a5b5c5d5e5f606162636465666768696a6b6c6d6e6f70717273" +
+	"7475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f90919293" +
+	"9495969798999a9b9c9d9e9fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3" +
+	"b4b5b6b7b8b9babbbcbdbebfc0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3" +
+	"d4d5d6d7d8d9dadb80"
+
+// selfTestVectors are the access unit encrypted by a reference
+// implementation independent of this package, OpenSSL applying the
+// subsample layout of ISO/IEC 23001-7 to the slice
+var selfTestVectors = []struct {
+	mode string
+	want string
+}{
+	{"cbcs", "" +
+		"000000016742001feca02802dc800000000168ce3c8000000001658881000f4c" +
+		"1415161718191a1b1c1d1ed3f613a7bf72e81888c9527f690a1ae02f30313233" +
+		"3435363738393a3b3c3d3e3f404142434445464748494a4b4c4d4e4f50515253" +
+		"5455565758595a5b5c5d5e5f606162636465666768696a6b6c6d6e6f70717273" +
+		"7475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f90919293" +
+		"9495969798999a9b9c9d9e9fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3" +
+		"b4b5b6b7b8b9babbbcbdbea5b1e0d28fc5c52f13e481255d92beeecfd0d1d2d3" +
+		"d4d5d6d7d8d9dadb80",
+	},
+	{"cenc", "" +
+		"000000016742001feca02802dc800000000168ce3c8000000001658881000f4c" +
+		"1415161718191a1b1c1d1e130f9a9479fd420c3ed6d41fb0df662c809fadc0d9" +
+		"ed5805d79df8ec72bd8df01c60e14ed74f041fb12b8d9cc4250bac9647f826c7" +
+		"4ee5c26c0bfdd09066c30643e1aaec6b9329cf0b9377936b3913412d6d953487" +
+		"1c5e9b67f3968c8dab29a21506d91b034ce053d5485ada77f9e020f03b8474a5" +
+		"7cddf1f1ab11618098f3eed9d543e85e532f50c941edab07c1757bc977d34e9e" +
+		"b7dcdc8114d3e52138dd1b6e740d7bb6293e6770ddc1beb4901c44f3528fb589" +
+		"f7ce40d49ba0b27680",
+	},
+}
+
+// selfTest encrypts the known answer access unit with cbcs 1:9 and cenc
+// and compares the ciphertext with the reference
+func selfTest() error {
+	au, _ := hex.DecodeString(selfTestAccessUnit)
+	for _, v := range selfTestVectors {
+		e, err := NewEncryptor(Config{
+			Enabled:      true,
+			KeyID:        selfTestKeyID,
+			Key:          selfTestKey,
+			IV:           selfTestIV,
+			Mode:         v.mode,
+			IVNonce:      zeroIVNonce,
+			CryptBlocks:  1,
+			SkipBlocks:   9,
+			Codec:        CodecH264,
+			NALFormat:    NALFormatAnnexB,
+			SkipSelfTest: true,
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrSelfTest, v.mode, err)
+		}
+
+		got, err := e.Encrypt(au)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrSelfTest, v.mode, err)
+		}
+		if want, _ := hex.DecodeString(v.want); !bytes.Equal(got, want) {
+			return fmt.Errorf("%w: %s ciphertext differs from the known answer", ErrSelfTest, v.mode)
+		}
+	}
+	return nil
+}
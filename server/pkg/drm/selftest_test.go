@@ -0,0 +1,45 @@
+package drm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	if err := selfTest(); err != nil {
+		t.Fatalf("selfTest() returned error: %s", err)
+	}
+
+	for i, v := range selfTestVectors {
+		// flip the last byte of the ciphertext of one scheme
+		tampered := v.want[:len(v.want)-2] + "00"
+		if tampered == v.want {
+			tampered = v.want[:len(v.want)-2] + "01"
+		}
+
+		selfTestVectors[i].want = tampered
+		err := selfTest()
+		_, newErr := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV})
+		_, skipErr := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, SkipSelfTest: true})
+		selfTestVectors[i].want = v.want
+
+		if !errors.Is(err, ErrSelfTest) || !strings.Contains(err.Error(), v.mode) {
+			t.Errorf("%s: selfTest() error = %v, want %v naming the scheme", v.mode, err, ErrSelfTest)
+		}
+		if !errors.Is(newErr, ErrSelfTest) {
+			t.Errorf("%s: NewEncryptor() error = %v, want %v", v.mode, newErr, ErrSelfTest)
+		}
+		if skipErr != nil {
+			t.Errorf("%s: NewEncryptor() with SkipSelfTest returned error: %s", v.mode, skipErr)
+		}
+	}
+}
+
+func BenchmarkSelfTest(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if err := selfTest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
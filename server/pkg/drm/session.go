@@ -0,0 +1,230 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrSessionLimit is returned by EncryptorFactory.Acquire when the
+	// maximum number of sessions with keys of their own is reached
+	ErrSessionLimit = errors.New("drm session limit reached")
+	// ErrFactoryClosed is returned by EncryptorFactory.Acquire after Close
+	ErrFactoryClosed = errors.New("drm encryptor factory is closed")
+)
+
+// minSessionSecret is the smallest master secret session keys are derived
+// from, the size of a content key
+const minSessionSecret = 16
+
+// EncryptorFactory creates the encryptors of viewer sessions, every session
+// gets content keys of its own derived from a master secret, so that a
+// leaked key names the session it was issued to. The keys are derived again
+// whenever asked for, only the encryptors are kept while sessions use them.
+type EncryptorFactory struct {
+	config      Config
+	secret      []byte
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]*factorySession
+	closed   bool
+}
+
+type factorySession struct {
+	tracks *EncryptorSet
+	refs   int
+}
+
+// NewEncryptorFactory creates encryptors configured like cfg for every
+// track it has a key for, with keys derived from secret instead. At most
+// maxSessions sessions hold encryptors at the same time, 0 is unlimited.
+func NewEncryptorFactory(cfg Config, secret []byte, maxSessions int) (*EncryptorFactory, error) {
+	if len(secret) < minSessionSecret {
+		return nil, fmt.Errorf("session secret must be at least %d bytes, got %d", minSessionSecret, len(secret))
+	}
+	if maxSessions < 0 {
+		return nil, fmt.Errorf("max sessions must not be negative, got %d", maxSessions)
+	}
+
+	f := &EncryptorFactory{
+		config:      cfg,
+		secret:      bytes.Clone(secret),
+		maxSessions: maxSessions,
+		sessions:    map[string]*factorySession{},
+	}
+
+	// configuration errors surface now instead of with the first viewer
+	if _, err := NewEncryptorSet(f.sessionConfig("")); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Acquire returns the encryptors of a session, creating them for its first
+// user. Every call has to be paired with Release. Encryptors created again
+// for a session reconnecting have its keys and IVs but a new IV nonce, so
+// that their per-sample IVs do not repeat those of the last ones.
+func (f *EncryptorFactory) Acquire(sessionID string) (*EncryptorSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, ErrFactoryClosed
+	}
+
+	if session, ok := f.sessions[sessionID]; ok {
+		session.refs++
+		return session.tracks, nil
+	}
+
+	if f.maxSessions > 0 && len(f.sessions) >= f.maxSessions {
+		return nil, fmt.Errorf("%w: %d sessions", ErrSessionLimit, f.maxSessions)
+	}
+
+	tracks, err := NewEncryptorSet(f.sessionConfig(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	f.sessions[sessionID] = &factorySession{tracks: tracks, refs: 1}
+	return tracks, nil
+}
+
+// Release gives up a use of the encryptors of a session, they are dropped
+// with the last one
+func (f *EncryptorFactory) Release(sessionID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.sessions[sessionID]
+	if !ok {
+		return
+	}
+
+	session.refs--
+	if session.refs <= 0 {
+		delete(f.sessions, sessionID)
+	}
+}
+
+// Close closes the encryptors of every session and overwrites the master
+// secret with zeros. Like Encryptor.Close it must only be called once
+// nothing encrypts with the encryptors anymore, and keys must not be asked
+// for afterwards.
+func (f *EncryptorFactory) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.closed = true
+
+	for sessionID, session := range f.sessions {
+		session.tracks.Close()
+		delete(f.sessions, sessionID)
+	}
+	clear(f.secret)
+}
+
+// Sessions returns how many sessions hold encryptors
+func (f *EncryptorFactory) Sessions() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.sessions)
+}
+
+// Layers describes the video layers of a session holding encryptors, see
+// Encryptor.ForLayer
+func (f *EncryptorFactory) Layers(sessionID string) []LayerInfo {
+	f.mu.Lock()
+	session, ok := f.sessions[sessionID]
+	f.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if video := session.tracks.Encryptor(TrackVideo); video != nil {
+		return video.Layers()
+	}
+	return nil
+}
+
+// Keys returns the keys of a session by track label, whether or not it
+// holds encryptors; tracks sent clear have none
+func (f *EncryptorFactory) Keys(sessionID string) map[string]TrackKey {
+	keys := map[string]TrackKey{
+		TrackVideo: deriveSessionKey(f.secret, sessionID, TrackVideo),
+	}
+	for track := range f.config.Tracks {
+		keys[track] = deriveSessionKey(f.secret, sessionID, track)
+	}
+	for _, track := range f.config.ClearTracks {
+		delete(keys, track)
+	}
+	return keys
+}
+
+// sessionConfig is the configuration with the keys of a session
+func (f *EncryptorFactory) sessionConfig(sessionID string) Config {
+	cfg := f.config
+	cfg.AutoGenerate = false
+	// the keys of a session are the same every time, its nonce must not be
+	cfg.IVNonce = ""
+
+	keys := f.Keys(sessionID)
+	video := keys[TrackVideo]
+	cfg.KeyID, cfg.Key, cfg.IV = video.KeyID, video.Key, video.IV
+
+	cfg.Tracks = map[string]TrackKey{}
+	for track, key := range keys {
+		if track != TrackVideo {
+			cfg.Tracks[track] = key
+		}
+	}
+	return cfg
+}
+
+// deriveSessionKey derives the key ID, key and IV of a track of a session
+// with HKDF-SHA256, the session ID and track label are the info
+func deriveSessionKey(secret []byte, sessionID, track string) TrackKey {
+	info := []byte("neko drm session key\x00" + track + "\x00" + sessionID)
+	okm := hkdfSHA256(secret, nil, info, 48)
+
+	return TrackKey{
+		KeyID: hex.EncodeToString(okm[:16]),
+		Key:   hex.EncodeToString(okm[16:32]),
+		IV:    hex.EncodeToString(okm[32:48]),
+	}
+}
+
+// hkdfSHA256 is HKDF of RFC 5869 with SHA-256, a nil salt is a string of
+// zeros as long as the hash
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var okm, block []byte
+	for counter := byte(1); len(okm) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		okm = append(okm, block...)
+	}
+	return okm[:length]
+}
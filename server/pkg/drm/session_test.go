@@ -0,0 +1,194 @@
+package drm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestHKDFSHA256(t *testing.T) {
+	// RFC 5869 test cases 1 and 3
+	tests := []struct {
+		secret, salt, info string
+		want               string
+	}{
+		{
+			secret: "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			salt:   "000102030405060708090a0b0c",
+			info:   "f0f1f2f3f4f5f6f7f8f9",
+			want:   "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			secret: "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			want:   "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+
+	for _, tt := range tests {
+		var salt []byte
+		if tt.salt != "" {
+			salt = mustHex(tt.salt)
+		}
+
+		got := hkdfSHA256(mustHex(tt.secret), salt, mustHex(tt.info), len(tt.want)/2)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("hkdfSHA256() = %x, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestEncryptorFactory(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5a}, 32)
+	cfg := Config{
+		Enabled: true,
+		Mode:    "cbcs",
+		Tracks:  map[string]TrackKey{TrackAudio: {}},
+	}
+
+	f, err := NewEncryptorFactory(cfg, secret, 2)
+	if err != nil {
+		t.Fatalf("NewEncryptorFactory() returned error: %s", err)
+	}
+
+	first, err := f.Acquire("first")
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %s", err)
+	}
+	again, _ := f.Acquire("first")
+	if again != first {
+		t.Errorf("Acquire() created new encryptors for a session holding some")
+	}
+	second, err := f.Acquire("second")
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %s", err)
+	}
+
+	// every session and track has a key of its own
+	seen := map[string]bool{}
+	for _, tracks := range []*EncryptorSet{first, second} {
+		for _, track := range []string{TrackVideo, TrackAudio} {
+			e := tracks.Encryptor(track)
+			if e == nil {
+				t.Fatalf("Acquire() has no %s encryptor", track)
+			}
+			if seen[string(e.Key())] || seen[string(e.KeyID())] {
+				t.Errorf("%s key %x is shared", track, e.KeyID())
+			}
+			seen[string(e.Key())], seen[string(e.KeyID())] = true, true
+		}
+	}
+
+	// keys are derived again without the encryptors
+	if got := f.Keys("first")[TrackVideo].KeyID; got != hex.EncodeToString(first.KeyID(TrackVideo)) {
+		t.Errorf("Keys() video key ID = %s, want %x", got, first.KeyID(TrackVideo))
+	}
+	other, _ := NewEncryptorFactory(cfg, bytes.Repeat([]byte{0xa5}, 32), 0)
+	if other.Keys("first")[TrackVideo] == f.Keys("first")[TrackVideo] {
+		t.Errorf("Keys() does not depend on the secret")
+	}
+
+	if _, err := f.Acquire("third"); !errors.Is(err, ErrSessionLimit) {
+		t.Errorf("Acquire() error = %v, want %v", err, ErrSessionLimit)
+	}
+
+	// the first session still has a user after one release
+	f.Release("first")
+	if _, err := f.Acquire("third"); !errors.Is(err, ErrSessionLimit) {
+		t.Errorf("Acquire() error = %v, want %v", err, ErrSessionLimit)
+	}
+	f.Release("first")
+	if _, err := f.Acquire("third"); err != nil {
+		t.Errorf("Acquire() returned error after release: %s", err)
+	}
+	if got := f.Sessions(); got != 2 {
+		t.Errorf("Sessions() = %d, want 2", got)
+	}
+}
+
+func TestEncryptorFactory_reacquire(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5a}, 32)
+	cfg := Config{Enabled: true, Mode: "cenc", IVNonce: testIVNonce}
+
+	f, err := NewEncryptorFactory(cfg, secret, 0)
+	if err != nil {
+		t.Fatalf("NewEncryptorFactory() returned error: %s", err)
+	}
+
+	// a session reconnecting gets encryptors of the same key again
+	frame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+	seen := map[string]bool{}
+	var keys [][]byte
+	for i := 0; i < 3; i++ {
+		tracks, err := f.Acquire("first")
+		if err != nil {
+			t.Fatalf("Acquire() returned error: %s", err)
+		}
+		e := tracks.Encryptor(TrackVideo)
+		keys = append(keys, e.Key())
+
+		for j := 0; j < 3; j++ {
+			sample, err := e.EncryptSample(frame)
+			if err != nil {
+				t.Fatalf("EncryptSample() returned error: %s", err)
+			}
+			if seen[string(sample.IV)] {
+				t.Errorf("acquire %d, sample %d reuses IV %x", i, j, sample.IV)
+			}
+			seen[string(sample.IV)] = true
+		}
+		f.Release("first")
+	}
+
+	if !bytes.Equal(keys[0], keys[1]) || !bytes.Equal(keys[1], keys[2]) {
+		t.Errorf("Acquire() changed the key of the session")
+	}
+}
+
+func TestEncryptorFactory_Close(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5a}, 32)
+	f, err := NewEncryptorFactory(Config{Enabled: true, Mode: "cbcs"}, secret, 0)
+	if err != nil {
+		t.Fatalf("NewEncryptorFactory() returned error: %s", err)
+	}
+
+	tracks, err := f.Acquire("first")
+	if err != nil {
+		t.Fatalf("Acquire() returned error: %s", err)
+	}
+	key := tracks.Encryptor(TrackVideo).state.Load().key
+
+	f.Close()
+
+	if !bytes.Equal(f.secret, make([]byte, len(f.secret))) || !bytes.Equal(key, make([]byte, len(key))) {
+		t.Errorf("Close() left the secret %x or the session key %x", f.secret, key)
+	}
+	if !bytes.Equal(secret, bytes.Repeat([]byte{0x5a}, 32)) {
+		t.Errorf("Close() overwrote the secret of the caller")
+	}
+	if tracks.Encryptor(TrackVideo).Enabled() || f.Sessions() != 0 {
+		t.Errorf("Close() left the session encryptors")
+	}
+	if _, err := f.Acquire("second"); !errors.Is(err, ErrFactoryClosed) {
+		t.Errorf("Acquire() error = %v, want %v", err, ErrFactoryClosed)
+	}
+}
+
+func TestNewEncryptorFactory_invalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         Config
+		secret      []byte
+		maxSessions int
+	}{
+		{"short secret", Config{Enabled: true}, make([]byte, 15), 0},
+		{"negative limit", Config{Enabled: true}, make([]byte, 16), -1},
+		{"invalid mode", Config{Enabled: true, Mode: "cbc"}, make([]byte, 16), 0},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewEncryptorFactory(tt.cfg, tt.secret, tt.maxSessions); err == nil {
+			t.Errorf("%s: NewEncryptorFactory() expected error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// DefaultClearLead is how many bytes of a VCL payload stay clear when its
+// slice header cannot be parsed
+const DefaultClearLead = 32
+
+// h264SPS holds the fields of a sequence parameter set that slice headers
+// depend on
+type h264SPS struct {
+	chromaArrayType         uint64
+	separateColourPlane     bool
+	log2MaxFrameNum         int
+	pocType                 uint64
+	log2MaxPocLsb           int
+	deltaPicOrderAlwaysZero bool
+	frameMbsOnly            bool
+	picSizeInMapUnits       uint64
+}
+
+// h264PPS holds the fields of a picture parameter set that slice headers
+// depend on
+type h264PPS struct {
+	spsID                          uint64
+	entropyCodingMode              bool
+	bottomFieldPicOrderPresent     bool
+	numSliceGroups                 uint64
+	sliceGroupMapType              uint64
+	sliceGroupChangeRate           uint64
+	numRefIdxL0Default             uint64
+	numRefIdxL1Default             uint64
+	weightedPred                   bool
+	weightedBipredIDC              uint64
+	deblockingFilterControlPresent bool
+	redundantPicCntPresent         bool
+}
+
+// errUnknownParameterSet is returned for slices referring to a parameter
+// set that was not seen or was malformed
+var errUnknownParameterSet = errors.New("unknown parameter set")
+
+// sliceHeaders caches the H.264 parameter sets of a stream to find where
+// the slice data of its VCL NAL units starts, ITU-T H.264 7.3.3. It is
+// shared by concurrent calls of the encryptor.
+type sliceHeaders struct {
+	mu  sync.RWMutex
+	sps map[uint64]*h264SPS
+	pps map[uint64]*h264PPS
+}
+
+func newSliceHeaders() *sliceHeaders {
+	return &sliceHeaders{
+		sps: map[uint64]*h264SPS{},
+		pps: map[uint64]*h264PPS{},
+	}
+}
+
+// update caches the SPS or PPS NAL unit without start code, anything else
+// is ignored. A malformed parameter set is forgotten so that slices
+// referring to it fall back to the fixed clear lead, its error returned.
+func (h *sliceHeaders) update(nalu []byte) error {
+	if len(nalu) == 0 {
+		return nil
+	}
+	nalType := nalu[0] & 0x1F
+	if nalType != 7 && nalType != 8 {
+		return nil
+	}
+	if len(nalu) < 2 {
+		return errBitsEnd
+	}
+
+	r := &bitReader{data: unescapeRBSP(nalu[1:])}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if nalType == 7 {
+		id, sps, err := parseSPS(r)
+		if id > 31 {
+			return fmt.Errorf("sps id %d out of range", id)
+		}
+		if err != nil {
+			delete(h.sps, id)
+			return err
+		}
+		h.sps[id] = sps
+		return nil
+	}
+
+	id, pps, err := parsePPS(r)
+	if id > 255 {
+		return fmt.Errorf("pps id %d out of range", id)
+	}
+	if err != nil {
+		delete(h.pps, id)
+		return err
+	}
+	h.pps[id] = pps
+	return nil
+}
+
+// size returns how many bytes of the RBSP of a VCL NAL unit without start
+// code the slice header occupies, including the byte it ends in
+func (h *sliceHeaders) size(nalu, rbsp []byte) (int, bool) {
+	n, err := h.parse(nalu, rbsp)
+	return n, err == nil
+}
+
+// parse reads the slice header of a VCL NAL unit without start code and
+// returns its size like size. Slices referring to parameter sets not seen
+// yet fail with errUnknownParameterSet.
+func (h *sliceHeaders) parse(nalu, rbsp []byte) (int, error) {
+	nalType := nalu[0] & 0x1F
+	// partitions B and C carry no slice header
+	if nalType != 1 && nalType != 2 && nalType != 5 {
+		return 0, fmt.Errorf("nal unit type %d carries no slice header", nalType)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	r := &bitReader{data: rbsp}
+	if err := h.parseSliceHeader(r, nalu[0]); err != nil {
+		return 0, err
+	}
+	if nalType == 2 {
+		r.ue() // slice_id
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	return (r.bits() + 7) / 8, nil
+}
+
+func parseSPS(r *bitReader) (uint64, *h264SPS, error) {
+	profile := r.u(8)
+	r.u(8) // constraint flags
+	r.u(8) // level_idc
+	id := r.ue()
+
+	sps := &h264SPS{chromaArrayType: 1}
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat := r.ue()
+		if chromaFormat == 3 {
+			sps.separateColourPlane = r.flag()
+		}
+		sps.chromaArrayType = chromaFormat
+		if sps.separateColourPlane {
+			sps.chromaArrayType = 0
+		}
+
+		r.ue()   // bit_depth_luma_minus8
+		r.ue()   // bit_depth_chroma_minus8
+		r.flag() // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				skipScalingList(r, size)
+			}
+		}
+	}
+
+	log2MaxFrameNum := r.ue()
+	if log2MaxFrameNum > 12 {
+		return id, nil, fmt.Errorf("log2_max_frame_num_minus4 %d out of range", log2MaxFrameNum)
+	}
+	sps.log2MaxFrameNum = int(log2MaxFrameNum) + 4
+
+	sps.pocType = r.ue()
+	switch sps.pocType {
+	case 0:
+		log2MaxPocLsb := r.ue()
+		if log2MaxPocLsb > 12 {
+			return id, nil, fmt.Errorf("log2_max_pic_order_cnt_lsb_minus4 %d out of range", log2MaxPocLsb)
+		}
+		sps.log2MaxPocLsb = int(log2MaxPocLsb) + 4
+	case 1:
+		sps.deltaPicOrderAlwaysZero = r.flag()
+		r.se() // offset_for_non_ref_pic
+		r.se() // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		if cycle > 255 {
+			return id, nil, fmt.Errorf("num_ref_frames_in_pic_order_cnt_cycle %d out of range", cycle)
+		}
+		for i := uint64(0); i < cycle; i++ {
+			r.se() // offset_for_ref_frame
+		}
+	case 2:
+	default:
+		return id, nil, fmt.Errorf("pic_order_cnt_type %d out of range", sps.pocType)
+	}
+
+	r.ue()   // max_num_ref_frames
+	r.flag() // gaps_in_frame_num_value_allowed_flag
+	width := r.ue() + 1
+	height := r.ue() + 1
+	sps.frameMbsOnly = r.flag()
+	sps.picSizeInMapUnits = width * height
+
+	return id, sps, r.err
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int64(8), int64(8)
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+func parsePPS(r *bitReader) (uint64, *h264PPS, error) {
+	id := r.ue()
+
+	pps := &h264PPS{}
+	pps.spsID = r.ue()
+	pps.entropyCodingMode = r.flag()
+	pps.bottomFieldPicOrderPresent = r.flag()
+	pps.numSliceGroups = r.ue() + 1
+	if pps.numSliceGroups > 8 {
+		return id, nil, fmt.Errorf("num_slice_groups_minus1 %d out of range", pps.numSliceGroups-1)
+	}
+
+	if pps.numSliceGroups > 1 {
+		pps.sliceGroupMapType = r.ue()
+		switch pps.sliceGroupMapType {
+		case 0:
+			for i := uint64(0); i < pps.numSliceGroups; i++ {
+				r.ue() // run_length_minus1
+			}
+		case 2:
+			for i := uint64(0); i < pps.numSliceGroups-1; i++ {
+				r.ue() // top_left
+				r.ue() // bottom_right
+			}
+		case 3, 4, 5:
+			r.flag() // slice_group_change_direction_flag
+			pps.sliceGroupChangeRate = r.ue() + 1
+		case 6:
+			units := r.ue() + 1
+			n := bits.Len64(pps.numSliceGroups - 1)
+			for i := uint64(0); i < units && r.err == nil; i++ {
+				r.u(n) // slice_group_id
+			}
+		}
+	}
+
+	pps.numRefIdxL0Default = r.ue() + 1
+	pps.numRefIdxL1Default = r.ue() + 1
+	pps.weightedPred = r.flag()
+	pps.weightedBipredIDC = r.u(2)
+	r.se() // pic_init_qp_minus26
+	r.se() // pic_init_qs_minus26
+	r.se() // chroma_qp_index_offset
+	pps.deblockingFilterControlPresent = r.flag()
+	r.flag() // constrained_intra_pred_flag
+	pps.redundantPicCntPresent = r.flag()
+
+	return id, pps, r.err
+}
+
+// slice types, slice_type modulo 5
+const (
+	sliceP  = 0
+	sliceB  = 1
+	sliceI  = 2
+	sliceSP = 3
+	sliceSI = 4
+)
+
+// parseSliceHeader reads slice_header() up to the start of slice_data()
+func (h *sliceHeaders) parseSliceHeader(r *bitReader, header byte) error {
+	idr := header&0x1F == 5
+	refIDC := header >> 5 & 3
+
+	r.ue() // first_mb_in_slice
+	sliceType := r.ue()
+	if sliceType > 9 {
+		return fmt.Errorf("slice_type %d out of range", sliceType)
+	}
+	sliceType %= 5
+
+	ppsID := r.ue()
+	pps, ok := h.pps[ppsID]
+	if !ok {
+		return fmt.Errorf("%w: pps %d", errUnknownParameterSet, ppsID)
+	}
+	sps, ok := h.sps[pps.spsID]
+	if !ok {
+		return fmt.Errorf("%w: sps %d", errUnknownParameterSet, pps.spsID)
+	}
+
+	if sps.separateColourPlane {
+		r.u(2) // colour_plane_id
+	}
+	r.u(sps.log2MaxFrameNum) // frame_num
+
+	field := false
+	if !sps.frameMbsOnly {
+		field = r.flag()
+		if field {
+			r.flag() // bottom_field_flag
+		}
+	}
+
+	if idr {
+		r.ue() // idr_pic_id
+	}
+
+	if sps.pocType == 0 {
+		r.u(sps.log2MaxPocLsb) // pic_order_cnt_lsb
+		if pps.bottomFieldPicOrderPresent && !field {
+			r.se() // delta_pic_order_cnt_bottom
+		}
+	}
+	if sps.pocType == 1 && !sps.deltaPicOrderAlwaysZero {
+		r.se() // delta_pic_order_cnt[0]
+		if pps.bottomFieldPicOrderPresent && !field {
+			r.se() // delta_pic_order_cnt[1]
+		}
+	}
+
+	if pps.redundantPicCntPresent {
+		r.ue() // redundant_pic_cnt
+	}
+
+	if sliceType == sliceB {
+		r.flag() // direct_spatial_mv_pred_flag
+	}
+
+	l0, l1 := pps.numRefIdxL0Default, pps.numRefIdxL1Default
+	if sliceType == sliceP || sliceType == sliceSP || sliceType == sliceB {
+		if r.flag() { // num_ref_idx_active_override_flag
+			l0 = r.ue() + 1
+			if sliceType == sliceB {
+				l1 = r.ue() + 1
+			}
+		}
+	}
+	if l0 > 32 || l1 > 32 {
+		return fmt.Errorf("num_ref_idx_active %d:%d out of range", l0, l1)
+	}
+
+	// ref_pic_list_modification()
+	if sliceType != sliceI && sliceType != sliceSI {
+		skipRefPicListModification(r)
+		if sliceType == sliceB {
+			skipRefPicListModification(r)
+		}
+	}
+
+	if (pps.weightedPred && (sliceType == sliceP || sliceType == sliceSP)) ||
+		(pps.weightedBipredIDC == 1 && sliceType == sliceB) {
+		// pred_weight_table()
+		r.ue() // luma_log2_weight_denom
+		if sps.chromaArrayType != 0 {
+			r.ue() // chroma_log2_weight_denom
+		}
+		skipPredWeights(r, l0, sps.chromaArrayType != 0)
+		if sliceType == sliceB {
+			skipPredWeights(r, l1, sps.chromaArrayType != 0)
+		}
+	}
+
+	// dec_ref_pic_marking()
+	if refIDC != 0 {
+		if idr {
+			r.flag() // no_output_of_prior_pics_flag
+			r.flag() // long_term_reference_flag
+		} else if r.flag() { // adaptive_ref_pic_marking_mode_flag
+			for i := 0; r.err == nil; i++ {
+				if i > 66 {
+					return errors.New("too many memory management control operations")
+				}
+				op := r.ue()
+				if op == 0 {
+					break
+				}
+				if op == 1 || op == 3 {
+					r.ue() // difference_of_pic_nums_minus1
+				}
+				if op == 2 {
+					r.ue() // long_term_pic_num
+				}
+				if op == 3 || op == 6 {
+					r.ue() // long_term_frame_idx
+				}
+				if op == 4 {
+					r.ue() // max_long_term_frame_idx_plus1
+				}
+			}
+		}
+	}
+
+	if pps.entropyCodingMode && sliceType != sliceI && sliceType != sliceSI {
+		r.ue() // cabac_init_idc
+	}
+	r.se() // slice_qp_delta
+	if sliceType == sliceSP || sliceType == sliceSI {
+		if sliceType == sliceSP {
+			r.flag() // sp_for_switch_flag
+		}
+		r.se() // slice_qs_delta
+	}
+
+	if pps.deblockingFilterControlPresent {
+		if r.ue() != 1 { // disable_deblocking_filter_idc
+			r.se() // slice_alpha_c0_offset_div2
+			r.se() // slice_beta_offset_div2
+		}
+	}
+
+	if pps.numSliceGroups > 1 && pps.sliceGroupMapType >= 3 && pps.sliceGroupMapType <= 5 {
+		// Ceil(Log2(PicSizeInMapUnits ÷ SliceGroupChangeRate + 1))
+		units := (sps.picSizeInMapUnits + pps.sliceGroupChangeRate - 1) / pps.sliceGroupChangeRate
+		r.u(bits.Len64(units)) // slice_group_change_cycle
+	}
+
+	return r.err
+}
+
+func skipRefPicListModification(r *bitReader) {
+	if !r.flag() { // ref_pic_list_modification_flag
+		return
+	}
+	for i := 0; r.err == nil && i <= 32; i++ {
+		op := r.ue() // modification_of_pic_nums_idc
+		if op == 3 {
+			return
+		}
+		r.ue() // abs_diff_pic_num_minus1 or long_term_pic_num
+	}
+}
+
+func skipPredWeights(r *bitReader, refs uint64, chroma bool) {
+	for i := uint64(0); i < refs && r.err == nil; i++ {
+		if r.flag() { // luma_weight_flag
+			r.se() // luma_weight
+			r.se() // luma_offset
+		}
+		if chroma && r.flag() { // chroma_weight_flag
+			for j := 0; j < 2; j++ {
+				r.se() // chroma_weight
+				r.se() // chroma_offset
+			}
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+)
+
+// bitWriter writes the syntax elements of H.264 parameter sets and slice
+// headers
+type bitWriter struct {
+	buf []byte
+	n   int // in bits
+}
+
+func (w *bitWriter) u(n int, v uint64) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>i&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) flag(b bool) {
+	if b {
+		w.u(1, 1)
+	} else {
+		w.u(1, 0)
+	}
+}
+
+func (w *bitWriter) ue(v uint64) {
+	zeros := 0
+	for (v+1)>>(zeros+1) != 0 {
+		zeros++
+	}
+	w.u(zeros, 0)
+	w.u(zeros+1, v+1)
+}
+
+func (w *bitWriter) se(v int64) {
+	if v > 0 {
+		w.ue(uint64(2*v - 1))
+	} else {
+		w.ue(uint64(-2 * v))
+	}
+}
+
+// h264Params describes the parameter sets with id 0 of a test stream
+type h264Params struct {
+	high           bool // high profile with a scaling list
+	pocType        uint64
+	fields         bool // frame_mbs_only_flag unset
+	cabac          bool
+	bottomFieldPOC bool
+	weightedPred   bool
+	weightedBipred uint64
+}
+
+func (p h264Params) sps() []byte {
+	w := &bitWriter{}
+	if p.high {
+		w.u(8, 100)
+	} else {
+		w.u(8, 66)
+	}
+	w.u(8, 0)  // constraint flags
+	w.u(8, 31) // level_idc
+	w.ue(0)    // seq_parameter_set_id
+	if p.high {
+		w.ue(1)       // chroma_format_idc
+		w.ue(0)       // bit_depth_luma_minus8
+		w.ue(0)       // bit_depth_chroma_minus8
+		w.flag(false) // qpprime_y_zero_transform_bypass_flag
+		w.flag(true)  // seq_scaling_matrix_present_flag
+		w.flag(true)  // seq_scaling_list_present_flag[0]
+		w.se(4)
+		w.se(-12) // next scale 0 ends the list
+		for i := 1; i < 8; i++ {
+			w.flag(false)
+		}
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(p.pocType)
+	switch p.pocType {
+	case 0:
+		w.ue(2) // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		w.flag(false) // delta_pic_order_always_zero_flag
+		w.se(-2)      // offset_for_non_ref_pic
+		w.se(1)       // offset_for_top_to_bottom_field
+		w.ue(2)       // num_ref_frames_in_pic_order_cnt_cycle
+		w.se(2)
+		w.se(2)
+	}
+	w.ue(4)       // max_num_ref_frames
+	w.flag(false) // gaps_in_frame_num_value_allowed_flag
+	w.ue(79)      // pic_width_in_mbs_minus1
+	w.ue(44)      // pic_height_in_map_units_minus1
+	w.flag(!p.fields)
+	w.flag(true)  // direct_8x8_inference_flag
+	w.flag(false) // frame_cropping_flag
+	w.flag(false) // vui_parameters_present_flag
+	return h264NAL(0x67, w.buf)
+}
+
+func (p h264Params) pps() []byte {
+	w := &bitWriter{}
+	w.ue(0) // pic_parameter_set_id
+	w.ue(0) // seq_parameter_set_id
+	w.flag(p.cabac)
+	w.flag(p.bottomFieldPOC)
+	w.ue(0) // num_slice_groups_minus1
+	w.ue(0) // num_ref_idx_l0_default_active_minus1
+	w.ue(0) // num_ref_idx_l1_default_active_minus1
+	w.flag(p.weightedPred)
+	w.u(2, p.weightedBipred)
+	w.se(0)       // pic_init_qp_minus26
+	w.se(0)       // pic_init_qs_minus26
+	w.se(0)       // chroma_qp_index_offset
+	w.flag(true)  // deblocking_filter_control_present_flag
+	w.flag(false) // constrained_intra_pred_flag
+	w.flag(false) // redundant_pic_cnt_present_flag
+	return h264NAL(0x68, w.buf)
+}
+
+// slice returns a slice NAL unit with the header written by fields,
+// followed by size bytes of slice data, and the size of its header
+func (p h264Params) slice(header byte, fields func(w *bitWriter), size int) ([]byte, int) {
+	w := &bitWriter{}
+	fields(w)
+	headerSize := len(w.buf)
+
+	rbsp := w.buf
+	for i := 0; i < size; i++ {
+		rbsp = append(rbsp, byte(i%200+20))
+	}
+	return h264NAL(header, rbsp), headerSize
+}
+
+// h264NAL builds a start code prefixed NAL unit with the rbsp and trailing
+// bits
+func h264NAL(header byte, rbsp []byte) []byte {
+	nalu := append([]byte{0, 0, 0, 1, header}, escapeRBSP(rbsp)...)
+	return append(nalu, 0x80)
+}
+
+// sliceHeaderCases are slice headers of the I, P and B slice types
+var sliceHeaderCases = []struct {
+	name   string
+	params h264Params
+	header byte
+	fields func(w *bitWriter)
+}{
+	{
+		name:   "I slice IDR",
+		header: 0x65,
+		fields: func(w *bitWriter) {
+			w.ue(0)       // first_mb_in_slice
+			w.ue(7)       // slice_type
+			w.ue(0)       // pic_parameter_set_id
+			w.u(4, 0)     // frame_num
+			w.ue(3)       // idr_pic_id
+			w.u(6, 0)     // pic_order_cnt_lsb
+			w.flag(false) // no_output_of_prior_pics_flag
+			w.flag(false) // long_term_reference_flag
+			w.se(-3)      // slice_qp_delta
+			w.ue(0)       // disable_deblocking_filter_idc
+			w.se(1)       // slice_alpha_c0_offset_div2
+			w.se(-1)      // slice_beta_offset_div2
+		},
+	},
+	{
+		name:   "P slice with reference list modification",
+		header: 0x41,
+		fields: func(w *bitWriter) {
+			w.ue(120)
+			w.ue(5)
+			w.ue(0)
+			w.u(4, 3)
+			w.u(6, 6)
+			w.flag(true) // num_ref_idx_active_override_flag
+			w.ue(2)      // num_ref_idx_l0_active_minus1
+			w.flag(true) // ref_pic_list_modification_flag_l0
+			w.ue(0)
+			w.ue(4)
+			w.ue(2)
+			w.ue(1)
+			w.ue(3)
+			w.flag(false) // adaptive_ref_pic_marking_mode_flag
+			w.se(2)
+			w.ue(1) // deblocking disabled, no offsets
+		},
+	},
+	{
+		name:   "P slice with a long header",
+		header: 0x41,
+		fields: func(w *bitWriter) {
+			w.ue(0)
+			w.ue(0)
+			w.ue(0)
+			w.u(4, 9)
+			w.u(6, 18)
+			w.flag(false)
+			w.flag(true)
+			for i := 0; i < 20; i++ {
+				w.ue(1)
+				w.ue(1000)
+			}
+			w.ue(3)
+			w.flag(false)
+			w.se(0)
+			w.ue(1)
+		},
+	},
+	{
+		name:   "P slice with weighted prediction",
+		params: h264Params{weightedPred: true},
+		header: 0x41,
+		fields: func(w *bitWriter) {
+			w.ue(0)
+			w.ue(0)
+			w.ue(0)
+			w.u(4, 1)
+			w.u(6, 2)
+			w.flag(false)
+			w.flag(false)
+			w.ue(5)       // luma_log2_weight_denom
+			w.ue(5)       // chroma_log2_weight_denom
+			w.flag(true)  // luma_weight_l0_flag
+			w.se(3)       // luma_weight_l0
+			w.se(-2)      // luma_offset_l0
+			w.flag(false) // chroma_weight_l0_flag
+			w.flag(false)
+			w.se(0)
+			w.ue(1)
+		},
+	},
+	{
+		name:   "B slice with CABAC and weighted bi-prediction",
+		params: h264Params{high: true, cabac: true, weightedBipred: 1},
+		header: 0x01,
+		fields: func(w *bitWriter) {
+			w.ue(0)
+			w.ue(6)
+			w.ue(0)
+			w.u(4, 2)
+			w.u(6, 4)
+			w.flag(true)  // direct_spatial_mv_pred_flag
+			w.flag(false) // num_ref_idx_active_override_flag
+			w.flag(false) // ref_pic_list_modification_flag_l0
+			w.flag(false) // ref_pic_list_modification_flag_l1
+			w.ue(6)
+			w.ue(6)
+			w.flag(false)
+			w.flag(true) // chroma_weight_l0_flag
+			w.se(1)
+			w.se(-1)
+			w.se(2)
+			w.se(-2)
+			w.flag(true) // luma_weight_l1_flag
+			w.se(5)
+			w.se(5)
+			w.flag(false)
+			w.ue(2) // cabac_init_idc
+			w.se(-1)
+			w.ue(0)
+			w.se(0)
+			w.se(0)
+		},
+	},
+	{
+		name:   "B slice with memory management operations",
+		header: 0x21,
+		fields: func(w *bitWriter) {
+			w.ue(0)
+			w.ue(1)
+			w.ue(0)
+			w.u(4, 5)
+			w.u(6, 10)
+			w.flag(false)
+			w.flag(true) // num_ref_idx_active_override_flag
+			w.ue(1)
+			w.ue(0)
+			w.flag(false)
+			w.flag(false)
+			w.flag(true) // adaptive_ref_pic_marking_mode_flag
+			w.ue(1)
+			w.ue(0)
+			w.ue(3)
+			w.ue(2)
+			w.ue(0)
+			w.ue(0)
+			w.se(4)
+			w.ue(1)
+		},
+	},
+	{
+		name:   "B field with pic order count type 1",
+		params: h264Params{pocType: 1, fields: true, bottomFieldPOC: true},
+		header: 0x01,
+		fields: func(w *bitWriter) {
+			w.ue(0)
+			w.ue(6)
+			w.ue(0)
+			w.u(4, 2)
+			w.flag(false) // field_pic_flag
+			w.se(-1)      // delta_pic_order_cnt[0]
+			w.se(1)       // delta_pic_order_cnt[1]
+			w.flag(false)
+			w.flag(false)
+			w.flag(false)
+			w.flag(false)
+			w.se(0)
+			w.ue(1)
+		},
+	},
+}
+
+func TestBitReader(t *testing.T) {
+	w := &bitWriter{}
+	w.ue(0)
+	w.ue(1)
+	w.ue(254)
+	w.se(-7)
+	w.se(7)
+	w.u(3, 5)
+
+	r := &bitReader{data: w.buf}
+	if got := []any{r.ue(), r.ue(), r.ue(), r.se(), r.se(), r.u(3)}; r.err != nil ||
+		got[0] != uint64(0) || got[1] != uint64(1) || got[2] != uint64(254) ||
+		got[3] != int64(-7) || got[4] != int64(7) || got[5] != uint64(5) {
+		t.Errorf("bitReader read %v, %v", got, r.err)
+	}
+	if r.bits() != w.n {
+		t.Errorf("bits() = %d, want %d", r.bits(), w.n)
+	}
+
+	r.u(8)
+	if r.err == nil {
+		t.Errorf("reading past the end returned no error")
+	}
+}
+
+func TestSliceHeaders_size(t *testing.T) {
+	for _, tt := range sliceHeaderCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newSliceHeaders()
+			h.update(tt.params.sps()[4:])
+			h.update(tt.params.pps()[4:])
+
+			slice, want := tt.params.slice(tt.header, tt.fields, 100)
+			nalu := slice[4:]
+
+			got, ok := h.size(nalu, unescapeRBSP(nalu[1:]))
+			if !ok || got != want {
+				t.Errorf("size() = %d, %v, want %d", got, ok, want)
+			}
+
+			// without parameter sets the header cannot be parsed
+			if _, ok := newSliceHeaders().size(nalu, unescapeRBSP(nalu[1:])); ok {
+				t.Errorf("size() without parameter sets succeeded")
+			}
+		})
+	}
+}
+
+func TestEncryptor_sliceHeaderClear(t *testing.T) {
+	block, _ := aes.NewCipher(mustHex(testKey))
+
+	for _, mode := range []string{"cbcs", "cenc"} {
+		for _, tt := range sliceHeaderCases {
+			t.Run(mode+" "+tt.name, func(t *testing.T) {
+				e := newTestEncryptor(t, Config{Mode: mode, CryptBlocks: 1, SkipBlocks: 9})
+				params := append(tt.params.sps(), tt.params.pps()...)
+				slice, header := tt.params.slice(tt.header, tt.fields, 200)
+
+				// before the parameter sets only the fixed lead stays clear
+				for _, au := range [][]byte{slice, append(params, slice...)} {
+					lead := DefaultClearLead
+					if len(au) > len(slice) {
+						lead = (header + 15) / 16 * 16
+					}
+
+					sample, err := e.EncryptSample(au)
+					if err != nil {
+						t.Fatalf("EncryptSample() returned error: %s", err)
+					}
+
+					out := sample.Data[len(au)-len(slice):]
+					if !bytes.Equal(out[:5+lead], slice[:5+lead]) {
+						t.Errorf("first %d payload bytes changed", lead)
+					}
+					if bytes.Equal(out[5+lead:5+lead+16], slice[5+lead:5+lead+16]) {
+						t.Errorf("first block after %d clear bytes not encrypted", lead)
+					}
+
+					got, err := DecryptSample(block, SampleParams{
+						Scheme:      mode,
+						IV:          sampleIV(mustHex(testIV), sample),
+						CryptBlocks: 1,
+						SkipBlocks:  9,
+						Escaped:     true,
+					}, sample.Data, sample.Subsamples)
+					if err != nil || !bytes.Equal(got, au) {
+						t.Errorf("DecryptSample() = %v, does not match source", err)
+					}
+				}
+			})
+		}
+	}
+}
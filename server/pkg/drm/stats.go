@@ -0,0 +1,223 @@
+package drm
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds cumulative encryptor counters
+type Stats struct {
+	// access units handed to the enabled encryptor, also those rejected or
+	// passed through clear while switched off, and those encrypted
+	FramesProcessed uint64
+	FramesEncrypted uint64
+	// VCL NAL units with a payload shorter than 16 bytes
+	ShortNALs uint64
+	// short VCL NAL units that were encrypted anyway (ctr policy)
+	ShortNALsEncrypted uint64
+	// access units that went through encryption and the time spent on
+	// them, failed ones included
+	Frames      uint64
+	EncryptTime time.Duration
+	// time spent on the last access unit that went through encryption
+	LastEncryptDuration time.Duration
+	// patterns staged by SetPattern
+	PatternChanges uint64
+	// bytes added to the stream by in-band signaling
+	OverheadBytes uint64
+	// access units rejected by strict stream checks
+	StreamViolations uint64
+	// access units rejected by strict mode or as encrypted already
+	StrictRejections uint64
+	// access units discarded with ErrInternal, by paranoid checks or when
+	// the NAL units found or the output do not add up
+	InternalErrors uint64
+	// emulation prevention bytes inserted into encrypted payloads
+	EmulationPreventionBytes uint64
+	// NAL units (whole samples for audio) encrypted and kept clear
+	NALsEncrypted uint64
+	NALsClear     uint64
+	// size of the access units before and after encryption
+	BytesIn  uint64
+	BytesOut uint64
+	// bytes of the protected ranges, with cbcs and cens the skipped blocks
+	// of the pattern included
+	BytesEncrypted uint64
+	// access units Encrypt failed for, whatever the reason
+	Errors uint64
+}
+
+// statsShard holds the counters written while the shard is in use
+type statsShard struct {
+	// writers that entered the shard and did not leave yet
+	writers atomic.Int64
+
+	processed           atomic.Uint64
+	encrypted           atomic.Uint64
+	shortNALs           atomic.Uint64
+	shortNALsEncrypted  atomic.Uint64
+	frames              atomic.Uint64
+	encryptNanos        atomic.Int64
+	patternChanges      atomic.Uint64
+	overheadBytes       atomic.Uint64
+	streamViolations    atomic.Uint64
+	strictRejections    atomic.Uint64
+	internalErrors      atomic.Uint64
+	emulationPrevention atomic.Uint64
+	nalsEncrypted       atomic.Uint64
+	nalsClear           atomic.Uint64
+	bytesIn             atomic.Uint64
+	bytesOut            atomic.Uint64
+	bytesEncrypted      atomic.Uint64
+	errors              atomic.Uint64
+}
+
+func (shard *statsShard) leave() {
+	shard.writers.Add(-1)
+}
+
+// fold moves the counters of the shard into stats
+func (shard *statsShard) fold(stats *Stats) {
+	stats.FramesProcessed += shard.processed.Swap(0)
+	stats.FramesEncrypted += shard.encrypted.Swap(0)
+	stats.ShortNALs += shard.shortNALs.Swap(0)
+	stats.ShortNALsEncrypted += shard.shortNALsEncrypted.Swap(0)
+	stats.Frames += shard.frames.Swap(0)
+	stats.EncryptTime += time.Duration(shard.encryptNanos.Swap(0))
+	stats.PatternChanges += shard.patternChanges.Swap(0)
+	stats.OverheadBytes += shard.overheadBytes.Swap(0)
+	stats.StreamViolations += shard.streamViolations.Swap(0)
+	stats.StrictRejections += shard.strictRejections.Swap(0)
+	stats.InternalErrors += shard.internalErrors.Swap(0)
+	stats.EmulationPreventionBytes += shard.emulationPrevention.Swap(0)
+	stats.NALsEncrypted += shard.nalsEncrypted.Swap(0)
+	stats.NALsClear += shard.nalsClear.Swap(0)
+	stats.BytesIn += shard.bytesIn.Swap(0)
+	stats.BytesOut += shard.bytesOut.Swap(0)
+	stats.BytesEncrypted += shard.bytesEncrypted.Swap(0)
+	stats.Errors += shard.errors.Swap(0)
+}
+
+// statsCounters counts into one of two shards without locking, an access
+// unit is counted into a single shard as a whole. A snapshot switches the
+// shard in use and folds the other one into the totals once its writers
+// left, so that it never holds half of an access unit.
+type statsCounters struct {
+	current atomic.Uint32
+	shards  [2]statsShard
+
+	// serializes snapshots, the totals are only written with it held
+	mu    sync.Mutex
+	total Stats
+
+	lastEncrypt atomic.Int64
+	// access units that went through encryption since the start, the
+	// position of a rotation; unlike the counters never reset
+	position atomic.Uint64
+}
+
+// enter returns the shard to count into, until leave is called
+func (c *statsCounters) enter() *statsShard {
+	for {
+		i := c.current.Load()
+		shard := &c.shards[i]
+		shard.writers.Add(1)
+
+		// a snapshot switched shards in between and may not wait for us
+		if c.current.Load() == i {
+			return shard
+		}
+		shard.leave()
+	}
+}
+
+// add counts into the shard in use, for counters outside of an access unit
+// being encrypted
+func (c *statsCounters) add(count func(shard *statsShard)) {
+	shard := c.enter()
+	count(shard)
+	shard.leave()
+}
+
+// counters of access units that did not go through encryption, for add
+func countClear(shard *statsShard) {
+	shard.processed.Add(1)
+}
+
+func countError(shard *statsShard) {
+	shard.processed.Add(1)
+	shard.errors.Add(1)
+}
+
+func countStreamViolation(shard *statsShard) {
+	countError(shard)
+	shard.streamViolations.Add(1)
+}
+
+func countStrictRejection(shard *statsShard) {
+	countError(shard)
+	shard.strictRejections.Add(1)
+}
+
+func countInternalError(shard *statsShard) {
+	countError(shard)
+	shard.internalErrors.Add(1)
+}
+
+// encrypted records the time spent on an access unit that went through
+// encryption, counted into shard
+func (c *statsCounters) encrypted(shard *statsShard, elapsed time.Duration) {
+	shard.frames.Add(1)
+	shard.encryptNanos.Add(int64(elapsed))
+	c.lastEncrypt.Store(int64(elapsed))
+	c.position.Add(1)
+}
+
+// snapshot returns the totals including the shard in use, zeroed after
+// when reset is set. It must not be called while in a shard.
+func (c *statsCounters) snapshot(reset bool) Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.current.Load()
+	c.current.Store(i ^ 1)
+
+	// writers hold a shard for a single access unit
+	shard := &c.shards[i]
+	for shard.writers.Load() != 0 {
+		runtime.Gosched()
+	}
+	shard.fold(&c.total)
+
+	stats := c.total
+	stats.LastEncryptDuration = time.Duration(c.lastEncrypt.Load())
+	if reset {
+		c.total = Stats{}
+		c.lastEncrypt.Store(0)
+	}
+	return stats
+}
+
+// protectedSize returns the bytes of the protected ranges of subsamples
+func protectedSize(subsamples []SubsampleInfo) uint64 {
+	var n uint64
+	for _, subsample := range subsamples {
+		n += uint64(subsample.BytesOfProtectedData)
+	}
+	return n
+}
+
+// Stats returns a snapshot of the cumulative counters, every access unit
+// is either fully or not at all part of it
+func (e *Encryptor) Stats() Stats {
+	return e.stats.snapshot(false)
+}
+
+// ResetStats returns a snapshot of the counters like Stats and starts
+// counting from zero again, for collecting them per interval. Every access
+// unit is counted in exactly one of the snapshots.
+func (e *Encryptor) ResetStats() Stats {
+	return e.stats.snapshot(true)
+}
@@ -0,0 +1,116 @@
+package drm
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestEncryptor_Stats(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	var bytesIn, bytesEncrypted uint64
+	for i, frame := range h264Stream() {
+		sample, err := e.EncryptSample(frame)
+		if err != nil {
+			t.Fatalf("EncryptSample() frame %d returned error: %s", i, err)
+		}
+		bytesIn += uint64(len(frame))
+		bytesEncrypted += protectedSize(sample.Subsamples)
+	}
+
+	// the four slices are encrypted; the access unit delimiters, parameter
+	// sets, SEI, filler and the two short slices stay clear
+	got := e.Stats()
+	want := Stats{
+		FramesProcessed: 4,
+		FramesEncrypted: 4,
+		Frames:          4,
+		ShortNALs:       2,
+		NALsEncrypted:   4,
+		NALsClear:       8,
+		BytesIn:         bytesIn,
+		BytesOut:        bytesIn,
+		BytesEncrypted:  bytesEncrypted,
+	}
+	if got.EncryptTime <= 0 || got.LastEncryptDuration <= 0 || got.LastEncryptDuration > got.EncryptTime {
+		t.Errorf("Stats() EncryptTime = %s, LastEncryptDuration = %s", got.EncryptTime, got.LastEncryptDuration)
+	}
+	got.EncryptTime, got.LastEncryptDuration = 0, 0
+	if got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	// switched off, access units are processed but not encrypted
+	if err := e.SetEnabled(false); err != nil {
+		t.Fatalf("SetEnabled() returned error: %s", err)
+	}
+	for _, frame := range h264Stream() {
+		if _, err := e.Encrypt(frame); err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+	}
+	if got := e.Stats(); got.FramesProcessed != 8 || got.FramesEncrypted != 4 {
+		t.Errorf("Stats() switched off FramesProcessed = %d, FramesEncrypted = %d, want 8 and 4", got.FramesProcessed, got.FramesEncrypted)
+	}
+
+	if got := e.ResetStats(); got.FramesProcessed != 8 || got.NALsEncrypted != 4 {
+		t.Errorf("ResetStats() = %+v, want the counters before the reset", got)
+	}
+	if got := e.Stats(); got != (Stats{}) {
+		t.Errorf("Stats() after ResetStats() = %+v, want zero", got)
+	}
+}
+
+func TestEncryptor_StatsConsistent(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	// one slice encrypted and four NAL units kept clear per access unit
+	frame := h264Stream()[0]
+	const workers, frames = 4, 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < frames; j++ {
+				if _, err := e.Encrypt(frame); err != nil {
+					t.Errorf("Encrypt() returned error: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	check := func(stats Stats) {
+		t.Helper()
+		n := stats.FramesEncrypted
+		if stats.FramesProcessed != n || stats.NALsEncrypted != n || stats.NALsClear != 4*n || stats.BytesIn != n*uint64(len(frame)) {
+			t.Fatalf("torn snapshot %+v", stats)
+		}
+	}
+
+	var total uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		check(e.Stats())
+		stats := e.ResetStats()
+		check(stats)
+		total += stats.FramesEncrypted
+	}
+
+	if total != workers*frames {
+		t.Errorf("ResetStats() counted %d access units in total, want %d", total, workers*frames)
+	}
+}
@@ -0,0 +1,145 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultMaxStreamBuffer is how many bytes StreamEncryptor buffers without
+// completing an access unit unless configured
+const DefaultMaxStreamBuffer = 8 << 20
+
+// ErrStreamBufferFull is returned by StreamEncryptor.Write when the stream
+// exceeds the buffer without completing an access unit
+var ErrStreamBufferFull = errors.New("stream buffer limit exceeded")
+
+// StreamEncryptor encrypts an Annex B byte stream delivered in buffers that
+// need not end on access unit boundaries. A buffer may end in the middle of
+// a NAL unit or even of a start code, the stream is buffered until an access
+// unit is complete: when the NAL unit starting the next one arrives, or
+// with Flush at the end of the stream. Every access unit is then encrypted
+// as a whole by the encryptor, as if Encrypt was called with it.
+//
+// A StreamEncryptor must not be used concurrently, the encryptor it wraps
+// may be shared.
+type StreamEncryptor struct {
+	encryptor *Encryptor
+	codec     nalCodec
+	maxBuffer int
+
+	buf    []byte
+	ranges []naluRange
+	// offset of the last NAL unit in buf, it may still be incomplete
+	last int
+	// whether the buffered access unit has a slice, the NAL units that
+	// start the next access unit only do so after one
+	vcl bool
+}
+
+// NewStreamEncryptor creates a stream encryptor buffering at most maxBuffer
+// bytes of an incomplete access unit, 0 is DefaultMaxStreamBuffer. The
+// encryptor must take and emit Annex B video access units.
+func NewStreamEncryptor(e *Encryptor, maxBuffer int) (*StreamEncryptor, error) {
+	if e.codec.isAudio() {
+		return nil, errors.New("stream encryptor requires a video codec")
+	}
+	if e.format.format == NALFormatAVCC || e.format.format == NALFormatAuto || e.format.outputAVCC(false) {
+		return nil, fmt.Errorf("stream encryptor requires the %s nal format", NALFormatAnnexB)
+	}
+	if maxBuffer < 0 {
+		return nil, fmt.Errorf("max buffer must not be negative, got %d", maxBuffer)
+	}
+	if maxBuffer == 0 {
+		maxBuffer = DefaultMaxStreamBuffer
+	}
+
+	return &StreamEncryptor{
+		encryptor: e,
+		codec:     e.codec,
+		maxBuffer: maxBuffer,
+	}, nil
+}
+
+// Write buffers the next part of the stream and returns the access units it
+// completes, encrypted. Access units failing to encrypt are left out and
+// their errors returned. When the buffered access unit grows beyond the
+// limit it is discarded with ErrStreamBufferFull, the stream resumes with
+// the next access unit.
+func (s *StreamEncryptor) Write(data []byte) ([][]byte, error) {
+	s.buf = append(s.buf, data...)
+
+	// NAL units before the last one are complete and were seen already,
+	// only the last one and those following it are new
+	var aus [][]byte
+	var errs []error
+	start := 0
+
+	s.ranges = findNALUnits(s.ranges[:0], s.buf[s.last:])
+	for i, r := range s.ranges {
+		offset := s.last + r.offset
+		nalu := s.buf[offset+r.headerLen : offset+r.length]
+
+		// bytes before the first start code belong to the access unit
+		if r.headerLen > 0 && s.vcl {
+			if begins, ok := s.codec.beginsAccessUnit(nalu); ok && begins {
+				au, err := s.encrypt(s.buf[start:offset])
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					aus = append(aus, au)
+				}
+				start, s.vcl = offset, false
+			}
+		}
+
+		// the last NAL unit may continue in the next buffer
+		if i == len(s.ranges)-1 {
+			s.last = offset
+			break
+		}
+		if r.headerLen > 0 && s.codec.isVCL(s.codec.nalType(nalu)) {
+			s.vcl = true
+		}
+	}
+
+	// the complete access units leave the buffer
+	n := copy(s.buf, s.buf[start:])
+	s.buf = s.buf[:n]
+	s.last -= start
+
+	if len(s.buf) > s.maxBuffer {
+		errs = append(errs, fmt.Errorf("%w: %d bytes without a complete access unit", ErrStreamBufferFull, len(s.buf)))
+		s.reset()
+	}
+
+	return aus, errors.Join(errs...)
+}
+
+// Flush encrypts and returns the buffered access unit at the end of the
+// stream, nil when nothing is buffered
+func (s *StreamEncryptor) Flush() ([]byte, error) {
+	if len(s.buf) == 0 {
+		return nil, nil
+	}
+
+	defer s.reset()
+	return s.encrypt(s.buf)
+}
+
+// Buffered returns how many bytes of the stream wait for their access unit
+// to complete
+func (s *StreamEncryptor) Buffered() int {
+	return len(s.buf)
+}
+
+// encrypt encrypts an access unit of the buffer into a buffer of its own,
+// the stream buffer is reused for the following ones
+func (s *StreamEncryptor) encrypt(au []byte) ([]byte, error) {
+	return s.encryptor.EncryptTo(nil, au)
+}
+
+func (s *StreamEncryptor) reset() {
+	s.buf = s.buf[:0]
+	s.last = 0
+	s.vcl = false
+}
@@ -0,0 +1,153 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// streamAccessUnits returns access units whose boundaries are only found
+// by the NAL units starting them: there are access units without delimiter
+// and with several slices
+func streamAccessUnits() [][]byte {
+	params := h264Params{}
+	idr, _ := params.slice(0x65, sliceHeaderCases[0].fields, 1500)
+	first, _ := params.slice(0x41, sliceHeaderCases[2].fields, 400)
+	second, _ := params.slice(0x41, sliceHeaderCases[1].fields, 300)
+
+	return [][]byte{
+		bytes.Join([][]byte{nalUnit(0x09, 1), params.sps(), params.pps(), nalUnit(0x06, 20), idr}, nil),
+		bytes.Join([][]byte{first, second}, nil),
+		bytes.Join([][]byte{nalUnit(0x09, 1), first}, nil),
+		bytes.Join([][]byte{first, nalUnit(0x0c, 30)}, nil),
+		bytes.Join([][]byte{nalUnit(0x06, 20), first, second}, nil),
+	}
+}
+
+// hevcSlice builds an H.265 slice, the first of its picture or not
+func hevcSlice(nalType byte, first bool, size int) []byte {
+	nalu := hevcNAL(nalType, size)
+	if first {
+		nalu[6] |= 0x80
+	}
+	return nalu
+}
+
+func TestStreamEncryptor(t *testing.T) {
+	hevc := [][]byte{
+		bytes.Join([][]byte{hevcNAL(32, 20), hevcNAL(33, 40), hevcNAL(34, 20), hevcSlice(19, true, 500), hevcSlice(19, false, 200)}, nil),
+		hevcSlice(1, true, 300),
+		bytes.Join([][]byte{hevcNAL(35, 1), hevcSlice(1, true, 300), hevcSlice(1, false, 100)}, nil),
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+		aus  [][]byte
+	}{
+		{"cbcs", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}, streamAccessUnits()},
+		{"cenc", Config{Mode: "cenc"}, streamAccessUnits()},
+		{"hevc", Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, Codec: CodecH265}, hevc},
+	}
+
+	for _, tt := range tests {
+		stream := bytes.Join(tt.aus, nil)
+
+		// buffers ending within NAL units and start codes
+		for _, size := range []int{1, 2, 7, 100, 1000, len(stream)} {
+			reference := newTestEncryptor(t, tt.cfg)
+			s, err := NewStreamEncryptor(newTestEncryptor(t, tt.cfg), 0)
+			if err != nil {
+				t.Fatalf("%s: NewStreamEncryptor() returned error: %s", tt.name, err)
+			}
+
+			var got [][]byte
+			for pos := 0; pos < len(stream); pos += size {
+				aus, err := s.Write(stream[pos:min(pos+size, len(stream))])
+				if err != nil {
+					t.Fatalf("%s %d: Write() returned error: %s", tt.name, size, err)
+				}
+				got = append(got, aus...)
+			}
+
+			// the last access unit waits for the end of the stream
+			if len(got) != len(tt.aus)-1 {
+				t.Fatalf("%s %d: Write() returned %d access units, want %d", tt.name, size, len(got), len(tt.aus)-1)
+			}
+			last, err := s.Flush()
+			if err != nil {
+				t.Fatalf("%s %d: Flush() returned error: %s", tt.name, size, err)
+			}
+			got = append(got, last)
+
+			for i, au := range tt.aus {
+				want, _ := reference.Encrypt(au)
+				if !bytes.Equal(got[i], want) {
+					t.Errorf("%s %d: access unit %d differs from Encrypt()", tt.name, size, i)
+				}
+			}
+			if s.Buffered() != 0 {
+				t.Errorf("%s %d: Buffered() = %d after Flush(), want 0", tt.name, size, s.Buffered())
+			}
+		}
+	}
+}
+
+func TestStreamEncryptor_maxBuffer(t *testing.T) {
+	s, err := NewStreamEncryptor(newTestEncryptor(t, Config{Mode: "cbcs"}), 4096)
+	if err != nil {
+		t.Fatalf("NewStreamEncryptor() returned error: %s", err)
+	}
+
+	aus := streamAccessUnits()
+	if got, err := s.Write(aus[0]); err != nil || len(got) != 0 {
+		t.Fatalf("Write() = %d access units, %v; want none buffered", len(got), err)
+	}
+
+	// a slice that never ends completes the first access unit
+	got, err := s.Write(aus[1][:6])
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Write() = %d access units, %v; want the first one", len(got), err)
+	}
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = s.Write(bytes.Repeat([]byte{0xff}, 1000))
+	}
+	if !errors.Is(err, ErrStreamBufferFull) {
+		t.Fatalf("Write() error = %v, want %v", err, ErrStreamBufferFull)
+	}
+	if s.Buffered() != 0 {
+		t.Errorf("Buffered() = %d, want the access unit discarded", s.Buffered())
+	}
+
+	// the stream resumes
+	for _, au := range aus {
+		if _, err := s.Write(au); err != nil {
+			t.Fatalf("Write() returned error after discarding: %s", err)
+		}
+	}
+	if last, err := s.Flush(); err != nil || len(last) != len(aus[len(aus)-1]) {
+		t.Errorf("Flush() = %d bytes, %v; want the last access unit", len(last), err)
+	}
+	if last, err := s.Flush(); last != nil || err != nil {
+		t.Errorf("Flush() = %x, %v; want nothing buffered", last, err)
+	}
+}
+
+func TestNewStreamEncryptor_invalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       Config
+		maxBuffer int
+	}{
+		{"audio", Config{Codec: CodecAudio}, 0},
+		{"avcc", Config{NALFormat: NALFormatAVCC}, 0},
+		{"auto", Config{NALFormat: NALFormatAuto}, 0},
+		{"negative limit", Config{}, -1},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewStreamEncryptor(newTestEncryptor(t, tt.cfg), tt.maxBuffer); err == nil {
+			t.Errorf("%s: NewStreamEncryptor() expected error", tt.name)
+		}
+	}
+}
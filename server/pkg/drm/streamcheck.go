@@ -0,0 +1,139 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Structural checks of strict stream mode
+const (
+	// parameter sets only change at IDR, at most one SPS and one PPS per
+	// access unit
+	CheckParameterSets = "parameter_sets"
+	// data partitioning NAL units 2-4 unless explicitly allowed
+	CheckDataPartitioning = "data_partitioning"
+	// filler data NAL units above MaxFillerRatio of the access unit
+	CheckFillerRatio = "filler_ratio"
+)
+
+// DefaultMaxFillerRatio is the default share of an access unit filler data
+// may take in strict stream mode
+const DefaultMaxFillerRatio = 0.5
+
+var ErrStreamViolation = errors.New("unsupported stream structure")
+
+// StreamChecks lists the checks of strict stream mode
+func StreamChecks() []string {
+	return []string{CheckParameterSets, CheckDataPartitioning, CheckFillerRatio}
+}
+
+// StreamViolation is returned by Encrypt for access units violating a
+// strict stream check, nothing of such an access unit is encrypted
+type StreamViolation struct {
+	Check  string
+	Detail string
+}
+
+func (v *StreamViolation) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrStreamViolation, v.Check, v.Detail)
+}
+
+func (v *StreamViolation) Unwrap() error {
+	return ErrStreamViolation
+}
+
+// StreamCheckConfig configures strict stream mode
+type StreamCheckConfig struct {
+	AllowDataPartitioning bool
+	// share of the access unit size, DefaultMaxFillerRatio when 0
+	MaxFillerRatio float64
+}
+
+// streamChecker holds the parameter sets last seen in the stream
+type streamChecker struct {
+	codec  nalCodec
+	config StreamCheckConfig
+
+	// parameter sets of the last access unit carrying them
+	mu  sync.Mutex
+	sps []byte
+	pps []byte
+}
+
+func newStreamChecker(codec nalCodec, config StreamCheckConfig) *streamChecker {
+	if config.MaxFillerRatio <= 0 {
+		config.MaxFillerRatio = DefaultMaxFillerRatio
+	}
+	return &streamChecker{codec: codec, config: config}
+}
+
+// check validates one access unit, the parameter sets are remembered only
+// when the access unit passes
+func (c *streamChecker) check(au []byte) error {
+	var sps, pps [][]byte
+	var idr bool
+	var filler int
+
+	for _, nalu := range parseNALUnits(au) {
+		nalu = nalu[startCodeLen(nalu):]
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalType := c.codec.nalType(nalu); {
+		case c.codec.isDataPartition(nalType):
+			if !c.config.AllowDataPartitioning {
+				return &StreamViolation{
+					Check:  CheckDataPartitioning,
+					Detail: fmt.Sprintf("data partition NAL unit type %d", nalType),
+				}
+			}
+		case c.codec.isKeyframe(nalType):
+			idr = true
+		case c.codec.isSPS(nalType):
+			sps = append(sps, nalu)
+		case c.codec.isPPS(nalType):
+			pps = append(pps, nalu)
+		case c.codec.isFiller(nalType):
+			filler += len(nalu)
+		}
+	}
+
+	if len(sps) > 1 || len(pps) > 1 {
+		return &StreamViolation{
+			Check:  CheckParameterSets,
+			Detail: fmt.Sprintf("%d SPS and %d PPS in one access unit", len(sps), len(pps)),
+		}
+	}
+
+	changed := func(last []byte, sets [][]byte) bool {
+		return len(sets) == 1 && last != nil && !bytes.Equal(last, sets[0])
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !idr && (changed(c.sps, sps) || changed(c.pps, pps)) {
+		return &StreamViolation{
+			Check:  CheckParameterSets,
+			Detail: "parameter sets changed outside of an IDR access unit",
+		}
+	}
+
+	if ratio := float64(filler) / float64(len(au)); ratio > c.config.MaxFillerRatio {
+		return &StreamViolation{
+			Check:  CheckFillerRatio,
+			Detail: fmt.Sprintf("filler data is %.0f%% of the access unit, at most %.0f%% allowed", ratio*100, c.config.MaxFillerRatio*100),
+		}
+	}
+
+	if len(sps) == 1 {
+		c.sps = bytes.Clone(sps[0])
+	}
+	if len(pps) == 1 {
+		c.pps = bytes.Clone(pps[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptor_strictStreamChecks(t *testing.T) {
+	join := func(nalus ...[]byte) []byte {
+		return bytes.Join(nalus, nil)
+	}
+
+	sps := nalUnit(0x67, 12)
+	otherSPS := append(nalUnit(0x67, 11), 0x42)
+	pps := nalUnit(0x68, 4)
+	idr := join(sps, pps, nalUnit(0x65, 300))
+
+	tests := []struct {
+		name      string
+		config    StreamCheckConfig
+		frames    [][]byte
+		wantCheck string // of the last frame, empty when accepted
+	}{
+		{
+			name:   "regular stream",
+			frames: [][]byte{idr, nalUnit(0x41, 200), idr},
+		},
+		{
+			name:      "parameter set change outside of IDR",
+			frames:    [][]byte{idr, join(otherSPS, nalUnit(0x41, 200))},
+			wantCheck: CheckParameterSets,
+		},
+		{
+			name:   "parameter set change at IDR",
+			frames: [][]byte{idr, join(otherSPS, pps, nalUnit(0x65, 300))},
+		},
+		{
+			name:   "repeated parameter sets outside of IDR",
+			frames: [][]byte{idr, join(sps, pps, nalUnit(0x41, 200))},
+		},
+		{
+			name:      "two SPS in one access unit",
+			frames:    [][]byte{join(sps, otherSPS, pps, nalUnit(0x65, 300))},
+			wantCheck: CheckParameterSets,
+		},
+		{
+			name:      "data partition",
+			frames:    [][]byte{idr, join(nalUnit(0x42, 100), nalUnit(0x43, 100))},
+			wantCheck: CheckDataPartitioning,
+		},
+		{
+			name:   "data partition allowed",
+			config: StreamCheckConfig{AllowDataPartitioning: true},
+			frames: [][]byte{idr, join(nalUnit(0x42, 100), nalUnit(0x43, 100))},
+		},
+		{
+			name:      "filler flooding",
+			frames:    [][]byte{idr, join(nalUnit(0x41, 100), nalUnit(0x0c, 400))},
+			wantCheck: CheckFillerRatio,
+		},
+		{
+			name:   "filler below threshold",
+			config: StreamCheckConfig{MaxFillerRatio: 0.9},
+			frames: [][]byte{idr, join(nalUnit(0x41, 100), nalUnit(0x0c, 400))},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, StrictStreamChecks: true, StreamChecks: tt.config})
+
+			var err error
+			var out []byte
+			for i, frame := range tt.frames {
+				out, err = e.Encrypt(frame)
+				if err != nil && i < len(tt.frames)-1 {
+					t.Fatalf("frame %d rejected: %s", i, err)
+				}
+			}
+
+			if tt.wantCheck == "" {
+				if err != nil {
+					t.Fatalf("Encrypt() returned error: %s", err)
+				}
+				return
+			}
+
+			var violation *StreamViolation
+			if !errors.As(err, &violation) || violation.Check != tt.wantCheck || !errors.Is(err, ErrStreamViolation) {
+				t.Fatalf("Encrypt() error = %v, want %s violation", err, tt.wantCheck)
+			}
+			if out != nil {
+				t.Errorf("Encrypt() returned data for a rejected access unit")
+			}
+			if got := e.Stats().StreamViolations; got != 1 {
+				t.Errorf("Stats().StreamViolations = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestEncryptor_streamChecksOff(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	frame := bytes.Join([][]byte{nalUnit(0x42, 100), nalUnit(0x0c, 400)}, nil)
+	if _, err := e.Encrypt(frame); err != nil {
+		t.Errorf("Encrypt() without strict checks returned error: %s", err)
+	}
+}
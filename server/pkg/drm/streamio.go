@@ -0,0 +1,191 @@
+package drm
+
+import (
+	"errors"
+	"io"
+)
+
+// streamReadSize is how much of the underlying reader EncryptReader reads
+// at once
+const streamReadSize = 32 << 10
+
+// ErrStreamClosed is returned when writing to a closed EncryptWriter
+var ErrStreamClosed = errors.New("stream closed")
+
+// EncryptWriter encrypts an Annex B byte stream written to it and forwards
+// the encrypted access units to the writer it wraps, as soon as the NAL
+// unit starting the next one arrives. Writes need not end on NAL unit
+// boundaries, see StreamEncryptor. The trailing access unit is only
+// forwarded by Flush or Close.
+//
+// An EncryptWriter must not be used concurrently.
+type EncryptWriter struct {
+	w      io.Writer
+	stream *StreamEncryptor
+	// error of the underlying writer, the stream is broken after it
+	err    error
+	closed bool
+}
+
+// NewEncryptWriter creates a writer encrypting into w, buffering at most
+// DefaultMaxStreamBuffer bytes of an incomplete access unit. The encryptor
+// must take Annex B video access units.
+func NewEncryptWriter(w io.Writer, e *Encryptor) (*EncryptWriter, error) {
+	stream, err := NewStreamEncryptor(e, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptWriter{
+		w:      w,
+		stream: stream,
+	}, nil
+}
+
+// Write buffers p and forwards the access units it completes. All of p is
+// consumed unless the underlying writer fails, which is returned from then
+// on. Access units failing to encrypt and those exceeding the buffer, with
+// ErrStreamBufferFull, are left out and their errors returned, the stream
+// may continue after them.
+func (w *EncryptWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	aus, err := w.stream.Write(p)
+	if werr := w.write(aus...); werr != nil {
+		return 0, werr
+	}
+	return len(p), err
+}
+
+// Flush encrypts and forwards the buffered access unit, as at the end of
+// the stream. An access unit continued by following writes is split by it.
+func (w *EncryptWriter) Flush() error {
+	if w.closed {
+		return ErrStreamClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	au, err := w.stream.Flush()
+	if err != nil {
+		return err
+	}
+	return w.write(au)
+}
+
+// Close flushes the trailing access unit, the underlying writer is not
+// closed. Writing afterwards returns ErrStreamClosed.
+func (w *EncryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	err := w.Flush()
+	w.closed = true
+	return err
+}
+
+// write forwards access units to the underlying writer, keeping its error
+func (w *EncryptWriter) write(aus ...[]byte) error {
+	for _, au := range aus {
+		if len(au) == 0 {
+			continue
+		}
+		if _, err := w.w.Write(au); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// EncryptReader encrypts the Annex B byte stream of the reader it wraps,
+// reads return the encrypted access units. An access unit is complete when
+// the NAL unit starting the next one was read, the trailing one when the
+// reader returns io.EOF, see StreamEncryptor.
+//
+// An EncryptReader must not be used concurrently.
+type EncryptReader struct {
+	r      io.Reader
+	stream *StreamEncryptor
+	buf    []byte
+
+	// encrypted access units not read yet
+	out []byte
+	// error of the stream to return once out is read
+	err error
+	// error of the underlying reader, io.EOF at the end of the stream
+	rerr error
+}
+
+// NewEncryptReader creates a reader encrypting the stream of r, buffering
+// at most DefaultMaxStreamBuffer bytes of an incomplete access unit. The
+// encryptor must take Annex B video access units.
+func NewEncryptReader(r io.Reader, e *Encryptor) (*EncryptReader, error) {
+	stream, err := NewStreamEncryptor(e, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptReader{
+		r:      r,
+		stream: stream,
+	}, nil
+}
+
+// Read reads encrypted access units into p. Errors of access units that
+// failed to encrypt or exceeded the buffer, with ErrStreamBufferFull, are
+// returned after the access units preceding them were read; the stream
+// continues after them. The error of the underlying reader, io.EOF at the
+// end of the stream, is returned once the stream read before it is flushed.
+func (r *EncryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			err := r.err
+			r.err = nil
+			return 0, err
+		}
+		if r.rerr != nil {
+			return 0, r.rerr
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		r.fill()
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads the next part of the stream and queues the access units it
+// completes
+func (r *EncryptReader) fill() {
+	if r.buf == nil {
+		r.buf = make([]byte, streamReadSize)
+	}
+
+	n, err := r.r.Read(r.buf)
+	aus, serr := r.stream.Write(r.buf[:n])
+	for _, au := range aus {
+		r.out = append(r.out, au...)
+	}
+
+	// the stream ends with the error of the reader
+	if err != nil {
+		au, ferr := r.stream.Flush()
+		r.out = append(r.out, au...)
+		serr = errors.Join(serr, ferr)
+		r.rerr = err
+	}
+
+	r.err = serr
+}
@@ -0,0 +1,167 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// encryptedStream returns the access units encrypted one by one
+func encryptedStream(t *testing.T, cfg Config, aus [][]byte) []byte {
+	reference := newTestEncryptor(t, cfg)
+
+	var want []byte
+	for _, au := range aus {
+		out, err := reference.Encrypt(au)
+		if err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+		want = append(want, out...)
+	}
+	return want
+}
+
+func TestEncryptWriter(t *testing.T) {
+	cfg := Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}
+	aus := streamAccessUnits()
+	stream := bytes.Join(aus, nil)
+	want := encryptedStream(t, cfg, aus)
+
+	for _, size := range []int{1, 3, 100, len(stream)} {
+		var out bytes.Buffer
+		w, err := NewEncryptWriter(&out, newTestEncryptor(t, cfg))
+		if err != nil {
+			t.Fatalf("NewEncryptWriter() returned error: %s", err)
+		}
+
+		for pos := 0; pos < len(stream); pos += size {
+			part := stream[pos:min(pos+size, len(stream))]
+			if n, err := w.Write(part); n != len(part) || err != nil {
+				t.Fatalf("%d: Write() = %d, %v; want %d", size, n, err, len(part))
+			}
+		}
+
+		// the last access unit waits for the end of the stream
+		if out.Len() != len(want)-len(aus[len(aus)-1]) {
+			t.Errorf("%d: %d bytes written before Close(), want all but the last access unit", size, out.Len())
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%d: Close() returned error: %s", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("%d: written stream differs from Encrypt()", size)
+		}
+
+		if _, err := w.Write(stream); !errors.Is(err, ErrStreamClosed) {
+			t.Errorf("%d: Write() after Close() error = %v, want %v", size, err, ErrStreamClosed)
+		}
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestEncryptWriter_errors(t *testing.T) {
+	aus := streamAccessUnits()
+
+	// a failing downstream breaks the stream
+	errWrite := errors.New("write failed")
+	w, err := NewEncryptWriter(failingWriter{errWrite}, newTestEncryptor(t, Config{Mode: "cbcs"}))
+	if err != nil {
+		t.Fatalf("NewEncryptWriter() returned error: %s", err)
+	}
+	if _, err := w.Write(bytes.Join(aus[:2], nil)); !errors.Is(err, errWrite) {
+		t.Errorf("Write() error = %v, want %v", err, errWrite)
+	}
+	if _, err := w.Write(aus[2]); !errors.Is(err, errWrite) {
+		t.Errorf("Write() after failing error = %v, want %v", err, errWrite)
+	}
+
+	// a stream without start codes does not grow the buffer
+	var out bytes.Buffer
+	w, err = NewEncryptWriter(&out, newTestEncryptor(t, Config{Mode: "cbcs"}))
+	if err != nil {
+		t.Fatalf("NewEncryptWriter() returned error: %s", err)
+	}
+	junk := bytes.Repeat([]byte{0xff}, 64<<10)
+	for i := 0; i <= DefaultMaxStreamBuffer/len(junk) && err == nil; i++ {
+		_, err = w.Write(junk)
+	}
+	if !errors.Is(err, ErrStreamBufferFull) {
+		t.Fatalf("Write() error = %v, want %v", err, ErrStreamBufferFull)
+	}
+	if err := w.Close(); err != nil || out.Len() != 0 {
+		t.Errorf("Close() = %v with %d bytes written, want nothing", err, out.Len())
+	}
+
+	if _, err := NewEncryptWriter(io.Discard, newTestEncryptor(t, Config{Codec: CodecAudio})); err == nil {
+		t.Errorf("NewEncryptWriter() with audio expected error")
+	}
+}
+
+func TestEncryptReader(t *testing.T) {
+	cfg := Config{Mode: "cenc"}
+	aus := streamAccessUnits()
+	want := encryptedStream(t, cfg, aus)
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data eof": iotest.DataErrReader,
+	}
+
+	for name, wrap := range readers {
+		r, err := NewEncryptReader(wrap(bytes.NewReader(bytes.Join(aus, nil))), newTestEncryptor(t, cfg))
+		if err != nil {
+			t.Fatalf("NewEncryptReader() returned error: %s", err)
+		}
+
+		got, err := io.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Fatalf("%s: ReadAll() returned error: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: read stream differs from Encrypt()", name)
+		}
+	}
+}
+
+func TestEncryptReader_errors(t *testing.T) {
+	aus := streamAccessUnits()
+
+	// the error of the reader follows the stream read before it
+	errRead := errors.New("read failed")
+	src := io.MultiReader(bytes.NewReader(aus[0]), iotest.ErrReader(errRead))
+	r, err := NewEncryptReader(src, newTestEncryptor(t, Config{Mode: "cbcs"}))
+	if err != nil {
+		t.Fatalf("NewEncryptReader() returned error: %s", err)
+	}
+	got, err := io.ReadAll(r)
+	if !errors.Is(err, errRead) || len(got) != len(aus[0]) {
+		t.Errorf("ReadAll() = %d bytes, %v; want %d bytes, %v", len(got), err, len(aus[0]), errRead)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, errRead) {
+		t.Errorf("Read() after failing error = %v, want %v", err, errRead)
+	}
+
+	// a stream without start codes is discarded, those following resume
+	junk := bytes.Repeat([]byte{0xff}, DefaultMaxStreamBuffer+1)
+	r, err = NewEncryptReader(io.MultiReader(bytes.NewReader(junk), bytes.NewReader(aus[1])), newTestEncryptor(t, Config{Mode: "cbcs"}))
+	if err != nil {
+		t.Fatalf("NewEncryptReader() returned error: %s", err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrStreamBufferFull) {
+		t.Errorf("ReadAll() error = %v, want %v", err, ErrStreamBufferFull)
+	}
+	if got, err := io.ReadAll(r); err != nil || len(got) != len(aus[1]) {
+		t.Errorf("ReadAll() = %d bytes, %v; want the access unit after the junk", len(got), err)
+	}
+
+	if _, err := NewEncryptReader(bytes.NewReader(nil), newTestEncryptor(t, Config{NALFormat: NALFormatAVCC})); err == nil {
+		t.Errorf("NewEncryptReader() with avcc expected error")
+	}
+}
@@ -0,0 +1,45 @@
+package drm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of strict mode, returned by Encrypt for video access units that
+// would leave the encryptor with VCL data in the clear
+var (
+	ErrNoStartCode      = errors.New("access unit has no start code")
+	ErrTruncatedNAL     = errors.New("truncated NAL unit")
+	ErrNothingEncrypted = errors.New("nothing of the VCL NAL units was encrypted")
+)
+
+// checkStrict rejects access units strict mode does not take before they
+// are encrypted, and returns whether the access unit has VCL NAL units,
+// of which something has to be encrypted then
+func (e *encryption) checkStrict(data []byte) (vcl bool, err error) {
+	e.ranges = findNALUnits(e.ranges[:0], data)
+	hl := e.codec.headerLen()
+
+	for _, r := range e.ranges {
+		nalu := r.nalu(data)
+
+		switch {
+		// without any start code the whole access unit is taken as one
+		// NAL unit, its first byte as header
+		case r.headerLen == 0:
+			return false, fmt.Errorf("%w: %d bytes", ErrNoStartCode, len(data))
+		// end of sequence and end of stream are headers alone, slices
+		// never are
+		case len(nalu) < hl:
+			return false, fmt.Errorf("%w: %d bytes at offset %d", ErrTruncatedNAL, len(nalu), r.offset)
+		case e.codec.isVCL(e.codec.nalType(nalu)):
+			if len(nalu) == hl {
+				return false, fmt.Errorf("%w: slice without payload at offset %d", ErrTruncatedNAL, r.offset)
+			}
+			// slices left clear by EncryptNALTypes need nothing encrypted
+			vcl = vcl || e.encrypts(e.codec.nalType(nalu))
+		}
+	}
+
+	return vcl, nil
+}
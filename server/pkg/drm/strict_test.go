@@ -0,0 +1,99 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// randomFrame returns random bytes without any start code
+func randomFrame(size int) []byte {
+	r := rand.New(rand.NewSource(1))
+	frame := make([]byte, size)
+	r.Read(frame)
+	for i := range frame {
+		if frame[i] == 0 {
+			frame[i] = 0xff
+		}
+	}
+	return frame
+}
+
+func TestEncryptor_strict(t *testing.T) {
+	params := h264Params{}
+	aus := h264Stream()
+
+	tests := []struct {
+		name    string
+		au      []byte
+		wantErr error
+	}{
+		{"random bytes", randomFrame(1000), ErrNoStartCode},
+		{"parameter sets", bytes.Join([][]byte{params.sps(), params.pps()}, nil), nil},
+		{"idr", aus[0], nil},
+		{"slices", aus[1], nil},
+		{"short slices", aus[3], ErrNothingEncrypted},
+		{"slice without payload", bytes.Join([][]byte{aus[1], {0, 0, 0, 1, 0x41}}, nil), ErrTruncatedNAL},
+		{"empty NAL unit", bytes.Join([][]byte{{0, 0, 0, 1}, aus[1]}, nil), ErrTruncatedNAL},
+		{"end of stream", bytes.Join([][]byte{aus[1], {0, 0, 0, 1, 0x0b}}, nil), nil},
+	}
+
+	for _, mode := range []string{"cbcs", "cenc"} {
+		for _, tt := range tests {
+			strict := newTestEncryptor(t, Config{Mode: mode, CryptBlocks: 1, SkipBlocks: 9, Strict: true})
+			lenient := newTestEncryptor(t, Config{Mode: mode, CryptBlocks: 1, SkipBlocks: 9})
+
+			_, err := strict.Encrypt(tt.au)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Errorf("%s %s: Encrypt() error = %v, want %v", mode, tt.name, err, tt.wantErr)
+			}
+
+			// paranoid checks are never done in place
+			cfg := Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: mode, CryptBlocks: 1, SkipBlocks: 9, Strict: true}
+			e, err := NewEncryptor(cfg)
+			if err != nil {
+				t.Fatalf("NewEncryptor() returned error: %s", err)
+			}
+			inPlace := bytes.Clone(tt.au)
+			err = e.EncryptInPlace(inPlace)
+			if tt.wantErr == nil && errors.Is(err, ErrNotInPlace) {
+				err = nil
+			}
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Errorf("%s %s: EncryptInPlace() error = %v, want %v", mode, tt.name, err, tt.wantErr)
+			}
+			if tt.wantErr != nil && !bytes.Equal(inPlace, tt.au) {
+				t.Errorf("%s %s: EncryptInPlace() modified a rejected access unit", mode, tt.name)
+			}
+
+			// the default passes all of them through
+			if _, err := lenient.Encrypt(tt.au); err != nil {
+				t.Errorf("%s %s: Encrypt() without strict mode returned error: %s", mode, tt.name, err)
+			}
+		}
+	}
+}
+
+func TestEncryptor_strictSampleIV(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cenc", Strict: true})
+	reference := newTestEncryptor(t, Config{Mode: "cenc"})
+	aus := h264Stream()
+
+	if _, err := e.Encrypt(aus[3]); !errors.Is(err, ErrNothingEncrypted) {
+		t.Fatalf("Encrypt() error = %v, want %v", err, ErrNothingEncrypted)
+	}
+	if got := e.Stats().StrictRejections; got != 1 {
+		t.Errorf("Stats().StrictRejections = %d, want 1", got)
+	}
+
+	// the rejected access unit gives its sample IV back
+	got, err := e.EncryptSample(aus[0])
+	if err != nil {
+		t.Fatalf("EncryptSample() returned error: %s", err)
+	}
+	want, _ := reference.EncryptSample(aus[0])
+	if !bytes.Equal(got.IV, want.IV) || !bytes.Equal(got.Data, want.Data) {
+		t.Errorf("EncryptSample() IV = %x, want %x", got.IV, want.IV)
+	}
+}
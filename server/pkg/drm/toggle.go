@@ -0,0 +1,105 @@
+package drm
+
+// SetEnabled switches encryption on or off at runtime, without recreating
+// the encryptor or the peer connection. The switch takes effect at the
+// next keyframe, so that no GOP mixes clear and encrypted slices, and is
+// reported to OnUpdate with ChangeEnabled. Every access unit is encrypted
+// or passed through clear as a whole, also while the switch happens.
+// Switching back before the keyframe came cancels it. Enabled keeps
+// reporting whether the encryptor is configured, Encrypting whether it
+// encrypts now.
+func (e *Encryptor) SetEnabled(enabled bool) error {
+	if !e.enabled.Load() {
+		return ErrProfileDisabled
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.pendingActive = enabled
+	e.toggling.Store(enabled != e.active.Load())
+	e.toggleLayers(enabled)
+	return nil
+}
+
+// Encrypting reports whether access units are encrypted now, false while
+// switched off by SetEnabled and for a disabled encryptor
+func (e *Encryptor) Encrypting() bool {
+	return e.enabled.Load() && e.active.Load()
+}
+
+// PendingEnabled returns the state SetEnabled switches to at the next
+// keyframe, ok is false when no switch is pending
+func (e *Encryptor) PendingEnabled() (enabled, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.pendingActive, e.toggling.Load()
+}
+
+// Keyframe tells the encryptor that the next access unit it is handed is a
+// keyframe, for callers that know better than the NAL unit types: a
+// staged profile or pending SetEnabled takes effect now rather than at
+// the next keyframe the encryptor recognizes
+func (e *Encryptor) Keyframe() {
+	if e.enabled.Load() {
+		e.switchIfDue(nil, keyframeSignaled)
+	}
+}
+
+// toggle switches to the pending enabled state, e.mu is held. The update
+// of a profile switched to at the same keyframe is extended, otherwise a
+// new one is returned.
+func (e *Encryptor) toggle(update *Update) *Update {
+	e.active.Store(e.pendingActive)
+	e.toggling.Store(false)
+
+	if update != nil {
+		update.Changes = append(update.Changes, ChangeEnabled)
+		update.Enabled = e.pendingActive
+		return update
+	}
+
+	e.epoch++
+	return &Update{
+		Epoch:   e.epoch,
+		Changes: []string{ChangeEnabled},
+		Profile: e.state.Load().profile(),
+		Enabled: e.pendingActive,
+	}
+}
+
+// clearSample passes an access unit through clear, copied into the storage
+// of dst unless nil
+func clearSample(dst, data []byte) EncryptedSample {
+	if dst != nil {
+		data = append(dst[:0], data...)
+	}
+
+	var clear subsampleMap
+	return EncryptedSample{Data: data, Subsamples: clear.finish(len(data))}
+}
+
+// passThrough returns an access unit left clear in the output format
+func (e *Encryptor) passThrough(dst, input []byte) (EncryptedSample, error) {
+	if e.format.output == "" {
+		e.stats.add(countClear)
+		return clearSample(dst, input), nil
+	}
+
+	data, avcc, err := e.format.annexB(input)
+	if err != nil {
+		e.stats.add(countError)
+		return EncryptedSample{}, err
+	}
+	e.stats.add(countClear)
+
+	switch {
+	case e.format.outputAVCC(avcc) && !avcc:
+		out, subsamples, err := e.format.toAVCC(dst, data, nil)
+		return EncryptedSample{Data: out, Subsamples: subsamples}, err
+	case avcc && !e.format.outputAVCC(avcc):
+		return clearSample(dst, data), nil
+	}
+	return clearSample(dst, input), nil
+}
@@ -0,0 +1,224 @@
+package drm
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestEncryptor_SetEnabled(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	var updates []Update
+	e.OnUpdate(func(u Update) {
+		updates = append(updates, u)
+	})
+
+	frames := h264Stream()
+	encrypted := func(frame []byte) bool {
+		t.Helper()
+
+		sample, err := e.EncryptSample(frame)
+		if err != nil {
+			t.Fatalf("EncryptSample() returned error: %s", err)
+		}
+		return !bytes.Equal(sample.Data, frame)
+	}
+
+	if err := e.SetEnabled(false); err != nil {
+		t.Fatalf("SetEnabled() returned error: %s", err)
+	}
+	if pending, ok := e.PendingEnabled(); pending || !ok {
+		t.Errorf("PendingEnabled() = %v, %v, want false, true", pending, ok)
+	}
+
+	// the rest of the GOP stays encrypted, short slices are clear anyway
+	for _, frame := range frames[1:3] {
+		if !encrypted(frame) {
+			t.Fatalf("frame before the keyframe sent clear")
+		}
+	}
+	if !e.Encrypting() || len(updates) != 0 {
+		t.Fatalf("switched off before the keyframe")
+	}
+
+	// clear from the keyframe on
+	for _, frame := range frames {
+		if encrypted(frame) {
+			t.Fatalf("frame after the keyframe encrypted")
+		}
+	}
+	if e.Encrypting() || !e.Enabled() {
+		t.Errorf("Encrypting() = %v, Enabled() = %v, want false, true", e.Encrypting(), e.Enabled())
+	}
+	if info, err := e.ClientInfo(); err != nil || info.Enabled || e.Info().Enabled {
+		t.Errorf("ClientInfo() = %+v, %v while switched off, want clients to remove the decryptor", info, err)
+	}
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].Changes, []string{ChangeEnabled}) || updates[0].Enabled {
+		t.Fatalf("OnUpdate() = %+v, want one update disabling encryption", updates)
+	}
+	if updates[0].Epoch != 2 || updates[0].Profile.KeyID != testKeyID {
+		t.Errorf("OnUpdate() epoch = %d, key ID = %s", updates[0].Epoch, updates[0].Profile.KeyID)
+	}
+
+	// and back on at the next keyframe
+	if err := e.SetEnabled(true); err != nil {
+		t.Fatalf("SetEnabled() returned error: %s", err)
+	}
+	if encrypted(frames[1]) {
+		t.Errorf("frame before the keyframe encrypted")
+	}
+	if !encrypted(frames[0]) || !encrypted(frames[1]) {
+		t.Errorf("frames after the keyframe sent clear")
+	}
+	if len(updates) != 2 || !updates[1].Enabled || updates[1].Epoch != 3 {
+		t.Errorf("OnUpdate() = %+v, want a second update enabling encryption", updates)
+	}
+}
+
+func TestEncryptor_SetEnabled_cancel(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+
+	var updates int
+	e.OnUpdate(func(u Update) {
+		updates++
+	})
+
+	_ = e.SetEnabled(false)
+	_ = e.SetEnabled(true)
+	if _, ok := e.PendingEnabled(); ok {
+		t.Errorf("PendingEnabled() reports a switch back to the current state")
+	}
+
+	frame := h264Stream()[0]
+	if sample, _ := e.EncryptSample(frame); bytes.Equal(sample.Data, frame) || updates != 0 {
+		t.Errorf("cancelled switch took effect")
+	}
+}
+
+func TestEncryptor_SetEnabled_profile(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	var updates []Update
+	e.OnUpdate(func(u Update) {
+		updates = append(updates, u)
+	})
+
+	profile := e.Profile()
+	profile.Key = testKey
+	profile.IV = "00112233445566778899aabbccddeeff"
+	if err := e.ApplyProfile(profile); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+	_ = e.SetEnabled(false)
+
+	// both at the same keyframe, in one update
+	if _, err := e.Encrypt(h264Stream()[0]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].Changes, []string{ChangeIV, ChangeEnabled}) || updates[0].Enabled {
+		t.Errorf("OnUpdate() = %+v, want one update of iv and enabled", updates)
+	}
+}
+
+func TestEncryptor_Keyframe(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+	_ = e.SetEnabled(false)
+
+	// the caller knows a P slice starts a new GOP
+	frame := h264Stream()[1]
+	e.Keyframe()
+	if sample, _ := e.EncryptSample(frame); !bytes.Equal(sample.Data, frame) {
+		t.Errorf("frame after Keyframe() encrypted")
+	}
+	if e.Encrypting() {
+		t.Errorf("Encrypting() = true after Keyframe()")
+	}
+}
+
+func TestEncryptor_SetEnabled_inPlace(t *testing.T) {
+	e, err := NewEncryptor(Config{Mode: "cenc", KeyID: testKeyID, Key: testKey, IV: testIV})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	_ = e.SetEnabled(false)
+
+	frame := h264Stream()[0]
+	buf := append([]byte(nil), frame...)
+	if err := e.EncryptInPlace(buf); err != nil {
+		t.Fatalf("EncryptInPlace() returned error: %s", err)
+	}
+	if !bytes.Equal(buf, frame) {
+		t.Errorf("EncryptInPlace() encrypted the keyframe switching off")
+	}
+
+	dst := make([]byte, 0, len(frame))
+	if out, _ := e.EncryptTo(dst, frame); !bytes.Equal(out, frame) {
+		t.Errorf("EncryptTo() encrypted while switched off")
+	}
+}
+
+func TestEncryptor_SetEnabled_audio(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", Codec: CodecAudio})
+	_ = e.SetEnabled(false)
+
+	// every audio frame is a keyframe
+	frame := bytes.Repeat([]byte{0x42}, 100)
+	if sample, _ := e.EncryptSample(frame); !bytes.Equal(sample.Data, frame) {
+		t.Errorf("audio frame encrypted after SetEnabled(false)")
+	}
+}
+
+func TestEncryptor_SetEnabled_closed(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cenc"})
+	e.Close()
+
+	if err := e.SetEnabled(true); !errors.Is(err, ErrProfileDisabled) {
+		t.Errorf("SetEnabled() of a closed encryptor = %v, want %v", err, ErrProfileDisabled)
+	}
+
+	disabled, _ := NewEncryptor(Config{})
+	if err := disabled.SetEnabled(true); !errors.Is(err, ErrProfileDisabled) {
+		t.Errorf("SetEnabled() of a disabled encryptor = %v, want %v", err, ErrProfileDisabled)
+	}
+	if disabled.Encrypting() {
+		t.Errorf("Encrypting() of a disabled encryptor = true")
+	}
+}
+
+func TestEncryptor_SetEnabled_concurrent(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	frames := h264Stream()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 200; j++ {
+				frame := frames[j%len(frames)]
+				sample, err := e.EncryptSample(frame)
+				if err != nil {
+					t.Errorf("EncryptSample() returned error: %s", err)
+					return
+				}
+
+				// whole frames only, clear or encrypted
+				clear := bytes.Equal(sample.Data, frame)
+				if clear == (FrameHeader{Subsamples: sample.Subsamples}).Encrypted() {
+					t.Errorf("sample clear = %v with subsamples %v", clear, sample.Subsamples)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		_ = e.SetEnabled(i%2 == 0)
+		e.Keyframe()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,85 @@
+package drm
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation scope of the spans of an Encryptor
+const TracerName = "github.com/m1k1o/neko/server/pkg/drm"
+
+// SpanEncrypt is the name of the span around encrypting an access unit
+const SpanEncrypt = "drm.encrypt"
+
+// Attributes of SpanEncrypt
+const (
+	AttributeMode      = attribute.Key("drm.mode")
+	AttributeNALUnits  = attribute.Key("drm.nal_units")
+	AttributeBytes     = attribute.Key("drm.bytes")
+	AttributeEncrypted = attribute.Key("drm.encrypted")
+)
+
+// SetTracer sets the provider of the tracer access units are traced with:
+// Encrypt, EncryptSample, EncryptTo and EncryptFrame wrap every access unit
+// in a SpanEncrypt span carrying the mode, the number of NAL units, the
+// input size and whether anything was encrypted, and record the error of
+// those that fail. The encryptor has no context to take a parent from,
+// every span is a root. Nothing is spent on tracing without provider, nil
+// removes it.
+func (e *Encryptor) SetTracer(tp trace.TracerProvider) {
+	if tp == nil {
+		e.tracer.Store(nil)
+		return
+	}
+
+	tracer := tp.Tracer(TracerName)
+	e.tracer.Store(&tracer)
+}
+
+// encryptSampleTraced is encryptSample in a span of tracer
+func (e *Encryptor) encryptSampleTraced(tracer trace.Tracer, dst, data []byte, keyframe keyframeSignal) (EncryptedSample, error) {
+	_, span := tracer.Start(context.Background(), SpanEncrypt, trace.WithSpanKind(trace.SpanKindInternal))
+	defer span.End()
+
+	units := e.nalUnitCount(data)
+	size := len(data)
+
+	sample, err := e.encryptAccessUnit(dst, data, keyframe)
+
+	mode := e.Mode()
+	if sample.state != nil {
+		mode = sample.state.mode
+	}
+	span.SetAttributes(
+		AttributeMode.String(mode),
+		AttributeNALUnits.Int(units),
+		AttributeBytes.Int(size),
+		AttributeEncrypted.Bool(err == nil && protectedSize(sample.Subsamples) > 0),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return sample, err
+}
+
+// nalUnitCount returns the number of NAL units of an access unit of the
+// configured NAL format, 1 for an audio sample and 0 when empty or
+// malformed
+func (e *Encryptor) nalUnitCount(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	if e.codec.isAudio() {
+		return 1
+	}
+
+	data, _, err := e.format.annexB(data)
+	if err != nil {
+		return 0
+	}
+	return len(findNALUnits(nil, data))
+}
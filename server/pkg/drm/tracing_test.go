@@ -0,0 +1,233 @@
+package drm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingProvider keeps the spans of its tracers
+type recordingProvider struct {
+	embedded.TracerProvider
+
+	mu    sync.Mutex
+	scope string
+	spans []*recordedSpan
+}
+
+type recordingTracer struct {
+	embedded.Tracer
+
+	p *recordingProvider
+}
+
+type recordedSpan struct {
+	noop.Span
+
+	name   string
+	attrs  map[attribute.Key]attribute.Value
+	errs   []error
+	status codes.Code
+	ended  bool
+}
+
+func (p *recordingProvider) Tracer(name string, _ ...trace.TracerOption) trace.Tracer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.scope = name
+	return recordingTracer{p: p}
+}
+
+func (t recordingTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	p := t.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	span := &recordedSpan{name: name, attrs: map[attribute.Key]attribute.Value{}}
+	p.spans = append(p.spans, span)
+	return ctx, span
+}
+
+// take returns the spans recorded since the last call
+func (p *recordingProvider) take() []*recordedSpan {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	spans := p.spans
+	p.spans = nil
+	return spans
+}
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordedSpan) SetStatus(code codes.Code, _ string) {
+	s.status = code
+}
+
+func (s *recordedSpan) End(...trace.SpanEndOption) {
+	s.ended = true
+}
+
+func TestEncryptor_SetTracer(t *testing.T) {
+	aus := h264Stream()
+	tp := &recordingProvider{}
+
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, RejectReencryption: true, TracerProvider: tp})
+	if tp.scope != TracerName {
+		t.Errorf("tracer scope = %q, want %q", tp.scope, TracerName)
+	}
+
+	once, err := e.Encrypt(aus[0])
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	spans := tp.take()
+	if len(spans) != 1 || spans[0].name != SpanEncrypt || !spans[0].ended {
+		t.Fatalf("Encrypt() recorded %d spans, want one ended %s span", len(spans), SpanEncrypt)
+	}
+
+	// AUD, SPS, PPS, SEI and the IDR slice
+	span := spans[0]
+	if span.attrs[AttributeMode].AsString() != "cbcs" || span.attrs[AttributeNALUnits].AsInt64() != 5 ||
+		span.attrs[AttributeBytes].AsInt64() != int64(len(aus[0])) || !span.attrs[AttributeEncrypted].AsBool() {
+		t.Errorf("span attributes = %v", span.attrs)
+	}
+	if len(span.errs) != 0 || span.status != codes.Unset {
+		t.Errorf("span of a successful access unit has errors %v and status %v", span.errs, span.status)
+	}
+
+	// slices too short to encrypt leave the access unit clear
+	if _, err := e.EncryptSample(aus[3]); err != nil {
+		t.Fatalf("EncryptSample() returned error: %s", err)
+	}
+	if spans := tp.take(); len(spans) != 1 || spans[0].attrs[AttributeEncrypted].AsBool() {
+		t.Errorf("EncryptSample() of short slices recorded %d spans, want one that encrypted nothing", len(spans))
+	}
+
+	// failures are recorded on the span
+	if _, err := e.Encrypt(once); !errors.Is(err, ErrAlreadyEncrypted) {
+		t.Fatalf("Encrypt() of its own output error = %v, want %v", err, ErrAlreadyEncrypted)
+	}
+	spans = tp.take()
+	if len(spans) != 1 || len(spans[0].errs) != 1 || !errors.Is(spans[0].errs[0], ErrAlreadyEncrypted) || spans[0].status != codes.Error {
+		t.Errorf("Encrypt() of its own output recorded %d spans, want one with the error", len(spans))
+	}
+	if spans[0].attrs[AttributeEncrypted].AsBool() {
+		t.Errorf("span of a failed access unit is marked encrypted")
+	}
+
+	// nothing is traced once removed
+	e.SetTracer(nil)
+	e.Encrypt(aus[1])
+	if spans := tp.take(); len(spans) != 0 {
+		t.Errorf("Encrypt() without tracer recorded %d spans", len(spans))
+	}
+}
+
+func TestEncryptor_SetTracerLayers(t *testing.T) {
+	tp := &recordingProvider{}
+
+	e := newTestEncryptor(t, Config{Mode: "cbcs", LayerIVs: true})
+	e.SetTracer(tp)
+
+	layer, err := e.ForLayer("h")
+	if err != nil {
+		t.Fatalf("ForLayer() returned error: %s", err)
+	}
+	if _, err := layer.EncryptTo(nil, h264Stream()[0]); err != nil {
+		t.Fatalf("EncryptTo() returned error: %s", err)
+	}
+	if spans := tp.take(); len(spans) != 1 {
+		t.Errorf("EncryptTo() of a layer recorded %d spans, want 1", len(spans))
+	}
+}
+
+func TestEncryptor_tracerOffAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not deterministic with the race detector")
+	}
+
+	frame := h264Stream()[0]
+
+	e, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+
+	buf := make([]byte, 0, 2*len(frame))
+	untraced := testing.AllocsPerRun(100, func() {
+		e.encryptAccessUnit(buf, frame, keyframeDetect)
+	})
+	off := testing.AllocsPerRun(100, func() {
+		e.encryptSample(buf, frame, keyframeDetect)
+	})
+	if off != untraced {
+		t.Errorf("encryptSample() without tracer allocates %v times, want %v as untraced", off, untraced)
+	}
+}
+
+// BenchmarkEncryptor_tracer compares encryption without tracer to the
+// untraced code path, and shows the cost of a no-op and a recording tracer
+func BenchmarkEncryptor_tracer(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		tp   trace.TracerProvider
+	}{
+		{"off", nil},
+		{"noop", noop.NewTracerProvider()},
+		{"recording", &recordingProvider{}},
+	}
+
+	frame := h264Stream()[0]
+	newEncryptor := func(b *testing.B, tp trace.TracerProvider) *Encryptor {
+		e, err := NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9, TracerProvider: tp})
+		if err != nil {
+			b.Fatalf("NewEncryptor() returned error: %s", err)
+		}
+		return e
+	}
+
+	b.Run("untraced", func(b *testing.B) {
+		e := newEncryptor(b, nil)
+
+		var buf []byte
+		b.SetBytes(int64(len(frame)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sample, _ := e.encryptAccessUnit(buf, frame, keyframeDetect)
+			buf = sample.Data
+		}
+	})
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			e := newEncryptor(b, bm.tp)
+
+			var buf []byte
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if tp, ok := bm.tp.(*recordingProvider); ok && i%1024 == 0 {
+					tp.take()
+				}
+				buf, _ = e.EncryptTo(buf, frame)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package drm
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Track labels of an EncryptorSet
+const (
+	TrackVideo = "video"
+	TrackAudio = "audio"
+)
+
+// TrackKey is the content key of a single track, hex encoded like Config
+type TrackKey struct {
+	KeyID string
+	Key   string
+	IV    string
+}
+
+// EncryptorSet holds an Encryptor per track, each with its own key so that
+// entitlements can differ per track
+type EncryptorSet struct {
+	encryptors map[string]*Encryptor
+}
+
+// NewEncryptorSet creates an Encryptor for every track of cfg.Tracks, and
+// for video from the flat key unless Tracks has one. The audio track
+// encrypts whole samples and uses the scheme of the configuration. Tracks
+// of cfg.ClearTracks get a disabled encryptor passing samples through.
+func NewEncryptorSet(cfg Config) (*EncryptorSet, error) {
+	keys := map[string]TrackKey{}
+	if cfg.KeyID != "" || cfg.Key != "" || cfg.IV != "" {
+		keys[TrackVideo] = TrackKey{KeyID: cfg.KeyID, Key: cfg.Key, IV: cfg.IV}
+	}
+	for track, key := range cfg.Tracks {
+		keys[track] = key
+	}
+	for _, track := range cfg.ClearTracks {
+		keys[track] = TrackKey{}
+	}
+
+	set := &EncryptorSet{encryptors: map[string]*Encryptor{}}
+	for track, key := range keys {
+		trackCfg := cfg
+		trackCfg.KeyID, trackCfg.Key, trackCfg.IV = key.KeyID, key.Key, key.IV
+		trackCfg.Tracks = nil
+		trackCfg.ClearTracks = nil
+		if track == TrackAudio {
+			trackCfg.Codec = CodecAudio
+		}
+		if cfg.clearTrack(track) {
+			trackCfg.Enabled = false
+		}
+
+		encryptor, err := NewEncryptor(trackCfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s track: %w", track, err)
+		}
+		set.encryptors[track] = encryptor
+	}
+
+	return set, nil
+}
+
+// Encryptor returns the encryptor of the track, nil without a key for it
+func (s *EncryptorSet) Encryptor(track string) *Encryptor {
+	return s.encryptors[track]
+}
+
+// KeyID returns the key ID of the track for license requests, nil without
+// a key for it
+func (s *EncryptorSet) KeyID(track string) []byte {
+	encryptor, ok := s.encryptors[track]
+	if !ok {
+		return nil
+	}
+	return encryptor.KeyID()
+}
+
+// Tracks returns the labels of the tracks with an encryptor, sorted
+func (s *EncryptorSet) Tracks() []string {
+	tracks := make([]string, 0, len(s.encryptors))
+	for track := range s.encryptors {
+		tracks = append(tracks, track)
+	}
+	slices.Sort(tracks)
+	return tracks
+}
+
+// EncryptedTracks returns the labels of the tracks that are encrypted,
+// sorted; tracks without a key or sent clear are left out
+func (s *EncryptorSet) EncryptedTracks() []string {
+	tracks := make([]string, 0, len(s.encryptors))
+	for track, encryptor := range s.encryptors {
+		if encryptor.Enabled() {
+			tracks = append(tracks, track)
+		}
+	}
+	slices.Sort(tracks)
+	return tracks
+}
+
+// Close closes the encryptors of every track, see Encryptor.Close
+func (s *EncryptorSet) Close() {
+	for _, encryptor := range s.encryptors {
+		encryptor.Close()
+	}
+}
+
+// clearTrack reports whether the track is one of cfg.ClearTracks
+func (cfg Config) clearTrack(track string) bool {
+	return slices.Contains(cfg.ClearTracks, track)
+}
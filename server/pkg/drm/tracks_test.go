@@ -0,0 +1,132 @@
+package drm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const (
+	testAudioKeyID = "a1a2a3a4a5a6a7a8a9aaabacadaeafa0"
+	testAudioKey   = "b1b2b3b4b5b6b7b8b9babbbcbdbebfb0"
+	testAudioIV    = "c1c2c3c4c5c6c7c8c9cacbcccdcecfc0"
+)
+
+func TestNewEncryptorSet(t *testing.T) {
+	audio := TrackKey{KeyID: testAudioKeyID, Key: testAudioKey, IV: testAudioIV}
+
+	tests := []struct {
+		name       string
+		cfg        Config
+		wantTracks []string
+	}{
+		{"flat key is video", Config{KeyID: testKeyID, Key: testKey, IV: testIV}, []string{TrackVideo}},
+		{"video and audio", Config{KeyID: testKeyID, Key: testKey, IV: testIV, Tracks: map[string]TrackKey{TrackAudio: audio}}, []string{TrackAudio, TrackVideo}},
+		{"tracks only", Config{Tracks: map[string]TrackKey{
+			TrackVideo: {KeyID: testKeyID, Key: testKey, IV: testIV},
+			TrackAudio: audio,
+		}}, []string{TrackAudio, TrackVideo}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Enabled = true
+			set, err := NewEncryptorSet(cfg)
+			if err != nil {
+				t.Fatalf("NewEncryptorSet() returned error: %s", err)
+			}
+
+			if got := set.Tracks(); !reflect.DeepEqual(got, tt.wantTracks) {
+				t.Errorf("Tracks() = %v, want %v", got, tt.wantTracks)
+			}
+			if got, want := set.KeyID(TrackVideo), mustHex(testKeyID); !bytes.Equal(got, want) {
+				t.Errorf("KeyID(%q) = %x, want %x", TrackVideo, got, want)
+			}
+
+			want := []byte(nil)
+			if len(tt.wantTracks) > 1 {
+				want = mustHex(testAudioKeyID)
+			}
+			if got := set.KeyID(TrackAudio); !bytes.Equal(got, want) {
+				t.Errorf("KeyID(%q) = %x, want %x", TrackAudio, got, want)
+			}
+		})
+	}
+}
+
+func TestNewEncryptorSet_invalidTrack(t *testing.T) {
+	_, err := NewEncryptorSet(Config{
+		Enabled: true,
+		KeyID:   testKeyID,
+		Key:     testKey,
+		IV:      testIV,
+		Tracks:  map[string]TrackKey{TrackAudio: {KeyID: testAudioKeyID, Key: "00", IV: testAudioIV}},
+	})
+	if err == nil {
+		t.Errorf("NewEncryptorSet() returned no error for a short audio key")
+	}
+}
+
+func TestNewEncryptorSet_clearTracks(t *testing.T) {
+	audio := TrackKey{KeyID: testAudioKeyID, Key: testAudioKey, IV: testAudioIV}
+
+	tests := []struct {
+		name          string
+		clear         []string
+		wantEncrypted []string
+	}{
+		{"none", nil, []string{TrackAudio, TrackVideo}},
+		{"audio", []string{TrackAudio}, []string{TrackVideo}},
+		{"video", []string{TrackVideo}, []string{TrackAudio}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := NewEncryptorSet(Config{
+				Enabled:     true,
+				KeyID:       testKeyID,
+				Key:         testKey,
+				IV:          testIV,
+				Tracks:      map[string]TrackKey{TrackAudio: audio},
+				ClearTracks: tt.clear,
+			})
+			if err != nil {
+				t.Fatalf("NewEncryptorSet() returned error: %s", err)
+			}
+
+			if got := set.EncryptedTracks(); !reflect.DeepEqual(got, tt.wantEncrypted) {
+				t.Errorf("EncryptedTracks() = %v, want %v", got, tt.wantEncrypted)
+			}
+
+			// clear tracks pass samples through and hold no key
+			for _, track := range tt.clear {
+				e := set.Encryptor(track)
+				if e == nil || e.Enabled() {
+					t.Fatalf("%s encryptor = %v, want a disabled one", track, e)
+				}
+				if keyID := set.KeyID(track); keyID != nil {
+					t.Errorf("KeyID(%q) = %x, want none", track, keyID)
+				}
+
+				frame := h264Stream()[0]
+				if got, err := e.Encrypt(frame); err != nil || !bytes.Equal(got, frame) {
+					t.Errorf("%s Encrypt() modified the sample: %v", track, err)
+				}
+			}
+		})
+	}
+
+	// session keys are not derived for clear tracks
+	f, err := NewEncryptorFactory(Config{
+		Enabled:     true,
+		Tracks:      map[string]TrackKey{TrackAudio: {}},
+		ClearTracks: []string{TrackAudio},
+	}, bytes.Repeat([]byte{0x5a}, 32), 0)
+	if err != nil {
+		t.Fatalf("NewEncryptorFactory() returned error: %s", err)
+	}
+	if _, ok := f.Keys("first")[TrackAudio]; ok {
+		t.Errorf("Keys() has a key for the clear audio track")
+	}
+}
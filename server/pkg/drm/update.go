@@ -0,0 +1,140 @@
+package drm
+
+import (
+	"bytes"
+	"slices"
+)
+
+// Change set entries of an Update
+const (
+	ChangeKeys    = "keys"
+	ChangeIV      = "iv"
+	ChangePattern = "pattern"
+	ChangeScheme  = "scheme"
+	// encryption was switched on or off, see SetEnabled
+	ChangeEnabled = "enabled"
+)
+
+// Update describes a single transition of the encryption parameters, the
+// epoch increases by one with every update
+type Update struct {
+	Epoch   uint64
+	Changes []string
+	Profile Profile
+	// Enabled is whether access units are encrypted from now on, clients
+	// install or remove their decryptor when it changes
+	Enabled bool
+}
+
+// diffStates returns what a client has to change to follow the transition
+func diffStates(old, new *cipherState) []string {
+	var changes []string
+
+	if !bytes.Equal(old.keyID, new.keyID) || !bytes.Equal(old.key, new.key) {
+		changes = append(changes, ChangeKeys)
+	}
+	if !bytes.Equal(old.iv, new.iv) || old.ivMode != new.ivMode {
+		changes = append(changes, ChangeIV)
+	}
+	if old.cryptBlocks != new.cryptBlocks || old.skipBlocks != new.skipBlocks {
+		changes = append(changes, ChangePattern)
+	}
+	if old.mode != new.mode {
+		changes = append(changes, ChangeScheme)
+	}
+
+	return changes
+}
+
+// switchTo makes s the state frames are encrypted with, e.mu is held. It
+// returns the update to report, nil when clients have nothing to change.
+// Calls in progress finish with the state they loaded.
+func (e *Encryptor) switchTo(s *cipherState) *Update {
+	old := e.state.Load()
+	changes := diffStates(old, s)
+
+	// identical key and IV continue the sample numbers and IVs, sharing the
+	// counter with calls still using the old state
+	if !slices.Contains(changes, ChangeKeys) && !slices.Contains(changes, ChangeIV) {
+		s.samples, s.ivNonce = old.samples, old.ivNonce
+	}
+
+	e.state.Store(s)
+
+	// switching to identical parameters is not a transition
+	if len(changes) == 0 {
+		return nil
+	}
+
+	e.epoch++
+	return &Update{
+		Epoch:   e.epoch,
+		Changes: changes,
+		Profile: s.profile(),
+		Enabled: e.active.Load(),
+	}
+}
+
+// Epoch returns the current configuration epoch, it starts at 1 and is 0
+// for a disabled encryptor
+func (e *Encryptor) Epoch() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.epoch
+}
+
+// OnUpdate sets a listener called exactly once for every transition of the
+// encryption parameters, at the frame the new parameters take effect
+func (e *Encryptor) OnUpdate(listener func(u Update)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.onUpdate = listener
+}
+
+// Rotation describes a switch to a new key, for clients to replace the key
+// of their decryptor
+type Rotation struct {
+	Epoch         uint64
+	KeyID         []byte
+	PreviousKeyID []byte
+	// IV is the constant IV, nil when every access unit has its own
+	IV         []byte
+	Generation uint64
+	// Frame is the number of access units encrypted before the first one
+	// with the new key
+	Frame uint64
+}
+
+// OnRotate sets a listener called once for every switch to a new key,
+// after OnUpdate and at the same access unit. Profiles staged by
+// ApplyProfile switch at a keyframe, UpdateKey switches right away.
+func (e *Encryptor) OnRotate(listener func(r Rotation)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.onRotate = listener
+}
+
+// rotationFrom returns the rotation of an update switching away from old,
+// nil unless the key changed, and keeps it for RotationState; e.mu is held
+func (e *Encryptor) rotationFrom(old *cipherState, update *Update) *Rotation {
+	if update == nil || !slices.Contains(update.Changes, ChangeKeys) {
+		return nil
+	}
+
+	s := e.state.Load()
+	r := &Rotation{
+		Epoch:         update.Epoch,
+		KeyID:         bytes.Clone(s.keyID),
+		PreviousKeyID: bytes.Clone(old.keyID),
+		Generation:    s.generation,
+		Frame:         e.stats.position.Load(),
+	}
+	if !PerSampleIV(s.ivMode) {
+		r.IV = bytes.Clone(s.iv)
+	}
+	e.rotated = r
+	return r
+}
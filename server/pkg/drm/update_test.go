@@ -0,0 +1,196 @@
+package drm
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptor_OnUpdate(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	if e.Epoch() != 1 {
+		t.Fatalf("Epoch() = %d, want 1", e.Epoch())
+	}
+
+	var updates []Update
+	e.OnUpdate(func(u Update) {
+		updates = append(updates, u)
+	})
+
+	base := Profile{
+		Mode:        "cbcs",
+		CryptBlocks: 1,
+		SkipBlocks:  9,
+		KeyID:       testKeyID,
+		Key:         testKey,
+		IV:          testIV,
+	}
+
+	with := func(f func(p *Profile)) Profile {
+		p := base
+		f(&p)
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		profile Profile
+		want    []string
+	}{
+		{
+			name:    "iv only",
+			profile: with(func(p *Profile) { p.IV = "00112233445566778899aabbccddeeff" }),
+			want:    []string{ChangeIV},
+		},
+		{
+			name:    "identical parameters",
+			profile: with(func(p *Profile) { p.IV = "00112233445566778899aabbccddeeff" }),
+			want:    nil,
+		},
+		{
+			name: "key only",
+			profile: with(func(p *Profile) {
+				p.Key = "101112131415161718191a1b1c1d1e1f"
+				p.IV = "00112233445566778899aabbccddeeff"
+			}),
+			want: []string{ChangeKeys},
+		},
+		{
+			name:    "pattern",
+			profile: with(func(p *Profile) { p.SkipBlocks = 0 }),
+			want:    []string{ChangeKeys, ChangeIV, ChangePattern},
+		},
+		{
+			name:    "scheme",
+			profile: with(func(p *Profile) { p.Mode = "cenc"; p.SkipBlocks = 0; p.CryptBlocks = 0 }),
+			want:    []string{ChangeIV, ChangePattern, ChangeScheme},
+		},
+	}
+
+	idrFrame := append(nalUnit(0x67, 8), nalUnit(0x65, 64)...)
+	epoch := e.Epoch()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updates = nil
+
+			if err := e.ApplyProfile(tt.profile); err != nil {
+				t.Fatalf("ApplyProfile() returned error: %s", err)
+			}
+
+			// several frames after the switch, still one update
+			for i := 0; i < 3; i++ {
+				if _, err := e.Encrypt(idrFrame); err != nil {
+					t.Fatalf("Encrypt() returned error: %s", err)
+				}
+			}
+
+			if tt.want == nil {
+				if len(updates) != 0 {
+					t.Errorf("OnUpdate() called %d times, want 0", len(updates))
+				}
+				if e.Epoch() != epoch {
+					t.Errorf("Epoch() = %d, want %d", e.Epoch(), epoch)
+				}
+				return
+			}
+
+			epoch++
+			if len(updates) != 1 {
+				t.Fatalf("OnUpdate() called %d times, want 1", len(updates))
+			}
+			if !reflect.DeepEqual(updates[0].Changes, tt.want) {
+				t.Errorf("OnUpdate() changes = %v, want %v", updates[0].Changes, tt.want)
+			}
+			if updates[0].Epoch != epoch || e.Epoch() != epoch {
+				t.Errorf("epoch = %d (Epoch() = %d), want %d", updates[0].Epoch, e.Epoch(), epoch)
+			}
+			if updates[0].Profile.Key != "" {
+				t.Errorf("OnUpdate() profile contains the key")
+			}
+		})
+	}
+}
+
+func TestEncryptor_EpochDisabled(t *testing.T) {
+	e, err := NewEncryptor(Config{})
+	if err != nil {
+		t.Fatalf("NewEncryptor() returned error: %s", err)
+	}
+	if e.Epoch() != 0 {
+		t.Errorf("Epoch() = %d, want 0", e.Epoch())
+	}
+}
+
+func TestEncryptor_OnRotate(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+
+	var rotations []Rotation
+	e.OnRotate(func(r Rotation) {
+		rotations = append(rotations, r)
+	})
+
+	frames := h264Stream()
+	for _, frame := range frames[:3] {
+		if _, err := e.Encrypt(frame); err != nil {
+			t.Fatalf("Encrypt() returned error: %s", err)
+		}
+	}
+
+	// a pattern change keeps the key
+	if err := e.SetPattern(Pattern{CryptBlocks: 1, SkipBlocks: 0}); err != nil {
+		t.Fatalf("SetPattern() returned error: %s", err)
+	}
+	if _, err := e.Encrypt(frames[0]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if len(rotations) != 0 {
+		t.Fatalf("OnRotate() = %+v without a new key", rotations)
+	}
+
+	next := e.Profile()
+	next.KeyID = "00000000000000000000000000000002"
+	next.Key = "101112131415161718191a1b1c1d1e1f"
+	next.IV = "00112233445566778899aabbccddeeff"
+	if err := e.ApplyProfile(next); err != nil {
+		t.Fatalf("ApplyProfile() returned error: %s", err)
+	}
+
+	// nothing before the keyframe
+	if _, err := e.Encrypt(frames[1]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if len(rotations) != 0 {
+		t.Fatalf("OnRotate() called before the keyframe")
+	}
+
+	if _, err := e.Encrypt(frames[0]); err != nil {
+		t.Fatalf("Encrypt() returned error: %s", err)
+	}
+	if len(rotations) != 1 {
+		t.Fatalf("OnRotate() called %d times, want once", len(rotations))
+	}
+
+	r := rotations[0]
+	if hex.EncodeToString(r.KeyID) != next.KeyID || hex.EncodeToString(r.PreviousKeyID) != testKeyID {
+		t.Errorf("rotation key IDs = %x from %x, want %s from %s", r.KeyID, r.PreviousKeyID, next.KeyID, testKeyID)
+	}
+	if hex.EncodeToString(r.IV) != next.IV {
+		t.Errorf("rotation IV = %x, want the constant IV %s", r.IV, next.IV)
+	}
+	if r.Frame != 5 || r.Epoch != e.Epoch() {
+		t.Errorf("rotation frame = %d, epoch = %d, want 5 and %d", r.Frame, r.Epoch, e.Epoch())
+	}
+
+	// counter mode IVs reach clients with every frame
+	ctr := newTestEncryptor(t, Config{Mode: "cenc"})
+	ctr.OnRotate(func(r Rotation) {
+		rotations = append(rotations, r)
+	})
+	if _, err := ctr.UpdateKeyHex("00000000000000000000000000000003", testKey, testIV); err != nil {
+		t.Fatalf("UpdateKeyHex() returned error: %s", err)
+	}
+	if len(rotations) != 2 || rotations[1].IV != nil || rotations[1].Frame != 0 {
+		t.Errorf("OnRotate() = %+v, want a rotation without IV right away", rotations)
+	}
+}
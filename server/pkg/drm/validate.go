@@ -0,0 +1,48 @@
+package drm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigErrors lists every invalid option of a configuration, so that all
+// of them can be fixed at once. The errors name the option, the shape of
+// what was given and what is expected, never key material.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d invalid options:", len(e))
+	for _, err := range e {
+		b.WriteString("\n  - ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the errors for errors.Is and errors.As
+func (e ConfigErrors) Unwrap() []error {
+	return e
+}
+
+// JoinConfigErrors returns nil without errors, a single error as it is and
+// ConfigErrors otherwise; nil errors are skipped and those of errors.Join
+// listed one by one
+func JoinConfigErrors(errs ...error) error {
+	var joined ConfigErrors
+	for _, err := range errs {
+		if multi, ok := err.(interface{ Unwrap() []error }); ok {
+			joined = append(joined, multi.Unwrap()...)
+		} else if err != nil {
+			joined = append(joined, err)
+		}
+	}
+
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
@@ -0,0 +1,75 @@
+package drm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNewEncryptor_allErrors(t *testing.T) {
+	const secret = "deadbeefdeadbeefdeadbeef"
+
+	_, err := NewEncryptor(Config{
+		Enabled: true,
+		KeyID:   "0001",
+		Key:     secret,
+		IV:      "not a key",
+		Mode:    "cbcs",
+	})
+
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("NewEncryptor() = %v, want three errors", err)
+	}
+
+	msg := err.Error()
+	for _, want := range []string{
+		"3 invalid options:",
+		"\n  - keyID must be 16 bytes hex or base64 encoded, got 2 bytes",
+		"\n  - key must be 16 bytes hex or base64 encoded, got 12 bytes",
+		"\n  - iv must be 16 bytes hex or base64 encoded",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("NewEncryptor() error %q does not contain %q", msg, want)
+		}
+	}
+	if strings.Contains(msg, secret) {
+		t.Errorf("NewEncryptor() error contains the key")
+	}
+
+	// mode and pattern checks are listed along
+	_, err = NewEncryptor(Config{Enabled: true, KeyID: "01", Key: testKey, IV: testIV, Mode: "cbcs", StrictPattern: true, SkipBlocks: 1, Parallelism: -1})
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Errorf("NewEncryptor() = %v, want key ID, pattern and parallelism errors", err)
+	}
+	_, err = NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "aes", Codec: "vp8"})
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Errorf("NewEncryptor() = %v, want mode and codec errors", err)
+	}
+
+	// a single error is returned as it is
+	_, err = NewEncryptor(Config{Enabled: true, KeyID: testKeyID, Key: testKey, IV: testIV, Mode: "cbc2"})
+	if errors.As(err, &errs) || err == nil {
+		t.Errorf("NewEncryptor() = %v, want a single error", err)
+	}
+}
+
+func TestJoinConfigErrors(t *testing.T) {
+	a, b, c := errors.New("a"), errors.New("b"), errors.New("c")
+
+	if err := JoinConfigErrors(nil, nil); err != nil {
+		t.Errorf("JoinConfigErrors() of nil = %v", err)
+	}
+	if err := JoinConfigErrors(nil, a); err != a {
+		t.Errorf("JoinConfigErrors() of one error = %v", err)
+	}
+
+	err := JoinConfigErrors(a, errors.Join(b, c))
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 3 || !errors.Is(err, c) {
+		t.Fatalf("JoinConfigErrors() = %#v, want three errors", err)
+	}
+	if want := "3 invalid options:\n  - a\n  - b\n  - c"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err, want)
+	}
+}
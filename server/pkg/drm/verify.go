@@ -0,0 +1,337 @@
+package drm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// VerifyIssue is the first broken NAL unit Verify found
+type VerifyIssue struct {
+	// index of the access unit, byte offset of the NAL unit in the stream
+	// and its type; NALType is -1 for issues of the whole access unit
+	AccessUnit int    `json:"access_unit"`
+	Offset     int    `json:"offset"`
+	NALType    int    `json:"nal_type"`
+	Reason     string `json:"reason"`
+}
+
+// VerifyReport summarizes a stream decrypted by Verify
+type VerifyReport struct {
+	AccessUnits int `json:"access_units"`
+	NALUnits    int `json:"nal_units"`
+
+	// VCL NAL units and those of them whose slice header parses after
+	// decryption; H.265 slices, data partitions B and C and slices before
+	// their parameter sets cannot be checked
+	Slices          int `json:"slices"`
+	ValidSlices     int `json:"valid_slices"`
+	UncheckedSlices int `json:"unchecked_slices"`
+
+	// SPS and PPS NAL units and those of them that parse as they are in the
+	// encrypted stream, H.265 ones cannot be checked
+	ParameterSets          int `json:"parameter_sets"`
+	ClearParameterSets     int `json:"clear_parameter_sets"`
+	UncheckedParameterSets int `json:"unchecked_parameter_sets"`
+
+	// broken NAL units and access units, and the first of them
+	Issues          int          `json:"issues"`
+	FirstCorruption *VerifyIssue `json:"first_corruption,omitempty"`
+}
+
+// OK reports whether nothing in the stream was found broken
+func (r VerifyReport) OK() bool {
+	return r.Issues == 0
+}
+
+// VerifyOptions configures Verify
+type VerifyOptions struct {
+	// Config of the encryptor the stream was encrypted with, its NAL
+	// formats are ignored. The KeySEI is not checked without a key ID.
+	Config Config
+	// Manifest names the protection of every access unit instead of the
+	// mode, pattern, key ID and IV of Config; the key of Config decrypts
+	// the periods of its key ID, any when it has none, Keys the others
+	Manifest *Manifest
+	Keys     []Key
+}
+
+// Verify decrypts an Annex B video stream of the Encryptor access unit by
+// access unit and returns the decrypted stream with a report of what was
+// found broken: access units failing to decrypt, NAL units with the
+// forbidden bit set, KeySEIs naming another key, malformed parameter sets
+// and slice headers. The slice data is entropy coded, a wrong key only
+// shows in a decoder fed the decrypted stream. Per-sample IVs are counted
+// from the first access unit, of its period with a manifest, unless a
+// KeySEI names them.
+//
+// An error is returned when the stream cannot be decrypted at all.
+func Verify(stream []byte, opts VerifyOptions) (VerifyReport, []byte, error) {
+	v := &verifier{opts: opts, period: -1}
+
+	cfg := opts.Config
+	cfg.Enabled = true
+	cfg.NALFormat, cfg.OutputNALFormat = NALFormatAnnexB, ""
+	if cfg.KeyID == "" {
+		// any key ID decrypts alike
+		cfg.KeyID = strings.Repeat("00", 16)
+	}
+
+	var err error
+	if v.codec, err = parseCodec(cfg.Codec); err != nil {
+		return VerifyReport{}, nil, err
+	}
+	if v.codec.isAudio() {
+		return VerifyReport{}, nil, errors.New("only video streams can be verified")
+	}
+	if v.codec == CodecH264 {
+		v.headers = newSliceHeaders()
+	}
+
+	// streams of encryptors without a nonce count the IVs from the IV alone
+	if cfg.IVNonce == "" {
+		cfg.IVNonce = zeroIVNonce
+	}
+
+	if opts.Manifest == nil {
+		if v.dec, err = NewDecryptor(cfg); err != nil {
+			return VerifyReport{}, nil, err
+		}
+		v.keyID = opts.Config.KeyID
+	}
+	v.cfg = cfg
+
+	out := make([]byte, 0, len(stream))
+	offset := 0
+	for _, au := range splitAccessUnits(v.codec, stream) {
+		dec, err := v.accessUnit(offset, au)
+		if err != nil {
+			return VerifyReport{}, nil, err
+		}
+		out = append(out, dec...)
+		offset += len(au)
+	}
+
+	return v.report, out, nil
+}
+
+// verifier holds the state of Verify along the stream
+type verifier struct {
+	opts VerifyOptions
+	cfg  Config
+
+	codec   nalCodec
+	headers *sliceHeaders // nil for H.265
+	report  VerifyReport
+
+	dec *Decryptor
+	// key ID the access units name in their KeySEI, empty when unknown
+	keyID string
+	// first sample of the manifest period of dec
+	period int64
+}
+
+// accessUnit decrypts and checks the access unit at offset in the stream
+func (v *verifier) accessUnit(offset int, au []byte) ([]byte, error) {
+	index := v.report.AccessUnits
+	v.report.AccessUnits++
+
+	if v.opts.Manifest != nil {
+		if err := v.selectPeriod(uint64(index)); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := v.dec.Decrypt(au)
+	if err != nil {
+		v.issue(index, offset, -1, fmt.Sprintf("decryption failed: %s", err))
+		out = au
+	}
+
+	if v.keyID != "" {
+		keyID, _ := hex.DecodeString(v.keyID)
+		if sei, ok := ParseKeySEI(au); ok && sei.KeyIDHash != KeyIDHash(keyID) {
+			v.issue(index, offset, -1, fmt.Sprintf("KeySEI names another key than %s", strings.ToLower(v.keyID)))
+		}
+	}
+
+	in, dec := findNALUnits(nil, au), findNALUnits(nil, out)
+	if len(in) != len(dec) {
+		v.issue(index, offset, -1, fmt.Sprintf("decryption turned %d NAL units into %d", len(in), len(dec)))
+		return out, nil
+	}
+
+	for i, r := range dec {
+		// bytes before the first start code
+		if r.headerLen == 0 {
+			continue
+		}
+		v.report.NALUnits++
+		v.nalUnit(index, offset+in[i].offset, r.nalu(out))
+	}
+	return out, nil
+}
+
+// nalUnit checks a decrypted NAL unit without start code
+func (v *verifier) nalUnit(index, offset int, nalu []byte) {
+	if len(nalu) < v.codec.headerLen() {
+		v.issue(index, offset, -1, "truncated NAL unit header")
+		return
+	}
+
+	nalType := v.codec.nalType(nalu)
+	if nalu[0]&0x80 != 0 {
+		v.issue(index, offset, int(nalType), "forbidden_zero_bit is set")
+		return
+	}
+
+	switch {
+	case v.codec.isSPS(nalType) || v.codec.isPPS(nalType):
+		v.report.ParameterSets++
+		if v.headers == nil {
+			v.report.UncheckedParameterSets++
+			return
+		}
+		// never encrypted, it has to parse as it is
+		if err := v.headers.update(nalu); err != nil {
+			v.issue(index, offset, int(nalType), fmt.Sprintf("malformed parameter set, encrypted or damaged: %s", err))
+			return
+		}
+		v.report.ClearParameterSets++
+	case v.codec.isVCL(nalType):
+		v.report.Slices++
+		if v.headers == nil || v.codec.isDataPartition(nalType) && nalType != 2 {
+			v.report.UncheckedSlices++
+			return
+		}
+		_, err := v.headers.parse(nalu, unescapeRBSP(nalu[1:]))
+		switch {
+		case err == nil:
+			v.report.ValidSlices++
+		case errors.Is(err, errUnknownParameterSet):
+			v.report.UncheckedSlices++
+		default:
+			v.issue(index, offset, int(nalType), fmt.Sprintf("malformed slice header: %s", err))
+		}
+	}
+}
+
+// selectPeriod switches to the decryptor of the manifest period of the
+// sample with the given index
+func (v *verifier) selectPeriod(sample uint64) error {
+	p, ok := v.opts.Manifest.PeriodAt(sample)
+	if !ok {
+		return fmt.Errorf("manifest has no period for access unit %d", sample)
+	}
+	if v.dec != nil && int64(p.Sample) == v.period {
+		return nil
+	}
+
+	dec, err := v.periodDecryptor(p)
+	if err != nil {
+		return fmt.Errorf("manifest period from access unit %d: %w", p.Sample, err)
+	}
+	v.dec, v.period, v.keyID = dec, int64(p.Sample), p.KeyID
+	return nil
+}
+
+// periodDecryptor creates the decryptor of a manifest period, one passing
+// the access units through when they were left clear
+func (v *verifier) periodDecryptor(p ManifestPeriod) (*Decryptor, error) {
+	if p.Scheme == "" {
+		return &Decryptor{}, nil
+	}
+
+	key, ok := v.key(p.KeyID)
+	if !ok {
+		return nil, fmt.Errorf("no key for key ID %s", p.KeyID)
+	}
+
+	profile := Profile{
+		Mode:        p.Scheme,
+		CryptBlocks: p.CryptBlocks,
+		SkipBlocks:  p.SkipBlocks,
+		KeyID:       p.KeyID,
+		Key:         key,
+		IV:          p.IV,
+		IVMode:      p.IVMode,
+	}
+
+	cfg := v.cfg
+	cfg.Mode, cfg.CryptBlocks, cfg.SkipBlocks = profile.Mode, profile.CryptBlocks, profile.SkipBlocks
+	cfg.KeyID, cfg.Key, cfg.IV = profile.KeyID, profile.Key, profile.IV
+	if p.IVNonce != "" {
+		cfg.IVNonce = p.IVNonce
+	}
+	dec, err := NewDecryptor(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// the configuration has no IV mode, the profile does, and a new state
+	// draws its own nonce
+	if dec.state, err = newCipherState(profile); err != nil {
+		return nil, err
+	}
+	if dec.state.ivNonce, err = newIVNonce(dec.state.ivMode, cfg.IVNonce); err != nil {
+		return nil, err
+	}
+	return dec, nil
+}
+
+// key returns the hex encoded key of a key ID of the manifest
+func (v *verifier) key(keyID string) (string, bool) {
+	if cfg := v.opts.Config; cfg.Key != "" && (cfg.KeyID == "" || strings.EqualFold(cfg.KeyID, keyID)) {
+		return cfg.Key, true
+	}
+	for _, k := range v.opts.Keys {
+		if strings.EqualFold(k.KeyID, keyID) {
+			return k.Key, true
+		}
+	}
+	return "", false
+}
+
+// issue counts a broken NAL unit or access unit, keeping the first one
+func (v *verifier) issue(index, offset, nalType int, reason string) {
+	v.report.Issues++
+	if v.report.FirstCorruption == nil {
+		v.report.FirstCorruption = &VerifyIssue{
+			AccessUnit: index,
+			Offset:     offset,
+			NALType:    nalType,
+			Reason:     reason,
+		}
+	}
+}
+
+// splitAccessUnits splits an Annex B stream into its access units where
+// StreamEncryptor does, the bytes before the first start code belong to
+// the first one
+func splitAccessUnits(codec nalCodec, stream []byte) [][]byte {
+	var aus [][]byte
+	start, vcl := 0, false
+
+	for _, r := range findNALUnits(nil, stream) {
+		if r.headerLen == 0 {
+			continue
+		}
+
+		nalu := r.nalu(stream)
+		if vcl {
+			if begins, _ := codec.beginsAccessUnit(nalu); begins {
+				aus = append(aus, stream[start:r.offset])
+				start, vcl = r.offset, false
+			}
+		}
+		if len(nalu) >= codec.headerLen() && codec.isVCL(codec.nalType(nalu)) {
+			vcl = true
+		}
+	}
+
+	if start < len(stream) {
+		aus = append(aus, stream[start:])
+	}
+	return aus
+}
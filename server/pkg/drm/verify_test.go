@@ -0,0 +1,172 @@
+package drm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	cfg := Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9}
+	aus := streamAccessUnits()
+	stream := encryptedStream(t, cfg, aus)
+
+	cfg.KeyID, cfg.Key, cfg.IV = testKeyID, testKey, testIV
+	report, out, err := Verify(stream, VerifyOptions{Config: cfg})
+	if err != nil {
+		t.Fatalf("Verify() returned error: %s", err)
+	}
+	if !bytes.Equal(out, bytes.Join(aus, nil)) {
+		t.Errorf("Verify() decrypted stream differs from the plaintext")
+	}
+
+	want := VerifyReport{
+		AccessUnits:        5,
+		NALUnits:           14,
+		Slices:             7,
+		ValidSlices:        7,
+		ParameterSets:      2,
+		ClearParameterSets: 2,
+	}
+	if report != want || !report.OK() {
+		t.Errorf("Verify() report = %+v, want %+v", report, want)
+	}
+}
+
+func TestVerify_corruption(t *testing.T) {
+	params := h264Params{}
+	aus := streamAccessUnits()
+	stream := encryptedStream(t, Config{Mode: "cenc"}, aus)
+
+	// a truncated PPS leaves the slices referring to it unchecked
+	pps := params.pps()
+	stream = bytes.Replace(stream, pps, pps[:6], 1)
+
+	report, _, err := Verify(stream, VerifyOptions{Config: Config{Mode: "cenc", KeyID: testKeyID, Key: testKey, IV: testIV}})
+	if err != nil {
+		t.Fatalf("Verify() returned error: %s", err)
+	}
+
+	want := VerifyIssue{AccessUnit: 0, Offset: bytes.Index(stream, pps[:6]), NALType: 8}
+	if report.FirstCorruption == nil {
+		t.Fatalf("Verify() found no corruption")
+	}
+	got := *report.FirstCorruption
+	got.Reason = ""
+	if got != want || !strings.Contains(report.FirstCorruption.Reason, "malformed parameter set") {
+		t.Errorf("Verify() first corruption = %+v, want %+v", *report.FirstCorruption, want)
+	}
+	if report.Issues != 1 || report.ClearParameterSets != 1 || report.UncheckedSlices != 7 {
+		t.Errorf("Verify() report = %+v, want one issue and the slices unchecked", report)
+	}
+}
+
+func TestVerify_keySEI(t *testing.T) {
+	cfg := Config{Mode: "cbcs", KeySEI: true}
+	stream := encryptedStream(t, cfg, streamAccessUnits())
+
+	tests := []struct {
+		name   string
+		keyID  string
+		issues int
+	}{
+		{"same key", testKeyID, 0},
+		{"other key", testProfile.KeyID, 5},
+		{"no key ID", "", 0},
+	}
+
+	for _, tt := range tests {
+		cfg := Config{Mode: "cbcs", KeySEI: true, KeyID: tt.keyID, Key: testKey, IV: testIV}
+		report, _, err := Verify(stream, VerifyOptions{Config: cfg})
+		if err != nil {
+			t.Fatalf("%s: Verify() returned error: %s", tt.name, err)
+		}
+		if report.Issues != tt.issues {
+			t.Errorf("%s: Verify() found %d issues, want %d", tt.name, report.Issues, tt.issues)
+		}
+		if tt.issues > 0 && !strings.Contains(report.FirstCorruption.Reason, "KeySEI") {
+			t.Errorf("%s: Verify() first corruption = %+v, want the KeySEI", tt.name, *report.FirstCorruption)
+		}
+	}
+}
+
+func TestVerify_manifest(t *testing.T) {
+	e := newTestEncryptor(t, Config{Mode: "cbcs", CryptBlocks: 1, SkipBlocks: 9})
+	r := NewManifestRecorder()
+
+	// the key rotates at the IDR of the second run of access units
+	aus := streamAccessUnits()
+	var stream []byte
+	for i := 0; i < 2; i++ {
+		for _, au := range aus {
+			sample, err := e.EncryptSample(au)
+			if err != nil {
+				t.Fatalf("EncryptSample() returned error: %s", err)
+			}
+			r.Record(sample, int64(len(stream)))
+			stream = append(stream, sample.Data...)
+		}
+		if err := e.ApplyProfile(testProfile); err != nil {
+			t.Fatalf("ApplyProfile() returned error: %s", err)
+		}
+	}
+
+	manifest := r.Manifest()
+	if len(manifest.Periods) != 2 {
+		t.Fatalf("manifest has %d periods, want 2", len(manifest.Periods))
+	}
+
+	opts := VerifyOptions{
+		Config:   Config{KeyID: testKeyID, Key: testKey},
+		Manifest: &manifest,
+	}
+	if _, _, err := Verify(stream, opts); err == nil || !strings.Contains(err.Error(), "no key") {
+		t.Errorf("Verify() without the rotated key error = %v, want no key", err)
+	}
+
+	opts.Keys = []Key{{KeyID: testProfile.KeyID, Key: testProfile.Key}}
+	report, out, err := Verify(stream, opts)
+	if err != nil {
+		t.Fatalf("Verify() returned error: %s", err)
+	}
+	if !report.OK() || report.ValidSlices != 14 {
+		t.Errorf("Verify() report = %+v, want all slices valid", report)
+	}
+	if !bytes.Equal(out, bytes.Repeat(bytes.Join(aus, nil), 2)) {
+		t.Errorf("Verify() decrypted stream differs from the plaintext")
+	}
+}
+
+func TestVerify_hevc(t *testing.T) {
+	cfg := Config{Mode: "cenc", Codec: CodecH265}
+	aus := [][]byte{
+		bytes.Join([][]byte{hevcNAL(32, 8), hevcNAL(33, 8), hevcNAL(34, 4), hevcSlice(19, true, 200)}, nil),
+		hevcSlice(1, true, 100),
+	}
+	stream := encryptedStream(t, cfg, aus)
+
+	cfg.KeyID, cfg.Key, cfg.IV = testKeyID, testKey, testIV
+	report, out, err := Verify(stream, VerifyOptions{Config: cfg})
+	if err != nil {
+		t.Fatalf("Verify() returned error: %s", err)
+	}
+	if !bytes.Equal(out, bytes.Join(aus, nil)) {
+		t.Errorf("Verify() decrypted stream differs from the plaintext")
+	}
+
+	want := VerifyReport{
+		AccessUnits:            2,
+		NALUnits:               5,
+		Slices:                 2,
+		UncheckedSlices:        2,
+		ParameterSets:          2,
+		UncheckedParameterSets: 2,
+	}
+	if report != want {
+		t.Errorf("Verify() report = %+v, want %+v", report, want)
+	}
+
+	if _, _, err := Verify(stream, VerifyOptions{Config: Config{Codec: CodecAudio, Key: testKey, IV: testIV}}); err == nil {
+		t.Errorf("Verify() of audio expected error")
+	}
+}
@@ -0,0 +1,203 @@
+// Package wire holds the versioned encodings of per-frame DRM metadata sent
+// to client side decryptors
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// Version is the metadata format version negotiated with a client
+type Version uint8
+
+const (
+	// Version1 supports only explicit subsample lists
+	Version1 Version = 1
+	// Version2 adds the compact subsample encoding
+	Version2 Version = 2
+)
+
+// MaxSubsamples is the maximum number of subsamples in one frame
+const MaxSubsamples = math.MaxUint16
+
+// subsample map encodings
+const (
+	encodingExplicit byte = 0x00
+	encodingCompact  byte = 0x01
+)
+
+var (
+	ErrTooManySubsamples = errors.New("too many subsamples")
+	ErrClearTooLarge     = errors.New("clear data of a subsample does not fit 16 bits")
+	ErrMalformed         = errors.New("malformed subsample map")
+	ErrUnknownEncoding   = errors.New("unknown subsample map encoding")
+)
+
+// AppendSubsamples appends the subsample map to dst. With Version2 the
+// compact encoding is used when every protected subsample shares the same
+// clear prefix, otherwise the explicit list is written.
+func AppendSubsamples(dst []byte, subsamples []drm.SubsampleInfo, version Version) ([]byte, error) {
+	if len(subsamples) > MaxSubsamples {
+		return nil, fmt.Errorf("%w: %d > %d", ErrTooManySubsamples, len(subsamples), MaxSubsamples)
+	}
+
+	for _, s := range subsamples {
+		if s.BytesOfClearData > math.MaxUint16 {
+			return nil, ErrClearTooLarge
+		}
+	}
+
+	if version >= Version2 && compactable(subsamples) {
+		return appendCompact(dst, subsamples), nil
+	}
+
+	return appendExplicit(dst, subsamples), nil
+}
+
+// compactable reports whether all protected subsamples share one clear
+// prefix, a single trailing clear-only subsample is allowed
+func compactable(subsamples []drm.SubsampleInfo) bool {
+	protected := subsamples
+	if n := len(protected); n > 0 && protected[n-1].BytesOfProtectedData == 0 {
+		// an empty trailing subsample can not be told apart from none
+		if protected[n-1].BytesOfClearData == 0 {
+			return false
+		}
+		protected = protected[:n-1]
+	}
+
+	if len(protected) < 2 {
+		return false
+	}
+
+	for _, s := range protected {
+		if s.BytesOfClearData != protected[0].BytesOfClearData || s.BytesOfProtectedData == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// explicit: 0x00, count u16, count * (clear u16, protected u32)
+func appendExplicit(dst []byte, subsamples []drm.SubsampleInfo) []byte {
+	dst = append(dst, encodingExplicit)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(subsamples)))
+
+	for _, s := range subsamples {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.BytesOfClearData))
+		dst = binary.BigEndian.AppendUint32(dst, s.BytesOfProtectedData)
+	}
+
+	return dst
+}
+
+// compact: 0x01, clear u16, count u16, count * protected uvarint,
+// trailing clear uvarint (0 when there is none)
+func appendCompact(dst []byte, subsamples []drm.SubsampleInfo) []byte {
+	var trailing uint32
+	if n := len(subsamples); subsamples[n-1].BytesOfProtectedData == 0 {
+		trailing = subsamples[n-1].BytesOfClearData
+		subsamples = subsamples[:n-1]
+	}
+
+	dst = append(dst, encodingCompact)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(subsamples[0].BytesOfClearData))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(subsamples)))
+
+	for _, s := range subsamples {
+		dst = binary.AppendUvarint(dst, uint64(s.BytesOfProtectedData))
+	}
+
+	return binary.AppendUvarint(dst, uint64(trailing))
+}
+
+// ReadSubsamples decodes a subsample map in either encoding and returns the
+// number of bytes consumed
+func ReadSubsamples(b []byte) ([]drm.SubsampleInfo, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrMalformed
+	}
+
+	switch b[0] {
+	case encodingExplicit:
+		return readExplicit(b)
+	case encodingCompact:
+		return readCompact(b)
+	default:
+		return nil, 0, fmt.Errorf("%w: 0x%02x", ErrUnknownEncoding, b[0])
+	}
+}
+
+func readExplicit(b []byte) ([]drm.SubsampleInfo, int, error) {
+	if len(b) < 3 {
+		return nil, 0, ErrMalformed
+	}
+
+	count := int(binary.BigEndian.Uint16(b[1:]))
+	size := 3 + count*6
+	if len(b) < size {
+		return nil, 0, ErrMalformed
+	}
+
+	subsamples := make([]drm.SubsampleInfo, count)
+	for i := range subsamples {
+		entry := b[3+i*6:]
+		subsamples[i] = drm.SubsampleInfo{
+			BytesOfClearData:     uint32(binary.BigEndian.Uint16(entry)),
+			BytesOfProtectedData: binary.BigEndian.Uint32(entry[2:]),
+		}
+	}
+
+	return subsamples, size, nil
+}
+
+func readCompact(b []byte) ([]drm.SubsampleInfo, int, error) {
+	if len(b) < 5 {
+		return nil, 0, ErrMalformed
+	}
+
+	clear := uint32(binary.BigEndian.Uint16(b[1:]))
+	count := int(binary.BigEndian.Uint16(b[3:]))
+	pos := 5
+
+	readUvarint := func() (uint32, bool) {
+		v, n := binary.Uvarint(b[pos:])
+		if n <= 0 || v > math.MaxUint32 {
+			return 0, false
+		}
+		pos += n
+		return uint32(v), true
+	}
+
+	subsamples := make([]drm.SubsampleInfo, 0, count+1)
+	for i := 0; i < count; i++ {
+		protected, ok := readUvarint()
+		if !ok {
+			return nil, 0, ErrMalformed
+		}
+
+		subsamples = append(subsamples, drm.SubsampleInfo{
+			BytesOfClearData:     clear,
+			BytesOfProtectedData: protected,
+		})
+	}
+
+	trailing, ok := readUvarint()
+	if !ok {
+		return nil, 0, ErrMalformed
+	}
+
+	if trailing > 0 {
+		if len(subsamples) >= MaxSubsamples {
+			return nil, 0, ErrTooManySubsamples
+		}
+		subsamples = append(subsamples, drm.SubsampleInfo{BytesOfClearData: trailing})
+	}
+
+	return subsamples, pos, nil
+}
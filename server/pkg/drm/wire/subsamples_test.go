@@ -0,0 +1,170 @@
+package wire
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+func sub(clear, protected uint32) drm.SubsampleInfo {
+	return drm.SubsampleInfo{BytesOfClearData: clear, BytesOfProtectedData: protected}
+}
+
+func slices(n int, clear uint32, trailing uint32) []drm.SubsampleInfo {
+	subs := make([]drm.SubsampleInfo, 0, n+1)
+	for i := 0; i < n; i++ {
+		subs = append(subs, drm.SubsampleInfo{
+			BytesOfClearData:     clear,
+			BytesOfProtectedData: uint32(100 + i*37),
+		})
+	}
+	if trailing > 0 {
+		subs = append(subs, drm.SubsampleInfo{BytesOfClearData: trailing})
+	}
+	return subs
+}
+
+func TestSubsamples_roundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		subsamples  []drm.SubsampleInfo
+		wantCompact bool
+	}{
+		{
+			name:       "empty",
+			subsamples: []drm.SubsampleInfo{},
+		},
+		{
+			name:       "single subsample",
+			subsamples: slices(1, 5, 0),
+		},
+		{
+			name:        "many slices",
+			subsamples:  slices(32, 5, 0),
+			wantCompact: true,
+		},
+		{
+			name:        "many slices with trailing clear",
+			subsamples:  slices(32, 5, 40),
+			wantCompact: true,
+		},
+		{
+			name:        "large protected sizes",
+			subsamples:  []drm.SubsampleInfo{sub(5, 1<<31), sub(5, 1), sub(5, 1<<20)},
+			wantCompact: true,
+		},
+		{
+			name:       "different clear prefix",
+			subsamples: append([]drm.SubsampleInfo{{BytesOfClearData: 40, BytesOfProtectedData: 900}}, slices(8, 5, 0)...),
+		},
+		{
+			name:       "clear only subsample in the middle",
+			subsamples: []drm.SubsampleInfo{sub(5, 100), sub(5, 0), sub(5, 100)},
+		},
+		{
+			name:       "empty trailing subsample",
+			subsamples: []drm.SubsampleInfo{sub(5, 100), sub(5, 100), sub(0, 0)},
+		},
+		{
+			name:        "maximum entries",
+			subsamples:  slices(MaxSubsamples, 5, 0),
+			wantCompact: true,
+		},
+		{
+			name:        "maximum entries with trailing clear",
+			subsamples:  slices(MaxSubsamples-1, 5, 7),
+			wantCompact: true,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, version := range []Version{Version1, Version2} {
+			t.Run(tt.name, func(t *testing.T) {
+				b, err := AppendSubsamples([]byte{0xff}, tt.subsamples, version)
+				if err != nil {
+					t.Fatalf("AppendSubsamples() returned error: %s", err)
+				}
+				if b[0] != 0xff {
+					t.Fatalf("AppendSubsamples() overwrote dst")
+				}
+
+				wantEncoding := encodingExplicit
+				if tt.wantCompact && version >= Version2 {
+					wantEncoding = encodingCompact
+				}
+				if b[1] != wantEncoding {
+					t.Errorf("AppendSubsamples(v%d) encoding = %d, want %d", version, b[1], wantEncoding)
+				}
+
+				// trailing bytes belong to the next field
+				got, n, err := ReadSubsamples(append(b[1:], 0xee))
+				if err != nil {
+					t.Fatalf("ReadSubsamples() returned error: %s", err)
+				}
+				if n != len(b)-1 {
+					t.Errorf("ReadSubsamples() consumed %d bytes, want %d", n, len(b)-1)
+				}
+				if !reflect.DeepEqual(got, tt.subsamples) {
+					t.Errorf("ReadSubsamples() = %v, want %v", got, tt.subsamples)
+				}
+			})
+		}
+	}
+}
+
+func TestSubsamples_compactIsSmaller(t *testing.T) {
+	subs := slices(32, 5, 0)
+
+	explicit, _ := AppendSubsamples(nil, subs, Version1)
+	compact, _ := AppendSubsamples(nil, subs, Version2)
+
+	if len(compact)*2 > len(explicit) {
+		t.Errorf("compact encoding is %d bytes, explicit %d", len(compact), len(explicit))
+	}
+}
+
+func TestAppendSubsamples_bounds(t *testing.T) {
+	if _, err := AppendSubsamples(nil, slices(MaxSubsamples+1, 5, 0), Version2); !errors.Is(err, ErrTooManySubsamples) {
+		t.Errorf("AppendSubsamples() error = %v, want %v", err, ErrTooManySubsamples)
+	}
+
+	large := []drm.SubsampleInfo{{BytesOfClearData: 1 << 16, BytesOfProtectedData: 16}}
+	if _, err := AppendSubsamples(nil, large, Version2); !errors.Is(err, ErrClearTooLarge) {
+		t.Errorf("AppendSubsamples() error = %v, want %v", err, ErrClearTooLarge)
+	}
+}
+
+func TestReadSubsamples_malformed(t *testing.T) {
+	for _, version := range []Version{Version1, Version2} {
+		b, err := AppendSubsamples(nil, slices(4, 5, 40), version)
+		if err != nil {
+			t.Fatalf("AppendSubsamples() returned error: %s", err)
+		}
+
+		// every truncation must be detected
+		for i := 0; i < len(b); i++ {
+			if _, _, err := ReadSubsamples(b[:i]); !errors.Is(err, ErrMalformed) {
+				t.Errorf("ReadSubsamples(v%d, %d of %d bytes) error = %v, want %v", version, i, len(b), err, ErrMalformed)
+			}
+		}
+	}
+
+	if _, _, err := ReadSubsamples([]byte{0x7f, 0, 0}); !errors.Is(err, ErrUnknownEncoding) {
+		t.Errorf("ReadSubsamples() error = %v, want %v", err, ErrUnknownEncoding)
+	}
+
+	// protected size overflowing 32 bits
+	overflow := []byte{encodingCompact, 0, 5, 0, 1, 0xff, 0xff, 0xff, 0xff, 0x7f, 0}
+	if _, _, err := ReadSubsamples(overflow); !errors.Is(err, ErrMalformed) {
+		t.Errorf("ReadSubsamples() error = %v, want %v", err, ErrMalformed)
+	}
+
+	// trailing clear beyond the maximum entry count
+	full, _ := AppendSubsamples(nil, slices(MaxSubsamples, 5, 0), Version2)
+	full[len(full)-1] = 7
+	if _, _, err := ReadSubsamples(full); !errors.Is(err, ErrTooManySubsamples) {
+		t.Errorf("ReadSubsamples() error = %v, want %v", err, ErrTooManySubsamples)
+	}
+}
@@ -0,0 +1,188 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+// trailerMagic marks the end of a frame carrying a metadata trailer
+var trailerMagic = [2]byte{'N', 'K'}
+
+// trailerFooterSize is the tlv length u16, version u8 and magic
+const trailerFooterSize = 2 + 1 + len(trailerMagic)
+
+// TLV types, 0x00-0x7f are reserved for DRM metadata and 0x80-0xff for the
+// embedding application
+const (
+	TypeSubsamples byte = 0x01
+
+	TypeApplicationFirst byte = 0x80
+)
+
+// MaxApplicationSize caps the application TLVs of one frame, headers
+// included
+const MaxApplicationSize = 1024
+
+var (
+	ErrNoTrailer           = errors.New("frame has no metadata trailer")
+	ErrApplicationType     = errors.New("application TLV type outside of the application range")
+	ErrApplicationTooLarge = errors.New("application TLVs exceed the size cap")
+	ErrUnsupportedVersion  = errors.New("unsupported trailer version")
+	ErrMalformedTrailer    = errors.New("malformed metadata trailer")
+	ErrSubsampleSize       = errors.New("subsample map does not cover the frame payload")
+)
+
+// TLV is one type-length-value entry of the trailer
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Trailer is the per-frame metadata appended after the frame payload:
+//
+//	payload | tlv* | tlv length u16 | version u8 | "NK"
+//
+// where each tlv is type u8, length u16, value
+type Trailer struct {
+	Version    Version
+	Subsamples []drm.SubsampleInfo // nil when not sent
+
+	// Application TLVs are opaque to the DRM logic and returned as is
+	Application []TLV
+	// Unknown TLVs from the DRM range written by newer servers, kept so
+	// they can be passed through
+	Unknown []TLV
+}
+
+// ValidateApplication checks the application TLVs against the type range
+// and the size cap
+func ValidateApplication(tlvs []TLV) error {
+	size := 0
+	for _, tlv := range tlvs {
+		if tlv.Type < TypeApplicationFirst {
+			return fmt.Errorf("%w: 0x%02x", ErrApplicationType, tlv.Type)
+		}
+		size += 3 + len(tlv.Value)
+	}
+
+	if size > MaxApplicationSize {
+		return fmt.Errorf("%w: %d > %d bytes", ErrApplicationTooLarge, size, MaxApplicationSize)
+	}
+
+	return nil
+}
+
+// AppendTrailer appends the trailer to the frame payload in dst
+func AppendTrailer(dst []byte, t Trailer) ([]byte, error) {
+	if t.Version != Version1 && t.Version != Version2 {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, t.Version)
+	}
+
+	if err := ValidateApplication(t.Application); err != nil {
+		return nil, err
+	}
+
+	start := len(dst)
+
+	if t.Subsamples != nil {
+		subsamples, err := AppendSubsamples(nil, t.Subsamples, t.Version)
+		if err != nil {
+			return nil, err
+		}
+		if len(subsamples) > 0xffff {
+			return nil, fmt.Errorf("%w: %d subsamples", ErrTooManySubsamples, len(t.Subsamples))
+		}
+		dst = appendTLV(dst, TypeSubsamples, subsamples)
+	}
+	for _, tlv := range t.Unknown {
+		dst = appendTLV(dst, tlv.Type, tlv.Value)
+	}
+	for _, tlv := range t.Application {
+		dst = appendTLV(dst, tlv.Type, tlv.Value)
+	}
+
+	size := len(dst) - start
+	if size > 0xffff {
+		return nil, fmt.Errorf("%w: trailer of %d bytes", ErrMalformedTrailer, size)
+	}
+
+	dst = binary.BigEndian.AppendUint16(dst, uint16(size))
+	dst = append(dst, byte(t.Version))
+	return append(dst, trailerMagic[:]...), nil
+}
+
+func appendTLV(dst []byte, typ byte, value []byte) []byte {
+	dst = append(dst, typ)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(value)))
+	return append(dst, value...)
+}
+
+// ParseTrailer splits a frame into its payload and trailer, TLV values
+// alias the frame. The subsample map, when present, must cover the payload
+// exactly.
+func ParseTrailer(frame []byte) ([]byte, Trailer, error) {
+	n := len(frame)
+	if n < trailerFooterSize || frame[n-2] != trailerMagic[0] || frame[n-1] != trailerMagic[1] {
+		return nil, Trailer{}, ErrNoTrailer
+	}
+
+	t := Trailer{Version: Version(frame[n-3])}
+	if t.Version != Version1 && t.Version != Version2 {
+		return nil, Trailer{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, t.Version)
+	}
+
+	size := int(binary.BigEndian.Uint16(frame[n-5:]))
+	end := n - trailerFooterSize
+	if size > end {
+		return nil, Trailer{}, ErrMalformedTrailer
+	}
+
+	payload := frame[:end-size]
+	tlvs := frame[end-size : end]
+
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, Trailer{}, ErrMalformedTrailer
+		}
+
+		typ := tlvs[0]
+		length := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+length {
+			return nil, Trailer{}, ErrMalformedTrailer
+		}
+
+		value := tlvs[3 : 3+length]
+		tlvs = tlvs[3+length:]
+
+		switch {
+		case typ == TypeSubsamples:
+			subsamples, read, err := ReadSubsamples(value)
+			if err != nil {
+				return nil, Trailer{}, err
+			}
+			if read != len(value) {
+				return nil, Trailer{}, ErrMalformedTrailer
+			}
+			t.Subsamples = subsamples
+		case typ >= TypeApplicationFirst:
+			t.Application = append(t.Application, TLV{Type: typ, Value: value})
+		default:
+			t.Unknown = append(t.Unknown, TLV{Type: typ, Value: value})
+		}
+	}
+
+	if t.Subsamples != nil {
+		var total uint64
+		for _, s := range t.Subsamples {
+			total += uint64(s.BytesOfClearData) + uint64(s.BytesOfProtectedData)
+		}
+		if total != uint64(len(payload)) {
+			return nil, Trailer{}, fmt.Errorf("%w: %d != %d bytes", ErrSubsampleSize, total, len(payload))
+		}
+	}
+
+	return payload, t, nil
+}
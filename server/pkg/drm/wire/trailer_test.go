@@ -0,0 +1,173 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+func TestTrailer_roundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xab}, 325)
+
+	tests := []struct {
+		name    string
+		trailer Trailer
+	}{
+		{
+			name:    "subsamples only",
+			trailer: Trailer{Version: Version2, Subsamples: []drm.SubsampleInfo{sub(5, 160), sub(160, 0)}},
+		},
+		{
+			name: "application TLVs",
+			trailer: Trailer{
+				Version:    Version1,
+				Subsamples: []drm.SubsampleInfo{sub(325, 0)},
+				Application: []TLV{
+					{Type: 0x80, Value: []byte("scene:42")},
+					{Type: 0xff, Value: []byte{}},
+				},
+			},
+		},
+		{
+			name: "application TLVs without DRM metadata",
+			trailer: Trailer{
+				Version:     Version2,
+				Application: []TLV{{Type: 0x90, Value: []byte{1, 2, 3}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := AppendTrailer(append([]byte{}, payload...), tt.trailer)
+			if err != nil {
+				t.Fatalf("AppendTrailer() returned error: %s", err)
+			}
+
+			got, trailer, err := ParseTrailer(frame)
+			if err != nil {
+				t.Fatalf("ParseTrailer() returned error: %s", err)
+			}
+
+			if !bytes.Equal(got, payload) {
+				t.Errorf("ParseTrailer() payload differs")
+			}
+			if !reflect.DeepEqual(trailer, tt.trailer) {
+				t.Errorf("ParseTrailer() = %+v, want %+v", trailer, tt.trailer)
+			}
+		})
+	}
+}
+
+func TestTrailer_applicationCap(t *testing.T) {
+	tests := []struct {
+		name    string
+		tlvs    []TLV
+		wantErr error
+	}{
+		{
+			name: "exactly at the cap",
+			tlvs: []TLV{{Type: 0x80, Value: make([]byte, MaxApplicationSize-3)}},
+		},
+		{
+			name:    "over the cap",
+			tlvs:    []TLV{{Type: 0x80, Value: make([]byte, MaxApplicationSize-3)}, {Type: 0x81}},
+			wantErr: ErrApplicationTooLarge,
+		},
+		{
+			name:    "DRM range type",
+			tlvs:    []TLV{{Type: TypeSubsamples, Value: []byte{0}}},
+			wantErr: ErrApplicationType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := AppendTrailer(nil, Trailer{Version: Version1, Application: tt.tlvs})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("AppendTrailer() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrailer_unknownPassThrough(t *testing.T) {
+	payload := []byte{0, 0, 0, 1, 0x65, 1, 2, 3}
+
+	// trailer of a newer server with a DRM TLV this parser does not know
+	frame, err := AppendTrailer(append([]byte{}, payload...), Trailer{
+		Version:     Version2,
+		Subsamples:  []drm.SubsampleInfo{sub(8, 0)},
+		Unknown:     []TLV{{Type: 0x42, Value: []byte{9, 9}}},
+		Application: []TLV{{Type: 0x80, Value: []byte("marker")}},
+	})
+	if err != nil {
+		t.Fatalf("AppendTrailer() returned error: %s", err)
+	}
+
+	_, trailer, err := ParseTrailer(frame)
+	if err != nil {
+		t.Fatalf("ParseTrailer() returned error: %s", err)
+	}
+
+	if len(trailer.Unknown) != 1 || trailer.Unknown[0].Type != 0x42 {
+		t.Fatalf("ParseTrailer() unknown = %+v, want type 0x42", trailer.Unknown)
+	}
+	if len(trailer.Application) != 1 || string(trailer.Application[0].Value) != "marker" {
+		t.Errorf("ParseTrailer() application = %+v, want marker", trailer.Application)
+	}
+
+	// writing the parsed trailer again keeps the unknown TLV
+	again, err := AppendTrailer(append([]byte{}, payload...), trailer)
+	if err != nil {
+		t.Fatalf("AppendTrailer() returned error: %s", err)
+	}
+	if !bytes.Equal(again, frame) {
+		t.Errorf("re-encoded trailer differs from the original")
+	}
+}
+
+func TestParseTrailer_malformed(t *testing.T) {
+	valid, err := AppendTrailer([]byte{1, 2, 3, 4}, Trailer{Version: Version1, Subsamples: []drm.SubsampleInfo{sub(4, 0)}})
+	if err != nil {
+		t.Fatalf("AppendTrailer() returned error: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		wantErr error
+	}{
+		{
+			name:    "no trailer",
+			frame:   []byte{0, 0, 0, 1, 0x65},
+			wantErr: ErrNoTrailer,
+		},
+		{
+			name:    "unknown version",
+			frame:   append(append([]byte{}, valid[:len(valid)-3]...), 9, 'N', 'K'),
+			wantErr: ErrUnsupportedVersion,
+		},
+		{
+			name:    "length beyond frame",
+			frame:   []byte{0xff, 0xff, 1, 'N', 'K'},
+			wantErr: ErrMalformedTrailer,
+		},
+		{
+			name:    "subsamples do not cover payload",
+			frame:   append([]byte{0xaa}, valid...),
+			wantErr: ErrSubsampleSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseTrailer(tt.frame); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseTrailer() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
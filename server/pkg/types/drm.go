@@ -0,0 +1,217 @@
+package types
+
+import (
+	"crypto/rsa"
+	"errors"
+	"time"
+
+	"github.com/m1k1o/neko/server/pkg/drm"
+)
+
+var (
+	ErrDRMDisabled    = errors.New("drm is disabled")
+	ErrDRMUnsupported = errors.New("not supported by the configured drm engine")
+	// ErrDRMWireVersionPinned is returned when a session picks another
+	// frame header version than the one it negotiated
+	ErrDRMWireVersionPinned = errors.New("frame header version of the session is pinned")
+)
+
+type DRMProfile struct {
+	Mode        string `json:"mode"`
+	CryptBlocks int    `json:"crypt_blocks"`
+	SkipBlocks  int    `json:"skip_blocks"`
+	KeyID       string `json:"key_id"`
+	Key         string `json:"key,omitempty"`
+	IV          string `json:"iv"`
+	IVMode      string `json:"iv_mode"`
+
+	// ActivateAt schedules the switch to the first keyframe at or after
+	// this time, unset means the next keyframe
+	ActivateAt *time.Time `json:"activate_at,omitempty"`
+}
+
+// DRMUpdate describes one change of the DRM parameters, Changes lists what
+// changed out of keys, iv, pattern, scheme and enabled
+type DRMUpdate struct {
+	Epoch   uint64     `json:"epoch"`
+	Changes []string   `json:"changes"`
+	Profile DRMProfile `json:"profile"`
+	// Enabled is false while encryption is switched off, frames are sent
+	// clear from the keyframe of this update on
+	Enabled bool `json:"enabled"`
+}
+
+// DRMStatus tells operators whether the stream is encrypted and with what
+type DRMStatus struct {
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode,omitempty"`
+	KeyID   string `json:"key_id,omitempty"`
+	// Pattern is crypt:skip, set with cbcs and cens only
+	Pattern         string `json:"pattern,omitempty"`
+	FramesEncrypted uint64 `json:"frames_encrypted"`
+	// LastRotation is unset until the key changed for the first time,
+	// LastRotationFrame is the number of access units encrypted before
+	// the first one with the current key
+	LastRotation      *time.Time `json:"last_rotation,omitempty"`
+	LastRotationFrame *uint64    `json:"last_rotation_frame,omitempty"`
+	// PendingKeyID is the key staged to take over at a keyframe, staged
+	// once PendingSinceFrame access units were encrypted
+	PendingKeyID      string  `json:"pending_key_id,omitempty"`
+	PendingSinceFrame *uint64 `json:"pending_since_frame,omitempty"`
+	// AwaitingSessions have not acknowledged the pending key yet, it is
+	// switched to without them at AckDeadline; set with drm.key_overlap
+	AwaitingSessions []string   `json:"awaiting_sessions,omitempty"`
+	AckDeadline      *time.Time `json:"ack_deadline,omitempty"`
+}
+
+// DRMKeyRotation names the key the stream switched to
+type DRMKeyRotation struct {
+	KeyID         string `json:"key_id"`
+	PreviousKeyID string `json:"previous_key_id"`
+}
+
+// DRMKeyChange tells clients to replace the key of their decryptor, from
+// the access unit Frame on, with binary fields encoded like DRMInfo
+type DRMKeyChange struct {
+	Epoch uint64 `json:"epoch"`
+	KeyID []byte `json:"key_id"`
+	// IV is omitted when every frame has its own
+	IV []byte `json:"iv,omitempty"`
+	// access units encrypted before the first one with the new key
+	Frame uint64    `json:"frame"`
+	Time  time.Time `json:"time"`
+}
+
+// DRMKeyExport is the current content key wrapped under the public key of
+// the caller, it never contains the plaintext key
+type DRMKeyExport struct {
+	KeyID        string `json:"key_id"`
+	Algorithm    string `json:"algorithm"`
+	EncryptedKey []byte `json:"encrypted_key"`
+}
+
+// DRMClearKey is a content key served to ClearKey CDMs
+type DRMClearKey struct {
+	KeyID []byte
+	Key   []byte
+}
+
+// DRMInitData is everything a player needs to bootstrap EME, it stays
+// valid until the epoch changes
+type DRMInitData struct {
+	Epoch        uint64           `json:"epoch"`
+	Scheme       string           `json:"scheme"`
+	CryptBlocks  int              `json:"crypt_blocks"`
+	SkipBlocks   int              `json:"skip_blocks"`
+	IV           string           `json:"iv"`
+	Keys         []DRMInitDataKey `json:"keys"`
+	InitDataType string           `json:"init_data_type"`
+	// PSSH boxes by key system, base64 encoded
+	PSSH map[string][]byte `json:"pssh"`
+}
+
+// DRMInfo is what a client needs to set up its decryptor, binary fields
+// are base64 encoded
+type DRMInfo struct {
+	Enabled bool   `json:"enabled"`
+	Epoch   uint64 `json:"epoch,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	KeyID   []byte `json:"key_id,omitempty"`
+	// IV is omitted when every frame has its own, see IVMode
+	IV          []byte `json:"iv,omitempty"`
+	IVMode      string `json:"iv_mode,omitempty"`
+	CryptBlocks int    `json:"crypt_blocks,omitempty"`
+	SkipBlocks  int    `json:"skip_blocks,omitempty"`
+	LicenseURL  string `json:"license_url,omitempty"`
+	// LicenseURLs are the license servers of single systems overriding
+	// LicenseURL, by pssh system name
+	LicenseURLs map[string]string `json:"license_urls,omitempty"`
+	// pssh boxes for the license request
+	InitData []byte `json:"init_data,omitempty"`
+	// Tracks lists the encrypted track labels, the others are sent clear
+	Tracks []string `json:"tracks,omitempty"`
+	// Exempt sessions are sent the stream clear and must not install a
+	// decryptor, Enabled is false for them
+	Exempt bool `json:"exempt,omitempty"`
+	// Layers lists the IVs of the video streams with drm.layer_ivs,
+	// omitted when every frame has its own
+	Layers []DRMLayer `json:"layers,omitempty"`
+	// WireVersions lists the frame header versions the server can emit with
+	// drm.frame_header, the client picks one with drm/wire_version
+	WireVersions []int `json:"wire_versions,omitempty"`
+}
+
+// DRMLayer is the IV a video stream is encrypted with, by its ID
+type DRMLayer struct {
+	ID string `json:"id"`
+	IV []byte `json:"iv"`
+}
+
+// DRMCapabilities describes the optional behavior of the running encryptor
+type DRMCapabilities struct {
+	Engine string `json:"engine"`
+	KeySEI bool   `json:"key_sei"`
+	// FrameHeader is set when every frame starts with its frame header
+	FrameHeader bool `json:"frame_header"`
+	// StreamChecks lists the checks access units are rejected by, empty
+	// unless strict stream checks are enabled
+	StreamChecks []string `json:"stream_checks"`
+}
+
+type DRMInitDataKey struct {
+	KeyID string `json:"key_id"`
+	// Pending keys are staged and take over at the next keyframe
+	Pending bool `json:"pending,omitempty"`
+	// Track is set for keys of a track other than video
+	Track string `json:"track,omitempty"`
+}
+
+type DRMManager interface {
+	Start()
+	Shutdown() error
+
+	Enabled() bool
+	DebugPage() bool
+	ClearKeyEndpoint() bool
+	Codec() string
+	Encryptor() *drm.Encryptor
+	TrackEncryptor(track string) *drm.Encryptor
+	// StreamEncryptors returns the encryptors of video streams with keys
+	// of their own, nil when they share the key
+	StreamEncryptors() *drm.EncryptorRegistry
+	Events() *drm.Bus
+
+	Epoch() uint64
+	Profile() DRMProfile
+	PendingProfile() (DRMProfile, bool)
+	ApplyProfile(profile DRMProfile) error
+	InitData(sessionID string) (DRMInitData, error)
+	ClearKeys(sessionID string, keyIDs [][]byte) ([]DRMClearKey, error)
+	Capabilities() (DRMCapabilities, error)
+	ClientInfo(sessionID string) (DRMInfo, error)
+	Info(sessionID string) (drm.DRMInfo, error)
+
+	// Exempt returns whether a session is sent the stream clear
+	Exempt(sessionID string) bool
+	// StreamChanged tells the client of a session that switched the video
+	// stream the DRM info of the new one
+	StreamChanged(session Session)
+
+	// session keys, the profile of a session names its own key ID
+	SessionProfile(sessionID string) DRMProfile
+	AcquireSession(sessionID string) (*drm.EncryptorSet, error)
+	ReleaseSession(sessionID string)
+
+	// SetWireVersion pins the frame header version a session negotiated,
+	// WireVersion returns it or the default
+	SetWireVersion(sessionID string, version int) error
+	WireVersion(sessionID string) int
+
+	Status() DRMStatus
+	// AcknowledgeKey records that the client of a session installed a key
+	AcknowledgeKey(sessionID, keyID string) bool
+	RotateKey(actor, keyID, key, iv string) (DRMKeyRotation, error)
+	// PushKey switches to key material pushed by a key orchestrator
+	PushKey(actor string, push drm.KeyPush) (drm.KeyPushResult, error)
+	ExportKey(actor, password string, publicKey *rsa.PublicKey) (DRMKeyExport, error)
+}
@@ -7,6 +7,7 @@ const (
 	SYSTEM_LOGS       = "system/logs"
 	SYSTEM_DISCONNECT = "system/disconnect"
 	SYSTEM_HEARTBEAT  = "system/heartbeat"
+	SYSTEM_DRM        = "system/drm"
 )
 
 const (
@@ -77,6 +78,15 @@ const (
 	BROADCAST_STATUS = "broadcast/status"
 )
 
+const (
+	DRM_UPDATED      = "drm/updated"
+	DRM_KEY_EXPORT   = "drm/key_export"
+	DRM_KEY_CHANGED  = "drm/keychanged"
+	DRM_KEY_ACK      = "drm/key_ack"
+	DRM_WIRE_VERSION = "drm/wire_version"
+	DRM_REQUEST      = "drm/request"
+)
+
 const (
 	SEND_UNICAST   = "send/unicast"
 	SEND_BROADCAST = "send/broadcast"
@@ -22,6 +22,10 @@ type MemberProfile struct {
 	SendsInactiveCursor   bool `json:"sends_inactive_cursor"    mapstructure:"sends_inactive_cursor"`
 	CanSeeInactiveCursors bool `json:"can_see_inactive_cursors" mapstructure:"can_see_inactive_cursors"`
 
+	// sent the stream clear by the builtin DRM engine, for clients that
+	// cannot decrypt it such as kiosks without a CDM
+	DRMExempt bool `json:"drm_exempt" mapstructure:"drm_exempt"`
+
 	// plugin scope
 	Plugins PluginSettings `json:"plugins"`
 }
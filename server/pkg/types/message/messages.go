@@ -1,6 +1,8 @@
 package message
 
 import (
+	"time"
+
 	"github.com/pion/webrtc/v3"
 
 	"github.com/m1k1o/neko/server/pkg/types"
@@ -23,6 +25,17 @@ type SystemInit struct {
 	TouchEvents       bool                   `json:"touch_events"`
 	ScreencastEnabled bool                   `json:"screencast_enabled"`
 	WebRTC            SystemWebRTC           `json:"webrtc"`
+	DRM               *SystemDRM             `json:"drm,omitempty"`
+}
+
+type SystemDRM struct {
+	Epoch   uint64           `json:"epoch"`
+	Codec   string           `json:"codec"`
+	Profile types.DRMProfile `json:"profile"`
+}
+
+type SystemDRMInfo struct {
+	types.DRMInfo
 }
 
 type SystemAdmin struct {
@@ -194,6 +207,40 @@ type BroadcastStatus struct {
 	URL      string `json:"url,omitempty"`
 }
 
+/////////////////////////////
+// DRM
+/////////////////////////////
+
+type DRMUpdated struct {
+	types.DRMUpdate
+}
+
+type DRMKeyChanged struct {
+	types.DRMKeyChange
+}
+
+// DRMKeyAck is sent by a client once its decryptor has a new key
+type DRMKeyAck struct {
+	KeyID string `json:"key_id"`
+}
+
+// DRMWireVersion is the frame header version a client picked of those in
+// the DRM info, the server answers with it once pinned
+type DRMWireVersion struct {
+	Version int `json:"version"`
+}
+
+type DRMKeyExport struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	KeyID   string    `json:"key_id,omitempty"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	// wrong passwords in a row and until when they lock the export
+	Failures    int        `json:"failures,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
 /////////////////////////////
 // Send (opaque comunication channel)
 /////////////////////////////